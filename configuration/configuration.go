@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,6 +28,18 @@ type Configuration struct {
 		AccessLog struct {
 			// Disabled disables access logging.
 			Disabled bool `yaml:"disabled,omitempty"`
+
+			// SlowThreshold, when set, restricts access logging to requests
+			// taking at least this long to complete.
+			SlowThreshold time.Duration `yaml:"slowthreshold,omitempty"`
+
+			// Format is the format of access log lines: "combined", the
+			// Combined Log Format and the default, "json" or "text".
+			Format string `yaml:"format,omitempty"`
+
+			// Output is where access log lines are written: "stdout", the
+			// default, "stderr", or the path of a file they are appended to.
+			Output string `yaml:"output,omitempty"`
 		} `yaml:"accesslog,omitempty"`
 
 		// Level is the granularity at which registry operations are logged.
@@ -40,9 +53,16 @@ type Configuration struct {
 		// the logger context.
 		Fields map[string]interface{} `yaml:"fields,omitempty"`
 
+		// RequestFields, when set, restricts the per-request fields added to
+		// log entries to those listed.
+		RequestFields []string `yaml:"requestfields,omitempty"`
+
 		// Hooks allows users to configure the log hooks, to enabling the
 		// sequent handling behavior, when defined levels of log message emit.
 		Hooks []LogHook `yaml:"hooks,omitempty"`
+
+		// Tracing configures the sampling of the requests traced.
+		Tracing LogTracing `yaml:"tracing,omitempty"`
 	}
 
 	// Loglevel is the level at which registry operations are logged.
@@ -89,6 +109,11 @@ type Configuration struct {
 		// receives a stop signal
 		DrainTimeout time.Duration `yaml:"draintimeout,omitempty"`
 
+		// RetryAfter is how long clients are asked to wait before retrying
+		// requests which are throttled or find the registry unavailable,
+		// unless the actual delay is known.
+		RetryAfter time.Duration `yaml:"retryafter,omitempty"`
+
 		// TLS instructs the http server to listen with a TLS configuration.
 		// This only support simple tls configuration with a cert and key.
 		// Mostly, this is useful for testing situations or simple deployments
@@ -108,6 +133,17 @@ type Configuration struct {
 			// A file may contain multiple CA certificates encoded as PEM
 			ClientCAs []string `yaml:"clientcas,omitempty"`
 
+			// ClientAuth is how client certificates are checked when
+			// ClientCAs are given: "require", the default, rejects
+			// connections without a valid certificate, while
+			// "verifyifgiven" only rejects connections with an invalid one.
+			ClientAuth string `yaml:"clientauth,omitempty"`
+
+			// ClientCertRoutes are the requests which must be made with a
+			// verified client certificate. They are authenticated by the
+			// certificate rather than by the access controller.
+			ClientCertRoutes []ClientCertRoute `yaml:"clientcertroutes,omitempty"`
+
 			// Specifies the lowest TLS version allowed
 			MinimumTLS string `yaml:"minimumtls,omitempty"`
 
@@ -138,6 +174,10 @@ type Configuration struct {
 		// the values are the associated header payloads.
 		Headers http.Header `yaml:"headers,omitempty"`
 
+		// Pages configures the responses to the requests outside of the API,
+		// such as those of browsers and load balancer probes.
+		Pages Pages `yaml:"pages,omitempty"`
+
 		// Debug configures the http debug interface, if specified. This can
 		// include services such as pprof, expvar and other data that should
 		// not be exposed externally. Left disabled by default.
@@ -149,14 +189,103 @@ type Configuration struct {
 				Enabled bool   `yaml:"enabled,omitempty"`
 				Path    string `yaml:"path,omitempty"`
 			} `yaml:"prometheus,omitempty"`
+			// StatsD configures sending the metrics exposed to
+			// Prometheus to a StatsD server as well.
+			StatsD struct {
+				Enabled bool `yaml:"enabled,omitempty"`
+				// Addr is the host:port of the server, over UDP,
+				// localhost:8125 if empty.
+				Addr string `yaml:"addr,omitempty"`
+				// Prefix starts the names of the metrics sent.
+				Prefix string `yaml:"prefix,omitempty"`
+				// Format is "statsd", the default, which appends the
+				// labels of the metrics to their names, or "dogstatsd",
+				// which sends them as tags.
+				Format string `yaml:"format,omitempty"`
+				// Tags are added to every metric sent, in the dogstatsd
+				// format.
+				Tags map[string]string `yaml:"tags,omitempty"`
+				// Interval is how often metrics are sent, 10s if zero.
+				Interval time.Duration `yaml:"interval,omitempty"`
+			} `yaml:"statsd,omitempty"`
+			// Info configures the /debug/info endpoint describing the
+			// running registry.
+			Info struct {
+				// Enabled serves the endpoint.
+				Enabled bool `yaml:"enabled,omitempty"`
+				// Storage adds the storage driver and the parameters
+				// identifying the storage it uses, never its
+				// credentials, to the endpoint.
+				Storage bool `yaml:"storage,omitempty"`
+			} `yaml:"info,omitempty"`
 		} `yaml:"debug,omitempty"`
 
+		// ManifestBuffer configures how pushed manifests are buffered before
+		// they are validated.
+		ManifestBuffer struct {
+			// MaxMemory is the size above which a pushed manifest is
+			// buffered to a temporary file rather than in memory. It
+			// defaults to 1MiB.
+			MaxMemory int64 `yaml:"maxmemory,omitempty"`
+			// Dir is the directory temporary files are created in. It
+			// defaults to the system temporary directory.
+			Dir string `yaml:"dir,omitempty"`
+		} `yaml:"manifestbuffer,omitempty"`
+
 		// HTTP2 configuration options
 		HTTP2 struct {
 			// Specifies whether the registry should disallow clients attempting
 			// to connect via http2. If set to true, only http/1.1 is supported.
 			Disabled bool `yaml:"disabled,omitempty"`
+
+			// MaxConcurrentStreams is the number of concurrent streams each
+			// client may open on a connection. It defaults to 250.
+			MaxConcurrentStreams uint32 `yaml:"maxconcurrentstreams,omitempty"`
+
+			// InitialConnWindowSize is the initial flow control window of
+			// connections, in bytes. It defaults to 1MiB.
+			InitialConnWindowSize int32 `yaml:"initialconnwindowsize,omitempty"`
+
+			// InitialStreamWindowSize is the initial flow control window of
+			// each stream, in bytes. It defaults to 1MiB.
+			InitialStreamWindowSize int32 `yaml:"initialstreamwindowsize,omitempty"`
 		} `yaml:"http2,omitempty"`
+
+		// KeepAlive configures HTTP keep-alives.
+		KeepAlive struct {
+			// Disabled closes connections after each request, rather than
+			// reusing them for subsequent requests.
+			Disabled bool `yaml:"disabled,omitempty"`
+		} `yaml:"keepalive,omitempty"`
+
+		// Connections configures limits applying to each client connection.
+		Connections struct {
+			// MaxRequests is the number of requests each connection may
+			// have in flight, such as the streams of an HTTP/2 connection.
+			// Requests beyond it are answered with 429 Too Many Requests.
+			// Requests are not limited if it is zero.
+			MaxRequests int `yaml:"maxrequests,omitempty"`
+		} `yaml:"connections,omitempty"`
+
+		// Compression configures the compression of manifest responses.
+		Compression struct {
+			// Enabled compresses manifests with gzip for clients accepting
+			// it, such as registries proxying this one.
+			Enabled bool `yaml:"enabled,omitempty"`
+
+			// MinSize is the size in bytes of the smallest manifest
+			// compressed. Smaller manifests are sent uncompressed.
+			MinSize int `yaml:"minsize,omitempty"`
+		} `yaml:"compression,omitempty"`
+
+		// StorageBudget limits the storage operations of each request.
+		StorageBudget struct {
+			// Operations is the number of storage driver calls a request
+			// may make, counting each path walked, past which it is
+			// aborted with a 503 Service Unavailable. There is no limit
+			// when zero.
+			Operations int `yaml:"operations,omitempty"`
+		} `yaml:"storagebudget,omitempty"`
 	} `yaml:"http,omitempty"`
 
 	// Notifications specifies configuration about various endpoint to which
@@ -212,6 +341,66 @@ type Configuration struct {
 			// Enabled determines if schema1 manifests should be pullable
 			Enabled bool `yaml:"enabled,omitempty"`
 		} `yaml:"schema1,omitempty"`
+		// ManifestList configures how manifest lists will be handled
+		ManifestList struct {
+			// HeadSize configures reporting, on HEAD of a manifest list, the
+			// size of the image for a default platform in a custom header
+			HeadSize struct {
+				// Enabled determines if the size header is added to HEAD
+				// responses for manifest lists
+				Enabled bool `yaml:"enabled,omitempty"`
+				// Architecture is the architecture of the platform whose
+				// size is reported. Defaults to amd64.
+				Architecture string `yaml:"architecture,omitempty"`
+				// OS is the operating system of the platform whose size
+				// is reported. Defaults to linux.
+				OS string `yaml:"os,omitempty"`
+				// Variant optionally restricts the platform to a CPU
+				// variant, such as v8 for arm64.
+				Variant string `yaml:"variant,omitempty"`
+				// Mode selects what is reported: "manifest" (the default)
+				// reports the size of the platform's manifest, "layers"
+				// reports the sum of the platform's layer sizes.
+				Mode string `yaml:"mode,omitempty"`
+			} `yaml:"headsize,omitempty"`
+		} `yaml:"manifestlist,omitempty"`
+		// Negotiation configures the manifest returned for requests whose
+		// accept header names no manifest media type
+		Negotiation struct {
+			// MediaTypes lists the manifest media types to return in order
+			// of preference. The stored manifest is returned as it is if it
+			// cannot be returned as any of them, or if the list is empty.
+			MediaTypes []string `yaml:"mediatypes,omitempty"`
+		} `yaml:"negotiation,omitempty"`
+		// Untyped configures the handling of stored manifests lacking a
+		// media type, such as those of older imports
+		Untyped struct {
+			// FallbackMediaType is the media type of the untyped manifests
+			// which cannot be classified by their content. Defaults to
+			// the OCI image manifest media type.
+			FallbackMediaType string `yaml:"fallbackmediatype,omitempty"`
+		} `yaml:"untyped,omitempty"`
+		// Normalize configures storing pushed docker manifests as their
+		// OCI equivalents, which changes their digests
+		Normalize struct {
+			// Repositories are regular expressions matching the full names
+			// of the repositories whose pushed schema2 manifests and
+			// manifest lists are converted to OCI ones.
+			Repositories []string `yaml:"repositories,omitempty"`
+			// OriginalDigest is how pulls by the digest a converted
+			// manifest was pushed with are answered: "fail", the default,
+			// or "redirect" to the converted manifest.
+			OriginalDigest string `yaml:"originaldigest,omitempty"`
+		} `yaml:"normalize,omitempty"`
+		// UnknownManifest configures the responses to requests for the
+		// manifests which are not found
+		UnknownManifest struct {
+			// DistinguishRepository answers the requests for the manifests
+			// of repositories without content with a NAME_UNKNOWN error
+			// rather than MANIFEST_UNKNOWN, and names the error code in a
+			// header so that HEAD requests tell them apart.
+			DistinguishRepository bool `yaml:"distinguishrepository,omitempty"`
+		} `yaml:"unknownmanifest,omitempty"`
 	} `yaml:"compatibility,omitempty"`
 
 	// Validation configures validation options for the registry.
@@ -232,7 +421,47 @@ type Configuration struct {
 				// that URLs in pushed manifests must not match.
 				Deny []string `yaml:"deny,omitempty"`
 			} `yaml:"urls,omitempty"`
+			// AllowedLayerMediaTypes specifies the media types layers in
+			// pushed manifests may have. When empty, layers of any media
+			// type are allowed.
+			AllowedLayerMediaTypes []string `yaml:"allowedlayermediatypes,omitempty"`
+
+			// AllowedArtifactLayerMediaTypes specifies the media types
+			// layers of artifact manifests may have, other than the image
+			// layers allowed by AllowedLayerMediaTypes. Any are allowed if
+			// empty.
+			AllowedArtifactLayerMediaTypes []string `yaml:"allowedartifactlayermediatypes,omitempty"`
+
+			// MaxConcurrentChecks limits the checks that the blobs
+			// referenced by pushed manifests exist run at once across
+			// the registry, queuing the others. There is no limit when
+			// zero.
+			MaxConcurrentChecks int `yaml:"maxconcurrentchecks,omitempty"`
+
+			// MaxManifestListDescriptors is the number of manifests
+			// pushed manifest lists and image indexes may reference.
+			// There is no limit when zero.
+			MaxManifestListDescriptors int `yaml:"maxmanifestlistdescriptors,omitempty"`
+
+			// Platform configures checking that the configs of pushed
+			// image manifests are for the platforms they are declared
+			// for, by manifest lists referencing them or on push.
+			Platform struct {
+				// Enabled enables the checks.
+				Enabled bool `yaml:"enabled,omitempty"`
+				// MaxConfigSize is the size in bytes of the largest
+				// config read for a check, 1 MiB if zero. Manifests
+				// with larger configs are rejected.
+				MaxConfigSize int64 `yaml:"maxconfigsize,omitempty"`
+			} `yaml:"platform,omitempty"`
 		} `yaml:"manifests,omitempty"`
+		// Tags configures the validation of the tags of requests.
+		Tags struct {
+			// MaxLength is the number of characters of the longest tag
+			// accepted, which may not exceed the 128 characters of the
+			// reference grammar, the limit when zero.
+			MaxLength int `yaml:"maxlength,omitempty"`
+		} `yaml:"tags,omitempty"`
 	} `yaml:"validation,omitempty"`
 
 	// Policy configures registry policy options.
@@ -246,7 +475,131 @@ type Configuration struct {
 			// the class in authorized resources.
 			Classes []string `yaml:"classes"`
 		} `yaml:"repository,omitempty"`
+
+		// AutoCreateRepositories creates repositories on their first push.
+		// When false, pushes to repositories which do not exist are
+		// denied until they are created through the repository endpoint.
+		// It defaults to true.
+		AutoCreateRepositories *bool `yaml:"autocreaterepositories,omitempty"`
+
+		// MaxTagsPerRepository caps the number of tags of each repository.
+		// Pushing a new tag to a repository at the limit is denied, while
+		// existing tags may still be overwritten. There is no limit when
+		// zero.
+		MaxTagsPerRepository int `yaml:"maxtagsperrepository,omitempty"`
+
+		// MaxManifestListDepth is the number of levels manifest lists may
+		// be nested within one another when the registry walks them, to
+		// export, import, filter or garbage collect them. It defaults to 8
+		// when zero.
+		MaxManifestListDepth int `yaml:"maxmanifestlistdepth,omitempty"`
+
+		// Admission configures a webhook called before a manifest push is
+		// accepted, which may deny it.
+		Admission struct {
+			// URL is the address of the admission webhook. Pushes are not
+			// sent for admission when empty.
+			URL string `yaml:"url,omitempty"`
+			// Headers are added to requests to the webhook.
+			Headers http.Header `yaml:"headers,omitempty"`
+			// Timeout bounds the time waited for the webhook to respond.
+			// It defaults to 5 seconds.
+			Timeout time.Duration `yaml:"timeout,omitempty"`
+			// FailOpen accepts pushes when the webhook cannot be reached
+			// or fails. By default, such pushes are rejected.
+			FailOpen bool `yaml:"failopen,omitempty"`
+		} `yaml:"admission,omitempty"`
+
+		// Quota caps the storage used by repositories.
+		Quota struct {
+			// Repositories lists the quotas of repositories.
+			Repositories []RepositoryQuota `yaml:"repositories,omitempty"`
+			// ReconcileInterval is the interval at which the usage of
+			// repositories is recomputed from their manifests. It
+			// defaults to 1 hour.
+			ReconcileInterval time.Duration `yaml:"reconcileinterval,omitempty"`
+		} `yaml:"quota,omitempty"`
+
+		// Referrers configures the referrers required of pushed manifests.
+		Referrers struct {
+			// Required lists the referrers required of the manifests
+			// pushed to repositories, which are not served until theirs
+			// is pushed. A repository is subject to the first
+			// requirement matching it.
+			Required []RequiredReferrer `yaml:"required,omitempty"`
+		} `yaml:"referrers,omitempty"`
+
+		// Retention configures the tags deleted by the prune-tags command.
+		Retention struct {
+			// Rules lists the retention rules. A tag is subject to the
+			// first rule matching its repository and itself.
+			Rules []RetentionRule `yaml:"rules,omitempty"`
+		} `yaml:"retention,omitempty"`
 	} `yaml:"policy,omitempty"`
+
+	// Search configures the indexes maintained to search for manifests.
+	Search struct {
+		// Annotations configures the index of manifest annotations.
+		Annotations struct {
+			// Keys lists the annotation keys pushed manifests are indexed
+			// by, at most 16. Manifests are not indexed when empty.
+			Keys []string `yaml:"keys,omitempty"`
+		} `yaml:"annotations,omitempty"`
+	} `yaml:"search,omitempty"`
+}
+
+// RepositoryQuota caps the storage used by a repository, or by each of the
+// repositories of a namespace.
+type RepositoryQuota struct {
+	// Name is the name of a repository or, when it ends with a slash, a
+	// namespace prefix. A repository has the quota whose name is its own
+	// or the longest prefix of it.
+	Name string `yaml:"name"`
+	// Limit is the number of bytes of unique blobs which the manifests of
+	// the repository may reference.
+	Limit int64 `yaml:"limit"`
+}
+
+// RetentionRule selects the tags of repositories to keep. The tags matched by
+// a rule which satisfy none of its conditions are deleted.
+type RetentionRule struct {
+	// Repository is the name of a repository or, when it ends with a slash,
+	// a namespace prefix. An empty name matches every repository.
+	Repository string `yaml:"repository,omitempty"`
+	// Tags is a regular expression matched against whole tags. An empty
+	// expression matches every tag.
+	Tags string `yaml:"tags,omitempty"`
+	// KeepLast keeps the given number of most recently pushed tags.
+	KeepLast int `yaml:"keeplast,omitempty"`
+	// KeepNewerThan keeps the tags pushed within the given duration.
+	KeepNewerThan time.Duration `yaml:"keepnewerthan,omitempty"`
+}
+
+// RequiredReferrer requires the manifests pushed to repositories to be
+// referred to by a manifest of an artifact type, such as a signature, before
+// they are served.
+type RequiredReferrer struct {
+	// Repository is the name of a repository or, when it ends with a slash,
+	// a namespace prefix. An empty name matches every repository.
+	Repository string `yaml:"repository,omitempty"`
+	// ArtifactType is the artifact type of the referrer required.
+	ArtifactType string `yaml:"artifacttype"`
+	// GracePeriod is the time after the push of a manifest within which its
+	// referrer must be pushed. There is no limit when zero.
+	GracePeriod time.Duration `yaml:"graceperiod,omitempty"`
+}
+
+// LogTracing configures which requests have the operations serving them
+// traced, in log entries at the debug level.
+type LogTracing struct {
+	// SamplingRate is the fraction of requests traced, between 0 and 1.
+	// Requests carrying a W3C traceparent header are traced if it is
+	// sampled, whatever the rate. Every request is traced if unset.
+	SamplingRate *float64 `yaml:"samplingrate,omitempty"`
+
+	// TraceID adds the trace id of the requests traced to their log
+	// entries, as the "trace.id" field.
+	TraceID bool `yaml:"traceid,omitempty"`
 }
 
 // LogHook is composed of hook Level and Type.
@@ -427,6 +780,12 @@ func (storage Storage) Type() string {
 			// allow configuration of delete
 		case "redirect":
 			// allow configuration of redirect
+		case "uploads":
+			// allow configuration of uploads
+		case "layout":
+			// allow configuration of the storage layout
+		case "tagwrites":
+			// allow configuration of tag writes
 		default:
 			storageType = append(storageType, k)
 		}
@@ -445,6 +804,27 @@ func (storage Storage) Parameters() Parameters {
 	return storage[storage.Type()]
 }
 
+// LayoutVersion returns the version of the storage layout, from the
+// "version" parameter of the layout section. It is 0 if not configured.
+func (storage Storage) LayoutVersion() (int, error) {
+	param, ok := storage["layout"]["version"]
+	if !ok {
+		return 0, nil
+	}
+	switch v := param.(type) {
+	case int:
+		return v, nil
+	case string:
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid storage layout version %q: %v", v, err)
+		}
+		return version, nil
+	default:
+		return 0, fmt.Errorf("invalid storage layout version %v: not a number", param)
+	}
+}
+
 // setParameter changes the parameter at the provided key to the new value
 func (storage Storage) setParameter(key string, value interface{}) {
 	storage[storage.Type()][key] = value
@@ -468,6 +848,12 @@ func (storage *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 					// allow configuration of delete
 				case "redirect":
 					// allow configuration of redirect
+				case "uploads":
+					// allow configuration of uploads
+				case "layout":
+					// allow configuration of the storage layout
+				case "tagwrites":
+					// allow configuration of tag writes
 				default:
 					types = append(types, k)
 				}
@@ -560,6 +946,56 @@ func (auth Auth) MarshalYAML() (interface{}, error) {
 	return map[string]Parameters(auth), nil
 }
 
+// ClientCertRoute selects requests which must be made with a verified client
+// certificate.
+type ClientCertRoute struct {
+	// Repositories is a regular expression matching the names of the
+	// repositories the route applies to in full.
+	Repositories string `yaml:"repositories"`
+
+	// Methods are the HTTP methods the route applies to, every method if
+	// empty.
+	Methods []string `yaml:"methods,omitempty"`
+}
+
+// Pages configures the responses to the requests outside of the API.
+type Pages struct {
+	// Root is the response to GET and HEAD requests for /. It is an empty
+	// 200 OK unless set.
+	Root Page `yaml:"root,omitempty"`
+
+	// NotFound is the response to the requests matching no route, outside
+	// of /v2/. It is a plain text 404 Not Found unless set.
+	NotFound Page `yaml:"notfound,omitempty"`
+}
+
+// Page is a response to requests outside of the API. At most one of
+// Redirect, Body and Problem may be set.
+type Page struct {
+	// Redirect redirects the requests to this URL, with a 302 Found.
+	Redirect string `yaml:"redirect,omitempty"`
+
+	// Body is the content served, of ContentType, text/plain unless set.
+	Body        string `yaml:"body,omitempty"`
+	ContentType string `yaml:"contenttype,omitempty"`
+
+	// Problem serves an RFC 7807 problem details object, as
+	// application/problem+json.
+	Problem *Problem `yaml:"problem,omitempty"`
+}
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	// Type is a URI identifying the problem, about:blank unless set.
+	Type string `yaml:"type,omitempty"`
+
+	// Title summarizes the problem, the text of the status unless set.
+	Title string `yaml:"title,omitempty"`
+
+	// Detail explains the problem.
+	Detail string `yaml:"detail,omitempty"`
+}
+
 // Notifications configures multiple http endpoints.
 type Notifications struct {
 	// EventConfig is the configuration for the event format that is sent to each Endpoint.
@@ -573,20 +1009,68 @@ type Notifications struct {
 // Endpoint describes the configuration of an http webhook notification
 // endpoint.
 type Endpoint struct {
-	Name              string        `yaml:"name"`              // identifies the endpoint in the registry instance.
-	Disabled          bool          `yaml:"disabled"`          // disables the endpoint
-	URL               string        `yaml:"url"`               // post url for the endpoint.
-	Headers           http.Header   `yaml:"headers"`           // static headers that should be added to all requests
-	Timeout           time.Duration `yaml:"timeout"`           // HTTP timeout
-	Threshold         int           `yaml:"threshold"`         // circuit breaker threshold before backing off on failure
-	Backoff           time.Duration `yaml:"backoff"`           // backoff duration
-	IgnoredMediaTypes []string      `yaml:"ignoredmediatypes"` // target media types to ignore
-	Ignore            Ignore        `yaml:"ignore"`            // ignore event types
+	Name              string         `yaml:"name"`                   // identifies the endpoint in the registry instance.
+	Disabled          bool           `yaml:"disabled"`               // disables the endpoint
+	URL               string         `yaml:"url"`                    // post url for the endpoint.
+	Headers           http.Header    `yaml:"headers"`                // static headers that should be added to all requests
+	Timeout           time.Duration  `yaml:"timeout"`                // HTTP timeout
+	Threshold         int            `yaml:"threshold"`              // circuit breaker threshold before backing off on failure
+	Backoff           time.Duration  `yaml:"backoff"`                // backoff duration
+	IgnoredMediaTypes []string       `yaml:"ignoredmediatypes"`      // target media types to ignore
+	Ignore            Ignore         `yaml:"ignore"`                 // ignore event types
+	QueueSize         int            `yaml:"queuesize"`              // maximum number of queued events, unbounded if zero
+	Workers           int            `yaml:"workers"`                // number of concurrent deliveries from a bounded queue
+	Overflow          string         `yaml:"overflow"`               // "block" or "drop" events when the bounded queue is full
+	BlockTimeout      time.Duration  `yaml:"blocktimeout"`           // maximum time to block on a full queue
+	Health            EndpointHealth `yaml:"health,omitempty"`       // health check probing the endpoint
+	AWS               EndpointAWS    `yaml:"aws,omitempty"`          // sns topic or sqs queue to deliver to rather than url
+	Repositories      []string       `yaml:"repositories,omitempty"` // patterns of the repositories whose events are delivered, all if empty
+}
+
+// EndpointAWS configures a notification endpoint delivering events to an AWS
+// SNS topic or SQS queue.
+type EndpointAWS struct {
+	// ARN names the SNS topic or SQS queue events are delivered to. The
+	// endpoint delivers events to its URL if empty.
+	ARN string `yaml:"arn,omitempty"`
+	// Region is the region of the topic or queue, that of its ARN if empty.
+	Region string `yaml:"region,omitempty"`
+	// RegionEndpoint overrides the endpoint of the service, such as for a
+	// local emulator.
+	RegionEndpoint string `yaml:"regionendpoint,omitempty"`
+	// AccessKey and SecretKey, with an optional SessionToken, are static
+	// credentials. The default AWS credential chain is used without them:
+	// the environment, shared credentials and instance roles.
+	AccessKey    string `yaml:"accesskey,omitempty"`
+	SecretKey    string `yaml:"secretkey,omitempty"`
+	SessionToken string `yaml:"sessiontoken,omitempty"`
+}
+
+// EndpointHealth configures a health check probing that a notification
+// endpoint is reachable.
+type EndpointHealth struct {
+	// Enabled turns on the health check.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Interval is the duration in between probes.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Threshold is the number of times a probe must fail to trigger an
+	// unhealthy state.
+	Threshold int `yaml:"threshold,omitempty"`
+	// Method is the HTTP method of the probes, HEAD or OPTIONS. It is HEAD
+	// if empty.
+	Method string `yaml:"method,omitempty"`
+	// Path is the path probed, resolved against the URL of the endpoint,
+	// which is probed if empty.
+	Path string `yaml:"path,omitempty"`
+	// Critical makes the health of the registry depend on the endpoint
+	// being reachable. Otherwise, its status is only reported.
+	Critical bool `yaml:"critical,omitempty"`
 }
 
 // Events configures notification events.
 type Events struct {
-	IncludeReferences bool `yaml:"includereferences"` // include reference data in manifest events
+	IncludeReferences bool              `yaml:"includereferences"`  // include reference data in manifest events
+	Metadata          map[string]string `yaml:"metadata,omitempty"` // static fields added to the source of every event
 }
 
 //Ignore configures mediaTypes and actions of the event, that it won't be propagated
@@ -644,6 +1128,94 @@ type Proxy struct {
 
 	// Password of the hub user
 	Password string `yaml:"password"`
+
+	// Mirrors lists upstream registries to pull from in place of RemoteURL,
+	// in order of priority. Content missing from the cache is pulled from
+	// the first mirror which does not fail with a rate limit, a server error
+	// or a timeout.
+	Mirrors []ProxyMirror `yaml:"mirrors,omitempty"`
+
+	// Strategy is the order mirrors are tried in. With "priority", the
+	// default, every pull starts with the first mirror. With "roundrobin",
+	// pulls start with each mirror in turn.
+	Strategy string `yaml:"strategy,omitempty"`
+
+	// Repositories, if set, are regular expressions matching the names of
+	// the only repositories pulled through the cache. Pulls of other
+	// repositories are answered as unknown without contacting the upstream.
+	Repositories []string `yaml:"repositories,omitempty"`
+
+	// Cache bounds the age of the manifests and the size of the blobs
+	// cached.
+	Cache ProxyCache `yaml:"cache,omitempty"`
+
+	// ContentLength is how blobs whose length differs from the
+	// Content-Length advertised by the upstream are handled. With
+	// "enforce", the default, they are rejected. With "ignore", they are
+	// cached if their content matches their digest.
+	ContentLength string `yaml:"contentlength,omitempty"`
+}
+
+// ProxyCache bounds the content of a pull through cache.
+type ProxyCache struct {
+	// MaxAge is how long pulled manifests are cached before being pulled
+	// from the upstream again. Zero means the default of 90 days.
+	MaxAge time.Duration `yaml:"maxage,omitempty"`
+
+	// MaxSize is the budget, in bytes, of the blobs cached. Once exceeded,
+	// the least recently accessed blobs are evicted. Zero means no budget.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+
+	// Protect is how long the blobs referenced by a manifest pulled are
+	// protected from eviction. Zero means the default of an hour.
+	Protect time.Duration `yaml:"protect,omitempty"`
+
+	// Policies decide how the manifests pulled are cached, by their media
+	// types and the tags they are pulled by. The first policy matching a
+	// manifest applies. Blobs, being content addressed, are cached
+	// whatever the policies.
+	Policies []ProxyCachePolicy `yaml:"policies,omitempty"`
+}
+
+// ProxyCachePolicy decides how the manifests it matches are cached by a pull
+// through cache. Manifests matching no policy are cached for MaxAge, and
+// their tags resolved with the upstream on every pull.
+type ProxyCachePolicy struct {
+	// MediaTypes, if set, are the media types of the manifests the policy
+	// applies to.
+	MediaTypes []string `yaml:"mediatypes,omitempty"`
+
+	// Tags, if set, are regular expressions matching the tags the policy
+	// applies to the manifests pulled by. Such a policy does not apply to
+	// manifests pulled by digest.
+	Tags []string `yaml:"tags,omitempty"`
+
+	// TTL is how long the manifests matching the policy are cached, and the
+	// tags pulling them are served from the cache without being resolved
+	// with the upstream. Zero means the manifests are cached for MaxAge and
+	// their tags resolved on every pull.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+
+	// NoCache passes the manifests matching the policy, and the tags pulling
+	// them, through without caching them.
+	NoCache bool `yaml:"nocache,omitempty"`
+}
+
+// ProxyMirror is an upstream registry of a pull through cache.
+type ProxyMirror struct {
+	// RemoteURL is the URL of the mirror
+	RemoteURL string `yaml:"remoteurl"`
+
+	// Username of the mirror user
+	Username string `yaml:"username,omitempty"`
+
+	// Password of the mirror user
+	Password string `yaml:"password,omitempty"`
+
+	// Timeout bounds the wait for a connection to the mirror and for it to
+	// respond to a request, after which the next mirror is tried. Zero means
+	// no timeout.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
 }
 
 // Parse parses an input configuration yaml document into a Configuration struct
@@ -678,6 +1250,17 @@ func Parse(rd io.Reader) (*Configuration, error) {
 					if v0_1.Storage.Type() == "" {
 						return nil, errors.New("no storage configuration provided")
 					}
+					if v0_1.Log.AccessLog.SlowThreshold < 0 {
+						return nil, fmt.Errorf("invalid log.accesslog.slowthreshold %v: must not be negative", v0_1.Log.AccessLog.SlowThreshold)
+					}
+					if v0_1.Policy.MaxManifestListDepth < 0 {
+						return nil, fmt.Errorf("invalid policy.maxmanifestlistdepth %d: must not be negative", v0_1.Policy.MaxManifestListDepth)
+					}
+					switch v0_1.Log.AccessLog.Format {
+					case "", "combined", "json", "text":
+					default:
+						return nil, fmt.Errorf("invalid log.accesslog.format %q: must be combined, json or text", v0_1.Log.AccessLog.Format)
+					}
 					return (*Configuration)(v0_1), nil
 				}
 				return nil, fmt.Errorf("expected *v0_1Configuration, received %#v", c)
@@ -21,12 +21,17 @@ var configStruct = Configuration{
 	Version: "0.1",
 	Log: struct {
 		AccessLog struct {
-			Disabled bool `yaml:"disabled,omitempty"`
+			Disabled      bool          `yaml:"disabled,omitempty"`
+			SlowThreshold time.Duration `yaml:"slowthreshold,omitempty"`
+			Format        string        `yaml:"format,omitempty"`
+			Output        string        `yaml:"output,omitempty"`
 		} `yaml:"accesslog,omitempty"`
-		Level     Loglevel               `yaml:"level,omitempty"`
-		Formatter string                 `yaml:"formatter,omitempty"`
-		Fields    map[string]interface{} `yaml:"fields,omitempty"`
-		Hooks     []LogHook              `yaml:"hooks,omitempty"`
+		Level         Loglevel               `yaml:"level,omitempty"`
+		Formatter     string                 `yaml:"formatter,omitempty"`
+		Fields        map[string]interface{} `yaml:"fields,omitempty"`
+		RequestFields []string               `yaml:"requestfields,omitempty"`
+		Hooks         []LogHook              `yaml:"hooks,omitempty"`
+		Tracing       LogTracing             `yaml:"tracing,omitempty"`
 	}{
 		Level:  "info",
 		Fields: map[string]interface{}{"environment": "test"},
@@ -79,37 +84,75 @@ var configStruct = Configuration{
 		Secret       string        `yaml:"secret,omitempty"`
 		RelativeURLs bool          `yaml:"relativeurls,omitempty"`
 		DrainTimeout time.Duration `yaml:"draintimeout,omitempty"`
+		RetryAfter   time.Duration `yaml:"retryafter,omitempty"`
 		TLS          struct {
-			Certificate  string   `yaml:"certificate,omitempty"`
-			Key          string   `yaml:"key,omitempty"`
-			ClientCAs    []string `yaml:"clientcas,omitempty"`
-			MinimumTLS   string   `yaml:"minimumtls,omitempty"`
-			CipherSuites []string `yaml:"ciphersuites,omitempty"`
-			LetsEncrypt  struct {
+			Certificate      string            `yaml:"certificate,omitempty"`
+			Key              string            `yaml:"key,omitempty"`
+			ClientCAs        []string          `yaml:"clientcas,omitempty"`
+			ClientAuth       string            `yaml:"clientauth,omitempty"`
+			ClientCertRoutes []ClientCertRoute `yaml:"clientcertroutes,omitempty"`
+			MinimumTLS       string            `yaml:"minimumtls,omitempty"`
+			CipherSuites     []string          `yaml:"ciphersuites,omitempty"`
+			LetsEncrypt      struct {
 				CacheFile string   `yaml:"cachefile,omitempty"`
 				Email     string   `yaml:"email,omitempty"`
 				Hosts     []string `yaml:"hosts,omitempty"`
 			} `yaml:"letsencrypt,omitempty"`
 		} `yaml:"tls,omitempty"`
 		Headers http.Header `yaml:"headers,omitempty"`
+		Pages   Pages       `yaml:"pages,omitempty"`
 		Debug   struct {
 			Addr       string `yaml:"addr,omitempty"`
 			Prometheus struct {
 				Enabled bool   `yaml:"enabled,omitempty"`
 				Path    string `yaml:"path,omitempty"`
 			} `yaml:"prometheus,omitempty"`
+			StatsD struct {
+				Enabled  bool              `yaml:"enabled,omitempty"`
+				Addr     string            `yaml:"addr,omitempty"`
+				Prefix   string            `yaml:"prefix,omitempty"`
+				Format   string            `yaml:"format,omitempty"`
+				Tags     map[string]string `yaml:"tags,omitempty"`
+				Interval time.Duration     `yaml:"interval,omitempty"`
+			} `yaml:"statsd,omitempty"`
+			Info struct {
+				Enabled bool `yaml:"enabled,omitempty"`
+				Storage bool `yaml:"storage,omitempty"`
+			} `yaml:"info,omitempty"`
 		} `yaml:"debug,omitempty"`
+		ManifestBuffer struct {
+			MaxMemory int64  `yaml:"maxmemory,omitempty"`
+			Dir       string `yaml:"dir,omitempty"`
+		} `yaml:"manifestbuffer,omitempty"`
 		HTTP2 struct {
-			Disabled bool `yaml:"disabled,omitempty"`
+			Disabled                bool   `yaml:"disabled,omitempty"`
+			MaxConcurrentStreams    uint32 `yaml:"maxconcurrentstreams,omitempty"`
+			InitialConnWindowSize   int32  `yaml:"initialconnwindowsize,omitempty"`
+			InitialStreamWindowSize int32  `yaml:"initialstreamwindowsize,omitempty"`
 		} `yaml:"http2,omitempty"`
+		KeepAlive struct {
+			Disabled bool `yaml:"disabled,omitempty"`
+		} `yaml:"keepalive,omitempty"`
+		Connections struct {
+			MaxRequests int `yaml:"maxrequests,omitempty"`
+		} `yaml:"connections,omitempty"`
+		Compression struct {
+			Enabled bool `yaml:"enabled,omitempty"`
+			MinSize int  `yaml:"minsize,omitempty"`
+		} `yaml:"compression,omitempty"`
+		StorageBudget struct {
+			Operations int `yaml:"operations,omitempty"`
+		} `yaml:"storagebudget,omitempty"`
 	}{
 		TLS: struct {
-			Certificate  string   `yaml:"certificate,omitempty"`
-			Key          string   `yaml:"key,omitempty"`
-			ClientCAs    []string `yaml:"clientcas,omitempty"`
-			MinimumTLS   string   `yaml:"minimumtls,omitempty"`
-			CipherSuites []string `yaml:"ciphersuites,omitempty"`
-			LetsEncrypt  struct {
+			Certificate      string            `yaml:"certificate,omitempty"`
+			Key              string            `yaml:"key,omitempty"`
+			ClientCAs        []string          `yaml:"clientcas,omitempty"`
+			ClientAuth       string            `yaml:"clientauth,omitempty"`
+			ClientCertRoutes []ClientCertRoute `yaml:"clientcertroutes,omitempty"`
+			MinimumTLS       string            `yaml:"minimumtls,omitempty"`
+			CipherSuites     []string          `yaml:"ciphersuites,omitempty"`
+			LetsEncrypt      struct {
 				CacheFile string   `yaml:"cachefile,omitempty"`
 				Email     string   `yaml:"email,omitempty"`
 				Hosts     []string `yaml:"hosts,omitempty"`
@@ -121,7 +164,10 @@ var configStruct = Configuration{
 			"X-Content-Type-Options": []string{"nosniff"},
 		},
 		HTTP2: struct {
-			Disabled bool `yaml:"disabled,omitempty"`
+			Disabled                bool   `yaml:"disabled,omitempty"`
+			MaxConcurrentStreams    uint32 `yaml:"maxconcurrentstreams,omitempty"`
+			InitialConnWindowSize   int32  `yaml:"initialconnwindowsize,omitempty"`
+			InitialStreamWindowSize int32  `yaml:"initialstreamwindowsize,omitempty"`
 		}{
 			Disabled: false,
 		},
@@ -365,6 +411,35 @@ func (suite *ConfigSuite) TestParseInvalidLoglevel(c *C) {
 
 }
 
+// TestParseInvalidAccessLogFormat validates that the parser will fail to parse
+// a configuration with an unknown access log format
+func (suite *ConfigSuite) TestParseInvalidAccessLogFormat(c *C) {
+	invalidConfigYaml := "version: 0.1\nlog:\n  accesslog:\n    format: xml\nstorage: inmemory"
+	_, err := Parse(bytes.NewReader([]byte(invalidConfigYaml)))
+	c.Assert(err, NotNil)
+}
+
+// TestParseInvalidSlowThreshold validates that the parser will fail to parse a
+// configuration with a negative access log slow threshold
+func (suite *ConfigSuite) TestParseInvalidSlowThreshold(c *C) {
+	invalidConfigYaml := "version: 0.1\nlog:\n  accesslog:\n    slowthreshold: -1s\nstorage: inmemory"
+	_, err := Parse(bytes.NewReader([]byte(invalidConfigYaml)))
+	c.Assert(err, NotNil)
+
+	os.Setenv("REGISTRY_LOG_ACCESSLOG_SLOWTHRESHOLD", "-1s")
+
+	_, err = Parse(bytes.NewReader([]byte(configYamlV0_1)))
+	c.Assert(err, NotNil)
+}
+
+// TestParseInvalidMaxManifestListDepth validates that the parser will fail to
+// parse a configuration with a negative maximum manifest list depth
+func (suite *ConfigSuite) TestParseInvalidMaxManifestListDepth(c *C) {
+	invalidConfigYaml := "version: 0.1\npolicy:\n  maxmanifestlistdepth: -1\nstorage: inmemory"
+	_, err := Parse(bytes.NewReader([]byte(invalidConfigYaml)))
+	c.Assert(err, NotNil)
+}
+
 // TestParseWithDifferentEnvReporting validates that environment variables
 // properly override reporting parameters
 func (suite *ConfigSuite) TestParseWithDifferentEnvReporting(c *C) {
@@ -412,6 +487,69 @@ func (suite *ConfigSuite) TestParseExtraneousVars(c *C) {
 	c.Assert(config, DeepEquals, suite.expectedConfig)
 }
 
+// TestParseEnvNestedString validates that a nested string parameter, such
+// as a storage driver secret, can be overridden from the environment.
+func (suite *ConfigSuite) TestParseEnvNestedString(c *C) {
+	suite.expectedConfig.Storage.setParameter("secretkey", "ENVSECRET")
+
+	os.Setenv("REGISTRY_STORAGE_S3_SECRETKEY", "ENVSECRET")
+
+	config, err := Parse(bytes.NewReader([]byte(configYamlV0_1)))
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, suite.expectedConfig)
+}
+
+// TestParseEnvMixedCaseKey validates that an environment variable replaces a
+// parameter given in the file with different casing instead of adding a
+// second, conflicting parameter.
+func (suite *ConfigSuite) TestParseEnvMixedCaseKey(c *C) {
+	configYaml := strings.Replace(configYamlV0_1, "secretkey:", "secretKey:", 1)
+	suite.expectedConfig.Storage.setParameter("secretkey", "ENVSECRET")
+
+	os.Setenv("REGISTRY_STORAGE_S3_SECRETKEY", "ENVSECRET")
+
+	config, err := Parse(bytes.NewReader([]byte(configYaml)))
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, suite.expectedConfig)
+}
+
+// TestParseEnvTypedValues validates that values from the environment are
+// coerced to the type of the field they override, or to the natural yaml
+// type when overriding a parameter map.
+func (suite *ConfigSuite) TestParseEnvTypedValues(c *C) {
+	suite.expectedConfig.HTTP.RelativeURLs = true
+	suite.expectedConfig.Redis.DB = 3
+	suite.expectedConfig.Storage.setParameter("secure", false)
+	suite.expectedConfig.Storage.setParameter("chunksize", 10485760)
+
+	os.Setenv("REGISTRY_HTTP_RELATIVEURLS", "true")
+	os.Setenv("REGISTRY_REDIS_DB", "3")
+	os.Setenv("REGISTRY_STORAGE_S3_SECURE", "false")
+	os.Setenv("REGISTRY_STORAGE_S3_CHUNKSIZE", "10485760")
+
+	config, err := Parse(bytes.NewReader([]byte(configYamlV0_1)))
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, suite.expectedConfig)
+}
+
+// TestParseEnvPrecedence validates the override order: values from the
+// environment take precedence over the file, and more specific variables
+// are applied after less specific ones regardless of the order in which they
+// were set.
+func (suite *ConfigSuite) TestParseEnvPrecedence(c *C) {
+	suite.expectedConfig.Storage = Storage{"s3": Parameters{
+		"region":    "us-west-2",
+		"secretkey": "MORESPECIFIC",
+	}}
+
+	os.Setenv("REGISTRY_STORAGE_S3_SECRETKEY", "MORESPECIFIC")
+	os.Setenv("REGISTRY_STORAGE_S3", "{region: us-west-2, secretkey: LESSSPECIFIC}")
+
+	config, err := Parse(bytes.NewReader([]byte(configYamlV0_1)))
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, suite.expectedConfig)
+}
+
 // TestParseEnvVarImplicitMaps validates that environment variables can set
 // values in maps that don't already exist.
 func (suite *ConfigSuite) TestParseEnvVarImplicitMaps(c *C) {
@@ -430,6 +568,23 @@ func (suite *ConfigSuite) TestParseEnvVarImplicitMaps(c *C) {
 	c.Assert(config, DeepEquals, suite.expectedConfig)
 }
 
+// TestParseEnvVarLayout validates that the storage layout can be configured
+// alongside the storage driver.
+func (suite *ConfigSuite) TestParseEnvVarLayout(c *C) {
+	os.Setenv("REGISTRY_STORAGE_LAYOUT_VERSION", "2")
+
+	config, err := Parse(bytes.NewReader([]byte(configYamlV0_1)))
+	c.Assert(err, IsNil)
+	c.Assert(config.Storage.Type(), Equals, "s3")
+	version, err := config.Storage.LayoutVersion()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, 2)
+
+	config.Storage["layout"]["version"] = "two"
+	_, err = config.Storage.LayoutVersion()
+	c.Assert(err, NotNil)
+}
+
 // TestParseEnvWrongTypeMap validates that incorrectly attempting to unmarshal a
 // string over existing map fails.
 func (suite *ConfigSuite) TestParseEnvWrongTypeMap(c *C) {
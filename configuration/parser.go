@@ -277,6 +277,15 @@ func (p *Parser) overwriteMap(m reflect.Value, fullpath string, path []string, p
 		}
 	}
 
+	// Drop any existing key which differs from the environment variable only
+	// in case, so that the environment takes precedence over the file rather
+	// than leaving two conflicting entries behind.
+	for _, k := range m.MapKeys() {
+		if strings.ToUpper(k.String()) == path[0] {
+			m.SetMapIndex(k, reflect.Value{})
+		}
+	}
+
 	m.SetMapIndex(reflect.ValueOf(strings.ToLower(path[0])), reflect.Indirect(mapValue))
 
 	return nil
@@ -3,6 +3,8 @@ package context
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -125,6 +127,19 @@ func GetResponseWriter(ctx context.Context) (http.ResponseWriter, error) {
 	return rw, nil
 }
 
+// SetResponseContentDigest records the digest of the content served or
+// received by the request in the current context, which response loggers
+// include as "http.response.contentdigest". For a manifest pulled by tag, this
+// is the digest the tag resolved to. It has no effect if the context does not
+// have a response writer from WithResponseWriter.
+func SetResponseContentDigest(ctx context.Context, dgst string) {
+	if irw, ok := ctx.Value("http.response").(*instrumentedResponseWriter); ok {
+		irw.mu.Lock()
+		irw.contentDigest = dgst
+		irw.mu.Unlock()
+	}
+}
+
 // getVarsFromRequest let's us change request vars implementation for testing
 // and maybe future changes.
 var getVarsFromRequest = mux.Vars
@@ -161,7 +176,8 @@ func GetResponseLogger(ctx context.Context) Logger {
 	l := getLogrusLogger(ctx,
 		"http.response.written",
 		"http.response.status",
-		"http.response.contenttype")
+		"http.response.contenttype",
+		"http.response.contentdigest")
 
 	duration := Since(ctx, "http.request.startedat")
 
@@ -172,6 +188,131 @@ func GetResponseLogger(ctx context.Context) Logger {
 	return l
 }
 
+// requestLogFields maps the names of the fields request and response loggers
+// may be restricted to onto the context keys they are resolved from.
+var requestLogFields = map[string]string{
+	"request.id":             "http.request.id",
+	"request.method":         "http.request.method",
+	"request.uri":            "http.request.uri",
+	"request.remoteaddr":     "http.request.remoteaddr",
+	"request.useragent":      "http.request.useragent",
+	"vars.name":              "vars.name",
+	"vars.reference":         "vars.reference",
+	"response.status":        "http.response.status",
+	"response.written":       "http.response.written",
+	"response.duration":      "http.response.duration",
+	"response.contentdigest": "http.response.contentdigest",
+}
+
+// ValidateRequestLogFields returns an error if any of fields may not be
+// selected for request loggers.
+func ValidateRequestLogFields(fields []string) error {
+	for _, field := range fields {
+		if _, ok := requestLogFields[field]; !ok {
+			return fmt.Errorf("unknown request log field %q", field)
+		}
+	}
+	return nil
+}
+
+// requestLogFieldsKey marks the entries of loggers returned by
+// GetRequestLoggerWithFields with the set of fields they may carry.
+const requestLogFieldsKey = "request.logfields"
+
+// GetRequestLoggerWithFields returns a logger that contains only the selected
+// request and vars fields from the current context, which must be valid
+// request log fields. Fields not available in the context are left out, as
+// are response fields. Like request loggers, the returned logger can safely
+// be pushed onto the context.
+//
+// The entries of the returned logger, and of the loggers derived from it,
+// are marked with the selected fields, so that a RequestLogFieldsHook on the
+// logrus logger removes the fields pushed later, which it must be configured
+// with.
+func GetRequestLoggerWithFields(ctx context.Context, fields []string) Logger {
+	var keys []interface{}
+	selected := make(map[string]struct{}, len(fields))
+	for _, field := range fields {
+		key, ok := requestLogFields[field]
+		if !ok {
+			continue
+		}
+		selected[key] = struct{}{}
+		if !strings.HasPrefix(field, "response.") {
+			keys = append(keys, key)
+		}
+	}
+	return getLogrusLogger(ctx, keys...).WithField(requestLogFieldsKey, selected)
+}
+
+// RequestLogFieldsHook is a logrus hook removing from the entries of loggers
+// returned by GetRequestLoggerWithFields the fields that were not selected,
+// except for those it keeps. Other entries are left as they are.
+type RequestLogFieldsHook struct {
+	keep map[string]struct{}
+}
+
+// NewRequestLogFieldsHook returns a hook keeping the fields named by keep
+// in addition to the selected fields.
+func NewRequestLogFieldsHook(keep ...string) *RequestLogFieldsHook {
+	h := &RequestLogFieldsHook{keep: make(map[string]struct{}, len(keep))}
+	for _, key := range keep {
+		h.keep[key] = struct{}{}
+	}
+	return h
+}
+
+// Levels returns all levels, as every entry may need its fields removed.
+func (h *RequestLogFieldsHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire removes the fields of a marked entry that were neither selected nor
+// kept.
+func (h *RequestLogFieldsHook) Fire(entry *log.Entry) error {
+	selected, ok := entry.Data[requestLogFieldsKey].(map[string]struct{})
+	if !ok {
+		return nil
+	}
+	for key := range entry.Data {
+		if _, ok := selected[key]; ok {
+			continue
+		}
+		if _, ok := h.keep[key]; ok {
+			continue
+		}
+		delete(entry.Data, key)
+	}
+	return nil
+}
+
+// GetResponseLoggerWithFields is like GetResponseLogger, but the returned
+// logger only contains the selected response fields.
+func GetResponseLoggerWithFields(ctx context.Context, fields []string) Logger {
+	l := getLogrusLogger(ctx)
+	for _, field := range fields {
+		switch field {
+		case "response.status":
+			if status := ctx.Value("http.response.status"); status != nil {
+				l = l.WithField("http.response.status", status)
+			}
+		case "response.written":
+			if written := ctx.Value("http.response.written"); written != nil {
+				l = l.WithField("http.response.written", written)
+			}
+		case "response.duration":
+			if duration := Since(ctx, "http.request.startedat"); duration > 0 {
+				l = l.WithField("http.response.duration", duration.String())
+			}
+		case "response.contentdigest":
+			if dgst := ctx.Value("http.response.contentdigest"); dgst != nil {
+				l = l.WithField("http.response.contentdigest", dgst)
+			}
+		}
+	}
+	return l
+}
+
 // httpRequestContext makes information about a request available to context.
 type httpRequestContext struct {
 	context.Context
@@ -262,9 +403,10 @@ type instrumentedResponseWriter struct {
 	http.ResponseWriter
 	context.Context
 
-	mu      sync.Mutex
-	status  int
-	written int64
+	mu            sync.Mutex
+	status        int
+	written       int64
+	contentDigest string
 }
 
 func (irw *instrumentedResponseWriter) Write(p []byte) (n int, err error) {
@@ -283,6 +425,28 @@ func (irw *instrumentedResponseWriter) Write(p []byte) (n int, err error) {
 	return
 }
 
+// ReadFrom copies the content of r with the ReadFrom of the parent
+// ResponseWriter, if it has one, so that files are sent with sendfile.
+func (irw *instrumentedResponseWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if rf, ok := irw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(irw.ResponseWriter, r)
+	}
+
+	irw.mu.Lock()
+	irw.written += n
+
+	// Guess the likely status if not set.
+	if irw.status == 0 {
+		irw.status = http.StatusOK
+	}
+
+	irw.mu.Unlock()
+
+	return
+}
+
 func (irw *instrumentedResponseWriter) WriteHeader(status int) {
 	irw.ResponseWriter.WriteHeader(status)
 
@@ -321,6 +485,10 @@ func (irw *instrumentedResponseWriter) Value(key interface{}) interface{} {
 			return irw.written
 		case "status":
 			return irw.status
+		case "contentdigest":
+			if irw.contentDigest != "" {
+				return irw.contentDigest
+			}
 		case "contenttype":
 			contentType := irw.Header().Get("Content-Type")
 			if contentType != "" {
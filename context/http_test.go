@@ -1,6 +1,8 @@
 package context
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
@@ -8,6 +10,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 func TestWithRequest(t *testing.T) {
@@ -163,6 +167,16 @@ func TestWithResponseWriter(t *testing.T) {
 		t.Fatalf("unexpected number reported bytes written: %v != %v", ctx.Value("http.response.written"), 1024)
 	}
 
+	if ctx.Value("http.response.contentdigest") != nil {
+		t.Fatalf("unexpected content digest in context: %v", ctx.Value("http.response.contentdigest"))
+	}
+
+	// The digest is set through a derived context, as by request handlers.
+	SetResponseContentDigest(WithValues(ctx, map[string]interface{}{"foo": "bar"}), "sha256:abc")
+	if ctx.Value("http.response.contentdigest") != "sha256:abc" {
+		t.Fatalf("unexpected content digest in context: %v != sha256:abc", ctx.Value("http.response.contentdigest"))
+	}
+
 	// Make sure flush propagates
 	rw.(http.Flusher).Flush()
 
@@ -220,6 +234,73 @@ func TestWithVars(t *testing.T) {
 	}
 }
 
+func TestRequestLoggerWithFields(t *testing.T) {
+	var req http.Request
+	req.Method = "GET"
+	req.Host = "example.com"
+	req.RequestURI = "/v2/foo/manifests/latest"
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header = make(http.Header)
+	req.Header.Set("User-Agent", "test/0.1")
+	getVarsFromRequest = func(r *http.Request) map[string]string {
+		return map[string]string{"name": "foo", "reference": "latest"}
+	}
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	logger.AddHook(NewRequestLogFieldsHook("service"))
+
+	fields := []string{"request.method", "vars.name", "response.status"}
+	ctx := WithLogger(Background(), logrus.NewEntry(logger).WithField("service", "registry"))
+	ctx = WithRequest(ctx, &req)
+	ctx, w := WithResponseWriter(ctx, httptest.NewRecorder())
+	ctx = WithLogger(ctx, GetRequestLoggerWithFields(ctx, fields))
+	ctx = WithVars(ctx, &req)
+	ctx = WithLogger(ctx, GetRequestLoggerWithFields(ctx, fields))
+	// Fields pushed later are removed.
+	ctx = WithLogger(ctx, GetLogger(ctx, "instance.id", "vars.reference"))
+	w.WriteHeader(http.StatusOK)
+	GetResponseLoggerWithFields(ctx, fields).Info("response completed")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("unexpected error decoding log entry: %v", err)
+	}
+	delete(entry, "level")
+	delete(entry, "msg")
+	delete(entry, "time")
+	expected := map[string]interface{}{
+		"http.request.method":  "GET",
+		"vars.name":            "foo",
+		"http.response.status": float64(http.StatusOK),
+		"service":              "registry",
+	}
+	if !reflect.DeepEqual(entry, expected) {
+		t.Fatalf("unexpected log entry fields: %v != %v", entry, expected)
+	}
+
+	// Entries of other loggers are left as they are.
+	buf.Reset()
+	GetLogger(WithLogger(Background(), logrus.NewEntry(logger)), "instance.id").Info("started")
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("unexpected error decoding log entry: %v", err)
+	}
+	if _, ok := entry["instance.id"]; !ok {
+		t.Fatalf("field removed from an unmarked entry: %v", entry)
+	}
+}
+
+func TestValidateRequestLogFields(t *testing.T) {
+	if err := ValidateRequestLogFields([]string{"request.id", "vars.reference", "response.duration"}); err != nil {
+		t.Fatalf("unexpected error validating fields: %v", err)
+	}
+	if err := ValidateRequestLogFields([]string{"request.host"}); err == nil {
+		t.Fatalf("expected an error for an unknown field")
+	}
+}
+
 // SingleHostReverseProxy will insert an X-Forwarded-For header, and can be used to test
 // RemoteAddr().  A fake RemoteAddr cannot be set on the HTTP request - it is overwritten
 // at the transport layer to 127.0.0.1:<port> .  However, as the X-Forwarded-For header
@@ -37,10 +37,16 @@ import (
 //
 // Notice that the function name is automatically resolved, along with the
 // package and a trace id is emitted that can be linked with parent ids.
+//
+// Operations of requests a TraceSampler did not sample are not traced: ctx is
+// returned as it is, with a done function emitting nothing.
 func WithTrace(ctx context.Context) (context.Context, func(format string, a ...interface{})) {
 	if ctx == nil {
 		ctx = Background()
 	}
+	if !TraceSampled(ctx) {
+		return ctx, func(format string, a ...interface{}) {}
+	}
 
 	pc, file, line, _ := runtime.Caller(1)
 	f := runtime.FuncForPC(pc)
@@ -0,0 +1,118 @@
+package context
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the W3C Trace Context header carrying the trace id and
+// sampling decision of the caller of a request.
+const TraceParentHeader = "traceparent"
+
+// TraceSampler is a head-based sampler deciding which requests are traced.
+// Requests carrying a valid traceparent header are traced if the caller
+// sampled them, so that distributed traces are kept or dropped whole. Other
+// requests are traced at the sampling rate.
+type TraceSampler struct {
+	rate float64
+
+	mu     sync.Mutex
+	random *mathrand.Rand
+}
+
+// NewTraceSampler returns a sampler tracing the fraction rate of the requests
+// not sampled by their caller. rate must be between 0 and 1.
+func NewTraceSampler(rate float64) (*TraceSampler, error) {
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("trace sampling rate must be between 0 and 1, %v invalid", rate)
+	}
+	return &TraceSampler{
+		rate:   rate,
+		random: mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// WithRequestTrace returns a context carrying the sampling decision for the
+// request r, read by WithTrace, as "trace.sampled". A sampled request is given
+// the trace id of its caller or, if it has none, a new one, as "trace.id",
+// which parents the spans traced while serving it.
+func (s *TraceSampler) WithRequestTrace(ctx context.Context, r *http.Request) context.Context {
+	traceID, sampled, ok := ParseTraceParent(r.Header.Get(TraceParentHeader))
+	if !ok {
+		sampled = s.sample()
+		traceID = newTraceID()
+	}
+	values := map[string]interface{}{"trace.sampled": sampled}
+	if sampled {
+		values["trace.id"] = traceID
+	}
+	return WithValues(ctx, values)
+}
+
+func (s *TraceSampler) sample() bool {
+	if s.rate >= 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.random.Float64() < s.rate
+}
+
+// TraceSampled reports whether the operation of ctx is traced. Operations are
+// traced unless a sampler decided otherwise.
+func TraceSampled(ctx context.Context) bool {
+	sampled, ok := ctx.Value("trace.sampled").(bool)
+	return !ok || sampled
+}
+
+// ParseTraceParent returns the trace id and the sampled flag of the
+// traceparent header value, or false if it is not valid.
+func ParseTraceParent(value string) (traceID string, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return "", false, false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	// Version 00 has exactly four fields; later versions may add more.
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", false, false
+	}
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) ||
+		!isLowerHex(parentID, 16) || parentID == strings.Repeat("0", 16) ||
+		!isLowerHex(flags, 2) {
+		return "", false, false
+	}
+	var flagBits [1]byte
+	if _, err := hex.Decode(flagBits[:], []byte(flags)); err != nil {
+		return "", false, false
+	}
+	return traceID, flagBits[0]&1 == 1, true
+}
+
+func isLowerHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newTraceID returns a random trace id in the traceparent format.
+func newTraceID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(fmt.Sprintf("error generating trace id: %v", err))
+	}
+	return hex.EncodeToString(id[:])
+}
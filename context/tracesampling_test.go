@@ -0,0 +1,106 @@
+package context
+
+import (
+	mathrand "math/rand"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		traceID string
+		sampled bool
+		ok      bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "4bf92f3577b34da6a3ce929d0e0e4736", false, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03-future", "4bf92f3577b34da6a3ce929d0e0e4736", true, true},
+		{"", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", "", false, false},
+	} {
+		traceID, sampled, ok := ParseTraceParent(tc.value)
+		if traceID != tc.traceID || sampled != tc.sampled || ok != tc.ok {
+			t.Errorf("ParseTraceParent(%q) = %q, %v, %v, expected %q, %v, %v", tc.value, traceID, sampled, ok, tc.traceID, tc.sampled, tc.ok)
+		}
+	}
+}
+
+func TestTraceSamplerRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.01, 50, 150},
+		{0.5, 4800, 5200},
+		{1, 10000, 10000},
+	} {
+		sampler, err := NewTraceSampler(tc.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sampler.random = mathrand.New(mathrand.NewSource(1))
+
+		sampled := 0
+		for i := 0; i < 10000; i++ {
+			ctx := sampler.WithRequestTrace(Background(), httptest.NewRequest("GET", "/v2/", nil))
+			if TraceSampled(ctx) {
+				sampled++
+				if id, _ := ctx.Value("trace.id").(string); len(id) != 32 {
+					t.Fatalf("sampled request given trace id %q", id)
+				}
+			} else if ctx.Value("trace.id") != nil {
+				t.Fatalf("request not sampled given trace id %v", ctx.Value("trace.id"))
+			}
+		}
+		if sampled < tc.min || sampled > tc.max {
+			t.Errorf("rate %v: %d requests of 10000 sampled, expected between %d and %d", tc.rate, sampled, tc.min, tc.max)
+		}
+	}
+
+	for _, rate := range []float64{-0.1, 1.5} {
+		if _, err := NewTraceSampler(rate); err == nil {
+			t.Errorf("expected an error for rate %v", rate)
+		}
+	}
+}
+
+func TestTraceSamplerTraceParent(t *testing.T) {
+	for _, tc := range []struct {
+		rate        float64
+		traceParent string
+		sampled     bool
+	}{
+		{0, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{1, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+		{0, "invalid", false},
+		{1, "invalid", true},
+	} {
+		sampler, err := NewTraceSampler(tc.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/v2/", nil)
+		r.Header.Set(TraceParentHeader, tc.traceParent)
+		ctx := sampler.WithRequestTrace(Background(), r)
+		if TraceSampled(ctx) != tc.sampled {
+			t.Fatalf("rate %v, traceparent %q: sampled %v, expected %v", tc.rate, tc.traceParent, TraceSampled(ctx), tc.sampled)
+		}
+		if traceID, _, ok := ParseTraceParent(tc.traceParent); ok && tc.sampled && ctx.Value("trace.id") != traceID {
+			t.Fatalf("trace id %v, expected that of the traceparent %s", ctx.Value("trace.id"), traceID)
+		}
+
+		// The decision applies to the operations serving the request.
+		traced, done := WithTrace(ctx)
+		done("operation")
+		if spanned := traced.Value("trace.parent.id") != nil; spanned != tc.sampled {
+			t.Fatalf("rate %v, traceparent %q: operation traced %v, expected %v", tc.rate, tc.traceParent, spanned, tc.sampled)
+		}
+	}
+}
@@ -117,3 +117,48 @@ type ErrManifestNameInvalid struct {
 func (err ErrManifestNameInvalid) Error() string {
 	return fmt.Sprintf("manifest name %q invalid: %v", err.Name, err.Reason)
 }
+
+// ErrManifestLayerMediaTypeNotAllowed is returned when a manifest references
+// a layer whose media type is not allowed by the registry.
+type ErrManifestLayerMediaTypeNotAllowed struct {
+	Digest    digest.Digest
+	MediaType string
+}
+
+func (err ErrManifestLayerMediaTypeNotAllowed) Error() string {
+	return fmt.Sprintf("layer %v has media type %q, which is not allowed", err.Digest, err.MediaType)
+}
+
+// ErrManifestPlatformInvalid is returned when the platform an image manifest
+// is declared for, by a manifest list referencing it or when pushed, does not
+// match the platform of its config, or cannot be checked against it.
+type ErrManifestPlatformInvalid struct {
+	Digest digest.Digest
+	Reason string
+}
+
+func (err ErrManifestPlatformInvalid) Error() string {
+	return fmt.Sprintf("invalid platform for manifest %v: %s", err.Digest, err.Reason)
+}
+
+// ErrManifestListTooManyDescriptors is returned when a manifest list
+// references more manifests than the registry allows.
+type ErrManifestListTooManyDescriptors struct {
+	Count int
+	Max   int
+}
+
+func (err ErrManifestListTooManyDescriptors) Error() string {
+	return fmt.Sprintf("manifest list references %d manifests, more than the maximum of %d", err.Count, err.Max)
+}
+
+// ErrManifestListTooDeep is returned when walking manifest lists nested within
+// one another beyond the maximum depth, with Digest the list found beyond it.
+type ErrManifestListTooDeep struct {
+	Digest   digest.Digest
+	MaxDepth int
+}
+
+func (err ErrManifestListTooDeep) Error() string {
+	return fmt.Sprintf("manifest list %v is nested beyond the maximum depth of %d", err.Digest, err.MaxDepth)
+}
@@ -60,6 +60,39 @@ func HTTPChecker(r string, statusCode int, timeout time.Duration, headers http.H
 	})
 }
 
+// ReachabilityChecker sends a request with the given method, HEAD if empty,
+// and verifies that the server answers it without a 5xx status code. Other
+// status codes, such as 405 from a server not handling the method, show the
+// server is reachable.
+func ReachabilityChecker(method, r string, timeout time.Duration, headers http.Header) health.Checker {
+	if method == "" {
+		method = http.MethodHead
+	}
+	return health.CheckFunc(func() error {
+		client := http.Client{
+			Timeout: timeout,
+		}
+		req, err := http.NewRequest(method, r, nil)
+		if err != nil {
+			return errors.New("error creating request: " + r)
+		}
+		for headerName, headerValues := range headers {
+			for _, headerValue := range headerValues {
+				req.Header.Add(headerName, headerValue)
+			}
+		}
+		response, err := client.Do(req)
+		if err != nil {
+			return errors.New("error while checking: " + r)
+		}
+		response.Body.Close()
+		if response.StatusCode >= http.StatusInternalServerError {
+			return errors.New("downstream service returned unexpected status: " + strconv.Itoa(response.StatusCode))
+		}
+		return nil
+	})
+}
+
 // TCPChecker attempts to open a TCP connection.
 func TCPChecker(addr string, timeout time.Duration) health.Checker {
 	return health.CheckFunc(func() error {
@@ -1,7 +1,10 @@
 package checks
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestFileChecker(t *testing.T) {
@@ -23,3 +26,30 @@ func TestHTTPChecker(t *testing.T) {
 		t.Errorf("Google at Portugal was expected as exists, error:%v", err)
 	}
 }
+
+func TestReachabilityChecker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unsupported":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case "/failing":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/", "/unsupported"} {
+		if err := ReachabilityChecker("", server.URL+path, time.Second, nil).Check(); err != nil {
+			t.Errorf("%s was expected as reachable, error:%v", path, err)
+		}
+	}
+	if err := ReachabilityChecker(http.MethodOptions, server.URL+"/failing", time.Second, nil).Check(); err == nil {
+		t.Errorf("/failing was expected as unreachable")
+	}
+
+	addr := server.Listener.Addr().String()
+	server.Close()
+	if err := ReachabilityChecker("", "http://"+addr, time.Second, nil).Check(); err == nil {
+		t.Errorf("closed server was expected as unreachable")
+	}
+}
@@ -17,6 +17,9 @@ import (
 type Registry struct {
 	mu               sync.RWMutex
 	registeredChecks map[string]Checker
+	// nonCritical holds the names of the checks which are reported without
+	// the health of the service depending on them.
+	nonCritical map[string]struct{}
 }
 
 // NewRegistry creates a new registry. This isn't necessary for normal use of
@@ -25,6 +28,7 @@ type Registry struct {
 func NewRegistry() *Registry {
 	return &Registry{
 		registeredChecks: make(map[string]Checker),
+		nonCritical:      make(map[string]struct{}),
 	}
 }
 
@@ -163,17 +167,28 @@ func PeriodicThresholdChecker(check Checker, period time.Duration, threshold int
 
 // CheckStatus returns a map with all the current health check errors
 func (registry *Registry) CheckStatus() map[string]string { // TODO(stevvooe) this needs a proper type
+	statusKeys, _ := registry.checkStatus()
+	return statusKeys
+}
+
+// checkStatus returns a map with all the current health check errors, and
+// whether any of them is the error of a critical check.
+func (registry *Registry) checkStatus() (map[string]string, bool) {
 	registry.mu.RLock()
 	defer registry.mu.RUnlock()
 	statusKeys := make(map[string]string)
+	critical := false
 	for k, v := range registry.registeredChecks {
 		err := v.Check()
 		if err != nil {
 			statusKeys[k] = err.Error()
+			if _, ok := registry.nonCritical[k]; !ok {
+				critical = true
+			}
 		}
 	}
 
-	return statusKeys
+	return statusKeys, critical
 }
 
 // CheckStatus returns a map with all the current health check errors from the
@@ -202,6 +217,25 @@ func Register(name string, check Checker) {
 	DefaultRegistry.Register(name, check)
 }
 
+// RegisterNonCritical associates the checker with the provided name. Its
+// errors are reported with those of the other checks, but do not make the
+// service unhealthy.
+func (registry *Registry) RegisterNonCritical(name string, check Checker) {
+	if registry == nil {
+		registry = DefaultRegistry
+	}
+	registry.Register(name, check)
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.nonCritical[name] = struct{}{}
+}
+
+// RegisterNonCritical associates the checker with the provided name in the
+// default registry, without the health of the service depending on it.
+func RegisterNonCritical(name string, check Checker) {
+	DefaultRegistry.RegisterNonCritical(name, check)
+}
+
 // RegisterFunc allows the convenience of registering a checker directly from
 // an arbitrary func() error.
 func (registry *Registry) RegisterFunc(name string, check func() error) {
@@ -240,14 +274,14 @@ func RegisterPeriodicThresholdFunc(name string, period time.Duration, threshold
 
 // StatusHandler returns a JSON blob with all the currently registered Health Checks
 // and their corresponding status.
-// Returns 503 if any Error status exists, 200 otherwise
+// Returns 503 if any Error status exists for a critical check, 200 otherwise
 func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		checks := CheckStatus()
+		checks, critical := DefaultRegistry.checkStatus()
 		status := http.StatusOK
 
 		// If there is an error, return 503
-		if len(checks) != 0 {
+		if critical {
 			status = http.StatusServiceUnavailable
 		}
 
@@ -260,11 +294,11 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 // Handler returns a handler that will return 503 response code if the health
 // checks have failed. If everything is okay with the health checks, the
 // handler will pass through to the provided handler. Use this handler to
-// disable a web application when the health checks fail.
+// disable a web application when the health checks fail. Non-critical checks
+// failing do not disable it.
 func Handler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		checks := CheckStatus()
-		if len(checks) != 0 {
+		if _, critical := DefaultRegistry.checkStatus(); critical {
 			errcode.ServeJSON(w, errcode.ErrorCodeUnavailable.
 				WithDetail("health check failed: please see /debug/health"))
 			return
@@ -1,6 +1,7 @@
 package health
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -105,3 +106,47 @@ func TestHealthHandler(t *testing.T) {
 	updater.Update(nil)
 	checkUp(t, "when server is back up") // now we should be back up.
 }
+
+// TestNonCriticalChecks ensures that failing non-critical checks are reported
+// without the service being reported unhealthy or disabled.
+func TestNonCriticalChecks(t *testing.T) {
+	// clear out existing checks.
+	DefaultRegistry = NewRegistry()
+
+	updater := NewStatusUpdater()
+	RegisterNonCritical("non_critical_check", updater)
+	updater.Update(fmt.Errorf("the dependency is unreachable"))
+
+	req, err := http.NewRequest("GET", "https://fakeurl.com/debug/health", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request.")
+	}
+	recorder := httptest.NewRecorder()
+	StatusHandler(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status of a failing non-critical check: %d", recorder.Code)
+	}
+	var checks map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &checks); err != nil {
+		t.Fatalf("error decoding health status: %v", err)
+	}
+	if checks["non_critical_check"] != "the dependency is unreachable" {
+		t.Fatalf("failing non-critical check not reported: %v", checks)
+	}
+
+	recorder = httptest.NewRecorder()
+	Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("service disabled by a failing non-critical check: %d", recorder.Code)
+	}
+
+	// A failing critical check still makes the service unhealthy.
+	RegisterFunc("critical_check", func() error { return fmt.Errorf("down") })
+	recorder = httptest.NewRecorder()
+	StatusHandler(recorder, req)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status of a failing critical check: %d", recorder.Code)
+	}
+}
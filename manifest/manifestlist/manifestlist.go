@@ -118,6 +118,17 @@ type ManifestList struct {
 
 	// Config references the image configuration as a blob.
 	Manifests []ManifestDescriptor `json:"manifests"`
+
+	// Annotations contains arbitrary metadata for an OCI image index.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// ArtifactType is the type of an artifact when an OCI image index is
+	// used for an artifact rather than a multi-platform image.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// Subject references the manifest an OCI image index refers to. It is
+	// not one of the references of the index, and need not exist.
+	Subject *distribution.Descriptor `json:"subject,omitempty"`
 }
 
 // References returns the distribution descriptors for the referenced image
@@ -11,6 +11,21 @@ import (
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+const (
+	// MediaTypeImageLayerZstd is the media type used for zstd compressed
+	// layers referenced by the manifest.
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeImageLayerNonDistributableZstd is the media type for zstd
+	// compressed layers referenced by the manifest but with distribution
+	// restrictions.
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+
+	// MediaTypeEmptyJSON is the media type of the empty JSON blob, used as
+	// the config of artifact manifests which have none.
+	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+)
+
 var (
 	// SchemaVersion provides a pre-initialized version structure for this
 	// packages version of the manifest.
@@ -20,6 +35,18 @@ var (
 	}
 )
 
+var (
+	// EmptyJSON is the content of the empty JSON blob.
+	EmptyJSON = []byte("{}")
+
+	// DescriptorEmptyJSON is the descriptor of the empty JSON blob.
+	DescriptorEmptyJSON = distribution.Descriptor{
+		MediaType: MediaTypeEmptyJSON,
+		Digest:    digest.FromBytes(EmptyJSON),
+		Size:      int64(len(EmptyJSON)),
+	}
+)
+
 func init() {
 	ocischemaFunc := func(b []byte) (distribution.Manifest, distribution.Descriptor, error) {
 		m := new(DeserializedManifest)
@@ -50,6 +77,15 @@ type Manifest struct {
 
 	// Annotations contains arbitrary metadata for the image manifest.
 	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// ArtifactType is the type of an artifact when the manifest is used for
+	// an artifact rather than an image.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	// Subject references the manifest this manifest refers to, such as the
+	// image an attestation is about. It is not one of the references of the
+	// manifest, and need not exist.
+	Subject *distribution.Descriptor `json:"subject,omitempty"`
 }
 
 // References returns the descriptors of this manifests references.
@@ -60,6 +96,13 @@ func (m Manifest) References() []distribution.Descriptor {
 	return references
 }
 
+// IsArtifact reports whether the manifest is used for an artifact rather than
+// an image, either because it has an artifact type or because its config is
+// not an image config.
+func (m Manifest) IsArtifact() bool {
+	return m.ArtifactType != "" || m.Config.MediaType != v1.MediaTypeImageConfig
+}
+
 // Target returns the target of this manifest.
 func (m Manifest) Target() distribution.Descriptor {
 	return m.Config
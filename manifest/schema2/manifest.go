@@ -127,6 +127,25 @@ func (m *DeserializedManifest) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// UnmarshalUntyped populates a new Manifest struct from JSON data lacking
+// the mediaType field, such as that of manifests stored by older imports.
+// The data is kept as is, while the media type of the manifest is set to
+// MediaTypeManifest.
+func UnmarshalUntyped(b []byte) (*DeserializedManifest, error) {
+	m := &DeserializedManifest{canonical: make([]byte, len(b))}
+	copy(m.canonical, b)
+
+	if err := json.Unmarshal(m.canonical, &m.Manifest); err != nil {
+		return nil, err
+	}
+	if m.MediaType != "" {
+		return nil, fmt.Errorf("mediaType in untyped manifest should be empty not '%s'", m.MediaType)
+	}
+	m.MediaType = MediaTypeManifest
+
+	return m, nil
+}
+
 // MarshalJSON returns the contents of canonical. If canonical is empty,
 // marshals the inner contents.
 func (m *DeserializedManifest) MarshalJSON() ([]byte, error) {
@@ -160,3 +160,30 @@ func TestMediaTypes(t *testing.T) {
 	mediaTypeTest(t, MediaTypeManifest, false)
 	mediaTypeTest(t, MediaTypeManifest+"XXX", true)
 }
+
+func TestUnmarshalUntyped(t *testing.T) {
+	untyped := bytes.Replace(expectedManifestSerialization, []byte(`   "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+`), nil, 1)
+
+	m, err := UnmarshalUntyped(untyped)
+	if err != nil {
+		t.Fatalf("error unmarshaling untyped manifest: %v", err)
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		t.Fatalf("error getting payload: %v", err)
+	}
+	if mediaType != MediaTypeManifest {
+		t.Fatalf("unexpected media type %q", mediaType)
+	}
+	if !bytes.Equal(payload, untyped) {
+		t.Fatalf("payload differs from the untyped content: %s", payload)
+	}
+	if len(m.Layers) != 1 || m.Config.Size != 985 {
+		t.Fatalf("unexpected manifest: %#v", m.Manifest)
+	}
+
+	if _, err := UnmarshalUntyped(expectedManifestSerialization); err == nil {
+		t.Fatal("expected an error unmarshaling a typed manifest as untyped")
+	}
+}
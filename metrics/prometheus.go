@@ -11,6 +11,10 @@ var (
 	// StorageNamespace is the prometheus namespace of blob/cache related operations
 	StorageNamespace = metrics.NewNamespace(NamespacePrefix, "storage", nil)
 
+	// GCNamespace is the prometheus namespace of garbage collection related
+	// operations
+	GCNamespace = metrics.NewNamespace(NamespacePrefix, "gc", nil)
+
 	// NotificationsNamespace is the prometheus namespace of notification related metrics
 	NotificationsNamespace = metrics.NewNamespace(NamespacePrefix, "notifications", nil)
 )
@@ -0,0 +1,236 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultStatsDAddr is the address of the StatsD server metrics are
+	// sent to, unless configured otherwise.
+	DefaultStatsDAddr = "localhost:8125"
+
+	// DefaultStatsDInterval is how often metrics are sent to the StatsD
+	// server, unless configured otherwise.
+	DefaultStatsDInterval = 10 * time.Second
+
+	// maxStatsDPacketSize keeps the packets sent within the MTU of most
+	// networks, as StatsD servers drop truncated packets.
+	maxStatsDPacketSize = 1432
+)
+
+// StatsDSink sends the metrics the registry exposes to Prometheus to a StatsD
+// server, at intervals. Counters are sent as StatsD counters of their
+// increase since the last interval, gauges as gauges. Histograms and summaries
+// are sent as the counters <name>.count and <name>.sum, their number of
+// observations and the sum of the values observed, from which rates and mean
+// durations are computed.
+//
+// The labels of the metrics are sent as DogStatsD tags if dogStatsD is set.
+// Otherwise, they are appended to the name of the metrics, as in
+// <name>.<label>.<value>, which plain StatsD servers can tell apart.
+type StatsDSink struct {
+	w         io.Writer
+	gatherer  prometheus.Gatherer
+	prefix    string
+	dogStatsD bool
+	tags      []string
+
+	// mu serializes flushes, and protects sent, which holds the last values
+	// sent of the counters, by name and labels.
+	mu   sync.Mutex
+	sent map[string]float64
+}
+
+// NewStatsDSink returns a sink of the metrics registered with the default
+// Prometheus registry, sending them to the StatsD server at addr over UDP.
+// The names of the metrics sent start with prefix, if set. tags are added to
+// every metric, and require dogStatsD.
+func NewStatsDSink(addr, prefix string, dogStatsD bool, tags map[string]string) (*StatsDSink, error) {
+	if len(tags) > 0 && !dogStatsD {
+		return nil, fmt.Errorf("statsd tags require the dogstatsd format")
+	}
+	if addr == "" {
+		addr = DefaultStatsDAddr
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to statsd server %s: %v", addr, err)
+	}
+	return newStatsDSink(conn, prometheus.DefaultGatherer, prefix, dogStatsD, tags), nil
+}
+
+func newStatsDSink(w io.Writer, gatherer prometheus.Gatherer, prefix string, dogStatsD bool, tags map[string]string) *StatsDSink {
+	var formatted []string
+	for name, value := range tags {
+		formatted = append(formatted, statsDTag(name, value))
+	}
+	sort.Strings(formatted)
+	return &StatsDSink{
+		w:         w,
+		gatherer:  gatherer,
+		prefix:    prefix,
+		dogStatsD: dogStatsD,
+		tags:      formatted,
+		sent:      make(map[string]float64),
+	}
+}
+
+// Run sends the metrics every interval, DefaultStatsDInterval if zero, until
+// ctx is done.
+func (s *StatsDSink) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultStatsDInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				logrus.Warnf("error sending metrics to statsd: %v", err)
+			}
+		}
+	}
+}
+
+// Flush sends the current values of the metrics.
+func (s *StatsDSink) Flush() error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			lines = append(lines, s.lines(family, metric)...)
+		}
+	}
+	return s.send(lines)
+}
+
+// lines returns the StatsD lines of metric, of the metric family.
+func (s *StatsDSink) lines(family *dto.MetricFamily, metric *dto.Metric) []string {
+	name := family.GetName()
+	if s.prefix != "" {
+		name = s.prefix + "." + name
+	}
+	var tags []string
+	for _, label := range metric.GetLabel() {
+		if s.dogStatsD {
+			tags = append(tags, statsDTag(label.GetName(), label.GetValue()))
+		} else {
+			name += "." + sanitizeStatsD(label.GetName()) + "." + sanitizeStatsD(label.GetValue())
+		}
+	}
+	tags = append(tags, s.tags...)
+
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		return []string{s.counter(name, tags, metric.GetCounter().GetValue())}
+	case dto.MetricType_GAUGE:
+		return s.gauge(name, tags, metric.GetGauge().GetValue())
+	case dto.MetricType_UNTYPED:
+		return s.gauge(name, tags, metric.GetUntyped().GetValue())
+	case dto.MetricType_HISTOGRAM:
+		histogram := metric.GetHistogram()
+		return []string{
+			s.counter(name+".count", tags, float64(histogram.GetSampleCount())),
+			s.counter(name+".sum", tags, histogram.GetSampleSum()),
+		}
+	case dto.MetricType_SUMMARY:
+		summary := metric.GetSummary()
+		return []string{
+			s.counter(name+".count", tags, float64(summary.GetSampleCount())),
+			s.counter(name+".sum", tags, summary.GetSampleSum()),
+		}
+	}
+	return nil
+}
+
+// counter returns the line of the increase of the counter name since it was
+// last sent, the whole value if the counter was reset since.
+func (s *StatsDSink) counter(name string, tags []string, value float64) string {
+	key := name + "|" + strings.Join(tags, ",")
+	increase := value
+	if last, ok := s.sent[key]; ok && last <= value {
+		increase = value - last
+	}
+	s.sent[key] = value
+	return s.line(name, increase, "c", tags)
+}
+
+// gauge returns the lines setting the gauge name to value. As StatsD reads a
+// signed gauge value as a change of the gauge, negative values are sent as
+// a change from zero.
+func (s *StatsDSink) gauge(name string, tags []string, value float64) []string {
+	if value < 0 {
+		return []string{s.line(name, 0, "g", tags), s.line(name, value, "g", tags)}
+	}
+	return []string{s.line(name, value, "g", tags)}
+}
+
+func (s *StatsDSink) line(name string, value float64, metricType string, tags []string) string {
+	line := sanitizeStatsD(name) + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + metricType
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// send writes lines in as few packets as fit them.
+func (s *StatsDSink) send(lines []string) error {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsDPacketSize {
+			if _, err := s.w.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := s.w.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func statsDTag(name, value string) string {
+	return sanitizeStatsD(name) + ":" + sanitizeStatsD(value)
+}
+
+// sanitizeStatsD replaces the characters separating the fields of StatsD
+// lines.
+func sanitizeStatsD(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// packetRecorder records the packets written to it.
+type packetRecorder struct {
+	packets []string
+}
+
+func (r *packetRecorder) Write(p []byte) (int, error) {
+	r.packets = append(r.packets, string(p))
+	return len(p), nil
+}
+
+// lines returns the lines recorded since last called, sorted.
+func (r *packetRecorder) lines() []string {
+	var lines []string
+	for _, packet := range r.packets {
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	r.packets = nil
+	sort.Strings(lines)
+	return lines
+}
+
+// instrumentedHandler returns a handler instrumented as those of the
+// registry are, with its metrics registered with a registry of their own.
+func instrumentedHandler(t *testing.T) (http.Handler, *prometheus.Registry) {
+	registry := prometheus.NewRegistry()
+	namespace := metrics.NewNamespace(NamespacePrefix, "http", nil)
+	httpMetrics := namespace.NewDefaultHttpMetrics("blob")
+	if err := registry.Register(namespace); err != nil {
+		t.Fatal(err)
+	}
+	return metrics.InstrumentHandler(httpMetrics, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})), registry
+}
+
+func serveRequests(handler http.Handler, n int) {
+	for i := 0; i < n; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/foo/blobs/sha256:abc", nil))
+	}
+}
+
+func checkLines(t *testing.T, lines []string, expected ...string) {
+	t.Helper()
+	for _, line := range expected {
+		found := false
+		for _, l := range lines {
+			found = found || l == line
+		}
+		if !found {
+			t.Errorf("line %q not sent, lines sent:\n%s", line, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestStatsDSink(t *testing.T) {
+	handler, registry := instrumentedHandler(t)
+	recorder := &packetRecorder{}
+	sink := newStatsDSink(recorder, registry, "", false, nil)
+
+	serveRequests(handler, 2)
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkLines(t, recorder.lines(),
+		"registry_http_requests_total.code.404.handler.blob.method.get:2|c",
+		"registry_http_request_duration_seconds.handler.blob.method.get.count:2|c",
+		"registry_http_in_flight_requests.handler.blob:0|g",
+	)
+
+	// Counters are sent as their increase since the last flush.
+	serveRequests(handler, 1)
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkLines(t, recorder.lines(),
+		"registry_http_requests_total.code.404.handler.blob.method.get:1|c",
+		"registry_http_request_duration_seconds.handler.blob.method.get.count:1|c",
+	)
+}
+
+func TestStatsDSinkDogStatsD(t *testing.T) {
+	handler, registry := instrumentedHandler(t)
+	recorder := &packetRecorder{}
+	sink := newStatsDSink(recorder, registry, "prod", true, map[string]string{"env": "prod", "dc": "eu"})
+
+	serveRequests(handler, 1)
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkLines(t, recorder.lines(),
+		"prod.registry_http_requests_total:1|c|#code:404,handler:blob,method:get,dc:eu,env:prod",
+		"prod.registry_http_request_duration_seconds.count:1|c|#handler:blob,method:get,dc:eu,env:prod",
+		"prod.registry_http_in_flight_requests:0|g|#handler:blob,dc:eu,env:prod",
+	)
+
+	if _, err := NewStatsDSink("", "", false, map[string]string{"env": "prod"}); err == nil {
+		t.Fatal("expected an error for tags without the dogstatsd format")
+	}
+}
+
+func TestStatsDSinkPackets(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauges := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gauge"}, []string{"index"})
+	registry.MustRegister(gauges)
+	for i := 0; i < 500; i++ {
+		gauges.WithLabelValues(fmt.Sprint(i)).Set(-1)
+	}
+	recorder := &packetRecorder{}
+	sink := newStatsDSink(recorder, registry, "", false, nil)
+	if err := sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.packets) < 2 {
+		t.Fatalf("expected the lines split across packets, got %d", len(recorder.packets))
+	}
+	for _, packet := range recorder.packets {
+		if len(packet) > maxStatsDPacketSize {
+			t.Fatalf("packet of %d bytes sent", len(packet))
+		}
+	}
+	lines := recorder.lines()
+	if len(lines) != 1000 {
+		t.Fatalf("expected 1000 lines, got %d", len(lines))
+	}
+	// Negative gauges are set from zero.
+	expected := []string{"gauge.index.0:-1|g", "gauge.index.0:0|g"}
+	if !reflect.DeepEqual(lines[:2], expected) {
+		t.Fatalf("unexpected lines %v, expected %v", lines[:2], expected)
+	}
+}
@@ -0,0 +1,229 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	events "github.com/docker/go-events"
+)
+
+// AWSConfig configures the delivery of the events of an endpoint to an SNS
+// topic or an SQS queue.
+type AWSConfig struct {
+	// ARN names the topic or queue.
+	ARN string
+	// Region is the region of the topic or queue, that of the ARN if empty.
+	Region string
+	// RegionEndpoint overrides the endpoint of the service.
+	RegionEndpoint string
+	// AccessKey, SecretKey and SessionToken are static credentials. The
+	// default credential chain of the SDK is used without them, as by the
+	// s3 storage driver.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// ParseAWSTarget checks that target is the ARN of an SNS topic or SQS queue,
+// returning it parsed.
+func ParseAWSTarget(target string) (arn.ARN, error) {
+	parsed, err := arn.Parse(target)
+	if err != nil {
+		return arn.ARN{}, err
+	}
+	switch parsed.Service {
+	case sns.ServiceName, sqs.ServiceName:
+	default:
+		return arn.ARN{}, fmt.Errorf("%s is neither an sns topic nor an sqs queue", target)
+	}
+	return parsed, nil
+}
+
+// newAWSClients returns the SNS and SQS clients configured by config, for the
+// topic or queue target.
+func newAWSClients(config AWSConfig, target arn.ARN, timeout time.Duration) (snsiface.SNSAPI, sqsiface.SQSAPI, error) {
+	awsConfig := aws.NewConfig().WithHTTPClient(&http.Client{Timeout: timeout})
+	if config.AccessKey != "" && config.SecretKey != "" {
+		awsConfig.WithCredentials(credentials.NewStaticCredentials(
+			config.AccessKey,
+			config.SecretKey,
+			config.SessionToken,
+		))
+	}
+	region := config.Region
+	if region == "" {
+		region = target.Region
+	}
+	awsConfig.WithRegion(region)
+	if config.RegionEndpoint != "" {
+		awsConfig.WithEndpoint(config.RegionEndpoint)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create new session with aws config: %v", err)
+	}
+	return sns.New(sess), sqs.New(sess), nil
+}
+
+// awsSink implements a single-flight notification endpoint publishing each
+// event as a message to an SNS topic or sending it to an SQS queue, with the
+// repository and action of the event as message attributes for subscription
+// filtering. Like httpSink, it only makes an attempt at delivering events.
+type awsSink struct {
+	target  arn.ARN
+	timeout time.Duration
+	sns     snsiface.SNSAPI
+	sqs     sqsiface.SQSAPI
+
+	mu        sync.Mutex
+	closed    bool
+	queueURL  string
+	listeners []httpStatusListener
+}
+
+// newAWSSink returns an unreliable, single-flight sink delivering events to
+// the topic or queue target with the given clients. Wrap in other sinks for
+// increased reliability.
+func newAWSSink(target arn.ARN, timeout time.Duration, snsClient snsiface.SNSAPI, sqsClient sqsiface.SQSAPI, listeners ...httpStatusListener) *awsSink {
+	return &awsSink{
+		target:    target,
+		timeout:   timeout,
+		sns:       snsClient,
+		sqs:       sqsClient,
+		listeners: listeners,
+	}
+}
+
+// Write makes an attempt to deliver the event, returning an error if it
+// fails. It is the caller's responsibility to retry on error.
+func (as *awsSink) Write(event events.Event) error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if as.closed {
+		return ErrSinkClosed
+	}
+
+	p, err := json.MarshalIndent(Envelope{Events: []events.Event{event}}, "", "   ")
+	if err != nil {
+		for _, listener := range as.listeners {
+			listener.err(err, event)
+		}
+		return fmt.Errorf("%v: error marshaling event envelope: %v", as, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), as.timeout)
+	defer cancel()
+	if as.target.Service == sns.ServiceName {
+		_, err = as.sns.PublishWithContext(ctx, &sns.PublishInput{
+			TopicArn:          aws.String(as.target.String()),
+			Message:           aws.String(string(p)),
+			MessageAttributes: snsAttributes(event),
+		})
+	} else {
+		err = as.sendMessage(ctx, string(p), event)
+	}
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			for _, listener := range as.listeners {
+				listener.failure(reqErr.StatusCode(), event)
+			}
+		} else {
+			for _, listener := range as.listeners {
+				listener.err(err, event)
+			}
+		}
+		return fmt.Errorf("%v: error delivering event: %v", as, err)
+	}
+
+	for _, listener := range as.listeners {
+		listener.success(http.StatusOK, event)
+	}
+	return nil
+}
+
+// sendMessage sends the message body for event to the queue, looking up the
+// URL of the queue on first use.
+func (as *awsSink) sendMessage(ctx context.Context, body string, event events.Event) error {
+	if as.queueURL == "" {
+		out, err := as.sqs.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+			QueueName:              aws.String(as.target.Resource),
+			QueueOwnerAWSAccountId: aws.String(as.target.AccountID),
+		})
+		if err != nil {
+			return err
+		}
+		as.queueURL = aws.StringValue(out.QueueUrl)
+	}
+
+	attributes := make(map[string]*sqs.MessageAttributeValue)
+	for name, value := range eventAttributes(event) {
+		attributes[name] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	_, err := as.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(as.queueURL),
+		MessageBody:       aws.String(body),
+		MessageAttributes: attributes,
+	})
+	return err
+}
+
+func snsAttributes(event events.Event) map[string]*sns.MessageAttributeValue {
+	attributes := make(map[string]*sns.MessageAttributeValue)
+	for name, value := range eventAttributes(event) {
+		attributes[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	return attributes
+}
+
+// eventAttributes returns the message attributes of event, leaving out those
+// which are empty, as the services reject them.
+func eventAttributes(event events.Event) map[string]string {
+	attributes := make(map[string]string)
+	if e, ok := event.(Event); ok {
+		if e.Target.Repository != "" {
+			attributes["repository"] = e.Target.Repository
+		}
+		if e.Action != "" {
+			attributes["action"] = e.Action
+		}
+	}
+	return attributes
+}
+
+// Close the endpoint
+func (as *awsSink) Close() error {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if as.closed {
+		return fmt.Errorf("awssink: already closed")
+	}
+
+	as.closed = true
+	return nil
+}
+
+func (as *awsSink) String() string {
+	return fmt.Sprintf("awsSink{%s}", as.target)
+}
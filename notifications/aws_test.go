@@ -0,0 +1,164 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	events "github.com/docker/go-events"
+)
+
+// mockSNS records the messages published, failing while err is set.
+type mockSNS struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+	err       error
+}
+
+func (m *mockSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...awsrequest.Option) (*sns.PublishOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.published = append(m.published, input)
+	return &sns.PublishOutput{MessageId: aws.String("id")}, nil
+}
+
+// mockSQS records the messages sent to the queue named queue.
+type mockSQS struct {
+	sqsiface.SQSAPI
+	lookups int
+	sent    []*sqs.SendMessageInput
+}
+
+func (m *mockSQS) GetQueueUrlWithContext(ctx aws.Context, input *sqs.GetQueueUrlInput, opts ...awsrequest.Option) (*sqs.GetQueueUrlOutput, error) {
+	m.lookups++
+	if aws.StringValue(input.QueueName) != "queue" || aws.StringValue(input.QueueOwnerAWSAccountId) != "123456789012" {
+		return nil, errors.New("queue does not exist")
+	}
+	return &sqs.GetQueueUrlOutput{QueueUrl: aws.String("https://sqs.us-east-1.amazonaws.com/123456789012/queue")}, nil
+}
+
+func (m *mockSQS) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...awsrequest.Option) (*sqs.SendMessageOutput, error) {
+	m.sent = append(m.sent, input)
+	return &sqs.SendMessageOutput{MessageId: aws.String("id")}, nil
+}
+
+// checkEnvelope checks that body is the envelope of event.
+func checkEnvelope(t *testing.T, body string, event Event) {
+	t.Helper()
+	var envelope struct {
+		Events []Event `json:"events"`
+	}
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+		t.Fatalf("error decoding message body: %v", err)
+	}
+	if len(envelope.Events) != 1 || envelope.Events[0].ID != event.ID || envelope.Events[0].Target.Repository != event.Target.Repository {
+		t.Fatalf("unexpected message body: %s", body)
+	}
+}
+
+func TestAWSSinkSNS(t *testing.T) {
+	target, err := ParseAWSTarget("arn:aws:sns:us-east-1:123456789012:registry-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &mockSNS{}
+	metrics := newSafeMetrics(t.Name())
+	sink := newAWSSink(target, time.Second, client, nil, metrics.httpStatusListener())
+
+	event := createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error publishing event: %v", err)
+	}
+	if len(client.published) != 1 {
+		t.Fatalf("expected a message published, got %d", len(client.published))
+	}
+	published := client.published[0]
+	if aws.StringValue(published.TopicArn) != target.String() {
+		t.Fatalf("message published to %s", aws.StringValue(published.TopicArn))
+	}
+	checkEnvelope(t, aws.StringValue(published.Message), event)
+	attributes := make(map[string]string)
+	for name, value := range published.MessageAttributes {
+		if aws.StringValue(value.DataType) != "String" {
+			t.Fatalf("attribute %s has data type %s", name, aws.StringValue(value.DataType))
+		}
+		attributes[name] = aws.StringValue(value.StringValue)
+	}
+	if expected := map[string]string{"repository": "library/test", "action": "push"}; !reflect.DeepEqual(attributes, expected) {
+		t.Fatalf("unexpected message attributes %v, expected %v", attributes, expected)
+	}
+
+	// Failures are reported to the caller, which retries them.
+	client.err = errors.New("throttled")
+	if err := sink.Write(event); err == nil {
+		t.Fatal("expected an error when publishing fails")
+	}
+	if metrics.Successes != 1 || metrics.Errors != 1 {
+		t.Fatalf("unexpected metrics: %d successes, %d errors", metrics.Successes, metrics.Errors)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(event); err != ErrSinkClosed {
+		t.Fatalf("expected a closed sink error, got %v", err)
+	}
+}
+
+func TestAWSSinkSQS(t *testing.T) {
+	target, err := ParseAWSTarget("arn:aws:sqs:us-east-1:123456789012:queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &mockSQS{}
+	sink := newAWSSink(target, time.Second, nil, client)
+
+	var sent []events.Event
+	for _, action := range []string{"push", "delete"} {
+		event := createTestEvent(action, "library/test", schema1.MediaTypeSignedManifest)
+		if err := sink.Write(event); err != nil {
+			t.Fatalf("unexpected error sending event: %v", err)
+		}
+		sent = append(sent, event)
+	}
+	if client.lookups != 1 {
+		t.Fatalf("expected the queue url looked up once, got %d lookups", client.lookups)
+	}
+	if len(client.sent) != len(sent) {
+		t.Fatalf("expected %d messages sent, got %d", len(sent), len(client.sent))
+	}
+	for i, message := range client.sent {
+		event := sent[i].(Event)
+		if aws.StringValue(message.QueueUrl) != "https://sqs.us-east-1.amazonaws.com/123456789012/queue" {
+			t.Fatalf("message sent to %s", aws.StringValue(message.QueueUrl))
+		}
+		checkEnvelope(t, aws.StringValue(message.MessageBody), event)
+		if action := aws.StringValue(message.MessageAttributes["action"].StringValue); action != event.Action {
+			t.Fatalf("message attribute action %q, expected %q", action, event.Action)
+		}
+		if repository := aws.StringValue(message.MessageAttributes["repository"].StringValue); repository != "library/test" {
+			t.Fatalf("message attribute repository %q", repository)
+		}
+	}
+}
+
+func TestParseAWSTarget(t *testing.T) {
+	for _, target := range []string{
+		"https://example.com/events",
+		"arn:aws:s3:::bucket",
+	} {
+		if _, err := ParseAWSTarget(target); err == nil {
+			t.Errorf("expected an error parsing %s", target)
+		}
+	}
+}
@@ -6,10 +6,14 @@ import (
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/uuid"
 	events "github.com/docker/go-events"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type bridge struct {
@@ -68,9 +72,34 @@ func (b *bridge) ManifestPushed(repo reference.Named, sm distribution.Manifest,
 			break
 		}
 	}
+	setManifestContents(manifestEvent, sm)
 	return b.sink.Write(*manifestEvent)
 }
 
+// setManifestContents records the configuration of an image manifest, or the
+// platform specific manifests of a manifest list, on the target of event, so
+// that consumers such as scanners need not fetch the manifest.
+func setManifestContents(event *Event, sm distribution.Manifest) {
+	switch m := sm.(type) {
+	case *schema2.DeserializedManifest:
+		event.Target.Config = m.Config.Digest
+	case *ocischema.DeserializedManifest:
+		event.Target.Config = m.Config.Digest
+	case *manifestlist.DeserializedManifestList:
+		for _, md := range m.Manifests {
+			desc := md.Descriptor
+			desc.Platform = &v1.Platform{
+				Architecture: md.Platform.Architecture,
+				OS:           md.Platform.OS,
+				OSVersion:    md.Platform.OSVersion,
+				OSFeatures:   md.Platform.OSFeatures,
+				Variant:      md.Platform.Variant,
+			}
+			event.Target.Manifests = append(event.Target.Manifests, desc)
+		}
+	}
+}
+
 func (b *bridge) ManifestPulled(repo reference.Named, sm distribution.Manifest, options ...distribution.ManifestServiceOption) error {
 	manifestEvent, err := b.createManifestEvent(EventActionPull, repo, sm)
 	if err != nil {
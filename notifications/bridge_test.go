@@ -1,10 +1,13 @@
 package notifications
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
 	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/distribution/distribution/v3/manifest/schema2"
 	"github.com/distribution/distribution/v3/reference"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	"github.com/distribution/distribution/v3/uuid"
@@ -20,6 +23,7 @@ var (
 	source = SourceRecord{
 		Addr:       "remote.test",
 		InstanceID: uuid.Generate().String(),
+		Metadata:   map[string]string{"datacenter": "test-dc"},
 	}
 	ub = mustUB(v2.NewURLBuilderFromString("http://test.example.com/", false))
 
@@ -88,6 +92,97 @@ func TestEventBridgeManifestPushedWithTag(t *testing.T) {
 	}
 }
 
+func TestEventBridgeImageManifestPushed(t *testing.T) {
+	config := distribution.Descriptor{
+		MediaType: schema2.MediaTypeImageConfig,
+		Digest:    digest.FromString("config"),
+		Size:      6,
+	}
+	sm, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    config,
+		Layers: []distribution.Descriptor{{
+			MediaType: schema2.MediaTypeLayer,
+			Digest:    digest.FromString("layer"),
+			Size:      5,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating manifest: %v", err)
+	}
+
+	var pushed Event
+	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
+		pushed = event.(Event)
+		return nil
+	}))
+
+	repoRef, _ := reference.WithName(repo)
+	if err := l.ManifestPushed(repoRef, sm); err != nil {
+		t.Fatalf("unexpected error notifying manifest push: %v", err)
+	}
+
+	if pushed.Target.Config != config.Digest {
+		t.Fatalf("unexpected config digest: %q != %q", pushed.Target.Config, config.Digest)
+	}
+	if len(pushed.Target.Manifests) != 0 {
+		t.Fatalf("unexpected manifests: %v", pushed.Target.Manifests)
+	}
+}
+
+func TestEventBridgeManifestListPushed(t *testing.T) {
+	descriptors := []manifestlist.ManifestDescriptor{
+		{
+			Descriptor: distribution.Descriptor{
+				MediaType: schema2.MediaTypeManifest,
+				Digest:    digest.FromString("amd64"),
+				Size:      5,
+			},
+			Platform: manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+		},
+		{
+			Descriptor: distribution.Descriptor{
+				MediaType: schema2.MediaTypeManifest,
+				Digest:    digest.FromString("arm64"),
+				Size:      5,
+			},
+			Platform: manifestlist.PlatformSpec{Architecture: "arm64", OS: "linux", Variant: "v8"},
+		},
+	}
+	sm, err := manifestlist.FromDescriptors(descriptors)
+	if err != nil {
+		t.Fatalf("unexpected error creating manifest list: %v", err)
+	}
+
+	var pushed Event
+	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
+		pushed = event.(Event)
+		return nil
+	}))
+
+	repoRef, _ := reference.WithName(repo)
+	if err := l.ManifestPushed(repoRef, sm); err != nil {
+		t.Fatalf("unexpected error notifying manifest push: %v", err)
+	}
+
+	if pushed.Target.Config != "" {
+		t.Fatalf("unexpected config digest: %q", pushed.Target.Config)
+	}
+	if len(pushed.Target.Manifests) != len(descriptors) {
+		t.Fatalf("unexpected number of manifests %v != %v", len(pushed.Target.Manifests), len(descriptors))
+	}
+	for i, desc := range pushed.Target.Manifests {
+		expected := descriptors[i]
+		if desc.Digest != expected.Digest || desc.MediaType != expected.MediaType {
+			t.Fatalf("unexpected manifest: %v != %v", desc, expected.Descriptor)
+		}
+		if desc.Platform == nil || desc.Platform.Architecture != expected.Platform.Architecture ||
+			desc.Platform.OS != expected.Platform.OS || desc.Platform.Variant != expected.Platform.Variant {
+			t.Fatalf("unexpected platform: %v != %v", desc.Platform, expected.Platform)
+		}
+	}
+}
+
 func TestEventBridgeManifestPulledWithTag(t *testing.T) {
 	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
 		checkCommonManifest(t, EventActionPull, event)
@@ -164,7 +259,7 @@ func createTestEnv(t *testing.T, fn testSinkFn) Listener {
 }
 
 func checkDeleted(t *testing.T, action string, event events.Event) {
-	if event.(Event).Source != source {
+	if !reflect.DeepEqual(event.(Event).Source, source) {
 		t.Fatalf("source not equal: %#v != %#v", event.(Event).Source, source)
 	}
 
@@ -210,7 +305,7 @@ func checkCommonManifest(t *testing.T, action string, event events.Event) {
 }
 
 func checkCommon(t *testing.T, event events.Event) {
-	if event.(Event).Source != source {
+	if !reflect.DeepEqual(event.(Event).Source, source) {
 		t.Fatalf("source not equal: %#v != %#v", event.(Event).Source, source)
 	}
 
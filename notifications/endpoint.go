@@ -18,6 +18,22 @@ type EndpointConfig struct {
 	IgnoredMediaTypes []string
 	Transport         *http.Transport `json:"-"`
 	Ignore            configuration.Ignore
+
+	// QueueSize bounds the number of queued events. If zero, the queue is
+	// unbounded and drained by a single worker.
+	QueueSize int
+	// Workers is the number of concurrent deliveries to a bounded queue.
+	Workers int
+	// Overflow is the policy applied when the bounded queue is full, either
+	// OverflowBlock or OverflowDrop.
+	Overflow string
+	// BlockTimeout is the maximum time a write blocks on a full queue with
+	// OverflowBlock.
+	BlockTimeout time.Duration
+	// Repositories are the patterns, as matched by path.Match, of the
+	// repositories whose events are delivered to the endpoint. The events of
+	// every repository are delivered if empty.
+	Repositories []string
 }
 
 // defaults set any zero-valued fields to a reasonable default.
@@ -37,6 +53,20 @@ func (ec *EndpointConfig) defaults() {
 	if ec.Transport == nil {
 		ec.Transport = http.DefaultTransport.(*http.Transport)
 	}
+
+	if ec.QueueSize > 0 {
+		if ec.Workers <= 0 {
+			ec.Workers = 1
+		}
+
+		if ec.Overflow == "" {
+			ec.Overflow = OverflowBlock
+		}
+
+		if ec.BlockTimeout <= 0 {
+			ec.BlockTimeout = time.Second
+		}
+	}
 }
 
 // Endpoint is a reliable, queued, thread-safe sink that notify external http
@@ -54,6 +84,30 @@ type Endpoint struct {
 
 // NewEndpoint returns a running endpoint, ready to receive events.
 func NewEndpoint(name, url string, config EndpointConfig) *Endpoint {
+	return newEndpoint(name, url, config, (*Endpoint).newHTTPSink)
+}
+
+// NewAWSEndpoint returns a running endpoint delivering events to the SNS
+// topic or SQS queue configured by awsConfig, ready to receive events. Its URL
+// is the ARN of the topic or queue.
+func NewAWSEndpoint(name string, awsConfig AWSConfig, config EndpointConfig) (*Endpoint, error) {
+	target, err := ParseAWSTarget(awsConfig.ARN)
+	if err != nil {
+		return nil, err
+	}
+	config.defaults()
+	snsClient, sqsClient, err := newAWSClients(awsConfig, target, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newEndpoint(name, awsConfig.ARN, config, func(e *Endpoint) events.Sink {
+		return newAWSSink(target, e.Timeout, snsClient, sqsClient, e.metrics.httpStatusListener())
+	}), nil
+}
+
+// newEndpoint returns a running endpoint delivering events through the sinks
+// returned by newSink.
+func newEndpoint(name, url string, config EndpointConfig, newSink func(*Endpoint) events.Sink) *Endpoint {
 	var endpoint Endpoint
 	endpoint.name = name
 	endpoint.url = url
@@ -61,19 +115,35 @@ func NewEndpoint(name, url string, config EndpointConfig) *Endpoint {
 	endpoint.defaults()
 	endpoint.metrics = newSafeMetrics(name)
 
-	// Configures the inmemory queue, retry, http pipeline.
-	endpoint.Sink = newHTTPSink(
-		endpoint.url, endpoint.Timeout, endpoint.Headers,
-		endpoint.Transport, endpoint.metrics.httpStatusListener())
-	endpoint.Sink = events.NewRetryingSink(endpoint.Sink, events.NewBreaker(endpoint.Threshold, endpoint.Backoff))
-	endpoint.Sink = newEventQueue(endpoint.Sink, endpoint.metrics.eventQueueListener())
+	// Configures the inmemory queue, retry, delivery pipeline.
+	if endpoint.QueueSize > 0 {
+		// Each worker has its own single-flight sink, while the
+		// breaker is shared so that the endpoint backs off as a whole.
+		breaker := events.NewBreaker(endpoint.Threshold, endpoint.Backoff)
+		sinks := make([]events.Sink, endpoint.Workers)
+		for i := range sinks {
+			sinks[i] = events.NewRetryingSink(newSink(&endpoint), breaker)
+		}
+		endpoint.Sink = newBoundedEventQueue(sinks, endpoint.QueueSize, endpoint.Overflow, endpoint.BlockTimeout, endpoint.metrics.boundedEventQueueListener())
+	} else {
+		endpoint.Sink = events.NewRetryingSink(newSink(&endpoint), events.NewBreaker(endpoint.Threshold, endpoint.Backoff))
+		endpoint.Sink = newEventQueue(endpoint.Sink, endpoint.metrics.eventQueueListener())
+	}
 	mediaTypes := append(config.Ignore.MediaTypes, config.IgnoredMediaTypes...)
 	endpoint.Sink = newIgnoredSink(endpoint.Sink, mediaTypes, config.Ignore.Actions)
+	endpoint.Sink = newRepositoriesSink(endpoint.Sink, config.Repositories)
 
 	register(&endpoint)
 	return &endpoint
 }
 
+// newHTTPSink returns an http sink delivering to the endpoint.
+func (e *Endpoint) newHTTPSink() events.Sink {
+	return newHTTPSink(
+		e.url, e.Timeout, e.Headers,
+		e.Transport, e.metrics.httpStatusListener())
+}
+
 // Name returns the name of the endpoint, generally used for debugging.
 func (e *Endpoint) Name() string {
 	return e.name
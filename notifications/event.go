@@ -6,6 +6,7 @@ import (
 
 	"github.com/distribution/distribution/v3"
 	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
 )
 
 // EventAction constants used in action field of Event.
@@ -75,6 +76,14 @@ type Event struct {
 
 		// References provides the references descriptors.
 		References []distribution.Descriptor `json:"references,omitempty"`
+
+		// Config is the digest of the configuration of a pushed image
+		// manifest.
+		Config digest.Digest `json:"config,omitempty"`
+
+		// Manifests describes the platform specific manifests of a pushed
+		// manifest list or image index.
+		Manifests []distribution.Descriptor `json:"manifests,omitempty"`
 	} `json:"target,omitempty"`
 
 	// Request covers the request that generated the event.
@@ -141,6 +150,10 @@ type SourceRecord struct {
 	// InstanceID identifies a running instance of an application. Changes
 	// after each restart.
 	InstanceID string `json:"instanceID,omitempty"`
+
+	// Metadata holds static fields set by the operator of the registry,
+	// such as the datacenter or cluster of the node.
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 var (
@@ -148,4 +161,8 @@ var (
 	// closed. If encountered, the error should be considered terminal and
 	// retries will not be successful.
 	ErrSinkClosed = fmt.Errorf("sink: closed")
+
+	// ErrQueueFull is returned if a write is issued to a bounded queue which
+	// is full, in which case the event is dropped.
+	ErrQueueFull = fmt.Errorf("sink: queue full")
 )
@@ -3,6 +3,7 @@ package notifications
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 
@@ -251,6 +252,25 @@ func (rl *repositoryListener) Tags(ctx context.Context) distribution.TagService
 	}
 }
 
+// HasTags passes through to the wrapped tag service, falling back to listing
+// its tags.
+func (tagSL *tagServiceListener) HasTags(ctx context.Context) (bool, error) {
+	if checker, ok := tagSL.TagService.(distribution.TagChecker); ok {
+		return checker.HasTags(ctx)
+	}
+	tags, err := tagSL.TagService.All(ctx)
+	return len(tags) > 0, err
+}
+
+// PushTime passes through to the wrapped tag service, if it records push
+// times.
+func (tagSL *tagServiceListener) PushTime(ctx context.Context, tag string) (time.Time, error) {
+	if provider, ok := tagSL.TagService.(distribution.TagPushTimeProvider); ok {
+		return provider.PushTime(ctx, tag)
+	}
+	return time.Time{}, distribution.ErrUnsupported
+}
+
 func (tagSL *tagServiceListener) Untag(ctx context.Context, tag string) error {
 	if err := tagSL.TagService.Untag(ctx, tag); err != nil {
 		return err
@@ -29,6 +29,7 @@ type EndpointMetrics struct {
 	Successes int            // total events written successfully
 	Failures  int            // total events failed
 	Errors    int            // total events errored
+	Dropped   int            // total events dropped because the queue was full
 	Statuses  map[string]int // status code histogram, per call event
 }
 
@@ -63,6 +64,14 @@ func (sm *safeMetrics) eventQueueListener() eventQueueListener {
 	}
 }
 
+// boundedEventQueueListener returns a listener that maintains queue related
+// counters, including dropped events.
+func (sm *safeMetrics) boundedEventQueueListener() boundedEventQueueListener {
+	return &endpointMetricsEventQueueListener{
+		safeMetrics: sm,
+	}
+}
+
 // endpointMetricsHTTPStatusListener increments counters related to http sinks
 // for the relevant events.
 type endpointMetricsHTTPStatusListener struct {
@@ -123,6 +132,14 @@ func (eqc *endpointMetricsEventQueueListener) egress(event events.Event) {
 	pendingGauge.WithValues(eqc.EndpointName).Dec(1)
 }
 
+func (eqc *endpointMetricsEventQueueListener) dropped(event events.Event) {
+	eqc.Lock()
+	defer eqc.Unlock()
+	eqc.Dropped++
+
+	eventsCounter.WithValues("Dropped", eqc.EndpointName).Inc(1)
+}
+
 // endpoints is global registry of endpoints used to report metrics to expvar
 var endpoints struct {
 	registered []*Endpoint
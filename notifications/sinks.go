@@ -3,7 +3,9 @@ package notifications
 import (
 	"container/list"
 	"fmt"
+	"path"
 	"sync"
+	"time"
 
 	events "github.com/docker/go-events"
 	"github.com/sirupsen/logrus"
@@ -119,6 +121,136 @@ func (eq *eventQueue) next() events.Event {
 	return block
 }
 
+// Overflow policies of a bounded event queue, applied when an event is
+// written to a full queue.
+const (
+	// OverflowBlock blocks the writer until the event can be queued or the
+	// block timeout expires.
+	OverflowBlock = "block"
+
+	// OverflowDrop drops the event immediately.
+	OverflowDrop = "drop"
+)
+
+// boundedEventQueue accepts up to a fixed number of messages into a queue for
+// asynchronous consumption by a fixed number of workers, each writing to its
+// own sink. Unlike eventQueue, it does not grow with a slow sink: once full,
+// writes either block for up to blockTimeout or are dropped right away,
+// depending on the overflow policy. Events may be delivered out of order when
+// there is more than one worker.
+type boundedEventQueue struct {
+	events       chan events.Event
+	sinks        []events.Sink
+	listeners    []boundedEventQueueListener
+	overflow     string
+	blockTimeout time.Duration
+	wg           sync.WaitGroup
+	mu           sync.RWMutex
+	closed       bool
+}
+
+// boundedEventQueueListener is called when various events happen on a
+// bounded queue.
+type boundedEventQueueListener interface {
+	eventQueueListener
+	dropped(event events.Event)
+}
+
+// newBoundedEventQueue returns a queue holding up to size events, consumed by
+// one worker per sink.
+func newBoundedEventQueue(sinks []events.Sink, size int, overflow string, blockTimeout time.Duration, listeners ...boundedEventQueueListener) *boundedEventQueue {
+	eq := boundedEventQueue{
+		events:       make(chan events.Event, size),
+		sinks:        sinks,
+		listeners:    listeners,
+		overflow:     overflow,
+		blockTimeout: blockTimeout,
+	}
+
+	for _, sink := range sinks {
+		eq.wg.Add(1)
+		go eq.run(sink)
+	}
+	return &eq
+}
+
+// Write accepts the event into the queue, failing if the queue has been
+// closed or if it is full according to the overflow policy.
+func (eq *boundedEventQueue) Write(event events.Event) error {
+	eq.mu.RLock()
+	defer eq.mu.RUnlock()
+
+	if eq.closed {
+		return ErrSinkClosed
+	}
+
+	for _, listener := range eq.listeners {
+		listener.ingress(event)
+	}
+
+	select {
+	case eq.events <- event:
+		return nil
+	default:
+	}
+
+	if eq.overflow == OverflowBlock {
+		timer := time.NewTimer(eq.blockTimeout)
+		defer timer.Stop()
+
+		select {
+		case eq.events <- event:
+			return nil
+		case <-timer.C:
+		}
+	}
+
+	for _, listener := range eq.listeners {
+		listener.egress(event)
+		listener.dropped(event)
+	}
+	return ErrQueueFull
+}
+
+// Close shuts down the event queue, flushing queued events to the sinks
+// before closing them.
+func (eq *boundedEventQueue) Close() error {
+	eq.mu.Lock()
+	if eq.closed {
+		eq.mu.Unlock()
+		return fmt.Errorf("eventqueue: already closed")
+	}
+	eq.closed = true
+	close(eq.events)
+	eq.mu.Unlock()
+
+	eq.wg.Wait()
+
+	var firstErr error
+	for _, sink := range eq.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// run is the goroutine of a worker, flushing events to its sink until the
+// queue is closed.
+func (eq *boundedEventQueue) run(sink events.Sink) {
+	defer eq.wg.Done()
+
+	for event := range eq.events {
+		if err := sink.Write(event); err != nil {
+			logrus.Warnf("eventqueue: error writing events to %v, these events will be lost: %v", sink, err)
+		}
+
+		for _, listener := range eq.listeners {
+			listener.egress(event)
+		}
+	}
+}
+
 // ignoredSink discards events with ignored target media types and actions.
 // passes the rest along.
 type ignoredSink struct {
@@ -162,3 +294,33 @@ func (imts *ignoredSink) Write(event events.Event) error {
 func (imts *ignoredSink) Close() error {
 	return nil
 }
+
+// repositoriesSink passes along the events of the repositories matching its
+// patterns, discarding the rest.
+type repositoriesSink struct {
+	events.Sink
+	patterns []string
+}
+
+func newRepositoriesSink(sink events.Sink, patterns []string) events.Sink {
+	if len(patterns) == 0 {
+		return sink
+	}
+
+	return &repositoriesSink{
+		Sink:     sink,
+		patterns: patterns,
+	}
+}
+
+// Write passes the event along if its target repository matches a pattern,
+// discarding it otherwise.
+func (rs *repositoriesSink) Write(event events.Event) error {
+	repository := event.(Event).Target.Repository
+	for _, pattern := range rs.patterns {
+		if matched, _ := path.Match(pattern, repository); matched {
+			return rs.Sink.Write(event)
+		}
+	}
+	return nil
+}
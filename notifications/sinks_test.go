@@ -64,6 +64,152 @@ func TestEventQueue(t *testing.T) {
 	}
 }
 
+func TestBoundedEventQueueWorkers(t *testing.T) {
+	const (
+		nevents  = 10
+		nworkers = 3
+	)
+	var ts testSink
+	gate := newGatedSinks(&ts, nworkers)
+	metrics := newSafeMetrics("")
+	eq := newBoundedEventQueue(gate.sinks, nevents, OverflowDrop, 0, metrics.boundedEventQueueListener())
+
+	for i := 0; i < nevents; i++ {
+		if err := eq.Write(createTestEvent("push", "library/test", "blob")); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+
+	// Exactly one event per worker is delivered at a time
+	for i := 0; i < nworkers; i++ {
+		<-gate.started
+	}
+	select {
+	case <-gate.started:
+		t.Fatalf("more than %d events delivered concurrently", nworkers)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(gate.release)
+	checkClose(t, eq)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if ts.count != nevents {
+		t.Fatalf("events did not make it to the sink: %d != %d", ts.count, nevents)
+	}
+
+	if !ts.closed {
+		t.Fatalf("sink should have been closed")
+	}
+
+	if metrics.Pending != 0 || metrics.Dropped != 0 {
+		t.Fatalf("unexpected pending or dropped count: %d, %d", metrics.Pending, metrics.Dropped)
+	}
+}
+
+func TestBoundedEventQueueDrop(t *testing.T) {
+	var ts testSink
+	gate := newGatedSinks(&ts, 1)
+	metrics := newSafeMetrics("")
+	eq := newBoundedEventQueue(gate.sinks, 2, OverflowDrop, 0, metrics.boundedEventQueueListener())
+
+	// One event is held by the worker and two fill the queue
+	if err := eq.Write(createTestEvent("push", "library/test", "blob")); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+	<-gate.started
+	for i := 0; i < 2; i++ {
+		if err := eq.Write(createTestEvent("push", "library/test", "blob")); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+
+	start := time.Now()
+	if err := eq.Write(createTestEvent("push", "library/test", "blob")); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull writing to a full queue, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("dropping an event blocked for %v", elapsed)
+	}
+
+	close(gate.release)
+	checkClose(t, eq)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if ts.count != 3 {
+		t.Fatalf("unexpected number of events delivered: %d != %d", ts.count, 3)
+	}
+
+	if metrics.Events != 4 || metrics.Dropped != 1 || metrics.Pending != 0 {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+}
+
+func TestBoundedEventQueueBlock(t *testing.T) {
+	const blockTimeout = 100 * time.Millisecond
+	var ts testSink
+	gate := newGatedSinks(&ts, 1)
+	metrics := newSafeMetrics("")
+	eq := newBoundedEventQueue(gate.sinks, 1, OverflowBlock, blockTimeout, metrics.boundedEventQueueListener())
+
+	// One event is held by the worker and one fills the queue
+	if err := eq.Write(createTestEvent("push", "library/test", "blob")); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+	<-gate.started
+	if err := eq.Write(createTestEvent("push", "library/test", "blob")); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+
+	// The writer is blocked until the timeout expires
+	start := time.Now()
+	if err := eq.Write(createTestEvent("push", "library/test", "blob")); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull writing to a full queue, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < blockTimeout {
+		t.Fatalf("write returned after %v, before the block timeout", elapsed)
+	}
+
+	// The writer is unblocked once the worker makes room
+	errs := make(chan error)
+	go func() {
+		errs <- eq.Write(createTestEvent("push", "library/test", "blob"))
+	}()
+	select {
+	case err := <-errs:
+		t.Fatalf("write to a full queue returned early: %v", err)
+	case <-time.After(blockTimeout / 2):
+	}
+	gate.release <- struct{}{}
+	if err := <-errs; err != nil {
+		t.Fatalf("error writing event after the queue drained: %v", err)
+	}
+
+	close(gate.release)
+	checkClose(t, eq)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if ts.count != 3 {
+		t.Fatalf("unexpected number of events delivered: %d != %d", ts.count, 3)
+	}
+
+	if metrics.Events != 4 || metrics.Dropped != 1 || metrics.Pending != 0 {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+}
+
 func TestIgnoredSink(t *testing.T) {
 	blob := createTestEvent("push", "library/test", "blob")
 	manifest := createTestEvent("pull", "library/test", "manifest")
@@ -122,6 +268,45 @@ func TestIgnoredSink(t *testing.T) {
 	}
 }
 
+func TestRepositoriesSink(t *testing.T) {
+	teamA, teamB, everyone := &testSink{}, &testSink{}, &testSink{}
+	broadcaster := events.NewBroadcaster(
+		newRepositoriesSink(teamA, []string{"teamA/*"}),
+		newRepositoriesSink(teamB, []string{"teamB/*", "shared"}),
+		newRepositoriesSink(everyone, nil),
+	)
+
+	for _, repository := range []string{"teamA/app", "teamA/tools/app", "shared", "teamAB/app"} {
+		if err := broadcaster.Write(createTestEvent("push", repository, "blob")); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+	if err := broadcaster.Close(); err != nil {
+		t.Fatalf("error closing broadcaster: %v", err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		sink     *testSink
+		count    int
+		expected string
+	}{
+		// * does not match the slashes of nested namespaces.
+		{"teamA", teamA, 1, "teamA/app"},
+		{"teamB", teamB, 1, "shared"},
+		{"everyone", everyone, 4, "teamAB/app"},
+	} {
+		c.sink.mu.Lock()
+		if c.sink.count != c.count {
+			t.Fatalf("%s: unexpected number of events delivered: %d != %d", c.name, c.sink.count, c.count)
+		}
+		if repository := c.sink.event.(Event).Target.Repository; repository != c.expected {
+			t.Fatalf("%s: unexpected event for %s, expected %s", c.name, repository, c.expected)
+		}
+		c.sink.mu.Unlock()
+	}
+}
+
 type testSink struct {
 	event  events.Event
 	count  int
@@ -156,6 +341,36 @@ func (ds *delayedSink) Write(event events.Event) error {
 	return ds.Sink.Write(event)
 }
 
+// gatedSinks are sinks which signal started when an event is written to them,
+// then hold it until signaled on release.
+type gatedSinks struct {
+	sinks   []events.Sink
+	started chan struct{}
+	release chan struct{}
+}
+
+func newGatedSinks(sink events.Sink, n int) *gatedSinks {
+	gs := &gatedSinks{
+		started: make(chan struct{}, 100),
+		release: make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		gs.sinks = append(gs.sinks, &gatedSink{Sink: sink, gatedSinks: gs})
+	}
+	return gs
+}
+
+type gatedSink struct {
+	events.Sink
+	*gatedSinks
+}
+
+func (gs *gatedSink) Write(event events.Event) error {
+	gs.started <- struct{}{}
+	<-gs.release
+	return gs.Sink.Write(event)
+}
+
 func checkClose(t *testing.T, sink events.Sink) {
 	if err := sink.Close(); err != nil {
 		t.Fatalf("unexpected error closing: %v", err)
@@ -54,6 +54,15 @@ type RepositoryEnumerator interface {
 	Enumerate(ctx context.Context, ingester func(string) error) error
 }
 
+// RepositoryWalker streams the repositories of a namespace.
+type RepositoryWalker interface {
+	// EnumerateRepositories calls fn with the name of each repository as it
+	// is found, in catalog order, without collecting the catalog first. It
+	// stops early, returning the error, if fn returns an error or ctx is
+	// done.
+	EnumerateRepositories(ctx context.Context, fn func(repo string) error) error
+}
+
 // RepositoryRemover removes given repository
 type RepositoryRemover interface {
 	Remove(ctx context.Context, name reference.Named) error
@@ -113,6 +122,14 @@ type Repository interface {
 	Tags(ctx context.Context) TagService
 }
 
+// RepositoryStorageNamer is implemented by repositories stored under a name
+// other than the one they were requested by, such as repositories renamed by
+// a registry middleware.
+type RepositoryStorageNamer interface {
+	// StorageName returns the name the repository is stored under.
+	StorageName() reference.Named
+}
+
 // TODO(stevvooe): Must add close methods to all these. May want to change the
 // way instances are created to better reflect internal dependency
 // relationships.
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	gorhandlers "github.com/gorilla/handlers"
+)
+
+// accessLogFormatters are the formatters of the access log formats other than
+// the Combined Log Format, by name.
+var accessLogFormatters = map[string]gorhandlers.LogFormatter{
+	"json": writeJSONAccessLog,
+	"text": writeTextAccessLog,
+}
+
+// configureAccessLog wraps handler so that it logs each request it serves, in
+// the configured format and to the configured output. handler is returned
+// unwrapped when access logging is disabled or restricted to slow requests,
+// which the application logs itself.
+func configureAccessLog(config *configuration.Configuration, handler http.Handler) (http.Handler, error) {
+	accessLog := config.Log.AccessLog
+	if accessLog.Disabled || accessLog.SlowThreshold > 0 {
+		return handler, nil
+	}
+
+	var out io.Writer
+	switch accessLog.Output {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(accessLog.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log: %v", err)
+		}
+		out = f
+	}
+
+	switch accessLog.Format {
+	case "", "combined":
+		return gorhandlers.CombinedLoggingHandler(out, handler), nil
+	default:
+		formatter, ok := accessLogFormatters[accessLog.Format]
+		if !ok {
+			return nil, fmt.Errorf("unsupported access log format: %q", accessLog.Format)
+		}
+		return gorhandlers.CustomLoggingHandler(out, handler, formatter), nil
+	}
+}
+
+// accessLogEntry holds the fields of an access log line, named after the
+// fields of the registry logger.
+type accessLogEntry struct {
+	Time       string `json:"time"`
+	RemoteAddr string `json:"request.remoteaddr"`
+	Method     string `json:"request.method"`
+	URI        string `json:"request.uri"`
+	Proto      string `json:"request.proto"`
+	Referer    string `json:"request.referer,omitempty"`
+	UserAgent  string `json:"request.useragent,omitempty"`
+	Status     int    `json:"response.status"`
+	Written    int    `json:"response.written"`
+	Duration   string `json:"response.duration"`
+}
+
+// newAccessLogEntry returns the access log entry of a request served. It is
+// called once the request is served, timing it from params.TimeStamp.
+func newAccessLogEntry(params gorhandlers.LogFormatterParams) accessLogEntry {
+	remoteAddr, _, err := net.SplitHostPort(params.Request.RemoteAddr)
+	if err != nil {
+		remoteAddr = params.Request.RemoteAddr
+	}
+	uri := params.Request.RequestURI
+	if uri == "" {
+		uri = params.URL.RequestURI()
+	}
+	return accessLogEntry{
+		Time:       params.TimeStamp.Format(time.RFC3339Nano),
+		RemoteAddr: remoteAddr,
+		Method:     params.Request.Method,
+		URI:        uri,
+		Proto:      params.Request.Proto,
+		Referer:    params.Request.Referer(),
+		UserAgent:  params.Request.UserAgent(),
+		Status:     params.StatusCode,
+		Written:    params.Size,
+		Duration:   time.Since(params.TimeStamp).String(),
+	}
+}
+
+// writeJSONAccessLog writes the access log line of a request as a JSON
+// object.
+func writeJSONAccessLog(w io.Writer, params gorhandlers.LogFormatterParams) {
+	b, err := json.Marshal(newAccessLogEntry(params))
+	if err != nil {
+		return
+	}
+	w.Write(append(b, '\n'))
+}
+
+// writeTextAccessLog writes the access log line of a request as key=value
+// pairs, quoting the values which may hold spaces.
+func writeTextAccessLog(w io.Writer, params gorhandlers.LogFormatterParams) {
+	e := newAccessLogEntry(params)
+	fmt.Fprintf(w, "time=%s request.remoteaddr=%s request.method=%s request.uri=%q request.proto=%s request.referer=%q request.useragent=%q response.status=%d response.written=%d response.duration=%s\n",
+		e.Time, e.RemoteAddr, e.Method, e.URI, e.Proto, e.Referer, e.UserAgent, e.Status, e.Written, e.Duration)
+}
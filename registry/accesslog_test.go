@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("accepted"))
+	})
+
+	for _, tc := range []struct {
+		format string
+		check  func(t *testing.T, line string)
+	}{
+		{
+			format: "combined",
+			check: func(t *testing.T, line string) {
+				combined := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "PUT /v2/foo/bar/manifests/latest\?x=1 HTTP/1\.1" 202 8 "http://example\.com/" "test agent"$`)
+				if !combined.MatchString(line) {
+					t.Errorf("malformed combined access log line: %q", line)
+				}
+			},
+		},
+		{
+			format: "json",
+			check: func(t *testing.T, line string) {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("malformed json access log line %q: %v", line, err)
+				}
+				for field, expected := range map[string]interface{}{
+					"request.remoteaddr": "192.0.2.1",
+					"request.method":     "PUT",
+					"request.uri":        "/v2/foo/bar/manifests/latest?x=1",
+					"request.proto":      "HTTP/1.1",
+					"request.referer":    "http://example.com/",
+					"request.useragent":  "test agent",
+					"response.status":    float64(http.StatusAccepted),
+					"response.written":   float64(len("accepted")),
+				} {
+					if entry[field] != expected {
+						t.Errorf("unexpected %s of json access log line: %v, expected %v", field, entry[field], expected)
+					}
+				}
+				for _, field := range []string{"time", "response.duration"} {
+					if _, ok := entry[field].(string); !ok {
+						t.Errorf("json access log line without %s: %q", field, line)
+					}
+				}
+			},
+		},
+		{
+			format: "text",
+			check: func(t *testing.T, line string) {
+				text := regexp.MustCompile(`^time=\S+ request\.remoteaddr=192\.0\.2\.1 request\.method=PUT request\.uri="/v2/foo/bar/manifests/latest\?x=1" request\.proto=HTTP/1\.1 request\.referer="http://example\.com/" request\.useragent="test agent" response\.status=202 response\.written=8 response\.duration=\S+$`)
+				if !text.MatchString(line) {
+					t.Errorf("malformed text access log line: %q", line)
+				}
+			},
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			output := filepath.Join(dir, tc.format+".log")
+			var config configuration.Configuration
+			config.Log.AccessLog.Format = tc.format
+			config.Log.AccessLog.Output = output
+			h, err := configureAccessLog(&config, handler)
+			if err != nil {
+				t.Fatalf("unexpected error configuring access log: %v", err)
+			}
+
+			req := httptest.NewRequest("PUT", "/v2/foo/bar/manifests/latest?x=1", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("Referer", "http://example.com/")
+			req.Header.Set("User-Agent", "test agent")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			b, err := ioutil.ReadFile(output)
+			if err != nil {
+				t.Fatalf("unexpected error reading access log: %v", err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("expected one access log line, got %q", b)
+			}
+			tc.check(t, lines[0])
+		})
+	}
+}
+
+func TestAccessLogUnsupportedFormat(t *testing.T) {
+	var config configuration.Configuration
+	config.Log.AccessLog.Format = "xml"
+	if _, err := configureAccessLog(&config, http.NotFoundHandler()); err == nil {
+		t.Fatal("expected an error configuring an unsupported access log format")
+	}
+}
@@ -81,6 +81,13 @@ var (
 		Format:      "<uuid>",
 	}
 
+	dockerUploadExpiresHeader = ParameterDescriptor{
+		Name:        "Docker-Upload-Expires",
+		Description: "The time after which the upload may be purged, if the registry purges uploads. Requests resuming the upload afterwards fail with `BLOB_UPLOAD_EXPIRED`.",
+		Type:        "date",
+		Format:      "<http date>",
+	}
+
 	digestHeader = ParameterDescriptor{
 		Name:        "Docker-Content-Digest",
 		Description: "Digest of the targeted content for the request.",
@@ -112,6 +119,14 @@ var (
 		},
 	}
 
+	tagSortParameter = ParameterDescriptor{
+		Name:        "sort",
+		Type:        "string",
+		Description: "Order of the tags listed: `lexical` (the default) or `pushtime`, the time each tag was last pushed, prefixed with `-` for descending order. Pagination with last follows the order.",
+		Format:      "<lexical|-lexical|pushtime|-pushtime>",
+		Required:    false,
+	}
+
 	unauthorizedResponseDescriptor = ResponseDescriptor{
 		Name:        "Authentication Required",
 		StatusCode:  http.StatusUnauthorized,
@@ -187,6 +202,12 @@ var (
 				Description: "Length of the JSON response body.",
 				Format:      "<length>",
 			},
+			{
+				Name:        "Retry-After",
+				Type:        "integer",
+				Description: "The number of seconds to wait before retrying the request.",
+				Format:      "<seconds>",
+			},
 		},
 		Body: BodyDescriptor{
 			ContentType: "application/json",
@@ -393,6 +414,14 @@ var routeDescriptors = []RouteDescriptor{
 							{
 								Description: "The API implements V2 protocol and is accessible.",
 								StatusCode:  http.StatusOK,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Docker-Distribution-Read-Only",
+										Type:        "string",
+										Description: "Set to `true` while the registry is in its read-only maintenance mode, rejecting pushes and deletes with `405 Method Not Allowed`.",
+										Format:      "true",
+									},
+								},
 							},
 						},
 						Failures: []ResponseDescriptor{
@@ -463,7 +492,7 @@ var routeDescriptors = []RouteDescriptor{
 						Name:            "Tags Paginated",
 						Description:     "Return a portion of the tags for the specified repository.",
 						PathParameters:  []ParameterDescriptor{nameParameterDescriptor},
-						QueryParameters: paginationParameters,
+						QueryParameters: append(append([]ParameterDescriptor{}, paginationParameters...), tagSortParameter),
 						Successes: []ResponseDescriptor{
 							{
 								StatusCode:  http.StatusOK,
@@ -502,6 +531,18 @@ var routeDescriptors = []RouteDescriptor{
 									ErrorCodePaginationNumberInvalid,
 								},
 							},
+							{
+								Name:        "Invalid tag ordering",
+								Description: "The received parameter sort was not a known order.",
+								StatusCode:  http.StatusBadRequest,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeTagSortInvalid,
+								},
+							},
 							unauthorizedResponseDescriptor,
 							repositoryNotFoundResponseDescriptor,
 							deniedResponseDescriptor,
@@ -510,6 +551,40 @@ var routeDescriptors = []RouteDescriptor{
 					},
 				},
 			},
+			{
+				Method:      "HEAD",
+				Description: "Check whether the repository identified by `name` has any tag, without listing them.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "The repository has at least one tag.",
+							},
+						},
+						Failures: []ResponseDescriptor{
+							unauthorizedResponseDescriptor,
+							{
+								Name:        "No Such Repository Error",
+								StatusCode:  http.StatusNotFound,
+								Description: "The repository is not known to the registry, or has no tag.",
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeNameUnknown,
+								},
+							},
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
 		},
 	},
 	{
@@ -543,14 +618,27 @@ var routeDescriptors = []RouteDescriptor{
 									Format:      manifestBody,
 								},
 							},
+							{
+								Description: "The manifest pushed with the digest `reference` was converted to an OCI manifest when pushed, and is available at the provided location. This response is only sent if the registry is configured to redirect pulls of converted manifests by their original digest.",
+								StatusCode:  http.StatusTemporaryRedirect,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Description: "The location of the converted manifest.",
+										Format:      "<url>",
+									},
+								},
+							},
 						},
 						Failures: []ResponseDescriptor{
 							{
-								Description: "The name or reference was invalid.",
+								Description: "The name or reference was invalid, or the tag longer than the registry accepts.",
 								StatusCode:  http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
 									ErrorCodeNameInvalid,
 									ErrorCodeTagInvalid,
+									ErrorCodeDigestInvalid,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -578,13 +666,22 @@ var routeDescriptors = []RouteDescriptor{
 							nameParameterDescriptor,
 							referenceParameterDescriptor,
 						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "platform",
+								Type:        "query",
+								Format:      "<os>/<architecture>[/<variant>]",
+								Required:    false,
+								Description: "The platform of the image manifest. If the registry validates platforms, the push fails with `MANIFEST_INVALID` unless the config of the manifest is for this platform.",
+							},
+						},
 						Body: BodyDescriptor{
 							ContentType: "<media type of manifest>",
 							Format:      manifestBody,
 						},
 						Successes: []ResponseDescriptor{
 							{
-								Description: "The manifest has been accepted by the registry and is stored under the specified `name` and `tag`.",
+								Description: "The manifest has been accepted by the registry and is stored under the specified `name` and `tag`. If the registry is configured to convert docker manifests pushed to the repository to OCI ones, the manifest is stored as converted, and the `Location` and `Docker-Content-Digest` headers refer to the converted manifest.",
 								StatusCode:  http.StatusCreated,
 								Headers: []ParameterDescriptor{
 									{
@@ -717,6 +814,244 @@ var routeDescriptors = []RouteDescriptor{
 		},
 	},
 
+	{
+		Name:        RouteNameReferrers,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/referrers/{digest:" + digest.DigestRegexp.String() + "}",
+		Entity:      "Referrers",
+		Description: "List the manifests referring to the manifest identified by `name` and `digest` through their subject.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "GET",
+				Description: "Fetch an image index of the manifests whose subject is the manifest identified by `digest`, which need not exist.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Referrers",
+						Description: "Return the descriptors of the referrers of the manifest. If the `artifactType` parameter is present, only referrers of that artifact type are returned, and the `OCI-Filters-Applied` header is set.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							digestPathParameter,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "artifactType",
+								Type:        "query",
+								Format:      "<artifact type>",
+								Required:    false,
+								Description: "Only return referrers of this artifact type.",
+							},
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "An image index of the referrers of the manifest.",
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/vnd.oci.image.index.v1+json",
+									Format: `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.oci.image.index.v1+json",
+	"manifests": [
+		{
+			"mediaType": <media type>,
+			"size": <size>,
+			"digest": <digest>,
+			"artifactType": <artifact type>,
+			"annotations": <annotations>
+		},
+		...
+	]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:       "Invalid Name or Digest",
+								StatusCode: http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeDigestInvalid,
+									ErrorCodeNameInvalid,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:        RouteNameAnnotations,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_annotations",
+		Entity:      "Annotations",
+		Description: "Search for the manifests of the repository identified by `name` by the values of their annotations. This endpoint is only available if enabled in the registry configuration, and only searches the annotation keys the registry indexes.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "GET",
+				Description: "Fetch an image index of the manifests whose annotation `key` has the given `value`.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Annotations",
+						Description: "Return the descriptors of the manifests whose annotation `key` has the given `value`, ordered by digest.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "key",
+								Type:        "query",
+								Format:      "<annotation key>",
+								Required:    true,
+								Description: "The key of an indexed annotation.",
+							},
+							{
+								Name:        "value",
+								Type:        "query",
+								Format:      "<annotation value>",
+								Required:    true,
+								Description: "The value of the annotation of the manifests returned.",
+							},
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "An image index of the manifests with the annotation value.",
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/vnd.oci.image.index.v1+json",
+									Format: `{
+	"schemaVersion": 2,
+	"mediaType": "application/vnd.oci.image.index.v1+json",
+	"manifests": [
+		{
+			"mediaType": <media type>,
+			"size": <size>,
+			"digest": <digest>,
+			"artifactType": <artifact type>,
+			"annotations": <annotations>
+		},
+		...
+	]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:       "Invalid Name or Annotation",
+								StatusCode: http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeNameInvalid,
+									ErrorCodeAnnotationInvalid,
+								},
+							},
+							{
+								Name:        "Not allowed",
+								Description: "The registry indexes no annotations.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:        RouteNameRepository,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_repository",
+		Entity:      "Repository",
+		Description: "Create the repository identified by `name` ahead of pushes to it, which is required when the registry does not create repositories on push. Creating a repository requires full access to it.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "PUT",
+				Description: "Create the repository identified by `name`, empty, unless it exists.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The repository was created.",
+								StatusCode:  http.StatusCreated,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "The `Content-Length` header must be zero and the body must be empty.",
+										Format:      "0",
+									},
+								},
+							},
+							{
+								Description: "The repository already exists.",
+								StatusCode:  http.StatusOK,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "The `Content-Length` header must be zero and the body must be empty.",
+										Format:      "0",
+									},
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:       "Invalid Name",
+								StatusCode: http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeNameInvalid,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+
 	{
 		Name:        RouteNameBlob,
 		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/{digest:" + digest.DigestRegexp.String() + "}",
@@ -982,7 +1317,7 @@ var routeDescriptors = []RouteDescriptor{
 								Type:        "query",
 								Format:      "<digest>",
 								Regexp:      digest.DigestRegexp,
-								Description: `Digest of uploaded blob. If present, the upload will be completed, in a single request, with contents of the request body as the resulting blob.`,
+								Description: `Digest of uploaded blob. If present, the upload will be completed, in a single request, with contents of the request body as the resulting blob. If the repository already has the blob, the upload completes without the body being read, so that a client sending an Expect: 100-continue header need not send it.`,
 							},
 						},
 						Body: BodyDescriptor{
@@ -1056,6 +1391,7 @@ var routeDescriptors = []RouteDescriptor{
 									},
 									contentLengthZeroHeader,
 									dockerUploadUUIDHeader,
+									dockerUploadExpiresHeader,
 								},
 							},
 						},
@@ -1141,6 +1477,58 @@ var routeDescriptors = []RouteDescriptor{
 					},
 				},
 			},
+			{
+				Method:      "GET",
+				Description: "List the in-progress blob uploads of the repository. This endpoint is only available if enabled in the registry configuration, and requires full access to the repository.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "List Blob Uploads",
+						Description: "Retrieve the identifier, offset, start time and last activity time of each in-progress upload.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The in-progress uploads of the repository.",
+								StatusCode:  http.StatusOK,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"name": <name>,
+	"uploads": [
+		{
+			"uuid": <uuid>,
+			"offset": <offset>,
+			"startedAt": <time>,
+			"lastModified": <time>
+		},
+		...
+	]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
 		},
 	},
 
@@ -1178,6 +1566,7 @@ var routeDescriptors = []RouteDescriptor{
 									},
 									contentLengthZeroHeader,
 									dockerUploadUUIDHeader,
+									dockerUploadExpiresHeader,
 								},
 							},
 						},
@@ -1200,6 +1589,7 @@ var routeDescriptors = []RouteDescriptor{
 								StatusCode:  http.StatusNotFound,
 								ErrorCodes: []errcode.ErrorCode{
 									ErrorCodeBlobUploadUnknown,
+									ErrorCodeBlobUploadExpired,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1253,6 +1643,7 @@ var routeDescriptors = []RouteDescriptor{
 									},
 									contentLengthZeroHeader,
 									dockerUploadUUIDHeader,
+									dockerUploadExpiresHeader,
 								},
 							},
 						},
@@ -1275,6 +1666,7 @@ var routeDescriptors = []RouteDescriptor{
 								StatusCode:  http.StatusNotFound,
 								ErrorCodes: []errcode.ErrorCode{
 									ErrorCodeBlobUploadUnknown,
+									ErrorCodeBlobUploadExpired,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1335,6 +1727,7 @@ var routeDescriptors = []RouteDescriptor{
 									},
 									contentLengthZeroHeader,
 									dockerUploadUUIDHeader,
+									dockerUploadExpiresHeader,
 								},
 							},
 						},
@@ -1357,6 +1750,7 @@ var routeDescriptors = []RouteDescriptor{
 								StatusCode:  http.StatusNotFound,
 								ErrorCodes: []errcode.ErrorCode{
 									ErrorCodeBlobUploadUnknown,
+									ErrorCodeBlobUploadExpired,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1380,7 +1774,7 @@ var routeDescriptors = []RouteDescriptor{
 				Description: "Complete the upload specified by `uuid`, optionally appending the body as the final chunk.",
 				Requests: []RequestDescriptor{
 					{
-						Description: "Complete the upload, providing all the data in the body, if necessary. A request without a body will just complete the upload with previously uploaded content.",
+						Description: "Complete the upload, providing all the data in the body, if necessary. A request without a body will just complete the upload with previously uploaded content. If the repository already has the blob of the declared digest and size, the upload is canceled and completed without the body being read.",
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
@@ -1452,6 +1846,7 @@ var routeDescriptors = []RouteDescriptor{
 								StatusCode:  http.StatusNotFound,
 								ErrorCodes: []errcode.ErrorCode{
 									ErrorCodeBlobUploadUnknown,
+									ErrorCodeBlobUploadExpired,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
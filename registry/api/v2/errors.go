@@ -136,6 +136,17 @@ var (
 		HTTPStatusCode: http.StatusNotFound,
 	})
 
+	// ErrorCodeBlobUploadExpired is returned when an upload is resumed
+	// after the time it may be purged at.
+	ErrorCodeBlobUploadExpired = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "BLOB_UPLOAD_EXPIRED",
+		Message: "blob upload expired",
+		Description: `The blob upload was started longer ago than the
+		registry keeps uploads for, and may have been purged. It must be
+		restarted.`,
+		HTTPStatusCode: http.StatusNotFound,
+	})
+
 	// ErrorCodeBlobUploadInvalid is returned when an upload is invalid.
 	ErrorCodeBlobUploadInvalid = errcode.Register(errGroup, errcode.ErrorDescriptor{
 		Value:   "BLOB_UPLOAD_INVALID",
@@ -154,4 +165,26 @@ var (
 		to return) is not an integer, or "n" is negative.`,
 		HTTPStatusCode: http.StatusBadRequest,
 	})
+
+	// ErrorCodeTagSortInvalid is returned when the `sort` parameter of a tag
+	// listing names an unknown order.
+	ErrorCodeTagSortInvalid = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "TAG_SORT_INVALID",
+		Message: "invalid tag ordering requested",
+		Description: `Returned when the "sort" parameter of a tag listing is
+		not one of "lexical", "-lexical", "pushtime" or "-pushtime".`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	// ErrorCodeAnnotationInvalid is returned when a search for manifests by
+	// annotation lacks the key or value of the annotation, or names a key
+	// which is not indexed.
+	ErrorCodeAnnotationInvalid = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "ANNOTATION_INVALID",
+		Message: "invalid annotation search",
+		Description: `Returned when a search for manifests by annotation
+		is missing the "key" or "value" parameter, or names an annotation
+		key which the registry does not index.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
 )
@@ -12,6 +12,9 @@ const (
 	RouteNameBlobUpload      = "blob-upload"
 	RouteNameBlobUploadChunk = "blob-upload-chunk"
 	RouteNameCatalog         = "catalog"
+	RouteNameReferrers       = "referrers"
+	RouteNameAnnotations     = "annotations"
+	RouteNameRepository      = "repository"
 )
 
 // Router builds a gorilla router with named routes for the various API
@@ -80,6 +80,36 @@ func makeURLBuilderTestCases(urlBuilder *URLBuilder) []urlBuilderTestCase {
 				return urlBuilder.BuildBlobURL(ref)
 			},
 		},
+		{
+			description:  "build referrers url",
+			expectedPath: "/v2/foo/bar/referrers/sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5?artifactType=application%2Fvnd.example",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				ref, _ := reference.WithDigest(fooBarRef, "sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5")
+				return urlBuilder.BuildReferrersURL(ref, url.Values{
+					"artifactType": []string{"application/vnd.example"},
+				})
+			},
+		},
+		{
+			description:  "build annotations url",
+			expectedPath: "/v2/foo/bar/_annotations?key=org.opencontainers.image.created&value=2024-01-01",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildAnnotationsURL(fooBarRef, url.Values{
+					"key":   []string{"org.opencontainers.image.created"},
+					"value": []string{"2024-01-01"},
+				})
+			},
+		},
+		{
+			description:  "build repository url",
+			expectedPath: "/v2/foo/bar/_repository",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildRepositoryURL(fooBarRef)
+			},
+		},
 		{
 			description:  "build blob upload url",
 			expectedPath: "/v2/foo/bar/blobs/uploads/",
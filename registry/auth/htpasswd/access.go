@@ -28,6 +28,9 @@ type accessController struct {
 	modtime  time.Time
 	mu       sync.Mutex
 	htpasswd *htpasswd
+
+	// failures, if set, delays the responses to failed authentications.
+	failures *failureDelayer
 }
 
 var _ auth.AccessController = &accessController{}
@@ -46,7 +49,12 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 	if err := createHtpasswdFile(path); err != nil {
 		return nil, err
 	}
-	return &accessController{realm: realm.(string), path: path}, nil
+
+	failures, err := newFailureDelayer(options)
+	if err != nil {
+		return nil, err
+	}
+	return &accessController{realm: realm.(string), path: path, failures: failures}, nil
 }
 
 func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
@@ -93,11 +101,17 @@ func (ac *accessController) Authorized(ctx context.Context, accessRecords ...aut
 
 	if err := localHTPasswd.authenticateUser(username, password); err != nil {
 		dcontext.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
+		if ac.failures != nil {
+			ac.failures.failed(ctx, failureSource(req))
+		}
 		return nil, &challenge{
 			realm: ac.realm,
 			err:   auth.ErrAuthenticationFailure,
 		}
 	}
+	if ac.failures != nil {
+		ac.failures.succeeded(failureSource(req))
+	}
 
 	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
 }
@@ -0,0 +1,202 @@
+package htpasswd
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+)
+
+const (
+	// defaultMaxFailureDelayFactor bounds the escalated delay, when no
+	// maximum is configured, to this multiple of the failure delay.
+	defaultMaxFailureDelayFactor = 32
+
+	// failureMemory is how long the failures of a source are remembered
+	// after the last one.
+	failureMemory = 10 * time.Minute
+
+	// maxFailureSources bounds the number of sources whose failures are
+	// remembered. When reached, the sources whose failures are forgotten are
+	// dropped, and if none are, the oldest.
+	maxFailureSources = 10000
+)
+
+// failureDelayer delays the responses to failed authentications, to slow
+// down guessing credentials. The delay doubles with each consecutive failure
+// from the same source IP, up to a maximum, and a random jitter is added to
+// it. A successful authentication clears the failures of its source, and is
+// never delayed.
+type failureDelayer struct {
+	delay    time.Duration
+	jitter   time.Duration
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	sources map[string]*sourceFailures
+
+	// now, sleep and random are replaced in tests.
+	now    func() time.Time
+	sleep  func(ctx context.Context, d time.Duration)
+	random func(n int64) int64
+}
+
+// sourceFailures are the consecutive failures of a source.
+type sourceFailures struct {
+	count int
+	last  time.Time
+}
+
+// newFailureDelayer returns the failure delayer configured by the
+// "failuredelay", "failurejitter" and "maxfailuredelay" options, or nil if
+// failures are not delayed.
+func newFailureDelayer(options map[string]interface{}) (*failureDelayer, error) {
+	delay, err := durationOption(options, "failuredelay")
+	if err != nil {
+		return nil, err
+	}
+	jitter, err := durationOption(options, "failurejitter")
+	if err != nil {
+		return nil, err
+	}
+	maxDelay, err := durationOption(options, "maxfailuredelay")
+	if err != nil {
+		return nil, err
+	}
+	if delay == 0 {
+		if jitter != 0 || maxDelay != 0 {
+			return nil, fmt.Errorf(`"failurejitter" and "maxfailuredelay" require "failuredelay" for htpasswd access controller`)
+		}
+		return nil, nil
+	}
+	if maxDelay == 0 {
+		maxDelay = defaultMaxFailureDelayFactor * delay
+	}
+	if maxDelay < delay {
+		return nil, fmt.Errorf(`"maxfailuredelay" must not be less than "failuredelay" for htpasswd access controller`)
+	}
+
+	return &failureDelayer{
+		delay:    delay,
+		jitter:   jitter,
+		maxDelay: maxDelay,
+		sources:  make(map[string]*sourceFailures),
+		now:      time.Now,
+		sleep: func(ctx context.Context, d time.Duration) {
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+			}
+		},
+		random: rand.Int63n,
+	}, nil
+}
+
+// failureSource returns the source failures of r are recorded for, which is
+// the IP address r was received from. Headers such as X-Forwarded-For are not
+// trusted, as a client could set them to evade the escalation of its delay.
+func failureSource(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// durationOption parses the option key as a duration, given as a string or
+// a number of nanoseconds. It is zero if not set.
+func durationOption(options map[string]interface{}, key string) (time.Duration, error) {
+	var d time.Duration
+	switch v := options[key].(type) {
+	case nil:
+		return 0, nil
+	case string:
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return 0, fmt.Errorf("%q must be a duration for htpasswd access controller: %v", key, err)
+		}
+	case int:
+		d = time.Duration(v)
+	case time.Duration:
+		d = v
+	default:
+		return 0, fmt.Errorf("%q must be a duration for htpasswd access controller", key)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%q must not be negative for htpasswd access controller", key)
+	}
+	return d, nil
+}
+
+// failed records a failed authentication from the source IP and waits for
+// the delay of its response, or for ctx to be done.
+func (fd *failureDelayer) failed(ctx context.Context, source string) {
+	d := fd.record(source)
+	dcontext.GetLogger(ctx).Debugf("delaying failed authentication from %s by %v", source, d)
+	fd.sleep(ctx, d)
+}
+
+// record records a failed authentication from source, returning the delay
+// of its response.
+func (fd *failureDelayer) record(source string) time.Duration {
+	now := fd.now()
+
+	fd.mu.Lock()
+	f, ok := fd.sources[source]
+	if !ok || now.Sub(f.last) > failureMemory {
+		if !ok && len(fd.sources) >= maxFailureSources {
+			fd.prune(now)
+		}
+		f = &sourceFailures{}
+		fd.sources[source] = f
+	}
+	f.count++
+	f.last = now
+	count := f.count
+	fd.mu.Unlock()
+
+	d := fd.delay
+	for i := 1; i < count && d < fd.maxDelay; i++ {
+		d *= 2
+	}
+	if d > fd.maxDelay {
+		d = fd.maxDelay
+	}
+	if fd.jitter > 0 {
+		d += time.Duration(fd.random(int64(fd.jitter)))
+	}
+	return d
+}
+
+// prune drops the sources whose failures are forgotten, or the oldest one if
+// none are. It must be called with mu held.
+func (fd *failureDelayer) prune(now time.Time) {
+	var oldest string
+	for source, f := range fd.sources {
+		if now.Sub(f.last) > failureMemory {
+			delete(fd.sources, source)
+			continue
+		}
+		if oldest == "" || f.last.Before(fd.sources[oldest].last) {
+			oldest = source
+		}
+	}
+	if len(fd.sources) >= maxFailureSources {
+		delete(fd.sources, oldest)
+	}
+}
+
+// succeeded clears the failures of the source IP of a successful
+// authentication.
+func (fd *failureDelayer) succeeded(source string) {
+	fd.mu.Lock()
+	delete(fd.sources, source)
+	fd.mu.Unlock()
+}
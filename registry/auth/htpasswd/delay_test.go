@@ -0,0 +1,202 @@
+package htpasswd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+)
+
+func TestFailureDelay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	// frodo's password is baggins.
+	content := "frodo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":           "The-Shire",
+		"path":            path,
+		"failuredelay":    "1s",
+		"failurejitter":   "100ms",
+		"maxfailuredelay": "5s",
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	failures := ac.(*accessController).failures
+	var slept []time.Duration
+	failures.sleep = func(ctx context.Context, d time.Duration) { slept = append(slept, d) }
+	failures.random = func(n int64) int64 { return n - 1 }
+	now := time.Now()
+	failures.now = func() time.Time { return now }
+
+	authorize := func(remoteAddr, password string) error {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/v2/", nil)
+		r.RemoteAddr = remoteAddr
+		r.SetBasicAuth("frodo", password)
+		_, err := ac.Authorized(dcontext.WithRequest(context.Background(), r))
+		return err
+	}
+	expectSlept := func(msg string, expected ...time.Duration) {
+		t.Helper()
+		if len(slept) != len(expected) {
+			t.Fatalf("%s: unexpected delays %v, expected %v", msg, slept, expected)
+		}
+		for i := range expected {
+			if slept[i] != expected[i] {
+				t.Fatalf("%s: unexpected delays %v, expected %v", msg, slept, expected)
+			}
+		}
+		slept = nil
+	}
+	const jitter = 100*time.Millisecond - 1
+
+	if err := authorize("10.0.0.1:1234", "baggins"); err != nil {
+		t.Fatalf("unexpected error authorizing: %v", err)
+	}
+	expectSlept("successful authentication")
+
+	// Consecutive failures from a source double its delay, up to the
+	// maximum.
+	for i := 0; i < 5; i++ {
+		if err := authorize("10.0.0.1:1234", "sackville"); err == nil {
+			t.Fatalf("expected an error authorizing with a wrong password")
+		}
+	}
+	expectSlept("repeated failures", time.Second+jitter, 2*time.Second+jitter, 4*time.Second+jitter, 5*time.Second+jitter, 5*time.Second+jitter)
+
+	// Other sources are delayed independently.
+	if err := authorize("10.0.0.2:1234", "sackville"); err == nil {
+		t.Fatalf("expected an error authorizing with a wrong password")
+	}
+	expectSlept("failure from another source", time.Second+jitter)
+
+	// A success is not delayed, and clears the failures of its source.
+	if err := authorize("10.0.0.1:4321", "baggins"); err != nil {
+		t.Fatalf("unexpected error authorizing: %v", err)
+	}
+	expectSlept("successful authentication after failures")
+	if err := authorize("10.0.0.1:1234", "sackville"); err == nil {
+		t.Fatalf("expected an error authorizing with a wrong password")
+	}
+	expectSlept("failure after a success", time.Second+jitter)
+
+	// Failures are forgotten after a while.
+	if err := authorize("10.0.0.2:1234", "sackville"); err == nil {
+		t.Fatalf("expected an error authorizing with a wrong password")
+	}
+	expectSlept("second failure from another source", 2*time.Second+jitter)
+	now = now.Add(failureMemory + time.Second)
+	if err := authorize("10.0.0.2:1234", "sackville"); err == nil {
+		t.Fatalf("expected an error authorizing with a wrong password")
+	}
+	expectSlept("failure after a while", time.Second+jitter)
+}
+
+func TestFailureDelayOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	for _, options := range []map[string]interface{}{
+		{"failuredelay": "soon"},
+		{"failuredelay": "-1s"},
+		{"failurejitter": "1s"},
+		{"failuredelay": "2s", "maxfailuredelay": "1s"},
+		{"failuredelay": true},
+	} {
+		options["realm"] = "The-Shire"
+		options["path"] = path
+		if _, err := newAccessController(options); err == nil {
+			t.Fatalf("expected an error creating an access controller with %v", options)
+		}
+	}
+}
+
+// TestFailureDelayWaits checks that a failed authentication takes at least
+// the failure delay, and a successful one does not.
+func TestFailureDelayWaits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "frodo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	const delay = 200 * time.Millisecond
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":        "The-Shire",
+		"path":         path,
+		"failuredelay": delay.String(),
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	for _, tc := range []struct {
+		password string
+		delayed  bool
+	}{
+		{"baggins", false},
+		{"sackville", true},
+	} {
+		r := httptest.NewRequest("GET", "/v2/", nil)
+		r.SetBasicAuth("frodo", tc.password)
+		start := time.Now()
+		ac.Authorized(dcontext.WithRequest(context.Background(), r))
+		if elapsed := time.Since(start); (elapsed >= delay) != tc.delayed {
+			t.Fatalf("authenticating with %q took %v, delayed: %v", tc.password, elapsed, tc.delayed)
+		}
+	}
+}
+
+// TestFailureDelayIgnoresForwardedHeaders checks that failures are recorded
+// for the address requests are received from, so that a client setting
+// forwarding headers neither evades the escalation nor clears the failures
+// of another.
+func TestFailureDelayIgnoresForwardedHeaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := "frodo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":        "The-Shire",
+		"path":         path,
+		"failuredelay": "1s",
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	failures := ac.(*accessController).failures
+	var slept []time.Duration
+	failures.sleep = func(ctx context.Context, d time.Duration) { slept = append(slept, d) }
+
+	authorize := func(remoteAddr, forwardedFor, password string) {
+		r := httptest.NewRequest("GET", "/v2/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		r.Header.Set("X-Real-Ip", forwardedFor)
+		r.SetBasicAuth("frodo", password)
+		ac.Authorized(dcontext.WithRequest(context.Background(), r))
+	}
+
+	authorize("10.0.0.1:1234", "192.168.0.1", "sackville")
+	authorize("10.0.0.1:1234", "192.168.0.2", "sackville")
+	// A success claiming to be forwarded for the failing client does not
+	// clear its failures.
+	authorize("10.0.0.2:1234", "10.0.0.1", "baggins")
+	authorize("10.0.0.1:1234", "192.168.0.3", "sackville")
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if len(slept) != len(expected) {
+		t.Fatalf("unexpected delays %v, expected %v", slept, expected)
+	}
+	for i := range expected {
+		if slept[i] != expected[i] {
+			t.Fatalf("unexpected delays %v, expected %v", slept, expected)
+		}
+	}
+}
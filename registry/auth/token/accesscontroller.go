@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -90,8 +91,14 @@ func (ac authChallenge) Error() string {
 	return ac.err.Error()
 }
 
-// Status returns the HTTP Response Status Code for this authChallenge.
+// Status returns the HTTP Response Status Code for this authChallenge. A
+// valid token not granting the access requested is answered with 403, as
+// requesting credentials again would not help unless a wider scope is
+// requested.
 func (ac authChallenge) Status() int {
+	if ac.err == ErrInsufficientScope {
+		return http.StatusForbidden
+	}
 	return http.StatusUnauthorized
 }
 
@@ -122,17 +129,49 @@ func (ac authChallenge) challengeParams(r *http.Request) string {
 
 // SetChallenge sets the WWW-Authenticate value for the response.
 func (ac authChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
-	w.Header().Add("WWW-Authenticate", ac.challengeParams(r))
+	w.Header().Set("WWW-Authenticate", ac.challengeParams(r))
+}
+
+// ChallengeFunc computes the realm and service of the challenge returned for
+// a request, and the issuer its token must come from. Tokens are verified
+// against the returned issuer, and against the returned service as their
+// audience. An empty value falls back to the configured one.
+//
+// A ChallengeFunc may be given to the token access controller with the
+// "challengefunc" option.
+type ChallengeFunc func(r *http.Request) (realm, service, issuer string)
+
+// challengeValues holds the realm, service and issuer configured for a host.
+type challengeValues struct {
+	realm   string
+	service string
+	issuer  string
+}
+
+// hostChallengeFunc returns a ChallengeFunc resolving the values configured
+// for the Host of a request, with or without its port.
+func hostChallengeFunc(hosts map[string]challengeValues) ChallengeFunc {
+	return func(r *http.Request) (string, string, string) {
+		host := strings.ToLower(r.Host)
+		values, ok := hosts[host]
+		if !ok {
+			if hostname, _, err := net.SplitHostPort(host); err == nil {
+				values = hosts[hostname]
+			}
+		}
+		return values.realm, values.service, values.issuer
+	}
 }
 
 // accessController implements the auth.AccessController interface.
 type accessController struct {
-	realm        string
-	autoRedirect bool
-	issuer       string
-	service      string
-	rootCerts    *x509.CertPool
-	trustedKeys  map[string]libtrust.PublicKey
+	realm         string
+	autoRedirect  bool
+	issuer        string
+	service       string
+	challengeFunc ChallengeFunc
+	rootCerts     *x509.CertPool
+	trustedKeys   map[string]libtrust.PublicKey
 }
 
 // tokenAccessOptions is a convenience type for handling
@@ -143,6 +182,7 @@ type tokenAccessOptions struct {
 	issuer         string
 	service        string
 	rootCertBundle string
+	challengeFunc  ChallengeFunc
 }
 
 // checkOptions gathers the necessary options
@@ -171,9 +211,90 @@ func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 		opts.autoRedirect = autoRedirect
 	}
 
+	hostsVal, hasHosts := options["hosts"]
+	challengeFuncVal, hasChallengeFunc := options["challengefunc"]
+	if hasHosts && hasChallengeFunc {
+		return opts, fmt.Errorf("token auth options hosts and challengefunc are mutually exclusive")
+	}
+
+	if hasHosts {
+		hosts, err := checkHosts(hostsVal)
+		if err != nil {
+			return opts, err
+		}
+		opts.challengeFunc = hostChallengeFunc(hosts)
+	}
+
+	if hasChallengeFunc {
+		switch f := challengeFuncVal.(type) {
+		case ChallengeFunc:
+			opts.challengeFunc = f
+		case func(r *http.Request) (string, string, string):
+			opts.challengeFunc = f
+		default:
+			return opts, fmt.Errorf("token auth requires a valid option func: challengefunc")
+		}
+	}
+
 	return opts, nil
 }
 
+// checkHosts parses the hosts option, mapping a host to the realm, service
+// and issuer used for requests to it.
+func checkHosts(hostsVal interface{}) (map[string]challengeValues, error) {
+	hostsMap, ok := toStringMap(hostsVal)
+	if !ok {
+		return nil, fmt.Errorf("token auth requires a valid option map: hosts")
+	}
+
+	hosts := make(map[string]challengeValues, len(hostsMap))
+	for host, val := range hostsMap {
+		valMap, ok := toStringMap(val)
+		if !ok {
+			return nil, fmt.Errorf("token auth requires a valid option map: hosts.%s", host)
+		}
+
+		var values challengeValues
+		for key, dest := range map[string]*string{
+			"realm":   &values.realm,
+			"service": &values.service,
+			"issuer":  &values.issuer,
+		} {
+			v, ok := valMap[key]
+			if !ok {
+				continue
+			}
+			if *dest, ok = v.(string); !ok {
+				return nil, fmt.Errorf("token auth requires a valid option string: hosts.%s.%s", host, key)
+			}
+		}
+
+		hosts[strings.ToLower(host)] = values
+	}
+
+	return hosts, nil
+}
+
+// toStringMap converts an option, as decoded from yaml, to a map keyed by
+// string.
+func toStringMap(val interface{}) (map[string]interface{}, bool) {
+	switch m := val.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, false
+			}
+			converted[key] = v
+		}
+		return converted, true
+	}
+	return nil, false
+}
+
 // newAccessController creates an accessController using the given options.
 func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
 	config, err := checkOptions(options)
@@ -223,30 +344,52 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 	}
 
 	return &accessController{
-		realm:        config.realm,
-		autoRedirect: config.autoRedirect,
-		issuer:       config.issuer,
-		service:      config.service,
-		rootCerts:    rootPool,
-		trustedKeys:  trustedKeys,
+		realm:         config.realm,
+		autoRedirect:  config.autoRedirect,
+		issuer:        config.issuer,
+		service:       config.service,
+		challengeFunc: config.challengeFunc,
+		rootCerts:     rootPool,
+		trustedKeys:   trustedKeys,
 	}, nil
 }
 
+// resolve returns the realm, service and issuer to use for the request.
+func (ac *accessController) resolve(r *http.Request) (realm, service, issuer string) {
+	realm, service, issuer = ac.realm, ac.service, ac.issuer
+	if ac.challengeFunc == nil {
+		return realm, service, issuer
+	}
+
+	r2, s2, i2 := ac.challengeFunc(r)
+	if r2 != "" {
+		realm = r2
+	}
+	if s2 != "" {
+		service = s2
+	}
+	if i2 != "" {
+		issuer = i2
+	}
+	return realm, service, issuer
+}
+
 // Authorized handles checking whether the given request is authorized
 // for actions on resources described by the given access items.
 func (ac *accessController) Authorized(ctx context.Context, accessItems ...auth.Access) (context.Context, error) {
-	challenge := &authChallenge{
-		realm:        ac.realm,
-		autoRedirect: ac.autoRedirect,
-		service:      ac.service,
-		accessSet:    newAccessSet(accessItems...),
-	}
-
 	req, err := dcontext.GetRequest(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	realm, service, issuer := ac.resolve(req)
+	challenge := &authChallenge{
+		realm:        realm,
+		autoRedirect: ac.autoRedirect,
+		service:      service,
+		accessSet:    newAccessSet(accessItems...),
+	}
+
 	parts := strings.Split(req.Header.Get("Authorization"), " ")
 
 	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
@@ -263,8 +406,8 @@ func (ac *accessController) Authorized(ctx context.Context, accessItems ...auth.
 	}
 
 	verifyOpts := VerifyOptions{
-		TrustedIssuers:    []string{ac.issuer},
-		AcceptedAudiences: []string{ac.service},
+		TrustedIssuers:    []string{issuer},
+		AcceptedAudiences: []string{service},
 		Roots:             ac.rootCerts,
 		TrustedKeys:       ac.trustedKeys,
 	}
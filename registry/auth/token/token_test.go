@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -531,3 +532,178 @@ func TestNewAccessControllerPemBlock(t *testing.T) {
 		t.Fatal("accessController has the wrong number of certificates")
 	}
 }
+
+// This tests that the challenge and the verification of tokens are resolved
+// from the Host of each request when hosts are configured.
+func TestAccessControllerPerHost(t *testing.T) {
+	rootKeys, err := makeRootKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootCertBundleFilename, err := writeTempRootCerts(rootKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(rootCertBundleFilename)
+
+	options := map[string]interface{}{
+		"realm":          "https://auth.example.com/token/",
+		"issuer":         "test-issuer.example.com",
+		"service":        "test-service.example.com",
+		"rootcertbundle": rootCertBundleFilename,
+		"hosts": map[interface{}]interface{}{
+			"registry.brand-a.com": map[interface{}]interface{}{
+				"realm":   "https://auth.brand-a.com/token/",
+				"service": "registry.brand-a.com",
+				"issuer":  "auth.brand-a.com",
+			},
+			"registry.brand-b.com": map[interface{}]interface{}{
+				"realm":   "https://auth.brand-b.com/token/",
+				"service": "registry.brand-b.com",
+				"issuer":  "auth.brand-b.com",
+			},
+		},
+	}
+
+	accessController, err := newAccessController(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testAccess := auth.Access{
+		Resource: auth.Resource{
+			Type: "repository",
+			Name: "foo/bar",
+		},
+		Action: "pull",
+	}
+
+	makeToken := func(issuer, service string) *Token {
+		token, err := makeTestToken(
+			issuer, service,
+			[]*ResourceActions{{
+				Type:    testAccess.Type,
+				Name:    testAccess.Name,
+				Actions: []string{testAccess.Action},
+			}},
+			rootKeys[0], 1, time.Now(), time.Now().Add(5*time.Minute),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	brandAToken := makeToken("auth.brand-a.com", "registry.brand-a.com")
+	brandBToken := makeToken("auth.brand-b.com", "registry.brand-b.com")
+
+	for _, tc := range []struct {
+		host      string
+		challenge string
+		accepted  *Token
+		rejected  *Token
+	}{
+		{
+			host:      "registry.brand-a.com",
+			challenge: `Bearer realm="https://auth.brand-a.com/token/",service="registry.brand-a.com",scope="repository:foo/bar:pull"`,
+			accepted:  brandAToken,
+			rejected:  brandBToken,
+		},
+		{
+			host:      "registry.brand-b.com:5000",
+			challenge: `Bearer realm="https://auth.brand-b.com/token/",service="registry.brand-b.com",scope="repository:foo/bar:pull"`,
+			accepted:  brandBToken,
+			rejected:  brandAToken,
+		},
+		{
+			host:      "registry.example.com",
+			challenge: `Bearer realm="https://auth.example.com/token/",service="test-service.example.com",scope="repository:foo/bar:pull"`,
+			accepted:  makeToken("test-issuer.example.com", "test-service.example.com"),
+			rejected:  brandAToken,
+		},
+	} {
+		req, err := http.NewRequest("GET", "http://"+tc.host+"/v2/foo/bar/tags/list", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.WithRequest(context.Background(), req)
+
+		_, err = accessController.Authorized(ctx, testAccess)
+		challenge, ok := err.(auth.Challenge)
+		if !ok {
+			t.Fatalf("%s: accessController did not return a challenge", tc.host)
+		}
+
+		w := httptest.NewRecorder()
+		challenge.SetHeaders(req, w)
+		if got := w.Header().Get("WWW-Authenticate"); got != tc.challenge {
+			t.Errorf("%s: unexpected challenge: got %s, expected %s", tc.host, got, tc.challenge)
+		}
+
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tc.accepted.compactRaw()))
+		if _, err := accessController.Authorized(ctx, testAccess); err != nil {
+			t.Errorf("%s: accessController returned unexpected error: %s", tc.host, err)
+		}
+
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tc.rejected.compactRaw()))
+		_, err = accessController.Authorized(ctx, testAccess)
+		challenge, ok = err.(auth.Challenge)
+		if !ok || challenge.Error() != ErrInvalidToken.Error() {
+			t.Errorf("%s: accessController did not reject a token for another host: %v", tc.host, err)
+		}
+	}
+}
+
+// This tests that a ChallengeFunc given as an option is used to compute the
+// challenge, falling back to the configured values.
+func TestAccessControllerChallengeFunc(t *testing.T) {
+	rootKeys, err := makeRootKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootCertBundleFilename, err := writeTempRootCerts(rootKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(rootCertBundleFilename)
+
+	options := map[string]interface{}{
+		"realm":          "https://auth.example.com/token/",
+		"issuer":         "test-issuer.example.com",
+		"service":        "test-service.example.com",
+		"rootcertbundle": rootCertBundleFilename,
+		"challengefunc": ChallengeFunc(func(r *http.Request) (string, string, string) {
+			return "https://" + r.Host + "/token/", "", ""
+		}),
+	}
+
+	accessController, err := newAccessController(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "http://registry.brand-a.com/v2/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = accessController.Authorized(context.WithRequest(context.Background(), req))
+	challenge, ok := err.(auth.Challenge)
+	if !ok {
+		t.Fatal("accessController did not return a challenge")
+	}
+
+	w := httptest.NewRecorder()
+	challenge.SetHeaders(req, w)
+	expected := `Bearer realm="https://registry.brand-a.com/token/",service="test-service.example.com"`
+	if got := w.Header().Get("WWW-Authenticate"); got != expected {
+		t.Fatalf("unexpected challenge: got %s, expected %s", got, expected)
+	}
+
+	options["hosts"] = map[string]interface{}{}
+	if _, err := newAccessController(options); err == nil {
+		t.Fatal("expected an error with both hosts and challengefunc")
+	}
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -510,6 +511,9 @@ func (ms *manifests) Get(ctx context.Context, dgst digest.Digest, options ...dis
 	for _, t := range mediaTypes {
 		req.Header.Add("Accept", t)
 	}
+	// Requesting gzip explicitly leaves the decompression to readManifest,
+	// whatever the transport, so that it can be bounded and verified.
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	if _, ok := ms.etags[digestOrTag]; ok {
 		req.Header.Set("If-None-Match", ms.etags[digestOrTag])
@@ -523,27 +527,78 @@ func (ms *manifests) Get(ctx context.Context, dgst digest.Digest, options ...dis
 	if resp.StatusCode == http.StatusNotModified {
 		return nil, distribution.ErrManifestNotModified
 	} else if SuccessStatus(resp.StatusCode) {
-		if contentDgst != nil {
-			dgst, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
-			if err == nil {
-				*contentDgst = dgst
-			}
+		headerDgst, headerErr := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+		if contentDgst != nil && headerErr == nil {
+			*contentDgst = headerDgst
 		}
 		mt := resp.Header.Get("Content-Type")
-		body, err := ioutil.ReadAll(resp.Body)
-
+		body, err := readManifest(resp)
 		if err != nil {
 			return nil, err
 		}
-		m, _, err := distribution.UnmarshalManifest(mt, body)
+		m, desc, err := distribution.UnmarshalManifest(mt, body)
 		if err != nil {
 			return nil, err
 		}
+
+		// A manifest fetched by digest must have that digest, and one
+		// fetched by tag the digest the registry reports for it.
+		expected := headerDgst
+		if digestOrTag == dgst.String() {
+			expected = dgst
+		} else if headerErr != nil {
+			return m, nil
+		}
+		if !manifestHasDigest(expected, desc, body) {
+			return nil, fmt.Errorf("manifest %s fetched with digest %s, expected %s", digestOrTag, desc.Digest, expected)
+		}
 		return m, nil
 	}
 	return nil, HandleErrorResponse(resp)
 }
 
+// maxManifestSize is the size of the largest manifest read, once
+// decompressed.
+const maxManifestSize = 4 << 20
+
+// readManifest reads the manifest in the body of resp, decompressing it if it
+// is encoded with gzip.
+func readManifest(resp *http.Response) ([]byte, error) {
+	r := resp.Body
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress manifest: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unsupported manifest content encoding %q", encoding)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxManifestSize {
+		return nil, fmt.Errorf("manifest exceeds the maximum size of %d bytes", maxManifestSize)
+	}
+	return body, nil
+}
+
+// manifestHasDigest returns whether the manifest described by desc, read as
+// body, has the digest dgst. This is the digest of body, or for signed schema1
+// manifests that of their payload without signatures, as computed when
+// unmarshaling them.
+func manifestHasDigest(dgst digest.Digest, desc distribution.Descriptor, body []byte) bool {
+	if desc.Digest == dgst {
+		return true
+	}
+	return dgst.Algorithm().Available() && dgst.Algorithm().FromBytes(body) == dgst
+}
+
 // Put puts a manifest.  A tag can be specified using an options parameter which uses some shared state to hold the
 // tag name in order to build the correct upload URL.
 func (ms *manifests) Put(ctx context.Context, m distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
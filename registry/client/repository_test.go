@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -1258,6 +1259,74 @@ func TestManifestFetchWithAccept(t *testing.T) {
 	}
 }
 
+func TestManifestFetchGzip(t *testing.T) {
+	ctx := context.Background()
+	repo, _ := reference.WithName("test.example.com/repo")
+	m1, dgst, _ := newRandomSchemaV1Manifest(repo, "latest", 6)
+	_, pl, err := m1.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manifest tagged other differs from the one its digest header names.
+	_, other, _ := newRandomSchemaV1Manifest(repo, "other", 6)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("unexpected Accept-Encoding header: %q", req.Header.Get("Accept-Encoding"))
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(pl)
+		zw.Close()
+		w.Header().Set("Content-Type", schema1.MediaTypeSignedManifest)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", fmt.Sprint(buf.Len()))
+		if strings.HasSuffix(req.URL.Path, "/other") {
+			w.Header().Set("Docker-Content-Digest", other.String())
+		} else {
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer s.Close()
+
+	r, err := NewRepository(repo, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := r.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := ms.Get(ctx, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1manifest, ok := manifest.(*schema1.SignedManifest)
+	if !ok {
+		t.Fatalf("Unexpected manifest type from Get: %T", manifest)
+	}
+	if err := checkEqualManifest(v1manifest, m1); err != nil {
+		t.Fatal(err)
+	}
+
+	var contentDigest digest.Digest
+	if _, err := ms.Get(ctx, "", distribution.WithTag("latest"), ReturnContentDigest(&contentDigest)); err != nil {
+		t.Fatal(err)
+	}
+	if contentDigest != dgst {
+		t.Fatalf("Unexpected returned content digest %v, expected %v", contentDigest, dgst)
+	}
+
+	if _, err := ms.Get(ctx, other); err == nil || !strings.Contains(err.Error(), "expected "+other.String()) {
+		t.Fatalf("expected a digest mismatch fetching by digest, got %v", err)
+	}
+	if _, err := ms.Get(ctx, "", distribution.WithTag("other")); err == nil || !strings.Contains(err.Error(), "expected "+other.String()) {
+		t.Fatalf("expected a digest mismatch fetching by tag, got %v", err)
+	}
+}
+
 func TestManifestDelete(t *testing.T) {
 	repo, _ := reference.WithName("test.example.com/repo/delete")
 	_, dgst1, _ := newRandomSchemaV1Manifest(repo, "latest", 6)
@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+)
+
+// connRequestsKey is the key of the count of the requests in flight on a
+// connection in the contexts of its requests.
+type connRequestsKey struct{}
+
+// configureConnectionLimit limits the requests each connection of server may
+// have in flight to http.connections.maxrequests, so that a client opening
+// many HTTP/2 streams on a connection cannot monopolize the registry. Unlike
+// http.http2.maxconcurrentstreams, which clients must respect before opening
+// streams, the requests beyond the limit are answered with 429 Too Many
+// Requests.
+func configureConnectionLimit(server *http.Server, config *configuration.Configuration) error {
+	max := config.HTTP.Connections.MaxRequests
+	if max < 0 {
+		return fmt.Errorf("http.connections.maxrequests must not be negative, %d invalid", max)
+	}
+	if max == 0 {
+		return nil
+	}
+
+	connContext := server.ConnContext
+	server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return context.WithValue(ctx, connRequestsKey{}, new(int32))
+	}
+	server.Handler = limitConnectionRequests(int32(max), server.Handler)
+	return nil
+}
+
+// limitConnectionRequests answers the requests beyond the max in flight on
+// their connection with 429 Too Many Requests.
+func limitConnectionRequests(max int32, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inflight, ok := r.Context().Value(connRequestsKey{}).(*int32)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		defer atomic.AddInt32(inflight, -1)
+		if atomic.AddInt32(inflight, 1) > max {
+			dcontext.GetLogger(r.Context()).Warnf("rejecting request from %s: %d requests in flight on the connection", r.RemoteAddr, max)
+			// The slot frees as soon as another request of the connection
+			// completes, so the client need not wait long.
+			w.Header().Set("Retry-After", "1")
+			errcode.ServeJSON(w, errcode.ErrorCodeTooManyRequests.WithMessage("too many requests in flight on the connection"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"golang.org/x/net/http2"
+)
+
+func TestConnectionLimit(t *testing.T) {
+	const max, extra = 3, 4
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	server.EnableHTTP2 = true
+
+	config := &configuration.Configuration{}
+	config.HTTP.Connections.MaxRequests = max
+	if err := configureServer(server.Config, config); err != nil {
+		t.Fatalf("unexpected error configuring server: %v", err)
+	}
+	if err := configureConnectionLimit(server.Config, config); err != nil {
+		t.Fatalf("unexpected error configuring connection limit: %v", err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	// Each client holds a single HTTP/2 connection, over which its requests
+	// are streams.
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+	newClient := func() *http.Client {
+		return &http.Client{Transport: &http2.Transport{TLSClientConfig: tlsConfig}}
+	}
+	get := func(client *http.Client, path string) *http.Response {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Errorf("unexpected error making request: %v", err)
+			return nil
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 {
+			t.Errorf("request made over %s rather than HTTP/2", resp.Proto)
+		}
+		return resp
+	}
+
+	busy := newClient()
+	var wg sync.WaitGroup
+	blocked := make([]*http.Response, max)
+	for i := 0; i < max; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			blocked[i] = get(busy, "/block")
+		}(i)
+	}
+	for i := 0; i < max; i++ {
+		<-started
+	}
+
+	// The streams beyond the limit on the busy connection are rejected.
+	rejected := make([]*http.Response, extra)
+	var rwg sync.WaitGroup
+	for i := 0; i < extra; i++ {
+		rwg.Add(1)
+		go func(i int) {
+			defer rwg.Done()
+			rejected[i] = get(busy, "/")
+		}(i)
+	}
+	rwg.Wait()
+	for _, resp := range rejected {
+		if resp == nil {
+			t.FailNow()
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("request beyond the limit answered with %s", resp.Status)
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Fatal("request beyond the limit answered without a Retry-After header")
+		}
+	}
+
+	// Another connection proceeds while the busy one is at its limit.
+	if resp := get(newClient(), "/"); resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("request on another connection was not served: %v", resp)
+	}
+
+	close(release)
+	wg.Wait()
+	for _, resp := range blocked {
+		if resp == nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("request within the limit was not served: %v", resp)
+		}
+	}
+
+	// The busy connection is served again once its requests complete.
+	if resp := get(busy, "/"); resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("request after the limit was freed was not served: %v", resp)
+	}
+}
+
+func TestConnectionLimitResponse(t *testing.T) {
+	handler := limitConnectionRequests(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request beyond the limit was served")
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), connRequestsKey{}, new(int32)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var errs errcode.Errors
+	if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	if w.Code != http.StatusTooManyRequests || len(errs) != 1 {
+		t.Fatalf("unexpected response: %d %v", w.Code, errs)
+	}
+	if code := errs[0].(errcode.Error).Code; code != errcode.ErrorCodeTooManyRequests {
+		t.Fatalf("unexpected error code %v", code)
+	}
+}
+
+func TestConnectionLimitInvalid(t *testing.T) {
+	config := &configuration.Configuration{}
+	config.HTTP.Connections.MaxRequests = -1
+	if err := configureConnectionLimit(&http.Server{}, config); err == nil {
+		t.Fatal("expected an error limiting connections to a negative number of requests")
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultAdmissionTimeout is the time waited for the admission webhook when
+// no timeout is configured.
+const defaultAdmissionTimeout = 5 * time.Second
+
+// admissionRequest is the body of a request to the admission webhook,
+// describing a manifest push. The manifest is sent base64 encoded, as
+// pushed, so that its digest can be checked.
+type admissionRequest struct {
+	Repository string        `json:"repository"`
+	Tag        string        `json:"tag,omitempty"`
+	Digest     digest.Digest `json:"digest"`
+	MediaType  string        `json:"mediaType"`
+	Manifest   []byte        `json:"manifest"`
+}
+
+// admissionResponse is the body of a response of the admission webhook.
+type admissionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Message string `json:"message,omitempty"`
+}
+
+// admissionWebhook asks an external service whether manifest pushes are
+// allowed.
+type admissionWebhook struct {
+	url      string
+	headers  http.Header
+	timeout  time.Duration
+	failOpen bool
+	client   *http.Client
+}
+
+// newAdmissionWebhook returns the admission webhook configured by config, or
+// nil if none is.
+func newAdmissionWebhook(config *configuration.Configuration) (*admissionWebhook, error) {
+	admission := config.Policy.Admission
+	if admission.URL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(admission.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	timeout := admission.Timeout
+	if timeout <= 0 {
+		timeout = defaultAdmissionTimeout
+	}
+
+	return &admissionWebhook{
+		url:      admission.URL,
+		headers:  admission.Headers,
+		timeout:  timeout,
+		failOpen: admission.FailOpen,
+		client:   &http.Client{},
+	}, nil
+}
+
+// review sends the push described by ar to the webhook and returns its
+// decision. The call is bounded by the webhook timeout and by the deadline of
+// ctx. An error is returned if the webhook does not respond with a decision.
+func (aw *admissionWebhook) review(ctx context.Context, ar admissionRequest) (admissionResponse, error) {
+	var decision admissionResponse
+
+	body, err := json.Marshal(ar)
+	if err != nil {
+		return decision, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, aw.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, aw.url, bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range aw.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := aw.client.Do(req)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return decision, fmt.Errorf("admission webhook responded with status %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return decision, fmt.Errorf("decoding admission webhook response: %v", err)
+	}
+
+	return decision, nil
+}
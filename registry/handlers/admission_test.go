@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// TestAdmissionWebhookContextDeadline checks that a webhook call ends at the
+// deadline of the request context when it comes before the webhook timeout.
+func TestAdmissionWebhookContextDeadline(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer webhook.Close()
+
+	config := &configuration.Configuration{}
+	config.Policy.Admission.URL = webhook.URL
+	config.Policy.Admission.Timeout = time.Minute
+
+	aw, err := newAdmissionWebhook(config)
+	if err != nil {
+		t.Fatalf("unexpected error creating admission webhook: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := aw.review(ctx, admissionRequest{Repository: "foo/bar"}); err == nil {
+		t.Fatal("expected an error reviewing past the context deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("review did not honor the context deadline, took %v", elapsed)
+	}
+}
+
+func TestNewAdmissionWebhookInvalid(t *testing.T) {
+	for _, u := range []string{"ftp://example.com/admit", "://missing-scheme"} {
+		config := &configuration.Configuration{}
+		config.Policy.Admission.URL = u
+		if _, err := newAdmissionWebhook(config); err == nil {
+			t.Errorf("expected an error for url %q", u)
+		}
+	}
+}
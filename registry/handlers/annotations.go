@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/gorilla/handlers"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// annotationsDispatcher constructs the handler searching for manifests by
+// annotation.
+func annotationsDispatcher(ctx *Context, r *http.Request) http.Handler {
+	annotationsHandler := &annotationsHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(annotationsHandler.GetAnnotated),
+	}
+}
+
+// annotationsHandler handles searches for the manifests of a repository by
+// the values of their annotations.
+type annotationsHandler struct {
+	*Context
+}
+
+// GetAnnotated returns an image index of the manifests whose annotation key
+// has the value of the request.
+func (ah *annotationsHandler) GetAnnotated(w http.ResponseWriter, r *http.Request) {
+	if len(ah.App.indexedAnnotations) == 0 {
+		ah.Errors = append(ah.Errors, errcode.ErrorCodeUnsupported.WithMessage("no annotations are indexed"))
+		return
+	}
+
+	q := r.URL.Query()
+	key := q.Get("key")
+	if _, ok := ah.App.indexedAnnotations[key]; !ok {
+		ah.Errors = append(ah.Errors, v2.ErrorCodeAnnotationInvalid.WithDetail(map[string]string{"key": key}))
+		return
+	}
+	if _, ok := q["value"]; !ok {
+		ah.Errors = append(ah.Errors, v2.ErrorCodeAnnotationInvalid.WithMessage("missing annotation value"))
+		return
+	}
+
+	manifests, err := storage.ManifestsByAnnotation(ah, ah.App.driver, ah.storageName, key, q.Get("value"))
+	if err != nil {
+		ah.Errors = append(ah.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	response := referrersAPIResponse{
+		SchemaVersion: 2,
+		MediaType:     v1.MediaTypeImageIndex,
+		Manifests:     make([]referrerDescriptor, 0, len(manifests)),
+	}
+	for _, m := range manifests {
+		response.Manifests = append(response.Manifests, referrerDescriptor{
+			MediaType:    m.MediaType,
+			Size:         m.Size,
+			Digest:       m.Digest,
+			ArtifactType: m.ArtifactType,
+			Annotations:  m.Annotations,
+		})
+	}
+
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		ah.Errors = append(ah.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
@@ -2,40 +2,57 @@ package handlers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/manifest"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema1"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	_ "github.com/distribution/distribution/v3/registry/middleware/registry/rewrite"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
-	_ "github.com/distribution/distribution/v3/registry/storage/driver/testdriver"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/redirect"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/split"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testdriver"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/docker/libtrust"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var headerConfig = http.Header{
@@ -352,6 +369,151 @@ func TestTagsAPI(t *testing.T) {
 	}
 }
 
+func TestTagsAPIHead(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	tagged, err := reference.WithName("foo/tagged")
+	checkErr(t, err, "building image name")
+	createRepository(env, t, tagged.Name(), "latest")
+
+	// A repository whose only tag was deleted.
+	untagged, err := reference.WithName("foo/untagged")
+	checkErr(t, err, "building image name")
+	createRepository(env, t, untagged.Name(), "latest")
+	ref, err := reference.WithTag(untagged, "latest")
+	checkErr(t, err, "building tag reference")
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building tag URL")
+	resp, err := httpDelete(u)
+	checkErr(t, err, "deleting tag")
+	checkResponse(t, "deleting tag", resp, http.StatusAccepted)
+
+	unknown, err := reference.WithName("foo/unknown")
+	checkErr(t, err, "building image name")
+
+	for _, test := range []struct {
+		name     reference.Named
+		expected int
+	}{
+		{tagged, http.StatusOK},
+		{untagged, http.StatusNotFound},
+		{unknown, http.StatusNotFound},
+	} {
+		tagsURL, err := env.builder.BuildTagsURL(test.name)
+		checkErr(t, err, "building tags URL")
+
+		msg := fmt.Sprintf("checking tags of %s", test.name)
+		resp, err := http.Head(tagsURL)
+		checkErr(t, err, msg)
+		resp.Body.Close()
+		checkResponse(t, msg, resp, test.expected)
+	}
+}
+
+// TestTagsAPISort tests the orders of the tags listed by the sort parameter.
+func TestTagsAPISort(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("test")
+	checkErr(t, err, "building image name")
+
+	// Pushed in neither lexical order, with b pushed again last.
+	for _, tag := range []string{"c", "a", "b", "d", "b"} {
+		createRepository(env, t, imageName.Name(), tag)
+	}
+
+	for _, test := range []struct {
+		name               string
+		queryParams        url.Values
+		expectedStatusCode int
+		expectedTags       []string
+		expectedLinkHeader string
+	}{
+		{
+			name:               "lexical",
+			queryParams:        url.Values{"sort": []string{"lexical"}},
+			expectedStatusCode: http.StatusOK,
+			expectedTags:       []string{"a", "b", "c", "d"},
+		},
+		{
+			name:               "lexical descending",
+			queryParams:        url.Values{"sort": []string{"-lexical"}},
+			expectedStatusCode: http.StatusOK,
+			expectedTags:       []string{"d", "c", "b", "a"},
+		},
+		{
+			name:               "lexical descending 1st page",
+			queryParams:        url.Values{"sort": []string{"-lexical"}, "n": []string{"2"}},
+			expectedStatusCode: http.StatusOK,
+			expectedTags:       []string{"d", "c"},
+			expectedLinkHeader: `</v2/test/tags/list?last=c&n=2&sort=-lexical>; rel="next"`,
+		},
+		{
+			name:               "lexical descending last page",
+			queryParams:        url.Values{"sort": []string{"-lexical"}, "last": []string{"c"}, "n": []string{"2"}},
+			expectedStatusCode: http.StatusOK,
+			expectedTags:       []string{"b", "a"},
+		},
+		{
+			name:               "push time",
+			queryParams:        url.Values{"sort": []string{"pushtime"}},
+			expectedStatusCode: http.StatusOK,
+			expectedTags:       []string{"c", "a", "d", "b"},
+		},
+		{
+			name:               "push time descending",
+			queryParams:        url.Values{"sort": []string{"-pushtime"}},
+			expectedStatusCode: http.StatusOK,
+			expectedTags:       []string{"b", "d", "a", "c"},
+		},
+		{
+			name:               "push time descending 1st page",
+			queryParams:        url.Values{"sort": []string{"-pushtime"}, "n": []string{"3"}},
+			expectedStatusCode: http.StatusOK,
+			expectedTags:       []string{"b", "d", "a"},
+			expectedLinkHeader: `</v2/test/tags/list?last=a&n=3&sort=-pushtime>; rel="next"`,
+		},
+		{
+			name:               "push time descending last page",
+			queryParams:        url.Values{"sort": []string{"-pushtime"}, "last": []string{"a"}, "n": []string{"3"}},
+			expectedStatusCode: http.StatusOK,
+			expectedTags:       []string{"c"},
+		},
+		{
+			name:               "unknown order",
+			queryParams:        url.Values{"sort": []string{"size"}},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tagsURL, err := env.builder.BuildTagsURL(imageName, test.queryParams)
+			checkErr(t, err, "building tags URL")
+
+			resp, err := http.Get(tagsURL)
+			checkErr(t, err, "listing tags")
+			defer resp.Body.Close()
+			checkResponse(t, "listing tags", resp, test.expectedStatusCode)
+
+			if test.expectedStatusCode != http.StatusOK {
+				checkBodyHasErrorCodes(t, "listing tags in an unknown order", resp, v2.ErrorCodeTagSortInvalid)
+				return
+			}
+			var body tagsAPIResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("unexpected error decoding response body: %v", err)
+			}
+			if !reflect.DeepEqual(body.Tags, test.expectedTags) {
+				t.Fatalf("expected tags %v, got %v", test.expectedTags, body.Tags)
+			}
+			if resp.Header.Get("Link") != test.expectedLinkHeader {
+				t.Fatalf("expected response Link header to be %q, got %q", test.expectedLinkHeader, resp.Header.Get("Link"))
+			}
+		})
+	}
+}
+
 func checkLink(t *testing.T, urlStr string, numEntries int, last string) url.Values {
 	re := regexp.MustCompile("<(/v2/_catalog.*)>; rel=\"next\"")
 	matches := re.FindStringSubmatch(urlStr)
@@ -420,6 +582,160 @@ func TestURLPrefix(t *testing.T) {
 	})
 }
 
+// TestConfiguredHeaders ensures the headers from the http.headers
+// configuration are present on successful responses, error responses and
+// redirects, including headers with multiple values.
+func TestConfiguredHeaders(t *testing.T) {
+	headers := http.Header{
+		"Strict-Transport-Security": []string{"max-age=31536000"},
+		"X-Content-Type-Options":    []string{"nosniff"},
+		"Content-Security-Policy":   []string{"default-src 'none'", "frame-ancestors 'none'"},
+	}
+
+	checkConfiguredHeaders := func(msg string, resp *http.Response) {
+		for k, vs := range headers {
+			if !reflect.DeepEqual(resp.Header[k], vs) {
+				t.Fatalf("%s: unexpected values for header %q: %v != %v", msg, k, resp.Header[k], vs)
+			}
+		}
+	}
+
+	newEnv := func(middleware map[string][]configuration.Middleware) *testEnv {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"testdriver": configuration.Parameters{},
+				"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				}},
+			},
+			Middleware: middleware,
+		}
+		config.HTTP.Headers = headers
+		return newTestEnvWithConfig(t, &config)
+	}
+
+	imageName, _ := reference.WithName("foo/headers")
+	args := makeBlobArgs(t)
+
+	env := newEnv(nil)
+	defer env.Shutdown()
+
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	layerURL := pushLayer(t, env.builder, imageName, args.layerDigest, uploadURLBase, args.layerFile)
+
+	// Successful pull
+	resp, err := http.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching layer", resp, http.StatusOK)
+	checkConfiguredHeaders("fetching layer", resp)
+
+	// Error response
+	ref, _ := reference.WithDigest(imageName, digest.FromString("missing"))
+	missingURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("unexpected error building blob url: %v", err)
+	}
+	resp, err = http.Get(missingURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching missing layer: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching missing layer", resp, http.StatusNotFound)
+	checkConfiguredHeaders("fetching missing layer", resp)
+
+	// Redirect
+	redirectEnv := newEnv(map[string][]configuration.Middleware{
+		"storage": {{
+			Name:    "redirect",
+			Options: configuration.Parameters{"baseurl": "https://storage.example.com/"},
+		}},
+	})
+	defer redirectEnv.Shutdown()
+
+	args.layerFile.Seek(0, io.SeekStart)
+	uploadURLBase, _ = startPushLayer(t, redirectEnv, imageName)
+	layerURL = pushLayer(t, redirectEnv.builder, imageName, args.layerDigest, uploadURLBase, args.layerFile)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err = client.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching redirected layer", resp, http.StatusTemporaryRedirect)
+	checkConfiguredHeaders("fetching redirected layer", resp)
+}
+
+// TestRedirectDisabledRepositories checks that the blobs of the repositories
+// matching the redirect disablerepositories are served by the registry, while
+// the blobs of other repositories are redirected to the backend.
+func TestRedirectDisabledRepositories(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+			"redirect": configuration.Parameters{"disablerepositories": []interface{}{"secret/.*"}},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"storage": {{
+				Name:    "redirect",
+				Options: configuration.Parameters{"baseurl": "https://storage.example.com/"},
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, tc := range []struct {
+		name     string
+		redirect bool
+	}{
+		{"foo/public", true},
+		{"secret/data", false},
+		{"secretive/data", true},
+	} {
+		imageName, _ := reference.WithName(tc.name)
+		args := makeBlobArgs(t)
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		layerURL := pushLayer(t, env.builder, imageName, args.layerDigest, uploadURLBase, args.layerFile)
+
+		resp, err := client.Get(layerURL)
+		if err != nil {
+			t.Fatalf("unexpected error fetching layer of %s: %v", tc.name, err)
+		}
+		defer resp.Body.Close()
+		if tc.redirect {
+			checkResponse(t, "fetching redirected layer", resp, http.StatusTemporaryRedirect)
+			if location := resp.Header.Get("Location"); !strings.HasPrefix(location, "https://storage.example.com/") {
+				t.Fatalf("unexpected redirect of %s: %q", tc.name, location)
+			}
+			continue
+		}
+
+		checkResponse(t, "fetching proxied layer", resp, http.StatusOK)
+		verifier := args.layerDigest.Verifier()
+		io.Copy(verifier, resp.Body)
+		if !verifier.Verified() {
+			t.Fatalf("content of layer of %s does not match its digest", tc.name)
+		}
+	}
+}
+
 type blobArgs struct {
 	imageName   reference.Named
 	layerFile   io.ReadSeeker
@@ -466,2345 +782,5921 @@ func TestBlobDelete(t *testing.T) {
 	testBlobDelete(t, env, args)
 }
 
-func TestRelativeURL(t *testing.T) {
-	config := configuration.Configuration{
-		Storage: configuration.Storage{
-			"testdriver": configuration.Parameters{},
-			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
-				"enabled": false,
-			}},
-		},
-	}
-	config.HTTP.Headers = headerConfig
-	config.HTTP.RelativeURLs = false
-	env := newTestEnvWithConfig(t, &config)
+// TestBlobUploadPatchReplay checks that a PATCH resent after it was applied,
+// as when a client retries after a network error, does not corrupt the upload.
+func TestBlobUploadPatchReplay(t *testing.T) {
+	env := newTestEnv(t, false)
 	defer env.Shutdown()
-	ref, _ := reference.WithName("foo/bar")
-	uploadURLBaseAbs, _ := startPushLayer(t, env, ref)
-
-	u, err := url.Parse(uploadURLBaseAbs)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !u.IsAbs() {
-		t.Fatal("Relative URL returned from blob upload chunk with non-relative configuration")
-	}
 
-	args := makeBlobArgs(t)
-	resp, err := doPushLayer(t, env.builder, ref, args.layerDigest, uploadURLBaseAbs, args.layerFile)
+	imageName, _ := reference.WithName("foo/replay")
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
 	if err != nil {
-		t.Fatalf("unexpected error doing layer push relative url: %v", err)
+		t.Fatalf("error creating random layer file: %v", err)
 	}
-	checkResponse(t, "relativeurl blob upload", resp, http.StatusCreated)
-	u, err = url.Parse(resp.Header.Get("Location"))
+	layer, err := ioutil.ReadAll(layerFile)
 	if err != nil {
-		t.Fatal(err)
-	}
-	if !u.IsAbs() {
-		t.Fatal("Relative URL returned from blob upload with non-relative configuration")
+		t.Fatalf("error reading layer: %v", err)
 	}
+	first, second := layer[:len(layer)/2], layer[len(layer)/2:]
 
-	config.HTTP.RelativeURLs = true
-	args = makeBlobArgs(t)
-	uploadURLBaseRelative, _ := startPushLayer(t, env, ref)
-	u, err = url.Parse(uploadURLBaseRelative)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if u.IsAbs() {
-		t.Fatal("Absolute URL returned from blob upload chunk with relative configuration")
-	}
+	firstURL, _ := startPushLayer(t, env, imageName)
 
-	// Start a new upload in absolute mode to get a valid base URL
-	config.HTTP.RelativeURLs = false
-	uploadURLBaseAbs, _ = startPushLayer(t, env, ref)
-	u, err = url.Parse(uploadURLBaseAbs)
+	// Push the first chunk
+	resp, err := doPushChunk(t, firstURL, bytes.NewReader(first), chunkOptions{
+		contentRange: fmt.Sprintf("0-%d", len(first)-1),
+	})
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("unexpected error pushing first chunk: %v", err)
 	}
-	if !u.IsAbs() {
-		t.Fatal("Relative URL returned from blob upload chunk with non-relative configuration")
+	resp.Body.Close()
+	checkResponse(t, "pushing first chunk", resp, http.StatusAccepted)
+	secondURL := resp.Header.Get("Location")
+
+	committed := fmt.Sprintf("0-%d", len(first)-1)
+
+	// Replay the first chunk exactly, from the URL it was first sent to,
+	// with and without a Content-Range
+	for _, options := range []chunkOptions{{contentRange: committed}, {}} {
+		resp, err = doPushChunk(t, firstURL, bytes.NewReader(first), options)
+		if err != nil {
+			t.Fatalf("unexpected error replaying first chunk: %v", err)
+		}
+		resp.Body.Close()
+		checkResponse(t, "replaying first chunk", resp, http.StatusAccepted)
+		checkHeaders(t, resp, http.Header{
+			"Range": []string{committed},
+		})
 	}
 
-	// Complete upload with relative URLs enabled to ensure the final location is relative
-	config.HTTP.RelativeURLs = true
-	resp, err = doPushLayer(t, env.builder, ref, args.layerDigest, uploadURLBaseAbs, args.layerFile)
+	// Send a chunk overlapping the end of the committed bytes
+	overlapping := layer[len(first)-10 : len(first)+10]
+	resp, err = doPushChunk(t, secondURL, bytes.NewReader(overlapping), chunkOptions{
+		contentRange: fmt.Sprintf("%d-%d", len(first)-10, len(first)+9),
+	})
 	if err != nil {
-		t.Fatalf("unexpected error doing layer push relative url: %v", err)
+		t.Fatalf("unexpected error pushing overlapping chunk: %v", err)
 	}
+	checkResponse(t, "pushing overlapping chunk", resp, http.StatusRequestedRangeNotSatisfiable)
+	checkBodyHasErrorCodes(t, "pushing overlapping chunk", resp, v2.ErrorCodeRangeInvalid)
+	resp.Body.Close()
+	checkHeaders(t, resp, http.Header{
+		"Range": []string{committed},
+	})
 
-	checkResponse(t, "relativeurl blob upload", resp, http.StatusCreated)
-	u, err = url.Parse(resp.Header.Get("Location"))
+	// Resynchronize with the returned location and finish the upload
+	resp, err = doPushChunk(t, resp.Header.Get("Location"), bytes.NewReader(second), chunkOptions{
+		contentRange: fmt.Sprintf("%d-%d", len(first), len(layer)-1),
+	})
 	if err != nil {
-		t.Fatal(err)
-	}
-	if u.IsAbs() {
-		t.Fatal("Relative URL returned from blob upload with non-relative configuration")
+		t.Fatalf("unexpected error pushing second chunk: %v", err)
 	}
-}
+	resp.Body.Close()
+	checkResponse(t, "pushing second chunk", resp, http.StatusAccepted)
+	checkHeaders(t, resp, http.Header{
+		"Range": []string{fmt.Sprintf("0-%d", len(layer)-1)},
+	})
 
-func TestBlobDeleteDisabled(t *testing.T) {
-	deleteEnabled := false
-	env := newTestEnv(t, deleteEnabled)
-	defer env.Shutdown()
-	args := makeBlobArgs(t)
+	finishUpload(t, env.builder, imageName, resp.Header.Get("Location"), layerDigest)
 
-	imageName := args.imageName
-	layerDigest := args.layerDigest
 	ref, _ := reference.WithDigest(imageName, layerDigest)
 	layerURL, err := env.builder.BuildBlobURL(ref)
 	if err != nil {
-		t.Fatalf("error building url: %v", err)
+		t.Fatalf("error building layer url: %v", err)
 	}
-
-	resp, err := httpDelete(layerURL)
+	resp, err = http.Get(layerURL)
 	if err != nil {
-		t.Fatalf("unexpected error deleting when disabled: %v", err)
+		t.Fatalf("unexpected error fetching layer: %v", err)
 	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching layer", resp, http.StatusOK)
 
-	checkResponse(t, "status of disabled delete", resp, http.StatusMethodNotAllowed)
+	fetched, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading layer: %v", err)
+	}
+	if !bytes.Equal(fetched, layer) {
+		t.Fatalf("fetched layer does not match pushed layer")
+	}
 }
 
-func testBlobAPI(t *testing.T, env *testEnv, args blobArgs) *testEnv {
-	// TODO(stevvooe): This test code is complete junk but it should cover the
-	// complete flow. This must be broken down and checked against the
-	// specification *before* we submit the final to docker core.
-	imageName := args.imageName
-	layerFile := args.layerFile
-	layerDigest := args.layerDigest
+// chunkRecordingDriver records the size of the chunks written to upload data
+// files, a chunk being the data written between opening and closing a writer.
+type chunkRecordingDriver struct {
+	storagedriver.StorageDriver
 
-	// -----------------------------------
-	// Test fetch for non-existent content
-	ref, _ := reference.WithDigest(imageName, layerDigest)
-	layerURL, err := env.builder.BuildBlobURL(ref)
-	if err != nil {
-		t.Fatalf("error building url: %v", err)
-	}
+	mu     sync.Mutex
+	chunks []int64
+}
 
-	resp, err := http.Get(layerURL)
-	if err != nil {
-		t.Fatalf("unexpected error fetching non-existent layer: %v", err)
+func (d *chunkRecordingDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := d.StorageDriver.Writer(ctx, path, append)
+	if err != nil || !strings.Contains(path, "/_uploads/") {
+		return fw, err
 	}
+	return &chunkRecordingFileWriter{FileWriter: fw, driver: d}, nil
+}
 
-	checkResponse(t, "fetching non-existent content", resp, http.StatusNotFound)
+func (d *chunkRecordingDriver) recorded() []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]int64(nil), d.chunks...)
+}
 
-	// ------------------------------------------
-	// Test head request for non-existent content
+type chunkRecordingFileWriter struct {
+	storagedriver.FileWriter
+	driver  *chunkRecordingDriver
+	written int64
+}
+
+func (w *chunkRecordingFileWriter) Write(p []byte) (int, error) {
+	n, err := w.FileWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *chunkRecordingFileWriter) record() {
+	if w.written == 0 {
+		return
+	}
+	w.driver.mu.Lock()
+	w.driver.chunks = append(w.driver.chunks, w.written)
+	w.driver.mu.Unlock()
+	w.written = 0
+}
+
+func (w *chunkRecordingFileWriter) Close() error {
+	w.record()
+	return w.FileWriter.Close()
+}
+
+func (w *chunkRecordingFileWriter) Commit() error {
+	w.record()
+	return w.FileWriter.Commit()
+}
+
+type chunkRecordingDriverFactory struct {
+	driver *chunkRecordingDriver
+}
+
+func (factory *chunkRecordingDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return factory.driver, nil
+}
+
+// TestBlobDigestTrailer checks that a blob download carries the digest of
+// the content streamed in a trailer when the client accepts trailers, and
+// only then.
+func TestBlobDigestTrailer(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	args := makeBlobArgs(t)
+	uploadURLBase, _ := startPushLayer(t, env, args.imageName)
+	pushLayer(t, env.builder, args.imageName, args.layerDigest, uploadURLBase, args.layerFile)
+	ref, _ := reference.WithDigest(args.imageName, args.layerDigest)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+
+	get := func(header http.Header) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest("GET", blobURL, nil)
+		checkErr(t, err, "building request")
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "fetching blob")
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		checkErr(t, err, "reading blob")
+		return resp, body
+	}
+
+	resp, body := get(http.Header{"Te": []string{"trailers"}})
+	checkResponse(t, "fetching blob accepting trailers", resp, http.StatusOK)
+	if digest.FromBytes(body) != args.layerDigest {
+		t.Fatalf("unexpected content fetched")
+	}
+	if trailer := resp.Trailer.Get("Docker-Content-Digest"); trailer != args.layerDigest.String() {
+		t.Fatalf("unexpected digest trailer: %q != %q", trailer, args.layerDigest)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"not accepting trailers", http.Header{}, http.StatusOK},
+		{"fetching a range", http.Header{"Te": []string{"trailers"}, "Range": []string{"bytes=0-9"}}, http.StatusPartialContent},
+	} {
+		resp, _ := get(tc.header)
+		checkResponse(t, tc.name, resp, tc.status)
+		if len(resp.Trailer) != 0 {
+			t.Fatalf("%s: unexpected trailers: %v", tc.name, resp.Trailer)
+		}
+		if resp.ContentLength < 0 {
+			t.Fatalf("%s: no content length", tc.name)
+		}
+	}
+}
+
+// TestBlobUploadDeclaredSize checks that completing an upload verifies the
+// size of the blob the client declares with the range of the final chunk,
+// discarding the upload when it does not match.
+func TestBlobUploadDeclaredSize(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/declared")
+	complete := func(uploadURLBase string, dgst digest.Digest, body []byte, contentRange string) *http.Response {
+		t.Helper()
+		u, err := url.Parse(uploadURLBase)
+		checkErr(t, err, "parsing upload url")
+		query := u.Query()
+		query.Set("digest", dgst.String())
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(body))
+		checkErr(t, err, "building request")
+		req.Header.Set("Content-Range", contentRange)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "completing upload")
+		return resp
+	}
+	startChunked := func() (layer []byte, dgst digest.Digest, location string) {
+		t.Helper()
+		layerFile, dgst, err := testutil.CreateRandomTarFile()
+		checkErr(t, err, "creating random layer file")
+		layer, err = ioutil.ReadAll(layerFile)
+		checkErr(t, err, "reading layer")
+		uploadURL, _ := startPushLayer(t, env, imageName)
+		resp, err := doPushChunk(t, uploadURL, bytes.NewReader(layer[:len(layer)/2]), chunkOptions{})
+		checkErr(t, err, "pushing first chunk")
+		resp.Body.Close()
+		checkResponse(t, "pushing first chunk", resp, http.StatusAccepted)
+		return layer, dgst, resp.Header.Get("Location")
+	}
+
+	// A final chunk ending the blob at the size uploaded completes it.
+	layer, dgst, location := startChunked()
+	resp := complete(location, dgst, layer[len(layer)/2:], fmt.Sprintf("%d-%d", len(layer)/2, len(layer)-1))
+	resp.Body.Close()
+	checkResponse(t, "completing with the size uploaded", resp, http.StatusCreated)
+
+	// A final chunk not starting at the offset is rejected, leaving the
+	// upload to resume.
+	layer, dgst, location = startChunked()
+	resp = complete(location, dgst, layer, fmt.Sprintf("0-%d", len(layer)-1))
+	checkResponse(t, "completing from the wrong offset", resp, http.StatusRequestedRangeNotSatisfiable)
+	checkBodyHasErrorCodes(t, "completing from the wrong offset", resp, v2.ErrorCodeRangeInvalid)
+	resp.Body.Close()
+
+	// Declaring a blob larger than the data uploaded discards the upload,
+	// even though the digest matches the data.
+	resp = complete(location, dgst, layer[len(layer)/2:], fmt.Sprintf("%d-%d", len(layer)/2, len(layer)+99))
+	checkResponse(t, "completing with a larger size", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "completing with a larger size", resp, v2.ErrorCodeSizeInvalid)
+	resp.Body.Close()
+
+	resp, err := http.Get(location)
+	checkErr(t, err, "getting upload status")
+	checkResponse(t, "getting discarded upload status", resp, http.StatusNotFound)
+	resp.Body.Close()
+
+	ref, _ := reference.WithDigest(imageName, dgst)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building layer url")
 	resp, err = http.Head(layerURL)
-	if err != nil {
-		t.Fatalf("unexpected error checking head on non-existent layer: %v", err)
+	checkErr(t, err, "checking layer existence")
+	checkResponse(t, "checking discarded layer", resp, http.StatusNotFound)
+	resp.Body.Close()
+}
+
+// TestBlobUploadMinChunkSize checks that many small chunks of an upload are
+// written to the driver in chunks of at least the minimum size but the last,
+// while the offsets reported count all the data received.
+func TestBlobUploadMinChunkSize(t *testing.T) {
+	const (
+		minChunkSize = 1024
+		patchSize    = 50
+		patches      = 200
+	)
+
+	driver := &chunkRecordingDriver{StorageDriver: testdriver.New()}
+	factory.Register("chunkrecording", &chunkRecordingDriverFactory{driver: driver})
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"chunkrecording": configuration.Parameters{},
+			"uploads":        configuration.Parameters{"minchunksize": minChunkSize},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	checkResponse(t, "checking head on non-existent layer", resp, http.StatusNotFound)
+	imageName, _ := reference.WithName("foo/smallchunks")
+	layer := make([]byte, patchSize*patches)
+	if _, err := rand.Read(layer); err != nil {
+		t.Fatalf("error generating layer: %v", err)
+	}
+	layerDigest := digest.FromBytes(layer)
 
-	// ------------------------------------------
-	// Start an upload, check the status then cancel
-	uploadURLBase, uploadUUID := startPushLayer(t, env, imageName)
+	uploadURL, _ := startPushLayer(t, env, imageName)
+	for i := 0; i < patches; i++ {
+		start, end := i*patchSize, (i+1)*patchSize
+		resp, err := doPushChunk(t, uploadURL, bytes.NewReader(layer[start:end]), chunkOptions{
+			contentRange: fmt.Sprintf("%d-%d", start, end-1),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error pushing chunk %d: %v", i, err)
+		}
+		resp.Body.Close()
+		checkResponse(t, "pushing small chunk", resp, http.StatusAccepted)
+		checkHeaders(t, resp, http.Header{
+			"Range": []string{fmt.Sprintf("0-%d", end-1)},
+		})
+		uploadURL = resp.Header.Get("Location")
+	}
 
-	// A status check should work
-	resp, err = http.Get(uploadURLBase)
+	// The status of the upload counts the data held back.
+	resp, err := http.Get(uploadURL)
 	if err != nil {
 		t.Fatalf("unexpected error getting upload status: %v", err)
 	}
-	checkResponse(t, "status of deleted upload", resp, http.StatusNoContent)
+	resp.Body.Close()
+	checkResponse(t, "getting upload status", resp, http.StatusNoContent)
 	checkHeaders(t, resp, http.Header{
-		"Location":           []string{"*"},
-		"Range":              []string{"0-0"},
-		"Docker-Upload-UUID": []string{uploadUUID},
+		"Range": []string{fmt.Sprintf("0-%d", len(layer)-1)},
 	})
 
-	req, err := http.NewRequest("DELETE", uploadURLBase, nil)
-	if err != nil {
-		t.Fatalf("unexpected error creating delete request: %v", err)
-	}
+	finishUpload(t, env.builder, imageName, uploadURL, layerDigest)
 
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatalf("unexpected error sending delete request: %v", err)
+	chunks := driver.recorded()
+	if max := len(layer)/minChunkSize + 1; len(chunks) > max {
+		t.Fatalf("%d patches written in %d chunks, expected at most %d", patches, len(chunks), max)
+	}
+	var total int64
+	for i, size := range chunks {
+		if i < len(chunks)-1 && size < minChunkSize {
+			t.Fatalf("chunk %d of %d bytes written, below the minimum: %v", i, size, chunks)
+		}
+		total += size
+	}
+	if total != int64(len(layer)) {
+		t.Fatalf("%d bytes written, expected %d: %v", total, len(layer), chunks)
 	}
 
-	checkResponse(t, "deleting upload", resp, http.StatusNoContent)
-
-	// A status check should result in 404
-	resp, err = http.Get(uploadURLBase)
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
 	if err != nil {
-		t.Fatalf("unexpected error getting upload status: %v", err)
+		t.Fatalf("error building layer url: %v", err)
 	}
-	checkResponse(t, "status of deleted upload", resp, http.StatusNotFound)
-
-	// -----------------------------------------
-	// Do layer push with an empty body and different digest
-	uploadURLBase, _ = startPushLayer(t, env, imageName)
-	resp, err = doPushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, bytes.NewReader([]byte{}))
+	resp, err = http.Get(layerURL)
 	if err != nil {
-		t.Fatalf("unexpected error doing bad layer push: %v", err)
+		t.Fatalf("unexpected error fetching layer: %v", err)
 	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching layer", resp, http.StatusOK)
 
-	checkResponse(t, "bad layer push", resp, http.StatusBadRequest)
-	checkBodyHasErrorCodes(t, "bad layer push", resp, v2.ErrorCodeDigestInvalid)
-
-	// -----------------------------------------
-	// Do layer push with an empty body and correct digest
-	zeroDigest, err := digest.FromReader(bytes.NewReader([]byte{}))
+	fetched, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		t.Fatalf("unexpected error digesting empty buffer: %v", err)
+		t.Fatalf("error reading layer: %v", err)
+	}
+	if !bytes.Equal(fetched, layer) {
+		t.Fatalf("fetched layer does not match pushed layer")
 	}
+}
 
-	uploadURLBase, _ = startPushLayer(t, env, imageName)
-	pushLayer(t, env.builder, imageName, zeroDigest, uploadURLBase, bytes.NewReader([]byte{}))
+type fixedDriverFactory struct {
+	driver storagedriver.StorageDriver
+}
 
-	// -----------------------------------------
-	// Do layer push with an empty body and correct digest
+func (factory *fixedDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return factory.driver, nil
+}
 
-	// This is a valid but empty tarfile!
-	emptyTar := bytes.Repeat([]byte("\x00"), 1024)
-	emptyDigest, err := digest.FromReader(bytes.NewReader(emptyTar))
-	if err != nil {
-		t.Fatalf("unexpected error digesting empty tar: %v", err)
+// TestBlobUploadScratchStorage checks that, with the split driver given an
+// uploads driver, chunked uploads are stored with the uploads driver until
+// committed to the blobs driver, and the uploads driver is cleaned up once
+// uploads are committed or cancelled.
+func TestBlobUploadScratchStorage(t *testing.T) {
+	metadataDriver := testdriver.New()
+	blobsDriver := testdriver.New()
+	uploadsDriver := testdriver.New()
+	factory.Register("scratchmetadata", &fixedDriverFactory{driver: metadataDriver})
+	factory.Register("scratchblobs", &fixedDriverFactory{driver: blobsDriver})
+	factory.Register("scratchuploads", &fixedDriverFactory{driver: uploadsDriver})
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"split": configuration.Parameters{
+				"metadata": map[interface{}]interface{}{"scratchmetadata": nil},
+				"blobs":    map[interface{}]interface{}{"scratchblobs": nil},
+				"uploads":  map[interface{}]interface{}{"scratchuploads": nil},
+			},
+			"delete": configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	uploadURLBase, _ = startPushLayer(t, env, imageName)
-	pushLayer(t, env.builder, imageName, emptyDigest, uploadURLBase, bytes.NewReader(emptyTar))
-
-	// ------------------------------------------
-	// Now, actually do successful upload.
-	layerLength, _ := layerFile.Seek(0, io.SeekEnd)
-	layerFile.Seek(0, io.SeekStart)
-
-	uploadURLBase, _ = startPushLayer(t, env, imageName)
-	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+	imageName, _ := reference.WithName("foo/scratch")
+	layer := make([]byte, 3000)
+	if _, err := rand.Read(layer); err != nil {
+		t.Fatalf("error generating layer: %v", err)
+	}
+	layerDigest := digest.FromBytes(layer)
+	uploadsPath := "/docker/registry/v2/repositories/foo/scratch/_uploads"
 
-	// ------------------------------------------
-	// Now, push just a chunk
-	layerFile.Seek(0, 0)
+	uploadURL, uploadUUID := startPushLayer(t, env, imageName)
+	for start := 0; start < len(layer); start += 1000 {
+		resp, err := doPushChunk(t, uploadURL, bytes.NewReader(layer[start:start+1000]), chunkOptions{
+			contentRange: fmt.Sprintf("%d-%d", start, start+999),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error pushing chunk: %v", err)
+		}
+		resp.Body.Close()
+		checkResponse(t, "pushing chunk", resp, http.StatusAccepted)
+		uploadURL = resp.Header.Get("Location")
+	}
 
-	canonicalDigester := digest.Canonical.Digester()
-	if _, err := io.Copy(canonicalDigester.Hash(), layerFile); err != nil {
-		t.Fatalf("error copying to digest: %v", err)
+	ctx := context.Background()
+	uploadData := path.Join(uploadsPath, uploadUUID, "data")
+	if fi, err := uploadsDriver.Stat(ctx, uploadData); err != nil || fi.Size() != int64(len(layer)) {
+		t.Fatalf("expected the upload in the uploads driver: %v", err)
+	}
+	if _, err := blobsDriver.Stat(ctx, uploadData); err == nil {
+		t.Fatalf("unexpected upload in the blobs driver")
 	}
-	canonicalDigest := canonicalDigester.Digest()
 
-	layerFile.Seek(0, 0)
-	uploadURLBase, _ = startPushLayer(t, env, imageName)
-	uploadURLBase, dgst := pushChunk(t, env.builder, imageName, uploadURLBase, layerFile, layerLength)
-	finishUpload(t, env.builder, imageName, uploadURLBase, dgst)
+	finishUpload(t, env.builder, imageName, uploadURL, layerDigest)
 
-	// -----------------------------------------
-	// Do layer push with invalid content range
-	layerFile.Seek(0, io.SeekStart)
-	uploadURLBase, _ = startPushLayer(t, env, imageName)
-	sizeInvalid := chunkOptions{
-		contentRange: "0-20",
-	}
-	resp, err = doPushChunk(t, uploadURLBase, layerFile, sizeInvalid)
+	blobData := fmt.Sprintf("/docker/registry/v2/blobs/sha256/%s/%s/data", layerDigest.Encoded()[:2], layerDigest.Encoded())
+	content, err := blobsDriver.GetContent(ctx, blobData)
 	if err != nil {
-		t.Fatalf("unexpected error doing push layer request: %v", err)
+		t.Fatalf("expected the layer in the blobs driver: %v", err)
 	}
-	defer resp.Body.Close()
-	checkResponse(t, "putting size invalid chunk", resp, http.StatusBadRequest)
-
-	layerFile.Seek(0, io.SeekStart)
-	uploadURLBase, _ = startPushLayer(t, env, imageName)
-	outOfOrder := chunkOptions{
-		contentRange: "3-22",
+	if !bytes.Equal(content, layer) {
+		t.Fatalf("layer in the blobs driver does not match pushed layer")
 	}
-	resp, err = doPushChunk(t, uploadURLBase, layerFile, outOfOrder)
-	if err != nil {
-		t.Fatalf("unexpected error doing push layer request: %v", err)
+	if _, err := uploadsDriver.Stat(ctx, path.Join(uploadsPath, uploadUUID)); err == nil {
+		t.Fatalf("upload left in the uploads driver after completion")
 	}
-	defer resp.Body.Close()
-	checkResponse(t, "putting range out of order chunk", resp, http.StatusRequestedRangeNotSatisfiable)
 
-	// ------------------------
-	// Use a head request to see if the layer exists.
-	resp, err = http.Head(layerURL)
+	// Cancelling an upload cleans up the uploads driver.
+	uploadURL, uploadUUID = startPushLayer(t, env, imageName)
+	resp, err := doPushChunk(t, uploadURL, bytes.NewReader(layer[:1000]), chunkOptions{contentRange: "0-999"})
 	if err != nil {
-		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+		t.Fatalf("unexpected error pushing chunk: %v", err)
+	}
+	resp.Body.Close()
+	checkResponse(t, "pushing chunk", resp, http.StatusAccepted)
+	if _, err := uploadsDriver.Stat(ctx, path.Join(uploadsPath, uploadUUID, "data")); err != nil {
+		t.Fatalf("expected the upload in the uploads driver: %v", err)
 	}
 
-	checkResponse(t, "checking head on existing layer", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Content-Length":        []string{fmt.Sprint(layerLength)},
-		"Docker-Content-Digest": []string{canonicalDigest.String()},
-	})
-
-	// ----------------
-	// Fetch the layer!
-	resp, err = http.Get(layerURL)
+	req, err := http.NewRequest(http.MethodDelete, resp.Header.Get("Location"), nil)
 	if err != nil {
-		t.Fatalf("unexpected error fetching layer: %v", err)
+		t.Fatalf("unexpected error creating delete request: %v", err)
 	}
-
-	checkResponse(t, "fetching layer", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Content-Length":        []string{fmt.Sprint(layerLength)},
-		"Docker-Content-Digest": []string{canonicalDigest.String()},
-	})
-
-	// Verify the body
-	verifier := layerDigest.Verifier()
-	io.Copy(verifier, resp.Body)
-
-	if !verifier.Verified() {
-		t.Fatalf("response body did not pass verification")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error cancelling upload: %v", err)
 	}
+	resp.Body.Close()
+	checkResponse(t, "cancelling upload", resp, http.StatusNoContent)
+	if _, err := uploadsDriver.Stat(ctx, path.Join(uploadsPath, uploadUUID)); err == nil {
+		t.Fatalf("upload left in the uploads driver after cancellation")
+	}
+}
 
-	// ----------------
-	// Fetch the layer with an invalid digest
-	badURL := strings.Replace(layerURL, "sha256", "sha257", 1)
-	resp, err = http.Get(badURL)
-	if err != nil {
-		t.Fatalf("unexpected error fetching layer: %v", err)
+// TestBlobUploadListing checks that, when enabled, the in-progress uploads of
+// a repository can be listed with their offsets and timestamps, and that
+// listing requires full access to the repository.
+func TestBlobUploadListing(t *testing.T) {
+	newConfig := func(listing bool) configuration.Configuration {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"testdriver": configuration.Parameters{},
+				"maintenance": configuration.Parameters{
+					"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					},
+					"uploadlisting": map[interface{}]interface{}{
+						"enabled": listing,
+					},
+				},
+			},
+		}
+		config.HTTP.Headers = headerConfig
+		return config
 	}
 
-	checkResponse(t, "fetching layer bad digest", resp, http.StatusBadRequest)
+	config := newConfig(true)
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	// Cache headers
-	resp, err = http.Get(layerURL)
-	if err != nil {
-		t.Fatalf("unexpected error fetching layer: %v", err)
-	}
+	imageName, _ := reference.WithName("foo/uploads")
+	listURL, err := env.builder.BuildBlobUploadURL(imageName)
+	checkErr(t, err, "building upload url")
 
-	checkResponse(t, "fetching layer", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Content-Length":        []string{fmt.Sprint(layerLength)},
-		"Docker-Content-Digest": []string{canonicalDigest.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, canonicalDigest)},
-		"Cache-Control":         []string{"max-age=31536000"},
-	})
+	before := time.Now().UTC().Truncate(time.Second)
+	_, emptyUUID := startPushLayer(t, env, imageName)
+	chunkURL, chunkUUID := startPushLayer(t, env, imageName)
 
-	// Matching etag, gives 304
-	etag := resp.Header.Get("Etag")
-	req, err = http.NewRequest("GET", layerURL, nil)
+	chunk := bytes.Repeat([]byte("a"), 100)
+	resp, err := doPushChunk(t, chunkURL, bytes.NewReader(chunk), chunkOptions{})
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("unexpected error pushing chunk: %v", err)
 	}
-	req.Header.Set("If-None-Match", etag)
+	resp.Body.Close()
+	checkResponse(t, "pushing chunk", resp, http.StatusAccepted)
+	after := time.Now().UTC()
 
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = http.Get(listURL)
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("unexpected error listing uploads: %v", err)
 	}
+	defer resp.Body.Close()
+	checkResponse(t, "listing uploads", resp, http.StatusOK)
 
-	checkResponse(t, "fetching layer with etag", resp, http.StatusNotModified)
-
-	// Non-matching etag, gives 200
-	req, err = http.NewRequest("GET", layerURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+	var body blobUploadsAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("error decoding upload list: %v", err)
+	}
+	if body.Name != imageName.Name() {
+		t.Fatalf("unexpected repository name: %q", body.Name)
 	}
-	req.Header.Set("If-None-Match", "")
-	resp, _ = http.DefaultClient.Do(req)
-	checkResponse(t, "fetching layer with invalid etag", resp, http.StatusOK)
 
-	// Missing tests:
-	// 	- Upload the same tar file under and different repository and
-	//       ensure the content remains uncorrupted.
-	return env
-}
+	expected := map[string]int64{emptyUUID: 0, chunkUUID: int64(len(chunk))}
+	if len(body.Uploads) != len(expected) {
+		t.Fatalf("expected %d uploads, got %v", len(expected), body.Uploads)
+	}
+	for _, upload := range body.Uploads {
+		offset, ok := expected[upload.UUID]
+		if !ok {
+			t.Fatalf("unexpected upload %s", upload.UUID)
+		}
+		if upload.Offset != offset {
+			t.Errorf("upload %s: expected offset %d, got %d", upload.UUID, offset, upload.Offset)
+		}
+		if upload.StartedAt.Before(before) || upload.StartedAt.After(after) {
+			t.Errorf("upload %s: start time %v outside of [%v, %v]", upload.UUID, upload.StartedAt, before, after)
+		}
+		if upload.LastModified.Before(upload.StartedAt) || upload.LastModified.After(after) {
+			t.Errorf("upload %s: last modified time %v outside of [%v, %v]", upload.UUID, upload.LastModified, upload.StartedAt, after)
+		}
+	}
 
-func testBlobDelete(t *testing.T, env *testEnv, args blobArgs) {
-	// Upload a layer
-	imageName := args.imageName
-	layerFile := args.layerFile
-	layerDigest := args.layerDigest
+	// Listing requires full access to the repository, which is not asked
+	// for when listing is disabled.
+	for _, listing := range []bool{true, false} {
+		authConfig := newConfig(listing)
+		authConfig.Auth = configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		}
+		authEnv := newTestEnvWithConfig(t, &authConfig)
+		defer authEnv.Shutdown()
 
-	ref, _ := reference.WithDigest(imageName, layerDigest)
-	layerURL, err := env.builder.BuildBlobURL(ref)
+		listURL, err = authEnv.builder.BuildBlobUploadURL(imageName)
+		checkErr(t, err, "building upload url")
+
+		resp, err = http.Get(listURL)
+		if err != nil {
+			t.Fatalf("unexpected error listing uploads: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, "listing uploads without authorization", resp, http.StatusUnauthorized)
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if fullAccess := strings.Contains(challenge, "repository:foo/uploads:*"); fullAccess != listing {
+			t.Fatalf("listing enabled %v: unexpected challenge %q", listing, challenge)
+		}
+	}
+}
+
+func TestRelativeURL(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.HTTP.RelativeURLs = false
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+	ref, _ := reference.WithName("foo/bar")
+	uploadURLBaseAbs, _ := startPushLayer(t, env, ref)
+
+	u, err := url.Parse(uploadURLBaseAbs)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err)
 	}
-	// ---------------
-	// Delete a layer
-	resp, err := httpDelete(layerURL)
+	if !u.IsAbs() {
+		t.Fatal("Relative URL returned from blob upload chunk with non-relative configuration")
+	}
+
+	args := makeBlobArgs(t)
+	resp, err := doPushLayer(t, env.builder, ref, args.layerDigest, uploadURLBaseAbs, args.layerFile)
 	if err != nil {
-		t.Fatalf("unexpected error deleting layer: %v", err)
+		t.Fatalf("unexpected error doing layer push relative url: %v", err)
+	}
+	checkResponse(t, "relativeurl blob upload", resp, http.StatusCreated)
+	u, err = url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.IsAbs() {
+		t.Fatal("Relative URL returned from blob upload with non-relative configuration")
 	}
 
-	checkResponse(t, "deleting layer", resp, http.StatusAccepted)
-	checkHeaders(t, resp, http.Header{
-		"Content-Length": []string{"0"},
-	})
+	config.HTTP.RelativeURLs = true
+	args = makeBlobArgs(t)
+	uploadURLBaseRelative, _ := startPushLayer(t, env, ref)
+	u, err = url.Parse(uploadURLBaseRelative)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.IsAbs() {
+		t.Fatal("Absolute URL returned from blob upload chunk with relative configuration")
+	}
 
-	// ---------------
-	// Try and get it back
-	// Use a head request to see if the layer exists.
-	resp, err = http.Head(layerURL)
+	// Start a new upload in absolute mode to get a valid base URL
+	config.HTTP.RelativeURLs = false
+	uploadURLBaseAbs, _ = startPushLayer(t, env, ref)
+	u, err = url.Parse(uploadURLBaseAbs)
 	if err != nil {
-		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+		t.Fatal(err)
+	}
+	if !u.IsAbs() {
+		t.Fatal("Relative URL returned from blob upload chunk with non-relative configuration")
 	}
 
-	checkResponse(t, "checking existence of deleted layer", resp, http.StatusNotFound)
+	// Complete upload with relative URLs enabled to ensure the final location is relative
+	config.HTTP.RelativeURLs = true
+	resp, err = doPushLayer(t, env.builder, ref, args.layerDigest, uploadURLBaseAbs, args.layerFile)
+	if err != nil {
+		t.Fatalf("unexpected error doing layer push relative url: %v", err)
+	}
 
-	// Delete already deleted layer
-	resp, err = httpDelete(layerURL)
+	checkResponse(t, "relativeurl blob upload", resp, http.StatusCreated)
+	u, err = url.Parse(resp.Header.Get("Location"))
 	if err != nil {
-		t.Fatalf("unexpected error deleting layer: %v", err)
+		t.Fatal(err)
+	}
+	if u.IsAbs() {
+		t.Fatal("Relative URL returned from blob upload with non-relative configuration")
 	}
+}
 
-	checkResponse(t, "deleting layer", resp, http.StatusNotFound)
+func TestBlobDeleteDisabled(t *testing.T) {
+	deleteEnabled := false
+	env := newTestEnv(t, deleteEnabled)
+	defer env.Shutdown()
+	args := makeBlobArgs(t)
 
-	// ----------------
-	// Attempt to delete a layer with an invalid digest
-	badURL := strings.Replace(layerURL, "sha256", "sha257", 1)
-	resp, err = httpDelete(badURL)
+	imageName := args.imageName
+	layerDigest := args.layerDigest
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
 	if err != nil {
-		t.Fatalf("unexpected error fetching layer: %v", err)
+		t.Fatalf("error building url: %v", err)
 	}
 
-	checkResponse(t, "deleting layer bad digest", resp, http.StatusBadRequest)
+	resp, err := httpDelete(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting when disabled: %v", err)
+	}
 
-	// ----------------
-	// Reupload previously deleted blob
-	layerFile.Seek(0, io.SeekStart)
+	checkResponse(t, "status of disabled delete", resp, http.StatusMethodNotAllowed)
+}
 
-	uploadURLBase, _ := startPushLayer(t, env, imageName)
-	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+type countingDriverFactory struct {
+	driver *countingDriver
+}
 
-	layerFile.Seek(0, io.SeekStart)
-	canonicalDigester := digest.Canonical.Digester()
-	if _, err := io.Copy(canonicalDigester.Hash(), layerFile); err != nil {
-		t.Fatalf("error copying to digest: %v", err)
-	}
-	canonicalDigest := canonicalDigester.Digest()
+func (factory *countingDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return factory.driver, nil
+}
 
-	// ------------------------
-	// Use a head request to see if it exists
-	resp, err = http.Head(layerURL)
-	if err != nil {
-		t.Fatalf("unexpected error checking head on existing layer: %v", err)
-	}
+// countingDriver counts the storage driver calls reading blobs and links.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	calls int32
+}
 
-	layerLength, _ := layerFile.Seek(0, io.SeekEnd)
-	checkResponse(t, "checking head on reuploaded layer", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Content-Length":        []string{fmt.Sprint(layerLength)},
-		"Docker-Content-Digest": []string{canonicalDigest.String()},
-	})
+func (d *countingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return d.StorageDriver.GetContent(ctx, path)
 }
 
-func TestDeleteDisabled(t *testing.T) {
-	env := newTestEnv(t, false)
+func (d *countingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func (d *countingDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (d *countingDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	atomic.AddInt32(&d.calls, 1)
+	return d.StorageDriver.URLFor(ctx, path, options)
+}
+
+// TestBlobHeadCached checks that the existence of a blob known to the blob
+// descriptor cache is reported without accessing storage, and that deleting
+// the blob invalidates the cached descriptor.
+func TestBlobHeadCached(t *testing.T) {
+	driver := &countingDriver{StorageDriver: testdriver.New()}
+	factory.Register("blobheadcounting", &countingDriverFactory{driver: driver})
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"blobheadcounting": configuration.Parameters{},
+			"cache":            configuration.Parameters{"blobdescriptor": "inmemory"},
+			"delete":           configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
 	defer env.Shutdown()
 
-	imageName, _ := reference.WithName("foo/bar")
-	// "build" our layer file
+	imageName, _ := reference.WithName("foo/cached")
 	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
 	if err != nil {
 		t.Fatalf("error creating random layer file: %v", err)
 	}
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+	layerLength, _ := layerFile.Seek(0, io.SeekEnd)
 
 	ref, _ := reference.WithDigest(imageName, layerDigest)
 	layerURL, err := env.builder.BuildBlobURL(ref)
 	if err != nil {
-		t.Fatalf("Error building blob URL")
+		t.Fatalf("error building url: %v", err)
 	}
-	uploadURLBase, _ := startPushLayer(t, env, imageName)
-	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
 
-	resp, err := httpDelete(layerURL)
+	// The first check populates the cache, if the push did not.
+	resp, err := http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+	}
+	checkResponse(t, "checking head on existing layer", resp, http.StatusOK)
+
+	atomic.StoreInt32(&driver.calls, 0)
+	resp, err = http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+	}
+	checkResponse(t, "checking head on cached layer", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length":        []string{fmt.Sprint(layerLength)},
+		"Docker-Content-Digest": []string{layerDigest.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, layerDigest)},
+	})
+	if calls := atomic.LoadInt32(&driver.calls); calls != 0 {
+		t.Fatalf("checking head on cached layer made %d storage calls", calls)
+	}
+
+	// The cached check describes the blob as the blob server does.
+	getResp, err := http.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
+	getResp.Body.Close()
+	checkResponse(t, "fetching layer", getResp, http.StatusOK)
+	for _, header := range []string{"Accept-Ranges", "Cache-Control", "Content-Length", "Content-Type", "Docker-Content-Digest", "ETag"} {
+		if got, want := resp.Header.Values(header), getResp.Header.Values(header); !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected %s header checking head on cached layer: %v != %v", header, got, want)
+		}
+	}
+
+	resp, err = httpDelete(layerURL)
 	if err != nil {
 		t.Fatalf("unexpected error deleting layer: %v", err)
 	}
+	checkResponse(t, "deleting layer", resp, http.StatusAccepted)
 
-	checkResponse(t, "deleting layer with delete disabled", resp, http.StatusMethodNotAllowed)
+	resp, err = http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on deleted layer: %v", err)
+	}
+	checkResponse(t, "checking head on deleted layer", resp, http.StatusNotFound)
 }
 
-func TestDeleteReadOnly(t *testing.T) {
-	env := newTestEnv(t, true)
+// TestBlobHeadCacheOutage checks that the existence of a blob is checked
+// against storage while the blob descriptor cache is unavailable.
+func TestBlobHeadCacheOutage(t *testing.T) {
+	// Nothing listens at the address of the cache.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	redisAddr := l.Addr().String()
+	l.Close()
+
+	driver := &countingDriver{StorageDriver: testdriver.New()}
+	factory.Register("blobheadoutage", &countingDriverFactory{driver: driver})
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"blobheadoutage": configuration.Parameters{},
+			"cache":          configuration.Parameters{"blobdescriptor": "redis"},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Redis.Addr = redisAddr
+	config.Redis.DialTimeout = 100 * time.Millisecond
+	env := newTestEnvWithConfig(t, &config)
 	defer env.Shutdown()
 
-	imageName, _ := reference.WithName("foo/bar")
-	// "build" our layer file
+	imageName, _ := reference.WithName("foo/outage")
 	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
 	if err != nil {
 		t.Fatalf("error creating random layer file: %v", err)
 	}
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+	layerLength, _ := layerFile.Seek(0, io.SeekEnd)
 
 	ref, _ := reference.WithDigest(imageName, layerDigest)
 	layerURL, err := env.builder.BuildBlobURL(ref)
 	if err != nil {
-		t.Fatalf("Error building blob URL")
+		t.Fatalf("error building url: %v", err)
 	}
-	uploadURLBase, _ := startPushLayer(t, env, imageName)
-	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
 
-	env.app.readOnly = true
-
-	resp, err := httpDelete(layerURL)
+	atomic.StoreInt32(&driver.calls, 0)
+	resp, err := http.Head(layerURL)
 	if err != nil {
-		t.Fatalf("unexpected error deleting layer: %v", err)
+		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+	}
+	checkResponse(t, "checking head on existing layer", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length":        []string{fmt.Sprint(layerLength)},
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
+	if calls := atomic.LoadInt32(&driver.calls); calls == 0 {
+		t.Fatalf("checking head during a cache outage made no storage calls")
 	}
 
-	checkResponse(t, "deleting layer in read-only mode", resp, http.StatusMethodNotAllowed)
-}
-
-func TestStartPushReadOnly(t *testing.T) {
-	env := newTestEnv(t, true)
-	defer env.Shutdown()
-	env.app.readOnly = true
-
-	imageName, _ := reference.WithName("foo/bar")
-
-	layerUploadURL, err := env.builder.BuildBlobUploadURL(imageName)
+	unknownRef, _ := reference.WithDigest(imageName, digest.FromString("unknown"))
+	unknownURL, err := env.builder.BuildBlobURL(unknownRef)
 	if err != nil {
-		t.Fatalf("unexpected error building layer upload url: %v", err)
+		t.Fatalf("error building url: %v", err)
 	}
-
-	resp, err := http.Post(layerUploadURL, "", nil)
+	resp, err = http.Head(unknownURL)
 	if err != nil {
-		t.Fatalf("unexpected error starting layer push: %v", err)
+		t.Fatalf("unexpected error checking head on unknown layer: %v", err)
 	}
-	defer resp.Body.Close()
-
-	checkResponse(t, "starting push in read-only mode", resp, http.StatusMethodNotAllowed)
+	checkResponse(t, "checking head on unknown layer", resp, http.StatusNotFound)
 }
 
-func httpDelete(url string) (*http.Response, error) {
-	req, err := http.NewRequest("DELETE", url, nil)
+// TestBlobDeleteCacheOutageRetryAfter checks that a blob deletion failing
+// while the blob descriptor cache is unavailable asks the client to retry
+// after the configured delay.
+func TestBlobDeleteCacheOutageRetryAfter(t *testing.T) {
+	// Nothing listens at the address of the cache.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		return nil, err
+		t.Fatalf("unexpected error listening: %v", err)
 	}
+	redisAddr := l.Addr().String()
+	l.Close()
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"cache":      configuration.Parameters{"blobdescriptor": "redis"},
+			"delete":     configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
-	//	defer resp.Body.Close()
-	return resp, err
-}
+	config.HTTP.Headers = headerConfig
+	config.HTTP.RetryAfter = 2500 * time.Millisecond
+	config.Redis.Addr = redisAddr
+	config.Redis.DialTimeout = 100 * time.Millisecond
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-type manifestArgs struct {
-	imageName reference.Named
-	mediaType string
-	manifest  distribution.Manifest
-	dgst      digest.Digest
+	imageName, _ := reference.WithName("foo/outage")
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building url: %v", err)
+	}
+	resp, err := httpDelete(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting layer: %v", err)
+	}
+	checkResponse(t, "deleting layer during a cache outage", resp, http.StatusServiceUnavailable)
+	checkBodyHasErrorCodes(t, "deleting layer during a cache outage", resp, errcode.ErrorCodeUnavailable)
+	checkHeaders(t, resp, http.Header{
+		"Retry-After": []string{"3"},
+	})
 }
 
-func TestManifestAPI(t *testing.T) {
-	schema1Repo, _ := reference.WithName("foo/schema1")
-	schema2Repo, _ := reference.WithName("foo/schema2")
+func testBlobAPI(t *testing.T, env *testEnv, args blobArgs) *testEnv {
+	// TODO(stevvooe): This test code is complete junk but it should cover the
+	// complete flow. This must be broken down and checked against the
+	// specification *before* we submit the final to docker core.
+	imageName := args.imageName
+	layerFile := args.layerFile
+	layerDigest := args.layerDigest
 
-	deleteEnabled := false
-	env1 := newTestEnv(t, deleteEnabled)
-	defer env1.Shutdown()
-	testManifestAPISchema1(t, env1, schema1Repo)
-	schema2Args := testManifestAPISchema2(t, env1, schema2Repo)
-	testManifestAPIManifestList(t, env1, schema2Args)
+	// -----------------------------------
+	// Test fetch for non-existent content
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building url: %v", err)
+	}
 
-	deleteEnabled = true
-	env2 := newTestEnv(t, deleteEnabled)
-	defer env2.Shutdown()
-	testManifestAPISchema1(t, env2, schema1Repo)
-	schema2Args = testManifestAPISchema2(t, env2, schema2Repo)
-	testManifestAPIManifestList(t, env2, schema2Args)
-}
+	resp, err := http.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching non-existent layer: %v", err)
+	}
 
-func TestManifestAPI_DeleteTag(t *testing.T) {
-	env := newTestEnv(t, false)
-	defer env.Shutdown()
+	checkResponse(t, "fetching non-existent content", resp, http.StatusNotFound)
 
-	imageName, err := reference.WithName("foo/bar")
-	checkErr(t, err, "building image name")
+	// ------------------------------------------
+	// Test head request for non-existent content
+	resp, err = http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on non-existent layer: %v", err)
+	}
 
-	tag := "latest"
-	dgst := createRepository(env, t, imageName.Name(), tag)
+	checkResponse(t, "checking head on non-existent layer", resp, http.StatusNotFound)
 
-	ref, err := reference.WithTag(imageName, tag)
-	checkErr(t, err, "building tag reference")
+	// ------------------------------------------
+	// Start an upload, check the status then cancel
+	uploadURLBase, uploadUUID := startPushLayer(t, env, imageName)
 
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building tag URL")
+	// A status check should work
+	resp, err = http.Get(uploadURLBase)
+	if err != nil {
+		t.Fatalf("unexpected error getting upload status: %v", err)
+	}
+	checkResponse(t, "status of deleted upload", resp, http.StatusNoContent)
+	checkHeaders(t, resp, http.Header{
+		"Location":           []string{"*"},
+		"Range":              []string{"0-0"},
+		"Docker-Upload-UUID": []string{uploadUUID},
+	})
 
-	resp, err := httpDelete(u)
-	m := "deleting tag"
-	checkErr(t, err, m)
-	defer resp.Body.Close()
+	req, err := http.NewRequest("DELETE", uploadURLBase, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating delete request: %v", err)
+	}
 
-	checkResponse(t, m, resp, http.StatusAccepted)
-	if resp.Body != http.NoBody {
-		t.Fatal("unexpected response body")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error sending delete request: %v", err)
 	}
 
-	msg := "checking tag no longer exists"
-	resp, err = http.Get(u)
-	checkErr(t, err, msg)
-	checkResponse(t, msg, resp, http.StatusNotFound)
+	checkResponse(t, "deleting upload", resp, http.StatusNoContent)
 
-	digestRef, err := reference.WithDigest(imageName, dgst)
-	checkErr(t, err, "building manifest digest reference")
+	// A status check should result in 404
+	resp, err = http.Get(uploadURLBase)
+	if err != nil {
+		t.Fatalf("unexpected error getting upload status: %v", err)
+	}
+	checkResponse(t, "status of deleted upload", resp, http.StatusNotFound)
 
-	u, err = env.builder.BuildManifestURL(digestRef)
-	checkErr(t, err, "building manifest URL")
+	// -----------------------------------------
+	// Do layer push with an empty body and different digest
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	resp, err = doPushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, bytes.NewReader([]byte{}))
+	if err != nil {
+		t.Fatalf("unexpected error doing bad layer push: %v", err)
+	}
 
-	msg = "checking manifest still exists"
-	resp, err = http.Head(u)
-	checkErr(t, err, msg)
-	checkResponse(t, msg, resp, http.StatusOK)
-}
+	checkResponse(t, "bad layer push", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "bad layer push", resp, v2.ErrorCodeDigestInvalid)
 
-func TestManifestAPI_DeleteTag_Unknown(t *testing.T) {
-	env := newTestEnv(t, false)
-	defer env.Shutdown()
+	// -----------------------------------------
+	// Do layer push with an empty body and correct digest
+	zeroDigest, err := digest.FromReader(bytes.NewReader([]byte{}))
+	if err != nil {
+		t.Fatalf("unexpected error digesting empty buffer: %v", err)
+	}
 
-	imageName, err := reference.WithName("foo/bar")
-	checkErr(t, err, "building named object")
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, zeroDigest, uploadURLBase, bytes.NewReader([]byte{}))
 
-	ref, err := reference.WithTag(imageName, "latest")
-	checkErr(t, err, "building tag reference")
+	// -----------------------------------------
+	// Do layer push with an empty body and correct digest
 
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building tag URL")
+	// This is a valid but empty tarfile!
+	emptyTar := bytes.Repeat([]byte("\x00"), 1024)
+	emptyDigest, err := digest.FromReader(bytes.NewReader(emptyTar))
+	if err != nil {
+		t.Fatalf("unexpected error digesting empty tar: %v", err)
+	}
 
-	resp, err := httpDelete(u)
-	msg := "deleting unknown tag"
-	checkErr(t, err, msg)
-	defer resp.Body.Close()
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, emptyDigest, uploadURLBase, bytes.NewReader(emptyTar))
 
-	checkResponse(t, msg, resp, http.StatusNotFound)
-	checkBodyHasErrorCodes(t, msg, resp, v2.ErrorCodeManifestUnknown)
-}
+	// ------------------------------------------
+	// Now, actually do successful upload.
+	layerLength, _ := layerFile.Seek(0, io.SeekEnd)
+	layerFile.Seek(0, io.SeekStart)
 
-func TestManifestAPI_DeleteTag_ReadOnly(t *testing.T) {
-	env := newTestEnv(t, false)
-	defer env.Shutdown()
-	env.app.readOnly = true
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
 
-	imageName, err := reference.WithName("foo/bar")
-	checkErr(t, err, "building named object")
+	// ------------------------------------------
+	// Now, push just a chunk
+	layerFile.Seek(0, 0)
 
-	ref, err := reference.WithTag(imageName, "latest")
-	checkErr(t, err, "building tag reference")
+	canonicalDigester := digest.Canonical.Digester()
+	if _, err := io.Copy(canonicalDigester.Hash(), layerFile); err != nil {
+		t.Fatalf("error copying to digest: %v", err)
+	}
+	canonicalDigest := canonicalDigester.Digest()
 
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building URL")
+	layerFile.Seek(0, 0)
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	uploadURLBase, dgst := pushChunk(t, env.builder, imageName, uploadURLBase, layerFile, layerLength)
+	finishUpload(t, env.builder, imageName, uploadURLBase, dgst)
 
-	resp, err := httpDelete(u)
-	msg := "deleting tag"
-	checkErr(t, err, msg)
+	// -----------------------------------------
+	// Do layer push with invalid content range
+	layerFile.Seek(0, io.SeekStart)
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	sizeInvalid := chunkOptions{
+		contentRange: "0-20",
+	}
+	resp, err = doPushChunk(t, uploadURLBase, layerFile, sizeInvalid)
+	if err != nil {
+		t.Fatalf("unexpected error doing push layer request: %v", err)
+	}
 	defer resp.Body.Close()
+	checkResponse(t, "putting size invalid chunk", resp, http.StatusBadRequest)
 
-	checkResponse(t, msg, resp, http.StatusMethodNotAllowed)
-}
+	layerFile.Seek(0, io.SeekStart)
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	outOfOrder := chunkOptions{
+		contentRange: "3-22",
+	}
+	resp, err = doPushChunk(t, uploadURLBase, layerFile, outOfOrder)
+	if err != nil {
+		t.Fatalf("unexpected error doing push layer request: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "putting range out of order chunk", resp, http.StatusRequestedRangeNotSatisfiable)
 
-// storageManifestErrDriverFactory implements the factory.StorageDriverFactory interface.
-type storageManifestErrDriverFactory struct{}
+	// ------------------------
+	// Use a head request to see if the layer exists.
+	resp, err = http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+	}
 
-const (
-	repositoryWithManifestNotFound    = "manifesttagnotfound"
-	repositoryWithManifestInvalidPath = "manifestinvalidpath"
-	repositoryWithManifestBadLink     = "manifestbadlink"
-	repositoryWithGenericStorageError = "genericstorageerr"
-)
+	checkResponse(t, "checking head on existing layer", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length":        []string{fmt.Sprint(layerLength)},
+		"Docker-Content-Digest": []string{canonicalDigest.String()},
+	})
 
-func (factory *storageManifestErrDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
-	// Initialize the mock driver
-	var errGenericStorage = errors.New("generic storage error")
-	return &mockErrorDriver{
-		returnErrs: []mockErrorMapping{
-			{
-				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestNotFound),
-				content:   nil,
-				err:       storagedriver.PathNotFoundError{},
-			},
-			{
-				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestInvalidPath),
-				content:   nil,
-				err:       storagedriver.InvalidPathError{},
-			},
-			{
-				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestBadLink),
-				content:   []byte("this is a bad sha"),
-				err:       nil,
-			},
-			{
-				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithGenericStorageError),
-				content:   nil,
-				err:       errGenericStorage,
-			},
-		},
-	}, nil
-}
+	// ----------------
+	// Fetch the layer!
+	resp, err = http.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
 
-type mockErrorMapping struct {
-	pathMatch string
-	content   []byte
-	err       error
-}
+	checkResponse(t, "fetching layer", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length":        []string{fmt.Sprint(layerLength)},
+		"Docker-Content-Digest": []string{canonicalDigest.String()},
+	})
 
-// mockErrorDriver implements StorageDriver to force storage error on manifest request
-type mockErrorDriver struct {
-	storagedriver.StorageDriver
-	returnErrs []mockErrorMapping
-}
+	// Verify the body
+	verifier := layerDigest.Verifier()
+	io.Copy(verifier, resp.Body)
 
-func (dr *mockErrorDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
-	for _, returns := range dr.returnErrs {
-		if strings.Contains(path, returns.pathMatch) {
-			return returns.content, returns.err
-		}
+	if !verifier.Verified() {
+		t.Fatalf("response body did not pass verification")
 	}
-	return nil, errors.New("Unknown storage error")
-}
 
-func TestGetManifestWithStorageError(t *testing.T) {
-	factory.Register("storagemanifesterror", &storageManifestErrDriverFactory{})
-	config := configuration.Configuration{
-		Storage: configuration.Storage{
-			"storagemanifesterror": configuration.Parameters{},
-			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
-				"enabled": false,
-			}},
-		},
+	// ----------------
+	// Fetch the layer with an invalid digest
+	badURL := strings.Replace(layerURL, "sha256", "sha257", 1)
+	resp, err = http.Get(badURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
 	}
-	config.HTTP.Headers = headerConfig
-	env1 := newTestEnvWithConfig(t, &config)
-	defer env1.Shutdown()
 
-	repo, _ := reference.WithName(repositoryWithManifestNotFound)
-	testManifestWithStorageError(t, env1, repo, http.StatusNotFound, v2.ErrorCodeManifestUnknown)
+	checkResponse(t, "fetching layer bad digest", resp, http.StatusBadRequest)
 
-	repo, _ = reference.WithName(repositoryWithGenericStorageError)
-	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+	// Cache headers
+	resp, err = http.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
 
-	repo, _ = reference.WithName(repositoryWithManifestInvalidPath)
-	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+	checkResponse(t, "fetching layer", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length":        []string{fmt.Sprint(layerLength)},
+		"Docker-Content-Digest": []string{canonicalDigest.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, canonicalDigest)},
+		"Cache-Control":         []string{"max-age=31536000"},
+	})
 
-	repo, _ = reference.WithName(repositoryWithManifestBadLink)
-	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+	// Matching etag, gives 304
+	etag := resp.Header.Get("Etag")
+	req, err = http.NewRequest("GET", layerURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+
+	checkResponse(t, "fetching layer with etag", resp, http.StatusNotModified)
+
+	// Non-matching etag, gives 200
+	req, err = http.NewRequest("GET", layerURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", "")
+	resp, _ = http.DefaultClient.Do(req)
+	checkResponse(t, "fetching layer with invalid etag", resp, http.StatusOK)
+
+	// Missing tests:
+	// 	- Upload the same tar file under and different repository and
+	//       ensure the content remains uncorrupted.
+	return env
 }
 
-func TestManifestDelete(t *testing.T) {
-	schema1Repo, _ := reference.WithName("foo/schema1")
-	schema2Repo, _ := reference.WithName("foo/schema2")
+func testBlobDelete(t *testing.T, env *testEnv, args blobArgs) {
+	// Upload a layer
+	imageName := args.imageName
+	layerFile := args.layerFile
+	layerDigest := args.layerDigest
 
-	deleteEnabled := true
-	env := newTestEnv(t, deleteEnabled)
-	defer env.Shutdown()
-	schema1Args := testManifestAPISchema1(t, env, schema1Repo)
-	testManifestDelete(t, env, schema1Args)
-	schema2Args := testManifestAPISchema2(t, env, schema2Repo)
-	testManifestDelete(t, env, schema2Args)
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// ---------------
+	// Delete a layer
+	resp, err := httpDelete(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting layer: %v", err)
+	}
+
+	checkResponse(t, "deleting layer", resp, http.StatusAccepted)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length": []string{"0"},
+	})
+
+	// ---------------
+	// Try and get it back
+	// Use a head request to see if the layer exists.
+	resp, err = http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+	}
+
+	checkResponse(t, "checking existence of deleted layer", resp, http.StatusNotFound)
+
+	// Delete already deleted layer
+	resp, err = httpDelete(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting layer: %v", err)
+	}
+
+	checkResponse(t, "deleting layer", resp, http.StatusNotFound)
+
+	// ----------------
+	// Attempt to delete a layer with an invalid digest
+	badURL := strings.Replace(layerURL, "sha256", "sha257", 1)
+	resp, err = httpDelete(badURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
+
+	checkResponse(t, "deleting layer bad digest", resp, http.StatusBadRequest)
+
+	// ----------------
+	// Reupload previously deleted blob
+	layerFile.Seek(0, io.SeekStart)
+
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+
+	layerFile.Seek(0, io.SeekStart)
+	canonicalDigester := digest.Canonical.Digester()
+	if _, err := io.Copy(canonicalDigester.Hash(), layerFile); err != nil {
+		t.Fatalf("error copying to digest: %v", err)
+	}
+	canonicalDigest := canonicalDigester.Digest()
+
+	// ------------------------
+	// Use a head request to see if it exists
+	resp, err = http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+	}
+
+	layerLength, _ := layerFile.Seek(0, io.SeekEnd)
+	checkResponse(t, "checking head on reuploaded layer", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length":        []string{fmt.Sprint(layerLength)},
+		"Docker-Content-Digest": []string{canonicalDigest.String()},
+	})
 }
 
-func TestManifestDeleteDisabled(t *testing.T) {
-	schema1Repo, _ := reference.WithName("foo/schema1")
-	deleteEnabled := false
-	env := newTestEnv(t, deleteEnabled)
+func TestDeleteDisabled(t *testing.T) {
+	env := newTestEnv(t, false)
 	defer env.Shutdown()
-	testManifestDeleteDisabled(t, env, schema1Repo)
+
+	imageName, _ := reference.WithName("foo/bar")
+	// "build" our layer file
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("Error building blob URL")
+	}
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+
+	resp, err := httpDelete(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting layer: %v", err)
+	}
+
+	checkResponse(t, "deleting layer with delete disabled", resp, http.StatusMethodNotAllowed)
 }
 
-func testManifestDeleteDisabled(t *testing.T, env *testEnv, imageName reference.Named) {
-	ref, _ := reference.WithDigest(imageName, digestSha256EmptyTar)
-	manifestURL, err := env.builder.BuildManifestURL(ref)
+func TestDeleteReadOnly(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	// "build" our layer file
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("Error building blob URL")
+	}
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+
+	env.app.readOnly.set(true)
+
+	resp, err := httpDelete(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting layer: %v", err)
+	}
+
+	checkResponse(t, "deleting layer in read-only mode", resp, http.StatusMethodNotAllowed)
+}
+
+func TestStartPushReadOnly(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+	env.app.readOnly.set(true)
+
+	imageName, _ := reference.WithName("foo/bar")
+
+	layerUploadURL, err := env.builder.BuildBlobUploadURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building layer upload url: %v", err)
+	}
+
+	resp, err := http.Post(layerUploadURL, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error starting layer push: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "starting push in read-only mode", resp, http.StatusMethodNotAllowed)
+}
+
+// readCounter counts the bytes read from a reader.
+type readCounter struct {
+	io.Reader
+	n int64
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.Reader.Read(p)
+	rc.n += int64(n)
+	return n, err
+}
+
+// TestPushExistingBlobByDigest checks that uploads of a blob the repository
+// already has, declared by digest, complete without the blob being sent.
+func TestPushExistingBlobByDigest(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+	content, err := ioutil.ReadAll(layerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, bytes.NewReader(content))
+
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building layer url: %v", err)
+	}
+
+	// The client waits for 100 Continue before sending the body, which the
+	// registry never asks for.
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}}
+	do := func(method, u string) (*http.Response, *readCounter) {
+		t.Helper()
+		body := &readCounter{Reader: bytes.NewReader(content)}
+		req, err := http.NewRequest(method, u, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = int64(len(content))
+		req.Header.Set("Expect", "100-continue")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing %s request: %v", method, err)
+		}
+		resp.Body.Close()
+		return resp, body
+	}
+
+	uploadURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{"digest": []string{layerDigest.String()}})
+	if err != nil {
+		t.Fatalf("error building upload url: %v", err)
+	}
+	resp, body := do("POST", uploadURL)
+	checkResponse(t, "starting upload of an existing blob", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{layerURL},
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
+	if body.n != 0 {
+		t.Fatalf("%d bytes of the existing blob were sent starting its upload", body.n)
+	}
+
+	// Completing an upload with the blob is short-circuited too.
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	u, err := url.Parse(uploadURLBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.RawQuery = url.Values{
+		"_state": u.Query()["_state"],
+		"digest": []string{layerDigest.String()},
+	}.Encode()
+	resp, body = do("PUT", u.String())
+	checkResponse(t, "completing upload of an existing blob", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{layerURL},
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
+	if body.n != 0 {
+		t.Fatalf("%d bytes of the existing blob were sent completing its upload", body.n)
+	}
+
+	// Blobs the repository does not have are uploaded as usual.
+	otherName, _ := reference.WithName("foo/other")
+	uploadURL, err = env.builder.BuildBlobUploadURL(otherName, url.Values{"digest": []string{layerDigest.String()}})
+	if err != nil {
+		t.Fatalf("error building upload url: %v", err)
+	}
+	resp, _ = do("POST", uploadURL)
+	checkResponse(t, "starting upload of a blob of another repository", resp, http.StatusAccepted)
+}
+
+// TestUploadExpiry checks that the time uploads may be purged after is
+// advertised, and that they cannot be resumed afterwards.
+func TestUploadExpiry(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+	env.app.uploadTTL = time.Hour
+
+	imageName, _ := reference.WithName("foo/bar")
+	uploadURL, err := env.builder.BuildBlobUploadURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building layer upload url: %v", err)
+	}
+
+	checkExpires := func(msg string, resp *http.Response) {
+		t.Helper()
+		expires, err := http.ParseTime(resp.Header.Get("Docker-Upload-Expires"))
+		if err != nil {
+			t.Fatalf("invalid Docker-Upload-Expires header %s: %v", msg, err)
+		}
+		if d := time.Until(expires); d <= 59*time.Minute || d > time.Hour {
+			t.Fatalf("unexpected Docker-Upload-Expires header %s: %s", msg, expires)
+		}
+	}
+
+	resp, err := http.Post(uploadURL, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error starting layer push: %v", err)
+	}
+	resp.Body.Close()
+	checkResponse(t, "starting layer push", resp, http.StatusAccepted)
+	checkExpires("starting layer push", resp)
+
+	resp, err = doPushChunk(t, resp.Header.Get("Location"), strings.NewReader("chunk"), chunkOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pushing chunk: %v", err)
+	}
+	resp.Body.Close()
+	checkResponse(t, "pushing chunk", resp, http.StatusAccepted)
+	checkExpires("pushing chunk", resp)
+
+	// Once the upload expires, resuming it fails.
+	env.app.uploadTTL = time.Nanosecond
+	resp, err = doPushChunk(t, resp.Header.Get("Location"), strings.NewReader("chunk"), chunkOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pushing chunk: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "pushing chunk to an expired upload", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "pushing chunk to an expired upload", resp, v2.ErrorCodeBlobUploadExpired)
+}
+
+func httpDelete(url string) (*http.Response, error) {
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	//	defer resp.Body.Close()
+	return resp, err
+}
+
+type manifestArgs struct {
+	imageName reference.Named
+	mediaType string
+	manifest  distribution.Manifest
+	dgst      digest.Digest
+}
+
+func TestManifestAPI(t *testing.T) {
+	schema1Repo, _ := reference.WithName("foo/schema1")
+	schema2Repo, _ := reference.WithName("foo/schema2")
+
+	deleteEnabled := false
+	env1 := newTestEnv(t, deleteEnabled)
+	defer env1.Shutdown()
+	testManifestAPISchema1(t, env1, schema1Repo)
+	schema2Args := testManifestAPISchema2(t, env1, schema2Repo)
+	testManifestAPIManifestList(t, env1, schema2Args)
+
+	deleteEnabled = true
+	env2 := newTestEnv(t, deleteEnabled)
+	defer env2.Shutdown()
+	testManifestAPISchema1(t, env2, schema1Repo)
+	schema2Args = testManifestAPISchema2(t, env2, schema2Repo)
+	testManifestAPIManifestList(t, env2, schema2Args)
+}
+
+// TestManifestNegotiation checks the manifest returned for a manifest list
+// fetched by tag without naming a manifest media type, with and without a
+// configured preference order.
+func TestManifestNegotiation(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		mediaTypes []string
+		// expected maps accept headers to the media type returned, the
+		// manifest list being returned as is unless a schema2 manifest is
+		// expected.
+		expected map[string]string
+	}{
+		{
+			name: "as stored",
+			expected: map[string]string{
+				"":                                 manifestlist.MediaTypeManifestList,
+				"*/*":                              manifestlist.MediaTypeManifestList,
+				"application/json, */*":            manifestlist.MediaTypeManifestList,
+				manifestlist.MediaTypeManifestList: manifestlist.MediaTypeManifestList,
+				schema2.MediaTypeManifest:          schema2.MediaTypeManifest,
+			},
+		},
+		{
+			name:       "image manifest preferred",
+			mediaTypes: []string{v1.MediaTypeImageManifest, schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList},
+			expected: map[string]string{
+				"":                                 schema2.MediaTypeManifest,
+				"*/*":                              schema2.MediaTypeManifest,
+				manifestlist.MediaTypeManifestList: manifestlist.MediaTypeManifestList,
+				schema2.MediaTypeManifest:          schema2.MediaTypeManifest,
+			},
+		},
+		{
+			name:       "manifest list preferred",
+			mediaTypes: []string{v1.MediaTypeImageIndex, manifestlist.MediaTypeManifestList, schema2.MediaTypeManifest},
+			expected: map[string]string{
+				"":                        manifestlist.MediaTypeManifestList,
+				"*/*":                     manifestlist.MediaTypeManifestList,
+				schema2.MediaTypeManifest: schema2.MediaTypeManifest,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := configuration.Configuration{
+				Storage: configuration.Storage{
+					"testdriver": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					}},
+				},
+			}
+			config.HTTP.Headers = headerConfig
+			config.Compatibility.Negotiation.MediaTypes = tc.mediaTypes
+
+			env := newTestEnvWithConfig(t, &config)
+			defer env.Shutdown()
+
+			imageName, _ := reference.WithName("foo/negotiation")
+			amd64 := pushSchema2Image(t, env, imageName, 1)
+
+			deserializedManifestList, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+				{
+					Descriptor: amd64.descriptor,
+					Platform:   manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+				},
+			})
+			if err != nil {
+				t.Fatalf("could not create DeserializedManifestList: %v", err)
+			}
+			_, canonical, err := deserializedManifestList.Payload()
+			if err != nil {
+				t.Fatalf("could not get manifest list payload: %v", err)
+			}
+
+			tagRef, _ := reference.WithTag(imageName, "multiarch")
+			manifestURL, err := env.builder.BuildManifestURL(tagRef)
+			checkErr(t, err, "building manifest url")
+
+			resp := putManifest(t, "putting manifest list", manifestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
+			checkResponse(t, "putting manifest list", resp, http.StatusCreated)
+
+			for accept, expected := range tc.expected {
+				req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+				if err != nil {
+					t.Fatalf("Error constructing request: %s", err)
+				}
+				if accept != "" {
+					req.Header.Set("Accept", accept)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("unexpected error fetching manifest: %v", err)
+				}
+				defer resp.Body.Close()
+
+				checkResponse(t, fmt.Sprintf("fetching manifest accepting %q", accept), resp, http.StatusOK)
+				if ct := resp.Header.Get("Content-Type"); ct != expected {
+					t.Fatalf("accepting %q: unexpected content type: %q != %q", accept, ct, expected)
+				}
+
+				switch expected {
+				case manifestlist.MediaTypeManifestList:
+					checkHeaders(t, resp, http.Header{
+						"Docker-Content-Digest": []string{digest.FromBytes(canonical).String()},
+					})
+				case schema2.MediaTypeManifest:
+					checkHeaders(t, resp, http.Header{
+						"Docker-Content-Digest": []string{amd64.descriptor.Digest.String()},
+					})
+				}
+			}
+		})
+	}
+}
+
+func TestManifestNegotiationInvalidMediaType(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+		},
+	}
+	config.Compatibility.Negotiation.MediaTypes = []string{"application/json"}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected an invalid negotiation media type to be rejected")
+		}
+	}()
+	NewApp(context.Background(), &config)
+}
+
+// TestManifestListHeadSize checks that a HEAD of a manifest list reports the
+// size of the configured default platform only when enabled, and that GET is
+// left untouched.
+func TestManifestListHeadSize(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		enabled      bool
+		architecture string
+		variant      string
+		mode         string
+		// expected returns the header value from the amd64 and arm64 images
+		expected func(amd64, arm64 testImage) string
+	}{
+		{
+			name: "disabled",
+			expected: func(amd64, arm64 testImage) string {
+				return ""
+			},
+		},
+		{
+			name:    "default platform manifest size",
+			enabled: true,
+			expected: func(amd64, arm64 testImage) string {
+				return fmt.Sprint(amd64.descriptor.Size)
+			},
+		},
+		{
+			name:         "chosen platform layer sizes",
+			enabled:      true,
+			architecture: "arm64",
+			variant:      "v8",
+			mode:         "layers",
+			expected: func(amd64, arm64 testImage) string {
+				return fmt.Sprint(arm64.layersSize)
+			},
+		},
+		{
+			name:         "no matching platform",
+			enabled:      true,
+			architecture: "s390x",
+			expected: func(amd64, arm64 testImage) string {
+				return ""
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := configuration.Configuration{
+				Storage: configuration.Storage{
+					"testdriver": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					}},
+				},
+			}
+			config.HTTP.Headers = headerConfig
+			headSize := &config.Compatibility.ManifestList.HeadSize
+			headSize.Enabled = tc.enabled
+			headSize.Architecture = tc.architecture
+			headSize.Variant = tc.variant
+			headSize.Mode = tc.mode
+
+			env := newTestEnvWithConfig(t, &config)
+			defer env.Shutdown()
+
+			imageName, _ := reference.WithName("foo/headsize")
+			amd64 := pushSchema2Image(t, env, imageName, 2)
+			arm64 := pushSchema2Image(t, env, imageName, 3)
+
+			deserializedManifestList, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+				{
+					Descriptor: amd64.descriptor,
+					Platform:   manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+				},
+				{
+					Descriptor: arm64.descriptor,
+					Platform:   manifestlist.PlatformSpec{Architecture: "arm64", OS: "linux", Variant: "v8"},
+				},
+			})
+			if err != nil {
+				t.Fatalf("could not create DeserializedManifestList: %v", err)
+			}
+			_, canonical, err := deserializedManifestList.Payload()
+			if err != nil {
+				t.Fatalf("could not get manifest list payload: %v", err)
+			}
+
+			tagRef, _ := reference.WithTag(imageName, "multiarch")
+			manifestURL, err := env.builder.BuildManifestURL(tagRef)
+			checkErr(t, err, "building manifest url")
+
+			resp := putManifest(t, "putting manifest list", manifestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
+			checkResponse(t, "putting manifest list", resp, http.StatusCreated)
+
+			for _, method := range []string{http.MethodHead, http.MethodGet} {
+				req, err := http.NewRequest(method, manifestURL, nil)
+				if err != nil {
+					t.Fatalf("Error constructing request: %s", err)
+				}
+				req.Header.Set("Accept", manifestlist.MediaTypeManifestList)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("unexpected error fetching manifest list: %v", err)
+				}
+				defer resp.Body.Close()
+
+				checkResponse(t, method+" manifest list", resp, http.StatusOK)
+				checkHeaders(t, resp, http.Header{
+					"Content-Length": []string{fmt.Sprint(len(canonical))},
+				})
+
+				expected := ""
+				if method == http.MethodHead {
+					expected = tc.expected(amd64, arm64)
+				}
+				if got := resp.Header.Get("Docker-Default-Platform-Size"); got != expected {
+					t.Fatalf("%s: unexpected Docker-Default-Platform-Size header: %q != %q", method, got, expected)
+				}
+
+				if method == http.MethodGet {
+					body, err := ioutil.ReadAll(resp.Body)
+					if err != nil {
+						t.Fatalf("error reading manifest list body: %v", err)
+					}
+					if !bytes.Equal(body, canonical) {
+						t.Fatalf("manifest lists do not match")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownManifest(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		distinguish bool
+		// expected are the error codes of the requests for a manifest of a
+		// repository without content and of one of a repository with some
+		expected [2]errcode.ErrorCode
+	}{
+		{
+			name:     "disabled",
+			expected: [2]errcode.ErrorCode{v2.ErrorCodeManifestUnknown, v2.ErrorCodeManifestUnknown},
+		},
+		{
+			name:        "distinguish repository",
+			distinguish: true,
+			expected:    [2]errcode.ErrorCode{v2.ErrorCodeNameUnknown, v2.ErrorCodeManifestUnknown},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := configuration.Configuration{
+				Storage: configuration.Storage{
+					"testdriver": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					}},
+				},
+			}
+			config.HTTP.Headers = headerConfig
+			config.Compatibility.UnknownManifest.DistinguishRepository = tc.distinguish
+			env := newTestEnvWithConfig(t, &config)
+			defer env.Shutdown()
+
+			absentName, _ := reference.WithName("foo/absent")
+			presentName, _ := reference.WithName("foo/present")
+			image := pushSchema2Image(t, env, presentName, 1)
+			missing := digest.FromString("missing manifest")
+
+			for i, name := range []reference.Named{absentName, presentName} {
+				tagRef, _ := reference.WithTag(name, "missing")
+				digestRef, _ := reference.WithDigest(name, missing)
+				for _, ref := range []reference.Named{tagRef, digestRef} {
+					manifestURL, err := env.builder.BuildManifestURL(ref)
+					checkErr(t, err, "building manifest url")
+
+					resp, err := http.Get(manifestURL)
+					checkErr(t, err, "getting unknown manifest")
+					checkResponse(t, "getting unknown manifest", resp, http.StatusNotFound)
+					checkBodyHasErrorCodes(t, "getting unknown manifest", resp, tc.expected[i])
+					resp.Body.Close()
+
+					resp, err = http.Head(manifestURL)
+					checkErr(t, err, "heading unknown manifest")
+					checkResponse(t, "heading unknown manifest", resp, http.StatusNotFound)
+					header := ""
+					if tc.distinguish {
+						header = tc.expected[i].String()
+					}
+					if code := resp.Header.Get(unknownManifestErrorCodeHeader); code != header {
+						t.Fatalf("unexpected %s header for %s: %q != %q", unknownManifestErrorCodeHeader, ref, code, header)
+					}
+					resp.Body.Close()
+				}
+			}
+
+			// The manifests which exist are served as before.
+			digestRef, _ := reference.WithDigest(presentName, image.descriptor.Digest)
+			manifestURL, err := env.builder.BuildManifestURL(digestRef)
+			checkErr(t, err, "building manifest url")
+			resp, err := http.Head(manifestURL)
+			checkErr(t, err, "heading manifest")
+			defer resp.Body.Close()
+			checkResponse(t, "heading manifest", resp, http.StatusOK)
+			if code := resp.Header.Get(unknownManifestErrorCodeHeader); code != "" {
+				t.Fatalf("unexpected %s header for an existing manifest: %q", unknownManifestErrorCodeHeader, code)
+			}
+		})
+	}
+}
+
+func TestManifestAdmissionWebhook(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		failOpen bool
+		// respond writes the webhook response, or blocks past the timeout
+		// if nil
+		respond        func(w http.ResponseWriter)
+		expectedStatus int
+		expectedCode   errcode.ErrorCode
+		expectedBody   string
+		// expectedRetryAfter is the Retry-After header expected with
+		// the response, if any
+		expectedRetryAfter string
+	}{
+		{
+			name: "allow",
+			respond: func(w http.ResponseWriter) {
+				fmt.Fprint(w, `{"allowed":true}`)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name: "deny",
+			respond: func(w http.ResponseWriter) {
+				fmt.Fprint(w, `{"allowed":false,"message":"image has critical vulnerabilities"}`)
+			},
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   errcode.ErrorCodeDenied,
+			expectedBody:   "image has critical vulnerabilities",
+		},
+		{
+			name:               "timeout fail-closed",
+			expectedStatus:     http.StatusServiceUnavailable,
+			expectedCode:       errcode.ErrorCodeUnavailable,
+			expectedRetryAfter: "2",
+		},
+		{
+			name:           "timeout fail-open",
+			failOpen:       true,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:     "error fail-open",
+			failOpen: true,
+			respond: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reviews := make(chan admissionRequest, 1)
+			webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var ar admissionRequest
+				if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+					t.Errorf("error decoding admission request: %v", err)
+				}
+				reviews <- ar
+
+				if tc.respond == nil {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+					return
+				}
+				tc.respond(w)
+			}))
+			defer webhook.Close()
+
+			config := configuration.Configuration{
+				Storage: configuration.Storage{
+					"testdriver": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					}},
+				},
+			}
+			config.HTTP.Headers = headerConfig
+			config.Policy.Admission.URL = webhook.URL
+			config.Policy.Admission.Timeout = 100 * time.Millisecond
+			config.Policy.Admission.FailOpen = tc.failOpen
+			config.HTTP.RetryAfter = 1500 * time.Millisecond
+
+			env := newTestEnvWithConfig(t, &config)
+			defer env.Shutdown()
+
+			imageName, _ := reference.WithName("foo/admission")
+			configBlob := []byte(`{"architecture":"amd64","os":"linux"}`)
+			configDigest := digest.FromBytes(configBlob)
+			uploadURLBase, _ := startPushLayer(t, env, imageName)
+			pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
+
+			deserializedManifest, err := schema2.FromStruct(schema2.Manifest{
+				Versioned: schema2.SchemaVersion,
+				Config: distribution.Descriptor{
+					Digest:    configDigest,
+					Size:      int64(len(configBlob)),
+					MediaType: schema2.MediaTypeImageConfig,
+				},
+			})
+			if err != nil {
+				t.Fatalf("could not create DeserializedManifest: %v", err)
+			}
+			_, canonical, err := deserializedManifest.Payload()
+			if err != nil {
+				t.Fatalf("could not get manifest payload: %v", err)
+			}
+
+			tagRef, _ := reference.WithTag(imageName, "latest")
+			manifestURL, err := env.builder.BuildManifestURL(tagRef)
+			checkErr(t, err, "building manifest url")
+
+			resp := putManifest(t, "putting manifest", manifestURL, schema2.MediaTypeManifest, deserializedManifest)
+			defer resp.Body.Close()
+			checkResponse(t, "putting manifest", resp, tc.expectedStatus)
+			if retryAfter := resp.Header.Get("Retry-After"); retryAfter != tc.expectedRetryAfter {
+				t.Fatalf("expected Retry-After %q, got %q", tc.expectedRetryAfter, retryAfter)
+			}
+			if tc.expectedStatus != http.StatusCreated {
+				body, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("error reading response body: %v", err)
+				}
+				if !strings.Contains(string(body), tc.expectedBody) {
+					t.Fatalf("expected %q in response body, got %s", tc.expectedBody, body)
+				}
+
+				var errs errcode.Errors
+				if err := json.Unmarshal(body, &errs); err != nil {
+					t.Fatalf("error decoding error response: %v", err)
+				}
+				if len(errs) != 1 || errs[0].(errcode.Error).Code != tc.expectedCode {
+					t.Fatalf("expected error code %v, got %v", tc.expectedCode, errs)
+				}
+			}
+
+			select {
+			case ar := <-reviews:
+				if ar.Repository != "foo/admission" || ar.Tag != "latest" || ar.Digest != digest.FromBytes(canonical) || ar.MediaType != schema2.MediaTypeManifest {
+					t.Fatalf("unexpected admission request: %+v", ar)
+				}
+				if !bytes.Equal(ar.Manifest, canonical) {
+					t.Fatalf("admission request manifest does not match pushed manifest")
+				}
+			default:
+				t.Fatalf("admission webhook was not called")
+			}
+
+			req, err := http.NewRequest("GET", manifestURL, nil)
+			if err != nil {
+				t.Fatalf("error constructing request: %v", err)
+			}
+			req.Header.Set("Accept", schema2.MediaTypeManifest)
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error fetching manifest: %v", err)
+			}
+			defer resp.Body.Close()
+			if tc.expectedStatus == http.StatusCreated {
+				checkResponse(t, "fetching admitted manifest", resp, http.StatusOK)
+			} else {
+				checkResponse(t, "fetching rejected manifest", resp, http.StatusNotFound)
+			}
+		})
+	}
+}
+
+// TestManifestAdmissionWebhookTagLimit checks that a push waiting on the
+// admission webhook does not hold up the pushes of new tags to the same
+// repository when the number of tags per repository is limited.
+func TestManifestAdmissionWebhookTagLimit(t *testing.T) {
+	reviewing := make(chan struct{})
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ar admissionRequest
+		if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+			t.Errorf("error decoding admission request: %v", err)
+		}
+		if ar.Tag == "slow" {
+			close(reviewing)
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		fmt.Fprint(w, `{"allowed":true}`)
+	}))
+	defer webhook.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Policy.Admission.URL = webhook.URL
+	config.Policy.Admission.Timeout = 5 * time.Second
+	config.Policy.MaxTagsPerRepository = 10
+
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/admission")
+	configBlob := []byte(`{"architecture":"amd64","os":"linux"}`)
+	configDigest := digest.FromBytes(configBlob)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
+
+	deserializedManifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config: distribution.Descriptor{
+			Digest:    configDigest,
+			Size:      int64(len(configBlob)),
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not create DeserializedManifest: %v", err)
+	}
+
+	manifestURL := func(tag string) string {
+		tagRef, _ := reference.WithTag(imageName, tag)
+		u, err := env.builder.BuildManifestURL(tagRef)
+		checkErr(t, err, "building manifest url")
+		return u
+	}
+
+	slowURL := manifestURL("slow")
+	slowDone := make(chan *http.Response)
+	go func() {
+		slowDone <- putManifest(t, "putting slow manifest", slowURL, schema2.MediaTypeManifest, deserializedManifest)
+	}()
+	<-reviewing
+
+	fastDone := make(chan *http.Response)
+	go func() {
+		fastDone <- putManifest(t, "putting fast manifest", manifestURL("fast"), schema2.MediaTypeManifest, deserializedManifest)
+	}()
+	select {
+	case resp := <-fastDone:
+		resp.Body.Close()
+		checkResponse(t, "putting fast manifest", resp, http.StatusCreated)
+	case <-time.After(2 * time.Second):
+		close(release)
+		(<-slowDone).Body.Close()
+		(<-fastDone).Body.Close()
+		t.Fatal("push of a new tag held up by a push waiting on the admission webhook")
+	}
+
+	close(release)
+	resp := <-slowDone
+	resp.Body.Close()
+	checkResponse(t, "putting slow manifest", resp, http.StatusCreated)
+}
+
+func TestManifestAPI_DeleteTag(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
+
+	tag := "latest"
+	dgst := createRepository(env, t, imageName.Name(), tag)
+
+	ref, err := reference.WithTag(imageName, tag)
+	checkErr(t, err, "building tag reference")
+
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building tag URL")
+
+	resp, err := httpDelete(u)
+	m := "deleting tag"
+	checkErr(t, err, m)
+	defer resp.Body.Close()
+
+	checkResponse(t, m, resp, http.StatusAccepted)
+	if resp.Body != http.NoBody {
+		t.Fatal("unexpected response body")
+	}
+
+	msg := "checking tag no longer exists"
+	resp, err = http.Get(u)
+	checkErr(t, err, msg)
+	checkResponse(t, msg, resp, http.StatusNotFound)
+
+	digestRef, err := reference.WithDigest(imageName, dgst)
+	checkErr(t, err, "building manifest digest reference")
+
+	u, err = env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest URL")
+
+	msg = "checking manifest still exists"
+	resp, err = http.Head(u)
+	checkErr(t, err, msg)
+	checkResponse(t, msg, resp, http.StatusOK)
+}
+
+func TestManifestAPI_DeleteTag_Unknown(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building named object")
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building tag URL")
+
+	resp, err := httpDelete(u)
+	msg := "deleting unknown tag"
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+
+	checkResponse(t, msg, resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, msg, resp, v2.ErrorCodeManifestUnknown)
+}
+
+func TestManifestAPI_DeleteTag_ReadOnly(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+	env.app.readOnly.set(true)
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building named object")
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building URL")
+
+	resp, err := httpDelete(u)
+	msg := "deleting tag"
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+
+	checkResponse(t, msg, resp, http.StatusMethodNotAllowed)
+}
+
+// storageManifestErrDriverFactory implements the factory.StorageDriverFactory interface.
+type storageManifestErrDriverFactory struct{}
+
+const (
+	repositoryWithManifestNotFound    = "manifesttagnotfound"
+	repositoryWithManifestInvalidPath = "manifestinvalidpath"
+	repositoryWithManifestBadLink     = "manifestbadlink"
+	repositoryWithGenericStorageError = "genericstorageerr"
+)
+
+func (factory *storageManifestErrDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	// Initialize the mock driver
+	var errGenericStorage = errors.New("generic storage error")
+	return &mockErrorDriver{
+		returnErrs: []mockErrorMapping{
+			{
+				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestNotFound),
+				content:   nil,
+				err:       storagedriver.PathNotFoundError{},
+			},
+			{
+				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestInvalidPath),
+				content:   nil,
+				err:       storagedriver.InvalidPathError{},
+			},
+			{
+				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestBadLink),
+				content:   []byte("this is a bad sha"),
+				err:       nil,
+			},
+			{
+				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithGenericStorageError),
+				content:   nil,
+				err:       errGenericStorage,
+			},
+		},
+	}, nil
+}
+
+type mockErrorMapping struct {
+	pathMatch string
+	content   []byte
+	err       error
+}
+
+// mockErrorDriver implements StorageDriver to force storage error on manifest request
+type mockErrorDriver struct {
+	storagedriver.StorageDriver
+	returnErrs []mockErrorMapping
+}
+
+func (dr *mockErrorDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	for _, returns := range dr.returnErrs {
+		if strings.Contains(path, returns.pathMatch) {
+			return returns.content, returns.err
+		}
+	}
+	return nil, errors.New("Unknown storage error")
+}
+
+func TestGetManifestWithStorageError(t *testing.T) {
+	factory.Register("storagemanifesterror", &storageManifestErrDriverFactory{})
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"storagemanifesterror": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env1 := newTestEnvWithConfig(t, &config)
+	defer env1.Shutdown()
+
+	repo, _ := reference.WithName(repositoryWithManifestNotFound)
+	testManifestWithStorageError(t, env1, repo, http.StatusNotFound, v2.ErrorCodeManifestUnknown)
+
+	repo, _ = reference.WithName(repositoryWithGenericStorageError)
+	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+
+	repo, _ = reference.WithName(repositoryWithManifestInvalidPath)
+	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+
+	repo, _ = reference.WithName(repositoryWithManifestBadLink)
+	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+}
+
+func TestManifestDelete(t *testing.T) {
+	schema1Repo, _ := reference.WithName("foo/schema1")
+	schema2Repo, _ := reference.WithName("foo/schema2")
+
+	deleteEnabled := true
+	env := newTestEnv(t, deleteEnabled)
+	defer env.Shutdown()
+	schema1Args := testManifestAPISchema1(t, env, schema1Repo)
+	testManifestDelete(t, env, schema1Args)
+	schema2Args := testManifestAPISchema2(t, env, schema2Repo)
+	testManifestDelete(t, env, schema2Args)
+}
+
+func TestManifestDeleteDisabled(t *testing.T) {
+	schema1Repo, _ := reference.WithName("foo/schema1")
+	deleteEnabled := false
+	env := newTestEnv(t, deleteEnabled)
+	defer env.Shutdown()
+	testManifestDeleteDisabled(t, env, schema1Repo)
+}
+
+func testManifestDeleteDisabled(t *testing.T, env *testEnv, imageName reference.Named) {
+	ref, _ := reference.WithDigest(imageName, digestSha256EmptyTar)
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	resp, err := httpDelete(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting manifest %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "status of disabled delete of manifest", resp, http.StatusMethodNotAllowed)
+}
+
+func testManifestWithStorageError(t *testing.T, env *testEnv, imageName reference.Named, expectedStatusCode int, expectedErrorCode errcode.ErrorCode) {
+	tag := "latest"
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	// -----------------------------
+	// Attempt to fetch the manifest
+	resp, err := http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "getting non-existent manifest", resp, expectedStatusCode)
+	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, expectedErrorCode)
+}
+
+func testManifestAPISchema1(t *testing.T, env *testEnv, imageName reference.Named) manifestArgs {
+	tag := "thetag"
+	args := manifestArgs{imageName: imageName}
+
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	// -----------------------------
+	// Attempt to fetch the manifest
+	resp, err := http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "getting non-existent manifest", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, v2.ErrorCodeManifestUnknown)
+
+	tagsURL, err := env.builder.BuildTagsURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building tags url: %v", err)
+	}
+
+	resp, err = http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting unknown tags: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Check that we get an unknown repository error when asking for tags
+	checkResponse(t, "getting unknown manifest tags", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeNameUnknown)
+
+	// --------------------------------
+	// Attempt to push unsigned manifest with missing layers
+	unsignedManifest := &schema1.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 1,
+		},
+		Name: imageName.Name(),
+		Tag:  tag,
+		FSLayers: []schema1.FSLayer{
+			{
+				BlobSum: "asdf",
+			},
+			{
+				BlobSum: "qwer",
+			},
+		},
+		History: []schema1.History{
+			{
+				V1Compatibility: "",
+			},
+			{
+				V1Compatibility: "",
+			},
+		},
+	}
+
+	resp = putManifest(t, "putting unsigned manifest", manifestURL, "", unsignedManifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting unsigned manifest", resp, http.StatusBadRequest)
+	_, p, counts := checkBodyHasErrorCodes(t, "putting unsigned manifest", resp, v2.ErrorCodeManifestInvalid)
+
+	expectedCounts := map[errcode.ErrorCode]int{
+		v2.ErrorCodeManifestInvalid: 1,
+	}
+
+	if !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	}
+
+	// sign the manifest and still get some interesting errors.
+	sm, err := schema1.Sign(unsignedManifest, env.pk)
+	if err != nil {
+		t.Fatalf("error signing manifest: %v", err)
+	}
+
+	resp = putManifest(t, "putting signed manifest with errors", manifestURL, "", sm)
+	defer resp.Body.Close()
+	checkResponse(t, "putting signed manifest with errors", resp, http.StatusBadRequest)
+	_, p, counts = checkBodyHasErrorCodes(t, "putting signed manifest with errors", resp,
+		v2.ErrorCodeManifestBlobUnknown, v2.ErrorCodeDigestInvalid)
+
+	expectedCounts = map[errcode.ErrorCode]int{
+		v2.ErrorCodeManifestBlobUnknown: 2,
+		v2.ErrorCodeDigestInvalid:       2,
+	}
+
+	if !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	}
+
+	// TODO(stevvooe): Add a test case where we take a mostly valid registry,
+	// tamper with the content and ensure that we get an unverified manifest
+	// error.
+
+	// Push 2 random layers
+	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
+
+	for i := range unsignedManifest.FSLayers {
+		rs, dgst, err := testutil.CreateRandomTarFile()
+
+		if err != nil {
+			t.Fatalf("error creating random layer %d: %v", i, err)
+		}
+
+		expectedLayers[dgst] = rs
+		unsignedManifest.FSLayers[i].BlobSum = dgst
+
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
+	}
+
+	// -------------------
+	// Push the signed manifest with all layers pushed.
+	signedManifest, err := schema1.Sign(unsignedManifest, env.pk)
+	if err != nil {
+		t.Fatalf("unexpected error signing manifest: %v", err)
+	}
+
+	dgst := digest.FromBytes(signedManifest.Canonical)
+	args.manifest = signedManifest
+	args.dgst = dgst
+
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+
+	resp = putManifest(t, "putting signed manifest no error", manifestURL, "", signedManifest)
+	checkResponse(t, "putting signed manifest no error", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// --------------------
+	// Push by digest -- should get same result
+	resp = putManifest(t, "putting signed manifest", manifestDigestURL, "", signedManifest)
+	checkResponse(t, "putting signed manifest", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// ------------------
+	// Fetch by tag name
+	resp, err = http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	var fetchedManifest schema1.SignedManifest
+	dec := json.NewDecoder(resp.Body)
+
+	if err := dec.Decode(&fetchedManifest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+
+	if !bytes.Equal(fetchedManifest.Canonical, signedManifest.Canonical) {
+		t.Fatalf("manifests do not match")
+	}
+
+	// ---------------
+	// Fetch by digest
+	resp, err = http.Get(manifestDigestURL)
+	checkErr(t, err, "fetching manifest by digest")
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	var fetchedManifestByDigest schema1.SignedManifest
+	dec = json.NewDecoder(resp.Body)
+	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+
+	if !bytes.Equal(fetchedManifestByDigest.Canonical, signedManifest.Canonical) {
+		t.Fatalf("manifests do not match")
+	}
+
+	// check signature was roundtripped
+	signatures, err := fetchedManifestByDigest.Signatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(signatures) != 1 {
+		t.Fatalf("expected 1 signature from manifest, got: %d", len(signatures))
+	}
+
+	// Re-sign, push and pull the same digest
+	sm2, err := schema1.Sign(&fetchedManifestByDigest.Manifest, env.pk)
+	if err != nil {
+		t.Fatal(err)
+
+	}
+
+	// Re-push with a few different Content-Types. The official schema1
+	// content type should work, as should application/json with/without a
+	// charset.
+	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, schema1.MediaTypeSignedManifest, sm2)
+	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
+	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, "application/json", sm2)
+	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
+	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, "application/json", sm2)
+	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
+
+	resp, err = http.Get(manifestDigestURL)
+	checkErr(t, err, "re-fetching manifest by digest")
+	defer resp.Body.Close()
+
+	checkResponse(t, "re-fetching uploaded manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	dec = json.NewDecoder(resp.Body)
+	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+
+	// check only 1 signature is returned
+	signatures, err = fetchedManifestByDigest.Signatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(signatures) != 1 {
+		t.Fatalf("expected 2 signature from manifest, got: %d", len(signatures))
+	}
+
+	// Get by name with etag, gives 304
+	etag := resp.Header.Get("Etag")
+	req, err := http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+
+	checkResponse(t, "fetching manifest by name with etag", resp, http.StatusNotModified)
+
+	// Get by digest with etag, gives 304
+	req, err = http.NewRequest("GET", manifestDigestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+
+	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
+
+	// Ensure that the tag is listed.
+	resp, err = http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting unknown tags: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "getting tags", resp, http.StatusOK)
+	dec = json.NewDecoder(resp.Body)
+
+	var tagsResponse tagsAPIResponse
+
+	if err := dec.Decode(&tagsResponse); err != nil {
+		t.Fatalf("unexpected error decoding error response: %v", err)
+	}
+
+	if tagsResponse.Name != imageName.Name() {
+		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName.Name())
+	}
+
+	if len(tagsResponse.Tags) != 1 {
+		t.Fatalf("expected some tags in response: %v", tagsResponse.Tags)
+	}
+
+	if tagsResponse.Tags[0] != tag {
+		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
+	}
+
+	// Attempt to put a manifest with mismatching FSLayer and History array cardinalities
+
+	unsignedManifest.History = append(unsignedManifest.History, schema1.History{
+		V1Compatibility: "",
+	})
+	invalidSigned, err := schema1.Sign(unsignedManifest, env.pk)
+	if err != nil {
+		t.Fatalf("error signing manifest")
+	}
+
+	resp = putManifest(t, "putting invalid signed manifest", manifestDigestURL, "", invalidSigned)
+	checkResponse(t, "putting invalid signed manifest", resp, http.StatusBadRequest)
+
+	return args
+}
+
+func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Named) manifestArgs {
+	tag := "schema2tag"
+	args := manifestArgs{
+		imageName: imageName,
+		mediaType: schema2.MediaTypeManifest,
+	}
+
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	// -----------------------------
+	// Attempt to fetch the manifest
+	resp, err := http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "getting non-existent manifest", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, v2.ErrorCodeManifestUnknown)
+
+	tagsURL, err := env.builder.BuildTagsURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building tags url: %v", err)
+	}
+
+	resp, err = http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting unknown tags: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Check that we get an unknown repository error when asking for tags
+	checkResponse(t, "getting unknown manifest tags", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeNameUnknown)
+
+	// --------------------------------
+	// Attempt to push manifest with missing config and missing layers
+	manifest := &schema2.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     schema2.MediaTypeManifest,
+		},
+		Config: distribution.Descriptor{
+			Digest:    "sha256:1a9ec845ee94c202b2d5da74a24f0ed2058318bfa9879fa541efaecba272e86b",
+			Size:      3253,
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+		Layers: []distribution.Descriptor{
+			{
+				Digest:    "sha256:463434349086340864309863409683460843608348608934092322395278926a",
+				Size:      6323,
+				MediaType: schema2.MediaTypeLayer,
+			},
+			{
+				Digest:    "sha256:630923423623623423352523525237238023652897356239852383652aaaaaaa",
+				Size:      6863,
+				MediaType: schema2.MediaTypeLayer,
+			},
+		},
+	}
+
+	resp = putManifest(t, "putting missing config manifest", manifestURL, schema2.MediaTypeManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting missing config manifest", resp, http.StatusBadRequest)
+	_, p, counts := checkBodyHasErrorCodes(t, "putting missing config manifest", resp, v2.ErrorCodeManifestBlobUnknown)
+
+	expectedCounts := map[errcode.ErrorCode]int{
+		v2.ErrorCodeManifestBlobUnknown: 3,
+	}
+
+	if !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	}
+
+	// Push a config, and reference it in the manifest
+	sampleConfig := []byte(`{
+		"architecture": "amd64",
+		"history": [
+		  {
+		    "created": "2015-10-31T22:22:54.690851953Z",
+		    "created_by": "/bin/sh -c #(nop) ADD file:a3bc1e842b69636f9df5256c49c5374fb4eef1e281fe3f282c65fb853ee171c5 in /"
+		  },
+		  {
+		    "created": "2015-10-31T22:22:55.613815829Z",
+		    "created_by": "/bin/sh -c #(nop) CMD [\"sh\"]"
+		  }
+		],
+		"rootfs": {
+		  "diff_ids": [
+		    "sha256:c6f988f4874bb0add23a778f753c65efe992244e148a1d2ec2a8b664fb66bbd1",
+		    "sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef"
+		  ],
+		  "type": "layers"
+		}
+	}`)
+	sampleConfigDigest := digest.FromBytes(sampleConfig)
+
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, sampleConfigDigest, uploadURLBase, bytes.NewReader(sampleConfig))
+	manifest.Config.Digest = sampleConfigDigest
+	manifest.Config.Size = int64(len(sampleConfig))
+
+	// The manifest should still be invalid, because its layer doesn't exist
+	resp = putManifest(t, "putting missing layer manifest", manifestURL, schema2.MediaTypeManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting missing layer manifest", resp, http.StatusBadRequest)
+	_, p, counts = checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeManifestBlobUnknown)
+
+	expectedCounts = map[errcode.ErrorCode]int{
+		v2.ErrorCodeManifestBlobUnknown: 2,
+	}
+
+	if !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	}
+
+	// Push 2 random layers
+	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
+
+	for i := range manifest.Layers {
+		rs, dgst, err := testutil.CreateRandomTarFile()
+
+		if err != nil {
+			t.Fatalf("error creating random layer %d: %v", i, err)
+		}
+
+		expectedLayers[dgst] = rs
+		manifest.Layers[i].Digest = dgst
+
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
+	}
+
+	// -------------------
+	// Push the manifest with all layers pushed.
+	deserializedManifest, err := schema2.FromStruct(*manifest)
+	if err != nil {
+		t.Fatalf("could not create DeserializedManifest: %v", err)
+	}
+	_, canonical, err := deserializedManifest.Payload()
+	if err != nil {
+		t.Fatalf("could not get manifest payload: %v", err)
+	}
+	dgst := digest.FromBytes(canonical)
+	args.dgst = dgst
+	args.manifest = deserializedManifest
+
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+
+	resp = putManifest(t, "putting manifest no error", manifestURL, schema2.MediaTypeManifest, manifest)
+	checkResponse(t, "putting manifest no error", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// --------------------
+	// Push by digest -- should get same result
+	resp = putManifest(t, "putting manifest by digest", manifestDigestURL, schema2.MediaTypeManifest, manifest)
+	checkResponse(t, "putting manifest by digest", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// ------------------
+	// Fetch by tag name
+	req, err := http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	var fetchedManifest schema2.DeserializedManifest
+	dec := json.NewDecoder(resp.Body)
+
+	if err := dec.Decode(&fetchedManifest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+
+	_, fetchedCanonical, err := fetchedManifest.Payload()
+	if err != nil {
+		t.Fatalf("error getting manifest payload: %v", err)
+	}
+
+	if !bytes.Equal(fetchedCanonical, canonical) {
+		t.Fatalf("manifests do not match")
+	}
+
+	// ---------------
+	// Fetch by digest
+	req, err = http.NewRequest("GET", manifestDigestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching manifest by digest")
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	var fetchedManifestByDigest schema2.DeserializedManifest
+	dec = json.NewDecoder(resp.Body)
+	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+
+	_, fetchedCanonical, err = fetchedManifest.Payload()
+	if err != nil {
+		t.Fatalf("error getting manifest payload: %v", err)
+	}
+
+	if !bytes.Equal(fetchedCanonical, canonical) {
+		t.Fatalf("manifests do not match")
+	}
+
+	// Get by name with etag, gives 304
+	etag := resp.Header.Get("Etag")
+	req, err = http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+
+	checkResponse(t, "fetching manifest by name with etag", resp, http.StatusNotModified)
+
+	// Get by digest with etag, gives 304
+	req, err = http.NewRequest("GET", manifestDigestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+
+	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
+
+	// Ensure that the tag is listed.
+	resp, err = http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting unknown tags: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "getting unknown manifest tags", resp, http.StatusOK)
+	dec = json.NewDecoder(resp.Body)
+
+	var tagsResponse tagsAPIResponse
+
+	if err := dec.Decode(&tagsResponse); err != nil {
+		t.Fatalf("unexpected error decoding error response: %v", err)
+	}
+
+	if tagsResponse.Name != imageName.Name() {
+		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName)
+	}
+
+	if len(tagsResponse.Tags) != 1 {
+		t.Fatalf("expected some tags in response: %v", tagsResponse.Tags)
+	}
+
+	if tagsResponse.Tags[0] != tag {
+		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
+	}
+
+	// ------------------
+	// Fetch as a schema1 manifest
+	req, err = http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("Accept", schema1.MediaTypeSignedManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest as schema1: %v", err)
+	}
+	defer resp.Body.Close()
+
+	manifestBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading response body: %v", err)
+	}
+
+	checkResponse(t, "fetching uploaded manifest as schema1", resp, http.StatusOK)
+
+	m, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeManifest, manifestBytes)
+	if err != nil {
+		t.Fatalf("unexpected error unmarshalling manifest: %v", err)
+	}
+
+	fetchedSchema1Manifest, ok := m.(*schema1.SignedManifest)
+	if !ok {
+		t.Fatalf("expecting schema1 manifest")
+	}
+
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{desc.Digest.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, desc.Digest)},
+	})
+
+	if fetchedSchema1Manifest.Manifest.SchemaVersion != 1 {
+		t.Fatal("wrong schema version")
+	}
+	if fetchedSchema1Manifest.Architecture != "amd64" {
+		t.Fatal("wrong architecture")
+	}
+	if fetchedSchema1Manifest.Name != imageName.Name() {
+		t.Fatal("wrong image name")
+	}
+	if fetchedSchema1Manifest.Tag != tag {
+		t.Fatal("wrong tag")
+	}
+	if len(fetchedSchema1Manifest.FSLayers) != 2 {
+		t.Fatal("wrong number of FSLayers")
+	}
+	for i := range manifest.Layers {
+		if fetchedSchema1Manifest.FSLayers[i].BlobSum != manifest.Layers[len(manifest.Layers)-i-1].Digest {
+			t.Fatalf("blob digest mismatch in schema1 manifest for layer %d", i)
+		}
+	}
+	if len(fetchedSchema1Manifest.History) != 2 {
+		t.Fatal("wrong number of History entries")
+	}
+
+	// Don't check V1Compatibility fields because we're using randomly-generated
+	// layers.
+
+	return args
+}
+
+func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs) {
+	imageName := args.imageName
+	tag := "manifestlisttag"
+
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	// --------------------------------
+	// Attempt to push manifest list that refers to an unknown manifest
+	manifestList := &manifestlist.ManifestList{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     manifestlist.MediaTypeManifestList,
+		},
+		Manifests: []manifestlist.ManifestDescriptor{
+			{
+				Descriptor: distribution.Descriptor{
+					Digest:    "sha256:1a9ec845ee94c202b2d5da74a24f0ed2058318bfa9879fa541efaecba272e86b",
+					Size:      3253,
+					MediaType: schema2.MediaTypeManifest,
+				},
+				Platform: manifestlist.PlatformSpec{
+					Architecture: "amd64",
+					OS:           "linux",
+				},
+			},
+		},
+	}
+
+	resp := putManifest(t, "putting missing manifest manifestlist", manifestURL, manifestlist.MediaTypeManifestList, manifestList)
+	defer resp.Body.Close()
+	checkResponse(t, "putting missing manifest manifestlist", resp, http.StatusBadRequest)
+	_, p, counts := checkBodyHasErrorCodes(t, "putting missing manifest manifestlist", resp, v2.ErrorCodeManifestBlobUnknown)
+
+	expectedCounts := map[errcode.ErrorCode]int{
+		v2.ErrorCodeManifestBlobUnknown: 1,
+	}
+
+	if !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	}
+
+	// -------------------
+	// Push a manifest list that references an actual manifest
+	manifestList.Manifests[0].Digest = args.dgst
+	deserializedManifestList, err := manifestlist.FromDescriptors(manifestList.Manifests)
+	if err != nil {
+		t.Fatalf("could not create DeserializedManifestList: %v", err)
+	}
+	_, canonical, err := deserializedManifestList.Payload()
+	if err != nil {
+		t.Fatalf("could not get manifest list payload: %v", err)
+	}
+	dgst := digest.FromBytes(canonical)
+
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+
+	resp = putManifest(t, "putting manifest list no error", manifestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
+	checkResponse(t, "putting manifest list no error", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// --------------------
+	// Push by digest -- should get same result
+	resp = putManifest(t, "putting manifest list by digest", manifestDigestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
+	checkResponse(t, "putting manifest list by digest", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// ------------------
+	// Fetch by tag name
+	req, err := http.NewRequest("GET", manifestURL, nil)
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
+		t.Fatalf("Error constructing request: %s", err)
 	}
-
-	resp, err := httpDelete(manifestURL)
+	// multiple headers in mixed list format to ensure we parse correctly server-side
+	req.Header.Set("Accept", fmt.Sprintf(` %s ; q=0.8 , %s ; q=0.5 `, manifestlist.MediaTypeManifestList, schema1.MediaTypeSignedManifest))
+	req.Header.Add("Accept", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("unexpected error deleting manifest %v", err)
+		t.Fatalf("unexpected error fetching manifest list: %v", err)
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "status of disabled delete of manifest", resp, http.StatusMethodNotAllowed)
-}
+	checkResponse(t, "fetching uploaded manifest list", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
 
-func testManifestWithStorageError(t *testing.T, env *testEnv, imageName reference.Named, expectedStatusCode int, expectedErrorCode errcode.ErrorCode) {
-	tag := "latest"
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	var fetchedManifestList manifestlist.DeserializedManifestList
+	dec := json.NewDecoder(resp.Body)
+
+	if err := dec.Decode(&fetchedManifestList); err != nil {
+		t.Fatalf("error decoding fetched manifest list: %v", err)
+	}
+
+	_, fetchedCanonical, err := fetchedManifestList.Payload()
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
+		t.Fatalf("error getting manifest list payload: %v", err)
 	}
 
-	// -----------------------------
-	// Attempt to fetch the manifest
-	resp, err := http.Get(manifestURL)
+	if !bytes.Equal(fetchedCanonical, canonical) {
+		t.Fatalf("manifest lists do not match")
+	}
+
+	// ---------------
+	// Fetch by digest
+	req, err = http.NewRequest("GET", manifestDigestURL, nil)
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest: %v", err)
+		t.Fatalf("Error constructing request: %s", err)
 	}
+	req.Header.Set("Accept", manifestlist.MediaTypeManifestList)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching manifest list by digest")
 	defer resp.Body.Close()
-	checkResponse(t, "getting non-existent manifest", resp, expectedStatusCode)
-	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, expectedErrorCode)
-}
 
-func testManifestAPISchema1(t *testing.T, env *testEnv, imageName reference.Named) manifestArgs {
-	tag := "thetag"
-	args := manifestArgs{imageName: imageName}
+	checkResponse(t, "fetching uploaded manifest list", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
 
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestURL, err := env.builder.BuildManifestURL(tagRef)
-	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
+	var fetchedManifestListByDigest manifestlist.DeserializedManifestList
+	dec = json.NewDecoder(resp.Body)
+	if err := dec.Decode(&fetchedManifestListByDigest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
 	}
 
-	// -----------------------------
-	// Attempt to fetch the manifest
-	resp, err := http.Get(manifestURL)
+	_, fetchedCanonical, err = fetchedManifestListByDigest.Payload()
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest: %v", err)
+		t.Fatalf("error getting manifest list payload: %v", err)
 	}
-	defer resp.Body.Close()
 
-	checkResponse(t, "getting non-existent manifest", resp, http.StatusNotFound)
-	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, v2.ErrorCodeManifestUnknown)
+	if !bytes.Equal(fetchedCanonical, canonical) {
+		t.Fatalf("manifests do not match")
+	}
 
-	tagsURL, err := env.builder.BuildTagsURL(imageName)
+	// Get by name with etag, gives 304
+	etag := resp.Header.Get("Etag")
+	req, err = http.NewRequest("GET", manifestURL, nil)
 	if err != nil {
-		t.Fatalf("unexpected error building tags url: %v", err)
+		t.Fatalf("Error constructing request: %s", err)
 	}
-
-	resp, err = http.Get(tagsURL)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("unexpected error getting unknown tags: %v", err)
+		t.Fatalf("Error constructing request: %s", err)
 	}
-	defer resp.Body.Close()
 
-	// Check that we get an unknown repository error when asking for tags
-	checkResponse(t, "getting unknown manifest tags", resp, http.StatusNotFound)
-	checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeNameUnknown)
+	checkResponse(t, "fetching manifest by name with etag", resp, http.StatusNotModified)
 
-	// --------------------------------
-	// Attempt to push unsigned manifest with missing layers
-	unsignedManifest := &schema1.Manifest{
-		Versioned: manifest.Versioned{
-			SchemaVersion: 1,
-		},
-		Name: imageName.Name(),
-		Tag:  tag,
-		FSLayers: []schema1.FSLayer{
-			{
-				BlobSum: "asdf",
-			},
-			{
-				BlobSum: "qwer",
-			},
-		},
-		History: []schema1.History{
-			{
-				V1Compatibility: "",
-			},
-			{
-				V1Compatibility: "",
-			},
-		},
+	// Get by digest with etag, gives 304
+	req, err = http.NewRequest("GET", manifestDigestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
 	}
 
-	resp = putManifest(t, "putting unsigned manifest", manifestURL, "", unsignedManifest)
-	defer resp.Body.Close()
-	checkResponse(t, "putting unsigned manifest", resp, http.StatusBadRequest)
-	_, p, counts := checkBodyHasErrorCodes(t, "putting unsigned manifest", resp, v2.ErrorCodeManifestInvalid)
+	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
 
-	expectedCounts := map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestInvalid: 1,
+	// ------------------
+	// Fetch as a schema1 manifest
+	req, err = http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
 	}
-
-	if !reflect.DeepEqual(counts, expectedCounts) {
-		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	req.Header.Set("Accept", schema1.MediaTypeSignedManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest list as schema1: %v", err)
 	}
+	defer resp.Body.Close()
 
-	// sign the manifest and still get some interesting errors.
-	sm, err := schema1.Sign(unsignedManifest, env.pk)
+	manifestBytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		t.Fatalf("error signing manifest: %v", err)
+		t.Fatalf("error reading response body: %v", err)
 	}
 
-	resp = putManifest(t, "putting signed manifest with errors", manifestURL, "", sm)
-	defer resp.Body.Close()
-	checkResponse(t, "putting signed manifest with errors", resp, http.StatusBadRequest)
-	_, p, counts = checkBodyHasErrorCodes(t, "putting signed manifest with errors", resp,
-		v2.ErrorCodeManifestBlobUnknown, v2.ErrorCodeDigestInvalid)
+	checkResponse(t, "fetching uploaded manifest list as schema1", resp, http.StatusOK)
 
-	expectedCounts = map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestBlobUnknown: 2,
-		v2.ErrorCodeDigestInvalid:       2,
+	m, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeManifest, manifestBytes)
+	if err != nil {
+		t.Fatalf("unexpected error unmarshalling manifest: %v", err)
 	}
 
-	if !reflect.DeepEqual(counts, expectedCounts) {
-		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	fetchedSchema1Manifest, ok := m.(*schema1.SignedManifest)
+	if !ok {
+		t.Fatalf("expecting schema1 manifest")
 	}
 
-	// TODO(stevvooe): Add a test case where we take a mostly valid registry,
-	// tamper with the content and ensure that we get an unverified manifest
-	// error.
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{desc.Digest.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, desc.Digest)},
+	})
 
-	// Push 2 random layers
-	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
+	if fetchedSchema1Manifest.Manifest.SchemaVersion != 1 {
+		t.Fatal("wrong schema version")
+	}
+	if fetchedSchema1Manifest.Architecture != "amd64" {
+		t.Fatal("wrong architecture")
+	}
+	if fetchedSchema1Manifest.Name != imageName.Name() {
+		t.Fatal("wrong image name")
+	}
+	if fetchedSchema1Manifest.Tag != tag {
+		t.Fatal("wrong tag")
+	}
+	if len(fetchedSchema1Manifest.FSLayers) != 2 {
+		t.Fatal("wrong number of FSLayers")
+	}
+	layers := args.manifest.(*schema2.DeserializedManifest).Layers
+	for i := range layers {
+		if fetchedSchema1Manifest.FSLayers[i].BlobSum != layers[len(layers)-i-1].Digest {
+			t.Fatalf("blob digest mismatch in schema1 manifest for layer %d", i)
+		}
+	}
+	if len(fetchedSchema1Manifest.History) != 2 {
+		t.Fatal("wrong number of History entries")
+	}
 
-	for i := range unsignedManifest.FSLayers {
-		rs, dgst, err := testutil.CreateRandomTarFile()
+	// Don't check V1Compatibility fields because we're using randomly-generated
+	// layers.
+}
 
-		if err != nil {
-			t.Fatalf("error creating random layer %d: %v", i, err)
-		}
+func testManifestDelete(t *testing.T, env *testEnv, args manifestArgs) {
+	imageName := args.imageName
+	dgst := args.dgst
+	manifest := args.manifest
 
-		expectedLayers[dgst] = rs
-		unsignedManifest.FSLayers[i].BlobSum = dgst
+	ref, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, _ := env.builder.BuildManifestURL(ref)
+	// ---------------
+	// Delete by digest
+	resp, err := httpDelete(manifestDigestURL)
+	checkErr(t, err, "deleting manifest by digest")
 
-		uploadURLBase, _ := startPushLayer(t, env, imageName)
-		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
-	}
+	checkResponse(t, "deleting manifest", resp, http.StatusAccepted)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length": []string{"0"},
+	})
 
-	// -------------------
-	// Push the signed manifest with all layers pushed.
-	signedManifest, err := schema1.Sign(unsignedManifest, env.pk)
-	if err != nil {
-		t.Fatalf("unexpected error signing manifest: %v", err)
-	}
+	// ---------------
+	// Attempt to fetch deleted manifest
+	resp, err = http.Get(manifestDigestURL)
+	checkErr(t, err, "fetching deleted manifest by digest")
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching deleted manifest", resp, http.StatusNotFound)
 
-	dgst := digest.FromBytes(signedManifest.Canonical)
-	args.manifest = signedManifest
-	args.dgst = dgst
+	// ---------------
+	// Delete already deleted manifest by digest
+	resp, err = httpDelete(manifestDigestURL)
+	checkErr(t, err, "re-deleting manifest by digest")
 
-	digestRef, _ := reference.WithDigest(imageName, dgst)
-	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
-	checkErr(t, err, "building manifest url")
+	checkResponse(t, "re-deleting manifest", resp, http.StatusNotFound)
 
-	resp = putManifest(t, "putting signed manifest no error", manifestURL, "", signedManifest)
-	checkResponse(t, "putting signed manifest no error", resp, http.StatusCreated)
+	// --------------------
+	// Re-upload manifest by digest
+	resp = putManifest(t, "putting manifest", manifestDigestURL, args.mediaType, manifest)
+	checkResponse(t, "putting manifest", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
 		"Location":              []string{manifestDigestURL},
 		"Docker-Content-Digest": []string{dgst.String()},
 	})
 
+	// ---------------
+	// Attempt to fetch re-uploaded deleted digest
+	resp, err = http.Get(manifestDigestURL)
+	checkErr(t, err, "fetching re-uploaded manifest by digest")
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching re-uploaded manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// ---------------
+	// Attempt to delete an unknown manifest
+	unknownDigest := digest.Digest("sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	unknownRef, _ := reference.WithDigest(imageName, unknownDigest)
+	unknownManifestDigestURL, err := env.builder.BuildManifestURL(unknownRef)
+	checkErr(t, err, "building unknown manifest url")
+
+	resp, err = httpDelete(unknownManifestDigestURL)
+	checkErr(t, err, "delting unknown manifest by digest")
+	checkResponse(t, "fetching deleted manifest", resp, http.StatusNotFound)
+
 	// --------------------
-	// Push by digest -- should get same result
-	resp = putManifest(t, "putting signed manifest", manifestDigestURL, "", signedManifest)
-	checkResponse(t, "putting signed manifest", resp, http.StatusCreated)
+	// Upload manifest by tag
+	tag := "atag"
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestTagURL, _ := env.builder.BuildManifestURL(tagRef)
+	resp = putManifest(t, "putting manifest by tag", manifestTagURL, args.mediaType, manifest)
+	checkResponse(t, "putting manifest by tag", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
 		"Location":              []string{manifestDigestURL},
 		"Docker-Content-Digest": []string{dgst.String()},
 	})
 
-	// ------------------
-	// Fetch by tag name
-	resp, err = http.Get(manifestURL)
+	tagsURL, err := env.builder.BuildTagsURL(imageName)
 	if err != nil {
-		t.Fatalf("unexpected error fetching manifest: %v", err)
+		t.Fatalf("unexpected error building tags url: %v", err)
 	}
-	defer resp.Body.Close()
 
-	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
-	})
+	// Ensure that the tag is listed.
+	resp, err = http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting unknown tags: %v", err)
+	}
+	defer resp.Body.Close()
 
-	var fetchedManifest schema1.SignedManifest
 	dec := json.NewDecoder(resp.Body)
+	var tagsResponse tagsAPIResponse
+	if err := dec.Decode(&tagsResponse); err != nil {
+		t.Fatalf("unexpected error decoding error response: %v", err)
+	}
 
-	if err := dec.Decode(&fetchedManifest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
+	if tagsResponse.Name != imageName.Name() {
+		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName)
 	}
 
-	if !bytes.Equal(fetchedManifest.Canonical, signedManifest.Canonical) {
-		t.Fatalf("manifests do not match")
+	if len(tagsResponse.Tags) != 1 {
+		t.Fatalf("expected some tags in response: %v", tagsResponse.Tags)
+	}
+
+	if tagsResponse.Tags[0] != tag {
+		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
 	}
 
 	// ---------------
-	// Fetch by digest
-	resp, err = http.Get(manifestDigestURL)
-	checkErr(t, err, "fetching manifest by digest")
-	defer resp.Body.Close()
+	// Delete by digest
+	resp, err = httpDelete(manifestDigestURL)
+	checkErr(t, err, "deleting manifest by digest")
 
-	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
+	checkResponse(t, "deleting manifest with tag", resp, http.StatusAccepted)
 	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+		"Content-Length": []string{"0"},
 	})
 
-	var fetchedManifestByDigest schema1.SignedManifest
-	dec = json.NewDecoder(resp.Body)
-	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
+	// Ensure that the tag is not listed.
+	resp, err = http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting unknown tags: %v", err)
 	}
+	defer resp.Body.Close()
 
-	if !bytes.Equal(fetchedManifestByDigest.Canonical, signedManifest.Canonical) {
-		t.Fatalf("manifests do not match")
+	dec = json.NewDecoder(resp.Body)
+	if err := dec.Decode(&tagsResponse); err != nil {
+		t.Fatalf("unexpected error decoding error response: %v", err)
 	}
 
-	// check signature was roundtripped
-	signatures, err := fetchedManifestByDigest.Signatures()
-	if err != nil {
-		t.Fatal(err)
+	if tagsResponse.Name != imageName.Name() {
+		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName)
 	}
 
-	if len(signatures) != 1 {
-		t.Fatalf("expected 1 signature from manifest, got: %d", len(signatures))
+	if len(tagsResponse.Tags) != 0 {
+		t.Fatalf("expected 0 tags in response: %v", tagsResponse.Tags)
 	}
 
-	// Re-sign, push and pull the same digest
-	sm2, err := schema1.Sign(&fetchedManifestByDigest.Manifest, env.pk)
-	if err != nil {
-		t.Fatal(err)
+}
 
-	}
+type testEnv struct {
+	pk      libtrust.PrivateKey
+	ctx     context.Context
+	config  configuration.Configuration
+	app     *App
+	server  *httptest.Server
+	builder *v2.URLBuilder
+}
 
-	// Re-push with a few different Content-Types. The official schema1
-	// content type should work, as should application/json with/without a
-	// charset.
-	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, schema1.MediaTypeSignedManifest, sm2)
-	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
-	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, "application/json", sm2)
-	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
-	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, "application/json", sm2)
-	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
+func newTestEnvMirror(t *testing.T, deleteEnabled bool) *testEnv {
+	upstreamEnv := newTestEnv(t, deleteEnabled)
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"delete":     configuration.Parameters{"enabled": deleteEnabled},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstreamEnv.server.URL,
+		},
+	}
+	config.Compatibility.Schema1.Enabled = true
 
-	resp, err = http.Get(manifestDigestURL)
-	checkErr(t, err, "re-fetching manifest by digest")
-	defer resp.Body.Close()
+	return newTestEnvWithConfig(t, &config)
 
-	checkResponse(t, "re-fetching uploaded manifest", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
-	})
+}
 
-	dec = json.NewDecoder(resp.Body)
-	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
+func newTestEnv(t *testing.T, deleteEnabled bool) *testEnv {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"delete":     configuration.Parameters{"enabled": deleteEnabled},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
 
-	// check only 1 signature is returned
-	signatures, err = fetchedManifestByDigest.Signatures()
-	if err != nil {
-		t.Fatal(err)
-	}
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
 
-	if len(signatures) != 1 {
-		t.Fatalf("expected 2 signature from manifest, got: %d", len(signatures))
-	}
+	return newTestEnvWithConfig(t, &config)
+}
 
-	// Get by name with etag, gives 304
-	etag := resp.Header.Get("Etag")
-	req, err := http.NewRequest("GET", manifestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
-	}
-	req.Header.Set("If-None-Match", etag)
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
-	}
+func newTestEnvWithConfig(t *testing.T, config *configuration.Configuration) *testEnv {
+	ctx := context.Background()
 
-	checkResponse(t, "fetching manifest by name with etag", resp, http.StatusNotModified)
+	app := NewApp(ctx, config)
+	server := httptest.NewServer(handlers.CombinedLoggingHandler(os.Stderr, app))
+	builder, err := v2.NewURLBuilderFromString(server.URL+config.HTTP.Prefix, false)
 
-	// Get by digest with etag, gives 304
-	req, err = http.NewRequest("GET", manifestDigestURL, nil)
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("error creating url builder: %v", err)
 	}
-	req.Header.Set("If-None-Match", etag)
-	resp, err = http.DefaultClient.Do(req)
+
+	pk, err := libtrust.GenerateECP256PrivateKey()
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("unexpected error generating private key: %v", err)
 	}
 
-	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
-
-	// Ensure that the tag is listed.
-	resp, err = http.Get(tagsURL)
-	if err != nil {
-		t.Fatalf("unexpected error getting unknown tags: %v", err)
+	return &testEnv{
+		pk:      pk,
+		ctx:     ctx,
+		config:  *config,
+		app:     app,
+		server:  server,
+		builder: builder,
 	}
-	defer resp.Body.Close()
+}
 
-	checkResponse(t, "getting tags", resp, http.StatusOK)
-	dec = json.NewDecoder(resp.Body)
+func (t *testEnv) Shutdown() {
+	t.server.CloseClientConnections()
+	t.server.Close()
+}
 
-	var tagsResponse tagsAPIResponse
+func putManifest(t *testing.T, msg, url, contentType string, v interface{}) *http.Response {
+	var body []byte
 
-	if err := dec.Decode(&tagsResponse); err != nil {
-		t.Fatalf("unexpected error decoding error response: %v", err)
+	switch m := v.(type) {
+	case *schema1.SignedManifest:
+		_, pl, err := m.Payload()
+		if err != nil {
+			t.Fatalf("error getting payload: %v", err)
+		}
+		body = pl
+	case *manifestlist.DeserializedManifestList:
+		_, pl, err := m.Payload()
+		if err != nil {
+			t.Fatalf("error getting payload: %v", err)
+		}
+		body = pl
+	default:
+		var err error
+		body, err = json.MarshalIndent(v, "", "   ")
+		if err != nil {
+			t.Fatalf("unexpected error marshaling %v: %v", v, err)
+		}
 	}
 
-	if tagsResponse.Name != imageName.Name() {
-		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName.Name())
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("error creating request for %s: %v", msg, err)
 	}
 
-	if len(tagsResponse.Tags) != 1 {
-		t.Fatalf("expected some tags in response: %v", tagsResponse.Tags)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
 
-	if tagsResponse.Tags[0] != tag {
-		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error doing put request while %s: %v", msg, err)
 	}
 
-	// Attempt to put a manifest with mismatching FSLayer and History array cardinalities
+	return resp
+}
 
-	unsignedManifest.History = append(unsignedManifest.History, schema1.History{
-		V1Compatibility: "",
-	})
-	invalidSigned, err := schema1.Sign(unsignedManifest, env.pk)
+func startPushLayer(t *testing.T, env *testEnv, name reference.Named) (location string, uuid string) {
+	layerUploadURL, err := env.builder.BuildBlobUploadURL(name)
 	if err != nil {
-		t.Fatalf("error signing manifest")
+		t.Fatalf("unexpected error building layer upload url: %v", err)
 	}
 
-	resp = putManifest(t, "putting invalid signed manifest", manifestDigestURL, "", invalidSigned)
-	checkResponse(t, "putting invalid signed manifest", resp, http.StatusBadRequest)
-
-	return args
-}
-
-func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Named) manifestArgs {
-	tag := "schema2tag"
-	args := manifestArgs{
-		imageName: imageName,
-		mediaType: schema2.MediaTypeManifest,
+	u, err := url.Parse(layerUploadURL)
+	if err != nil {
+		t.Fatalf("error parsing layer upload URL: %v", err)
 	}
 
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	base, err := url.Parse(env.server.URL)
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
+		t.Fatalf("error parsing server URL: %v", err)
 	}
 
-	// -----------------------------
-	// Attempt to fetch the manifest
-	resp, err := http.Get(manifestURL)
+	layerUploadURL = base.ResolveReference(u).String()
+	resp, err := http.Post(layerUploadURL, "", nil)
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest: %v", err)
+		t.Fatalf("unexpected error starting layer push: %v", err)
 	}
+
 	defer resp.Body.Close()
 
-	checkResponse(t, "getting non-existent manifest", resp, http.StatusNotFound)
-	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, v2.ErrorCodeManifestUnknown)
+	checkResponse(t, fmt.Sprintf("pushing starting layer push %v", name.String()), resp, http.StatusAccepted)
 
-	tagsURL, err := env.builder.BuildTagsURL(imageName)
+	u, err = url.Parse(resp.Header.Get("Location"))
 	if err != nil {
-		t.Fatalf("unexpected error building tags url: %v", err)
+		t.Fatalf("error parsing location header: %v", err)
 	}
 
-	resp, err = http.Get(tagsURL)
-	if err != nil {
-		t.Fatalf("unexpected error getting unknown tags: %v", err)
-	}
-	defer resp.Body.Close()
+	uuid = path.Base(u.Path)
+	checkHeaders(t, resp, http.Header{
+		"Location":           []string{"*"},
+		"Content-Length":     []string{"0"},
+		"Docker-Upload-UUID": []string{uuid},
+	})
 
-	// Check that we get an unknown repository error when asking for tags
-	checkResponse(t, "getting unknown manifest tags", resp, http.StatusNotFound)
-	checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeNameUnknown)
+	return resp.Header.Get("Location"), uuid
+}
 
-	// --------------------------------
-	// Attempt to push manifest with missing config and missing layers
-	manifest := &schema2.Manifest{
-		Versioned: manifest.Versioned{
-			SchemaVersion: 2,
-			MediaType:     schema2.MediaTypeManifest,
-		},
-		Config: distribution.Descriptor{
-			Digest:    "sha256:1a9ec845ee94c202b2d5da74a24f0ed2058318bfa9879fa541efaecba272e86b",
-			Size:      3253,
-			MediaType: schema2.MediaTypeImageConfig,
-		},
-		Layers: []distribution.Descriptor{
-			{
-				Digest:    "sha256:463434349086340864309863409683460843608348608934092322395278926a",
-				Size:      6323,
-				MediaType: schema2.MediaTypeLayer,
-			},
-			{
-				Digest:    "sha256:630923423623623423352523525237238023652897356239852383652aaaaaaa",
-				Size:      6863,
-				MediaType: schema2.MediaTypeLayer,
-			},
-		},
+// doPushLayer pushes the layer content returning the url on success returning
+// the response. If you're only expecting a successful response, use pushLayer.
+func doPushLayer(t *testing.T, ub *v2.URLBuilder, name reference.Named, dgst digest.Digest, uploadURLBase string, body io.Reader) (*http.Response, error) {
+	u, err := url.Parse(uploadURLBase)
+	if err != nil {
+		t.Fatalf("unexpected error parsing pushLayer url: %v", err)
 	}
 
-	resp = putManifest(t, "putting missing config manifest", manifestURL, schema2.MediaTypeManifest, manifest)
-	defer resp.Body.Close()
-	checkResponse(t, "putting missing config manifest", resp, http.StatusBadRequest)
-	_, p, counts := checkBodyHasErrorCodes(t, "putting missing config manifest", resp, v2.ErrorCodeManifestBlobUnknown)
+	u.RawQuery = url.Values{
+		"_state": u.Query()["_state"],
+		"digest": []string{dgst.String()},
+	}.Encode()
 
-	expectedCounts := map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestBlobUnknown: 3,
-	}
+	uploadURL := u.String()
 
-	if !reflect.DeepEqual(counts, expectedCounts) {
-		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	// Just do a monolithic upload
+	req, err := http.NewRequest("PUT", uploadURL, body)
+	if err != nil {
+		t.Fatalf("unexpected error creating new request: %v", err)
 	}
 
-	// Push a config, and reference it in the manifest
-	sampleConfig := []byte(`{
-		"architecture": "amd64",
-		"history": [
-		  {
-		    "created": "2015-10-31T22:22:54.690851953Z",
-		    "created_by": "/bin/sh -c #(nop) ADD file:a3bc1e842b69636f9df5256c49c5374fb4eef1e281fe3f282c65fb853ee171c5 in /"
-		  },
-		  {
-		    "created": "2015-10-31T22:22:55.613815829Z",
-		    "created_by": "/bin/sh -c #(nop) CMD [\"sh\"]"
-		  }
-		],
-		"rootfs": {
-		  "diff_ids": [
-		    "sha256:c6f988f4874bb0add23a778f753c65efe992244e148a1d2ec2a8b664fb66bbd1",
-		    "sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef"
-		  ],
-		  "type": "layers"
-		}
-	}`)
-	sampleConfigDigest := digest.FromBytes(sampleConfig)
+	return http.DefaultClient.Do(req)
+}
 
-	uploadURLBase, _ := startPushLayer(t, env, imageName)
-	pushLayer(t, env.builder, imageName, sampleConfigDigest, uploadURLBase, bytes.NewReader(sampleConfig))
-	manifest.Config.Digest = sampleConfigDigest
-	manifest.Config.Size = int64(len(sampleConfig))
+// pushLayer pushes the layer content returning the url on success.
+func pushLayer(t *testing.T, ub *v2.URLBuilder, name reference.Named, dgst digest.Digest, uploadURLBase string, body io.Reader) string {
+	digester := digest.Canonical.Digester()
 
-	// The manifest should still be invalid, because its layer doesn't exist
-	resp = putManifest(t, "putting missing layer manifest", manifestURL, schema2.MediaTypeManifest, manifest)
+	resp, err := doPushLayer(t, ub, name, dgst, uploadURLBase, io.TeeReader(body, digester.Hash()))
+	if err != nil {
+		t.Fatalf("unexpected error doing push layer request: %v", err)
+	}
 	defer resp.Body.Close()
-	checkResponse(t, "putting missing layer manifest", resp, http.StatusBadRequest)
-	_, p, counts = checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeManifestBlobUnknown)
 
-	expectedCounts = map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestBlobUnknown: 2,
-	}
+	checkResponse(t, "putting monolithic chunk", resp, http.StatusCreated)
 
-	if !reflect.DeepEqual(counts, expectedCounts) {
-		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	if err != nil {
+		t.Fatalf("error generating sha256 digest of body")
 	}
 
-	// Push 2 random layers
-	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
-
-	for i := range manifest.Layers {
-		rs, dgst, err := testutil.CreateRandomTarFile()
+	sha256Dgst := digester.Digest()
 
-		if err != nil {
-			t.Fatalf("error creating random layer %d: %v", i, err)
-		}
+	ref, _ := reference.WithDigest(name, sha256Dgst)
+	expectedLayerURL, err := ub.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building expected layer url: %v", err)
+	}
 
-		expectedLayers[dgst] = rs
-		manifest.Layers[i].Digest = dgst
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{expectedLayerURL},
+		"Content-Length":        []string{"0"},
+		"Docker-Content-Digest": []string{sha256Dgst.String()},
+	})
 
-		uploadURLBase, _ := startPushLayer(t, env, imageName)
-		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
-	}
+	return resp.Header.Get("Location")
+}
 
-	// -------------------
-	// Push the manifest with all layers pushed.
-	deserializedManifest, err := schema2.FromStruct(*manifest)
+func finishUpload(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadURLBase string, dgst digest.Digest) string {
+	resp, err := doPushLayer(t, ub, name, dgst, uploadURLBase, nil)
 	if err != nil {
-		t.Fatalf("could not create DeserializedManifest: %v", err)
+		t.Fatalf("unexpected error doing push layer request: %v", err)
 	}
-	_, canonical, err := deserializedManifest.Payload()
+	defer resp.Body.Close()
+
+	checkResponse(t, "putting monolithic chunk", resp, http.StatusCreated)
+
+	ref, _ := reference.WithDigest(name, dgst)
+	expectedLayerURL, err := ub.BuildBlobURL(ref)
 	if err != nil {
-		t.Fatalf("could not get manifest payload: %v", err)
+		t.Fatalf("error building expected layer url: %v", err)
 	}
-	dgst := digest.FromBytes(canonical)
-	args.dgst = dgst
-	args.manifest = deserializedManifest
-
-	digestRef, _ := reference.WithDigest(imageName, dgst)
-	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
-	checkErr(t, err, "building manifest url")
 
-	resp = putManifest(t, "putting manifest no error", manifestURL, schema2.MediaTypeManifest, manifest)
-	checkResponse(t, "putting manifest no error", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
-		"Location":              []string{manifestDigestURL},
+		"Location":              []string{expectedLayerURL},
+		"Content-Length":        []string{"0"},
 		"Docker-Content-Digest": []string{dgst.String()},
 	})
 
-	// --------------------
-	// Push by digest -- should get same result
-	resp = putManifest(t, "putting manifest by digest", manifestDigestURL, schema2.MediaTypeManifest, manifest)
-	checkResponse(t, "putting manifest by digest", resp, http.StatusCreated)
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{manifestDigestURL},
-		"Docker-Content-Digest": []string{dgst.String()},
-	})
+	return resp.Header.Get("Location")
+}
+
+type chunkOptions struct {
+	// Content-Range header to set when pushing chunks
+	contentRange string
+}
+
+func doPushChunk(t *testing.T, uploadURLBase string, body io.Reader, options chunkOptions) (*http.Response, error) {
+	u, err := url.Parse(uploadURLBase)
+	if err != nil {
+		t.Fatalf("unexpected error parsing pushLayer url: %v", err)
+	}
+
+	u.RawQuery = url.Values{
+		"_state": u.Query()["_state"],
+	}.Encode()
 
-	// ------------------
-	// Fetch by tag name
-	req, err := http.NewRequest("GET", manifestURL, nil)
+	uploadURL := u.String()
+
+	req, err := http.NewRequest("PATCH", uploadURL, body)
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("unexpected error creating new request: %v", err)
 	}
-	req.Header.Set("Accept", schema2.MediaTypeManifest)
-	resp, err = http.DefaultClient.Do(req)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if options.contentRange != "" {
+		req.Header.Set("Content-Range", options.contentRange)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	return resp, err
+}
+
+func pushChunk(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadURLBase string, body io.Reader, length int64) (string, digest.Digest) {
+	digester := digest.Canonical.Digester()
+
+	resp, err := doPushChunk(t, uploadURLBase, io.TeeReader(body, digester.Hash()), chunkOptions{})
 	if err != nil {
-		t.Fatalf("unexpected error fetching manifest: %v", err)
+		t.Fatalf("unexpected error doing push layer request: %v", err)
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
+	checkResponse(t, "putting chunk", resp, http.StatusAccepted)
+
+	if err != nil {
+		t.Fatalf("error generating sha256 digest of body")
+	}
+
 	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+		"Range":          []string{fmt.Sprintf("0-%d", length-1)},
+		"Content-Length": []string{"0"},
 	})
 
-	var fetchedManifest schema2.DeserializedManifest
-	dec := json.NewDecoder(resp.Body)
+	return resp.Header.Get("Location"), digester.Digest()
+}
 
-	if err := dec.Decode(&fetchedManifest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
-	}
+func checkResponse(t *testing.T, msg string, resp *http.Response, expectedStatus int) {
+	if resp.StatusCode != expectedStatus {
+		t.Logf("unexpected status %s: %v != %v", msg, resp.StatusCode, expectedStatus)
+		maybeDumpResponse(t, resp)
 
-	_, fetchedCanonical, err := fetchedManifest.Payload()
-	if err != nil {
-		t.Fatalf("error getting manifest payload: %v", err)
+		t.FailNow()
 	}
 
-	if !bytes.Equal(fetchedCanonical, canonical) {
-		t.Fatalf("manifests do not match")
+	// We expect the headers included in the configuration, unless the
+	// status code is 405 (Method Not Allowed), which means the handler
+	// doesn't even get called.
+	if resp.StatusCode != 405 && !reflect.DeepEqual(resp.Header["X-Content-Type-Options"], []string{"nosniff"}) {
+		t.Logf("missing or incorrect header X-Content-Type-Options %s", msg)
+		maybeDumpResponse(t, resp)
+
+		t.FailNow()
 	}
+}
 
-	// ---------------
-	// Fetch by digest
-	req, err = http.NewRequest("GET", manifestDigestURL, nil)
+// checkBodyHasErrorCodes ensures the body is an error body and has the
+// expected error codes, returning the error structure, the json slice and a
+// count of the errors by code.
+func checkBodyHasErrorCodes(t *testing.T, msg string, resp *http.Response, errorCodes ...errcode.ErrorCode) (errcode.Errors, []byte, map[errcode.ErrorCode]int) {
+	p, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("unexpected error reading body %s: %v", msg, err)
 	}
-	req.Header.Set("Accept", schema2.MediaTypeManifest)
-	resp, err = http.DefaultClient.Do(req)
-	checkErr(t, err, "fetching manifest by digest")
-	defer resp.Body.Close()
 
-	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
-	})
+	var errs errcode.Errors
+	if err := json.Unmarshal(p, &errs); err != nil {
+		t.Fatalf("unexpected error decoding error response: %v", err)
+	}
 
-	var fetchedManifestByDigest schema2.DeserializedManifest
-	dec = json.NewDecoder(resp.Body)
-	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
+	if len(errs) == 0 {
+		t.Fatalf("expected errors in response")
 	}
 
-	_, fetchedCanonical, err = fetchedManifest.Payload()
-	if err != nil {
-		t.Fatalf("error getting manifest payload: %v", err)
+	// TODO(stevvooe): Shoot. The error setup is not working out. The content-
+	// type headers are being set after writing the status code.
+	// if resp.Header.Get("Content-Type") != "application/json" {
+	// 	t.Fatalf("unexpected content type: %v != 'application/json'",
+	// 		resp.Header.Get("Content-Type"))
+	// }
+
+	expected := map[errcode.ErrorCode]struct{}{}
+	counts := map[errcode.ErrorCode]int{}
+
+	// Initialize map with zeros for expected
+	for _, code := range errorCodes {
+		expected[code] = struct{}{}
+		counts[code] = 0
 	}
 
-	if !bytes.Equal(fetchedCanonical, canonical) {
-		t.Fatalf("manifests do not match")
+	for _, e := range errs {
+		err, ok := e.(errcode.ErrorCoder)
+		if !ok {
+			t.Fatalf("not an ErrorCoder: %#v", e)
+		}
+		if _, ok := expected[err.ErrorCode()]; !ok {
+			t.Fatalf("unexpected error code %v encountered during %s: %s ", err.ErrorCode(), msg, string(p))
+		}
+		counts[err.ErrorCode()]++
 	}
 
-	// Get by name with etag, gives 304
-	etag := resp.Header.Get("Etag")
-	req, err = http.NewRequest("GET", manifestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+	// Ensure that counts of expected errors were all non-zero
+	for code := range expected {
+		if counts[code] == 0 {
+			t.Fatalf("expected error code %v not encountered during %s: %s", code, msg, string(p))
+		}
 	}
-	req.Header.Set("If-None-Match", etag)
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+
+	return errs, p, counts
+}
+
+func maybeDumpResponse(t *testing.T, resp *http.Response) {
+	if d, err := httputil.DumpResponse(resp, true); err != nil {
+		t.Logf("error dumping response: %v", err)
+	} else {
+		t.Logf("response:\n%s", string(d))
 	}
+}
 
-	checkResponse(t, "fetching manifest by name with etag", resp, http.StatusNotModified)
+// matchHeaders checks that the response has at least the headers. If not, the
+// test will fail. If a passed in header value is "*", any non-zero value will
+// suffice as a match.
+func checkHeaders(t *testing.T, resp *http.Response, headers http.Header) {
+	for k, vs := range headers {
+		if resp.Header.Get(k) == "" {
+			t.Fatalf("response missing header %q", k)
+		}
 
-	// Get by digest with etag, gives 304
-	req, err = http.NewRequest("GET", manifestDigestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		for _, v := range vs {
+			if v == "*" {
+				// Just ensure there is some value.
+				if len(resp.Header[http.CanonicalHeaderKey(k)]) > 0 {
+					continue
+				}
+			}
+
+			for _, hv := range resp.Header[http.CanonicalHeaderKey(k)] {
+				if hv != v {
+					t.Fatalf("%+v %v header value not matched in response: %q != %q", resp.Header, k, hv, v)
+				}
+			}
+		}
 	}
-	req.Header.Set("If-None-Match", etag)
-	resp, err = http.DefaultClient.Do(req)
+}
+
+func checkErr(t *testing.T, err error, msg string) {
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("unexpected error %s: %v", msg, err)
 	}
+}
 
-	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
-
-	// Ensure that the tag is listed.
-	resp, err = http.Get(tagsURL)
+func createRepository(env *testEnv, t *testing.T, imageName string, tag string) digest.Digest {
+	imageNameRef, err := reference.WithName(imageName)
 	if err != nil {
-		t.Fatalf("unexpected error getting unknown tags: %v", err)
+		t.Fatalf("unable to parse reference: %v", err)
 	}
-	defer resp.Body.Close()
 
-	checkResponse(t, "getting unknown manifest tags", resp, http.StatusOK)
-	dec = json.NewDecoder(resp.Body)
+	unsignedManifest := &schema1.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 1,
+		},
+		Name: imageName,
+		Tag:  tag,
+		FSLayers: []schema1.FSLayer{
+			{
+				BlobSum: "asdf",
+			},
+		},
+		History: []schema1.History{
+			{
+				V1Compatibility: "",
+			},
+		},
+	}
 
-	var tagsResponse tagsAPIResponse
+	// Push 2 random layers
+	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
 
-	if err := dec.Decode(&tagsResponse); err != nil {
-		t.Fatalf("unexpected error decoding error response: %v", err)
+	for i := range unsignedManifest.FSLayers {
+		rs, dgst, err := testutil.CreateRandomTarFile()
+		if err != nil {
+			t.Fatalf("error creating random layer %d: %v", i, err)
+		}
+
+		expectedLayers[dgst] = rs
+		unsignedManifest.FSLayers[i].BlobSum = dgst
+		uploadURLBase, _ := startPushLayer(t, env, imageNameRef)
+		pushLayer(t, env.builder, imageNameRef, dgst, uploadURLBase, rs)
 	}
 
-	if tagsResponse.Name != imageName.Name() {
-		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName)
+	signedManifest, err := schema1.Sign(unsignedManifest, env.pk)
+	if err != nil {
+		t.Fatalf("unexpected error signing manifest: %v", err)
 	}
 
-	if len(tagsResponse.Tags) != 1 {
-		t.Fatalf("expected some tags in response: %v", tagsResponse.Tags)
+	dgst := digest.FromBytes(signedManifest.Canonical)
+
+	// Create this repository by tag to ensure the tag mapping is made in the registry
+	tagRef, _ := reference.WithTag(imageNameRef, tag)
+	manifestDigestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	digestRef, _ := reference.WithDigest(imageNameRef, dgst)
+	location, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building location URL")
+
+	resp := putManifest(t, "putting signed manifest", manifestDigestURL, "", signedManifest)
+	checkResponse(t, "putting signed manifest", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{location},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+	return dgst
+}
+
+// testImage describes an image manifest pushed by pushSchema2Image.
+type testImage struct {
+	descriptor distribution.Descriptor
+	layersSize int64
+}
+
+// pushSchema2Image pushes a schema2 image made of a config and the given
+// number of random layers, referenced by digest only.
+func pushSchema2Image(t *testing.T, env *testEnv, imageName reference.Named, numLayers int) testImage {
+	config := []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","layers":%d}`, numLayers))
+	configDigest := digest.FromBytes(config)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(config))
+
+	m := schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config: distribution.Descriptor{
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+			MediaType: schema2.MediaTypeImageConfig,
+		},
 	}
 
-	if tagsResponse.Tags[0] != tag {
-		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
-	}
+	var layersSize int64
+	for i := 0; i < numLayers; i++ {
+		rs, dgst, err := testutil.CreateRandomTarFile()
+		if err != nil {
+			t.Fatalf("error creating random layer %d: %v", i, err)
+		}
+		size, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			t.Fatalf("error getting size of layer %d: %v", i, err)
+		}
+		rs.Seek(0, io.SeekStart)
 
-	// ------------------
-	// Fetch as a schema1 manifest
-	resp, err = http.Get(manifestURL)
-	if err != nil {
-		t.Fatalf("unexpected error fetching manifest as schema1: %v", err)
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
+
+		m.Layers = append(m.Layers, distribution.Descriptor{
+			Digest:    dgst,
+			Size:      size,
+			MediaType: schema2.MediaTypeLayer,
+		})
+		layersSize += size
 	}
-	defer resp.Body.Close()
 
-	manifestBytes, err := ioutil.ReadAll(resp.Body)
+	deserializedManifest, err := schema2.FromStruct(m)
 	if err != nil {
-		t.Fatalf("error reading response body: %v", err)
+		t.Fatalf("could not create DeserializedManifest: %v", err)
 	}
-
-	checkResponse(t, "fetching uploaded manifest as schema1", resp, http.StatusOK)
-
-	m, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeManifest, manifestBytes)
+	_, canonical, err := deserializedManifest.Payload()
 	if err != nil {
-		t.Fatalf("unexpected error unmarshalling manifest: %v", err)
+		t.Fatalf("could not get manifest payload: %v", err)
 	}
+	dgst := digest.FromBytes(canonical)
 
-	fetchedSchema1Manifest, ok := m.(*schema1.SignedManifest)
-	if !ok {
-		t.Fatalf("expecting schema1 manifest")
-	}
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
 
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{desc.Digest.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, desc.Digest)},
-	})
+	resp := putManifest(t, "putting schema2 manifest", manifestDigestURL, schema2.MediaTypeManifest, deserializedManifest)
+	checkResponse(t, "putting schema2 manifest", resp, http.StatusCreated)
 
-	if fetchedSchema1Manifest.Manifest.SchemaVersion != 1 {
-		t.Fatal("wrong schema version")
-	}
-	if fetchedSchema1Manifest.Architecture != "amd64" {
-		t.Fatal("wrong architecture")
-	}
-	if fetchedSchema1Manifest.Name != imageName.Name() {
-		t.Fatal("wrong image name")
-	}
-	if fetchedSchema1Manifest.Tag != tag {
-		t.Fatal("wrong tag")
-	}
-	if len(fetchedSchema1Manifest.FSLayers) != 2 {
-		t.Fatal("wrong number of FSLayers")
-	}
-	for i := range manifest.Layers {
-		if fetchedSchema1Manifest.FSLayers[i].BlobSum != manifest.Layers[len(manifest.Layers)-i-1].Digest {
-			t.Fatalf("blob digest mismatch in schema1 manifest for layer %d", i)
-		}
-	}
-	if len(fetchedSchema1Manifest.History) != 2 {
-		t.Fatal("wrong number of History entries")
+	return testImage{
+		descriptor: distribution.Descriptor{
+			Digest:    dgst,
+			Size:      int64(len(canonical)),
+			MediaType: schema2.MediaTypeManifest,
+		},
+		layersSize: layersSize,
 	}
-
-	// Don't check V1Compatibility fields because we're using randomly-generated
-	// layers.
-
-	return args
 }
 
-func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs) {
-	imageName := args.imageName
-	tag := "manifestlisttag"
+// TestOCIManifestZstdLayers pushes an OCI manifest with zstd compressed
+// layers and checks that the manifest and layers are pulled back unchanged.
+func TestOCIManifestZstdLayers(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestURL, err := env.builder.BuildManifestURL(tagRef)
-	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
-	}
+	imageName, _ := reference.WithName("foo/zstd")
 
-	// --------------------------------
-	// Attempt to push manifest list that refers to an unknown manifest
-	manifestList := &manifestlist.ManifestList{
-		Versioned: manifest.Versioned{
-			SchemaVersion: 2,
-			MediaType:     manifestlist.MediaTypeManifestList,
-		},
-		Manifests: []manifestlist.ManifestDescriptor{
-			{
-				Descriptor: distribution.Descriptor{
-					Digest:    "sha256:1a9ec845ee94c202b2d5da74a24f0ed2058318bfa9879fa541efaecba272e86b",
-					Size:      3253,
-					MediaType: schema2.MediaTypeManifest,
-				},
-				Platform: manifestlist.PlatformSpec{
-					Architecture: "amd64",
-					OS:           "linux",
-				},
-			},
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	configDigest := digest.FromBytes(config)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(config))
+
+	m := ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config: distribution.Descriptor{
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+			MediaType: v1.MediaTypeImageConfig,
 		},
 	}
 
-	resp := putManifest(t, "putting missing manifest manifestlist", manifestURL, manifestlist.MediaTypeManifestList, manifestList)
-	defer resp.Body.Close()
-	checkResponse(t, "putting missing manifest manifestlist", resp, http.StatusBadRequest)
-	_, p, counts := checkBodyHasErrorCodes(t, "putting missing manifest manifestlist", resp, v2.ErrorCodeManifestBlobUnknown)
+	layers := make(map[digest.Digest][]byte)
+	for i := 0; i < 2; i++ {
+		// Layers are opaque to the registry, so a zstd frame magic number
+		// followed by random bytes stands for a zstd compressed tar.
+		rs, _, err := testutil.CreateRandomTarFile()
+		if err != nil {
+			t.Fatalf("error creating random layer %d: %v", i, err)
+		}
+		random, err := ioutil.ReadAll(rs)
+		if err != nil {
+			t.Fatalf("error reading random layer %d: %v", i, err)
+		}
+		layer := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, random...)
+		dgst := digest.FromBytes(layer)
+		layers[dgst] = layer
 
-	expectedCounts := map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestBlobUnknown: 1,
-	}
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, bytes.NewReader(layer))
 
-	if !reflect.DeepEqual(counts, expectedCounts) {
-		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+		m.Layers = append(m.Layers, distribution.Descriptor{
+			Digest:    dgst,
+			Size:      int64(len(layer)),
+			MediaType: ocischema.MediaTypeImageLayerZstd,
+		})
 	}
 
-	// -------------------
-	// Push a manifest list that references an actual manifest
-	manifestList.Manifests[0].Digest = args.dgst
-	deserializedManifestList, err := manifestlist.FromDescriptors(manifestList.Manifests)
+	deserializedManifest, err := ocischema.FromStruct(m)
 	if err != nil {
-		t.Fatalf("could not create DeserializedManifestList: %v", err)
+		t.Fatalf("could not create DeserializedManifest: %v", err)
 	}
-	_, canonical, err := deserializedManifestList.Payload()
+	_, canonical, err := deserializedManifest.Payload()
 	if err != nil {
-		t.Fatalf("could not get manifest list payload: %v", err)
+		t.Fatalf("could not get manifest payload: %v", err)
 	}
-	dgst := digest.FromBytes(canonical)
 
-	digestRef, _ := reference.WithDigest(imageName, dgst)
-	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
 	checkErr(t, err, "building manifest url")
 
-	resp = putManifest(t, "putting manifest list no error", manifestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
-	checkResponse(t, "putting manifest list no error", resp, http.StatusCreated)
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{manifestDigestURL},
-		"Docker-Content-Digest": []string{dgst.String()},
-	})
-
-	// --------------------
-	// Push by digest -- should get same result
-	resp = putManifest(t, "putting manifest list by digest", manifestDigestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
-	checkResponse(t, "putting manifest list by digest", resp, http.StatusCreated)
+	resp := putManifest(t, "putting oci manifest", manifestURL, v1.MediaTypeImageManifest, deserializedManifest)
+	checkResponse(t, "putting oci manifest", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
-		"Location":              []string{manifestDigestURL},
-		"Docker-Content-Digest": []string{dgst.String()},
+		"Docker-Content-Digest": []string{digest.FromBytes(canonical).String()},
 	})
 
-	// ------------------
-	// Fetch by tag name
 	req, err := http.NewRequest("GET", manifestURL, nil)
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("error constructing request: %v", err)
 	}
-	// multiple headers in mixed list format to ensure we parse correctly server-side
-	req.Header.Set("Accept", fmt.Sprintf(` %s ; q=0.8 , %s ; q=0.5 `, manifestlist.MediaTypeManifestList, schema1.MediaTypeSignedManifest))
-	req.Header.Add("Accept", schema2.MediaTypeManifest)
+	req.Header.Set("Accept", v1.MediaTypeImageManifest)
 	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("unexpected error fetching manifest list: %v", err)
+		t.Fatalf("unexpected error fetching manifest: %v", err)
 	}
 	defer resp.Body.Close()
-
-	checkResponse(t, "fetching uploaded manifest list", resp, http.StatusOK)
+	checkResponse(t, "fetching oci manifest", resp, http.StatusOK)
 	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+		"Content-Type": []string{v1.MediaTypeImageManifest},
 	})
 
-	var fetchedManifestList manifestlist.DeserializedManifestList
-	dec := json.NewDecoder(resp.Body)
-
-	if err := dec.Decode(&fetchedManifestList); err != nil {
-		t.Fatalf("error decoding fetched manifest list: %v", err)
-	}
-
-	_, fetchedCanonical, err := fetchedManifestList.Payload()
+	fetched, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		t.Fatalf("error getting manifest list payload: %v", err)
+		t.Fatalf("error reading manifest: %v", err)
 	}
-
-	if !bytes.Equal(fetchedCanonical, canonical) {
-		t.Fatalf("manifest lists do not match")
+	if !bytes.Equal(fetched, canonical) {
+		t.Fatalf("fetched manifest does not match pushed manifest")
 	}
 
-	// ---------------
-	// Fetch by digest
-	req, err = http.NewRequest("GET", manifestDigestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
-	}
-	req.Header.Set("Accept", manifestlist.MediaTypeManifestList)
-	resp, err = http.DefaultClient.Do(req)
-	checkErr(t, err, "fetching manifest list by digest")
-	defer resp.Body.Close()
+	for dgst, layer := range layers {
+		ref, _ := reference.WithDigest(imageName, dgst)
+		layerURL, err := env.builder.BuildBlobURL(ref)
+		if err != nil {
+			t.Fatalf("error building layer url: %v", err)
+		}
 
-	checkResponse(t, "fetching uploaded manifest list", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
-	})
+		resp, err := http.Get(layerURL)
+		if err != nil {
+			t.Fatalf("unexpected error fetching layer: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, "fetching zstd layer", resp, http.StatusOK)
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+			t.Fatalf("unexpected Content-Encoding on zstd layer: %q", encoding)
+		}
 
-	var fetchedManifestListByDigest manifestlist.DeserializedManifestList
-	dec = json.NewDecoder(resp.Body)
-	if err := dec.Decode(&fetchedManifestListByDigest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
+		fetched, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("error reading layer: %v", err)
+		}
+		if !bytes.Equal(fetched, layer) {
+			t.Fatalf("fetched layer %s does not match pushed layer", dgst)
+		}
 	}
+}
 
-	_, fetchedCanonical, err = fetchedManifestListByDigest.Payload()
-	if err != nil {
-		t.Fatalf("error getting manifest list payload: %v", err)
-	}
+// TestOCIArtifactEmptyConfig pushes an artifact manifest referencing the
+// empty JSON config without pushing the config blob, and pulls it back.
+func TestOCIArtifactEmptyConfig(t *testing.T) {
+	const signatureMediaType = "application/vnd.example.signature.v1+json"
 
-	if !bytes.Equal(fetchedCanonical, canonical) {
-		t.Fatalf("manifests do not match")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
+	config.HTTP.Headers = headerConfig
+	config.Validation.Manifests.AllowedLayerMediaTypes = []string{signatureMediaType}
 
-	// Get by name with etag, gives 304
-	etag := resp.Header.Get("Etag")
-	req, err = http.NewRequest("GET", manifestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
-	}
-	req.Header.Set("If-None-Match", etag)
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
-	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	checkResponse(t, "fetching manifest by name with etag", resp, http.StatusNotModified)
+	imageName, _ := reference.WithName("foo/artifact")
 
-	// Get by digest with etag, gives 304
-	req, err = http.NewRequest("GET", manifestDigestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
-	}
-	req.Header.Set("If-None-Match", etag)
-	resp, err = http.DefaultClient.Do(req)
+	signature := []byte(`{"critical":{"type":"example signature"}}`)
+	signatureDigest := digest.FromBytes(signature)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, signatureDigest, uploadURLBase, bytes.NewReader(signature))
+
+	deserializedManifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config:    ocischema.DescriptorEmptyJSON,
+		Layers: []distribution.Descriptor{{
+			Digest:    signatureDigest,
+			Size:      int64(len(signature)),
+			MediaType: signatureMediaType,
+		}},
+	})
 	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+		t.Fatalf("could not create DeserializedManifest: %v", err)
 	}
 
-	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
+	tagRef, _ := reference.WithTag(imageName, "signature")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
 
-	// ------------------
-	// Fetch as a schema1 manifest
-	resp, err = http.Get(manifestURL)
+	resp := putManifest(t, "putting artifact manifest", manifestURL, v1.MediaTypeImageManifest, deserializedManifest)
+	checkResponse(t, "putting artifact manifest", resp, http.StatusCreated)
+
+	ref, _ := reference.WithDigest(imageName, ocischema.DescriptorEmptyJSON.Digest)
+	configURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building config url")
+
+	resp, err = http.Get(configURL)
 	if err != nil {
-		t.Fatalf("unexpected error fetching manifest list as schema1: %v", err)
+		t.Fatalf("unexpected error fetching config: %v", err)
 	}
 	defer resp.Body.Close()
+	checkResponse(t, "fetching empty config", resp, http.StatusOK)
 
-	manifestBytes, err := ioutil.ReadAll(resp.Body)
+	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		t.Fatalf("error reading response body: %v", err)
+		t.Fatalf("error reading config: %v", err)
 	}
+	if !bytes.Equal(content, ocischema.EmptyJSON) {
+		t.Fatalf("unexpected empty config content: %q", content)
+	}
+}
+
+// TestLayerMediaTypesOptIn pushes a manifest with a layer of a custom media
+// type, which is accepted unless the allowed layer media types are configured.
+func TestLayerMediaTypesOptIn(t *testing.T) {
+	const customMediaType = "application/vnd.example.layer.v1"
+
+	for _, c := range []struct {
+		allowed        []string
+		expectedStatus int
+	}{
+		{nil, http.StatusCreated},
+		{[]string{schema2.MediaTypeLayer}, http.StatusBadRequest},
+	} {
+		func() {
+			config := configuration.Configuration{
+				Storage: configuration.Storage{
+					"testdriver": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					}},
+				},
+			}
+			config.HTTP.Headers = headerConfig
+			config.Validation.Manifests.AllowedLayerMediaTypes = c.allowed
+
+			env := newTestEnvWithConfig(t, &config)
+			defer env.Shutdown()
+
+			imageName, _ := reference.WithName("foo/custom")
+
+			imageConfig := []byte(`{"architecture":"amd64","os":"linux"}`)
+			configDigest := digest.FromBytes(imageConfig)
+			uploadURLBase, _ := startPushLayer(t, env, imageName)
+			pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(imageConfig))
+
+			layer := []byte("custom layer")
+			layerDigest := digest.FromBytes(layer)
+			uploadURLBase, _ = startPushLayer(t, env, imageName)
+			pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, bytes.NewReader(layer))
+
+			deserializedManifest, err := schema2.FromStruct(schema2.Manifest{
+				Versioned: schema2.SchemaVersion,
+				Config: distribution.Descriptor{
+					Digest:    configDigest,
+					Size:      int64(len(imageConfig)),
+					MediaType: schema2.MediaTypeImageConfig,
+				},
+				Layers: []distribution.Descriptor{{
+					Digest:    layerDigest,
+					Size:      int64(len(layer)),
+					MediaType: customMediaType,
+				}},
+			})
+			if err != nil {
+				t.Fatalf("could not create DeserializedManifest: %v", err)
+			}
 
-	checkResponse(t, "fetching uploaded manifest list as schema1", resp, http.StatusOK)
+			tagRef, _ := reference.WithTag(imageName, "latest")
+			manifestURL, err := env.builder.BuildManifestURL(tagRef)
+			checkErr(t, err, "building manifest url")
 
-	m, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeManifest, manifestBytes)
-	if err != nil {
-		t.Fatalf("unexpected error unmarshalling manifest: %v", err)
+			resp := putManifest(t, "putting manifest", manifestURL, schema2.MediaTypeManifest, deserializedManifest)
+			defer resp.Body.Close()
+			checkResponse(t, fmt.Sprintf("putting manifest with allowed layer media types %v", c.allowed), resp, c.expectedStatus)
+			if c.expectedStatus == http.StatusBadRequest {
+				checkBodyHasErrorCodes(t, "putting manifest", resp, v2.ErrorCodeManifestInvalid)
+			}
+		}()
 	}
+}
 
-	fetchedSchema1Manifest, ok := m.(*schema1.SignedManifest)
-	if !ok {
-		t.Fatalf("expecting schema1 manifest")
-	}
+// searchAnnotated searches the manifests of imageName whose annotation key
+// has value, returning their digests.
+func searchAnnotated(t *testing.T, env *testEnv, imageName reference.Named, key, value string) []digest.Digest {
+	t.Helper()
+	searchURL, err := env.builder.BuildAnnotationsURL(imageName, url.Values{"key": []string{key}, "value": []string{value}})
+	checkErr(t, err, "building annotations url")
 
+	resp, err := http.Get(searchURL)
+	checkErr(t, err, "searching manifests")
+	defer resp.Body.Close()
+	checkResponse(t, "searching manifests", resp, http.StatusOK)
 	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{desc.Digest.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, desc.Digest)},
+		"Content-Type": []string{v1.MediaTypeImageIndex},
 	})
 
-	if fetchedSchema1Manifest.Manifest.SchemaVersion != 1 {
-		t.Fatal("wrong schema version")
+	var index referrersAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		t.Fatalf("error decoding search results: %v", err)
 	}
-	if fetchedSchema1Manifest.Architecture != "amd64" {
-		t.Fatal("wrong architecture")
-	}
-	if fetchedSchema1Manifest.Name != imageName.Name() {
-		t.Fatal("wrong image name")
-	}
-	if fetchedSchema1Manifest.Tag != tag {
-		t.Fatal("wrong tag")
-	}
-	if len(fetchedSchema1Manifest.FSLayers) != 2 {
-		t.Fatal("wrong number of FSLayers")
-	}
-	layers := args.manifest.(*schema2.DeserializedManifest).Layers
-	for i := range layers {
-		if fetchedSchema1Manifest.FSLayers[i].BlobSum != layers[len(layers)-i-1].Digest {
-			t.Fatalf("blob digest mismatch in schema1 manifest for layer %d", i)
+	var digests []digest.Digest
+	for _, m := range index.Manifests {
+		if m.Annotations[key] != value {
+			t.Fatalf("unexpected annotations of %s=%s result %s: %v", key, value, m.Digest, m.Annotations)
 		}
+		digests = append(digests, m.Digest)
 	}
-	if len(fetchedSchema1Manifest.History) != 2 {
-		t.Fatal("wrong number of History entries")
-	}
-
-	// Don't check V1Compatibility fields because we're using randomly-generated
-	// layers.
+	return digests
 }
 
-func testManifestDelete(t *testing.T, env *testEnv, args manifestArgs) {
-	imageName := args.imageName
-	dgst := args.dgst
-	manifest := args.manifest
+// TestAnnotationSearch checks that manifests are indexed by their configured
+// annotations on push, can be searched by each, and are removed from the
+// index once deleted.
+func TestAnnotationSearch(t *testing.T) {
+	const (
+		createdKey = "org.opencontainers.image.created"
+		teamKey    = "com.example.team"
+	)
 
-	ref, _ := reference.WithDigest(imageName, dgst)
-	manifestDigestURL, _ := env.builder.BuildManifestURL(ref)
-	// ---------------
-	// Delete by digest
-	resp, err := httpDelete(manifestDigestURL)
-	checkErr(t, err, "deleting manifest by digest")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+			"delete": configuration.Parameters{"enabled": true},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Search.Annotations.Keys = []string{createdKey, teamKey}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	checkResponse(t, "deleting manifest", resp, http.StatusAccepted)
-	checkHeaders(t, resp, http.Header{
-		"Content-Length": []string{"0"},
-	})
+	imageName, _ := reference.WithName("foo/annotated")
+	push := func(annotations map[string]string) digest.Digest {
+		deserializedManifest, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned:    ocischema.SchemaVersion,
+			ArtifactType: "application/vnd.example.sbom.v1+json",
+			Config:       ocischema.DescriptorEmptyJSON,
+			Layers:       []distribution.Descriptor{ocischema.DescriptorEmptyJSON},
+			Annotations:  annotations,
+		})
+		checkErr(t, err, "creating manifest")
+		_, payload, err := deserializedManifest.Payload()
+		checkErr(t, err, "getting payload")
+		dgst := digest.FromBytes(payload)
 
-	// ---------------
-	// Attempt to fetch deleted manifest
-	resp, err = http.Get(manifestDigestURL)
-	checkErr(t, err, "fetching deleted manifest by digest")
-	defer resp.Body.Close()
+		digestRef, _ := reference.WithDigest(imageName, dgst)
+		manifestURL, err := env.builder.BuildManifestURL(digestRef)
+		checkErr(t, err, "building manifest url")
+		resp := putManifest(t, "putting annotated manifest", manifestURL, v1.MediaTypeImageManifest, deserializedManifest)
+		checkResponse(t, "putting annotated manifest", resp, http.StatusCreated)
+		return dgst
+	}
 
-	checkResponse(t, "fetching deleted manifest", resp, http.StatusNotFound)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, ocischema.DescriptorEmptyJSON.Digest, uploadURLBase, bytes.NewReader(ocischema.EmptyJSON))
 
-	// ---------------
-	// Delete already deleted manifest by digest
-	resp, err = httpDelete(manifestDigestURL)
-	checkErr(t, err, "re-deleting manifest by digest")
+	january := push(map[string]string{createdKey: "2024-01-01T00:00:00Z", teamKey: "platform"})
+	february := push(map[string]string{createdKey: "2024-02-01T00:00:00Z", teamKey: "security"})
 
-	checkResponse(t, "re-deleting manifest", resp, http.StatusNotFound)
+	for _, c := range []struct {
+		key, value string
+		expected   []digest.Digest
+	}{
+		{createdKey, "2024-01-01T00:00:00Z", []digest.Digest{january}},
+		{createdKey, "2024-02-01T00:00:00Z", []digest.Digest{february}},
+		{createdKey, "2024-03-01T00:00:00Z", nil},
+		{teamKey, "platform", []digest.Digest{january}},
+		{teamKey, "security", []digest.Digest{february}},
+	} {
+		if found := searchAnnotated(t, env, imageName, c.key, c.value); !reflect.DeepEqual(found, c.expected) {
+			t.Fatalf("%s=%s: expected %v, got %v", c.key, c.value, c.expected, found)
+		}
+	}
 
-	// --------------------
-	// Re-upload manifest by digest
-	resp = putManifest(t, "putting manifest", manifestDigestURL, args.mediaType, manifest)
-	checkResponse(t, "putting manifest", resp, http.StatusCreated)
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{manifestDigestURL},
-		"Docker-Content-Digest": []string{dgst.String()},
-	})
+	// Keys which are not indexed cannot be searched
+	for _, values := range []url.Values{
+		{"key": []string{"com.example.other"}, "value": []string{"platform"}},
+		{"key": []string{teamKey}},
+		{"value": []string{"platform"}},
+	} {
+		searchURL, err := env.builder.BuildAnnotationsURL(imageName, values)
+		checkErr(t, err, "building annotations url")
+		resp, err := http.Get(searchURL)
+		checkErr(t, err, "searching manifests")
+		defer resp.Body.Close()
+		checkResponse(t, "searching manifests", resp, http.StatusBadRequest)
+		checkBodyHasErrorCodes(t, "searching manifests", resp, v2.ErrorCodeAnnotationInvalid)
+	}
+
+	// Deleted manifests are removed from the index
+	digestRef, _ := reference.WithDigest(imageName, january)
+	manifestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	resp, err := httpDelete(manifestURL)
+	checkErr(t, err, "deleting manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "deleting manifest", resp, http.StatusAccepted)
+	if found := searchAnnotated(t, env, imageName, teamKey, "platform"); len(found) != 0 {
+		t.Fatalf("deleted manifest found: %v", found)
+	}
+	if found := searchAnnotated(t, env, imageName, teamKey, "security"); !reflect.DeepEqual(found, []digest.Digest{february}) {
+		t.Fatalf("unexpected manifests after delete: %v", found)
+	}
 
-	// ---------------
-	// Attempt to fetch re-uploaded deleted digest
-	resp, err = http.Get(manifestDigestURL)
-	checkErr(t, err, "fetching re-uploaded manifest by digest")
+	// Searches are unsupported when no annotations are indexed
+	disabledEnv := newTestEnv(t, false)
+	defer disabledEnv.Shutdown()
+	searchURL, err := disabledEnv.builder.BuildAnnotationsURL(imageName, url.Values{"key": []string{teamKey}, "value": []string{"platform"}})
+	checkErr(t, err, "building annotations url")
+	resp, err = http.Get(searchURL)
+	checkErr(t, err, "searching manifests")
 	defer resp.Body.Close()
+	checkResponse(t, "searching manifests", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "searching manifests", resp, errcode.ErrorCodeUnsupported)
+}
 
-	checkResponse(t, "fetching re-uploaded manifest", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-	})
+// TestOCIArtifactAttestation checks that an attestation-style artifact,
+// with an artifact type, an empty config, a non-image layer and a subject,
+// can be pushed and pulled by tag and digest, and is listed among the
+// referrers of its subject.
+func TestOCIArtifactAttestation(t *testing.T) {
+	const attestationType = "application/vnd.in-toto+json"
 
-	// ---------------
-	// Attempt to delete an unknown manifest
-	unknownDigest := digest.Digest("sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
-	unknownRef, _ := reference.WithDigest(imageName, unknownDigest)
-	unknownManifestDigestURL, err := env.builder.BuildManifestURL(unknownRef)
-	checkErr(t, err, "building unknown manifest url")
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-	resp, err = httpDelete(unknownManifestDigestURL)
-	checkErr(t, err, "delting unknown manifest by digest")
-	checkResponse(t, "fetching deleted manifest", resp, http.StatusNotFound)
+	imageName, _ := reference.WithName("foo/attested")
+	image := pushSchema2Image(t, env, imageName, 1)
 
-	// --------------------
-	// Upload manifest by tag
-	tag := "atag"
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestTagURL, _ := env.builder.BuildManifestURL(tagRef)
-	resp = putManifest(t, "putting manifest by tag", manifestTagURL, args.mediaType, manifest)
-	checkResponse(t, "putting manifest by tag", resp, http.StatusCreated)
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{manifestDigestURL},
-		"Docker-Content-Digest": []string{dgst.String()},
+	statement := []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`)
+	statementDigest := digest.FromBytes(statement)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, statementDigest, uploadURLBase, bytes.NewReader(statement))
+
+	deserializedManifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: attestationType,
+		Config:       ocischema.DescriptorEmptyJSON,
+		Layers: []distribution.Descriptor{{
+			Digest:    statementDigest,
+			Size:      int64(len(statement)),
+			MediaType: attestationType,
+		}},
+		Subject:     &image.descriptor,
+		Annotations: map[string]string{"org.example.predicate": "provenance"},
 	})
-
-	tagsURL, err := env.builder.BuildTagsURL(imageName)
 	if err != nil {
-		t.Fatalf("unexpected error building tags url: %v", err)
+		t.Fatalf("could not create DeserializedManifest: %v", err)
 	}
+	_, payload, err := deserializedManifest.Payload()
+	checkErr(t, err, "getting payload")
+	attestationDigest := digest.FromBytes(payload)
 
-	// Ensure that the tag is listed.
-	resp, err = http.Get(tagsURL)
-	if err != nil {
-		t.Fatalf("unexpected error getting unknown tags: %v", err)
-	}
-	defer resp.Body.Close()
+	tagRef, _ := reference.WithTag(imageName, "attestation")
+	tagURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
 
-	dec := json.NewDecoder(resp.Body)
-	var tagsResponse tagsAPIResponse
-	if err := dec.Decode(&tagsResponse); err != nil {
-		t.Fatalf("unexpected error decoding error response: %v", err)
-	}
+	resp := putManifest(t, "putting attestation", tagURL, v1.MediaTypeImageManifest, deserializedManifest)
+	checkResponse(t, "putting attestation", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{attestationDigest.String()},
+	})
 
-	if tagsResponse.Name != imageName.Name() {
-		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName)
-	}
+	digestRef, _ := reference.WithDigest(imageName, attestationDigest)
+	digestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
 
-	if len(tagsResponse.Tags) != 1 {
-		t.Fatalf("expected some tags in response: %v", tagsResponse.Tags)
-	}
+	// Pull by tag with an OCI accept header, and by digest without one
+	for _, c := range []struct {
+		url    string
+		accept string
+	}{
+		{tagURL, v1.MediaTypeImageManifest},
+		{digestURL, ""},
+	} {
+		req, err := http.NewRequest("GET", c.url, nil)
+		checkErr(t, err, "building request")
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "fetching attestation")
+		defer resp.Body.Close()
+		checkResponse(t, "fetching attestation", resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Content-Type":          []string{v1.MediaTypeImageManifest},
+			"Docker-Content-Digest": []string{attestationDigest.String()},
+		})
 
-	if tagsResponse.Tags[0] != tag {
-		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
+		body, err := ioutil.ReadAll(resp.Body)
+		checkErr(t, err, "reading attestation")
+		if !bytes.Equal(body, payload) {
+			t.Fatalf("fetched attestation does not match pushed attestation")
+		}
 	}
 
-	// ---------------
-	// Delete by digest
-	resp, err = httpDelete(manifestDigestURL)
-	checkErr(t, err, "deleting manifest by digest")
+	// The attestation is listed among the referrers of the image
+	subjectRef, _ := reference.WithDigest(imageName, image.descriptor.Digest)
+	for _, c := range []struct {
+		artifactType string
+		expected     int
+	}{
+		{"", 1},
+		{attestationType, 1},
+		{"application/vnd.example.signature.v1+json", 0},
+	} {
+		var values []url.Values
+		if c.artifactType != "" {
+			values = append(values, url.Values{"artifactType": []string{c.artifactType}})
+		}
+		referrersURL, err := env.builder.BuildReferrersURL(subjectRef, values...)
+		checkErr(t, err, "building referrers url")
+
+		resp, err := http.Get(referrersURL)
+		checkErr(t, err, "fetching referrers")
+		defer resp.Body.Close()
+		checkResponse(t, "fetching referrers", resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Content-Type": []string{v1.MediaTypeImageIndex},
+		})
+		if c.artifactType != "" {
+			checkHeaders(t, resp, http.Header{
+				"OCI-Filters-Applied": []string{"artifactType"},
+			})
+		}
 
-	checkResponse(t, "deleting manifest with tag", resp, http.StatusAccepted)
-	checkHeaders(t, resp, http.Header{
-		"Content-Length": []string{"0"},
-	})
+		var index referrersAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			t.Fatalf("error decoding referrers: %v", err)
+		}
+		if len(index.Manifests) != c.expected {
+			t.Fatalf("artifactType %q: expected %d referrers, got %v", c.artifactType, c.expected, index.Manifests)
+		}
+		if c.expected == 0 {
+			continue
+		}
 
-	// Ensure that the tag is not listed.
-	resp, err = http.Get(tagsURL)
-	if err != nil {
-		t.Fatalf("unexpected error getting unknown tags: %v", err)
+		expected := referrerDescriptor{
+			MediaType:    v1.MediaTypeImageManifest,
+			Size:         int64(len(payload)),
+			Digest:       attestationDigest,
+			ArtifactType: attestationType,
+			Annotations:  map[string]string{"org.example.predicate": "provenance"},
+		}
+		if !reflect.DeepEqual(index.Manifests[0], expected) {
+			t.Fatalf("unexpected referrer: %+v != %+v", index.Manifests[0], expected)
+		}
 	}
-	defer resp.Body.Close()
+}
 
-	dec = json.NewDecoder(resp.Body)
-	if err := dec.Decode(&tagsResponse); err != nil {
-		t.Fatalf("unexpected error decoding error response: %v", err)
-	}
+// TestRequiredReferrers checks that an image pushed to a repository
+// requiring signatures is only served once its signature is pushed.
+func TestRequiredReferrers(t *testing.T) {
+	const signatureType = "application/vnd.example.signature.v1+json"
 
-	if tagsResponse.Name != imageName.Name() {
-		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName)
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
-
-	if len(tagsResponse.Tags) != 0 {
-		t.Fatalf("expected 0 tags in response: %v", tagsResponse.Tags)
+	config.HTTP.Headers = headerConfig
+	config.Policy.Referrers.Required = []configuration.RequiredReferrer{
+		{Repository: "signed/", ArtifactType: signatureType},
 	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-}
+	imageName, _ := reference.WithName("signed/app")
+	image := pushSchema2Image(t, env, imageName, 1)
+	digestRef, _ := reference.WithDigest(imageName, image.descriptor.Digest)
+	imageURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
 
-type testEnv struct {
-	pk      libtrust.PrivateKey
-	ctx     context.Context
-	config  configuration.Configuration
-	app     *App
-	server  *httptest.Server
-	builder *v2.URLBuilder
+	resp, err := http.Get(imageURL)
+	checkErr(t, err, "fetching unsigned image")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching unsigned image", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching unsigned image", resp, v2.ErrorCodeManifestUnknown)
+
+	signature := []byte(`{"signature":"signed"}`)
+	signatureDigest := digest.FromBytes(signature)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, signatureDigest, uploadURLBase, bytes.NewReader(signature))
+
+	deserializedManifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: signatureType,
+		Config:       ocischema.DescriptorEmptyJSON,
+		Layers: []distribution.Descriptor{{
+			Digest:    signatureDigest,
+			Size:      int64(len(signature)),
+			MediaType: signatureType,
+		}},
+		Subject: &image.descriptor,
+	})
+	checkErr(t, err, "creating signature manifest")
+	_, payload, err := deserializedManifest.Payload()
+	checkErr(t, err, "getting payload")
+	signatureRef, _ := reference.WithDigest(imageName, digest.FromBytes(payload))
+	signatureURL, err := env.builder.BuildManifestURL(signatureRef)
+	checkErr(t, err, "building manifest url")
+	resp = putManifest(t, "putting signature", signatureURL, v1.MediaTypeImageManifest, deserializedManifest)
+	checkResponse(t, "putting signature", resp, http.StatusCreated)
+
+	resp, err = http.Get(imageURL)
+	checkErr(t, err, "fetching signed image")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching signed image", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{image.descriptor.Digest.String()},
+	})
 }
 
-func newTestEnvMirror(t *testing.T, deleteEnabled bool) *testEnv {
-	upstreamEnv := newTestEnv(t, deleteEnabled)
+// TestRepositoryCreation checks that pushes to repositories which do not
+// exist are denied when repositories are not created on push, unless they
+// were created first.
+func TestRepositoryCreation(t *testing.T) {
 	config := configuration.Configuration{
 		Storage: configuration.Storage{
 			"testdriver": configuration.Parameters{},
-			"delete":     configuration.Parameters{"enabled": deleteEnabled},
 			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
 				"enabled": false,
 			}},
 		},
-		Proxy: configuration.Proxy{
-			RemoteURL: upstreamEnv.server.URL,
-		},
 	}
-	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	autoCreate := false
+	config.Policy.AutoCreateRepositories = &autoCreate
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	return newTestEnvWithConfig(t, &config)
+	imageName, _ := reference.WithName("foo/created")
+
+	uploadURL, err := env.builder.BuildBlobUploadURL(imageName)
+	checkErr(t, err, "building upload url")
+	resp, err := http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload")
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload to a repository not created", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "starting upload to a repository not created", resp, errcode.ErrorCodeDenied)
 
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp = putManifest(t, "putting manifest", manifestURL, schema2.MediaTypeManifest, &schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+	})
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest to a repository not created", resp, http.StatusForbidden)
+
+	repositoryURL, err := env.builder.BuildRepositoryURL(imageName)
+	checkErr(t, err, "building repository url")
+	for _, expected := range []int{http.StatusCreated, http.StatusOK} {
+		req, err := http.NewRequest(http.MethodPut, repositoryURL, nil)
+		checkErr(t, err, "building request")
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "creating repository")
+		resp.Body.Close()
+		checkResponse(t, "creating repository", resp, expected)
+	}
+
+	image := pushSchema2Image(t, env, imageName, 1)
+	digestRef, _ := reference.WithDigest(imageName, image.descriptor.Digest)
+	imageURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = http.Get(imageURL)
+	checkErr(t, err, "fetching image")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching image", resp, http.StatusOK)
 }
 
-func newTestEnv(t *testing.T, deleteEnabled bool) *testEnv {
+// TestInvalidReferences checks that manifest requests with names or
+// references not conforming to the reference grammar, or tags longer than
+// configured, are rejected with the error telling which.
+func TestInvalidReferences(t *testing.T) {
 	config := configuration.Configuration{
 		Storage: configuration.Storage{
 			"testdriver": configuration.Parameters{},
-			"delete":     configuration.Parameters{"enabled": deleteEnabled},
 			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
 				"enabled": false,
 			}},
 		},
 	}
-
-	config.Compatibility.Schema1.Enabled = true
 	config.HTTP.Headers = headerConfig
+	config.Validation.Tags.MaxLength = 20
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	return newTestEnvWithConfig(t, &config)
-}
-
-func newTestEnvWithConfig(t *testing.T, config *configuration.Configuration) *testEnv {
-	ctx := context.Background()
-
-	app := NewApp(ctx, config)
-	server := httptest.NewServer(handlers.CombinedLoggingHandler(os.Stderr, app))
-	builder, err := v2.NewURLBuilderFromString(server.URL+config.HTTP.Prefix, false)
-
-	if err != nil {
-		t.Fatalf("error creating url builder: %v", err)
-	}
+	for _, tc := range []struct {
+		path   string
+		status int
+		code   errcode.ErrorCode
+	}{
+		{"/v2/foo/bar/manifests/" + strings.Repeat("a", 1000), http.StatusBadRequest, v2.ErrorCodeTagInvalid},
+		{"/v2/foo/bar/manifests/bad!tag", http.StatusBadRequest, v2.ErrorCodeTagInvalid},
+		{"/v2/foo/bar/manifests/t\u00e4g", http.StatusBadRequest, v2.ErrorCodeTagInvalid},
+		{"/v2/foo/bar/manifests/.tag", http.StatusBadRequest, v2.ErrorCodeTagInvalid},
+		{"/v2/foo/bar/manifests/" + strings.Repeat("a", 21), http.StatusBadRequest, v2.ErrorCodeTagInvalid},
+		{"/v2/foo/bar/manifests/sha256:abc", http.StatusBadRequest, v2.ErrorCodeDigestInvalid},
+		{"/v2/foo/Bar/manifests/latest", http.StatusBadRequest, v2.ErrorCodeNameInvalid},
+		{"/v2/foo/bar/manifests/" + strings.Repeat("a", 20), http.StatusNotFound, v2.ErrorCodeManifestUnknown},
+		{"/v2/foo/bar/manifests/v1.0_rc-1", http.StatusNotFound, v2.ErrorCodeManifestUnknown},
+		{"/v2/foo/bar/manifests/" + digest.FromString("manifest").String(), http.StatusNotFound, v2.ErrorCodeManifestUnknown},
+	} {
+		u := env.server.URL + (&url.URL{Path: tc.path}).EscapedPath()
+		resp, err := http.Get(u)
+		checkErr(t, err, "fetching manifest")
+		checkResponse(t, tc.path, resp, tc.status)
+		checkBodyHasErrorCodes(t, tc.path, resp, tc.code)
+		resp.Body.Close()
+	}
+
+	// Other unknown routes are not found.
+	resp, err := http.Get(env.server.URL + "/v2/foo/bar/unknown")
+	checkErr(t, err, "fetching unknown route")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching unknown route", resp, http.StatusNotFound)
+}
 
-	pk, err := libtrust.GenerateECP256PrivateKey()
+// TestManifestPutSpillBuffer checks that manifests larger than the configured
+// memory buffer are accepted or rejected as usual, and that their temporary
+// files are removed in both cases.
+func TestManifestPutSpillBuffer(t *testing.T) {
+	bufferDir, err := ioutil.TempDir("", "manifest-buffer-")
 	if err != nil {
-		t.Fatalf("unexpected error generating private key: %v", err)
+		t.Fatalf("unexpected error creating buffer directory: %v", err)
 	}
+	defer os.RemoveAll(bufferDir)
 
-	return &testEnv{
-		pk:      pk,
-		ctx:     ctx,
-		config:  *config,
-		app:     app,
-		server:  server,
-		builder: builder,
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
-}
-
-func (t *testEnv) Shutdown() {
-	t.server.CloseClientConnections()
-	t.server.Close()
-}
+	config.HTTP.Headers = headerConfig
+	config.HTTP.ManifestBuffer.MaxMemory = 16
+	config.HTTP.ManifestBuffer.Dir = bufferDir
 
-func putManifest(t *testing.T, msg, url, contentType string, v interface{}) *http.Response {
-	var body []byte
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	switch m := v.(type) {
-	case *schema1.SignedManifest:
-		_, pl, err := m.Payload()
-		if err != nil {
-			t.Fatalf("error getting payload: %v", err)
-		}
-		body = pl
-	case *manifestlist.DeserializedManifestList:
-		_, pl, err := m.Payload()
+	checkBufferDirEmpty := func(msg string) {
+		t.Helper()
+		entries, err := ioutil.ReadDir(bufferDir)
 		if err != nil {
-			t.Fatalf("error getting payload: %v", err)
+			t.Fatalf("unexpected error reading buffer directory: %v", err)
 		}
-		body = pl
-	default:
-		var err error
-		body, err = json.MarshalIndent(v, "", "   ")
-		if err != nil {
-			t.Fatalf("unexpected error marshaling %v: %v", v, err)
+		if len(entries) != 0 {
+			t.Fatalf("%s: expected no temporary files, found %d", msg, len(entries))
 		}
 	}
 
-	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
-	if err != nil {
-		t.Fatalf("error creating request for %s: %v", msg, err)
-	}
+	imageName, _ := reference.WithName("foo/spill")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
 
-	if contentType != "" {
-		req.Header.Set("Content-Type", contentType)
+	// A manifest referencing unknown blobs fails validation.
+	invalid := &schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config: distribution.Descriptor{
+			Digest:    digest.FromString("unknown config"),
+			Size:      14,
+			MediaType: schema2.MediaTypeImageConfig,
+		},
 	}
-
-	resp, err := http.DefaultClient.Do(req)
+	deserializedManifest, err := schema2.FromStruct(*invalid)
 	if err != nil {
-		t.Fatalf("error doing put request while %s: %v", msg, err)
+		t.Fatalf("could not create DeserializedManifest: %v", err)
 	}
+	resp := putManifest(t, "putting invalid manifest", manifestURL, schema2.MediaTypeManifest, deserializedManifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting invalid manifest", resp, http.StatusBadRequest)
+	checkBufferDirEmpty("after invalid manifest")
 
-	return resp
+	pushSchema2Image(t, env, imageName, 2)
+	checkBufferDirEmpty("after valid manifest")
 }
 
-func startPushLayer(t *testing.T, env *testEnv, name reference.Named) (location string, uuid string) {
-	layerUploadURL, err := env.builder.BuildBlobUploadURL(name)
+// Test mutation operations on a registry configured as a cache.  Ensure that they return
+// appropriate errors.
+func TestRegistryAsCacheMutationAPIs(t *testing.T) {
+	deleteEnabled := true
+	env := newTestEnvMirror(t, deleteEnabled)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/bar")
+	tag := "latest"
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
 	if err != nil {
-		t.Fatalf("unexpected error building layer upload url: %v", err)
+		t.Fatalf("unexpected error building base url: %v", err)
 	}
 
-	u, err := url.Parse(layerUploadURL)
+	// Manifest upload
+	m := &schema1.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 1,
+		},
+		Name:     imageName.Name(),
+		Tag:      tag,
+		FSLayers: []schema1.FSLayer{},
+		History:  []schema1.History{},
+	}
+
+	sm, err := schema1.Sign(m, env.pk)
 	if err != nil {
-		t.Fatalf("error parsing layer upload URL: %v", err)
+		t.Fatalf("error signing manifest: %v", err)
 	}
 
-	base, err := url.Parse(env.server.URL)
+	resp := putManifest(t, "putting unsigned manifest", manifestURL, "", sm)
+	checkResponse(t, "putting signed manifest to cache", resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
+
+	// Manifest Delete
+	resp, _ = httpDelete(manifestURL)
+	checkResponse(t, "deleting signed manifest from cache", resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
+
+	// Blob upload initialization
+	layerUploadURL, err := env.builder.BuildBlobUploadURL(imageName)
 	if err != nil {
-		t.Fatalf("error parsing server URL: %v", err)
+		t.Fatalf("unexpected error building layer upload url: %v", err)
 	}
 
-	layerUploadURL = base.ResolveReference(u).String()
-	resp, err := http.Post(layerUploadURL, "", nil)
+	resp, err = http.Post(layerUploadURL, "", nil)
 	if err != nil {
 		t.Fatalf("unexpected error starting layer push: %v", err)
 	}
-
 	defer resp.Body.Close()
 
-	checkResponse(t, fmt.Sprintf("pushing starting layer push %v", name.String()), resp, http.StatusAccepted)
+	checkResponse(t, fmt.Sprintf("starting layer push to cache %v", imageName), resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
 
-	u, err = url.Parse(resp.Header.Get("Location"))
-	if err != nil {
-		t.Fatalf("error parsing location header: %v", err)
+	// Blob Delete
+	ref, _ := reference.WithDigest(imageName, digestSha256EmptyTar)
+	blobURL, _ := env.builder.BuildBlobURL(ref)
+	resp, _ = httpDelete(blobURL)
+	checkResponse(t, "deleting blob from cache", resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
+
+}
+
+func TestProxyManifestGetByTag(t *testing.T) {
+	truthConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
+	truthConfig.Compatibility.Schema1.Enabled = true
+	truthConfig.HTTP.Headers = headerConfig
 
-	uuid = path.Base(u.Path)
+	imageName, _ := reference.WithName("foo/bar")
+	tag := "latest"
+
+	truthEnv := newTestEnvWithConfig(t, &truthConfig)
+	defer truthEnv.Shutdown()
+	// create a repository in the truth registry
+	dgst := createRepository(truthEnv, t, imageName.Name(), tag)
+
+	proxyConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: truthEnv.server.URL,
+		},
+	}
+	proxyConfig.Compatibility.Schema1.Enabled = true
+	proxyConfig.HTTP.Headers = headerConfig
+
+	proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
+	defer proxyEnv.Shutdown()
+
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, err := proxyEnv.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+
+	resp, err := http.Get(manifestDigestURL)
+	checkErr(t, err, "fetching manifest from proxy by digest")
+	defer resp.Body.Close()
+
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestTagURL, err := proxyEnv.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	resp, err = http.Get(manifestTagURL)
+	checkErr(t, err, "fetching manifest from proxy by tag (error check 1)")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest from proxy by tag (response check 1)", resp, http.StatusOK)
 	checkHeaders(t, resp, http.Header{
-		"Location":           []string{"*"},
-		"Content-Length":     []string{"0"},
-		"Docker-Upload-UUID": []string{uuid},
+		"Docker-Content-Digest": []string{dgst.String()},
 	})
 
-	return resp.Header.Get("Location"), uuid
+	// Create another manifest in the remote with the same image/tag pair
+	newDigest := createRepository(truthEnv, t, imageName.Name(), tag)
+	if dgst == newDigest {
+		t.Fatalf("non-random test data")
+	}
+
+	// fetch it with the same proxy URL as before.  Ensure the updated content is at the same tag
+	resp, err = http.Get(manifestTagURL)
+	checkErr(t, err, "fetching manifest from proxy by tag (error check 2)")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest from proxy by tag (response check 2)", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{newDigest.String()},
+	})
 }
 
-// doPushLayer pushes the layer content returning the url on success returning
-// the response. If you're only expecting a successful response, use pushLayer.
-func doPushLayer(t *testing.T, ub *v2.URLBuilder, name reference.Named, dgst digest.Digest, uploadURLBase string, body io.Reader) (*http.Response, error) {
-	u, err := url.Parse(uploadURLBase)
-	if err != nil {
-		t.Fatalf("unexpected error parsing pushLayer url: %v", err)
+// TestMaxTagsPerRepository checks that pushing a new tag to a repository at
+// its limit is denied, while existing tags may still be overwritten.
+func TestMaxTagsPerRepository(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
+	config.HTTP.Headers = headerConfig
+	config.Policy.MaxTagsPerRepository = 2
 
-	u.RawQuery = url.Values{
-		"_state": u.Query()["_state"],
-		"digest": []string{dgst.String()},
-	}.Encode()
+	// A slow admission webhook lines up concurrent pushes of new tags, which
+	// then race to the limit.
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		json.NewEncoder(w).Encode(admissionResponse{Allowed: true})
+	}))
+	defer webhook.Close()
+	config.Policy.Admission.URL = webhook.URL
 
-	uploadURL := u.String()
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	// Just do a monolithic upload
-	req, err := http.NewRequest("PUT", uploadURL, body)
-	if err != nil {
-		t.Fatalf("unexpected error creating new request: %v", err)
-	}
+	imageName, _ := reference.WithName("foo/tags")
 
-	return http.DefaultClient.Do(req)
-}
+	imageConfig := []byte(`{"architecture":"amd64","os":"linux"}`)
+	layer := []byte("layer")
+	for _, content := range [][]byte{imageConfig, layer} {
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+	}
 
-// pushLayer pushes the layer content returning the url on success.
-func pushLayer(t *testing.T, ub *v2.URLBuilder, name reference.Named, dgst digest.Digest, uploadURLBase string, body io.Reader) string {
-	digester := digest.Canonical.Digester()
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config: distribution.Descriptor{
+			Digest:    digest.FromBytes(imageConfig),
+			Size:      int64(len(imageConfig)),
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+		Layers: []distribution.Descriptor{{
+			Digest:    digest.FromBytes(layer),
+			Size:      int64(len(layer)),
+			MediaType: schema2.MediaTypeLayer,
+		}},
+	})
+	checkErr(t, err, "creating manifest")
 
-	resp, err := doPushLayer(t, ub, name, dgst, uploadURLBase, io.TeeReader(body, digester.Hash()))
-	if err != nil {
-		t.Fatalf("unexpected error doing push layer request: %v", err)
+	putTag := func(tag string) *http.Response {
+		t.Helper()
+		tagRef, _ := reference.WithTag(imageName, tag)
+		manifestURL, err := env.builder.BuildManifestURL(tagRef)
+		checkErr(t, err, "building manifest url")
+		return putManifest(t, "putting manifest", manifestURL, schema2.MediaTypeManifest, m)
 	}
-	defer resp.Body.Close()
 
-	checkResponse(t, "putting monolithic chunk", resp, http.StatusCreated)
+	checkResponse(t, "pushing first tag", putTag("1"), http.StatusCreated)
+	checkResponse(t, "pushing second tag", putTag("2"), http.StatusCreated)
 
-	if err != nil {
-		t.Fatalf("error generating sha256 digest of body")
+	resp := putTag("3")
+	checkResponse(t, "pushing tag over the limit", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "pushing tag over the limit", resp, errcode.ErrorCodeDenied)
+
+	checkResponse(t, "overwriting tag at the limit", putTag("2"), http.StatusCreated)
+
+	// Concurrent pushes of new tags cannot exceed the limit.
+	imageName, _ = reference.WithName("foo/racingtags")
+	for _, content := range [][]byte{imageConfig, layer} {
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+	}
+
+	var (
+		wg      sync.WaitGroup
+		created int32
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(tag string) {
+			defer wg.Done()
+			resp := putTag(tag)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusCreated {
+				atomic.AddInt32(&created, 1)
+			}
+		}(fmt.Sprint(i))
 	}
+	wg.Wait()
+	if created != 2 {
+		t.Fatalf("%d concurrent pushes of new tags succeeded, want 2", created)
+	}
+}
 
-	sha256Dgst := digester.Digest()
+// TestRepositoryQuota checks that pushes which keep a repository under its
+// quota succeed, that blob uploads and manifest pushes which would exceed it
+// are denied, and that deleting a manifest frees its blobs.
+func TestRepositoryQuota(t *testing.T) {
+	const limit = 4096
 
-	ref, _ := reference.WithDigest(name, sha256Dgst)
-	expectedLayerURL, err := ub.BuildBlobURL(ref)
-	if err != nil {
-		t.Fatalf("error building expected layer url: %v", err)
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"delete":     configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Policy.Quota.Repositories = []configuration.RepositoryQuota{
+		{Name: "quota/", Limit: limit},
 	}
 
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{expectedLayerURL},
-		"Content-Length":        []string{"0"},
-		"Docker-Content-Digest": []string{sha256Dgst.String()},
-	})
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("quota/image")
+
+	pushBlob := func(content []byte) *http.Response {
+		t.Helper()
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		resp, err := doPushLayer(t, env.builder, imageName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("unexpected error pushing blob: %v", err)
+		}
+		return resp
+	}
+
+	pushManifest := func(layers ...[]byte) (digest.Digest, *http.Response) {
+		t.Helper()
+		config := []byte(`{"architecture":"amd64","os":"linux"}`)
+		m := schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config: distribution.Descriptor{
+				Digest:    digest.FromBytes(config),
+				Size:      int64(len(config)),
+				MediaType: schema2.MediaTypeImageConfig,
+			},
+		}
+		for _, layer := range layers {
+			m.Layers = append(m.Layers, distribution.Descriptor{
+				Digest:    digest.FromBytes(layer),
+				Size:      int64(len(layer)),
+				MediaType: schema2.MediaTypeLayer,
+			})
+		}
+		deserializedManifest, err := schema2.FromStruct(m)
+		checkErr(t, err, "creating manifest")
+		_, payload, err := deserializedManifest.Payload()
+		checkErr(t, err, "getting payload")
+		dgst := digest.FromBytes(payload)
+
+		digestRef, _ := reference.WithDigest(imageName, dgst)
+		manifestURL, err := env.builder.BuildManifestURL(digestRef)
+		checkErr(t, err, "building manifest url")
+		return dgst, putManifest(t, "putting manifest", manifestURL, schema2.MediaTypeManifest, deserializedManifest)
+	}
+
+	config1 := []byte(`{"architecture":"amd64","os":"linux"}`)
+	resp := pushBlob(config1)
+	checkResponse(t, "pushing config", resp, http.StatusCreated)
+
+	// A push which stays under the quota.
+	layer1 := bytes.Repeat([]byte("a"), 1500)
+	resp = pushBlob(layer1)
+	checkResponse(t, "pushing layer under quota", resp, http.StatusCreated)
+	dgst1, resp := pushManifest(layer1)
+	checkResponse(t, "pushing manifest under quota", resp, http.StatusCreated)
+
+	// A blob which alone would exceed the quota.
+	resp = pushBlob(bytes.Repeat([]byte("b"), limit))
+	checkResponse(t, "pushing layer over quota", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "pushing layer over quota", resp, errcode.ErrorCodeDenied)
+
+	// Blobs which each fit, but not together with the first manifest.
+	layer2 := bytes.Repeat([]byte("c"), 1500)
+	layer3 := bytes.Repeat([]byte("d"), 1500)
+	for _, layer := range [][]byte{layer2, layer3} {
+		resp = pushBlob(layer)
+		checkResponse(t, "pushing layer under quota", resp, http.StatusCreated)
+	}
+	_, resp = pushManifest(layer2, layer3)
+	checkResponse(t, "pushing manifest over quota", resp, http.StatusForbidden)
+	_, body, _ := checkBodyHasErrorCodes(t, "pushing manifest over quota", resp, errcode.ErrorCodeDenied)
+	if !strings.Contains(string(body), "quota of 4096 bytes") {
+		t.Fatalf("expected the error to describe the quota, got %s", body)
+	}
+
+	// Deleting the first manifest frees room for the second.
+	digestRef, _ := reference.WithDigest(imageName, dgst1)
+	manifestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = httpDelete(manifestURL)
+	checkErr(t, err, "deleting manifest")
+	checkResponse(t, "deleting manifest", resp, http.StatusAccepted)
 
-	return resp.Header.Get("Location")
-}
+	_, resp = pushManifest(layer2, layer3)
+	checkResponse(t, "pushing manifest after deletion", resp, http.StatusCreated)
 
-func finishUpload(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadURLBase string, dgst digest.Digest) string {
-	resp, err := doPushLayer(t, ub, name, dgst, uploadURLBase, nil)
-	if err != nil {
-		t.Fatalf("unexpected error doing push layer request: %v", err)
-	}
-	defer resp.Body.Close()
+	// Repositories without a quota are not limited.
+	freeName, _ := reference.WithName("free/image")
+	uploadURLBase, _ := startPushLayer(t, env, freeName)
+	pushLayer(t, env.builder, freeName, digest.FromBytes(bytes.Repeat([]byte("e"), 2*limit)), uploadURLBase, bytes.NewReader(bytes.Repeat([]byte("e"), 2*limit)))
+}
 
-	checkResponse(t, "putting monolithic chunk", resp, http.StatusCreated)
+// TestRepositoryQuotaRewrite checks that the quota of a repository renamed by
+// the rewrite middleware applies to, and is shared by, the pushes made by its
+// old name.
+func TestRepositoryQuotaRewrite(t *testing.T) {
+	const limit = 4096
 
-	ref, _ := reference.WithDigest(name, dgst)
-	expectedLayerURL, err := ub.BuildBlobURL(ref)
-	if err != nil {
-		t.Fatalf("error building expected layer url: %v", err)
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"registry": {{
+				Name: "rewrite",
+				Options: configuration.Parameters{"rules": []interface{}{
+					map[interface{}]interface{}{"match": "old/(.*)", "replace": "new/$1"},
+				}},
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Policy.Quota.Repositories = []configuration.RepositoryQuota{
+		{Name: "new/", Limit: limit},
 	}
 
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{expectedLayerURL},
-		"Content-Length":        []string{"0"},
-		"Docker-Content-Digest": []string{dgst.String()},
-	})
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	return resp.Header.Get("Location")
-}
+	newName, _ := reference.WithName("new/image")
+	oldName, _ := reference.WithName("old/image")
 
-type chunkOptions struct {
-	// Content-Range header to set when pushing chunks
-	contentRange string
+	pushBlob := func(name reference.Named, content []byte) *http.Response {
+		t.Helper()
+		uploadURLBase, _ := startPushLayer(t, env, name)
+		resp, err := doPushLayer(t, env.builder, name, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("unexpected error pushing blob: %v", err)
+		}
+		return resp
+	}
+
+	pushManifest := func(name reference.Named, layers ...[]byte) *http.Response {
+		t.Helper()
+		config := []byte(`{"architecture":"amd64","os":"linux"}`)
+		m := schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config: distribution.Descriptor{
+				Digest:    digest.FromBytes(config),
+				Size:      int64(len(config)),
+				MediaType: schema2.MediaTypeImageConfig,
+			},
+		}
+		for _, layer := range layers {
+			m.Layers = append(m.Layers, distribution.Descriptor{
+				Digest:    digest.FromBytes(layer),
+				Size:      int64(len(layer)),
+				MediaType: schema2.MediaTypeLayer,
+			})
+		}
+		deserializedManifest, err := schema2.FromStruct(m)
+		checkErr(t, err, "creating manifest")
+		tagRef, _ := reference.WithTag(name, fmt.Sprint(len(layers)))
+		manifestURL, err := env.builder.BuildManifestURL(tagRef)
+		checkErr(t, err, "building manifest url")
+		return putManifest(t, "putting manifest", manifestURL, schema2.MediaTypeManifest, deserializedManifest)
+	}
+
+	checkResponse(t, "pushing config", pushBlob(newName, []byte(`{"architecture":"amd64","os":"linux"}`)), http.StatusCreated)
+	layer1 := bytes.Repeat([]byte("a"), 1500)
+	checkResponse(t, "pushing layer under quota", pushBlob(newName, layer1), http.StatusCreated)
+	checkResponse(t, "pushing manifest under quota", pushManifest(newName, layer1), http.StatusCreated)
+
+	// The old name is limited by the quota of the new name.
+	resp := pushBlob(oldName, bytes.Repeat([]byte("b"), limit))
+	checkResponse(t, "pushing layer over quota by the old name", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "pushing layer over quota by the old name", resp, errcode.ErrorCodeDenied)
+
+	// The usage of the new name counts against pushes by the old name.
+	layer2 := bytes.Repeat([]byte("c"), 1500)
+	layer3 := bytes.Repeat([]byte("d"), 1500)
+	for _, layer := range [][]byte{layer2, layer3} {
+		checkResponse(t, "pushing layer under quota by the old name", pushBlob(oldName, layer), http.StatusCreated)
+	}
+	resp = pushManifest(oldName, layer2, layer3)
+	checkResponse(t, "pushing manifest over quota by the old name", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "pushing manifest over quota by the old name", resp, errcode.ErrorCodeDenied)
 }
 
-func doPushChunk(t *testing.T, uploadURLBase string, body io.Reader, options chunkOptions) (*http.Response, error) {
-	u, err := url.Parse(uploadURLBase)
-	if err != nil {
-		t.Fatalf("unexpected error parsing pushLayer url: %v", err)
-	}
+// logRecorder records the entries logged by a logger.
+type logRecorder struct {
+	mu      sync.Mutex
+	entries []*logrus.Entry
+}
 
-	u.RawQuery = url.Values{
-		"_state": u.Query()["_state"],
-	}.Encode()
+func (lr *logRecorder) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
 
-	uploadURL := u.String()
+func (lr *logRecorder) Fire(entry *logrus.Entry) error {
+	lr.mu.Lock()
+	lr.entries = append(lr.entries, entry)
+	lr.mu.Unlock()
+	return nil
+}
 
-	req, err := http.NewRequest("PATCH", uploadURL, body)
-	if err != nil {
-		t.Fatalf("unexpected error creating new request: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/octet-stream")
-	if options.contentRange != "" {
-		req.Header.Set("Content-Range", options.contentRange)
+// waitForEntry waits for the entry logged with msg for the request to uri,
+// which is logged after the response is written.
+func (lr *logRecorder) waitForEntry(t *testing.T, msg, uri string) *logrus.Entry {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lr.mu.Lock()
+		for _, entry := range lr.entries {
+			if entry.Message == msg && entry.Data["http.request.uri"] == uri {
+				lr.mu.Unlock()
+				return entry
+			}
+		}
+		lr.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
 	}
+	t.Fatalf("no %q entry logged for %s", msg, uri)
+	return nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// TestContentDigestLogged checks that the access log entries of pulls carry
+// the digest of the content served, which for a pull by tag is the digest
+// the tag resolved to.
+func TestContentDigestLogged(t *testing.T) {
+	recorder := &logRecorder{}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(recorder)
+	defaultLogger := dcontext.GetLogger(context.Background())
+	dcontext.SetDefaultLogger(logrus.NewEntry(logger))
+	defer dcontext.SetDefaultLogger(defaultLogger)
 
-	return resp, err
-}
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-func pushChunk(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadURLBase string, body io.Reader, length int64) (string, digest.Digest) {
-	digester := digest.Canonical.Digester()
+	imageName, err := reference.WithName("foo/logged")
+	checkErr(t, err, "building image name")
+	dgst := createRepository(env, t, imageName.Name(), "latest")
 
-	resp, err := doPushChunk(t, uploadURLBase, io.TeeReader(body, digester.Hash()), chunkOptions{})
-	if err != nil {
-		t.Fatalf("unexpected error doing push layer request: %v", err)
-	}
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err := http.Get(manifestURL)
+	checkErr(t, err, "fetching manifest by tag")
 	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest by tag", resp, http.StatusOK)
 
-	checkResponse(t, "putting chunk", resp, http.StatusAccepted)
-
-	if err != nil {
-		t.Fatalf("error generating sha256 digest of body")
+	u, _ := url.Parse(manifestURL)
+	entry := recorder.waitForEntry(t, "response completed", u.RequestURI())
+	if logged := entry.Data["http.response.contentdigest"]; logged != dgst.String() {
+		t.Fatalf("unexpected content digest logged for pull by tag: %v != %s", logged, dgst)
 	}
 
-	checkHeaders(t, resp, http.Header{
-		"Range":          []string{fmt.Sprintf("0-%d", length-1)},
-		"Content-Length": []string{"0"},
-	})
+	args := makeBlobArgs(t)
+	uploadURLBase, _ := startPushLayer(t, env, args.imageName)
+	pushLayer(t, env.builder, args.imageName, args.layerDigest, uploadURLBase, args.layerFile)
+	blobRef, _ := reference.WithDigest(args.imageName, args.layerDigest)
+	blobURL, err := env.builder.BuildBlobURL(blobRef)
+	checkErr(t, err, "building blob url")
+	resp, err = http.Get(blobURL)
+	checkErr(t, err, "fetching blob")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching blob", resp, http.StatusOK)
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		t.Fatalf("unexpected error reading blob: %v", err)
+	}
 
-	return resp.Header.Get("Location"), digester.Digest()
+	u, _ = url.Parse(blobURL)
+	entry = recorder.waitForEntry(t, "response completed", u.RequestURI())
+	if logged := entry.Data["http.response.contentdigest"]; logged != args.layerDigest.String() {
+		t.Fatalf("unexpected content digest logged for blob pull: %v != %s", logged, args.layerDigest)
+	}
 }
 
-func checkResponse(t *testing.T, msg string, resp *http.Response, expectedStatus int) {
-	if resp.StatusCode != expectedStatus {
-		t.Logf("unexpected status %s: %v != %v", msg, resp.StatusCode, expectedStatus)
-		maybeDumpResponse(t, resp)
+// TestResponseWrittenLogged checks that the access log entries of pulls
+// carry the number of bytes sent to the client, which is less than the size
+// of the blob when the client disconnects before reading all of it.
+func TestResponseWrittenLogged(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	defaultLogger := dcontext.GetLogger(context.Background())
+	dcontext.SetDefaultLogger(logrus.NewEntry(logger))
+	defer dcontext.SetDefaultLogger(defaultLogger)
 
-		t.FailNow()
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
+	config.HTTP.Headers = headerConfig
+	config.Log.RequestFields = []string{"request.uri", "response.status", "response.written"}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	// We expect the headers included in the configuration, unless the
-	// status code is 405 (Method Not Allowed), which means the handler
-	// doesn't even get called.
-	if resp.StatusCode != 405 && !reflect.DeepEqual(resp.Header["X-Content-Type-Options"], []string{"nosniff"}) {
-		t.Logf("missing or incorrect header X-Content-Type-Options %s", msg)
-		maybeDumpResponse(t, resp)
+	recorder := &logRecorder{}
+	logger.AddHook(recorder)
 
-		t.FailNow()
+	imageName, _ := reference.WithName("foo/billed")
+	pushBlob := func(size int) string {
+		t.Helper()
+		blob := make([]byte, size)
+		if _, err := rand.Read(blob); err != nil {
+			t.Fatalf("error generating blob: %v", err)
+		}
+		dgst := digest.FromBytes(blob)
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, bytes.NewReader(blob))
+		ref, _ := reference.WithDigest(imageName, dgst)
+		blobURL, err := env.builder.BuildBlobURL(ref)
+		checkErr(t, err, "building blob url")
+		return blobURL
+	}
+	written := func(blobURL string) int64 {
+		t.Helper()
+		u, _ := url.Parse(blobURL)
+		entry := recorder.waitForEntry(t, "response completed", u.RequestURI())
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		n, ok := entry.Data["http.response.written"].(int64)
+		if !ok {
+			t.Fatalf("no written bytes logged for %s: %v", blobURL, entry.Data)
+		}
+		return n
 	}
-}
 
-// checkBodyHasErrorCodes ensures the body is an error body and has the
-// expected error codes, returning the error structure, the json slice and a
-// count of the errors by code.
-func checkBodyHasErrorCodes(t *testing.T, msg string, resp *http.Response, errorCodes ...errcode.ErrorCode) (errcode.Errors, []byte, map[errcode.ErrorCode]int) {
-	p, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatalf("unexpected error reading body %s: %v", msg, err)
+	// A full transfer logs the size of the blob.
+	const fullSize = 100000
+	fullURL := pushBlob(fullSize)
+	resp, err := http.Get(fullURL)
+	checkErr(t, err, "fetching blob")
+	checkResponse(t, "fetching blob", resp, http.StatusOK)
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		t.Fatalf("unexpected error reading blob: %v", err)
+	}
+	resp.Body.Close()
+	if n := written(fullURL); n != fullSize {
+		t.Fatalf("unexpected written bytes logged for full transfer: %d != %d", n, fullSize)
 	}
 
-	var errs errcode.Errors
-	if err := json.Unmarshal(p, &errs); err != nil {
-		t.Fatalf("unexpected error decoding error response: %v", err)
+	// A transfer cut short logs what was sent before the client went away.
+	// The blob is larger than the socket buffers can hold.
+	const truncatedSize, read = 16 << 20, 1 << 20
+	truncatedURL := pushBlob(truncatedSize)
+	resp, err = http.Get(truncatedURL)
+	checkErr(t, err, "fetching blob")
+	checkResponse(t, "fetching blob", resp, http.StatusOK)
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, read); err != nil {
+		t.Fatalf("unexpected error reading blob: %v", err)
+	}
+	resp.Body.Close()
+	if n := written(truncatedURL); n < read || n >= truncatedSize {
+		t.Fatalf("unexpected written bytes logged for truncated transfer: %d, read %d of %d", n, read, truncatedSize)
 	}
+}
 
-	if len(errs) == 0 {
-		t.Fatalf("expected errors in response")
+// TestRequestLogFields checks that, when the request log fields are
+// selected, the entries logged for authenticated requests only carry the
+// selected fields besides the static fields, those of the error logged and
+// the subject of the request.
+func TestRequestLogFields(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	defaultLogger := dcontext.GetLogger(context.Background())
+	// The static fields are added to the base logger, as when the registry
+	// configures logging.
+	dcontext.SetDefaultLogger(logrus.NewEntry(logger).WithField("service", "registry"))
+	defer dcontext.SetDefaultLogger(defaultLogger)
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
 	}
+	config.HTTP.Headers = headerConfig
+	config.Log.Fields = map[string]interface{}{"service": "registry"}
+	config.Log.RequestFields = []string{"request.method", "request.uri", "vars.name", "response.status"}
 
-	// TODO(stevvooe): Shoot. The error setup is not working out. The content-
-	// type headers are being set after writing the status code.
-	// if resp.Header.Get("Content-Type") != "application/json" {
-	// 	t.Fatalf("unexpected content type: %v != 'application/json'",
-	// 		resp.Header.Get("Content-Type"))
-	// }
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	expected := map[errcode.ErrorCode]struct{}{}
-	counts := map[errcode.ErrorCode]int{}
+	// Recording after the app configured the logger sees the entries as
+	// they are written.
+	recorder := &logRecorder{}
+	logger.AddHook(recorder)
 
-	// Initialize map with zeros for expected
-	for _, code := range errorCodes {
-		expected[code] = struct{}{}
-		counts[code] = 0
+	get := func(u string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", u, nil)
+		checkErr(t, err, "building request")
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "getting "+u)
+		resp.Body.Close()
 	}
 
-	for _, e := range errs {
-		err, ok := e.(errcode.ErrorCoder)
-		if !ok {
-			t.Fatalf("not an ErrorCoder: %#v", e)
+	baseURL, err := env.builder.BuildBaseURL()
+	checkErr(t, err, "building base url")
+	imageName, _ := reference.WithName("foo/logged")
+	tagsURL, err := env.builder.BuildTagsURL(imageName)
+	checkErr(t, err, "building tags url")
+
+	for _, tc := range []struct {
+		url      string
+		msg      string
+		expected logrus.Fields
+	}{
+		{
+			url: baseURL,
+			msg: "response completed",
+			expected: logrus.Fields{
+				"http.request.method":  "GET",
+				"http.response.status": http.StatusOK,
+				"service":              "registry",
+				"auth.user":            "silly",
+			},
+		},
+		{
+			url: tagsURL,
+			msg: "response completed with error",
+			expected: logrus.Fields{
+				"http.request.method":  "GET",
+				"http.response.status": http.StatusNotFound,
+				"vars.name":            "foo/logged",
+				"service":              "registry",
+				"err.code":             v2.ErrorCodeNameUnknown,
+				"err.message":          v2.ErrorCodeNameUnknown.Message(),
+				"err.detail":           map[string]string{"name": "foo/logged"},
+				"auth.user":            "silly",
+			},
+		},
+	} {
+		get(tc.url)
+		u, _ := url.Parse(tc.url)
+		entry := recorder.waitForEntry(t, tc.msg, u.RequestURI())
+
+		recorder.mu.Lock()
+		fields := make(logrus.Fields, len(entry.Data))
+		for key, value := range entry.Data {
+			fields[key] = value
 		}
-		if _, ok := expected[err.ErrorCode()]; !ok {
-			t.Fatalf("unexpected error code %v encountered during %s: %s ", err.ErrorCode(), msg, string(p))
+		recorder.mu.Unlock()
+		delete(fields, "http.request.uri")
+		if !reflect.DeepEqual(fields, tc.expected) {
+			t.Errorf("unexpected fields logged for %s: %v != %v", tc.url, fields, tc.expected)
 		}
-		counts[err.ErrorCode()]++
 	}
+}
 
-	// Ensure that counts of expected errors were all non-zero
-	for code := range expected {
-		if counts[code] == 0 {
-			t.Fatalf("expected error code %v not encountered during %s: %s", code, msg, string(p))
+// TestAuthSubjectLogged checks that the access log entries of requests
+// carry the subject the access controller authorized them for, whichever the
+// access controller, and that anonymous requests are logged without one.
+func TestAuthSubjectLogged(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	defaultLogger := dcontext.GetLogger(context.Background())
+	dcontext.SetDefaultLogger(logrus.NewEntry(logger))
+	defer dcontext.SetDefaultLogger(defaultLogger)
+
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	checkErr(t, err, "hashing password")
+	if err := ioutil.WriteFile(htpasswdPath, []byte("pusher:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatalf("error writing htpasswd file: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		auth      configuration.Auth
+		authorize func(r *http.Request)
+		subject   string
+	}{
+		{
+			name:      "silly",
+			auth:      configuration.Auth{"silly": {"realm": "realm-test", "service": "service-test"}},
+			authorize: func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") },
+			subject:   "silly",
+		},
+		{
+			name:      "htpasswd",
+			auth:      configuration.Auth{"htpasswd": {"realm": "realm-test", "path": htpasswdPath}},
+			authorize: func(r *http.Request) { r.SetBasicAuth("pusher", "secret") },
+			subject:   "pusher",
+		},
+		{
+			name:      "anonymous",
+			authorize: func(r *http.Request) {},
+		},
+	} {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"testdriver": configuration.Parameters{},
+				"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				}},
+			},
+			Auth: tc.auth,
+		}
+		config.HTTP.Headers = headerConfig
+		env := newTestEnvWithConfig(t, &config)
+
+		recorder := &logRecorder{}
+		logger.AddHook(recorder)
+
+		do := func(method, u string, body []byte, status int) http.Header {
+			t.Helper()
+			req, err := http.NewRequest(method, u, bytes.NewReader(body))
+			checkErr(t, err, "building request")
+			tc.authorize(req)
+			resp, err := http.DefaultClient.Do(req)
+			checkErr(t, err, tc.name+": "+method+" "+u)
+			defer resp.Body.Close()
+			checkResponse(t, tc.name+": "+method+" "+u, resp, status)
+
+			parsed, _ := url.Parse(u)
+			entry := recorder.waitForEntry(t, "response completed", parsed.RequestURI())
+			recorder.mu.Lock()
+			defer recorder.mu.Unlock()
+			if subject, ok := entry.Data["auth.user"]; tc.subject == "" && ok {
+				t.Errorf("%s: subject logged for an anonymous %s: %v", tc.name, method, subject)
+			} else if tc.subject != "" && subject != tc.subject {
+				t.Errorf("%s: unexpected subject logged for %s: %v != %s", tc.name, method, subject, tc.subject)
+			}
+			return resp.Header
 		}
-	}
-
-	return errs, p, counts
-}
 
-func maybeDumpResponse(t *testing.T, resp *http.Response) {
-	if d, err := httputil.DumpResponse(resp, true); err != nil {
-		t.Logf("error dumping response: %v", err)
-	} else {
-		t.Logf("response:\n%s", string(d))
+		imageName, _ := reference.WithName("foo/audited")
+		blob := []byte("audited layer")
+		dgst := digest.FromBytes(blob)
+		uploadURL, err := env.builder.BuildBlobUploadURL(imageName)
+		checkErr(t, err, "building upload url")
+		ref, _ := reference.WithDigest(imageName, dgst)
+		blobURL, err := env.builder.BuildBlobURL(ref)
+		checkErr(t, err, "building blob url")
+
+		location, err := url.Parse(do(http.MethodPost, uploadURL, nil, http.StatusAccepted).Get("Location"))
+		checkErr(t, err, "parsing upload location")
+		query := location.Query()
+		query.Set("digest", dgst.String())
+		location.RawQuery = query.Encode()
+		do(http.MethodPut, location.String(), blob, http.StatusCreated)
+		do(http.MethodGet, blobURL, nil, http.StatusOK)
+
+		env.Shutdown()
 	}
 }
 
-// matchHeaders checks that the response has at least the headers. If not, the
-// test will fail. If a passed in header value is "*", any non-zero value will
-// suffice as a match.
-func checkHeaders(t *testing.T, resp *http.Response, headers http.Header) {
-	for k, vs := range headers {
-		if resp.Header.Get(k) == "" {
-			t.Fatalf("response missing header %q", k)
+// TestProxyRetryAfter checks that a pull through cache reports its upstream
+// throttling pulls to clients, passing on the delay the upstream asked for.
+func TestProxyRetryAfter(t *testing.T) {
+	var retryAfter atomic.Value
+	retryAfter.Store("120")
+	status := int32(http.StatusTooManyRequests)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		if value := retryAfter.Load().(string); value != "" {
+			w.Header().Set("Retry-After", value)
 		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer upstream.Close()
 
-		for _, v := range vs {
-			if v == "*" {
-				// Just ensure there is some value.
-				if len(resp.Header[http.CanonicalHeaderKey(k)]) > 0 {
-					continue
-				}
-			}
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstream.URL,
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-			for _, hv := range resp.Header[http.CanonicalHeaderKey(k)] {
-				if hv != v {
-					t.Fatalf("%+v %v header value not matched in response: %q != %q", resp.Header, k, hv, v)
-				}
-			}
+	imageName, _ := reference.WithName("foo/throttled")
+	blobRef, _ := reference.WithDigest(imageName, digest.FromString("throttled"))
+	blobURL, err := env.builder.BuildBlobURL(blobRef)
+	checkErr(t, err, "building blob url")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	for _, u := range []string{blobURL, manifestURL} {
+		resp, err := http.Get(u)
+		checkErr(t, err, "pulling from throttled upstream")
+		defer resp.Body.Close()
+		checkBodyHasErrorCodes(t, "pulling from throttled upstream", resp, errcode.ErrorCodeTooManyRequests)
+		checkResponse(t, "pulling from throttled upstream", resp, http.StatusTooManyRequests)
+		checkHeaders(t, resp, http.Header{
+			"Retry-After": []string{"120"},
+		})
+	}
+
+	// Without a delay from the upstream, the default one is used.
+	retryAfter.Store("")
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	resp, err := http.Get(blobURL)
+	checkErr(t, err, "pulling from unavailable upstream")
+	defer resp.Body.Close()
+	checkResponse(t, "pulling from unavailable upstream", resp, http.StatusServiceUnavailable)
+	checkHeaders(t, resp, http.Header{
+		"Retry-After": []string{fmt.Sprint(int(defaultRetryAfter.Seconds()))},
+	})
+}
+
+// TestProxyRepositories checks that a pull through cache restricted to some
+// repositories pulls them from the upstream, and answers pulls of other
+// repositories as unknown without contacting the upstream.
+func TestProxyRepositories(t *testing.T) {
+	blob := []byte("mirrored layer")
+	dgst := digest.FromBytes(blob)
+	var mu sync.Mutex
+	var requested []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/v2/":
+		case "/v2/library/allowed/blobs/" + dgst.String():
+			w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			w.Write(blob)
+		default:
+			w.WriteHeader(http.StatusNotFound)
 		}
+	}))
+	defer upstream.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL:    upstream.URL,
+			Repositories: []string{"library/allowed", "approved/.*"},
+		},
 	}
-}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-func checkErr(t *testing.T, err error, msg string) {
-	if err != nil {
-		t.Fatalf("unexpected error %s: %v", msg, err)
+	blobURL := func(name string) string {
+		t.Helper()
+		imageName, _ := reference.WithName(name)
+		ref, _ := reference.WithDigest(imageName, dgst)
+		u, err := env.builder.BuildBlobURL(ref)
+		checkErr(t, err, "building blob url")
+		return u
 	}
-}
 
-func createRepository(env *testEnv, t *testing.T, imageName string, tag string) digest.Digest {
-	imageNameRef, err := reference.WithName(imageName)
-	if err != nil {
-		t.Fatalf("unable to parse reference: %v", err)
+	resp, err := http.Get(blobURL("library/allowed"))
+	checkErr(t, err, "pulling allowed repository")
+	defer resp.Body.Close()
+	checkResponse(t, "pulling allowed repository", resp, http.StatusOK)
+	if body, err := ioutil.ReadAll(resp.Body); err != nil || !bytes.Equal(body, blob) {
+		t.Fatalf("unexpected blob pulled from allowed repository: %q, %v", body, err)
+	}
+
+	mu.Lock()
+	requested = nil
+	mu.Unlock()
+	for _, name := range []string{"library/other", "library/allowed/nested", "unapproved/app"} {
+		resp, err := http.Get(blobURL(name))
+		checkErr(t, err, "pulling "+name)
+		defer resp.Body.Close()
+		checkResponse(t, "pulling "+name, resp, http.StatusNotFound)
+		checkBodyHasErrorCodes(t, "pulling "+name, resp, v2.ErrorCodeNameUnknown)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requested) != 0 {
+		t.Fatalf("upstream contacted for repositories not pulled through the cache: %v", requested)
 	}
+}
 
-	unsignedManifest := &schema1.Manifest{
-		Versioned: manifest.Versioned{
-			SchemaVersion: 1,
-		},
-		Name: imageName,
-		Tag:  tag,
-		FSLayers: []schema1.FSLayer{
-			{
-				BlobSum: "asdf",
-			},
+// TestEventSourceMetadata checks that the static metadata configured for
+// events is sent with the source of both push and pull events.
+func TestEventSourceMetadata(t *testing.T) {
+	received := make(chan notifications.Event, 16)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var envelope struct {
+			Events []notifications.Event `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, event := range envelope.Events {
+			received <- event
+		}
+	}))
+	defer endpoint.Close()
+
+	metadata := map[string]string{"datacenter": "eu-west", "cluster": "blue"}
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
 		},
-		History: []schema1.History{
-			{
-				V1Compatibility: "",
-			},
+		Notifications: configuration.Notifications{
+			EventConfig: configuration.Events{Metadata: metadata},
+			Endpoints: []configuration.Endpoint{{
+				Name:      "collector",
+				URL:       endpoint.URL,
+				Timeout:   time.Second,
+				Threshold: 3,
+				Backoff:   100 * time.Millisecond,
+			}},
 		},
 	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	// Push 2 random layers
-	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
+	imageName, _ := reference.WithName("foo/events")
+	blob := make([]byte, 1000)
+	if _, err := rand.Read(blob); err != nil {
+		t.Fatalf("error generating blob: %v", err)
+	}
+	dgst := digest.FromBytes(blob)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, dgst, uploadURLBase, bytes.NewReader(blob))
 
-	for i := range unsignedManifest.FSLayers {
-		rs, dgst, err := testutil.CreateRandomTarFile()
-		if err != nil {
-			t.Fatalf("error creating random layer %d: %v", i, err)
+	ref, _ := reference.WithDigest(imageName, dgst)
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err := http.Get(blobURL)
+	checkErr(t, err, "fetching blob")
+	resp.Body.Close()
+	checkResponse(t, "fetching blob", resp, http.StatusOK)
+
+	actions := make(map[string]bool)
+	timeout := time.After(10 * time.Second)
+	for !actions[notifications.EventActionPush] || !actions[notifications.EventActionPull] {
+		select {
+		case event := <-received:
+			if !reflect.DeepEqual(event.Source.Metadata, metadata) {
+				t.Fatalf("unexpected source metadata for %s event: %v", event.Action, event.Source.Metadata)
+			}
+			actions[event.Action] = true
+		case <-timeout:
+			t.Fatalf("timed out waiting for push and pull events, received %v", actions)
 		}
-
-		expectedLayers[dgst] = rs
-		unsignedManifest.FSLayers[i].BlobSum = dgst
-		uploadURLBase, _ := startPushLayer(t, env, imageNameRef)
-		pushLayer(t, env.builder, imageNameRef, dgst, uploadURLBase, rs)
 	}
+}
 
-	signedManifest, err := schema1.Sign(unsignedManifest, env.pk)
-	if err != nil {
-		t.Fatalf("unexpected error signing manifest: %v", err)
+// getManifestAccepting fetches a manifest accepting OCI and docker manifests,
+// without following redirects.
+func getManifestAccepting(t *testing.T, manifestURL string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	checkErr(t, err, "building manifest request")
+	req.Header.Set("Accept", strings.Join([]string{
+		v1.MediaTypeImageManifest,
+		v1.MediaTypeImageIndex,
+		schema2.MediaTypeManifest,
+		manifestlist.MediaTypeManifestList,
+	}, ", "))
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 	}
+	resp, err := client.Do(req)
+	checkErr(t, err, "fetching manifest")
+	return resp
+}
 
-	dgst := digest.FromBytes(signedManifest.Canonical)
-
-	// Create this repository by tag to ensure the tag mapping is made in the registry
-	tagRef, _ := reference.WithTag(imageNameRef, tag)
-	manifestDigestURL, err := env.builder.BuildManifestURL(tagRef)
-	checkErr(t, err, "building manifest url")
+func TestManifestNormalization(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		repositories   []string
+		originalDigest string
+	}{
+		{name: "disabled"},
+		{name: "other repositories", repositories: []string{"bar/.*"}},
+		{name: "original digest fails", repositories: []string{"foo/.*"}},
+		{name: "original digest redirects", repositories: []string{"foo/.*"}, originalDigest: "redirect"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := configuration.Configuration{
+				Storage: configuration.Storage{
+					"testdriver": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					}},
+				},
+			}
+			config.HTTP.Headers = headerConfig
+			config.Compatibility.Normalize.Repositories = tc.repositories
+			config.Compatibility.Normalize.OriginalDigest = tc.originalDigest
+			env := newTestEnvWithConfig(t, &config)
+			defer env.Shutdown()
+			normalized := len(tc.repositories) > 0 && tc.repositories[0] == "foo/.*"
+
+			imageName, _ := reference.WithName("foo/normalized")
+			amd64 := pushSchema2Image(t, env, imageName, 2)
+			arm64 := pushSchema2Image(t, env, imageName, 1)
+
+			list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+				{Descriptor: amd64.descriptor, Platform: manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"}},
+				{Descriptor: arm64.descriptor, Platform: manifestlist.PlatformSpec{Architecture: "arm64", OS: "linux"}},
+			})
+			checkErr(t, err, "creating manifest list")
+			tagRef, _ := reference.WithTag(imageName, "multiarch")
+			tagURL, err := env.builder.BuildManifestURL(tagRef)
+			checkErr(t, err, "building manifest url")
+			resp := putManifest(t, "putting manifest list", tagURL, manifestlist.MediaTypeManifestList, list)
+			resp.Body.Close()
+			checkResponse(t, "putting manifest list", resp, http.StatusCreated)
+
+			resp = getManifestAccepting(t, tagURL)
+			defer resp.Body.Close()
+			checkResponse(t, "fetching manifest list", resp, http.StatusOK)
+			var index manifestlist.ManifestList
+			if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+				t.Fatalf("error decoding manifest list: %v", err)
+			}
 
-	digestRef, _ := reference.WithDigest(imageNameRef, dgst)
-	location, err := env.builder.BuildManifestURL(digestRef)
-	checkErr(t, err, "building location URL")
+			if !normalized {
+				if index.MediaType != manifestlist.MediaTypeManifestList {
+					t.Fatalf("manifest list stored as %s", index.MediaType)
+				}
+				digestRef, _ := reference.WithDigest(imageName, amd64.descriptor.Digest)
+				digestURL, err := env.builder.BuildManifestURL(digestRef)
+				checkErr(t, err, "building manifest url")
+				resp := getManifestAccepting(t, digestURL)
+				defer resp.Body.Close()
+				checkResponse(t, "fetching schema2 manifest", resp, http.StatusOK)
+				checkHeaders(t, resp, http.Header{
+					"Content-Type":          []string{schema2.MediaTypeManifest},
+					"Docker-Content-Digest": []string{amd64.descriptor.Digest.String()},
+				})
+				return
+			}
 
-	resp := putManifest(t, "putting signed manifest", manifestDigestURL, "", signedManifest)
-	checkResponse(t, "putting signed manifest", resp, http.StatusCreated)
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{location},
-		"Docker-Content-Digest": []string{dgst.String()},
-	})
-	return dgst
-}
+			// The list is stored as an index of the converted manifests.
+			if index.MediaType != v1.MediaTypeImageIndex {
+				t.Fatalf("manifest list stored as %s", index.MediaType)
+			}
+			for i, original := range []testImage{amd64, arm64} {
+				descriptor := index.Manifests[i]
+				if descriptor.MediaType != v1.MediaTypeImageManifest || descriptor.Digest == original.descriptor.Digest {
+					t.Fatalf("index references the manifest pushed as %s by %v", original.descriptor.Digest, descriptor.Descriptor)
+				}
 
-// Test mutation operations on a registry configured as a cache.  Ensure that they return
-// appropriate errors.
-func TestRegistryAsCacheMutationAPIs(t *testing.T) {
-	deleteEnabled := true
-	env := newTestEnvMirror(t, deleteEnabled)
-	defer env.Shutdown()
+				digestRef, _ := reference.WithDigest(imageName, descriptor.Digest)
+				normalizedURL, err := env.builder.BuildManifestURL(digestRef)
+				checkErr(t, err, "building manifest url")
+				resp := getManifestAccepting(t, normalizedURL)
+				defer resp.Body.Close()
+				checkResponse(t, "fetching normalized manifest", resp, http.StatusOK)
+				checkHeaders(t, resp, http.Header{"Content-Type": []string{v1.MediaTypeImageManifest}})
+				var m ocischema.Manifest
+				if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+					t.Fatalf("error decoding normalized manifest: %v", err)
+				}
+				if m.Config.MediaType != v1.MediaTypeImageConfig {
+					t.Fatalf("normalized config has media type %s", m.Config.MediaType)
+				}
+				for _, layer := range m.Layers {
+					if layer.MediaType != v1.MediaTypeImageLayerGzip {
+						t.Fatalf("normalized layer has media type %s", layer.MediaType)
+					}
+				}
 
-	imageName, _ := reference.WithName("foo/bar")
-	tag := "latest"
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestURL, err := env.builder.BuildManifestURL(tagRef)
-	if err != nil {
-		t.Fatalf("unexpected error building base url: %v", err)
+				digestRef, _ = reference.WithDigest(imageName, original.descriptor.Digest)
+				originalURL, err := env.builder.BuildManifestURL(digestRef)
+				checkErr(t, err, "building manifest url")
+				resp = getManifestAccepting(t, originalURL)
+				defer resp.Body.Close()
+				if tc.originalDigest == "redirect" {
+					checkResponse(t, "fetching manifest by original digest", resp, http.StatusTemporaryRedirect)
+					checkHeaders(t, resp, http.Header{"Location": []string{normalizedURL}})
+				} else {
+					checkResponse(t, "fetching manifest by original digest", resp, http.StatusNotFound)
+					checkBodyHasErrorCodes(t, "fetching manifest by original digest", resp, v2.ErrorCodeManifestUnknown)
+				}
+			}
+		})
 	}
+}
 
-	// Manifest upload
-	m := &schema1.Manifest{
-		Versioned: manifest.Versioned{
-			SchemaVersion: 1,
+// TestPutManifestPlatform checks that an image manifest pushed with the
+// platform query parameter is rejected unless its config is for the platform,
+// when the registry validates platforms.
+func TestPutManifestPlatform(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
 		},
-		Name:     imageName.Name(),
-		Tag:      tag,
-		FSLayers: []schema1.FSLayer{},
-		History:  []schema1.History{},
-	}
-
-	sm, err := schema1.Sign(m, env.pk)
-	if err != nil {
-		t.Fatalf("error signing manifest: %v", err)
 	}
+	config.HTTP.Headers = headerConfig
+	config.Validation.Manifests.Platform.Enabled = true
 
-	resp := putManifest(t, "putting unsigned manifest", manifestURL, "", sm)
-	checkResponse(t, "putting signed manifest to cache", resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
-
-	// Manifest Delete
-	resp, _ = httpDelete(manifestURL)
-	checkResponse(t, "deleting signed manifest from cache", resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	// Blob upload initialization
-	layerUploadURL, err := env.builder.BuildBlobUploadURL(imageName)
-	if err != nil {
-		t.Fatalf("unexpected error building layer upload url: %v", err)
+	imageName, _ := reference.WithName("foo/platform")
+	var descriptors []distribution.Descriptor
+	for _, blob := range []struct {
+		mediaType string
+		content   []byte
+	}{
+		{schema2.MediaTypeImageConfig, []byte(`{"os":"linux","architecture":"amd64","rootfs":{"type":"layers"}}`)},
+		{schema2.MediaTypeLayer, []byte("layer")},
+	} {
+		dgst := digest.FromBytes(blob.content)
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, bytes.NewReader(blob.content))
+		descriptors = append(descriptors, distribution.Descriptor{MediaType: blob.mediaType, Size: int64(len(blob.content)), Digest: dgst})
 	}
-
-	resp, err = http.Post(layerUploadURL, "", nil)
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    descriptors[0],
+		Layers:    descriptors[1:],
+	})
 	if err != nil {
-		t.Fatalf("unexpected error starting layer push: %v", err)
+		t.Fatalf("could not create DeserializedManifest: %v", err)
 	}
-	defer resp.Body.Close()
 
-	checkResponse(t, fmt.Sprintf("starting layer push to cache %v", imageName), resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
 
-	// Blob Delete
-	ref, _ := reference.WithDigest(imageName, digestSha256EmptyTar)
-	blobURL, _ := env.builder.BuildBlobURL(ref)
-	resp, _ = httpDelete(blobURL)
-	checkResponse(t, "deleting blob from cache", resp, errcode.ErrorCodeUnsupported.Descriptor().HTTPStatusCode)
+	for _, platform := range []string{"linux/arm64", "linux"} {
+		resp := putManifest(t, "putting manifest for "+platform, manifestURL+"?platform="+platform, schema2.MediaTypeManifest, manifest)
+		defer resp.Body.Close()
+		checkResponse(t, "putting manifest for "+platform, resp, http.StatusBadRequest)
+		checkBodyHasErrorCodes(t, "putting manifest for "+platform, resp, v2.ErrorCodeManifestInvalid)
+	}
 
+	resp := putManifest(t, "putting manifest for its platform", manifestURL+"?platform=linux/amd64", schema2.MediaTypeManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest for its platform", resp, http.StatusCreated)
 }
 
-func TestProxyManifestGetByTag(t *testing.T) {
-	truthConfig := configuration.Configuration{
+// TestPutManifestListDescriptorLimit checks that manifest lists referencing
+// more manifests than configured are rejected.
+func TestPutManifestListDescriptorLimit(t *testing.T) {
+	const limit = 3
+
+	config := configuration.Configuration{
 		Storage: configuration.Storage{
 			"testdriver": configuration.Parameters{},
 			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
@@ -2812,63 +6704,140 @@ func TestProxyManifestGetByTag(t *testing.T) {
 			}},
 		},
 	}
-	truthConfig.Compatibility.Schema1.Enabled = true
-	truthConfig.HTTP.Headers = headerConfig
+	config.HTTP.Headers = headerConfig
+	config.Validation.Manifests.MaxManifestListDescriptors = limit
 
-	imageName, _ := reference.WithName("foo/bar")
-	tag := "latest"
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	truthEnv := newTestEnvWithConfig(t, &truthConfig)
-	defer truthEnv.Shutdown()
-	// create a repository in the truth registry
-	dgst := createRepository(truthEnv, t, imageName.Name(), tag)
+	imageName, _ := reference.WithName("foo/limited")
+	image := pushSchema2Image(t, env, imageName, 1)
 
-	proxyConfig := configuration.Configuration{
+	for _, tc := range []struct {
+		descriptors int
+		expected    int
+	}{
+		{2, http.StatusCreated},
+		{limit, http.StatusCreated},
+		{limit + 1, http.StatusBadRequest},
+	} {
+		var descriptors []manifestlist.ManifestDescriptor
+		for i := 0; i < tc.descriptors; i++ {
+			descriptors = append(descriptors, manifestlist.ManifestDescriptor{
+				Descriptor: image.descriptor,
+				Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: fmt.Sprint("arch", i)},
+			})
+		}
+		list, err := manifestlist.FromDescriptors(descriptors)
+		if err != nil {
+			t.Fatalf("could not create manifest list: %v", err)
+		}
+
+		tagRef, _ := reference.WithTag(imageName, fmt.Sprint("list", tc.descriptors))
+		manifestURL, err := env.builder.BuildManifestURL(tagRef)
+		checkErr(t, err, "building manifest url")
+
+		msg := fmt.Sprintf("putting manifest list of %d manifests", tc.descriptors)
+		resp := putManifest(t, msg, manifestURL, manifestlist.MediaTypeManifestList, list)
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, tc.expected)
+		if tc.expected == http.StatusBadRequest {
+			checkBodyHasErrorCodes(t, msg, resp, v2.ErrorCodeManifestInvalid)
+
+			resp, err := http.Get(manifestURL)
+			checkErr(t, err, "fetching rejected manifest list")
+			defer resp.Body.Close()
+			checkResponse(t, "fetching rejected manifest list", resp, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGetManifestCompressed(t *testing.T) {
+	config := configuration.Configuration{
 		Storage: configuration.Storage{
 			"testdriver": configuration.Parameters{},
-		},
-		Proxy: configuration.Proxy{
-			RemoteURL: truthEnv.server.URL,
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
 		},
 	}
-	proxyConfig.Compatibility.Schema1.Enabled = true
-	proxyConfig.HTTP.Headers = headerConfig
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	config.HTTP.Compression.Enabled = true
 
-	proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
-	defer proxyEnv.Shutdown()
+	upstreamEnv := newTestEnvWithConfig(t, &config)
+	defer upstreamEnv.Shutdown()
 
-	digestRef, _ := reference.WithDigest(imageName, dgst)
-	manifestDigestURL, err := proxyEnv.builder.BuildManifestURL(digestRef)
+	imageName := "foo/compressed"
+	dgst := createRepository(upstreamEnv, t, imageName, "latest")
+	imageNameRef, _ := reference.WithName(imageName)
+	tagRef, _ := reference.WithTag(imageNameRef, "latest")
+	manifestURL, err := upstreamEnv.builder.BuildManifestURL(tagRef)
 	checkErr(t, err, "building manifest url")
 
-	resp, err := http.Get(manifestDigestURL)
-	checkErr(t, err, "fetching manifest from proxy by digest")
-	defer resp.Body.Close()
+	for _, encoding := range []string{"gzip", "identity"} {
+		req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error fetching manifest: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, "fetching manifest with "+encoding, resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Docker-Content-Digest": []string{dgst.String()},
+			"Vary":                  []string{"Accept-Encoding"},
+		})
 
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestTagURL, err := proxyEnv.builder.BuildManifestURL(tagRef)
-	checkErr(t, err, "building manifest url")
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("error reading manifest: %v", err)
+		}
+		if resp.Header.Get("Content-Length") != fmt.Sprint(len(body)) {
+			t.Fatalf("Content-Length %s, for a body of %d bytes", resp.Header.Get("Content-Length"), len(body))
+		}
+		if got := resp.Header.Get("Content-Encoding"); (encoding == "gzip") != (got == "gzip") {
+			t.Fatalf("unexpected Content-Encoding %q fetching with %s", got, encoding)
+		}
+		if encoding == "gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("error decompressing manifest: %v", err)
+			}
+			if body, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatalf("error decompressing manifest: %v", err)
+			}
+		}
+		var sm schema1.SignedManifest
+		if err := json.Unmarshal(body, &sm); err != nil {
+			t.Fatalf("error decoding manifest fetched with %s: %v", encoding, err)
+		}
+		if actual := digest.FromBytes(sm.Canonical); actual != dgst {
+			t.Fatalf("manifest fetched with %s has digest %s, expected %s", encoding, actual, dgst)
+		}
+	}
 
-	resp, err = http.Get(manifestTagURL)
-	checkErr(t, err, "fetching manifest from proxy by tag (error check 1)")
-	defer resp.Body.Close()
-	checkResponse(t, "fetching manifest from proxy by tag (response check 1)", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-	})
+	// A registry proxying the upstream pulls the manifest compressed.
+	config.HTTP.Compression.Enabled = false
+	config.Proxy.RemoteURL = upstreamEnv.server.URL
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	// Create another manifest in the remote with the same image/tag pair
-	newDigest := createRepository(truthEnv, t, imageName.Name(), tag)
-	if dgst == newDigest {
-		t.Fatalf("non-random test data")
+	manifestURL, err = env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err := http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("error fetching manifest through the proxy: %v", err)
 	}
-
-	// fetch it with the same proxy URL as before.  Ensure the updated content is at the same tag
-	resp, err = http.Get(manifestTagURL)
-	checkErr(t, err, "fetching manifest from proxy by tag (error check 2)")
 	defer resp.Body.Close()
-	checkResponse(t, "fetching manifest from proxy by tag (response check 2)", resp, http.StatusOK)
+	checkResponse(t, "fetching manifest through the proxy", resp, http.StatusOK)
 	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{newDigest.String()},
+		"Docker-Content-Digest": []string{dgst.String()},
 	})
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Fatalf("unexpected Content-Encoding %q with compression disabled", resp.Header.Get("Content-Encoding"))
+	}
 }
@@ -10,8 +10,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -51,6 +53,10 @@ const randomSecretSize = 32
 // defaultCheckInterval is the default time in between health checks
 const defaultCheckInterval = 10 * time.Second
 
+// defaultTagCacheTTL is how long tags are cached for when the tag cache is
+// enabled without a ttl.
+const defaultTagCacheTTL = 30 * time.Second
+
 // App is a global registry application object. Shared resources can be placed
 // on this object that will be accessible from all requests. Any writable
 // fields should be protected.
@@ -85,8 +91,61 @@ type App struct {
 	// isCache is true if this registry is configured as a pull through cache
 	isCache bool
 
-	// readOnly is true if the registry is in a read-only maintenance mode
-	readOnly bool
+	// readOnly is whether the registry is in a read-only maintenance mode
+	readOnly readOnlyMode
+
+	// uploadListing is true if in-progress uploads of a repository may be
+	// listed
+	uploadListing bool
+
+	// noAutoCreate is true if pushes are denied to repositories which do
+	// not exist, until they are created through the repository endpoint
+	noAutoCreate bool
+
+	// traceSampler decides which requests are traced, if set
+	traceSampler *dcontext.TraceSampler
+
+	// uploadTTL is how long after they are started uploads are purged, or
+	// zero if they are not
+	uploadTTL time.Duration
+
+	// admission is consulted before manifest pushes, if configured
+	admission *admissionWebhook
+
+	// quota enforces the storage quotas of repositories, if configured
+	quota *quotaTracker
+
+	// newTagLocks serializes the pushes of new tags to a repository, when
+	// the number of tags is limited
+	newTagLocks keyedLocks
+
+	// clientCertRoutes are the requests authenticated by a verified client
+	// certificate rather than by the access controller
+	clientCertRoutes []clientCertRoute
+
+	// redirectDisabledRepositories match the names of the repositories whose
+	// blobs are served by the registry rather than redirected to the backend
+	redirectDisabledRepositories []*regexp.Regexp
+
+	// indexedAnnotations are the annotation keys manifests may be searched
+	// by
+	indexedAnnotations map[string]struct{}
+
+	// normalizedRepositories match the names of the repositories whose
+	// pushed docker manifests are stored as OCI ones
+	normalizedRepositories []*regexp.Regexp
+
+	// redirectNormalized redirects pulls by the digest a converted manifest
+	// was pushed with to the converted manifest, rather than failing them
+	redirectNormalized bool
+
+	// maxTagLength is the length of the longest tag accepted, the limit of
+	// the reference grammar if zero
+	maxTagLength int
+
+	// storageBudget is the number of storage operations a request may
+	// make, unlimited if zero
+	storageBudget int64
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
@@ -97,19 +156,35 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		Config:  config,
 		Context: ctx,
 		router:  v2.RouterWithPrefix(config.HTTP.Prefix),
-		isCache: config.Proxy.RemoteURL != "",
+		isCache: config.Proxy.RemoteURL != "" || len(config.Proxy.Mirrors) > 0,
 	}
 
 	// Register the handler dispatchers.
 	app.register(v2.RouteNameBase, func(ctx *Context, r *http.Request) http.Handler {
+		if ctx.readOnly.enabled() {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(readOnlyHeader, "true")
+				apiBase(w, r)
+			})
+		}
 		return http.HandlerFunc(apiBase)
 	})
 	app.register(v2.RouteNameManifest, manifestDispatcher)
 	app.register(v2.RouteNameCatalog, catalogDispatcher)
 	app.register(v2.RouteNameTags, tagsDispatcher)
+	app.register(v2.RouteNameReferrers, referrersDispatcher)
+	app.register(v2.RouteNameAnnotations, annotationsDispatcher)
+	app.register(v2.RouteNameRepository, repositoryDispatcher)
 	app.register(v2.RouteNameBlob, blobDispatcher)
 	app.register(v2.RouteNameBlobUpload, blobUploadDispatcher)
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
+	app.router.NotFoundHandler = http.HandlerFunc(app.invalidReference)
+	if err := validatePage("root", config.HTTP.Pages.Root); err != nil {
+		panic(err)
+	}
+	if err := validatePage("notfound", config.HTTP.Pages.NotFound); err != nil {
+		panic(err)
+	}
 
 	// override the storage driver's UA string for registry outbound HTTP requests
 	storageParams := config.Storage.Parameters()
@@ -127,6 +202,15 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		panic(err)
 	}
 
+	layoutVersion, err := config.Storage.LayoutVersion()
+	if err != nil {
+		panic(err)
+	}
+	app.driver, err = storage.WithLayoutVersion(app.driver, layoutVersion)
+	if err != nil {
+		panic(err)
+	}
+
 	purgeConfig := uploadPurgeDefaultConfig()
 	if mc, ok := config.Storage["maintenance"]; ok {
 		if v, ok := mc["uploadpurging"]; ok {
@@ -141,21 +225,51 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				panic("readonly config key must contain additional keys")
 			}
 			if readOnlyEnabled, ok := readOnly["enabled"]; ok {
-				app.readOnly, ok = readOnlyEnabled.(bool)
+				enabled, ok := readOnlyEnabled.(bool)
 				if !ok {
 					panic("readonly's enabled config key must have a boolean value")
 				}
+				app.readOnly.set(enabled)
+			}
+			if windows, ok := readOnly["windows"]; ok && !app.readOnly.enabled() {
+				scheduler := &readOnlyScheduler{
+					mode:    &app.readOnly,
+					windows: parseReadOnlyWindows(windows),
+					now:     time.Now,
+				}
+				go scheduler.run(app)
+			}
+		}
+		if v, ok := mc["uploadlisting"]; ok {
+			uploadListing, ok := v.(map[interface{}]interface{})
+			if !ok {
+				panic("uploadlisting config key must contain additional keys")
+			}
+			if uploadListingEnabled, ok := uploadListing["enabled"]; ok {
+				app.uploadListing, ok = uploadListingEnabled.(bool)
+				if !ok {
+					panic("uploadlisting's enabled config key must have a boolean value")
+				}
 			}
 		}
 	}
 
-	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+	app.uploadTTL = startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
 
 	app.driver, err = applyStorageMiddleware(app.driver, config.Middleware["storage"])
 	if err != nil {
 		panic(err)
 	}
 
+	if n := config.HTTP.StorageBudget.Operations; n != 0 {
+		if n < 0 {
+			panic(fmt.Sprintf("http.storagebudget.operations must not be negative, %d invalid", n))
+		}
+		app.driver = &budgetedDriver{StorageDriver: app.driver}
+		app.storageBudget = int64(n)
+		dcontext.GetLogger(app).Infof("limiting requests to %d storage operations", n)
+	}
+
 	app.configureSecret(config)
 	app.configureEvents(config)
 	app.configureRedis(config)
@@ -182,6 +296,46 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		options = append(options, storage.EnableSchema1)
 	}
 
+	switch mode := config.Compatibility.ManifestList.HeadSize.Mode; mode {
+	case "", headSizeModeManifest, headSizeModeLayers:
+	default:
+		panic(fmt.Sprintf(`invalid manifestlist "headsize" mode %q: must be %q or %q`, mode, headSizeModeManifest, headSizeModeLayers))
+	}
+
+	for _, mediaType := range config.Compatibility.Negotiation.MediaTypes {
+		if _, ok := manifestMediaTypes[mediaType]; !ok {
+			panic(fmt.Sprintf(`invalid negotiation "mediatypes" entry %q: not a manifest media type`, mediaType))
+		}
+	}
+
+	if mediaType := config.Compatibility.Untyped.FallbackMediaType; mediaType != "" {
+		options = append(options, storage.ManifestFallbackMediaType(mediaType))
+	}
+
+	for _, s := range config.Compatibility.Normalize.Repositories {
+		re, err := regexp.Compile("^(?:" + s + ")$")
+		if err != nil {
+			panic(fmt.Sprintf("invalid normalize repositories %q: %v", s, err))
+		}
+		app.normalizedRepositories = append(app.normalizedRepositories, re)
+	}
+	switch config.Compatibility.Normalize.OriginalDigest {
+	case "", "fail":
+	case "redirect":
+		app.redirectNormalized = true
+	default:
+		panic(fmt.Sprintf("invalid normalize originaldigest %q, must be fail or redirect", config.Compatibility.Normalize.OriginalDigest))
+	}
+
+	if err := dcontext.ValidateRequestLogFields(config.Log.RequestFields); err != nil {
+		panic(fmt.Sprintf(`invalid log "requestfields" configuration: %v`, err))
+	}
+
+	app.admission, err = newAdmissionWebhook(config)
+	if err != nil {
+		panic(fmt.Sprintf(`invalid policy "admission" configuration: %v`, err))
+	}
+
 	if config.HTTP.Host != "" {
 		u, err := url.Parse(config.HTTP.Host)
 		if err != nil {
@@ -204,6 +358,16 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	// configure tag write serialization
+	if tw, ok := config.Storage["tagwrites"]; ok {
+		s, ok := tw["serialize"]
+		if ok {
+			if serialize, ok := s.(bool); ok && serialize {
+				options = append(options, storage.SerializeTagWrites)
+			}
+		}
+	}
+
 	// configure redirects
 	var redirectDisabled bool
 	if redirectConfig, ok := config.Storage["redirect"]; ok {
@@ -211,9 +375,39 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		switch v := v.(type) {
 		case bool:
 			redirectDisabled = v
+		case nil:
+			// redirects stay enabled
 		default:
 			panic(fmt.Sprintf("invalid type for redirect config: %#v", redirectConfig))
 		}
+
+		switch v := redirectConfig["disablerepositories"].(type) {
+		case []interface{}:
+			for _, pattern := range v {
+				s, ok := pattern.(string)
+				if !ok {
+					panic(fmt.Sprintf("invalid type for redirect disablerepositories: %#v", pattern))
+				}
+				re, err := regexp.Compile("^(?:" + s + ")$")
+				if err != nil {
+					panic(fmt.Sprintf("invalid redirect disablerepositories %q: %v", s, err))
+				}
+				app.redirectDisabledRepositories = append(app.redirectDisabledRepositories, re)
+			}
+		case nil:
+		default:
+			panic(fmt.Sprintf("invalid type for redirect disablerepositories: %#v", v))
+		}
+
+		switch v := redirectConfig["contenttypes"].(type) {
+		case bool:
+			if v {
+				options = append(options, storage.StoreContentTypes)
+			}
+		case nil:
+		default:
+			panic(fmt.Sprintf("invalid type for redirect contenttypes: %#v", v))
+		}
 	}
 	if redirectDisabled {
 		dcontext.GetLogger(app).Infof("backend redirection disabled")
@@ -256,6 +450,149 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				options = append(options, storage.ManifestURLsDenyRegexp(re))
 			}
 		}
+
+		if len(config.Validation.Manifests.AllowedLayerMediaTypes) > 0 {
+			options = append(options, storage.AllowedLayerMediaTypes(config.Validation.Manifests.AllowedLayerMediaTypes))
+		}
+		if len(config.Validation.Manifests.AllowedArtifactLayerMediaTypes) > 0 {
+			options = append(options, storage.AllowedArtifactLayerMediaTypes(config.Validation.Manifests.AllowedArtifactLayerMediaTypes))
+		}
+
+		if platform := config.Validation.Manifests.Platform; platform.Enabled {
+			size := platform.MaxConfigSize
+			if size < 0 {
+				panic(fmt.Sprintf("validation.manifests.platform.maxconfigsize must not be negative, %d invalid", size))
+			}
+			if size == 0 {
+				size = storage.DefaultMaxPlatformConfigSize
+			}
+			options = append(options, storage.ValidatePlatforms(size))
+		}
+	}
+
+	if n := config.Validation.Manifests.MaxConcurrentChecks; n != 0 {
+		if n < 0 {
+			panic(fmt.Sprintf("validation.manifests.maxconcurrentchecks must not be negative, %d invalid", n))
+		}
+		options = append(options, storage.ManifestVerificationConcurrency(n))
+	}
+	if n := config.Validation.Tags.MaxLength; n != 0 {
+		if n < 0 || n > maxTagLength {
+			panic(fmt.Sprintf("validation.tags.maxlength must be between 0 and %d, %d invalid", maxTagLength, n))
+		}
+		app.maxTagLength = n
+	}
+	if n := config.Validation.Manifests.MaxManifestListDescriptors; n != 0 {
+		if n < 0 {
+			panic(fmt.Sprintf("validation.manifests.maxmanifestlistdescriptors must not be negative, %d invalid", n))
+		}
+		options = append(options, storage.MaxManifestListDescriptors(n))
+	}
+
+	// configure uploads
+	if uc, ok := config.Storage["uploads"]; ok {
+		if param, ok := uc["minchunksize"]; ok {
+			var size int64
+			switch v := param.(type) {
+			case int:
+				size = int64(v)
+			case string:
+				if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+					panic(fmt.Sprintf(`invalid uploads "minchunksize" parameter %q: %v`, v, err))
+				}
+			default:
+				panic(fmt.Sprintf(`invalid uploads "minchunksize" parameter %v: not a number`, param))
+			}
+			if size < 0 {
+				panic(fmt.Sprintf(`invalid uploads "minchunksize" parameter %d: must not be negative`, size))
+			}
+			if size > 0 {
+				options = append(options, storage.UploadMinChunkSize(size))
+				dcontext.GetLogger(app).Infof("writing uploads in chunks of at least %d bytes", size)
+			}
+		}
+	}
+
+	// configure the annotation index
+	if keys := config.Search.Annotations.Keys; len(keys) > 0 {
+		options = append(options, storage.IndexedAnnotations(keys))
+		app.indexedAnnotations = make(map[string]struct{}, len(keys))
+		for _, key := range keys {
+			app.indexedAnnotations[key] = struct{}{}
+		}
+		dcontext.GetLogger(app).Infof("indexing manifest annotations %v", keys)
+	}
+
+	if tracing := config.Log.Tracing; tracing.SamplingRate != nil || tracing.TraceID {
+		rate := 1.0
+		if tracing.SamplingRate != nil {
+			rate = *tracing.SamplingRate
+		}
+		sampler, err := dcontext.NewTraceSampler(rate)
+		if err != nil {
+			panic(fmt.Sprintf("log.tracing.samplingrate: %v", err))
+		}
+		app.traceSampler = sampler
+	}
+
+	if create := config.Policy.AutoCreateRepositories; create != nil && !*create {
+		app.noAutoCreate = true
+		dcontext.GetLogger(app).Info("repositories are not created on push")
+	}
+
+	// configure the referrers required of pushed manifests
+	if required := config.Policy.Referrers.Required; len(required) > 0 {
+		if app.isCache {
+			panic("required referrers are not supported by pull-through caches, which do not take pushes")
+		}
+		var requirements []storage.RequiredReferrer
+		for _, rr := range required {
+			requirements = append(requirements, storage.RequiredReferrer{
+				Repository:   rr.Repository,
+				ArtifactType: rr.ArtifactType,
+				GracePeriod:  rr.GracePeriod,
+			})
+		}
+		options = append(options, storage.RequiredReferrers(requirements))
+		dcontext.GetLogger(app).Infof("requiring referrers of the manifests pushed to %d repository patterns", len(required))
+	}
+
+	// configure the tag cache
+	if cc, ok := config.Storage["cache"]; ok {
+		switch v := cc["tags"]; v {
+		case nil, "":
+		case "inmemory":
+			ttl := defaultTagCacheTTL
+			if param, ok := cc["tagttl"]; ok {
+				s, ok := param.(string)
+				if !ok {
+					panic(fmt.Sprintf(`invalid cache "tagttl" parameter %v: not a duration`, param))
+				}
+				if ttl, err = time.ParseDuration(s); err != nil {
+					panic(fmt.Sprintf(`invalid cache "tagttl" parameter %q: %v`, s, err))
+				}
+			}
+			options = append(options, storage.TagCache(ttl))
+			dcontext.GetLogger(app).Infof("using inmemory tag cache with ttl %v", ttl)
+		default:
+			dcontext.GetLogger(app).Warnf("unknown tag cache type %q, tag caching disabled", v)
+		}
+	}
+
+	// configure the negative caching of blob descriptors
+	if cc, ok := config.Storage["cache"]; ok {
+		if param, ok := cc["negativettl"]; ok {
+			s, ok := param.(string)
+			if !ok {
+				panic(fmt.Sprintf(`invalid cache "negativettl" parameter %v: not a duration`, param))
+			}
+			ttl, err := time.ParseDuration(s)
+			if err != nil {
+				panic(fmt.Sprintf(`invalid cache "negativettl" parameter %q: %v`, s, err))
+			}
+			options = append(options, storage.BlobDescriptorNegativeCache(ttl))
+			dcontext.GetLogger(app).Infof("caching absent blobs in memory for %v", ttl)
+		}
 	}
 
 	// configure storage caches
@@ -287,7 +624,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 			}
 			dcontext.GetLogger(app).Infof("using inmemory blob descriptor cache")
 		default:
-			if v != "" {
+			if v != nil && v != "" {
 				dcontext.GetLogger(app).Warnf("unknown cache type %q, caching disabled", config.Storage["cache"])
 			}
 		}
@@ -301,11 +638,27 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	// Quota usage is keyed on the names repositories are stored under, so it
+	// is computed below the registry middleware, which may rename them.
+	storageRegistry := app.registry
 	app.registry, err = applyRegistryMiddleware(app, app.registry, config.Middleware["registry"])
 	if err != nil {
 		panic(err)
 	}
 
+	app.quota, err = newQuotaTracker(config, storageRegistry)
+	if err != nil {
+		panic(fmt.Sprintf(`invalid policy "quota" configuration: %v`, err))
+	}
+	if app.quota != nil {
+		startQuotaReconciler(app, app.quota, config.Policy.Quota.ReconcileInterval)
+	}
+
+	app.clientCertRoutes, err = newClientCertRoutes(config)
+	if err != nil {
+		panic(fmt.Sprintf(`invalid http.tls "clientcertroutes" configuration: %v`, err))
+	}
+
 	authType := config.Auth.Type()
 
 	if authType != "" && !strings.EqualFold(authType, "none") {
@@ -318,13 +671,16 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	// configure as a pull through cache
-	if config.Proxy.RemoteURL != "" {
+	if app.isCache {
 		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy)
 		if err != nil {
 			panic(err.Error())
 		}
-		app.isCache = true
-		dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		if len(config.Proxy.Mirrors) > 0 {
+			dcontext.GetLogger(app).Infof("Registry configured as a proxy cache to %d mirrors", len(config.Proxy.Mirrors))
+		} else {
+			dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		}
 	}
 	var ok bool
 	app.repoRemover, ok = app.registry.(distribution.RepositoryRemover)
@@ -419,6 +775,57 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 			healthRegistry.Register(tcpChecker.Addr, health.PeriodicChecker(checker, interval))
 		}
 	}
+
+	for _, endpoint := range app.Config.Notifications.Endpoints {
+		if endpoint.Disabled || !endpoint.Health.Enabled {
+			continue
+		}
+		app.registerEndpointHealthCheck(healthRegistry, endpoint)
+	}
+}
+
+// registerEndpointHealthCheck registers a health check probing that the
+// notification endpoint is reachable. Probes are sent independently of the
+// delivery of events, which their failures do not affect.
+func (app *App) registerEndpointHealthCheck(healthRegistry *health.Registry, endpoint configuration.Endpoint) {
+	config := endpoint.Health
+	interval := config.Interval
+	if interval == 0 {
+		interval = defaultCheckInterval
+	}
+
+	switch config.Method {
+	case "", http.MethodHead, http.MethodOptions:
+	default:
+		panic(fmt.Sprintf("invalid health check method %q for endpoint %s", config.Method, endpoint.Name))
+	}
+
+	probeURL, err := url.Parse(endpoint.URL)
+	if err != nil {
+		panic(fmt.Sprintf("invalid url for endpoint %s: %v", endpoint.Name, err))
+	}
+	if config.Path != "" {
+		path, err := url.Parse(config.Path)
+		if err != nil {
+			panic(fmt.Sprintf("invalid health check path %q for endpoint %s: %v", config.Path, endpoint.Name, err))
+		}
+		probeURL = probeURL.ResolveReference(path)
+	}
+
+	checker := checks.ReachabilityChecker(config.Method, probeURL.String(), endpoint.Timeout, endpoint.Headers)
+	if config.Threshold != 0 {
+		checker = health.PeriodicThresholdChecker(checker, interval, config.Threshold)
+	} else {
+		checker = health.PeriodicChecker(checker, interval)
+	}
+
+	dcontext.GetLogger(app).Infof("configuring notification endpoint health check endpoint=%s, url=%s, interval=%d, critical=%t", endpoint.Name, probeURL, interval/time.Second, config.Critical)
+	name := "notifications_" + endpoint.Name
+	if config.Critical {
+		healthRegistry.Register(name, checker)
+	} else {
+		healthRegistry.RegisterNonCritical(name, checker)
+	}
 }
 
 // register a handler with the application, by route name. The handler will be
@@ -427,14 +834,19 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 func (app *App) register(routeName string, dispatch dispatchFunc) {
 	handler := app.dispatcher(dispatch)
 
-	// Chain the handler with prometheus instrumented handler
-	if app.Config.HTTP.Debug.Prometheus.Enabled {
+	// Chain the handler with prometheus instrumented handler, whose metrics
+	// are sent to StatsD as well, if enabled.
+	if app.Config.HTTP.Debug.Prometheus.Enabled || app.Config.HTTP.Debug.StatsD.Enabled {
 		namespace := metrics.NewNamespace(prometheus.NamespacePrefix, "http", nil)
 		httpMetrics := namespace.NewDefaultHttpMetrics(strings.Replace(routeName, "-", "_", -1))
 		metrics.Register(namespace)
 		handler = metrics.InstrumentHandler(httpMetrics, handler)
 	}
 
+	if app.slowRequestsOnly() {
+		handler = logSlowRequests(app.Config.Log.AccessLog.SlowThreshold, routeName, handler)
+	}
+
 	// TODO(stevvooe): This odd dispatcher/route registration is by-product of
 	// some limitations in the gorilla/mux router. We are using it to keep
 	// routing consistent between the client and server, but we may want to
@@ -444,6 +856,13 @@ func (app *App) register(routeName string, dispatch dispatchFunc) {
 	app.router.GetRoute(routeName).Handler(handler)
 }
 
+// slowRequestsOnly reports whether access logging is restricted to slow
+// requests.
+func (app *App) slowRequestsOnly() bool {
+	accessLog := app.Config.Log.AccessLog
+	return !accessLog.Disabled && accessLog.SlowThreshold > 0
+}
+
 // configureEvents prepares the event sink for action.
 func (app *App) configureEvents(configuration *configuration.Configuration) {
 	// Configure all of the endpoint sinks.
@@ -454,15 +873,53 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 			continue
 		}
 
-		dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
-		endpoint := notifications.NewEndpoint(endpoint.Name, endpoint.URL, notifications.EndpointConfig{
+		switch endpoint.Overflow {
+		case "", notifications.OverflowBlock, notifications.OverflowDrop:
+		default:
+			panic(fmt.Sprintf("invalid overflow policy %q for endpoint %s", endpoint.Overflow, endpoint.Name))
+		}
+
+		for _, pattern := range endpoint.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				panic(fmt.Sprintf("invalid repository pattern %q for endpoint %s: %v", pattern, endpoint.Name, err))
+			}
+		}
+
+		endpointConfig := notifications.EndpointConfig{
 			Timeout:           endpoint.Timeout,
 			Threshold:         endpoint.Threshold,
 			Backoff:           endpoint.Backoff,
 			Headers:           endpoint.Headers,
 			IgnoredMediaTypes: endpoint.IgnoredMediaTypes,
 			Ignore:            endpoint.Ignore,
-		})
+			QueueSize:         endpoint.QueueSize,
+			Workers:           endpoint.Workers,
+			Overflow:          endpoint.Overflow,
+			BlockTimeout:      endpoint.BlockTimeout,
+			Repositories:      endpoint.Repositories,
+		}
+		if aws := endpoint.AWS; aws.ARN != "" {
+			if endpoint.Health.Enabled {
+				panic(fmt.Sprintf("health checks are not supported for endpoint %s delivering to %s", endpoint.Name, aws.ARN))
+			}
+			dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s", endpoint.Name, aws.ARN, endpoint.Timeout)
+			sink, err := notifications.NewAWSEndpoint(endpoint.Name, notifications.AWSConfig{
+				ARN:            aws.ARN,
+				Region:         aws.Region,
+				RegionEndpoint: aws.RegionEndpoint,
+				AccessKey:      aws.AccessKey,
+				SecretKey:      aws.SecretKey,
+				SessionToken:   aws.SessionToken,
+			}, endpointConfig)
+			if err != nil {
+				panic(fmt.Sprintf("invalid aws configuration for endpoint %s: %v", endpoint.Name, err))
+			}
+			sinks = append(sinks, sink)
+			continue
+		}
+
+		dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
+		endpoint := notifications.NewEndpoint(endpoint.Name, endpoint.URL, endpointConfig)
 
 		sinks = append(sinks, endpoint)
 	}
@@ -489,6 +946,12 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 		Addr:       hostname,
 		InstanceID: dcontext.GetStringValue(app, "instance.id"),
 	}
+	if len(configuration.Notifications.EventConfig.Metadata) != 0 {
+		app.events.source.Metadata = make(map[string]string, len(configuration.Notifications.EventConfig.Metadata))
+		for k, v := range configuration.Notifications.EventConfig.Metadata {
+			app.events.source.Metadata[k] = v
+		}
+	}
 }
 
 type redisStartAtKey struct{}
@@ -586,6 +1049,20 @@ func (app *App) configureLogHook(configuration *configuration.Configuration) {
 
 	logger := entry.Logger
 
+	if configuration.Log.RequestFields != nil {
+		// The fields of request log entries are restricted to those
+		// selected, besides the static fields and those describing the
+		// error logged and the subject of the request.
+		keep := []string{logrus.ErrorKey, errCodeKey{}.String(), errMessageKey{}.String(), errDetailKey{}.String(), authSubjectKey{}.String()}
+		for key := range configuration.Log.Fields {
+			keep = append(keep, key)
+		}
+		if configuration.Log.Tracing.TraceID {
+			keep = append(keep, "trace.id")
+		}
+		logger.Hooks.Add(dcontext.NewRequestLogFieldsHook(keep...))
+	}
+
 	for _, configHook := range configuration.Log.Hooks {
 		if !configHook.Disabled {
 			switch configHook.Type {
@@ -626,20 +1103,74 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Prepare the context with our own little decorations.
 	ctx := r.Context()
 	ctx = dcontext.WithRequest(ctx, r)
+	if app.traceSampler != nil {
+		ctx = app.traceSampler.WithRequestTrace(ctx, r)
+	}
 	ctx, w = dcontext.WithResponseWriter(ctx, w)
-	ctx = dcontext.WithLogger(ctx, dcontext.GetRequestLogger(ctx))
+	ctx = withAuthSubjectRecord(ctx)
+	ctx = dcontext.WithLogger(ctx, app.requestLogger(ctx))
 	r = r.WithContext(ctx)
 
 	defer func() {
+		if app.slowRequestsOnly() {
+			return
+		}
 		status, ok := ctx.Value("http.response.status").(int)
 		if ok && status >= 200 && status <= 399 {
-			dcontext.GetResponseLogger(r.Context()).Infof("response completed")
+			app.responseLogger(r.Context()).Infof("response completed")
 		}
 	}()
 
-	// Set a header with the Docker Distribution API Version for all responses.
-	w.Header().Add("Docker-Distribution-API-Version", "registry/2.0")
-	app.router.ServeHTTP(w, r)
+	// Set a header with the Docker Distribution API Version for all
+	// responses, once even if configured as well, so that clients probing
+	// the base route find it.
+	headersHandler(app.Config.HTTP.Headers, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		app.router.ServeHTTP(w, r)
+	})).ServeHTTP(w, r)
+}
+
+// requestLogger returns the logger for the request in ctx, restricted to the
+// configured request fields if any.
+func (app *App) requestLogger(ctx context.Context) dcontext.Logger {
+	if app.Config.Log.Tracing.TraceID {
+		// Only traced requests have a trace id.
+		ctx = dcontext.WithLogger(ctx, dcontext.GetLogger(ctx, "trace.id"))
+	}
+	if app.Config.Log.RequestFields != nil {
+		return dcontext.GetRequestLoggerWithFields(ctx, app.Config.Log.RequestFields)
+	}
+	return dcontext.GetRequestLogger(ctx)
+}
+
+// responseLogger returns the logger for the response in ctx, restricted to
+// the configured request fields if any. The subject the request was
+// authorized for is logged as "auth.user".
+func (app *App) responseLogger(ctx context.Context) dcontext.Logger {
+	ctx = withAuthSubjectLogger(ctx)
+	if app.Config.Log.RequestFields != nil {
+		return dcontext.GetResponseLoggerWithFields(ctx, app.Config.Log.RequestFields)
+	}
+	return dcontext.GetResponseLogger(ctx)
+}
+
+// headersHandler wraps the handler, adding the configured headers to every
+// response before it is passed on. Since the headers are set ahead of
+// dispatch, they are also present on error responses and redirects.
+func headersHandler(headers http.Header, handler http.Handler) http.Handler {
+	if len(headers) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for headerName, headerValues := range headers {
+			for _, value := range headerValues {
+				w.Header().Add(headerName, value)
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
 }
 
 // dispatchFunc takes a context and request and returns a constructed handler
@@ -655,14 +1186,13 @@ type dispatchFunc func(ctx *Context, r *http.Request) http.Handler
 // handler, using the dispatch factory function.
 func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		for headerName, headerValues := range app.Config.HTTP.Headers {
-			for _, value := range headerValues {
-				w.Header().Add(headerName, value)
-			}
-		}
-
 		context := app.context(w, r)
 
+		var budget *storageBudget
+		if app.storageBudget > 0 {
+			context.Context, budget = withStorageBudget(context.Context, app.storageBudget)
+		}
+
 		if err := app.authorized(w, r, context); err != nil {
 			dcontext.GetLogger(context).Warnf("error authorizing context: %v", err)
 			return
@@ -670,6 +1200,7 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 
 		// Add username to request logging
 		context.Context = dcontext.WithLogger(context.Context, dcontext.GetLogger(context.Context, auth.UserNameKey))
+		recordAuthSubject(context, dcontext.GetStringValue(context, auth.UserNameKey))
 
 		// sync up context on the request.
 		r = r.WithContext(context)
@@ -701,12 +1232,18 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 					context.Errors = append(context.Errors, err)
 				}
 
+				app.setRetryAfter(w, context.Errors)
 				if err := errcode.ServeJSON(w, context.Errors); err != nil {
 					dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
 				}
 				return
 			}
 
+			context.storageName = repository.Named().Name()
+			if namer, ok := repository.(distribution.RepositoryStorageNamer); ok {
+				context.storageName = namer.StorageName().Name()
+			}
+
 			// assign and decorate the authorized repository with an event bridge.
 			context.Repository, context.RepositoryRemover = notifications.Listen(
 				repository,
@@ -726,10 +1263,14 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 		}
 
 		dispatch(context, r).ServeHTTP(w, r)
+		if budget != nil && budget.exceeded() {
+			app.storageBudgetExceeded(context, budget)
+		}
 		// Automated error response handling here. Handlers may return their
 		// own errors if they need different behavior (such as range errors
 		// for layer upload).
 		if context.Errors.Len() > 0 {
+			app.setRetryAfter(w, context.Errors)
 			if err := errcode.ServeJSON(w, context.Errors); err != nil {
 				dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
 			}
@@ -773,7 +1314,7 @@ func (app *App) logError(ctx context.Context, errors errcode.Errors) {
 			errCodeKey{},
 			errMessageKey{},
 			errDetailKey{}))
-		dcontext.GetResponseLogger(c).Errorf("response completed with error")
+		app.responseLogger(c).Errorf("response completed with error")
 	}
 }
 
@@ -782,11 +1323,15 @@ func (app *App) logError(ctx context.Context, errors errcode.Errors) {
 func (app *App) context(w http.ResponseWriter, r *http.Request) *Context {
 	ctx := r.Context()
 	ctx = dcontext.WithVars(ctx, r)
-	ctx = dcontext.WithLogger(ctx, dcontext.GetLogger(ctx,
-		"vars.name",
-		"vars.reference",
-		"vars.digest",
-		"vars.uuid"))
+	if app.Config.Log.RequestFields != nil {
+		ctx = dcontext.WithLogger(ctx, dcontext.GetRequestLoggerWithFields(ctx, app.Config.Log.RequestFields))
+	} else {
+		ctx = dcontext.WithLogger(ctx, dcontext.GetLogger(ctx,
+			"vars.name",
+			"vars.reference",
+			"vars.digest",
+			"vars.uuid"))
+	}
 
 	context := &Context{
 		App:     app,
@@ -812,6 +1357,20 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	dcontext.GetLogger(context).Debug("authorizing request")
 	repo := getName(context)
 
+	if app.clientCertRequired(r, repo) {
+		name, ok := verifiedClientCert(r)
+		if !ok {
+			if err := errcode.ServeJSON(w, errcode.ErrorCodeDenied.WithMessage("client certificate required")); err != nil {
+				dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+			}
+			return fmt.Errorf("forbidden: no verified client certificate")
+		}
+
+		context.Context = auth.WithUser(context.Context, auth.UserInfo{Name: name})
+		dcontext.GetLogger(context, auth.UserNameKey).Info("authorized request with client certificate")
+		return nil
+	}
+
 	if app.accessController == nil {
 		return nil // access controller is not enabled.
 	}
@@ -820,6 +1379,10 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 
 	if repo != "" {
 		accessRecords = appendAccessRecords(accessRecords, r.Method, repo)
+		if app.uploadListing {
+			accessRecords = appendUploadListingAccessRecord(accessRecords, r, repo)
+		}
+		accessRecords = appendRepositoryCreationAccessRecord(accessRecords, r, repo)
 		if fromRepo := r.FormValue("from"); fromRepo != "" {
 			// mounting a blob from one repository to another requires pull (GET)
 			// access to the source repository.
@@ -849,7 +1412,13 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			// Add the appropriate WWW-Auth header
 			err.SetHeaders(r, w)
 
-			if err := errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized.WithDetail(accessRecords)); err != nil {
+			// Challenges for credentials which are valid but do not
+			// grant the access requested are answered as denied.
+			code := errcode.ErrorCodeUnauthorized
+			if status, ok := err.(interface{ Status() int }); ok && status.Status() == http.StatusForbidden {
+				code = errcode.ErrorCodeDenied
+			}
+			if err := errcode.ServeJSON(w, code.WithDetail(accessRecords)); err != nil {
 				dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
 			}
 		default:
@@ -934,10 +1503,55 @@ func appendAccessRecords(records []auth.Access, method string, repo string) []au
 				Resource: resource,
 				Action:   "delete",
 			})
+	default:
+		// Require full access for any other method, so that a route
+		// accepting one is never left open to tokens of any scope.
+		records = append(records,
+			auth.Access{
+				Resource: resource,
+				Action:   "*",
+			})
 	}
 	return records
 }
 
+// Add the access record for listing the uploads of a repository if it's our
+// current route. Listing uploads exposes the activity of other clients, so it
+// requires full access to the repository.
+func appendUploadListingAccessRecord(accessRecords []auth.Access, r *http.Request, repo string) []auth.Access {
+	route := mux.CurrentRoute(r)
+	if route.GetName() != v2.RouteNameBlobUpload || r.Method != http.MethodGet {
+		return accessRecords
+	}
+
+	return append(accessRecords,
+		auth.Access{
+			Resource: auth.Resource{
+				Type: "repository",
+				Name: repo,
+			},
+			Action: "*",
+		})
+}
+
+// Add the access record for creating a repository if it's our current route.
+// Creating repositories is reserved to clients with full access to them.
+func appendRepositoryCreationAccessRecord(accessRecords []auth.Access, r *http.Request, repo string) []auth.Access {
+	route := mux.CurrentRoute(r)
+	if route.GetName() != v2.RouteNameRepository {
+		return accessRecords
+	}
+
+	return append(accessRecords,
+		auth.Access{
+			Resource: auth.Resource{
+				Type: "repository",
+				Name: repo,
+			},
+			Action: "*",
+		})
+}
+
 // Add the access record for the catalog if it's our current route
 func appendCatalogAccessRecord(accessRecords []auth.Access, r *http.Request) []auth.Access {
 	route := mux.CurrentRoute(r)
@@ -1012,10 +1626,11 @@ func badPurgeUploadConfig(reason string) {
 }
 
 // startUploadPurger schedules a goroutine which will periodically
-// check upload directories for old files and delete them
-func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageDriver, log dcontext.Logger, config map[interface{}]interface{}) {
+// check upload directories for old files and delete them. It returns the age
+// uploads are deleted at, or zero if they are not deleted.
+func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageDriver, log dcontext.Logger, config map[interface{}]interface{}) time.Duration {
 	if config["enabled"] == false {
-		return
+		return 0
 	}
 
 	var purgeAgeDuration time.Duration
@@ -1073,4 +1688,9 @@ func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageD
 			time.Sleep(intervalDuration)
 		}
 	}()
+
+	if dryRunBool {
+		return 0
+	}
+	return purgeAgeDuration
 }
@@ -1,12 +1,14 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/context"
@@ -17,6 +19,7 @@ import (
 	"github.com/distribution/distribution/v3/registry/storage"
 	memorycache "github.com/distribution/distribution/v3/registry/storage/cache/memory"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testdriver"
+	"github.com/sirupsen/logrus"
 )
 
 // TestAppDispatcher builds an application with a test dispatcher and ensures
@@ -277,3 +280,70 @@ func TestAppendAccessRecords(t *testing.T) {
 	}
 
 }
+
+func TestStartUploadPurgerTTL(t *testing.T) {
+	config := func(enabled, dryRun bool) map[interface{}]interface{} {
+		return map[interface{}]interface{}{
+			"enabled":  enabled,
+			"age":      "2h",
+			"interval": "24h",
+			"dryrun":   dryRun,
+		}
+	}
+
+	ctx := context.Background()
+	log := context.GetLogger(ctx)
+	for _, tc := range []struct {
+		enabled, dryRun bool
+		expected        time.Duration
+	}{
+		{true, false, 2 * time.Hour},
+		{true, true, 0},
+		{false, false, 0},
+	} {
+		if ttl := startUploadPurger(ctx, testdriver.New(), log, config(tc.enabled, tc.dryRun)); ttl != tc.expected {
+			t.Errorf("unexpected upload TTL purging uploads with enabled=%v dryrun=%v: %s", tc.enabled, tc.dryRun, ttl)
+		}
+	}
+}
+
+// TestRequestLoggerTraceID checks that only the log entries of the requests
+// traced carry their trace id, when configured.
+func TestRequestLoggerTraceID(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	config := &configuration.Configuration{}
+	config.Log.Tracing.TraceID = true
+	sampler, err := context.NewTraceSampler(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{Config: config, traceSampler: sampler}
+
+	for _, tc := range []struct {
+		flags   string
+		sampled bool
+	}{
+		{"01", true},
+		{"00", false},
+	} {
+		var buf bytes.Buffer
+		logger := logrus.New()
+		logger.Out = &buf
+		logger.Formatter = &logrus.JSONFormatter{}
+
+		r := httptest.NewRequest("GET", "/v2/", nil)
+		r.Header.Set(context.TraceParentHeader, "00-"+traceID+"-00f067aa0ba902b7-"+tc.flags)
+		ctx := context.WithRequest(context.WithLogger(context.Background(), logrus.NewEntry(logger)), r)
+		ctx = app.traceSampler.WithRequestTrace(ctx, r)
+		app.requestLogger(ctx).Info("request")
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("error decoding log line %q: %v", buf.String(), err)
+		}
+		if id, ok := entry["trace.id"]; ok != tc.sampled || (ok && id != traceID) {
+			t.Fatalf("sampled %v: unexpected trace.id %v in log line %s", tc.sampled, id, buf.String())
+		}
+	}
+}
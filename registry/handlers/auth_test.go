@@ -0,0 +1,355 @@
+package handlers
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	"github.com/docker/libtrust"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	tokenTestIssuer  = "issuer.example.com"
+	tokenTestService = "registry.example.com"
+)
+
+// tokenTestEnv is a test environment with token authentication, along with
+// the key tokens are signed with.
+type tokenTestEnv struct {
+	*testEnv
+	key libtrust.PrivateKey
+}
+
+func newTokenTestEnv(t *testing.T) *tokenTestEnv {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	cert, err := libtrust.GenerateCACert(key, key)
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	bundle, err := ioutil.TempFile("", "rootcertbundle")
+	if err != nil {
+		t.Fatalf("failed to create certificate bundle: %v", err)
+	}
+	defer bundle.Close()
+	t.Cleanup(func() { os.Remove(bundle.Name()) })
+	if err := pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+		t.Fatalf("failed to write certificate bundle: %v", err)
+	}
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"delete":     configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"token": {
+				"realm":          "https://auth.example.com/token",
+				"issuer":         tokenTestIssuer,
+				"service":        tokenTestService,
+				"rootcertbundle": bundle.Name(),
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+
+	return &tokenTestEnv{testEnv: newTestEnvWithConfig(t, &config), key: key}
+}
+
+// token returns a token granting the given actions on each repository.
+func (env *tokenTestEnv) token(t *testing.T, access map[string][]string) string {
+	header, err := json.Marshal(token.Header{
+		Type:       "JWT",
+		SigningAlg: "ES256",
+		KeyID:      env.key.KeyID(),
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal token header: %v", err)
+	}
+
+	now := time.Now()
+	claims := token.ClaimSet{
+		Issuer:     tokenTestIssuer,
+		Subject:    "user",
+		Audience:   tokenTestService,
+		Expiration: now.Add(time.Hour).Unix(),
+		NotBefore:  now.Add(-time.Minute).Unix(),
+		IssuedAt:   now.Unix(),
+		JWTID:      fmt.Sprint(now.UnixNano()),
+	}
+	for name, actions := range access {
+		claims.Access = append(claims.Access, &token.ResourceActions{Type: "repository", Name: name, Actions: actions})
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to marshal token claims: %v", err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	signed := encode(header) + "." + encode(payload)
+	signature, _, err := env.key.Sign(strings.NewReader(signed), crypto.SHA256)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed + "." + encode(signature)
+}
+
+// challengeScope returns the sorted actions of each repository in the scope
+// of a bearer challenge.
+func challengeScope(challenge string) map[string][]string {
+	scopes := make(map[string][]string)
+	m := regexp.MustCompile(`scope="([^"]*)"`).FindStringSubmatch(challenge)
+	if m == nil {
+		return scopes
+	}
+	for _, scope := range strings.Fields(m[1]) {
+		parts := strings.SplitN(scope, ":", 3)
+		if len(parts) != 3 || parts[0] != "repository" {
+			continue
+		}
+		actions := strings.Split(parts[2], ",")
+		sort.Strings(actions)
+		scopes[parts[1]] = actions
+	}
+	return scopes
+}
+
+// TestPullOnlyTokenWriteRoutes checks that every route writing to a
+// repository denies a token only granting pull access to it, with a
+// challenge for the scope required.
+func TestPullOnlyTokenWriteRoutes(t *testing.T) {
+	env := newTokenTestEnv(t)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/pullonly")
+	dgst := digest.FromString("layer")
+	pullToken := env.token(t, map[string][]string{
+		"foo/pullonly": {"pull"},
+		"foo/source":   {"pull"},
+	})
+
+	uploadURL, err := env.builder.BuildBlobUploadURL(imageName)
+	checkErr(t, err, "building upload url")
+	mountURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{
+		"mount": []string{dgst.String()},
+		"from":  []string{"foo/source"},
+	})
+	checkErr(t, err, "building mount url")
+	chunkURL, err := env.builder.BuildBlobUploadChunkURL(imageName, "b9b6a9a5-a215-4a1b-9e2e-6bdb6b4c3f6a")
+	checkErr(t, err, "building upload chunk url")
+	completeURL, err := env.builder.BuildBlobUploadChunkURL(imageName, "b9b6a9a5-a215-4a1b-9e2e-6bdb6b4c3f6a", url.Values{
+		"digest": []string{dgst.String()},
+	})
+	checkErr(t, err, "building upload completion url")
+	blobRef, _ := reference.WithDigest(imageName, dgst)
+	blobURL, err := env.builder.BuildBlobURL(blobRef)
+	checkErr(t, err, "building blob url")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		url        string
+		repository string
+		actions    []string
+	}{
+		{"upload init", http.MethodPost, uploadURL, "foo/pullonly", []string{"pull", "push"}},
+		{"blob mount", http.MethodPost, mountURL, "foo/pullonly", []string{"pull", "push"}},
+		{"upload chunk", http.MethodPatch, chunkURL, "foo/pullonly", []string{"pull", "push"}},
+		{"upload completion", http.MethodPut, completeURL, "foo/pullonly", []string{"pull", "push"}},
+		{"upload cancellation", http.MethodDelete, chunkURL, "foo/pullonly", []string{"delete"}},
+		{"manifest put", http.MethodPut, manifestURL, "foo/pullonly", []string{"pull", "push"}},
+		{"manifest delete", http.MethodDelete, manifestURL, "foo/pullonly", []string{"delete"}},
+		{"blob delete", http.MethodDelete, blobURL, "foo/pullonly", []string{"delete"}},
+		{"unknown method", "PROPPATCH", manifestURL, "foo/pullonly", []string{"*"}},
+	} {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		if err != nil {
+			t.Fatalf("%s: error constructing request: %v", tc.name, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+pullToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		defer resp.Body.Close()
+
+		checkResponse(t, tc.name, resp, http.StatusForbidden)
+		checkBodyHasErrorCodes(t, tc.name, resp, errcode.ErrorCodeDenied)
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if !strings.Contains(challenge, `error="insufficient_scope"`) || !reflect.DeepEqual(challengeScope(challenge)[tc.repository], tc.actions) {
+			t.Fatalf("%s: unexpected challenge %q, expected insufficient scope for %s on %s", tc.name, challenge, tc.actions, tc.repository)
+		}
+	}
+
+	// The token still grants what it was issued for.
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		t.Fatalf("error constructing request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+pullToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest with a pull token", resp, http.StatusNotFound)
+
+	// Requests without a token are still asked for one.
+	resp, err = http.Post(uploadURL, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload without a token", resp, http.StatusUnauthorized)
+}
+
+// TestMountRequiresPullOnSource checks that mounting a blob requires pull
+// access to the repository it is mounted from, on top of push access to the
+// repository it is mounted into.
+func TestMountRequiresPullOnSource(t *testing.T) {
+	env := newTokenTestEnv(t)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/target")
+	mountURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{
+		"mount": []string{digest.FromString("layer").String()},
+		"from":  []string{"foo/private"},
+	})
+	checkErr(t, err, "building mount url")
+
+	req, err := http.NewRequest(http.MethodPost, mountURL, nil)
+	if err != nil {
+		t.Fatalf("error constructing request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+env.token(t, map[string][]string{
+		"foo/target": {"pull", "push"},
+	}))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error mounting blob: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "mounting from a repository without pull access", resp, http.StatusForbidden)
+	if challenge := resp.Header.Get("WWW-Authenticate"); !reflect.DeepEqual(challengeScope(challenge)["foo/private"], []string{"pull"}) {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+}
+
+// TestBaseRouteHeaders checks that the base route answers with the API
+// version header, whichever the access controller, along with a single
+// challenge when the request is not authenticated.
+func TestBaseRouteHeaders(t *testing.T) {
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	checkErr(t, err, "hashing password")
+	if err := ioutil.WriteFile(htpasswdPath, []byte("user:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatalf("error writing htpasswd file: %v", err)
+	}
+
+	tokenEnv := newTokenTestEnv(t)
+	defer tokenEnv.Shutdown()
+
+	for _, tc := range []struct {
+		name      string
+		auth      configuration.Auth
+		env       *testEnv
+		authorize func(r *http.Request)
+		challenge string
+	}{
+		{
+			name:      "silly",
+			auth:      configuration.Auth{"silly": {"realm": "realm-test", "service": "service-test"}},
+			authorize: func(r *http.Request) { r.Header.Set("Authorization", "Bearer token") },
+			challenge: `Bearer realm="realm-test",service="service-test"`,
+		},
+		{
+			name:      "htpasswd",
+			auth:      configuration.Auth{"htpasswd": {"realm": "realm-test", "path": htpasswdPath}},
+			authorize: func(r *http.Request) { r.SetBasicAuth("user", "secret") },
+			challenge: `Basic realm="realm-test"`,
+		},
+		{
+			name:      "token",
+			env:       tokenEnv.testEnv,
+			authorize: func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+tokenEnv.token(t, nil)) },
+			challenge: `Bearer realm="https://auth.example.com/token",service="` + tokenTestService + `"`,
+		},
+	} {
+		env := tc.env
+		if env == nil {
+			config := configuration.Configuration{
+				Storage: configuration.Storage{
+					"testdriver": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+						"enabled": false,
+					}},
+				},
+				Auth: tc.auth,
+			}
+			// A version header configured as well is not sent twice.
+			config.HTTP.Headers = http.Header{
+				"X-Content-Type-Options":          []string{"nosniff"},
+				"Docker-Distribution-Api-Version": []string{"registry/2.0"},
+			}
+			env = newTestEnvWithConfig(t, &config)
+			defer env.Shutdown()
+		}
+		baseURL, err := env.builder.BuildBaseURL()
+		checkErr(t, err, "building base url")
+
+		for _, authenticated := range []bool{false, true} {
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				msg := fmt.Sprintf("%s: %s base route, authenticated %v", tc.name, method, authenticated)
+				req, err := http.NewRequest(method, baseURL, nil)
+				checkErr(t, err, "building request")
+				status := http.StatusUnauthorized
+				if authenticated {
+					tc.authorize(req)
+					status = http.StatusOK
+				}
+				resp, err := http.DefaultClient.Do(req)
+				checkErr(t, err, msg)
+				resp.Body.Close()
+				checkResponse(t, msg, resp, status)
+
+				if version := resp.Header.Values("Docker-Distribution-Api-Version"); !reflect.DeepEqual(version, []string{"registry/2.0"}) {
+					t.Errorf("%s: unexpected api version headers %q", msg, version)
+				}
+				challenges := resp.Header.Values("WWW-Authenticate")
+				if authenticated && len(challenges) != 0 {
+					t.Errorf("%s: unexpected challenges %q", msg, challenges)
+				} else if !authenticated && !reflect.DeepEqual(challenges, []string{tc.challenge}) {
+					t.Errorf("%s: unexpected challenges %q, expected %q", msg, challenges, tc.challenge)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+)
+
+// authSubjectKey is the key of the subject a request was authorized for, in
+// the contexts of access log entries.
+type authSubjectKey struct{}
+
+func (authSubjectKey) String() string { return "auth.user" }
+
+// authSubject records the subject a request was authorized for. It is put in
+// the request context before dispatch, so that access log entries emitted
+// outside of the dispatched handler carry the subject too.
+type authSubject struct {
+	name string
+}
+
+type authSubjectRecordKey struct{}
+
+// withAuthSubjectRecord returns a context recording the subject the request
+// is authorized for.
+func withAuthSubjectRecord(ctx context.Context) context.Context {
+	return context.WithValue(ctx, authSubjectRecordKey{}, &authSubject{})
+}
+
+// recordAuthSubject records name as the subject the request in ctx was
+// authorized for.
+func recordAuthSubject(ctx context.Context, name string) {
+	if record, ok := ctx.Value(authSubjectRecordKey{}).(*authSubject); ok {
+		record.name = name
+	}
+}
+
+// withAuthSubjectLogger returns a context whose logger carries the "auth.user"
+// field, if the request was authorized for a subject. Anonymous requests are
+// left without the field.
+func withAuthSubjectLogger(ctx context.Context) context.Context {
+	record, ok := ctx.Value(authSubjectRecordKey{}).(*authSubject)
+	if !ok || record.name == "" {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, authSubjectKey{}, record.name)
+	return dcontext.WithLogger(ctx, dcontext.GetLogger(ctx, authSubjectKey{}))
+}
@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
 )
@@ -34,10 +37,10 @@ func blobDispatcher(ctx *Context, r *http.Request) http.Handler {
 
 	mhandler := handlers.MethodHandler{
 		"GET":  http.HandlerFunc(blobHandler.GetBlob),
-		"HEAD": http.HandlerFunc(blobHandler.GetBlob),
+		"HEAD": http.HandlerFunc(blobHandler.HeadBlob),
 	}
 
-	if !ctx.readOnly {
+	if !ctx.readOnly.enabled() {
 		mhandler["DELETE"] = http.HandlerFunc(blobHandler.DeleteBlob)
 	}
 
@@ -66,13 +69,130 @@ func (bh *blobHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := blobs.ServeBlob(bh, w, r, desc.Digest); err != nil {
+	context.SetResponseContentDigest(bh, desc.Digest.String())
+	if acceptsTrailers(r) && desc.Digest.Algorithm().Available() {
+		tw := &digestTrailerWriter{ResponseWriter: w, digester: desc.Digest.Algorithm().Digester()}
+		defer tw.writeTrailer()
+		w = tw
+	}
+	if err := bh.serveBlob(blobs, w, r, desc.Digest); err != nil {
 		context.GetLogger(bh).Debugf("unexpected error getting blob HTTP handler: %v", err)
 		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
 	}
 }
 
+// serveBlob serves the blob dgst from blobs. The blobs of repositories with
+// redirects disabled are served with their content.
+func (bh *blobHandler) serveBlob(blobs distribution.BlobStore, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
+	name := bh.Repository.Named().Name()
+	for _, re := range bh.App.redirectDisabledRepositories {
+		if re.MatchString(name) {
+			return blobs.ServeBlob(storage.WithRedirectDisabled(bh), w, r, dgst)
+		}
+	}
+	return blobs.ServeBlob(bh, w, r, dgst)
+}
+
+// acceptsTrailers reports whether the client of r advertises it accepts
+// trailers in the response, by a TE header.
+func acceptsTrailers(r *http.Request) bool {
+	for _, te := range r.Header.Values("TE") {
+		for _, token := range strings.Split(te, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// digestTrailerWriter sends the digest of the blob content it writes in a
+// Docker-Content-Digest trailer, so that clients can verify a download as
+// they stream it. Only full responses carry the trailer: redirects, partial
+// and not modified responses are left as they are. The response is chunked
+// in place of carrying a Content-Length, as trailers require.
+type digestTrailerWriter struct {
+	http.ResponseWriter
+	digester    digest.Digester
+	wroteHeader bool
+	trailer     bool
+}
+
+func (tw *digestTrailerWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		if status == http.StatusOK {
+			tw.trailer = true
+			tw.Header().Del("Content-Length")
+			tw.Header().Add("Trailer", "Docker-Content-Digest")
+		}
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *digestTrailerWriter) Write(p []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	n, err := tw.ResponseWriter.Write(p)
+	if tw.trailer {
+		tw.digester.Hash().Write(p[:n])
+	}
+	return n, err
+}
+
+// writeTrailer sets the trailer to the digest of the content written, once
+// the body is complete.
+func (tw *digestTrailerWriter) writeTrailer() {
+	if tw.trailer {
+		tw.Header().Set("Docker-Content-Digest", tw.digester.Digest().String())
+	}
+}
+
+// HeadBlob checks for the existence of a blob. The response carries the
+// headers GetBlob would send, without the content. Since the descriptor is
+// resolved through the repository's blob descriptor cache, a blob known to
+// the cache is reported without accessing storage. Conditional and range
+// requests are left to the blob server, as are all requests to a pull
+// through cache, which fetches the blob from the remote registry.
+func (bh *blobHandler) HeadBlob(w http.ResponseWriter, r *http.Request) {
+	context.GetLogger(bh).Debug("HeadBlob")
+	blobs := bh.Repository.Blobs(bh)
+	desc, err := blobs.Stat(bh, bh.Digest)
+	if err != nil {
+		if err == distribution.ErrBlobUnknown {
+			bh.Errors = append(bh.Errors, v2.ErrorCodeBlobUnknown.WithDetail(bh.Digest))
+		} else {
+			bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	context.SetResponseContentDigest(bh, desc.Digest.String())
+	if bh.App.isCache || hasConditionalHeaders(r) {
+		if err := bh.serveBlob(blobs, w, r, desc.Digest); err != nil {
+			context.GetLogger(bh).Debugf("unexpected error getting blob HTTP handler: %v", err)
+			bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	storage.SetBlobHeaders(w.Header(), desc)
+	w.WriteHeader(http.StatusOK)
+}
+
+// hasConditionalHeaders reports whether r is a range request or conditional
+// request, whose response depends on its headers.
+func hasConditionalHeaders(r *http.Request) bool {
+	for _, header := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if r.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // DeleteBlob deletes a layer blob
 func (bh *blobHandler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 	context.GetLogger(bh).Debug("DeleteBlob")
@@ -87,6 +207,9 @@ func (bh *blobHandler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 		case distribution.ErrBlobUnknown:
 			bh.Errors = append(bh.Errors, v2.ErrorCodeBlobUnknown)
 			return
+		case cache.ErrUnavailable:
+			bh.Errors = append(bh.Errors, errcode.ErrorCodeUnavailable.WithDetail(err))
+			return
 		default:
 			bh.Errors = append(bh.Errors, err)
 			context.GetLogger(bh).Errorf("Unknown error deleting blob: %s", err.Error())
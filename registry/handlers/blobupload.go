@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
@@ -29,13 +31,17 @@ func blobUploadDispatcher(ctx *Context, r *http.Request) http.Handler {
 		"HEAD": http.HandlerFunc(buh.GetUploadStatus),
 	}
 
-	if !ctx.readOnly {
+	if !ctx.readOnly.enabled() {
 		handler["POST"] = http.HandlerFunc(buh.StartBlobUpload)
 		handler["PATCH"] = http.HandlerFunc(buh.PatchBlobData)
 		handler["PUT"] = http.HandlerFunc(buh.PutBlobUploadComplete)
 		handler["DELETE"] = http.HandlerFunc(buh.CancelBlobUpload)
 	}
 
+	if buh.UUID == "" && ctx.uploadListing {
+		handler["GET"] = http.HandlerFunc(buh.ListBlobUploads)
+	}
+
 	if buh.UUID != "" {
 		if h := buh.ResumeBlobUpload(ctx, r); h != nil {
 			return h
@@ -62,6 +68,10 @@ type blobUploadHandler struct {
 // StartBlobUpload begins the blob upload process and allocates a server-side
 // blob writer session, optionally mounting the blob from a separate repository.
 func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Request) {
+	if !checkRepositoryCreation(buh.Context) {
+		return
+	}
+
 	var options []distribution.BlobCreateOption
 
 	fromRepo := r.FormValue("from")
@@ -74,6 +84,22 @@ func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Req
 		}
 	}
 
+	// A client declaring the digest of the blob it is about to upload need
+	// not send it if the repository already has it.
+	if dgstStr := r.FormValue("digest"); dgstStr != "" && len(options) == 0 {
+		dgst, err := digest.Parse(dgstStr)
+		if err != nil {
+			buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail("digest parsing failed"))
+			return
+		}
+		if desc, ok := buh.existingBlob(dgst, -1); ok {
+			if err := buh.writeBlobCreatedHeaders(w, desc); err != nil {
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			}
+			return
+		}
+	}
+
 	blobs := buh.Repository.Blobs(buh)
 	upload, err := blobs.Create(buh, options...)
 
@@ -120,6 +146,49 @@ func (buh *blobUploadHandler) GetUploadStatus(w http.ResponseWriter, r *http.Req
 	w.WriteHeader(http.StatusNoContent)
 }
 
+type blobUploadsAPIResponse struct {
+	Name    string                     `json:"name"`
+	Uploads []blobUploadStatusResponse `json:"uploads"`
+}
+
+type blobUploadStatusResponse struct {
+	UUID         string    `json:"uuid"`
+	Offset       int64     `json:"offset"`
+	StartedAt    time.Time `json:"startedAt"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// ListBlobUploads returns a json list of the in-progress uploads of a
+// repository, as found in the upload store.
+func (buh *blobUploadHandler) ListBlobUploads(w http.ResponseWriter, r *http.Request) {
+	uploads, err := storage.ListUploads(buh, buh.App.driver, buh.storageName)
+	if err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	response := blobUploadsAPIResponse{
+		Name:    buh.Repository.Named().Name(),
+		Uploads: make([]blobUploadStatusResponse, 0, len(uploads)),
+	}
+	for _, upload := range uploads {
+		response.Uploads = append(response.Uploads, blobUploadStatusResponse{
+			UUID:         upload.ID,
+			Offset:       upload.Offset,
+			StartedAt:    upload.StartedAt,
+			LastModified: upload.LastModified,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
 // PatchBlobData writes data to an upload.
 func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Request) {
 	if buh.Upload == nil {
@@ -134,25 +203,61 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Without a Content-Range, the chunk starts at the offset the upload URL
+	// was issued for.
+	start, length := buh.State.Offset, r.ContentLength
+
 	cr := r.Header.Get("Content-Range")
 	cl := r.Header.Get("Content-Length")
-	if cr != "" && cl != "" {
-		start, end, err := parseContentRange(cr)
+	checkRange := cr != "" && cl != ""
+	if checkRange {
+		var end int64
+		var err error
+		start, end, err = parseContentRange(cr)
 		if err != nil {
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 			return
 		}
-		if start > end || start != buh.Upload.Size() {
+		if start > end {
 			buh.Errors = append(buh.Errors, v2.ErrorCodeRangeInvalid)
 			return
 		}
+		length = (end - start) + 1
+	}
+
+	if size := buh.Upload.Size(); start != size {
+		if start < size && length >= 0 && start+length <= size {
+			// The chunk was already written, most likely by a request the
+			// client is retrying. Ignore it and report the current offset.
+			dcontext.GetLogger(buh).Infof("ignoring replayed chunk %d-%d of upload %s at offset %d", start, start+length-1, buh.UUID, size)
+			if err := buh.blobUploadResponse(w, r, false); err != nil {
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+				return
+			}
+
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		// The chunk leaves a gap or overlaps the end of the written data.
+		// Reject it, returning the current offset in Range so the client
+		// can resynchronize.
+		if err := buh.blobUploadResponse(w, r, false); err != nil {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		w.Header().Del("Content-Length") // the error body follows
+		buh.Errors = append(buh.Errors, v2.ErrorCodeRangeInvalid)
+		return
+	}
 
+	if checkRange {
 		clInt, err := strconv.ParseInt(cl, 10, 64)
 		if err != nil {
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 			return
 		}
-		if clInt != (end-start)+1 {
+		if clInt != length {
 			buh.Errors = append(buh.Errors, v2.ErrorCodeSizeInvalid)
 			return
 		}
@@ -197,12 +302,50 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		return
 	}
 
+	size, ok := buh.declaredSize(r)
+	if !ok {
+		return
+	}
+
+	// Rather than receiving a final chunk completing a blob the repository
+	// already has, the upload is canceled.
+	if r.ContentLength != 0 {
+		if desc, ok := buh.existingBlob(dgst, size); ok {
+			if err := buh.Upload.Cancel(buh); err != nil {
+				dcontext.GetLogger(buh).Errorf("error canceling upload of existing blob: %v", err)
+			}
+			if err := buh.writeBlobCreatedHeaders(w, desc); err != nil {
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			}
+			return
+		}
+	}
+
 	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PUT"); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 		return
 	}
 
+	if buh.App.quota != nil {
+		if err := buh.App.quota.checkBlob(buh, buh.storageName, dgst, buh.Upload.Size()); err != nil {
+			if _, ok := err.(errcode.Error); !ok {
+				err = errcode.ErrorCodeUnknown.WithDetail(err)
+			}
+			buh.Errors = append(buh.Errors, err)
+			if err := buh.Upload.Cancel(buh); err != nil {
+				dcontext.GetLogger(buh).Errorf("error canceling upload after error: %v", err)
+			}
+			return
+		}
+	}
+
+	// The size committed is verified along with the digest. A zero size is
+	// not verified.
+	if size < 0 {
+		size = 0
+	}
 	desc, err := buh.Upload.Commit(buh, distribution.Descriptor{
+		Size:   size,
 		Digest: dgst,
 
 		// TODO(stevvooe): This isn't wildly important yet, but we should
@@ -222,7 +365,9 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 				buh.Errors = append(buh.Errors, errcode.ErrorCodeDenied)
 			case distribution.ErrUnsupported:
 				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnsupported)
-			case distribution.ErrBlobInvalidLength, distribution.ErrBlobDigestUnsupported:
+			case distribution.ErrBlobInvalidLength:
+				buh.Errors = append(buh.Errors, v2.ErrorCodeSizeInvalid.WithDetail(map[string]int64{"declared": size}))
+			case distribution.ErrBlobDigestUnsupported:
 				buh.Errors = append(buh.Errors, v2.ErrorCodeBlobUploadInvalid.WithDetail(err))
 			default:
 				dcontext.GetLogger(buh).Errorf("unknown error completing upload: %v", err)
@@ -245,6 +390,35 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 	}
 }
 
+// declaredSize returns the size of the blob the client declares completing
+// the upload with, or -1 if it declares none. A Content-Range header gives
+// the range of the final chunk, which must start at the current offset, the
+// blob ending with it. Otherwise, a Content-Length header gives the size of
+// the final chunk, following the data already uploaded. If the range is
+// invalid, the error is recorded and false returned.
+func (buh *blobUploadHandler) declaredSize(r *http.Request) (int64, bool) {
+	offset := buh.Upload.Size()
+
+	cr := r.Header.Get("Content-Range")
+	if cr == "" {
+		if r.ContentLength < 0 {
+			return -1, true
+		}
+		return offset + r.ContentLength, true
+	}
+
+	start, end, err := parseContentRange(cr)
+	if err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return 0, false
+	}
+	if start != offset || start > end {
+		buh.Errors = append(buh.Errors, v2.ErrorCodeRangeInvalid)
+		return 0, false
+	}
+	return end + 1, true
+}
+
 // CancelBlobUpload cancels an in-progress upload of a blob.
 func (buh *blobUploadHandler) CancelBlobUpload(w http.ResponseWriter, r *http.Request) {
 	if buh.Upload == nil {
@@ -285,6 +459,17 @@ func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) ht
 		})
 	}
 
+	// Expired uploads may be purged at any time, so they may only be
+	// canceled.
+	if expires, ok := buh.uploadExpires(state.StartedAt); ok && !time.Now().Before(expires) && r.Method != http.MethodDelete {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dcontext.GetLogger(ctx).Infof("resuming upload %s expired at %s", buh.UUID, expires)
+			buh.Errors = append(buh.Errors, v2.ErrorCodeBlobUploadExpired.WithDetail(map[string]string{
+				"expired": expires.UTC().Format(time.RFC3339),
+			}))
+		})
+	}
+
 	blobs := ctx.Repository.Blobs(buh)
 	upload, err := blobs.Resume(buh, buh.UUID)
 	if err != nil {
@@ -302,6 +487,12 @@ func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) ht
 	buh.Upload = upload
 
 	if size := upload.Size(); size != buh.State.Offset {
+		if r.Method == http.MethodPatch && size > buh.State.Offset {
+			// The upload URL predates data written since, as when a client
+			// retries a PATCH. PatchBlobData detects replayed chunks.
+			return nil
+		}
+
 		defer upload.Close()
 		dcontext.GetLogger(ctx).Errorf("upload resumed at wrong offset: %d != %d", size, buh.State.Offset)
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -348,6 +539,9 @@ func (buh *blobUploadHandler) blobUploadResponse(w http.ResponseWriter, r *http.
 
 	w.Header().Set("Docker-Upload-UUID", buh.UUID)
 	w.Header().Set("Location", uploadURL)
+	if expires, ok := buh.uploadExpires(buh.State.StartedAt); ok {
+		w.Header().Set("Docker-Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	}
 
 	w.Header().Set("Content-Length", "0")
 	w.Header().Set("Range", fmt.Sprintf("0-%d", endRange))
@@ -355,6 +549,15 @@ func (buh *blobUploadHandler) blobUploadResponse(w http.ResponseWriter, r *http.
 	return nil
 }
 
+// uploadExpires returns the time after which an upload started at startedAt
+// may be purged, if uploads are purged.
+func (buh *blobUploadHandler) uploadExpires(startedAt time.Time) (time.Time, bool) {
+	if buh.App.uploadTTL <= 0 || startedAt.IsZero() {
+		return time.Time{}, false
+	}
+	return startedAt.Add(buh.App.uploadTTL), true
+}
+
 // mountBlob attempts to mount a blob from another repository by its digest. If
 // successful, the blob is linked into the blob store and 201 Created is
 // returned with the canonical url of the blob.
@@ -377,6 +580,23 @@ func (buh *blobUploadHandler) createBlobMountOption(fromRepo, mountDigest string
 	return storage.WithMountFrom(canonical), nil
 }
 
+// existingBlob returns the descriptor of the blob of the repository with
+// the digest dgst, if it has one, so that uploading it can be skipped. If
+// size is not negative, the blob must have that size.
+func (buh *blobUploadHandler) existingBlob(dgst digest.Digest, size int64) (distribution.Descriptor, bool) {
+	desc, err := buh.Repository.Blobs(buh).Stat(buh, dgst)
+	if err != nil {
+		if err != distribution.ErrBlobUnknown {
+			dcontext.GetLogger(buh).Errorf("error checking for existing blob %s: %v", dgst, err)
+		}
+		return distribution.Descriptor{}, false
+	}
+	if size >= 0 && desc.Size != size {
+		return distribution.Descriptor{}, false
+	}
+	return desc, true
+}
+
 // writeBlobCreatedHeaders writes the standard headers describing a newly
 // created blob. A 201 Created is written as well as the canonical URL and
 // blob digest.
@@ -393,6 +613,7 @@ func (buh *blobUploadHandler) writeBlobCreatedHeaders(w http.ResponseWriter, des
 	w.Header().Set("Location", blobURL)
 	w.Header().Set("Content-Length", "0")
 	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	dcontext.SetResponseContentDigest(buh, desc.Digest.String())
 	w.WriteHeader(http.StatusCreated)
 	return nil
 }
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// clientCertRoute selects requests which must be made with a verified client
+// certificate.
+type clientCertRoute struct {
+	repositories *regexp.Regexp
+	methods      map[string]struct{}
+}
+
+func newClientCertRoutes(config *configuration.Configuration) ([]clientCertRoute, error) {
+	var routes []clientCertRoute
+	for _, route := range config.HTTP.TLS.ClientCertRoutes {
+		if route.Repositories == "" {
+			return nil, fmt.Errorf("client certificate route without repositories")
+		}
+		repositories, err := regexp.Compile("^(?:" + route.Repositories + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid repositories %q: %v", route.Repositories, err)
+		}
+
+		methods := make(map[string]struct{}, len(route.Methods))
+		for _, method := range route.Methods {
+			methods[strings.ToUpper(method)] = struct{}{}
+		}
+		routes = append(routes, clientCertRoute{repositories: repositories, methods: methods})
+	}
+	return routes, nil
+}
+
+func (route clientCertRoute) matches(method, repo string) bool {
+	if !route.repositories.MatchString(repo) {
+		return false
+	}
+	if len(route.methods) == 0 {
+		return true
+	}
+	_, ok := route.methods[method]
+	return ok
+}
+
+// clientCertRequired reports whether r, for the repository repo, must be made
+// with a verified client certificate.
+func (app *App) clientCertRequired(r *http.Request, repo string) bool {
+	if repo == "" {
+		return false
+	}
+	for _, route := range app.clientCertRoutes {
+		if route.matches(r.Method, repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifiedClientCert returns the common name of the subject of the client
+// certificate r was made with, if it was verified against the client CAs.
+func verifiedClientCert(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName == "" {
+		return subject.String(), true
+	}
+	return subject.CommonName, true
+}
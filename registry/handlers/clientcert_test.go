@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+)
+
+// testCA issues client certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create client certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestClientCertRoutes checks that requests selected by client certificate
+// routes are authenticated by a verified client certificate in place of the
+// access controller, and denied without one, while other requests still go
+// through the access controller.
+func TestClientCertRoutes(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.HTTP.TLS.ClientCertRoutes = []configuration.ClientCertRoute{
+		{Repositories: "automation/.*", Methods: []string{"post", "patch", "put", "delete"}},
+	}
+	config.HTTP.Headers = headerConfig
+
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(NewApp(context.Background(), &config))
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	builder, err := v2.NewURLBuilderFromString(server.URL, false)
+	if err != nil {
+		t.Fatalf("error creating url builder: %v", err)
+	}
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = certs
+		return &http.Client{Transport: transport}
+	}
+	withCert := newClient(ca.issue(t, "automation"))
+	withoutCert := newClient()
+
+	automation, _ := reference.WithName("automation/app")
+	public, _ := reference.WithName("public/app")
+	automationUploadURL, err := builder.BuildBlobUploadURL(automation)
+	checkErr(t, err, "building upload url")
+	publicUploadURL, err := builder.BuildBlobUploadURL(public)
+	checkErr(t, err, "building upload url")
+	automationTagsURL, err := builder.BuildTagsURL(automation)
+	checkErr(t, err, "building tags url")
+
+	for _, tc := range []struct {
+		name   string
+		client *http.Client
+		method string
+		url    string
+		status int
+	}{
+		{"upload with a certificate", withCert, http.MethodPost, automationUploadURL, http.StatusAccepted},
+		{"upload without a certificate", withoutCert, http.MethodPost, automationUploadURL, http.StatusForbidden},
+		{"route not requiring a certificate", withCert, http.MethodGet, automationTagsURL, http.StatusUnauthorized},
+		{"repository not requiring a certificate", withCert, http.MethodPost, publicUploadURL, http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		if err != nil {
+			t.Fatalf("%s: error constructing request: %v", tc.name, err)
+		}
+		resp, err := tc.client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		defer resp.Body.Close()
+
+		checkResponse(t, tc.name, resp, tc.status)
+		if tc.status == http.StatusForbidden {
+			checkBodyHasErrorCodes(t, tc.name, resp, errcode.ErrorCodeDenied)
+		}
+	}
+
+	// Certificates not issued by the client CAs are rejected during the
+	// handshake.
+	untrusted := newClient(newTestCA(t).issue(t, "automation"))
+	if resp, err := untrusted.Post(automationUploadURL, "", nil); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the handshake to fail with an untrusted certificate, got %s", resp.Status)
+	}
+}
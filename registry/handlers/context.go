@@ -28,6 +28,11 @@ type Context struct {
 	// RepositoryRemover provides method to delete a repository
 	RepositoryRemover distribution.RepositoryRemover
 
+	// storageName is the name Repository is stored under, which state kept
+	// by repository, such as quota usage, is keyed on. It differs from the
+	// name of Repository when a registry middleware renamed it.
+	storageName string
+
 	// Errors is a collection of errors encountered during the request to be
 	// returned to the client API. If errors are added to the collection, the
 	// handler *must not* start the response via http.ResponseWriter.
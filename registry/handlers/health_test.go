@@ -6,12 +6,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/health"
+	"github.com/distribution/distribution/v3/notifications"
 )
 
 func TestFileHealthCheck(t *testing.T) {
@@ -208,3 +210,87 @@ func TestHTTPHealthCheck(t *testing.T) {
 		t.Fatal("expected 0 items in health check results")
 	}
 }
+
+func TestNotificationEndpointHealthCheck(t *testing.T) {
+	interval := 100 * time.Millisecond
+
+	var mu sync.Mutex
+	delivered := 0
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/ping":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.Method == http.MethodPost:
+			mu.Lock()
+			delivered++
+			mu.Unlock()
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer reachable.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	endpoint := func(name, url, path string) configuration.Endpoint {
+		return configuration.Endpoint{
+			Name:    name,
+			URL:     url,
+			Timeout: time.Second,
+			Health: configuration.EndpointHealth{
+				Enabled:  true,
+				Interval: interval,
+				Path:     path,
+			},
+		}
+	}
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Notifications: configuration.Notifications{
+			Endpoints: []configuration.Endpoint{
+				endpoint("up", reachable.URL+"/events", ""),
+				endpoint("down", unreachable.URL+"/events", ""),
+				endpoint("failing", reachable.URL+"/events", "/ping"),
+			},
+		},
+	}
+
+	app := NewApp(context.Background(), config)
+	healthRegistry := health.NewRegistry()
+	app.RegisterHealthChecks(healthRegistry)
+
+	// Wait for health check to happen
+	<-time.After(5 * interval)
+
+	status := healthRegistry.CheckStatus()
+	if len(status) != 2 {
+		t.Fatalf("expected 2 items in health check results, got %v", status)
+	}
+	for _, name := range []string{"notifications_down", "notifications_failing"} {
+		if _, ok := status[name]; !ok {
+			t.Fatalf("expected %s in health check results, got %v", name, status)
+		}
+	}
+
+	// Failing probes do not keep events from being delivered.
+	if err := app.events.sink.Write(notifications.Event{Action: notifications.EventActionPush}); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		mu.Lock()
+		n := delivered
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the event delivered to the 2 reachable endpoints, delivered %d times", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
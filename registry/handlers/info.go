@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/version"
+)
+
+// storageIdentityParameters are the storage driver parameters identifying the
+// storage used. Only these are reported, so that credentials never are,
+// whatever the parameters holding them are named.
+var storageIdentityParameters = []string{"accountname", "bucket", "container", "prefix", "region", "rootdirectory"}
+
+// registryInfo describes the running registry.
+type registryInfo struct {
+	Version  string            `json:"version"`
+	Revision string            `json:"revision,omitempty"`
+	Storage  map[string]string `json:"storage,omitempty"`
+}
+
+// storageIdentity returns the driver of the storage configured and the
+// parameters identifying the storage it uses.
+func storageIdentity(storage configuration.Storage) map[string]string {
+	identity := map[string]string{"driver": storage.Type()}
+	parameters := storage.Parameters()
+	for _, name := range storageIdentityParameters {
+		switch v := parameters[name].(type) {
+		case nil, map[interface{}]interface{}, map[string]interface{}, []interface{}:
+		default:
+			identity[name] = fmt.Sprint(v)
+		}
+	}
+	return identity
+}
+
+// InfoHandler returns a handler serving the version of the registry and, when
+// enabled in the configuration, the identity of its storage.
+func InfoHandler(config *configuration.Configuration) http.Handler {
+	info := registryInfo{
+		Version:  version.Version,
+		Revision: version.Revision,
+	}
+	if config.HTTP.Debug.Info.Storage {
+		info.Storage = storageIdentity(config.Storage)
+	}
+	p, err := json.Marshal(info)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			dcontext.GetLogger(r.Context()).Errorf("error encoding registry info: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", fmt.Sprint(len(p)))
+		w.Write(p)
+	})
+}
@@ -2,10 +2,14 @@ package handlers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"hash/fnv"
 	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
@@ -17,6 +21,8 @@ import (
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
@@ -32,6 +38,26 @@ const (
 	imageClass          = "image"
 )
 
+// These constants are the modes in which the size of a manifest list's
+// default platform can be reported on HEAD requests.
+const (
+	headSizeModeManifest = "manifest"
+	headSizeModeLayers   = "layers"
+)
+
+// defaultPlatformSizeHeader carries, on HEAD of a manifest list, the size of
+// the image for the configured default platform. It is only set when enabled
+// in the configuration and does not change Content-Length, so spec-compliant
+// clients are unaffected.
+const defaultPlatformSizeHeader = "Docker-Default-Platform-Size"
+
+// unknownManifestErrorCodeHeader names the error code of the requests for
+// manifests which are not found, NAME_UNKNOWN or MANIFEST_UNKNOWN, so that
+// HEAD requests, whose responses have no body, can tell whether the
+// repository or the manifest is missing. It is only set when enabled in the
+// configuration.
+const unknownManifestErrorCodeHeader = "Docker-Distribution-Error-Code"
+
 type storageType int
 
 const (
@@ -43,6 +69,17 @@ const (
 	numStorageTypes                        // 5
 )
 
+// manifestMediaTypes maps the media types clients may accept to the manifest
+// types they select.
+var manifestMediaTypes = map[string]storageType{
+	schema1.MediaTypeManifest:          manifestSchema1,
+	schema1.MediaTypeSignedManifest:    manifestSchema1,
+	schema2.MediaTypeManifest:          manifestSchema2,
+	manifestlist.MediaTypeManifestList: manifestlistSchema,
+	v1.MediaTypeImageManifest:          ociSchema,
+	v1.MediaTypeImageIndex:             ociImageIndexSchema,
+}
+
 // manifestDispatcher takes the request context and builds the
 // appropriate handler for handling manifest requests.
 func manifestDispatcher(ctx *Context, r *http.Request) http.Handler {
@@ -52,7 +89,12 @@ func manifestDispatcher(ctx *Context, r *http.Request) http.Handler {
 	reference := getReference(ctx)
 	dgst, err := digest.Parse(reference)
 	if err != nil {
-		// We just have a tag
+		// We just have a tag, unless the reference is a malformed digest.
+		if err := invalidTagError(reference, ctx.App.maxTagLength); err != nil {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx.Errors = append(ctx.Errors, err)
+			})
+		}
 		manifestHandler.Tag = reference
 	} else {
 		manifestHandler.Digest = dgst
@@ -63,7 +105,7 @@ func manifestDispatcher(ctx *Context, r *http.Request) http.Handler {
 		"HEAD": http.HandlerFunc(manifestHandler.GetManifest),
 	}
 
-	if !ctx.readOnly {
+	if !ctx.readOnly.enabled() {
 		mhandler["PUT"] = http.HandlerFunc(manifestHandler.PutManifest)
 		mhandler["DELETE"] = http.HandlerFunc(manifestHandler.DeleteManifest)
 	}
@@ -89,6 +131,9 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	var supports [numStorageTypes]bool
+	// negotiated is set if the accept header names a manifest media type,
+	// rather than being absent or only holding wildcards.
+	negotiated := false
 
 	// this parsing of Accept headers is not quite as full-featured as godoc.org's parser, but we don't care about "q=" values
 	// https://github.com/golang/gddo/blob/e91d4165076d7474d20abda83f92d15c7ebc3e81/httputil/header/header.go#L165-L202
@@ -103,17 +148,9 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 				continue
 			}
 
-			if mediaType == schema2.MediaTypeManifest {
-				supports[manifestSchema2] = true
-			}
-			if mediaType == manifestlist.MediaTypeManifestList {
-				supports[manifestlistSchema] = true
-			}
-			if mediaType == v1.MediaTypeImageManifest {
-				supports[ociSchema] = true
-			}
-			if mediaType == v1.MediaTypeImageIndex {
-				supports[ociImageIndexSchema] = true
+			if accepted, ok := manifestMediaTypes[mediaType]; ok {
+				supports[accepted] = true
+				negotiated = true
 			}
 		}
 	}
@@ -123,7 +160,7 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		desc, err := tags.Get(imh, imh.Tag)
 		if err != nil {
 			if _, ok := err.(distribution.ErrTagUnknown); ok {
-				imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithDetail(err))
+				imh.manifestUnknown(w, err)
 			} else {
 				imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			}
@@ -144,7 +181,10 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 	manifest, err := manifests.Get(imh, imh.Digest, options...)
 	if err != nil {
 		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
-			imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithDetail(err))
+			if imh.serveNormalized(w, r, manifests) {
+				return
+			}
+			imh.manifestUnknown(w, err)
 		} else {
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		}
@@ -166,6 +206,18 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	if !negotiated {
+		supports = imh.defaultSupports(manifestType)
+	}
+
+	// Manifests fetched by digest are returned as they are, whatever the
+	// accept header: there is nothing else to return which would match the
+	// digest, and clients of artifacts may not know which type to expect.
+	if imh.Tag == "" {
+		supports[ociSchema] = true
+		supports[ociImageIndexSchema] = true
+	}
+
 	if manifestType == ociSchema && !supports[ociSchema] {
 		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithMessage("OCI manifest found, but accept header does not support OCI manifests"))
 		return
@@ -230,13 +282,123 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	compression := imh.App.Config.HTTP.Compression
+	if compression.Enabled && r.Method == http.MethodGet && len(p) >= compression.MinSize && acceptsGzip(r) {
+		// The digest and etag identify the manifest, not its encoding.
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(p); err == nil && zw.Close() == nil {
+			w.Header().Set("Content-Encoding", "gzip")
+			p = buf.Bytes()
+		} else {
+			dcontext.GetLogger(imh).Warnf("unable to compress manifest %s, sending it uncompressed", imh.Digest)
+		}
+	}
+	if compression.Enabled {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
 	w.Header().Set("Content-Type", ct)
 	w.Header().Set("Content-Length", fmt.Sprint(len(p)))
 	w.Header().Set("Docker-Content-Digest", imh.Digest.String())
 	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, imh.Digest))
+	dcontext.SetResponseContentDigest(imh, imh.Digest.String())
+
+	if manifestList, ok := manifest.(*manifestlist.DeserializedManifestList); ok && r.Method == http.MethodHead && imh.App.Config.Compatibility.ManifestList.HeadSize.Enabled {
+		size, err := imh.defaultPlatformSize(manifests, manifestList)
+		if err != nil {
+			dcontext.GetLogger(imh).Warnf("unable to determine default platform size for manifest list %s: %v", imh.Digest, err)
+		} else {
+			w.Header().Set(defaultPlatformSizeHeader, fmt.Sprint(size))
+		}
+	}
+
 	w.Write(p)
 }
 
+// defaultSupports returns the manifest types accepted by a request naming
+// none, for a manifest of the given type. This is the first type of the
+// configured preference order which the manifest is or, fetched by tag, can
+// be converted to, and the type of the manifest itself if there is none.
+func (imh *manifestHandler) defaultSupports(manifestType storageType) [numStorageTypes]bool {
+	target := manifestType
+	for _, mediaType := range imh.App.Config.Compatibility.Negotiation.MediaTypes {
+		preferred := manifestMediaTypes[mediaType]
+		if preferred == manifestType || (imh.Tag != "" && canConvertManifest(manifestType, preferred)) {
+			target = preferred
+			break
+		}
+	}
+
+	var supports [numStorageTypes]bool
+	supports[target] = true
+	return supports
+}
+
+// canConvertManifest reports whether a manifest of type from can be returned
+// as a manifest of type to, a manifest list being returned as the image
+// manifest of the default platform.
+func canConvertManifest(from, to storageType) bool {
+	switch from {
+	case manifestlistSchema:
+		return to == manifestSchema2 || to == manifestSchema1
+	case manifestSchema2:
+		return to == manifestSchema1
+	}
+	return false
+}
+
+// defaultPlatformSize returns the size of the image for the configured
+// default platform of a manifest list: either the size of the platform's
+// manifest or the sum of its layer sizes, depending on the configured mode.
+func (imh *manifestHandler) defaultPlatformSize(manifests distribution.ManifestService, manifestList *manifestlist.DeserializedManifestList) (int64, error) {
+	config := imh.App.Config.Compatibility.ManifestList.HeadSize
+	arch, os := config.Architecture, config.OS
+	if arch == "" {
+		arch = defaultArch
+	}
+	if os == "" {
+		os = defaultOS
+	}
+
+	var target *manifestlist.ManifestDescriptor
+	for i, manifestDescriptor := range manifestList.Manifests {
+		platform := manifestDescriptor.Platform
+		if platform.Architecture == arch && platform.OS == os && (config.Variant == "" || platform.Variant == config.Variant) {
+			target = &manifestList.Manifests[i]
+			break
+		}
+	}
+	if target == nil {
+		return 0, fmt.Errorf("no manifest for platform %s/%s", os, arch)
+	}
+
+	if config.Mode != headSizeModeLayers {
+		return target.Size, nil
+	}
+
+	manifest, err := manifests.Get(imh, target.Digest)
+	if err != nil {
+		return 0, err
+	}
+
+	var layers []distribution.Descriptor
+	switch m := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		layers = m.Layers
+	case *ocischema.DeserializedManifest:
+		layers = m.Layers
+	default:
+		return 0, fmt.Errorf("unsupported manifest type %T for platform %s/%s", manifest, os, arch)
+	}
+
+	var size int64
+	for _, layer := range layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
 func (imh *manifestHandler) convertSchema2Manifest(schema2Manifest *schema2.DeserializedManifest) (distribution.Manifest, error) {
 	targetDescriptor := schema2Manifest.Target()
 	blobs := imh.Repository.Blobs(imh)
@@ -277,6 +439,50 @@ func (imh *manifestHandler) convertSchema2Manifest(schema2Manifest *schema2.Dese
 	return manifest, nil
 }
 
+// acceptsGzip returns whether the Accept-Encoding header of r accepts gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(header, ",") {
+			params := strings.Split(coding, ";")
+			if name := strings.ToLower(strings.TrimSpace(params[0])); name != "gzip" && name != "*" {
+				continue
+			}
+			accepted := true
+			for _, param := range params[1:] {
+				if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+					weight, err := strconv.ParseFloat(q[2:], 64)
+					accepted = err == nil && weight > 0
+				}
+			}
+			return accepted
+		}
+	}
+	return false
+}
+
+// manifestUnknown adds the error of a manifest which is not found. When
+// enabled in the configuration, it is a NAME_UNKNOWN error if the repository
+// has no content, and its code is named in a header.
+func (imh *manifestHandler) manifestUnknown(w http.ResponseWriter, err error) {
+	if !imh.App.Config.Compatibility.UnknownManifest.DistinguishRepository {
+		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithDetail(err))
+		return
+	}
+
+	exists, statErr := storage.RepositoryExists(imh, imh.App.driver, imh.storageName)
+	if statErr != nil {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(statErr))
+		return
+	}
+	if !exists {
+		w.Header().Set(unknownManifestErrorCodeHeader, v2.ErrorCodeNameUnknown.String())
+		imh.Errors = append(imh.Errors, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": imh.Repository.Named().Name()}))
+		return
+	}
+	w.Header().Set(unknownManifestErrorCodeHeader, v2.ErrorCodeManifestUnknown.String())
+	imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithDetail(err))
+}
+
 func etagMatch(r *http.Request, etag string) bool {
 	for _, headerVal := range r.Header["If-None-Match"] {
 		if headerVal == etag || headerVal == fmt.Sprintf(`"%s"`, etag) { // allow quoted or unquoted
@@ -289,21 +495,45 @@ func etagMatch(r *http.Request, etag string) bool {
 // PutManifest validates and stores a manifest in the registry.
 func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("PutImageManifest")
+	if !checkRepositoryCreation(imh.Context) {
+		return
+	}
+
 	manifests, err := imh.Repository.Manifests(imh)
 	if err != nil {
 		imh.Errors = append(imh.Errors, err)
 		return
 	}
 
-	var jsonBuf bytes.Buffer
-	if err := copyFullPayload(imh, w, r, &jsonBuf, maxManifestBodySize, "image manifest PUT"); err != nil {
+	bufferConfig := imh.App.Config.HTTP.ManifestBuffer
+	maxMemory := bufferConfig.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = defaultManifestBufferMaxMemory
+	}
+	jsonBuf := newSpillBuffer(maxMemory, bufferConfig.Dir)
+	defer func() {
+		if err := jsonBuf.Close(); err != nil {
+			dcontext.GetLogger(imh).Errorf("error removing manifest buffer: %v", err)
+		}
+	}()
+
+	if err := copyFullPayload(imh, w, r, jsonBuf, maxManifestBodySize, "image manifest PUT"); err != nil {
 		// copyFullPayload reports the error if necessary
 		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(err.Error()))
 		return
 	}
 
+	// payload may be mapped from the temporary file of jsonBuf, and is not
+	// used once the request is handled: the parsed manifests hold their own
+	// copy.
+	payload, err := jsonBuf.Bytes()
+	if err != nil {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
 	mediaType := r.Header.Get("Content-Type")
-	manifest, desc, err := distribution.UnmarshalManifest(mediaType, jsonBuf.Bytes())
+	manifest, desc, err := distribution.UnmarshalManifest(mediaType, payload)
 	if err != nil {
 		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(err))
 		return
@@ -322,6 +552,28 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Manifests converted to OCI ones are checked and stored as converted,
+	// under the digest of the conversion.
+	original := desc.Digest
+	if imh.App.normalizes(imh.Repository.Named().Name()) {
+		normalized, err := imh.normalize(manifests, manifest)
+		if err != nil {
+			imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(err))
+			return
+		}
+		if normalized != nil {
+			mediaType, payload, err = normalized.Payload()
+			if err != nil {
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+				return
+			}
+			manifest = normalized
+			desc = distribution.Descriptor{MediaType: mediaType, Size: int64(len(payload)), Digest: digest.FromBytes(payload)}
+			imh.Digest = desc.Digest
+			dcontext.GetLogger(imh).Debugf("normalized manifest %s to %s", original, desc.Digest)
+		}
+	}
+
 	isAnOCIManifest := mediaType == v1.MediaTypeImageManifest || mediaType == v1.MediaTypeImageIndex
 
 	if isAnOCIManifest {
@@ -334,14 +586,48 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 	if imh.Tag != "" {
 		options = append(options, distribution.WithTag(imh.Tag))
 	}
+	if p := r.URL.Query().Get("platform"); p != "" {
+		platform, err := storage.ParsePlatform(p)
+		if err != nil {
+			imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(err.Error()))
+			return
+		}
+		options = append(options, storage.WithPlatform(platform))
+	}
 
 	if err := imh.applyResourcePolicy(manifest); err != nil {
 		imh.Errors = append(imh.Errors, err)
 		return
 	}
 
+	if err := imh.admit(mediaType, payload); err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
+	// The tag limit is checked before storing the manifest, so that pushes
+	// over the limit store nothing, and again when storing the tag.
+	if err := imh.checkTagLimit(imh.Repository.Tags(imh)); err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
+	release := func() {}
+	if imh.App.quota != nil {
+		release, err = imh.App.quota.reserveManifest(imh, imh.storageName, desc.Digest, manifest)
+		if err != nil {
+			if _, ok := err.(errcode.Error); !ok {
+				err = errcode.ErrorCodeUnknown.WithDetail(err)
+			}
+			imh.Errors = append(imh.Errors, err)
+			return
+		}
+	}
+
 	_, err = manifests.Put(imh, manifest, options...)
 	if err != nil {
+		release()
+
 		// TODO(stevvooe): These error handling switches really need to be
 		// handled by an app global mapper.
 		if err == distribution.ErrUnsupported {
@@ -362,6 +648,8 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 					imh.Errors = append(imh.Errors, v2.ErrorCodeNameInvalid.WithDetail(err))
 				case distribution.ErrManifestUnverified:
 					imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnverified)
+				case distribution.ErrManifestLayerMediaTypeNotAllowed, distribution.ErrManifestPlatformInvalid, distribution.ErrManifestListTooManyDescriptors:
+					imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(verificationError.Error()))
 				default:
 					if verificationError == digest.ErrDigestInvalidFormat {
 						imh.Errors = append(imh.Errors, v2.ErrorCodeDigestInvalid)
@@ -378,15 +666,19 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Tag this manifest
-	if imh.Tag != "" {
-		tags := imh.Repository.Tags(imh)
-		err = tags.Tag(imh, imh.Tag, desc)
-		if err != nil {
+	if desc.Digest != original {
+		if err := storage.LinkNormalizedManifest(imh, imh.App.driver, imh.storageName, original, desc.Digest); err != nil {
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			return
 		}
+	}
 
+	// Tag this manifest
+	if imh.Tag != "" {
+		if err := imh.tagManifest(desc); err != nil {
+			imh.Errors = append(imh.Errors, err)
+			return
+		}
 	}
 
 	// Construct a canonical url for the uploaded manifest.
@@ -406,11 +698,127 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 
 	w.Header().Set("Location", location)
 	w.Header().Set("Docker-Content-Digest", imh.Digest.String())
+	dcontext.SetResponseContentDigest(imh, imh.Digest.String())
 	w.WriteHeader(http.StatusCreated)
 
 	dcontext.GetLogger(imh).Debug("Succeeded in putting manifest!")
 }
 
+// admit asks the admission webhook, if one is configured, whether the
+// manifest push may proceed.
+func (imh *manifestHandler) admit(mediaType string, payload []byte) error {
+	aw := imh.App.admission
+	if aw == nil {
+		return nil
+	}
+
+	decision, err := aw.review(imh, admissionRequest{
+		Repository: imh.Repository.Named().Name(),
+		Tag:        imh.Tag,
+		Digest:     imh.Digest,
+		MediaType:  mediaType,
+		Manifest:   payload,
+	})
+	if err != nil {
+		if aw.failOpen {
+			dcontext.GetLogger(imh).Warnf("admission webhook failed, accepting manifest push: %v", err)
+			return nil
+		}
+		dcontext.GetLogger(imh).Errorf("admission webhook failed, rejecting manifest push: %v", err)
+		return errcode.ErrorCodeUnavailable.WithMessage("admission webhook unavailable")
+	}
+
+	if !decision.Allowed {
+		message := decision.Message
+		if message == "" {
+			message = "manifest push denied by admission webhook"
+		}
+		return errcode.ErrorCodeDenied.WithMessage(message)
+	}
+
+	return nil
+}
+
+// checkTagLimit returns an error if pushing the tag of the request would
+// bring the repository over the configured number of tags. Overwriting an
+// existing tag is always allowed. Otherwise the tags of the repository are
+// listed, which costs a listing of its tags directory.
+func (imh *manifestHandler) checkTagLimit(tags distribution.TagService) error {
+	limit := imh.App.Config.Policy.MaxTagsPerRepository
+	if limit <= 0 || imh.Tag == "" {
+		return nil
+	}
+
+	exists, err := imh.tagExists(tags)
+	if err != nil || exists {
+		return err
+	}
+
+	all, err := tags.All(imh)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+			return errcode.ErrorCodeUnknown.WithDetail(err)
+		}
+	}
+	if len(all) >= limit {
+		return errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf("repository %s has reached its limit of %d tags; overwrite or delete an existing tag instead", imh.Repository.Named().Name(), limit))
+	}
+	return nil
+}
+
+// tagManifest tags the manifest of desc with the tag of the request. When the
+// number of tags per repository is limited, pushes of new tags to a
+// repository are serialized from checking the limit to storing the tag, so
+// that concurrent pushes to the registry cannot exceed it. Registries sharing
+// storage may still exceed it by the number of pushes racing.
+func (imh *manifestHandler) tagManifest(desc distribution.Descriptor) error {
+	tags := imh.Repository.Tags(imh)
+	if imh.App.Config.Policy.MaxTagsPerRepository > 0 {
+		exists, err := imh.tagExists(tags)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			unlock := imh.App.newTagLocks.lock(imh.storageName)
+			defer unlock()
+			// The tag may have been pushed, or the limit reached, since
+			// the manifest was checked.
+			if err := imh.checkTagLimit(tags); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tags.Tag(imh, imh.Tag, desc); err != nil {
+		return errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	return nil
+}
+
+// tagExists returns whether the tag of the request exists.
+func (imh *manifestHandler) tagExists(tags distribution.TagService) (bool, error) {
+	_, err := tags.Get(imh, imh.Tag)
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		return false, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	return false, nil
+}
+
+// keyedLocks serializes work on keys, hashing them to a fixed set of locks.
+type keyedLocks [64]sync.Mutex
+
+// lock locks the lock of key, returning the function unlocking it.
+func (l *keyedLocks) lock(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	mu := &l[h.Sum32()%uint32(len(l))]
+	mu.Lock()
+	return mu.Unlock
+}
+
 // applyResourcePolicy checks whether the resource class matches what has
 // been authorized and allowed by the policy configuration.
 func (imh *manifestHandler) applyResourcePolicy(manifest distribution.Manifest) error {
@@ -526,12 +934,19 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		case distribution.ErrUnsupported:
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnsupported)
 			return
+		case cache.ErrUnavailable:
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnavailable.WithDetail(err))
+			return
 		default:
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown)
 			return
 		}
 	}
 
+	if imh.App.quota != nil {
+		imh.App.quota.deleteManifest(imh.storageName, imh.Digest)
+	}
+
 	tagService := imh.Repository.Tags(imh)
 	referencedTags, err := tagService.Lookup(imh, distribution.Descriptor{Digest: imh.Digest})
 	if err != nil {
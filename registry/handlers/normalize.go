@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociLayerMediaTypes maps the media types of docker layers to those of their
+// OCI equivalents.
+var ociLayerMediaTypes = map[string]string{
+	schema2.MediaTypeLayer:             v1.MediaTypeImageLayerGzip,
+	schema2.MediaTypeUncompressedLayer: v1.MediaTypeImageLayer,
+	schema2.MediaTypeForeignLayer:      v1.MediaTypeImageLayerNonDistributableGzip,
+}
+
+// normalizes returns whether the pushed docker manifests of the named
+// repository are stored as OCI ones.
+func (app *App) normalizes(name string) bool {
+	for _, re := range app.normalizedRepositories {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize converts a pushed schema2 manifest to an OCI image manifest, and
+// a manifest list to an OCI image index referencing the manifests it lists
+// as they were stored. It returns nil if the manifest is of another type.
+func (imh *manifestHandler) normalize(manifests distribution.ManifestService, m distribution.Manifest) (distribution.Manifest, error) {
+	switch m := m.(type) {
+	case *schema2.DeserializedManifest:
+		return normalizeSchema2(m)
+	case *manifestlist.DeserializedManifestList:
+		if m.MediaType != manifestlist.MediaTypeManifestList {
+			return nil, nil
+		}
+		return imh.normalizeManifestList(manifests, m)
+	}
+	return nil, nil
+}
+
+// normalizeSchema2 converts a schema2 manifest to an OCI image manifest with
+// the same config and layers, remapping their media types.
+func normalizeSchema2(m *schema2.DeserializedManifest) (*ocischema.DeserializedManifest, error) {
+	config := m.Config
+	if config.MediaType == schema2.MediaTypeImageConfig {
+		config.MediaType = v1.MediaTypeImageConfig
+	}
+
+	layers := make([]distribution.Descriptor, len(m.Layers))
+	for i, layer := range m.Layers {
+		if mediaType, ok := ociLayerMediaTypes[layer.MediaType]; ok {
+			layer.MediaType = mediaType
+		}
+		layers[i] = layer
+	}
+
+	return ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageManifest,
+		},
+		Config: config,
+		Layers: layers,
+	})
+}
+
+// normalizeManifestList converts a manifest list to an OCI image index. The
+// manifests it references which were converted when pushed are referenced
+// as they were stored.
+func (imh *manifestHandler) normalizeManifestList(manifests distribution.ManifestService, m *manifestlist.DeserializedManifestList) (*manifestlist.DeserializedManifestList, error) {
+	descriptors := make([]manifestlist.ManifestDescriptor, len(m.Manifests))
+	for i, descriptor := range m.Manifests {
+		normalized, err := storage.NormalizedManifest(imh, imh.App.driver, imh.storageName, descriptor.Digest)
+		if err == nil {
+			stored, err := manifests.Get(imh, normalized)
+			if err != nil {
+				return nil, err
+			}
+			mediaType, payload, err := stored.Payload()
+			if err != nil {
+				return nil, err
+			}
+			descriptor.MediaType = mediaType
+			descriptor.Size = int64(len(payload))
+			descriptor.Digest = normalized
+		} else if _, ok := err.(distribution.ErrManifestUnknownRevision); !ok {
+			return nil, err
+		}
+		descriptors[i] = descriptor
+	}
+
+	index := m.ManifestList
+	index.MediaType = v1.MediaTypeImageIndex
+	index.Manifests = descriptors
+	payload, err := json.MarshalIndent(&index, "", "   ")
+	if err != nil {
+		return nil, err
+	}
+	normalized := new(manifestlist.DeserializedManifestList)
+	if err := normalized.UnmarshalJSON(payload); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// serveNormalized answers a pull by the digest a converted manifest was
+// pushed with, failing it or redirecting it to the converted manifest. It
+// returns false if the digest is not that of a converted manifest.
+func (imh *manifestHandler) serveNormalized(w http.ResponseWriter, r *http.Request, manifests distribution.ManifestService) bool {
+	if imh.Tag != "" || !imh.App.normalizes(imh.Repository.Named().Name()) {
+		return false
+	}
+	normalized, err := storage.NormalizedManifest(imh, imh.App.driver, imh.storageName, imh.Digest)
+	if err != nil {
+		return false
+	}
+	if exists, err := manifests.Exists(imh, normalized); err != nil || !exists {
+		return false
+	}
+
+	if !imh.App.redirectNormalized {
+		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithMessage(
+			fmt.Sprintf("manifest was stored as %s when pushed", normalized)).WithDetail(map[string]string{"normalized": normalized.String()}))
+		return true
+	}
+
+	ref, err := reference.WithDigest(imh.Repository.Named(), normalized)
+	if err != nil {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return true
+	}
+	location, err := imh.urlBuilder.BuildManifestURL(ref)
+	if err != nil {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return true
+	}
+	http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+	return true
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+)
+
+// problemDetails is an RFC 7807 problem details object.
+type problemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// validatePage checks the page configured by name is at most one of a
+// redirect, a body and a problem, redirecting to a valid URL.
+func validatePage(name string, page configuration.Page) error {
+	set := 0
+	if page.Redirect != "" {
+		if _, err := url.Parse(page.Redirect); err != nil {
+			return fmt.Errorf("invalid %s page redirect %q: %v", name, page.Redirect, err)
+		}
+		set++
+	}
+	if page.Body != "" {
+		set++
+	}
+	if page.Problem != nil {
+		set++
+	}
+	if set > 1 {
+		return fmt.Errorf("%s page must set at most one of redirect, body and problem", name)
+	}
+	if page.ContentType != "" && page.Body == "" {
+		return fmt.Errorf("%s page content type set without a body", name)
+	}
+	return nil
+}
+
+// servePage serves the page configured, with status unless a redirect, and
+// reports whether one was configured.
+func servePage(w http.ResponseWriter, r *http.Request, page configuration.Page, status int) bool {
+	switch {
+	case page.Redirect != "":
+		http.Redirect(w, r, page.Redirect, http.StatusFound)
+	case page.Body != "":
+		contentType := page.ContentType
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(page.Body)))
+		w.WriteHeader(status)
+		w.Write([]byte(page.Body))
+	case page.Problem != nil:
+		problem := problemDetails{
+			Type:     page.Problem.Type,
+			Title:    page.Problem.Title,
+			Status:   status,
+			Detail:   page.Problem.Detail,
+			Instance: r.URL.Path,
+		}
+		if problem.Type == "" {
+			problem.Type = "about:blank"
+		}
+		if problem.Title == "" {
+			problem.Title = http.StatusText(status)
+		}
+		p, err := json.Marshal(problem)
+		if err != nil {
+			dcontext.GetLogger(r.Context()).Errorf("error encoding problem details: %v", err)
+			return false
+		}
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(p)))
+		w.WriteHeader(status)
+		w.Write(p)
+	default:
+		return false
+	}
+	return true
+}
+
+// notFound serves the requests matching no route: the root page configured
+// for GET and HEAD requests for /, the not found page configured for the
+// requests outside of the API, and a plain 404 Not Found otherwise.
+func (app *App) notFound(w http.ResponseWriter, r *http.Request) {
+	pages := app.Config.HTTP.Pages
+	if r.URL.Path == "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if servePage(w, r, pages.Root, http.StatusOK) {
+			return
+		}
+	}
+
+	apiPath := strings.TrimSuffix(app.Config.HTTP.Prefix, "/") + "/v2"
+	if r.URL.Path != apiPath && !strings.HasPrefix(r.URL.Path, apiPath+"/") {
+		if servePage(w, r, pages.NotFound, http.StatusNotFound) {
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
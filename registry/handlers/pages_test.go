@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func newPagesTestEnv(t *testing.T, pages configuration.Pages) *testEnv {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.HTTP.Pages = pages
+	return newTestEnvWithConfig(t, &config)
+}
+
+func getPage(t *testing.T, env *testEnv, method, path string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, env.server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error requesting %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading response: %v", err)
+	}
+	return resp, body
+}
+
+func TestPages(t *testing.T) {
+	env := newPagesTestEnv(t, configuration.Pages{
+		Root: configuration.Page{Body: "<h1>registry</h1>", ContentType: "text/html"},
+		NotFound: configuration.Page{Problem: &configuration.Problem{
+			Type:   "https://registry.example.com/problems/not-found",
+			Detail: "only the registry API is served",
+		}},
+	})
+	defer env.Shutdown()
+
+	resp, body := getPage(t, env, http.MethodGet, "/")
+	checkResponse(t, "getting root", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{"Content-Type": []string{"text/html"}})
+	if string(body) != "<h1>registry</h1>" {
+		t.Fatalf("unexpected root body %q", body)
+	}
+	resp, body = getPage(t, env, http.MethodHead, "/")
+	checkResponse(t, "heading root", resp, http.StatusOK)
+	if len(body) != 0 {
+		t.Fatalf("unexpected root body %q", body)
+	}
+
+	for _, path := range []string{"/favicon.ico", "/v1/_ping", "/v2x"} {
+		resp, body := getPage(t, env, http.MethodGet, path)
+		checkResponse(t, "getting "+path, resp, http.StatusNotFound)
+		checkHeaders(t, resp, http.Header{"Content-Type": []string{"application/problem+json"}})
+		var problem problemDetails
+		if err := json.Unmarshal(body, &problem); err != nil {
+			t.Fatalf("unexpected error decoding problem details %q: %v", body, err)
+		}
+		expected := problemDetails{
+			Type:     "https://registry.example.com/problems/not-found",
+			Title:    "Not Found",
+			Status:   http.StatusNotFound,
+			Detail:   "only the registry API is served",
+			Instance: path,
+		}
+		if problem != expected {
+			t.Fatalf("unexpected problem details for %s: %+v != %+v", path, problem, expected)
+		}
+	}
+
+	// The requests of the API matching no route are answered as before.
+	resp, body = getPage(t, env, http.MethodGet, "/v2/foo/bar/unknown")
+	checkResponse(t, "getting unknown API route", resp, http.StatusNotFound)
+	if resp.Header.Get("Content-Type") == "application/problem+json" {
+		t.Fatalf("unexpected problem details for unknown API route: %q", body)
+	}
+	resp, _ = getPage(t, env, http.MethodGet, "/v2/")
+	checkResponse(t, "getting base route", resp, http.StatusOK)
+}
+
+func TestPagesRedirect(t *testing.T) {
+	env := newPagesTestEnv(t, configuration.Pages{
+		Root:     configuration.Page{Redirect: "https://docs.example.com/registry"},
+		NotFound: configuration.Page{Redirect: "https://docs.example.com/"},
+	})
+	defer env.Shutdown()
+
+	resp, _ := getPage(t, env, http.MethodGet, "/")
+	checkResponse(t, "getting root", resp, http.StatusFound)
+	checkHeaders(t, resp, http.Header{"Location": []string{"https://docs.example.com/registry"}})
+
+	resp, _ = getPage(t, env, http.MethodGet, "/index.html")
+	checkResponse(t, "getting unknown path", resp, http.StatusFound)
+	checkHeaders(t, resp, http.Header{"Location": []string{"https://docs.example.com/"}})
+
+	// Other methods than GET and HEAD of the root are not found.
+	resp, _ = getPage(t, env, http.MethodPost, "/")
+	checkResponse(t, "posting root", resp, http.StatusFound)
+	checkHeaders(t, resp, http.Header{"Location": []string{"https://docs.example.com/"}})
+}
+
+func TestPagesUnconfigured(t *testing.T) {
+	env := newPagesTestEnv(t, configuration.Pages{})
+	defer env.Shutdown()
+
+	resp, body := getPage(t, env, http.MethodGet, "/favicon.ico")
+	checkResponse(t, "getting unknown path", resp, http.StatusNotFound)
+	if string(body) != "404 page not found\n" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestPagesInvalid(t *testing.T) {
+	for _, pages := range []configuration.Pages{
+		{Root: configuration.Page{Redirect: "https://docs.example.com/", Body: "registry"}},
+		{NotFound: configuration.Page{Body: "not found", Problem: &configuration.Problem{}}},
+		{NotFound: configuration.Page{ContentType: "text/html"}},
+		{Root: configuration.Page{Redirect: "http://[::1"}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("invalid pages %+v accepted", pages)
+				}
+			}()
+			newPagesTestEnv(t, pages)
+		}()
+	}
+}
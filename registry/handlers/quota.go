@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultQuotaReconcileInterval is the interval at which the usage of
+// repositories is recomputed when none is configured.
+const defaultQuotaReconcileInterval = time.Hour
+
+// quotaTracker enforces the storage quotas of repositories. The usage of a
+// repository is the size of the unique blobs referenced by its manifests,
+// the manifests themselves included. It is computed from the manifests of
+// the repository when first needed, maintained as manifests are pushed and
+// deleted, and periodically recomputed to account for changes made
+// elsewhere, such as by garbage collection or by other registry instances.
+type quotaTracker struct {
+	registry distribution.Namespace
+	// quotas are sorted by decreasing name length, so that the first match
+	// is the most specific.
+	quotas []configuration.RepositoryQuota
+
+	mu           sync.Mutex
+	repositories map[string]*repositoryUsage
+}
+
+// newQuotaTracker returns the quota tracker configured by config, or nil if
+// no quota is configured.
+func newQuotaTracker(config *configuration.Configuration, registry distribution.Namespace) (*quotaTracker, error) {
+	quotas := config.Policy.Quota.Repositories
+	if len(quotas) == 0 {
+		return nil, nil
+	}
+
+	for _, quota := range quotas {
+		if quota.Name == "" {
+			return nil, fmt.Errorf("quota without a repository name")
+		}
+		if quota.Limit <= 0 {
+			return nil, fmt.Errorf("quota of %s must have a positive limit", quota.Name)
+		}
+	}
+
+	sorted := make([]configuration.RepositoryQuota, len(quotas))
+	copy(sorted, quotas)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Name) > len(sorted[j].Name)
+	})
+
+	return &quotaTracker{
+		registry:     registry,
+		quotas:       sorted,
+		repositories: make(map[string]*repositoryUsage),
+	}, nil
+}
+
+// limit returns the quota of the named repository, if it has one.
+func (qt *quotaTracker) limit(name string) (int64, bool) {
+	for _, quota := range qt.quotas {
+		if quota.Name == name || (strings.HasSuffix(quota.Name, "/") && strings.HasPrefix(name, quota.Name)) {
+			return quota.Limit, true
+		}
+	}
+	return 0, false
+}
+
+// usage returns the loaded usage of the named repository, locked.
+func (qt *quotaTracker) usage(ctx context.Context, name string) (*repositoryUsage, error) {
+	qt.mu.Lock()
+	ru, ok := qt.repositories[name]
+	if !ok {
+		ru = &repositoryUsage{}
+		qt.repositories[name] = ru
+	}
+	qt.mu.Unlock()
+
+	ru.mu.Lock()
+	if !ru.loaded {
+		state, err := qt.compute(ctx, name)
+		if err != nil {
+			ru.mu.Unlock()
+			return nil, err
+		}
+		ru.usageState = state
+		ru.loaded = true
+	}
+	return ru, nil
+}
+
+// compute computes the usage of the named repository from its manifests.
+func (qt *quotaTracker) compute(ctx context.Context, name string) (usageState, error) {
+	state := newUsageState()
+
+	named, err := reference.WithName(name)
+	if err != nil {
+		return state, err
+	}
+	repository, err := qt.registry.Repository(ctx, named)
+	if err != nil {
+		return state, err
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return state, err
+	}
+	enumerator, ok := manifests.(distribution.ManifestEnumerator)
+	if !ok {
+		return state, fmt.Errorf("unable to enumerate the manifests of %s", name)
+	}
+
+	err = enumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		manifest, err := manifests.Get(ctx, dgst)
+		if err != nil {
+			// The manifest may have been deleted since it was enumerated.
+			dcontext.GetLogger(ctx).Warnf("quota: unable to get manifest %s of %s: %v", dgst, name, err)
+			return nil
+		}
+		refs, err := quotaReferences(dgst, manifest)
+		if err != nil {
+			return err
+		}
+		state.add(dgst, refs)
+		return nil
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		err = nil
+	}
+	return state, err
+}
+
+// reserveManifest records the push of the manifest dgst to the named
+// repository, unless it would exceed the quota of the repository. The
+// returned function undoes the reservation, in case the push fails.
+func (qt *quotaTracker) reserveManifest(ctx context.Context, name string, dgst digest.Digest, manifest distribution.Manifest) (func(), error) {
+	limit, ok := qt.limit(name)
+	if !ok {
+		return func() {}, nil
+	}
+
+	refs, err := quotaReferences(dgst, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	ru, err := qt.usage(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer ru.mu.Unlock()
+
+	if _, exists := ru.manifests[dgst]; exists {
+		return func() {}, nil
+	}
+	if size := ru.size + ru.added(refs); size > limit {
+		return nil, quotaExceeded(name, size, limit)
+	}
+
+	ru.apply(usageChange{digest: dgst, refs: refs})
+	return func() {
+		ru.mu.Lock()
+		defer ru.mu.Unlock()
+		ru.apply(usageChange{digest: dgst, remove: true})
+	}, nil
+}
+
+// checkBlob returns an error if a blob of the given size uploaded to the
+// named repository would exceed the quota of the repository once
+// referenced.
+func (qt *quotaTracker) checkBlob(ctx context.Context, name string, dgst digest.Digest, size int64) error {
+	limit, ok := qt.limit(name)
+	if !ok {
+		return nil
+	}
+
+	ru, err := qt.usage(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer ru.mu.Unlock()
+
+	total := ru.size + ru.added([]distribution.Descriptor{{Digest: dgst, Size: size}})
+	if total > limit {
+		return quotaExceeded(name, total, limit)
+	}
+	return nil
+}
+
+// deleteManifest records the deletion of the manifest dgst from the named
+// repository.
+func (qt *quotaTracker) deleteManifest(name string, dgst digest.Digest) {
+	qt.mu.Lock()
+	ru, ok := qt.repositories[name]
+	qt.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ru.mu.Lock()
+	defer ru.mu.Unlock()
+	ru.apply(usageChange{digest: dgst, remove: true})
+}
+
+// reconcile recomputes the usage of the repositories tracked so far.
+// Changes made while a repository is being recomputed are replayed on the
+// recomputed usage.
+func (qt *quotaTracker) reconcile(ctx context.Context) {
+	qt.mu.Lock()
+	names := make([]string, 0, len(qt.repositories))
+	for name := range qt.repositories {
+		names = append(names, name)
+	}
+	qt.mu.Unlock()
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+
+		qt.mu.Lock()
+		ru := qt.repositories[name]
+		qt.mu.Unlock()
+
+		ru.mu.Lock()
+		if !ru.loaded {
+			ru.mu.Unlock()
+			continue
+		}
+		ru.reconciling = true
+		ru.pending = nil
+		ru.mu.Unlock()
+
+		// The usage is computed without holding the lock of the
+		// repository, so that pushes proceed meanwhile, and swapped in
+		// once computed.
+		state, err := qt.compute(ctx, name)
+
+		ru.mu.Lock()
+		if err != nil {
+			if ctx.Err() == nil {
+				dcontext.GetLogger(ctx).Errorf("quota: unable to reconcile the usage of %s: %v", name, err)
+			}
+		} else {
+			for _, change := range ru.pending {
+				state.apply(change)
+			}
+			if state.size != ru.size {
+				dcontext.GetLogger(ctx).Infof("quota: reconciled the usage of %s from %d to %d bytes", name, ru.size, state.size)
+			}
+			ru.usageState = state
+		}
+		ru.reconciling = false
+		ru.pending = nil
+		ru.mu.Unlock()
+	}
+}
+
+// startQuotaReconciler schedules a goroutine which periodically reconciles
+// the usage of repositories, until ctx is done.
+func startQuotaReconciler(ctx context.Context, qt *quotaTracker, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultQuotaReconcileInterval
+	}
+
+	go qt.runReconciler(ctx, interval)
+}
+
+// runReconciler reconciles the usage of repositories every interval, until
+// ctx is done.
+func (qt *quotaTracker) runReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			qt.reconcile(ctx)
+		}
+	}
+}
+
+func quotaExceeded(name string, size, limit int64) error {
+	return errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf("push would bring the usage of repository %s to %d bytes, exceeding its quota of %d bytes", name, size, limit))
+}
+
+// quotaReferences returns the blobs whose size counts towards the usage of
+// a repository holding the manifest dgst.
+func quotaReferences(dgst digest.Digest, manifest distribution.Manifest) ([]distribution.Descriptor, error) {
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, err
+	}
+	return append([]distribution.Descriptor{{Digest: dgst, Size: int64(len(payload))}}, manifest.References()...), nil
+}
+
+// repositoryUsage is the usage of a repository, guarded by mu.
+type repositoryUsage struct {
+	mu     sync.Mutex
+	loaded bool
+	usageState
+
+	// reconciling is set while the usage is recomputed, during which
+	// changes are also recorded in pending.
+	reconciling bool
+	pending     []usageChange
+}
+
+func (ru *repositoryUsage) apply(change usageChange) {
+	ru.usageState.apply(change)
+	if ru.reconciling {
+		ru.pending = append(ru.pending, change)
+	}
+}
+
+// usageChange is the push or deletion of a manifest.
+type usageChange struct {
+	digest digest.Digest
+	refs   []distribution.Descriptor
+	remove bool
+}
+
+// usageState counts the manifests referencing each blob of a repository.
+type usageState struct {
+	size      int64
+	manifests map[digest.Digest][]distribution.Descriptor
+	blobs     map[digest.Digest]*blobReferences
+}
+
+type blobReferences struct {
+	size  int64
+	count int
+}
+
+func newUsageState() usageState {
+	return usageState{
+		manifests: make(map[digest.Digest][]distribution.Descriptor),
+		blobs:     make(map[digest.Digest]*blobReferences),
+	}
+}
+
+// added returns the number of bytes refs would add to the usage.
+func (us *usageState) added(refs []distribution.Descriptor) int64 {
+	var size int64
+	seen := make(map[digest.Digest]struct{}, len(refs))
+	for _, ref := range refs {
+		if _, ok := us.blobs[ref.Digest]; ok {
+			continue
+		}
+		if _, ok := seen[ref.Digest]; ok {
+			continue
+		}
+		seen[ref.Digest] = struct{}{}
+		size += ref.Size
+	}
+	return size
+}
+
+// apply applies change, which has no effect if the manifest was already
+// pushed or deleted.
+func (us *usageState) apply(change usageChange) {
+	if change.remove {
+		us.remove(change.digest)
+	} else {
+		us.add(change.digest, change.refs)
+	}
+}
+
+func (us *usageState) add(dgst digest.Digest, refs []distribution.Descriptor) {
+	if _, ok := us.manifests[dgst]; ok {
+		return
+	}
+	us.manifests[dgst] = refs
+
+	for _, ref := range refs {
+		br, ok := us.blobs[ref.Digest]
+		if !ok {
+			br = &blobReferences{size: ref.Size}
+			us.blobs[ref.Digest] = br
+			us.size += ref.Size
+		}
+		br.count++
+	}
+}
+
+func (us *usageState) remove(dgst digest.Digest) {
+	refs, ok := us.manifests[dgst]
+	if !ok {
+		return
+	}
+	delete(us.manifests, dgst)
+
+	for _, ref := range refs {
+		br := us.blobs[ref.Digest]
+		br.count--
+		if br.count == 0 {
+			delete(us.blobs, ref.Digest)
+			us.size -= br.size
+		}
+	}
+}
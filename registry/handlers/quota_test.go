@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func newTestQuotaTracker(t *testing.T, limit int64) *quotaTracker {
+	t.Helper()
+	registry, err := storage.NewRegistry(context.Background(), inmemory.New())
+	if err != nil {
+		t.Fatalf("unexpected error creating registry: %v", err)
+	}
+
+	var config configuration.Configuration
+	config.Policy.Quota.Repositories = []configuration.RepositoryQuota{
+		{Name: "quota/", Limit: limit},
+		{Name: "quota/small", Limit: 1},
+	}
+	qt, err := newQuotaTracker(&config, registry)
+	if err != nil {
+		t.Fatalf("unexpected error creating quota tracker: %v", err)
+	}
+	return qt
+}
+
+// testQuotaManifest returns a manifest referencing a single layer of the
+// given size, and its digest.
+func testQuotaManifest(t *testing.T, layer string, size int64) (digest.Digest, distribution.Manifest) {
+	t.Helper()
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config: distribution.Descriptor{
+			Digest:    digest.FromString("config"),
+			Size:      10,
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+		Layers: []distribution.Descriptor{{
+			Digest:    digest.FromString(layer),
+			Size:      size,
+			MediaType: schema2.MediaTypeLayer,
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating manifest: %v", err)
+	}
+	_, payload, _ := m.Payload()
+	return digest.FromBytes(payload), m
+}
+
+func TestQuotaLimit(t *testing.T) {
+	qt := newTestQuotaTracker(t, 100)
+
+	for name, expected := range map[string]int64{
+		"quota/foo":       100,
+		"quota/small":     1,
+		"quota/small/foo": 100,
+	} {
+		if limit, ok := qt.limit(name); !ok || limit != expected {
+			t.Errorf("unexpected quota of %s: %d, %v", name, limit, ok)
+		}
+	}
+	if _, ok := qt.limit("quotas/foo"); ok {
+		t.Errorf("unexpected quota of quotas/foo")
+	}
+}
+
+// TestQuotaConcurrentReservations checks that concurrent pushes cannot
+// together exceed the quota of a repository.
+func TestQuotaConcurrentReservations(t *testing.T) {
+	const (
+		layerSize = 1000
+		pushes    = 20
+	)
+	ctx := context.Background()
+	qt := newTestQuotaTracker(t, 10*layerSize)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int
+	)
+	for i := 0; i < pushes; i++ {
+		dgst, m := testQuotaManifest(t, fmt.Sprintf("layer-%d", i), layerSize)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := qt.reserveManifest(ctx, "quota/concurrent", dgst, m); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	ru, err := qt.usage(ctx, "quota/concurrent")
+	if err != nil {
+		t.Fatalf("unexpected error getting usage: %v", err)
+	}
+	size := ru.size
+	ru.mu.Unlock()
+
+	if size > 10*layerSize {
+		t.Fatalf("usage of %d bytes exceeds the quota", size)
+	}
+	if accepted == 0 || accepted == pushes {
+		t.Fatalf("unexpected number of accepted pushes: %d", accepted)
+	}
+	if len(ru.manifests) != accepted {
+		t.Fatalf("usage counts %d manifests, %d pushes were accepted", len(ru.manifests), accepted)
+	}
+}
+
+// TestQuotaReconcile checks that reconciliation recomputes the usage of a
+// repository from its stored manifests.
+func TestQuotaReconcile(t *testing.T) {
+	ctx := context.Background()
+	qt := newTestQuotaTracker(t, 10000)
+
+	// A reservation whose manifest is never stored, as when another
+	// instance failed to record the failure of a push.
+	dgst, m := testQuotaManifest(t, "layer", 1000)
+	if _, err := qt.reserveManifest(ctx, "quota/reconcile", dgst, m); err != nil {
+		t.Fatalf("unexpected error reserving manifest: %v", err)
+	}
+
+	checkUsage := func(expected int64) {
+		t.Helper()
+		ru, err := qt.usage(ctx, "quota/reconcile")
+		if err != nil {
+			t.Fatalf("unexpected error getting usage: %v", err)
+		}
+		defer ru.mu.Unlock()
+		if ru.size != expected {
+			t.Fatalf("unexpected usage: %d != %d", ru.size, expected)
+		}
+	}
+
+	_, payload, _ := m.Payload()
+	checkUsage(int64(len(payload)) + 10 + 1000)
+
+	qt.reconcile(ctx)
+	checkUsage(0)
+}
+
+// blockingWalkDriver blocks walks once armed, until released.
+type blockingWalkDriver struct {
+	storagedriver.StorageDriver
+	armed   chan struct{}
+	walking chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingWalkDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	select {
+	case <-d.armed:
+		d.walking <- struct{}{}
+		<-d.release
+	default:
+	}
+	return d.StorageDriver.Walk(ctx, path, f)
+}
+
+// TestQuotaReconcileConcurrentPush checks that pushes proceed while the
+// usage of their repository is recomputed, and are kept in the recomputed
+// usage.
+func TestQuotaReconcileConcurrentPush(t *testing.T) {
+	ctx := context.Background()
+	driver := &blockingWalkDriver{
+		StorageDriver: inmemory.New(),
+		armed:         make(chan struct{}),
+		walking:       make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+	registry, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatalf("unexpected error creating registry: %v", err)
+	}
+	var config configuration.Configuration
+	config.Policy.Quota.Repositories = []configuration.RepositoryQuota{{Name: "quota/", Limit: 10000}}
+	qt, err := newQuotaTracker(&config, registry)
+	if err != nil {
+		t.Fatalf("unexpected error creating quota tracker: %v", err)
+	}
+
+	first, m := testQuotaManifest(t, "first", 1000)
+	if _, err := qt.reserveManifest(ctx, "quota/reconcile", first, m); err != nil {
+		t.Fatalf("unexpected error reserving manifest: %v", err)
+	}
+
+	close(driver.armed)
+	reconciled := make(chan struct{})
+	go func() {
+		qt.reconcile(ctx)
+		close(reconciled)
+	}()
+	<-driver.walking
+
+	second, m := testQuotaManifest(t, "second", 2000)
+	reserved := make(chan error)
+	go func() {
+		_, err := qt.reserveManifest(ctx, "quota/reconcile", second, m)
+		reserved <- err
+	}()
+	select {
+	case err := <-reserved:
+		if err != nil {
+			t.Fatalf("unexpected error reserving manifest: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		close(driver.release)
+		t.Fatal("push held up by the reconciliation of its repository")
+	}
+	close(driver.release)
+	<-reconciled
+
+	ru, err := qt.usage(ctx, "quota/reconcile")
+	if err != nil {
+		t.Fatalf("unexpected error getting usage: %v", err)
+	}
+	defer ru.mu.Unlock()
+	if _, ok := ru.manifests[second]; !ok || len(ru.manifests) != 1 {
+		t.Fatalf("unexpected manifests in the reconciled usage: %v", ru.manifests)
+	}
+}
+
+// TestQuotaReconcilerStops checks that the reconciler returns once its
+// context is done.
+func TestQuotaReconcilerStops(t *testing.T) {
+	qt := newTestQuotaTracker(t, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stopped := make(chan struct{})
+	go func() {
+		qt.runReconciler(ctx, time.Millisecond)
+		close(stopped)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reconciler still running after its context is done")
+	}
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+)
+
+// readOnlyHeader is set on the responses of the base route while the registry
+// is read-only.
+const readOnlyHeader = "Docker-Distribution-Read-Only"
+
+// readOnlyMode is whether the registry is in the read-only maintenance mode.
+// It may be flipped while requests are being served.
+type readOnlyMode struct {
+	v int32
+}
+
+// enabled returns whether the registry is read-only.
+func (m *readOnlyMode) enabled() bool {
+	return atomic.LoadInt32(&m.v) != 0
+}
+
+// set makes the registry read-only or writable, and returns whether that
+// changed its mode.
+func (m *readOnlyMode) set(enabled bool) bool {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	return atomic.SwapInt32(&m.v, v) != v
+}
+
+// cronFields are the fields of a schedule in the format of crontab(5), with
+// the range of their values. Sunday is both 0 and 7 as day of the week.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// cronSchedule is the set of the minutes at which a schedule in the format of
+// crontab(5) fires, a bit set of the values of each of its fields.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny are set if the day of month or the day of the week
+	// is "*". As in cron, if both are restricted, a day matching either
+	// matches the schedule.
+	domAny, dowAny bool
+}
+
+// parseCronSchedule parses a schedule of five fields, each of which is "*", a
+// value, or a range of values "a-b", optionally followed by a step "/n", or a
+// comma separated list of those.
+func parseCronSchedule(spec string) (cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return cronSchedule{}, fmt.Errorf("schedule %q must have %d fields", spec, len(cronFields))
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("invalid %s %q in schedule %q: %v", cronFields[i].name, field, spec, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField returns the bit set of the values of a field of a schedule,
+// which range from min to max.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		values, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			values = part[:i]
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if values != "*" {
+			bounds := strings.SplitN(values, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%s is not within %d-%d", values, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// matches returns whether the schedule fires at the minute of t.
+func (s cronSchedule) matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// readOnlyWindow is a time window the registry is read-only during, starting
+// whenever its schedule fires.
+type readOnlyWindow struct {
+	spec     string
+	schedule cronSchedule
+	duration time.Duration
+}
+
+// active returns whether t is within the window, that is, whether its
+// schedule fired at a minute less than its duration before t.
+func (w readOnlyWindow) active(t time.Time) bool {
+	for start := t.Truncate(time.Minute); start.Add(w.duration).After(t); start = start.Add(-time.Minute) {
+		if w.schedule.matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnlyScheduler makes the registry read-only during its windows, and
+// writable outside of them. Schedules are matched in the time zone of the
+// times now returns.
+type readOnlyScheduler struct {
+	mode    *readOnlyMode
+	windows []readOnlyWindow
+	now     func() time.Time
+}
+
+// update sets the mode of the registry as of the current time, logging the
+// transitions into and out of read-only windows.
+func (s *readOnlyScheduler) update(ctx context.Context) {
+	now := s.now()
+	for _, w := range s.windows {
+		if w.active(now) {
+			if s.mode.set(true) {
+				dcontext.GetLogger(ctx).Infof("entering read-only maintenance window %q lasting %s", w.spec, w.duration)
+			}
+			return
+		}
+	}
+	if s.mode.set(false) {
+		dcontext.GetLogger(ctx).Info("leaving read-only maintenance window")
+	}
+}
+
+// run updates the mode of the registry at the start of every minute, until
+// ctx is done.
+func (s *readOnlyScheduler) run(ctx context.Context) {
+	for {
+		s.update(ctx)
+
+		now := s.now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// parseReadOnlyWindows parses the windows key of the readonly maintenance
+// configuration, a list of windows with a schedule and a duration.
+func parseReadOnlyWindows(v interface{}) []readOnlyWindow {
+	list, ok := v.([]interface{})
+	if !ok {
+		panic("readonly's windows config key must contain a list of windows")
+	}
+
+	windows := make([]readOnlyWindow, 0, len(list))
+	for _, item := range list {
+		window, ok := item.(map[interface{}]interface{})
+		if !ok {
+			panic("readonly windows must contain a schedule and a duration")
+		}
+		spec, ok := window["schedule"].(string)
+		if !ok {
+			panic("readonly window's schedule config key must have a string value")
+		}
+		schedule, err := parseCronSchedule(spec)
+		if err != nil {
+			panic(fmt.Sprintf("invalid readonly window: %v", err))
+		}
+		durationStr, ok := window["duration"].(string)
+		if !ok {
+			panic("readonly window's duration config key must have a string value")
+		}
+		duration, err := time.ParseDuration(durationStr)
+		if err != nil || duration <= 0 {
+			panic(fmt.Sprintf("invalid readonly window duration %q", durationStr))
+		}
+		windows = append(windows, readOnlyWindow{
+			spec:     spec,
+			schedule: schedule,
+			duration: duration,
+		})
+	}
+	return windows
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/reference"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	for _, spec := range []string{
+		"* * * * *",
+		"0 2 * * *",
+		"*/15 1-5 1,15 * 1-5",
+		"30 22 * 1-12/3 0,7",
+	} {
+		if _, err := parseCronSchedule(spec); err != nil {
+			t.Errorf("unexpected error parsing schedule %q: %v", spec, err)
+		}
+	}
+
+	for _, spec := range []string{
+		"",
+		"0 2 * *",
+		"0 2 * * * *",
+		"60 2 * * *",
+		"0 24 * * *",
+		"0 2 0 * *",
+		"0 2 * 13 *",
+		"0 2 * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCronSchedule(spec); err == nil {
+			t.Errorf("expected an error parsing schedule %q", spec)
+		}
+	}
+}
+
+// testWindow parses a window for tests, failing them if it is invalid.
+func testWindow(t *testing.T, spec string, duration time.Duration) readOnlyWindow {
+	t.Helper()
+	schedule, err := parseCronSchedule(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readOnlyWindow{spec: spec, schedule: schedule, duration: duration}
+}
+
+func TestReadOnlySchedulerWindowBoundaries(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 1, 58, 30, 0, time.UTC) // a Friday
+	var mode readOnlyMode
+	scheduler := &readOnlyScheduler{
+		mode: &mode,
+		windows: []readOnlyWindow{
+			testWindow(t, "0 2 * * 1-5", 2*time.Hour),
+			testWindow(t, "30 23 * * 6", time.Hour),
+		},
+		now: func() time.Time { return now },
+	}
+
+	for _, step := range []struct {
+		advance  time.Duration
+		readOnly bool
+	}{
+		{0, false},
+		{time.Minute, false},                  // 01:59:30
+		{30 * time.Second, true},              // 02:00, the window opens
+		{time.Hour + 59*time.Minute, true},    // 03:59
+		{59 * time.Second, true},              // 03:59:59
+		{time.Second, false},                  // 04:00, the window closes
+		{22 * time.Hour, false},               // 02:00 on Saturday is not scheduled
+		{21*time.Hour + 30*time.Minute, true}, // 23:30 on Saturday
+		{59 * time.Minute, true},              // 00:29 on Sunday, past midnight
+		{time.Minute, false},                  // 00:30 on Sunday
+	} {
+		now = now.Add(step.advance)
+		scheduler.update(context.Background())
+		if mode.enabled() != step.readOnly {
+			t.Fatalf("read-only at %s: got %v, expected %v", now, mode.enabled(), step.readOnly)
+		}
+	}
+}
+
+func TestReadOnlySchedulerRejectsWrites(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	now := time.Date(2024, time.March, 1, 1, 59, 0, 0, time.UTC)
+	scheduler := &readOnlyScheduler{
+		mode:    &env.app.readOnly,
+		windows: []readOnlyWindow{testWindow(t, "0 2 * * *", time.Hour)},
+		now:     func() time.Time { return now },
+	}
+
+	imageName, _ := reference.WithName("foo/bar")
+	uploadURL, err := env.builder.BuildBlobUploadURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building layer upload url: %v", err)
+	}
+	baseURL, err := env.builder.BuildBaseURL()
+	if err != nil {
+		t.Fatalf("unexpected error building base url: %v", err)
+	}
+
+	check := func(readOnly bool) {
+		t.Helper()
+		scheduler.update(env.ctx)
+
+		resp, err := http.Get(baseURL)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		resp.Body.Close()
+		checkResponse(t, "checking the base route", resp, http.StatusOK)
+		if got := resp.Header.Get(readOnlyHeader) == "true"; got != readOnly {
+			t.Fatalf("unexpected %s header at %s: %q", readOnlyHeader, now, resp.Header.Get(readOnlyHeader))
+		}
+
+		resp, err = http.Post(uploadURL, "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error starting layer push: %v", err)
+		}
+		resp.Body.Close()
+		if readOnly {
+			checkResponse(t, "starting push in a read-only window", resp, http.StatusMethodNotAllowed)
+		} else {
+			checkResponse(t, "starting push outside of read-only windows", resp, http.StatusAccepted)
+		}
+	}
+
+	check(false)
+	now = now.Add(time.Minute)
+	check(true)
+	now = now.Add(time.Hour)
+	check(false)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxTagLength is the length of the longest tag of the reference grammar.
+const maxTagLength = 128
+
+var anchoredTagRegexp = regexp.MustCompile(`^` + reference.TagRegexp.String() + `$`)
+
+// invalidTagError returns the error the manifest reference ref is rejected
+// with, if it is neither a digest nor a tag of the reference grammar of at
+// most maxLength characters. There is no limit other than the grammar's when
+// maxLength is zero.
+func invalidTagError(ref string, maxLength int) error {
+	// Tags do not have colons, so references with one are digests.
+	if strings.Contains(ref, ":") {
+		if _, err := digest.Parse(ref); err != nil {
+			return v2.ErrorCodeDigestInvalid.WithMessage("invalid digest").WithDetail(err.Error())
+		}
+		return nil
+	}
+	if !anchoredTagRegexp.MatchString(ref) {
+		return v2.ErrorCodeTagInvalid.WithMessage("invalid tag").WithDetail(fmt.Sprintf("tags must match %s", reference.TagRegexp))
+	}
+	if maxLength > 0 && len(ref) > maxLength {
+		return v2.ErrorCodeTagInvalid.WithMessage("invalid tag").WithDetail(fmt.Sprintf("tags must not be longer than %d characters", maxLength))
+	}
+	return nil
+}
+
+// invalidReference serves the requests matching no route. The requests for
+// the manifests of repositories whose name or reference does not conform to
+// the reference grammar, which the routes only match, are rejected with an
+// error telling which, rather than as unknown routes, without accessing
+// storage. Other requests are served by notFound.
+func (app *App) invalidReference(w http.ResponseWriter, r *http.Request) {
+	err := invalidManifestPathError(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(app.Config.HTTP.Prefix, "/")), app.maxTagLength)
+	if err == nil {
+		app.notFound(w, r)
+		return
+	}
+	if serveErr := errcode.ServeJSON(w, err); serveErr != nil {
+		dcontext.GetLogger(app).Errorf("error serving error json: %v (from %v)", serveErr, err)
+	}
+}
+
+// invalidManifestPathError returns the error rejecting the request for the
+// manifest at path, of the form /v2/<name>/manifests/<reference>, if its name
+// or reference is invalid.
+func invalidManifestPathError(path string, maxLength int) error {
+	if !strings.HasPrefix(path, "/v2/") {
+		return nil
+	}
+	i := strings.LastIndex(path, "/manifests/")
+	if i < len("/v2/") {
+		return nil
+	}
+	name, ref := path[len("/v2/"):i], path[i+len("/manifests/"):]
+	if ref == "" || strings.Contains(ref, "/") {
+		return nil
+	}
+	if _, err := reference.WithName(name); err != nil {
+		return v2.ErrorCodeNameInvalid.WithDetail(err.Error())
+	}
+	return invalidTagError(ref, maxLength)
+}
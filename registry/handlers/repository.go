@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/gorilla/handlers"
+)
+
+// repositoryDispatcher constructs the handler creating repositories.
+func repositoryDispatcher(ctx *Context, r *http.Request) http.Handler {
+	repositoryHandler := &repositoryHandler{
+		Context: ctx,
+	}
+
+	handler := handlers.MethodHandler{}
+	if !ctx.readOnly.enabled() {
+		handler["PUT"] = http.HandlerFunc(repositoryHandler.CreateRepository)
+	}
+	return handler
+}
+
+// repositoryHandler handles the creation of repositories ahead of pushes.
+type repositoryHandler struct {
+	*Context
+}
+
+// CreateRepository creates the repository of the request unless it exists,
+// so that it may be pushed to when repositories are not created on push.
+func (rh *repositoryHandler) CreateRepository(w http.ResponseWriter, r *http.Request) {
+	created, err := storage.CreateRepository(rh, rh.App.driver, rh.storageName)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Content-Length", "0")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// checkRepositoryCreation adds an error to the context and returns false if
+// the repository of the context does not exist and the registry does not
+// create repositories on push.
+func checkRepositoryCreation(ctx *Context) bool {
+	if !ctx.App.noAutoCreate {
+		return true
+	}
+
+	exists, err := storage.RepositoryExists(ctx, ctx.App.driver, ctx.storageName)
+	if err != nil {
+		ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return false
+	}
+	if !exists {
+		ctx.Errors = append(ctx.Errors, errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf(
+			"repository %s does not exist and is not created on push: it must be created first", ctx.Repository.Named().Name())))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/proxy"
+)
+
+// defaultRetryAfter is how long clients are asked to wait before retrying
+// throttled or unavailable requests, unless http.retryafter is configured.
+const defaultRetryAfter = 10 * time.Second
+
+// setRetryAfter sets the Retry-After header of a response reporting errs,
+// if the first of them throttles the client or finds the registry
+// unavailable. Errors caused by the upstream of a pull through cache
+// throttling a pull are reported as such, in place of an unknown error, and
+// the delay the upstream asked for takes precedence over the configured one.
+//
+// Apart from the limit of requests in flight on each connection, enforced
+// before requests reach the app, the registry has no rate limiter of its
+// own, and it drains on shutdown by refusing new connections while serving
+// those in flight, rather than by answering 503. The responses given a
+// Retry-After here are thus those of pulls an upstream throttles, and of
+// requests failing while the admission webhook or the blob descriptor cache
+// is unavailable.
+func (app *App) setRetryAfter(w http.ResponseWriter, errs errcode.Errors) {
+	delay := app.Config.HTTP.RetryAfter
+	if delay <= 0 {
+		delay = defaultRetryAfter
+	}
+
+	for i, err := range errs {
+		if e, ok := err.(errcode.Error); ok {
+			if detail, ok := e.Detail.(error); ok {
+				err = detail
+			}
+		}
+
+		var throttled proxy.ErrUpstreamThrottled
+		if !errors.As(err, &throttled) {
+			continue
+		}
+		code := errcode.ErrorCodeTooManyRequests
+		if throttled.StatusCode == http.StatusServiceUnavailable {
+			code = errcode.ErrorCodeUnavailable
+		}
+		errs[i] = code.WithMessage(throttled.Error())
+		if throttled.RetryAfter > 0 {
+			delay = throttled.RetryAfter
+		}
+	}
+
+	if len(errs) == 0 || w.Header().Get("Retry-After") != "" {
+		return
+	}
+	coder, ok := errs[0].(errcode.ErrorCoder)
+	if !ok {
+		return
+	}
+	switch coder.ErrorCode().Descriptor().HTTPStatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// Round up, so that clients do not retry before the delay is over.
+		seconds := int64((delay + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+}
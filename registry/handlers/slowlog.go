@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+)
+
+type routeNameKey struct{}
+
+func (routeNameKey) String() string { return "http.request.route" }
+
+// logSlowRequests wraps handler, serving the named route, to log requests
+// which take longer than threshold to complete. The line is emitted through
+// the context logger with the request, response, repository and
+// authorization subject fields.
+func logSlowRequests(threshold time.Duration, routeName string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler.ServeHTTP(w, r)
+
+		duration := time.Since(start)
+		if duration < threshold {
+			return
+		}
+
+		ctx := withAuthSubjectLogger(dcontext.WithVars(r.Context(), r))
+		ctx = context.WithValue(ctx, routeNameKey{}, routeName)
+		ctx = dcontext.WithLogger(ctx, dcontext.GetLogger(ctx,
+			routeNameKey{},
+			"vars.name",
+			"vars.reference",
+			"vars.digest"))
+		dcontext.GetResponseLogger(ctx).Warnf("slow request took %v, exceeding %v", duration, threshold)
+	})
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogSlowRequests(t *testing.T) {
+	const dgst = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	for _, tc := range []struct {
+		name  string
+		delay time.Duration
+		slow  bool
+	}{
+		{name: "fast request", delay: 0, slow: false},
+		{name: "slow request", delay: 50 * time.Millisecond, slow: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := logrus.New()
+			logger.Out = &buf
+			logger.Formatter = &logrus.JSONFormatter{}
+
+			router := v2.Router()
+			router.GetRoute(v2.RouteNameBlob).Handler(logSlowRequests(20*time.Millisecond, v2.RouteNameBlob,
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					time.Sleep(tc.delay)
+					w.WriteHeader(http.StatusNotFound)
+				})))
+
+			// Prepare the request context as App.ServeHTTP does
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := dcontext.WithRequest(r.Context(), r)
+				ctx, w = dcontext.WithResponseWriter(ctx, w)
+				ctx = dcontext.WithLogger(ctx, logrus.NewEntry(logger))
+				ctx = dcontext.WithLogger(ctx, dcontext.GetRequestLogger(ctx))
+				router.ServeHTTP(w, r.WithContext(ctx))
+			})
+
+			req := httptest.NewRequest("GET", "/v2/foo/bar/blobs/"+dgst, nil)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !tc.slow {
+				if buf.Len() != 0 {
+					t.Fatalf("unexpected log line for a fast request: %s", buf.String())
+				}
+				return
+			}
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("error decoding log line %q: %v", buf.String(), err)
+			}
+
+			for field, expected := range map[string]interface{}{
+				"http.request.method":  "GET",
+				"http.request.route":   v2.RouteNameBlob,
+				"http.response.status": float64(http.StatusNotFound),
+				"vars.name":            "foo/bar",
+				"vars.digest":          dgst,
+			} {
+				if entry[field] != expected {
+					t.Errorf("unexpected %s: got %v, expected %v", field, entry[field], expected)
+				}
+			}
+			if _, ok := entry["http.response.duration"]; !ok {
+				t.Errorf("missing http.response.duration in log line: %s", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+)
+
+// defaultManifestBufferMaxMemory is the size above which pushed manifests
+// are buffered to a temporary file when no other is configured.
+const defaultManifestBufferMaxMemory = 1 << 20
+
+// spillBuffer is an io.Writer which holds up to maxMemory bytes in memory and
+// moves its content to a temporary file in dir once more is written. This
+// keeps large request bodies out of memory while they are received, which
+// may take long for slow clients. Close must be called to remove the
+// temporary file.
+type spillBuffer struct {
+	maxMemory int64
+	dir       string
+
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+
+	// mapped is the content of the temporary file mapped in memory, once
+	// requested
+	mapped []byte
+}
+
+func newSpillBuffer(maxMemory int64, dir string) *spillBuffer {
+	return &spillBuffer{
+		maxMemory: maxMemory,
+		dir:       dir,
+	}
+}
+
+// Write appends p to the buffer, spilling to a temporary file if the buffer
+// grows past maxMemory.
+func (sb *spillBuffer) Write(p []byte) (int, error) {
+	if sb.file == nil && int64(sb.mem.Len()+len(p)) > sb.maxMemory {
+		file, err := ioutil.TempFile(sb.dir, "manifest-")
+		if err != nil {
+			return 0, err
+		}
+		sb.file = file
+
+		if _, err := sb.mem.WriteTo(file); err != nil {
+			return 0, err
+		}
+		sb.mem = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if sb.file != nil {
+		n, err = sb.file.Write(p)
+	} else {
+		n, err = sb.mem.Write(p)
+	}
+	sb.size += int64(n)
+	return n, err
+}
+
+// Bytes returns the content of the buffer. If it was spilled, the content is
+// served from the temporary file, mapped read-only in memory where the
+// platform allows it, rather than read back into the heap. The content must
+// not be used once the buffer is closed.
+func (sb *spillBuffer) Bytes() ([]byte, error) {
+	if sb.file == nil {
+		return sb.mem.Bytes(), nil
+	}
+	if sb.mapped == nil {
+		mapped, err := mapFile(sb.file, sb.size)
+		if err != nil {
+			return nil, err
+		}
+		sb.mapped = mapped
+	}
+	return sb.mapped, nil
+}
+
+// Close releases the buffer, removing its temporary file if any.
+func (sb *spillBuffer) Close() error {
+	if sb.file == nil {
+		return nil
+	}
+
+	var unmapErr error
+	if sb.mapped != nil {
+		unmapErr = unmapFile(sb.mapped)
+		sb.mapped = nil
+	}
+	closeErr := sb.file.Close()
+	err := os.Remove(sb.file.Name())
+	sb.file = nil
+	if err != nil {
+		return err
+	}
+	if unmapErr != nil {
+		return unmapErr
+	}
+	return closeErr
+}
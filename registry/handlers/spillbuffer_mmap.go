@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package handlers
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the size bytes of file read-only in memory, so that they are
+// paged in from the file as they are read.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile releases the memory mapped by mapFile.
+func unmapFile(mapped []byte) error {
+	return syscall.Munmap(mapped)
+}
@@ -0,0 +1,24 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package handlers
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the size bytes of file back in memory, on platforms where
+// files cannot be mapped in memory.
+func mapFile(file *os.File, size int64) ([]byte, error) {
+	p := make([]byte, size)
+	if _, err := file.ReadAt(p, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return p, nil
+}
+
+// unmapFile releases the content read by mapFile.
+func unmapFile(mapped []byte) error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spillbuffer-")
+	if err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	countFiles := func() int {
+		t.Helper()
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("unexpected error reading directory: %v", err)
+		}
+		return len(entries)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		spilled bool
+	}{
+		{"in memory", bytes.Repeat([]byte("a"), 8), false},
+		{"at limit", bytes.Repeat([]byte("b"), 16), false},
+		{"spilled", bytes.Repeat([]byte("c"), 40), true},
+	} {
+		sb := newSpillBuffer(16, dir)
+
+		// Write in small chunks so that spilling happens part way through.
+		for p := tc.content; len(p) > 0; {
+			n := 6
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := sb.Write(p[:n]); err != nil {
+				t.Fatalf("%s: unexpected error writing: %v", tc.name, err)
+			}
+			p = p[n:]
+		}
+
+		if files := countFiles(); tc.spilled != (files == 1) {
+			t.Fatalf("%s: unexpected number of temporary files: %d", tc.name, files)
+		}
+
+		content, err := sb.Bytes()
+		if err != nil {
+			t.Fatalf("%s: unexpected error reading content: %v", tc.name, err)
+		}
+		if !bytes.Equal(content, tc.content) {
+			t.Fatalf("%s: unexpected content: %q", tc.name, content)
+		}
+
+		if err := sb.Close(); err != nil {
+			t.Fatalf("%s: unexpected error closing: %v", tc.name, err)
+		}
+		if files := countFiles(); files != 0 {
+			t.Fatalf("%s: expected temporary file to be removed, found %d files", tc.name, files)
+		}
+	}
+}
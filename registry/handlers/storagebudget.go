@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// storageBudget counts the storage operations of a request against the
+// number it may make.
+type storageBudget struct {
+	limit int64
+	used  int64
+}
+
+type storageBudgetKey struct{}
+
+type storageOperationsKey struct{}
+
+func (storageOperationsKey) String() string { return "storage.operations" }
+
+// withStorageBudget returns a context whose storage operations are counted
+// against a budget of limit.
+func withStorageBudget(ctx context.Context, limit int64) (context.Context, *storageBudget) {
+	budget := &storageBudget{limit: limit}
+	return context.WithValue(ctx, storageBudgetKey{}, budget), budget
+}
+
+// errStorageBudgetExceeded is returned by the storage operations of a request
+// past its budget.
+type errStorageBudgetExceeded struct {
+	limit int64
+}
+
+func (err errStorageBudgetExceeded) Error() string {
+	return fmt.Sprintf("request exceeded its budget of %d storage operations", err.limit)
+}
+
+// spend counts a storage operation of the request of ctx, if it has a
+// budget, failing once the budget is exceeded.
+func spend(ctx context.Context) error {
+	budget, ok := ctx.Value(storageBudgetKey{}).(*storageBudget)
+	if !ok {
+		return nil
+	}
+	if atomic.AddInt64(&budget.used, 1) > budget.limit {
+		return errStorageBudgetExceeded{limit: budget.limit}
+	}
+	return nil
+}
+
+func (budget *storageBudget) operations() int64 {
+	return atomic.LoadInt64(&budget.used)
+}
+
+func (budget *storageBudget) exceeded() bool {
+	return budget.operations() > budget.limit
+}
+
+// storageBudgetExceeded logs the request of ctx exceeding its budget and
+// replaces the errors it failed with by 503 Service Unavailable. The
+// responses already served are left as they are.
+func (app *App) storageBudgetExceeded(ctx *Context, budget *storageBudget) {
+	logCtx := context.WithValue(ctx, storageOperationsKey{}, budget.operations())
+	dcontext.GetLogger(logCtx, storageOperationsKey{}).Warnf("request aborted, exceeding its budget of %d storage operations", budget.limit)
+
+	if ctx.Errors.Len() > 0 {
+		ctx.Errors = errcode.Errors{errcode.ErrorCodeUnavailable.WithDetail(errStorageBudgetExceeded{limit: budget.limit}.Error())}
+	}
+}
+
+// budgetedDriver counts the operations of the requests with a storage budget
+// against it, failing those past the budget. Walks count each path visited.
+type budgetedDriver struct {
+	storagedriver.StorageDriver
+}
+
+var _ storagedriver.StorageDriver = &budgetedDriver{}
+
+func (d *budgetedDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := spend(ctx); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *budgetedDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := spend(ctx); err != nil {
+		return err
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (d *budgetedDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if err := spend(ctx); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func (d *budgetedDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if err := spend(ctx); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.Writer(ctx, path, append)
+}
+
+func (d *budgetedDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if err := spend(ctx); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (d *budgetedDriver) List(ctx context.Context, path string) ([]string, error) {
+	if err := spend(ctx); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.List(ctx, path)
+}
+
+func (d *budgetedDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := spend(ctx); err != nil {
+		return err
+	}
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+func (d *budgetedDriver) Delete(ctx context.Context, path string) error {
+	if err := spend(ctx); err != nil {
+		return err
+	}
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+func (d *budgetedDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	if err := spend(ctx); err != nil {
+		return "", err
+	}
+	return d.StorageDriver.URLFor(ctx, path, options)
+}
+
+func (d *budgetedDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	if err := spend(ctx); err != nil {
+		return err
+	}
+	return d.StorageDriver.Walk(ctx, path, func(fileInfo storagedriver.FileInfo) error {
+		if err := spend(ctx); err != nil {
+			return err
+		}
+		return f(fileInfo)
+	})
+}
+
+// Capabilities reports the capabilities of the wrapped driver.
+func (d *budgetedDriver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.CapabilitiesOf(d.StorageDriver)
+}
+
+// OpenFile opens the file holding the content stored at path, if the wrapped
+// driver implements storagedriver.FileOpener.
+func (d *budgetedDriver) OpenFile(ctx context.Context, path string) (*os.File, error) {
+	if err := spend(ctx); err != nil {
+		return nil, err
+	}
+	return storagedriver.OpenFile(ctx, d.StorageDriver, path)
+}
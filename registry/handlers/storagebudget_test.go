@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+func TestStorageBudget(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.HTTP.StorageBudget.Operations = 50
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	// The requests pushing and pulling an image are within the budget.
+	imageName, _ := reference.WithName("foo/budget")
+	image := pushSchema2Image(t, env, imageName, 2)
+	digestRef, _ := reference.WithDigest(imageName, image.descriptor.Digest)
+	manifestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	resp, err := http.Get(manifestURL)
+	checkErr(t, err, "getting manifest")
+	resp.Body.Close()
+	checkResponse(t, "getting manifest", resp, http.StatusOK)
+
+	// Operations outside of requests are not counted.
+	for i := 0; i < 40; i++ {
+		if _, err := storage.CreateRepository(context.Background(), env.app.driver, fmt.Sprintf("foo/repository%d", i)); err != nil {
+			t.Fatalf("unexpected error creating repository: %v", err)
+		}
+	}
+
+	// Walking every repository for the catalog exceeds the budget.
+	catalogURL, err := env.builder.BuildCatalogURL()
+	checkErr(t, err, "building catalog url")
+	resp, err = http.Get(catalogURL)
+	checkErr(t, err, "getting catalog")
+	defer resp.Body.Close()
+	checkResponse(t, "getting catalog", resp, http.StatusServiceUnavailable)
+	checkBodyHasErrorCodes(t, "getting catalog", resp, errcode.ErrorCodeUnavailable)
+
+	// Each request has a budget of its own.
+	resp, err = http.Get(manifestURL)
+	checkErr(t, err, "getting manifest")
+	resp.Body.Close()
+	checkResponse(t, "getting manifest", resp, http.StatusOK)
+}
@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
@@ -19,7 +21,8 @@ func tagsDispatcher(ctx *Context, r *http.Request) http.Handler {
 	}
 
 	return handlers.MethodHandler{
-		"GET": http.HandlerFunc(tagsHandler.GetTags),
+		"GET":  http.HandlerFunc(tagsHandler.GetTags),
+		"HEAD": http.HandlerFunc(tagsHandler.HeadTags),
 	}
 }
 
@@ -33,6 +36,44 @@ type tagsAPIResponse struct {
 	Tags []string `json:"tags"`
 }
 
+// HeadTags responds with 200 if the repository has at least one tag, and 404
+// otherwise. Unlike GetTags, it does not list the tags of the repository if
+// the tag service can tell whether it has any.
+func (th *tagsHandler) HeadTags(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var (
+		hasTags bool
+		err     error
+	)
+	tagService := th.Repository.Tags(th)
+	if checker, ok := tagService.(distribution.TagChecker); ok {
+		hasTags, err = checker.HasTags(th)
+	} else {
+		var tags []string
+		tags, err = tagService.All(th)
+		hasTags = len(tags) > 0
+	}
+	if err != nil {
+		switch err := err.(type) {
+		case distribution.ErrRepositoryUnknown:
+			th.Errors = append(th.Errors, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": th.Repository.Named().Name()}))
+		case errcode.Error:
+			th.Errors = append(th.Errors, err)
+		default:
+			th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	if !hasTags {
+		th.Errors = append(th.Errors, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": th.Repository.Named().Name()}))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
 // GetTags returns a json list of tags for a specific image name.
 func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
@@ -51,10 +92,32 @@ func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// do pagination if requested
 	q := r.URL.Query()
+	order := q.Get("sort")
+	switch order {
+	case "", tagSortLexical:
+	case tagSortLexicalDescending:
+		sort.Sort(sort.Reverse(sort.StringSlice(tags)))
+	case tagSortPushTime, tagSortPushTimeDescending:
+		tags, err = sortTagsByPushTime(th, tagService, tags, order == tagSortPushTimeDescending)
+		if err != nil {
+			if err == distribution.ErrUnsupported {
+				th.Errors = append(th.Errors, errcode.ErrorCodeUnsupported.WithDetail(map[string]string{"sort": order}))
+			} else {
+				th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			}
+			return
+		}
+	default:
+		th.Errors = append(th.Errors, v2.ErrorCodeTagSortInvalid.WithDetail(map[string]string{"sort": order}))
+		return
+	}
+
+	// do pagination if requested
 	// get entries after latest, if any specified
-	if lastEntry := q.Get("last"); lastEntry != "" {
+	if lastEntry := q.Get("last"); lastEntry != "" && order != "" && order != tagSortLexical {
+		tags = tagsAfter(tags, order, lastEntry)
+	} else if lastEntry != "" {
 		lastEntryIndex := sort.SearchStrings(tags, lastEntry)
 
 		// as`sort.SearchStrings` can return len(tags), if the
@@ -107,3 +170,61 @@ func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// Orders of the tags listed, selected by the sort parameter.
+const (
+	tagSortLexical            = "lexical"
+	tagSortLexicalDescending  = "-lexical"
+	tagSortPushTime           = "pushtime"
+	tagSortPushTimeDescending = "-pushtime"
+)
+
+// sortTagsByPushTime sorts tags by the time they were last pushed, oldest
+// first unless descending, ties broken by name. Tags deleted since they were
+// listed are left out.
+func sortTagsByPushTime(ctx context.Context, tagService distribution.TagService, tags []string, descending bool) ([]string, error) {
+	provider, ok := tagService.(distribution.TagPushTimeProvider)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+
+	pushedAt := make(map[string]time.Time, len(tags))
+	pushed := tags[:0]
+	for _, tag := range tags {
+		t, err := provider.PushTime(ctx, tag)
+		if err != nil {
+			if _, ok := err.(distribution.ErrTagUnknown); ok {
+				continue
+			}
+			return nil, err
+		}
+		pushedAt[tag] = t
+		pushed = append(pushed, tag)
+	}
+
+	sort.SliceStable(pushed, func(i, j int) bool {
+		ti, tj := pushedAt[pushed[i]], pushedAt[pushed[j]]
+		if ti.Equal(tj) {
+			return pushed[i] < pushed[j]
+		}
+		if descending {
+			return ti.After(tj)
+		}
+		return ti.Before(tj)
+	})
+	return pushed, nil
+}
+
+// tagsAfter returns the tags listed after last in the given order. With push
+// time orders, none are if last is no longer tagged, as its position is lost.
+func tagsAfter(tags []string, order, last string) []string {
+	if order == tagSortLexicalDescending {
+		return tags[sort.Search(len(tags), func(i int) bool { return tags[i] < last }):]
+	}
+	for i, tag := range tags {
+		if tag == last {
+			return tags[i+1:]
+		}
+	}
+	return []string{}
+}
@@ -0,0 +1,185 @@
+// Package rewrite provides a registry middleware rewriting repository names,
+// so that repositories may be renamed without clients changing the names
+// they use.
+package rewrite
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	middleware "github.com/distribution/distribution/v3/registry/middleware/registry"
+)
+
+func init() {
+	middleware.Register("rewrite", newRewriteNamespace)
+}
+
+// Rule rewrites the repository names matched by Match to Replace, which may
+// refer to the submatches of Match as in regexp.Regexp.Expand. Match is
+// matched against whole names, as if it were anchored at both ends.
+type Rule struct {
+	Match   *regexp.Regexp
+	Replace string
+}
+
+// namespace rewrites the names of repositories before resolving them in the
+// wrapped namespace.
+type namespace struct {
+	distribution.Namespace
+	rules []Rule
+}
+
+var _ distribution.RepositoryEnumerator = &namespace{}
+var _ distribution.RepositoryRemover = &namespace{}
+var _ distribution.RepositoryStorageNamer = &repository{}
+
+// New returns a namespace resolving repositories in ns after rewriting their
+// names with the first matching rule. A rewritten name is not rewritten
+// again, so rules cannot loop; a chain of renames must be collapsed into a
+// single rule.
+func New(ns distribution.Namespace, rules []Rule) distribution.Namespace {
+	anchored := make([]Rule, len(rules))
+	for i, rule := range rules {
+		anchored[i] = Rule{
+			Match:   regexp.MustCompile(`^(?:` + rule.Match.String() + `)$`),
+			Replace: rule.Replace,
+		}
+	}
+	return &namespace{Namespace: ns, rules: anchored}
+}
+
+func newRewriteNamespace(ctx context.Context, ns distribution.Namespace, options map[string]interface{}) (distribution.Namespace, error) {
+	rules, err := parseRules(options)
+	if err != nil {
+		return nil, err
+	}
+	return New(ns, rules), nil
+}
+
+func parseRules(options map[string]interface{}) ([]Rule, error) {
+	rawRules, ok := options["rules"].([]interface{})
+	if !ok || len(rawRules) == 0 {
+		return nil, fmt.Errorf("rewrite middleware requires a list of rules")
+	}
+
+	rules := make([]Rule, 0, len(rawRules))
+	for i, rawRule := range rawRules {
+		var match, replace interface{}
+		switch rule := rawRule.(type) {
+		case map[interface{}]interface{}:
+			match, replace = rule["match"], rule["replace"]
+		case map[string]interface{}:
+			match, replace = rule["match"], rule["replace"]
+		default:
+			return nil, fmt.Errorf("rewrite rule %d must be a map, not %T", i, rawRule)
+		}
+
+		expr, ok := match.(string)
+		if !ok || expr == "" {
+			return nil, fmt.Errorf("rewrite rule %d requires a match expression", i)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match expression of rewrite rule %d: %v", i, err)
+		}
+		replacement, ok := replace.(string)
+		if !ok || replacement == "" {
+			return nil, fmt.Errorf("rewrite rule %d requires a replacement", i)
+		}
+
+		rules = append(rules, Rule{Match: re, Replace: replacement})
+	}
+	return rules, nil
+}
+
+// rewrite returns the name the named repository is stored under, and whether
+// it differs from name.
+func (ns *namespace) rewrite(name reference.Named) (reference.Named, bool, error) {
+	for _, rule := range ns.rules {
+		match := rule.Match.FindStringSubmatchIndex(name.Name())
+		if match == nil {
+			continue
+		}
+
+		rewritten := string(rule.Match.ExpandString(nil, rule.Replace, name.Name(), match))
+		if rewritten == name.Name() {
+			return name, false, nil
+		}
+		named, err := reference.WithName(rewritten)
+		if err != nil {
+			return nil, false, distribution.ErrRepositoryNameInvalid{
+				Name:   rewritten,
+				Reason: fmt.Errorf("rewritten from %s: %v", name.Name(), err),
+			}
+		}
+		return named, true, nil
+	}
+	return name, false, nil
+}
+
+// Repository returns the repository name is rewritten to. The repository
+// keeps the name it was requested by, which URLs returned to clients are
+// built from.
+func (ns *namespace) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
+	rewritten, ok, err := ns.rewrite(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return ns.Namespace.Repository(ctx, name)
+	}
+
+	dcontext.GetLogger(ctx).Infof("rewrote repository name %s to %s", name.Name(), rewritten.Name())
+	repo, err := ns.Namespace.Repository(ctx, rewritten)
+	if err != nil {
+		return nil, err
+	}
+	return &repository{Repository: repo, name: name}, nil
+}
+
+// Enumerate enumerates the repositories of the wrapped namespace, by the
+// names they are stored under.
+func (ns *namespace) Enumerate(ctx context.Context, ingester func(string) error) error {
+	enumerator, ok := ns.Namespace.(distribution.RepositoryEnumerator)
+	if !ok {
+		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+	return enumerator.Enumerate(ctx, ingester)
+}
+
+// Remove removes the repository name is rewritten to.
+func (ns *namespace) Remove(ctx context.Context, name reference.Named) error {
+	remover, ok := ns.Namespace.(distribution.RepositoryRemover)
+	if !ok {
+		return fmt.Errorf("unable to convert Namespace to RepositoryRemover")
+	}
+
+	rewritten, ok, err := ns.rewrite(name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		dcontext.GetLogger(ctx).Infof("rewrote repository name %s to %s", name.Name(), rewritten.Name())
+	}
+	return remover.Remove(ctx, rewritten)
+}
+
+// repository is a repository resolved under a rewritten name.
+type repository struct {
+	distribution.Repository
+	name reference.Named
+}
+
+// Named returns the name the repository was requested by.
+func (r *repository) Named() reference.Named {
+	return r.name
+}
+
+// StorageName returns the name the repository is stored under.
+func (r *repository) StorageName() reference.Named {
+	return r.Repository.Named()
+}
@@ -0,0 +1,191 @@
+package rewrite
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	middleware "github.com/distribution/distribution/v3/registry/middleware/registry"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func newTestNamespace(t *testing.T) (distribution.Namespace, distribution.Namespace) {
+	t.Helper()
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("unexpected error creating registry: %v", err)
+	}
+
+	ns, err := middleware.Get(ctx, "rewrite", map[string]interface{}{
+		"rules": []interface{}{
+			map[interface{}]interface{}{"match": "^old/(.*)$", "replace": "new/$1"},
+			map[interface{}]interface{}{"match": "^legacy$", "replace": "old/legacy"},
+		},
+	}, registry)
+	if err != nil {
+		t.Fatalf("unexpected error creating middleware: %v", err)
+	}
+	return ns, registry
+}
+
+func tagRepository(t *testing.T, ns distribution.Namespace, name, tag string) {
+	t.Helper()
+	ctx := context.Background()
+	named, _ := reference.WithName(name)
+	repo, err := ns.Repository(ctx, named)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, tag, distribution.Descriptor{Digest: digest.FromString(tag)}); err != nil {
+		t.Fatalf("unexpected error tagging: %v", err)
+	}
+}
+
+func repositoryTags(t *testing.T, ns distribution.Namespace, name string) []string {
+	t.Helper()
+	ctx := context.Background()
+	named, _ := reference.WithName(name)
+	repo, err := ns.Repository(ctx, named)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	tags, err := repo.Tags(ctx).All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil
+		}
+		t.Fatalf("unexpected error listing tags: %v", err)
+	}
+	return tags
+}
+
+func TestRewrite(t *testing.T) {
+	ns, registry := newTestNamespace(t)
+
+	named, _ := reference.WithName("old/app")
+	repo, err := ns.Repository(context.Background(), named)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	if repo.Named().Name() != "old/app" {
+		t.Fatalf("repository does not keep its requested name: %s", repo.Named())
+	}
+	if namer, ok := repo.(distribution.RepositoryStorageNamer); !ok || namer.StorageName().Name() != "new/app" {
+		t.Fatalf("repository does not report the name it is stored under")
+	}
+
+	tagRepository(t, ns, "old/app", "latest")
+	if tags := repositoryTags(t, registry, "new/app"); len(tags) != 1 || tags[0] != "latest" {
+		t.Fatalf("tag pushed to the old name not stored under the new name: %v", tags)
+	}
+	if tags := repositoryTags(t, registry, "old/app"); len(tags) != 0 {
+		t.Fatalf("unexpected tags stored under the old name: %v", tags)
+	}
+	if tags := repositoryTags(t, ns, "new/app"); len(tags) != 1 {
+		t.Fatalf("tag not visible by the new name: %v", tags)
+	}
+
+	// A rewritten name is not rewritten again.
+	tagRepository(t, ns, "legacy", "v1")
+	if tags := repositoryTags(t, registry, "old/legacy"); len(tags) != 1 {
+		t.Fatalf("tag not stored under the rewritten name: %v", tags)
+	}
+	if tags := repositoryTags(t, registry, "new/legacy"); len(tags) != 0 {
+		t.Fatalf("rewritten name was rewritten again: %v", tags)
+	}
+}
+
+func TestRewriteNoMatch(t *testing.T) {
+	ns, registry := newTestNamespace(t)
+
+	named, _ := reference.WithName("other/app")
+	repo, err := ns.Repository(context.Background(), named)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	if _, ok := repo.(*repository); ok {
+		t.Fatalf("unmatched repository was wrapped")
+	}
+
+	tagRepository(t, ns, "other/app", "latest")
+	if tags := repositoryTags(t, registry, "other/app"); len(tags) != 1 {
+		t.Fatalf("tag not stored under the requested name: %v", tags)
+	}
+}
+
+func TestRewriteAnchored(t *testing.T) {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("unexpected error creating registry: %v", err)
+	}
+	rules, err := parseRules(map[string]interface{}{
+		"rules": []interface{}{
+			map[interface{}]interface{}{"match": "old", "replace": "new"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error parsing rules: %v", err)
+	}
+	ns := New(registry, rules)
+
+	for name, want := range map[string]string{
+		"old":      "new",
+		"bold/old": "bold/old",
+		"old/app":  "old/app",
+	} {
+		named, _ := reference.WithName(name)
+		repo, err := ns.Repository(ctx, named)
+		if err != nil {
+			t.Fatalf("unexpected error getting repository: %v", err)
+		}
+		storageName := repo.Named().Name()
+		if namer, ok := repo.(distribution.RepositoryStorageNamer); ok {
+			storageName = namer.StorageName().Name()
+		}
+		if storageName != want {
+			t.Errorf("%s rewritten to %s, want %s", name, storageName, want)
+		}
+	}
+}
+
+func TestRewriteInvalidName(t *testing.T) {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("unexpected error creating registry: %v", err)
+	}
+	rules, err := parseRules(map[string]interface{}{
+		"rules": []interface{}{
+			map[interface{}]interface{}{"match": "^old/(.*)$", "replace": "new//$1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error parsing rules: %v", err)
+	}
+
+	named, _ := reference.WithName("old/app")
+	_, err = New(registry, rules).Repository(ctx, named)
+	if _, ok := err.(distribution.ErrRepositoryNameInvalid); !ok {
+		t.Fatalf("expected an invalid name error, got %v", err)
+	}
+}
+
+func TestParseRulesInvalid(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"rules": []interface{}{}},
+		{"rules": []interface{}{"^old$"}},
+		{"rules": []interface{}{map[interface{}]interface{}{"replace": "new"}}},
+		{"rules": []interface{}{map[interface{}]interface{}{"match": "(", "replace": "new"}}},
+		{"rules": []interface{}{map[interface{}]interface{}{"match": "^old$"}}},
+	} {
+		if _, err := parseRules(options); err == nil {
+			t.Errorf("expected an error for options %v", options)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// defaultCacheProtect is how long the blobs referenced by a manifest
+	// pulled are protected from eviction, when not configured.
+	defaultCacheProtect = time.Hour
+
+	cacheBudgetSaveFrequency = 5 * time.Second
+)
+
+// evictFunc removes the content of a reference from the cache.
+type evictFunc func(reference.Canonical) error
+
+// cachedBlob tracks a blob of the cache. Fields are exported for
+// serialization.
+type cachedBlob struct {
+	Size         int64
+	Accessed     time.Time
+	Repositories map[string]struct{}
+}
+
+// cachedManifest tracks a manifest of the cache and the blobs it references.
+// Fields are exported for serialization.
+type cachedManifest struct {
+	Pulled     time.Time
+	References []digest.Digest
+}
+
+// cacheBudgetState is the state of a cacheBudget saved to storage.
+type cacheBudgetState struct {
+	Blobs     map[digest.Digest]*cachedBlob
+	Manifests map[string]*cachedManifest
+}
+
+// cacheBudget bounds the size of the blobs cached by a pull through cache.
+// Once the blobs cached use more than the budget, the least recently accessed
+// ones are evicted in the background, along with the cached manifests which
+// reference them and are left incomplete. The blobs referenced by a manifest
+// pulled within the protection window are not evicted, so images being
+// pulled stay whole.
+//
+// The methods of a nil cacheBudget do nothing, as there is no budget to
+// enforce.
+type cacheBudget struct {
+	sync.Mutex
+
+	budget  int64
+	protect time.Duration
+	used    int64
+
+	blobs     map[digest.Digest]*cachedBlob
+	manifests map[string]*cachedManifest
+
+	evictBlob     evictFunc
+	evictManifest evictFunc
+
+	driver          driver.StorageDriver
+	pathToStateFile string
+	dirty           bool
+
+	kick chan struct{}
+}
+
+// newCacheBudget returns a cacheBudget of budget bytes, saving its state to
+// path, which evicts blobs and manifests with evictBlob and evictManifest.
+func newCacheBudget(d driver.StorageDriver, path string, budget int64, protect time.Duration, evictBlob, evictManifest evictFunc) *cacheBudget {
+	if protect == 0 {
+		protect = defaultCacheProtect
+	}
+	return &cacheBudget{
+		budget:          budget,
+		protect:         protect,
+		blobs:           make(map[digest.Digest]*cachedBlob),
+		manifests:       make(map[string]*cachedManifest),
+		evictBlob:       evictBlob,
+		evictManifest:   evictManifest,
+		driver:          d,
+		pathToStateFile: path,
+		kick:            make(chan struct{}, 1),
+	}
+}
+
+// start reads the saved state and starts enforcing the budget in the
+// background.
+func (cb *cacheBudget) start(ctx context.Context) error {
+	if err := cb.readState(ctx); err != nil {
+		return err
+	}
+	cb.signal()
+
+	go func() {
+		ticker := time.NewTicker(cacheBudgetSaveFrequency)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cb.kick:
+				cb.enforce(ctx)
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			cb.saveState(ctx)
+		}
+	}()
+	return nil
+}
+
+// signal wakes up the enforcement of the budget if it is exceeded.
+func (cb *cacheBudget) signal() {
+	cb.Lock()
+	exceeded := cb.used > cb.budget
+	cb.Unlock()
+	if !exceeded {
+		return
+	}
+	select {
+	case cb.kick <- struct{}{}:
+	default:
+	}
+}
+
+// addBlob records that a blob of size bytes was cached for the repository.
+func (cb *cacheBudget) addBlob(repo reference.Named, dgst digest.Digest, size int64) {
+	if cb == nil {
+		return
+	}
+	cb.Lock()
+	blob, ok := cb.blobs[dgst]
+	if !ok {
+		blob = &cachedBlob{Size: size, Repositories: make(map[string]struct{})}
+		cb.blobs[dgst] = blob
+		cb.used += size
+	}
+	blob.Accessed = time.Now()
+	blob.Repositories[repo.Name()] = struct{}{}
+	cb.dirty = true
+	cb.Unlock()
+
+	cb.signal()
+}
+
+// touchBlob records an access to a cached blob.
+func (cb *cacheBudget) touchBlob(dgst digest.Digest) {
+	if cb == nil {
+		return
+	}
+	cb.Lock()
+	defer cb.Unlock()
+	if blob, ok := cb.blobs[dgst]; ok {
+		blob.Accessed = time.Now()
+		cb.dirty = true
+	}
+}
+
+// pulledManifest records a pull of a manifest referencing the given blobs,
+// which protects them from eviction for a while.
+func (cb *cacheBudget) pulledManifest(ref reference.Canonical, references []digest.Digest) {
+	if cb == nil {
+		return
+	}
+	cb.Lock()
+	defer cb.Unlock()
+	now := time.Now()
+	cb.manifests[ref.String()] = &cachedManifest{Pulled: now, References: references}
+	for _, dgst := range references {
+		if blob, ok := cb.blobs[dgst]; ok {
+			blob.Accessed = now
+		}
+	}
+	cb.dirty = true
+}
+
+// forgetBlob stops tracking the blob of a repository, once it is removed
+// from the cache otherwise.
+func (cb *cacheBudget) forgetBlob(ref reference.Canonical) {
+	if cb == nil {
+		return
+	}
+	cb.Lock()
+	defer cb.Unlock()
+	blob, ok := cb.blobs[ref.Digest()]
+	if !ok {
+		return
+	}
+	delete(blob.Repositories, ref.Name())
+	if len(blob.Repositories) == 0 {
+		delete(cb.blobs, ref.Digest())
+		cb.used -= blob.Size
+	}
+	cb.dirty = true
+}
+
+// forgetManifest stops tracking a manifest, once it is removed from the
+// cache otherwise.
+func (cb *cacheBudget) forgetManifest(ref reference.Canonical) {
+	if cb == nil {
+		return
+	}
+	cb.Lock()
+	defer cb.Unlock()
+	delete(cb.manifests, ref.String())
+	cb.dirty = true
+}
+
+// usage returns the number of bytes of the blobs cached.
+func (cb *cacheBudget) usage() int64 {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.used
+}
+
+// enforce evicts the least recently accessed blobs which are not protected
+// until the budget is no longer exceeded, and the manifests referencing them.
+func (cb *cacheBudget) enforce(ctx context.Context) {
+	blobs, manifests := cb.selectEvictions(ctx)
+
+	for _, ref := range blobs {
+		if err := cb.evictBlob(ref); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); ok {
+				// removed along with the blob of another repository
+				continue
+			}
+			dcontext.GetLogger(ctx).Errorf("Error evicting blob %s from the cache: %s", ref, err)
+		}
+	}
+	for _, ref := range manifests {
+		if err := cb.evictManifest(ref); err != nil {
+			dcontext.GetLogger(ctx).Errorf("Error evicting manifest %s from the cache: %s", ref, err)
+		}
+	}
+}
+
+// selectEvictions returns the blobs and manifests to evict to keep within the
+// budget, no longer tracking them.
+func (cb *cacheBudget) selectEvictions(ctx context.Context) (blobs, manifests []reference.Canonical) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if cb.used <= cb.budget {
+		return nil, nil
+	}
+
+	protected := make(map[digest.Digest]struct{})
+	since := time.Now().Add(-cb.protect)
+	for _, m := range cb.manifests {
+		if m.Pulled.After(since) {
+			for _, dgst := range m.References {
+				protected[dgst] = struct{}{}
+			}
+		}
+	}
+
+	candidates := make([]digest.Digest, 0, len(cb.blobs))
+	for dgst := range cb.blobs {
+		if _, ok := protected[dgst]; !ok {
+			candidates = append(candidates, dgst)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return cb.blobs[candidates[i]].Accessed.Before(cb.blobs[candidates[j]].Accessed)
+	})
+
+	evicted := make(map[digest.Digest]struct{})
+	for _, dgst := range candidates {
+		if cb.used <= cb.budget {
+			break
+		}
+		blob := cb.blobs[dgst]
+		for name := range blob.Repositories {
+			ref, err := canonicalReference(name, dgst)
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+				continue
+			}
+			blobs = append(blobs, ref)
+		}
+		delete(cb.blobs, dgst)
+		cb.used -= blob.Size
+		evicted[dgst] = struct{}{}
+	}
+	if cb.used > cb.budget {
+		dcontext.GetLogger(ctx).Warnf("Cache uses %d bytes, exceeding its budget of %d bytes with protected blobs", cb.used, cb.budget)
+	}
+
+	for key, m := range cb.manifests {
+		for _, dgst := range m.References {
+			if _, ok := evicted[dgst]; !ok {
+				continue
+			}
+			ref, err := reference.Parse(key)
+			if canonical, ok := ref.(reference.Canonical); err == nil && ok {
+				manifests = append(manifests, canonical)
+			}
+			delete(cb.manifests, key)
+			break
+		}
+	}
+
+	if len(blobs) > 0 {
+		cb.dirty = true
+	}
+	return blobs, manifests
+}
+
+// canonicalReference returns the reference of the named repository's dgst.
+func canonicalReference(name string, dgst digest.Digest) (reference.Canonical, error) {
+	named, err := reference.WithName(name)
+	if err != nil {
+		return nil, err
+	}
+	return reference.WithDigest(named, dgst)
+}
+
+// saveState writes the state of the budget to storage, if it changed.
+func (cb *cacheBudget) saveState(ctx context.Context) {
+	cb.Lock()
+	defer cb.Unlock()
+	if !cb.dirty {
+		return
+	}
+
+	b, err := json.Marshal(cacheBudgetState{Blobs: cb.blobs, Manifests: cb.manifests})
+	if err == nil {
+		err = cb.driver.PutContent(ctx, cb.pathToStateFile, b)
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Error writing cache budget state: %s", err)
+		return
+	}
+	cb.dirty = false
+}
+
+// readState reads the state of the budget from storage, if saved.
+func (cb *cacheBudget) readState(ctx context.Context) error {
+	b, err := cb.driver.GetContent(ctx, cb.pathToStateFile)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	var state cacheBudgetState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+
+	cb.Lock()
+	defer cb.Unlock()
+	if state.Blobs != nil {
+		cb.blobs = state.Blobs
+	}
+	if state.Manifests != nil {
+		cb.manifests = state.Manifests
+	}
+	cb.used = 0
+	for _, blob := range cb.blobs {
+		cb.used += blob.Size
+	}
+	return nil
+}
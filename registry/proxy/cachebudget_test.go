@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// evictions records the references a cacheBudget evicts.
+type evictions struct {
+	sync.Mutex
+	blobs, manifests []string
+}
+
+func (e *evictions) blob(ref reference.Canonical) error {
+	e.Lock()
+	defer e.Unlock()
+	e.blobs = append(e.blobs, ref.String())
+	return nil
+}
+
+func (e *evictions) manifest(ref reference.Canonical) error {
+	e.Lock()
+	defer e.Unlock()
+	e.manifests = append(e.manifests, ref.String())
+	return nil
+}
+
+func newTestCacheBudget(budget int64) (*cacheBudget, *evictions) {
+	e := &evictions{}
+	return newCacheBudget(inmemory.New(), "/cache-budget-state.json", budget, time.Hour, e.blob, e.manifest), e
+}
+
+// addAccessed adds a blob of the foo repository, accessed at the given time.
+func addAccessed(cb *cacheBudget, content string, size int64, accessed time.Time) digest.Digest {
+	name, _ := reference.WithName("foo")
+	dgst := digest.FromString(content)
+	cb.addBlob(name, dgst, size)
+	cb.Lock()
+	cb.blobs[dgst].Accessed = accessed
+	cb.Unlock()
+	return dgst
+}
+
+func TestCacheBudgetEvictsLeastRecentlyAccessed(t *testing.T) {
+	ctx := context.Background()
+	cb, e := newTestCacheBudget(25)
+	start := time.Now().Add(-time.Hour)
+
+	a := addAccessed(cb, "a", 10, start)
+	b := addAccessed(cb, "b", 10, start.Add(time.Second))
+	c := addAccessed(cb, "c", 10, start.Add(2*time.Second))
+	cb.touchBlob(a)
+
+	cb.enforce(ctx)
+	if used := cb.usage(); used != 20 {
+		t.Fatalf("unexpected usage after eviction: %d", used)
+	}
+	if len(e.blobs) != 1 || e.blobs[0] != "foo@"+b.String() {
+		t.Fatalf("expected the least recently accessed blob %s to be evicted, got %v", b, e.blobs)
+	}
+
+	// Filling past the budget keeps evicting the least recently accessed
+	// blobs, keeping the usage bounded.
+	var last digest.Digest
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		last = addAccessed(cb, fmt.Sprint("blob", i), 10, now.Add(time.Duration(i+1)*time.Second))
+		cb.enforce(ctx)
+		if used := cb.usage(); used > 25 {
+			t.Fatalf("usage %d exceeds the budget after adding blob %d", used, i)
+		}
+	}
+	for _, dgst := range []digest.Digest{a, c} {
+		if _, ok := cb.blobs[dgst]; ok {
+			t.Errorf("blob %s accessed before the others was not evicted", dgst)
+		}
+	}
+	if _, ok := cb.blobs[last]; !ok {
+		t.Errorf("the most recently accessed blob %s was evicted", last)
+	}
+	if len(e.blobs) != 21 {
+		t.Errorf("expected 21 evictions, got %d", len(e.blobs))
+	}
+}
+
+func TestCacheBudgetProtectsPulledManifests(t *testing.T) {
+	ctx := context.Background()
+	cb, e := newTestCacheBudget(15)
+	start := time.Now().Add(-time.Hour)
+
+	protected := addAccessed(cb, "protected", 10, start)
+	name, _ := reference.WithName("foo")
+	pulled, _ := reference.WithDigest(name, digest.FromString("pulled manifest"))
+	cb.pulledManifest(pulled, []digest.Digest{protected})
+	cb.Lock()
+	cb.blobs[protected].Accessed = start
+	cb.Unlock()
+
+	evicted := addAccessed(cb, "evicted", 10, start.Add(time.Second))
+	orphaned, _ := reference.WithDigest(name, digest.FromString("orphaned manifest"))
+	cb.pulledManifest(orphaned, []digest.Digest{evicted})
+	cb.Lock()
+	// pulled before the protection window
+	cb.manifests[orphaned.String()].Pulled = start.Add(-2 * time.Hour)
+	cb.Unlock()
+
+	cb.enforce(ctx)
+	if len(e.blobs) != 1 || e.blobs[0] != "foo@"+evicted.String() {
+		t.Fatalf("expected the unprotected blob %s to be evicted, got %v", evicted, e.blobs)
+	}
+	if len(e.manifests) != 1 || e.manifests[0] != orphaned.String() {
+		t.Fatalf("expected the manifest %s referencing the evicted blob to be evicted, got %v", orphaned, e.manifests)
+	}
+
+	// Protected blobs are kept even when they exceed the budget alone.
+	addAccessed(cb, "also protected", 10, start.Add(2*time.Second))
+	cb.pulledManifest(pulled, []digest.Digest{protected, digest.FromString("also protected")})
+	cb.enforce(ctx)
+	if len(e.blobs) != 1 {
+		t.Fatalf("protected blobs were evicted: %v", e.blobs)
+	}
+}
+
+func TestCacheBudgetState(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	e := &evictions{}
+	cb := newCacheBudget(d, "/cache-budget-state.json", 100, 0, e.blob, e.manifest)
+	addAccessed(cb, "a", 10, time.Now())
+	addAccessed(cb, "b", 20, time.Now())
+	cb.saveState(ctx)
+
+	restored := newCacheBudget(d, "/cache-budget-state.json", 100, 0, e.blob, e.manifest)
+	if err := restored.readState(ctx); err != nil {
+		t.Fatalf("unexpected error reading state: %v", err)
+	}
+	if used := restored.usage(); used != 30 {
+		t.Fatalf("unexpected usage after restoring state: %d", used)
+	}
+}
+
+func TestProxyCacheTracksBlobs(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("counted against the cache budget")
+	server, dgst := newBlobUpstream(t, content)
+	proxyRegistry, _ := newTestProxyingRegistry(t, configuration.Proxy{
+		RemoteURL: server.URL,
+		Cache:     configuration.ProxyCache{MaxSize: 1 << 20},
+	})
+
+	name, _ := reference.WithName("foo")
+	repo, err := proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("error getting repository: %v", err)
+	}
+	r, _ := http.NewRequest(http.MethodGet, "", nil)
+	if err := repo.Blobs(ctx).ServeBlob(ctx, httptest.NewRecorder(), r, dgst); err != nil {
+		t.Fatalf("error serving blob: %v", err)
+	}
+
+	// The blob is cached in the background.
+	budget := proxyRegistry.(*proxyingRegistry).budget
+	deadline := time.Now().Add(5 * time.Second)
+	for budget.usage() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if used := budget.usage(); used != int64(len(content)) {
+		t.Fatalf("unexpected usage of the cache: %d", used)
+	}
+}
+
+func TestProxyCacheInvalid(t *testing.T) {
+	_, err := NewRegistryPullThroughCache(context.Background(), nil, inmemory.New(), configuration.Proxy{
+		RemoteURL: "http://localhost",
+		Cache:     configuration.ProxyCache{MaxSize: -1},
+	})
+	if err == nil {
+		t.Fatalf("expected an error for a negative cache budget")
+	}
+}
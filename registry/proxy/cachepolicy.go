@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+)
+
+// cachePolicy decides how the manifests it matches are cached.
+type cachePolicy struct {
+	mediaTypes map[string]bool
+	tags       []*regexp.Regexp
+	ttl        time.Duration
+	noCache    bool
+}
+
+// matches returns whether the policy applies to a manifest of the media type
+// pulled by tag, empty if pulled by digest.
+func (p *cachePolicy) matches(tag, mediaType string) bool {
+	if len(p.mediaTypes) > 0 && !p.mediaTypes[mediaType] {
+		return false
+	}
+	if len(p.tags) == 0 {
+		return true
+	}
+	if tag == "" {
+		return false
+	}
+	for _, re := range p.tags {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvedTag is when a tag was last resolved with the upstream, and the
+// media type of the manifest it pointed at.
+type resolvedTag struct {
+	at        time.Time
+	mediaType string
+}
+
+// cachePolicies are the caching policies of a pull through cache, along with
+// when the tags the policies serve from the cache were resolved.
+type cachePolicies struct {
+	policies []*cachePolicy
+
+	mu       sync.Mutex
+	resolved map[string]resolvedTag
+}
+
+// newCachePolicies returns the configured caching policies, nil if there are
+// none.
+func newCachePolicies(config []configuration.ProxyCachePolicy) (*cachePolicies, error) {
+	if len(config) == 0 {
+		return nil, nil
+	}
+
+	cp := &cachePolicies{resolved: make(map[string]resolvedTag)}
+	for i, c := range config {
+		if c.TTL < 0 {
+			return nil, fmt.Errorf("proxy cache policy %d: ttl must not be negative", i)
+		}
+		if c.NoCache && c.TTL > 0 {
+			return nil, fmt.Errorf("proxy cache policy %d: nocache and ttl are mutually exclusive", i)
+		}
+		p := &cachePolicy{ttl: c.TTL, noCache: c.NoCache}
+		if len(c.MediaTypes) > 0 {
+			p.mediaTypes = make(map[string]bool)
+			for _, mediaType := range c.MediaTypes {
+				p.mediaTypes[mediaType] = true
+			}
+		}
+		for _, pattern := range c.Tags {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("proxy cache policy %d: invalid tags %q: %v", i, pattern, err)
+			}
+			p.tags = append(p.tags, re)
+		}
+		cp.policies = append(cp.policies, p)
+	}
+	return cp, nil
+}
+
+// match returns the first policy applying to a manifest of the media type
+// pulled by tag, empty if pulled by digest, or nil if none does.
+func (cp *cachePolicies) match(tag, mediaType string) *cachePolicy {
+	if cp == nil {
+		return nil
+	}
+	for _, p := range cp.policies {
+		if p.matches(tag, mediaType) {
+			return p
+		}
+	}
+	return nil
+}
+
+// noCache returns whether a manifest of the media type pulled by tag is
+// passed through without being cached.
+func (cp *cachePolicies) noCache(tag, mediaType string) bool {
+	p := cp.match(tag, mediaType)
+	return p != nil && p.noCache
+}
+
+// ttl returns how long a manifest of the media type pulled by tag is
+// cached, or def if no policy sets it.
+func (cp *cachePolicies) ttl(tag, mediaType string, def time.Duration) time.Duration {
+	if p := cp.match(tag, mediaType); p != nil && p.ttl > 0 {
+		return p.ttl
+	}
+	return def
+}
+
+// fresh returns whether the tag of the named repository was resolved with
+// the upstream within the TTL of its policy, so that it is served from the
+// cache.
+func (cp *cachePolicies) fresh(name reference.Named, tag string) bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	resolved, ok := cp.resolved[name.Name()+":"+tag]
+	cp.mu.Unlock()
+	if !ok {
+		return false
+	}
+	p := cp.match(tag, resolved.mediaType)
+	return p != nil && p.ttl > 0 && time.Since(resolved.at) < p.ttl
+}
+
+// resolvedTag records that the tag of the named repository was resolved with
+// the upstream as desc, if its policy serves it from the cache.
+func (cp *cachePolicies) resolvedTag(name reference.Named, tag string, desc distribution.Descriptor) {
+	if p := cp.match(tag, desc.MediaType); p == nil || p.ttl == 0 {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.resolved[name.Name()+":"+tag] = resolvedTag{at: time.Now(), mediaType: desc.MediaType}
+}
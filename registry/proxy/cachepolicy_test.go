@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// taggedUpstream is an upstream serving the foo repository, the tags of
+// which may be moved, counting the requests for each tag.
+type taggedUpstream struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	content  map[digest.Digest][]byte
+	types    map[digest.Digest]string
+	tags     map[string]digest.Digest
+	requests map[string]int
+}
+
+func newTaggedUpstream(t *testing.T) *taggedUpstream {
+	u := &taggedUpstream{
+		content:  make(map[digest.Digest][]byte),
+		types:    make(map[digest.Digest]string),
+		tags:     make(map[string]digest.Digest),
+		requests: make(map[string]int),
+	}
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serve))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *taggedUpstream) add(p []byte, mediaType string) distribution.Descriptor {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	dgst := digest.FromBytes(p)
+	u.content[dgst] = p
+	u.types[dgst] = mediaType
+	return distribution.Descriptor{MediaType: mediaType, Size: int64(len(p)), Digest: dgst}
+}
+
+// pushImage tags a new image with a layer of the given content as tag.
+func (u *taggedUpstream) pushImage(t *testing.T, tag, layer string) (distribution.Descriptor, distribution.Descriptor) {
+	layerDesc := u.add([]byte(layer), schema2.MediaTypeLayer)
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    u.add([]byte(`{"layer":"`+layer+`"}`), schema2.MediaTypeImageConfig),
+		Layers:    []distribution.Descriptor{layerDesc},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, payload, _ := m.Payload()
+	desc := u.add(payload, mediaType)
+	u.tag(tag, desc.Digest)
+	return desc, layerDesc
+}
+
+func (u *taggedUpstream) tag(tag string, dgst digest.Digest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.tags[tag] = dgst
+}
+
+func (u *taggedUpstream) tagRequests(tag string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests[tag]
+}
+
+func (u *taggedUpstream) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/" {
+		return
+	}
+
+	u.mu.Lock()
+	ref := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	dgst, ok := u.tags[ref]
+	if ok {
+		u.requests[ref]++
+	} else {
+		dgst = digest.Digest(ref)
+	}
+	p, ok := u.content[dgst]
+	mediaType := u.types[dgst]
+	u.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if strings.Contains(r.URL.Path, "/blobs/") {
+		mediaType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(p)))
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	if r.Method == http.MethodGet {
+		w.Write(p)
+	}
+}
+
+// pullTag pulls the manifest tagged tag through repo as the manifest
+// handler does, returning its digest.
+func pullTag(t *testing.T, repo distribution.Repository, tag string) digest.Digest {
+	ctx := context.Background()
+	desc, err := repo.Tags(ctx).Get(ctx, tag)
+	if err != nil {
+		t.Fatalf("error resolving tag %s: %v", tag, err)
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manifests.Get(ctx, desc.Digest, distribution.WithTag(tag)); err != nil {
+		t.Fatalf("error pulling manifest tagged %s: %v", tag, err)
+	}
+	return desc.Digest
+}
+
+func TestCachePolicyTTL(t *testing.T) {
+	upstream := newTaggedUpstream(t)
+	proxyRegistry, localRegistry := newTestProxyingRegistry(t, configuration.Proxy{
+		RemoteURL: upstream.URL,
+		Cache: configuration.ProxyCache{
+			Policies: []configuration.ProxyCachePolicy{
+				{Tags: []string{"latest", "dev"}},
+				{Tags: []string{`v[0-9]+(\.[0-9]+)*`}, TTL: time.Hour},
+			},
+		},
+	})
+
+	ctx := context.Background()
+	name, _ := reference.WithName("foo")
+	repo, err := proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, _ := upstream.pushImage(t, "v1.0", "release")
+	latest, _ := upstream.pushImage(t, "latest", "latest")
+	if dgst := pullTag(t, repo, "v1.0"); dgst != release.Digest {
+		t.Fatalf("v1.0 pulled as %s, expected %s", dgst, release.Digest)
+	}
+	if dgst := pullTag(t, repo, "latest"); dgst != latest.Digest {
+		t.Fatalf("latest pulled as %s, expected %s", dgst, latest.Digest)
+	}
+
+	// Once the tags move, the release tag is served from the cache without
+	// contacting the upstream, while latest is revalidated.
+	upstream.pushImage(t, "v1.0", "rebuilt release")
+	moved, _ := upstream.pushImage(t, "latest", "new latest")
+	requests := upstream.tagRequests("v1.0")
+	if dgst := pullTag(t, repo, "v1.0"); dgst != release.Digest {
+		t.Fatalf("v1.0 revalidated as %s within its ttl", dgst)
+	}
+	if n := upstream.tagRequests("v1.0"); n != requests {
+		t.Fatalf("upstream contacted for v1.0 within its ttl")
+	}
+	if dgst := pullTag(t, repo, "latest"); dgst != moved.Digest {
+		t.Fatalf("latest pulled as %s, expected it revalidated as %s", dgst, moved.Digest)
+	}
+
+	// Both manifests are cached.
+	localRepo, err := localRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localManifests, err := localRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dgst := range []digest.Digest{release.Digest, moved.Digest} {
+		if exists, err := localManifests.Exists(ctx, dgst); err != nil || !exists {
+			t.Fatalf("manifest %s not cached: %v", dgst, err)
+		}
+	}
+}
+
+func TestCachePolicyNoCache(t *testing.T) {
+	upstream := newTaggedUpstream(t)
+	proxyRegistry, localRegistry := newTestProxyingRegistry(t, configuration.Proxy{
+		RemoteURL: upstream.URL,
+		Cache: configuration.ProxyCache{
+			Policies: []configuration.ProxyCachePolicy{
+				{Tags: []string{"dev"}, NoCache: true},
+				{MediaTypes: []string{v1.MediaTypeImageIndex}, NoCache: true},
+			},
+		},
+	})
+
+	ctx := context.Background()
+	name, _ := reference.WithName("foo")
+	repo, err := proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, layer := upstream.pushImage(t, "dev", "dev")
+	stable, _ := upstream.pushImage(t, "stable", "stable")
+	index, err := manifestlist.FromDescriptorsWithMediaType([]manifestlist.ManifestDescriptor{{Descriptor: stable}}, v1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ := index.Payload()
+	indexDesc := upstream.add(payload, v1.MediaTypeImageIndex)
+	upstream.tag("multi", indexDesc.Digest)
+
+	for tag, dgst := range map[string]digest.Digest{"dev": dev.Digest, "multi": indexDesc.Digest, "stable": stable.Digest} {
+		if pulled := pullTag(t, repo, tag); pulled != dgst {
+			t.Fatalf("%s pulled as %s, expected %s", tag, pulled, dgst)
+		}
+	}
+
+	localRepo, err := localRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localManifests, err := localRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dgst := range []digest.Digest{dev.Digest, indexDesc.Digest} {
+		if exists, err := localManifests.Exists(ctx, dgst); err != nil || exists {
+			t.Fatalf("manifest %s cached despite its policy: %v", dgst, err)
+		}
+	}
+	for _, tag := range []string{"dev", "multi"} {
+		if _, err := localRepo.Tags(ctx).Get(ctx, tag); err == nil {
+			t.Fatalf("tag %s cached despite its policy", tag)
+		}
+	}
+	if exists, err := localManifests.Exists(ctx, stable.Digest); err != nil || !exists {
+		t.Fatalf("manifest matching no policy not cached: %v", err)
+	}
+
+	// Blobs are cached whatever the policy of the manifests referencing
+	// them.
+	if _, err := repo.Blobs(ctx).Get(ctx, layer.Digest); err != nil {
+		t.Fatalf("error pulling blob: %v", err)
+	}
+	if _, err := localRepo.Blobs(ctx).Stat(ctx, layer.Digest); err != nil {
+		t.Fatalf("blob of a manifest not cached was not cached: %v", err)
+	}
+}
+
+func TestCachePolicyInvalid(t *testing.T) {
+	for _, policy := range []configuration.ProxyCachePolicy{
+		{Tags: []string{"("}},
+		{TTL: -time.Hour},
+		{NoCache: true, TTL: time.Hour},
+	} {
+		if _, err := newCachePolicies([]configuration.ProxyCachePolicy{policy}); err == nil {
+			t.Errorf("expected an error configuring the policy %+v", policy)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	// prefetchAttempts is how many times a pull the upstream throttles is
+	// tried before prefetching fails.
+	prefetchAttempts = 5
+
+	// prefetchThrottleDelay is how long a throttled pull first waits before
+	// it is retried when the upstream does not say, doubling on each retry.
+	prefetchThrottleDelay = 5 * time.Second
+)
+
+// PrefetchedBlob describes a blob of an image PrefetchImage pulled into the
+// cache.
+type PrefetchedBlob struct {
+	distribution.Descriptor
+
+	// Cached is true if the blob was in the cache already.
+	Cached bool
+}
+
+// PrefetchResult describes the content of an image PrefetchImage pulled
+// into the cache.
+type PrefetchResult struct {
+	// Manifests are the digests of the manifest ref resolves to and, if it
+	// is a manifest list or image index, of the manifests it references.
+	Manifests []digest.Digest
+
+	// Blobs are the blobs the manifests reference, in the order they were
+	// pulled.
+	Blobs []PrefetchedBlob
+}
+
+// PrefetchImage pulls the image ref into registry, a pull through cache
+// created by NewRegistryPullThroughCache, ahead of clients pulling it. ref
+// must be tagged or digested. The manifest it resolves to is cached, along
+// with all the platform manifests of a manifest list or image index and
+// every blob they reference, other than foreign layers. If progress is not
+// nil, it is called with each blob once it is cached.
+//
+// Pulls the upstream throttles are retried after the delay it asks for, and
+// prefetching stops when ctx is done, or on reaching a manifest list nested
+// beyond maxDepth levels, storage.DefaultMaxManifestListDepth if zero. The
+// content cached up to an error is reported along with it.
+func PrefetchImage(ctx context.Context, registry distribution.Namespace, ref reference.Named, maxDepth int, progress func(PrefetchedBlob)) (PrefetchResult, error) {
+	if maxDepth <= 0 {
+		maxDepth = storage.DefaultMaxManifestListDepth
+	}
+
+	var result PrefetchResult
+
+	repo, err := registry.Repository(ctx, reference.TrimNamed(ref))
+	if err != nil {
+		return result, err
+	}
+	pr, ok := repo.(*proxiedRepository)
+	if !ok {
+		return result, fmt.Errorf("repository %s is not pulled through a cache", ref.Name())
+	}
+	blobs := pr.blobStore.(*proxyBlobStore)
+
+	var dgst digest.Digest
+	switch ref := ref.(type) {
+	case reference.Canonical:
+		dgst = ref.Digest()
+	case reference.Tagged:
+		err := retryThrottled(ctx, "tag.get", func() error {
+			desc, err := pr.tags.Get(ctx, ref.Tag())
+			dgst = desc.Digest
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+	default:
+		return result, fmt.Errorf("reference %s is neither tagged nor digested", ref)
+	}
+
+	manifests, err := pr.Manifests(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	// The manifests to pull, with the levels of manifest lists referencing
+	// them.
+	type queued struct {
+		dgst  digest.Digest
+		depth int
+	}
+	seen := make(map[digest.Digest]struct{})
+	queue := []queued{{dgst: dgst}}
+	for len(queue) > 0 {
+		var depth int
+		dgst, depth, queue = queue[0].dgst, queue[0].depth, queue[1:]
+		if _, ok := seen[dgst]; ok {
+			continue
+		}
+		seen[dgst] = struct{}{}
+
+		var m distribution.Manifest
+		err := retryThrottled(ctx, "manifest.get", func() (err error) {
+			m, err = manifests.Get(ctx, dgst)
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Manifests = append(result.Manifests, dgst)
+
+		if _, ok := m.(*manifestlist.DeserializedManifestList); ok {
+			if depth+1 > maxDepth {
+				return result, distribution.ErrManifestListTooDeep{Digest: dgst, MaxDepth: maxDepth}
+			}
+			for _, desc := range m.References() {
+				queue = append(queue, queued{dgst: desc.Digest, depth: depth + 1})
+			}
+			continue
+		}
+
+		for _, desc := range m.References() {
+			if _, ok := seen[desc.Digest]; ok || len(desc.URLs) > 0 {
+				continue
+			}
+			seen[desc.Digest] = struct{}{}
+
+			var blob PrefetchedBlob
+			err := retryThrottled(ctx, "blob.prefetch", func() (err error) {
+				blob, err = blobs.prefetch(ctx, desc.Digest)
+				return err
+			})
+			if err != nil {
+				return result, err
+			}
+			dcontext.GetLoggerWithField(ctx, "cached", blob.Cached).Debugf("prefetched blob %s of %s", blob.Digest, ref)
+			result.Blobs = append(result.Blobs, blob)
+			if progress != nil {
+				progress(blob)
+			}
+		}
+	}
+	return result, nil
+}
+
+// retryThrottled calls pull, named operation in the logs, until the
+// upstream does not throttle it, waiting the delay the upstream asks for
+// between attempts, until prefetchAttempts were made or ctx is done.
+func retryThrottled(ctx context.Context, operation string, pull func() error) error {
+	delay := prefetchThrottleDelay
+	for attempt := 1; ; attempt++ {
+		err := pull()
+		var throttled ErrUpstreamThrottled
+		if err == nil || !errors.As(err, &throttled) || attempt == prefetchAttempts {
+			if err == nil && attempt > 1 {
+				logRetried(ctx, operation, attempt, "")
+			}
+			return err
+		}
+
+		wait := throttled.RetryAfter
+		if wait == 0 {
+			wait = delay
+			delay *= 2
+		}
+		logRetry(ctx, operation, attempt, wait, "", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// prefetch pulls the blob dgst into the local store unless it is cached
+// already.
+func (pbs *proxyBlobStore) prefetch(ctx context.Context, dgst digest.Digest) (PrefetchedBlob, error) {
+	if desc, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+		pbs.budget.touchBlob(dgst)
+		return PrefetchedBlob{Descriptor: desc, Cached: true}, nil
+	}
+
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return PrefetchedBlob{}, err
+	}
+
+	// A blob a client is pulling through already is pulled again rather
+	// than waited for, since committing the same content twice is harmless.
+	mu.Lock()
+	_, pulling := inflight[dgst]
+	if !pulling {
+		inflight[dgst] = struct{}{}
+	}
+	mu.Unlock()
+	if !pulling {
+		defer func() {
+			mu.Lock()
+			delete(inflight, dgst)
+			mu.Unlock()
+		}()
+	}
+
+	desc, err := pbs.storeLocal(ctx, dgst)
+	if err != nil {
+		return PrefetchedBlob{}, err
+	}
+
+	blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
+	if err != nil {
+		return PrefetchedBlob{}, err
+	}
+	pbs.scheduler.AddBlob(blobRef, repositoryTTL)
+	return PrefetchedBlob{Descriptor: desc}, nil
+}
@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// imageUpstream is an upstream serving a multi-platform image in the foo
+// repository, throttling the first request for each piece of content.
+type imageUpstream struct {
+	*httptest.Server
+
+	list    digest.Digest
+	blobs   []digest.Digest
+	content map[string][]byte
+	types   map[string]string
+
+	mu        sync.Mutex
+	throttled map[string]bool
+}
+
+func newImageUpstream(t *testing.T) *imageUpstream {
+	u := &imageUpstream{
+		content:   make(map[string][]byte),
+		types:     make(map[string]string),
+		throttled: make(map[string]bool),
+	}
+	addBlob := func(p []byte, mediaType string) distribution.Descriptor {
+		desc := distribution.Descriptor{MediaType: mediaType, Size: int64(len(p)), Digest: digest.FromBytes(p)}
+		if _, ok := u.content["blobs/"+desc.Digest.String()]; !ok {
+			u.blobs = append(u.blobs, desc.Digest)
+		}
+		u.content["blobs/"+desc.Digest.String()] = p
+		return desc
+	}
+
+	// The platforms share a layer.
+	shared := addBlob([]byte("shared layer"), schema2.MediaTypeLayer)
+	var platforms []manifestlist.ManifestDescriptor
+	for _, arch := range []string{"amd64", "arm64"} {
+		m, err := schema2.FromStruct(schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config:    addBlob([]byte(fmt.Sprintf(`{"architecture":%q}`, arch)), schema2.MediaTypeImageConfig),
+			Layers: []distribution.Descriptor{
+				shared,
+				addBlob([]byte("layer for "+arch), schema2.MediaTypeLayer),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, payload, _ := m.Payload()
+		dgst := digest.FromBytes(payload)
+		u.content["manifests/"+dgst.String()] = payload
+		u.types["manifests/"+dgst.String()] = mediaType
+		platforms = append(platforms, manifestlist.ManifestDescriptor{
+			Descriptor: distribution.Descriptor{MediaType: mediaType, Size: int64(len(payload)), Digest: dgst},
+			Platform:   manifestlist.PlatformSpec{Architecture: arch, OS: "linux"},
+		})
+	}
+
+	list, err := manifestlist.FromDescriptors(platforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, payload, _ := list.Payload()
+	u.list = digest.FromBytes(payload)
+	for _, path := range []string{"manifests/latest", "manifests/" + u.list.String()} {
+		u.content[path] = payload
+		u.types[path] = mediaType
+	}
+
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serve))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *imageUpstream) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/" {
+		return
+	}
+
+	u.mu.Lock()
+	key := r.Method + " " + r.URL.Path
+	throttle := !u.throttled[key]
+	u.throttled[key] = true
+	u.mu.Unlock()
+	if throttle {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/foo/")
+	p, ok := u.content[path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	mediaType := u.types[path]
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(p)))
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(p).String())
+	if r.Method == http.MethodGet {
+		w.Write(p)
+	}
+}
+
+func TestPrefetchImage(t *testing.T) {
+	defer func(delay time.Duration) { prefetchThrottleDelay = delay }(prefetchThrottleDelay)
+	prefetchThrottleDelay = time.Millisecond
+
+	upstream := newImageUpstream(t)
+	proxyRegistry, localRegistry := newTestProxyingRegistry(t, configuration.Proxy{RemoteURL: upstream.URL})
+
+	ctx := context.Background()
+	name, _ := reference.WithName("foo")
+	ref, _ := reference.WithTag(name, "latest")
+	var reported []PrefetchedBlob
+	result, err := PrefetchImage(ctx, proxyRegistry, ref, 0, func(blob PrefetchedBlob) {
+		reported = append(reported, blob)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error prefetching image: %v", err)
+	}
+	if len(result.Manifests) != 3 || result.Manifests[0] != upstream.list {
+		t.Fatalf("unexpected manifests prefetched: %v", result.Manifests)
+	}
+	if len(result.Blobs) != len(upstream.blobs) || len(reported) != len(upstream.blobs) {
+		t.Fatalf("prefetched %d blobs and reported %d, expected %d", len(result.Blobs), len(reported), len(upstream.blobs))
+	}
+	for _, blob := range result.Blobs {
+		if blob.Cached {
+			t.Errorf("blob %s reported as cached before it was pulled", blob.Digest)
+		}
+	}
+
+	// All the content is cached, and served without the upstream.
+	localRepo, err := localRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dgst := range upstream.blobs {
+		p, err := localRepo.Blobs(ctx).Get(ctx, dgst)
+		if err != nil {
+			t.Fatalf("blob %s was not cached: %v", dgst, err)
+		}
+		if digest.FromBytes(p) != dgst {
+			t.Fatalf("blob %s was cached with the wrong content", dgst)
+		}
+	}
+	localManifests, err := localRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dgst := range result.Manifests {
+		if exists, err := localManifests.Exists(ctx, dgst); err != nil || !exists {
+			t.Fatalf("manifest %s was not cached: %v", dgst, err)
+		}
+	}
+
+	// Prefetching the image again by digest pulls nothing.
+	canonical, _ := reference.WithDigest(name, upstream.list)
+	result, err = PrefetchImage(ctx, proxyRegistry, canonical, 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected error prefetching image again: %v", err)
+	}
+	if len(result.Blobs) != len(upstream.blobs) {
+		t.Fatalf("prefetched %d blobs again, expected %d", len(result.Blobs), len(upstream.blobs))
+	}
+	for _, blob := range result.Blobs {
+		if !blob.Cached {
+			t.Errorf("cached blob %s was pulled again", blob.Digest)
+		}
+	}
+}
+
+func TestPrefetchImageCanceled(t *testing.T) {
+	defer func(delay time.Duration) { prefetchThrottleDelay = delay }(prefetchThrottleDelay)
+	prefetchThrottleDelay = time.Hour
+
+	upstream, _ := newRateLimitedUpstream(t)
+	proxyRegistry, _ := newTestProxyingRegistry(t, configuration.Proxy{RemoteURL: upstream.URL})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	name, _ := reference.WithName("foo")
+	ref, _ := reference.WithTag(name, "latest")
+	if _, err := PrefetchImage(ctx, proxyRegistry, ref, 0, nil); err != context.DeadlineExceeded {
+		t.Fatalf("expected prefetching a throttled image to end with the context, got %v", err)
+	}
+}
+
+func TestPrefetchImageUntaggedReference(t *testing.T) {
+	upstream := newImageUpstream(t)
+	proxyRegistry, _ := newTestProxyingRegistry(t, configuration.Proxy{RemoteURL: upstream.URL})
+
+	ref, _ := reference.WithName("foo")
+	if _, err := PrefetchImage(context.Background(), proxyRegistry, ref, 0, nil); err == nil {
+		t.Fatal("expected an error prefetching a reference without a tag or digest")
+	}
+}
+
+func TestPrefetchImageNestedLists(t *testing.T) {
+	upstream := newTaggedUpstream(t)
+	proxyRegistry, _ := newTestProxyingRegistry(t, configuration.Proxy{RemoteURL: upstream.URL})
+
+	desc, _ := upstream.pushImage(t, "image", "image")
+	for i := 0; i < 3; i++ {
+		list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{{Descriptor: desc}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, payload, _ := list.Payload()
+		desc = upstream.add(payload, mediaType)
+	}
+	upstream.tag("nested", desc.Digest)
+
+	name, _ := reference.WithName("foo")
+	ref, _ := reference.WithTag(name, "nested")
+	_, err := PrefetchImage(context.Background(), proxyRegistry, ref, 2, nil)
+	if _, ok := err.(distribution.ErrManifestListTooDeep); !ok {
+		t.Fatalf("expected prefetching lists nested beyond the limit to fail, got %v", err)
+	}
+
+	result, err := PrefetchImage(context.Background(), proxyRegistry, ref, 3, nil)
+	if err != nil {
+		t.Fatalf("unexpected error prefetching lists nested within the limit: %v", err)
+	}
+	if len(result.Manifests) != 4 {
+		t.Fatalf("expected the 3 lists and the image prefetched, got %v", result.Manifests)
+	}
+}
+
+func TestRetryThrottledLogs(t *testing.T) {
+	ctx, buf := newLoggingContext()
+	attempts := 0
+	err := retryThrottled(ctx, "manifest.get", func() error {
+		attempts++
+		if attempts == 1 {
+			return ErrUpstreamThrottled{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Millisecond}
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("unexpected result retrying a throttled pull: %d attempts, %v", attempts, err)
+	}
+
+	entries := logEntries(t, buf)
+	if len(entries) != 2 {
+		t.Fatalf("expected a retry and a success logged: %v", entries)
+	}
+	retried, succeeded := entries[0], entries[1]
+	for key, value := range map[string]interface{}{
+		"level":             "warning",
+		"http.request.id":   "request-1",
+		"proxy.operation":   "manifest.get",
+		"proxy.attempt":     float64(1),
+		"proxy.backoff":     "1ms",
+		"proxy.error.class": "throttled",
+	} {
+		if retried[key] != value {
+			t.Errorf("retry logged with %s %v, expected %v", key, retried[key], value)
+		}
+	}
+	if succeeded["level"] != "info" || succeeded["proxy.attempts"] != float64(2) || succeeded["http.request.id"] != "request-1" {
+		t.Errorf("unexpected success logged: %v", succeeded)
+	}
+}
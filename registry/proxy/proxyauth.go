@@ -5,75 +5,43 @@ import (
 	"net/url"
 	"strings"
 
-	"github.com/distribution/distribution/v3/context"
-	"github.com/distribution/distribution/v3/registry/client/auth"
 	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
 )
 
 const challengeHeader = "Docker-Distribution-Api-Version"
 
-type userpass struct {
+// credentials presents a username and password to the token authentication
+// URLs an upstream challenges with. The URLs are discovered on first use,
+// along with the challenges of the upstream.
+type credentials struct {
 	username string
 	password string
-}
-
-type credentials struct {
-	creds map[string]userpass
+	cm       challenge.Manager
+	endpoint url.URL
 }
 
 func (c credentials) Basic(u *url.URL) (string, string) {
-	up := c.creds[u.String()]
-
-	return up.username, up.password
-}
-
-func (c credentials) RefreshToken(u *url.URL, service string) string {
-	return ""
-}
-
-func (c credentials) SetRefreshToken(u *url.URL, service, token string) {
-}
-
-// configureAuth stores credentials for challenge responses
-func configureAuth(username, password, remoteURL string) (auth.CredentialStore, error) {
-	creds := map[string]userpass{}
-
-	authURLs, err := getAuthURLs(remoteURL)
+	challenges, err := c.cm.GetChallenges(c.endpoint)
 	if err != nil {
-		return nil, err
+		return "", ""
 	}
-
-	for _, url := range authURLs {
-		context.GetLogger(context.Background()).Infof("Discovered token authentication URL: %s", url)
-		creds[url] = userpass{
-			username: username,
-			password: password,
+	for _, ch := range challenges {
+		if strings.EqualFold(ch.Scheme, "bearer") && ch.Parameters["realm"] == u.String() {
+			return c.username, c.password
 		}
 	}
-
-	return credentials{creds: creds}, nil
+	return "", ""
 }
 
-func getAuthURLs(remoteURL string) ([]string, error) {
-	authURLs := []string{}
-
-	resp, err := http.Get(remoteURL + "/v2/")
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	for _, c := range challenge.ResponseChallenges(resp) {
-		if strings.EqualFold(c.Scheme, "bearer") {
-			authURLs = append(authURLs, c.Parameters["realm"])
-		}
-	}
+func (c credentials) RefreshToken(u *url.URL, service string) string {
+	return ""
+}
 
-	return authURLs, nil
+func (c credentials) SetRefreshToken(u *url.URL, service, token string) {
 }
 
-func ping(manager challenge.Manager, endpoint, versionHeader string) error {
-	resp, err := http.Get(endpoint)
+func ping(client *http.Client, manager challenge.Manager, endpoint, versionHeader string) error {
+	resp, err := client.Get(endpoint)
 	if err != nil {
 		return err
 	}
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -20,6 +22,12 @@ type proxyBlobStore struct {
 	scheduler      *scheduler.TTLExpirationScheduler
 	repositoryName reference.Named
 	authChallenger authChallenger
+	budget         *cacheBudget
+
+	// ignoreContentLength accepts blobs whose length differs from the
+	// Content-Length advertised by the upstream, as long as their content
+	// matches their digest.
+	ignoreContentLength bool
 }
 
 var _ distribution.BlobStore = &proxyBlobStore{}
@@ -31,20 +39,33 @@ var inflight = make(map[digest.Digest]struct{})
 var mu sync.Mutex
 
 func setResponseHeaders(w http.ResponseWriter, length int64, mediaType string, digest digest.Digest) {
-	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
 	w.Header().Set("Content-Type", mediaType)
 	w.Header().Set("Docker-Content-Digest", digest.String())
 	w.Header().Set("Etag", digest.String())
 }
 
+// copyContent copies the blob dgst fetched from the upstream to writer,
+// returning an error if its content does not match its digest or, unless
+// ignoreContentLength is set, its length differs from that advertised.
 func (pbs *proxyBlobStore) copyContent(ctx context.Context, dgst digest.Digest, writer io.Writer) (distribution.Descriptor, error) {
+	if err := dgst.Validate(); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
 	desc, err := pbs.remoteStore.Stat(ctx, dgst)
 	if err != nil {
 		return distribution.Descriptor{}, err
 	}
 
 	if w, ok := writer.(http.ResponseWriter); ok {
-		setResponseHeaders(w, desc.Size, desc.MediaType, dgst)
+		length := desc.Size
+		if pbs.ignoreContentLength {
+			length = -1
+		}
+		setResponseHeaders(w, length, desc.MediaType, dgst)
 	}
 
 	remoteReader, err := pbs.remoteStore.Open(ctx, dgst)
@@ -54,11 +75,32 @@ func (pbs *proxyBlobStore) copyContent(ctx context.Context, dgst digest.Digest,
 
 	defer remoteReader.Close()
 
-	_, err = io.CopyN(writer, remoteReader, desc.Size)
+	// Read one byte past the advertised length, to tell an upstream sending
+	// more than it advertised.
+	var reader io.Reader = remoteReader
+	if !pbs.ignoreContentLength {
+		reader = io.LimitReader(remoteReader, desc.Size+1)
+	}
+	verifier := dgst.Verifier()
+	n, err := io.Copy(io.MultiWriter(writer, verifier), reader)
 	if err != nil {
 		return distribution.Descriptor{}, err
 	}
 
+	if n != desc.Size {
+		if !pbs.ignoreContentLength {
+			return distribution.Descriptor{}, fmt.Errorf("upstream sent %d bytes of blob %s, advertised %d", n, dgst, desc.Size)
+		}
+		dcontext.GetLogger(ctx).Warnf("upstream sent %d bytes of blob %s, advertised %d", n, dgst, desc.Size)
+		desc.Size = n
+	}
+	if !verifier.Verified() {
+		return distribution.Descriptor{}, distribution.ErrBlobInvalidDigest{
+			Digest: dgst,
+			Reason: errors.New("content fetched from upstream does not match digest"),
+		}
+	}
+
 	proxyMetrics.BlobPush(uint64(desc.Size))
 
 	return desc, nil
@@ -73,36 +115,36 @@ func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter
 	}
 
 	proxyMetrics.BlobPush(uint64(localDesc.Size))
+	pbs.budget.touchBlob(dgst)
 	return true, pbs.localStore.ServeBlob(ctx, w, r, dgst)
 }
 
-func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) error {
-	defer func() {
-		mu.Lock()
-		delete(inflight, dgst)
-		mu.Unlock()
-	}()
-
+func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	var desc distribution.Descriptor
 	var err error
 	var bw distribution.BlobWriter
 
 	bw, err = pbs.localStore.Create(ctx)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
 	desc, err = pbs.copyContent(ctx, dgst, bw)
 	if err != nil {
-		return err
+		// Discard what was fetched, rather than cache bad content.
+		if cancelErr := bw.Cancel(ctx); cancelErr != nil {
+			dcontext.GetLogger(ctx).Errorf("Error canceling upload of blob %s: %v", dgst, cancelErr)
+		}
+		return distribution.Descriptor{}, err
 	}
 
 	_, err = bw.Commit(ctx, desc)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
-	return nil
+	pbs.budget.addBlob(pbs.repositoryName, dgst, desc.Size)
+	return desc, nil
 }
 
 func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
@@ -131,8 +173,14 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 	mu.Unlock()
 
 	go func(dgst digest.Digest) {
+		defer func() {
+			mu.Lock()
+			delete(inflight, dgst)
+			mu.Unlock()
+		}()
+
 		// temporary workaround for https://github.com/distribution/distribution/issues/3438
-		if err := pbs.storeLocal(context.Background(), dgst); err != nil {
+		if _, err := pbs.storeLocal(context.Background(), dgst); err != nil {
 			dcontext.GetLogger(ctx).Errorf("Error committing to storage: %s", err.Error())
 		}
 
@@ -172,6 +220,7 @@ func (pbs *proxyBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distri
 func (pbs *proxyBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
 	blob, err := pbs.localStore.Get(ctx, dgst)
 	if err == nil {
+		pbs.budget.touchBlob(dgst)
 		return blob, nil
 	}
 
@@ -179,15 +228,25 @@ func (pbs *proxyBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte,
 		return []byte{}, err
 	}
 
+	if err := dgst.Validate(); err != nil {
+		return []byte{}, err
+	}
 	blob, err = pbs.remoteStore.Get(ctx, dgst)
 	if err != nil {
 		return []byte{}, err
 	}
+	if dgst.Algorithm().FromBytes(blob) != dgst {
+		return []byte{}, distribution.ErrBlobInvalidDigest{
+			Digest: dgst,
+			Reason: errors.New("content fetched from upstream does not match digest"),
+		}
+	}
 
 	_, err = pbs.localStore.Put(ctx, "", blob)
 	if err != nil {
 		return []byte{}, err
 	}
+	pbs.budget.addBlob(pbs.repositoryName, dgst, int64(len(blob)))
 	return blob, nil
 }
 
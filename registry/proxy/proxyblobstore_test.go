@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
 	"math/rand"
@@ -409,3 +410,138 @@ func testProxyStoreServe(t *testing.T, te *testEnv, numClients int) {
 		t.Fatalf("unexpected remote stats: %#v", remoteStats)
 	}
 }
+
+// lyingBlobStore serves the blobs of a store as an upstream lying about
+// them would: it advertises their length plus extra, and serves their
+// content altered by alter.
+type lyingBlobStore struct {
+	distribution.BlobStore
+	extra int64
+	alter func([]byte) []byte
+}
+
+type bytesReadSeekCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadSeekCloser) Close() error {
+	return nil
+}
+
+func (lbs lyingBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	desc, err := lbs.BlobStore.Stat(ctx, dgst)
+	desc.Size += lbs.extra
+	return desc, err
+}
+
+func (lbs lyingBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	p, err := lbs.BlobStore.Get(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+	return lbs.alter(p), nil
+}
+
+func (lbs lyingBlobStore) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	p, err := lbs.Get(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+	return bytesReadSeekCloser{bytes.NewReader(p)}, nil
+}
+
+func truncated(p []byte) []byte {
+	return p[:len(p)-10]
+}
+
+func sameContent(p []byte) []byte {
+	return p
+}
+
+// TestProxyStoreRejectsBadContent checks that blobs an upstream serves with
+// content not matching their digest or lengths not matching those advertised
+// are rejected, rather than cached.
+func TestProxyStoreRejectsBadContent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		extra   int64
+		alter   func([]byte) []byte
+		corrupt bool
+	}{
+		{name: "truncated", alter: truncated, corrupt: true},
+		{name: "advertised truncated", extra: -10, alter: truncated, corrupt: true},
+		{name: "corrupted", alter: func(p []byte) []byte {
+			corrupted := append([]byte(nil), p...)
+			corrupted[0]++
+			return corrupted
+		}, corrupt: true},
+		{name: "longer than advertised", extra: -10, alter: sameContent},
+		{name: "shorter than advertised", extra: 10, alter: sameContent},
+	} {
+		te := makeTestEnv(t, "foo/bar")
+		populate(t, te, 1, 100, 1)
+		dgst := te.inRemote[0].Digest
+		te.store.remoteStore = lyingBlobStore{
+			BlobStore: te.store.remoteStore.(statsBlobStore),
+			extra:     tc.extra,
+			alter:     tc.alter,
+		}
+
+		if _, err := te.store.storeLocal(te.ctx, dgst); err == nil {
+			t.Fatalf("%s: expected an error caching the blob", tc.name)
+		}
+		if _, err := te.store.localStore.Stat(te.ctx, dgst); err != distribution.ErrBlobUnknown {
+			t.Fatalf("%s: expected the blob not to be cached, got %v", tc.name, err)
+		}
+
+		if _, err := te.store.copyContent(te.ctx, dgst, httptest.NewRecorder()); err == nil {
+			t.Fatalf("%s: expected an error serving the blob", tc.name)
+		}
+
+		// Get does not rely on the length advertised.
+		if !tc.corrupt {
+			continue
+		}
+		if _, err := te.store.Get(te.ctx, dgst); err == nil {
+			t.Fatalf("%s: expected an error getting the blob", tc.name)
+		}
+		if (*te.LocalStats())["put"] != 0 {
+			t.Fatalf("%s: blob put in the cache", tc.name)
+		}
+	}
+}
+
+// TestProxyStoreIgnoreContentLength checks that blobs whose length differs
+// from that advertised are cached when their content matches their digest,
+// and only then, if the content length is ignored.
+func TestProxyStoreIgnoreContentLength(t *testing.T) {
+	te := makeTestEnv(t, "foo/bar")
+	populate(t, te, 1, 100, 1)
+	dgst := te.inRemote[0].Digest
+	te.store.ignoreContentLength = true
+	remote := te.store.remoteStore.(statsBlobStore)
+
+	te.store.remoteStore = lyingBlobStore{BlobStore: remote, extra: -10, alter: truncated}
+	if _, err := te.store.storeLocal(te.ctx, dgst); err == nil {
+		t.Fatal("expected an error caching a truncated blob")
+	}
+
+	te.store.remoteStore = lyingBlobStore{BlobStore: remote, extra: 10, alter: sameContent}
+	w := httptest.NewRecorder()
+	if _, err := te.store.copyContent(te.ctx, dgst, w); err != nil {
+		t.Fatalf("unexpected error serving the blob: %v", err)
+	}
+	if length := w.Header().Get("Content-Length"); length != "" {
+		t.Fatalf("Content-Length %s set while ignoring the advertised length", length)
+	}
+	desc, err := te.store.storeLocal(te.ctx, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error caching the blob: %v", err)
+	}
+	if desc.Size != 100 {
+		t.Fatalf("blob cached with size %d, expected 100", desc.Size)
+	}
+	if _, err := te.store.localStore.Stat(te.ctx, dgst); err != nil {
+		t.Fatalf("blob not cached: %v", err)
+	}
+}
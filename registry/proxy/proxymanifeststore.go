@@ -21,6 +21,11 @@ type proxyManifestStore struct {
 	repositoryName  reference.Named
 	scheduler       *scheduler.TTLExpirationScheduler
 	authChallenger  authChallenger
+
+	// ttl is how long pulled manifests are cached, repositoryTTL if zero.
+	ttl      time.Duration
+	budget   *cacheBudget
+	policies *cachePolicies
 }
 
 var _ distribution.ManifestService = &proxyManifestStore{}
@@ -56,7 +61,7 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 		fromRemote = true
 	}
 
-	_, payload, err := manifest.Payload()
+	mediaType, payload, err := manifest.Payload()
 	if err != nil {
 		return nil, err
 	}
@@ -65,6 +70,16 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 	if fromRemote {
 		proxyMetrics.ManifestPull(uint64(len(payload)))
 
+		var tag string
+		for _, option := range options {
+			if opt, ok := option.(distribution.WithTagOption); ok {
+				tag = opt.Tag
+			}
+		}
+		if pms.policies.noCache(tag, mediaType) {
+			return manifest, nil
+		}
+
 		_, err = pms.localManifests.Put(ctx, manifest)
 		if err != nil {
 			return nil, err
@@ -77,12 +92,30 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 			return nil, err
 		}
 
-		pms.scheduler.AddManifest(repoBlob, repositoryTTL)
+		ttl := pms.ttl
+		if ttl == 0 {
+			ttl = repositoryTTL
+		}
+		ttl = pms.policies.ttl(tag, mediaType, ttl)
+		pms.scheduler.AddManifest(repoBlob, ttl)
 		// Ensure the manifest blob is cleaned up
 		//pms.scheduler.AddBlob(blobRef, repositoryTTL)
 
 	}
 
+	if pms.budget != nil {
+		ref, err := reference.WithDigest(pms.repositoryName, dgst)
+		if err != nil {
+			return nil, err
+		}
+		references := manifest.References()
+		digests := make([]digest.Digest, len(references))
+		for i, desc := range references {
+			digests[i] = desc.Digest
+		}
+		pms.budget.pulledManifest(ref, digests)
+	}
+
 	return manifest, err
 }
 
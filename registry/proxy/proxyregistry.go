@@ -5,45 +5,99 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/reference"
-	"github.com/distribution/distribution/v3/registry/client"
 	"github.com/distribution/distribution/v3/registry/client/auth"
 	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
-	"github.com/distribution/distribution/v3/registry/client/transport"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 )
 
-// proxyingRegistry fetches content from a remote registry and caches it locally
+// proxyingRegistry fetches content from remote registries and caches it locally
 type proxyingRegistry struct {
-	embedded       distribution.Namespace // provides local registry functionality
-	scheduler      *scheduler.TTLExpirationScheduler
-	remoteURL      url.URL
-	authChallenger authChallenger
+	embedded   distribution.Namespace // provides local registry functionality
+	scheduler  *scheduler.TTLExpirationScheduler
+	upstreams  []*upstream
+	roundRobin bool
+
+	// repositories match the names of the repositories pulled through the
+	// cache, if set.
+	repositories []*regexp.Regexp
+
+	// next counts the pulls started with each upstream in turn, when pulls
+	// are round-robin.
+	next uint32
+
+	// manifestTTL is how long pulled manifests are cached.
+	manifestTTL time.Duration
+
+	// budget bounds the size of the blobs cached, if set.
+	budget *cacheBudget
+
+	// policies decide how the manifests pulled are cached, if set.
+	policies *cachePolicies
+
+	// ignoreContentLength accepts blobs whose length differs from the
+	// Content-Length advertised by the upstream.
+	ignoreContentLength bool
 }
 
 // NewRegistryPullThroughCache creates a registry acting as a pull through cache
 func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy) (distribution.Namespace, error) {
-	remoteURL, err := url.Parse(config.RemoteURL)
+	var roundRobin bool
+	switch config.Strategy {
+	case "", "priority":
+	case "roundrobin":
+		roundRobin = true
+	default:
+		return nil, fmt.Errorf("unknown proxy strategy %q", config.Strategy)
+	}
+	if config.RemoteURL != "" && len(config.Mirrors) > 0 {
+		return nil, fmt.Errorf("proxy remoteurl and mirrors are mutually exclusive")
+	}
+	if _, err := url.Parse(config.RemoteURL); err != nil {
+		return nil, err
+	}
+	var repositories []*regexp.Regexp
+	for _, pattern := range config.Repositories {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy repositories %q: %v", pattern, err)
+		}
+		repositories = append(repositories, re)
+	}
+
+	if config.Cache.MaxAge < 0 || config.Cache.MaxSize < 0 || config.Cache.Protect < 0 {
+		return nil, fmt.Errorf("proxy cache maxage, maxsize and protect must not be negative")
+	}
+	manifestTTL := repositoryTTL
+	if config.Cache.MaxAge > 0 {
+		manifestTTL = config.Cache.MaxAge
+	}
+	policies, err := newCachePolicies(config.Cache.Policies)
 	if err != nil {
 		return nil, err
 	}
+	var ignoreContentLength bool
+	switch config.ContentLength {
+	case "", "enforce":
+	case "ignore":
+		ignoreContentLength = true
+	default:
+		return nil, fmt.Errorf("unknown proxy contentlength %q", config.ContentLength)
+	}
 
 	v := storage.NewVacuum(ctx, driver)
-	s := scheduler.New(ctx, driver, "/scheduler-state.json")
-	s.OnBlobExpire(func(ref reference.Reference) error {
-		var r reference.Canonical
-		var ok bool
-		if r, ok = ref.(reference.Canonical); !ok {
-			return fmt.Errorf("unexpected reference type : %T", ref)
-		}
-
+	removeBlob := func(r reference.Canonical) error {
 		repo, err := registry.Repository(ctx, r)
 		if err != nil {
 			return err
@@ -63,15 +117,8 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 		}
 
 		return nil
-	})
-
-	s.OnManifestExpire(func(ref reference.Reference) error {
-		var r reference.Canonical
-		var ok bool
-		if r, ok = ref.(reference.Canonical); !ok {
-			return fmt.Errorf("unexpected reference type : %T", ref)
-		}
-
+	}
+	removeManifest := func(r reference.Canonical) error {
 		repo, err := registry.Repository(ctx, r)
 		if err != nil {
 			return err
@@ -86,27 +133,62 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 			return err
 		}
 		return nil
+	}
+
+	var budget *cacheBudget
+	if config.Cache.MaxSize > 0 {
+		budget = newCacheBudget(driver, "/cache-budget-state.json", config.Cache.MaxSize, config.Cache.Protect, removeBlob, removeManifest)
+	}
+
+	s := scheduler.New(ctx, driver, "/scheduler-state.json")
+	s.OnBlobExpire(func(ref reference.Reference) error {
+		var r reference.Canonical
+		var ok bool
+		if r, ok = ref.(reference.Canonical); !ok {
+			return fmt.Errorf("unexpected reference type : %T", ref)
+		}
+
+		budget.forgetBlob(r)
+		return removeBlob(r)
+	})
+
+	s.OnManifestExpire(func(ref reference.Reference) error {
+		var r reference.Canonical
+		var ok bool
+		if r, ok = ref.(reference.Canonical); !ok {
+			return fmt.Errorf("unexpected reference type : %T", ref)
+		}
+
+		budget.forgetManifest(r)
+		return removeManifest(r)
 	})
 
 	err = s.Start()
 	if err != nil {
 		return nil, err
 	}
+	if budget != nil {
+		if err := budget.start(ctx); err != nil {
+			return nil, err
+		}
+	}
 
-	cs, err := configureAuth(config.Username, config.Password, config.RemoteURL)
+	upstreams, err := configureUpstreams(config)
 	if err != nil {
 		return nil, err
 	}
 
 	return &proxyingRegistry{
-		embedded:  registry,
-		scheduler: s,
-		remoteURL: *remoteURL,
-		authChallenger: &remoteAuthChallenger{
-			remoteURL: *remoteURL,
-			cm:        challenge.NewSimpleManager(),
-			cs:        cs,
-		},
+		embedded:     registry,
+		scheduler:    s,
+		upstreams:    upstreams,
+		roundRobin:   roundRobin,
+		repositories: repositories,
+		manifestTTL:  manifestTTL,
+		budget:       budget,
+		policies:     policies,
+
+		ignoreContentLength: ignoreContentLength,
 	}, nil
 }
 
@@ -119,24 +201,10 @@ func (pr *proxyingRegistry) Repositories(ctx context.Context, repos []string, la
 }
 
 func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
-	c := pr.authChallenger
-
-	tkopts := auth.TokenHandlerOptions{
-		Transport:   http.DefaultTransport,
-		Credentials: c.credentialStore(),
-		Scopes: []auth.Scope{
-			auth.RepositoryScope{
-				Repository: name.Name(),
-				Actions:    []string{"pull"},
-			},
-		},
-		Logger: dcontext.GetLogger(ctx),
+	if !pr.allowed(name.Name()) {
+		return nil, distribution.ErrRepositoryUnknown{Name: name.Name()}
 	}
 
-	tr := transport.NewTransport(http.DefaultTransport,
-		auth.NewAuthorizer(c.challengeManager(),
-			auth.NewTokenHandlerWithOptions(tkopts)))
-
 	localRepo, err := pr.embedded.Repository(ctx, name)
 	if err != nil {
 		return nil, err
@@ -146,23 +214,46 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		return nil, err
 	}
 
-	remoteRepo, err := client.NewRepository(name, pr.remoteURL.String(), tr)
-	if err != nil {
-		return nil, err
+	upstreams := pr.upstreamOrder()
+	remotes := make([]*remote, len(upstreams))
+	for i, u := range upstreams {
+		remotes[i], err = u.repository(ctx, name)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	remoteManifests, err := remoteRepo.Manifests(ctx)
-	if err != nil {
-		return nil, err
+	// Content is pulled from a single upstream directly, and from mirrors
+	// through services failing over from one to the next.
+	var (
+		remoteBlobs     distribution.BlobService
+		remoteManifests distribution.ManifestService
+		remoteTags      distribution.TagService
+		c               authChallenger
+	)
+	if len(remotes) == 1 {
+		remoteBlobs = remotes[0].blobs
+		remoteManifests = remotes[0].manifests
+		remoteTags = remotes[0].tags
+		c = remotes[0].upstream.authChallenger
+	} else {
+		f := &failover{remotes: remotes}
+		remoteBlobs = failoverBlobService{f}
+		remoteManifests = failoverManifestService{f}
+		remoteTags = failoverTagService{f}
+		c = f
 	}
 
 	return &proxiedRepository{
 		blobStore: &proxyBlobStore{
 			localStore:     localRepo.Blobs(ctx),
-			remoteStore:    remoteRepo.Blobs(ctx),
+			remoteStore:    remoteBlobs,
 			scheduler:      pr.scheduler,
 			repositoryName: name,
-			authChallenger: pr.authChallenger,
+			authChallenger: c,
+			budget:         pr.budget,
+
+			ignoreContentLength: pr.ignoreContentLength,
 		},
 		manifests: &proxyManifestStore{
 			repositoryName:  name,
@@ -170,17 +261,48 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 			remoteManifests: remoteManifests,
 			ctx:             ctx,
 			scheduler:       pr.scheduler,
-			authChallenger:  pr.authChallenger,
+			authChallenger:  c,
+			ttl:             pr.manifestTTL,
+			budget:          pr.budget,
+			policies:        pr.policies,
 		},
 		name: name,
 		tags: &proxyTagService{
 			localTags:      localRepo.Tags(ctx),
-			remoteTags:     remoteRepo.Tags(ctx),
-			authChallenger: pr.authChallenger,
+			remoteTags:     remoteTags,
+			authChallenger: c,
+			repositoryName: name,
+			policies:       pr.policies,
 		},
 	}, nil
 }
 
+// allowed reports whether the repository named name is pulled through the
+// cache.
+func (pr *proxyingRegistry) allowed(name string) bool {
+	if len(pr.repositories) == 0 {
+		return true
+	}
+	for _, re := range pr.repositories {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamOrder returns the upstreams in the order a pull tries them.
+func (pr *proxyingRegistry) upstreamOrder() []*upstream {
+	if !pr.roundRobin || len(pr.upstreams) == 1 {
+		return pr.upstreams
+	}
+
+	start := int((atomic.AddUint32(&pr.next, 1) - 1) % uint32(len(pr.upstreams)))
+	upstreams := make([]*upstream, 0, len(pr.upstreams))
+	upstreams = append(upstreams, pr.upstreams[start:]...)
+	return append(upstreams, pr.upstreams[:start]...)
+}
+
 func (pr *proxyingRegistry) Blobs() distribution.BlobEnumerator {
 	return pr.embedded.Blobs()
 }
@@ -198,6 +320,7 @@ type authChallenger interface {
 
 type remoteAuthChallenger struct {
 	remoteURL url.URL
+	client    *http.Client
 	sync.Mutex
 	cm challenge.Manager
 	cs auth.CredentialStore
@@ -228,11 +351,17 @@ func (r *remoteAuthChallenger) tryEstablishChallenges(ctx context.Context) error
 	}
 
 	// establish challenge type with upstream
-	if err := ping(r.cm, remoteURL.String(), challengeHeader); err != nil {
+	if err := ping(r.client, r.cm, remoteURL.String(), challengeHeader); err != nil {
 		return err
 	}
 
 	dcontext.GetLogger(ctx).Infof("Challenge established with upstream : %s %s", remoteURL, r.cm)
+	challenges, _ = r.cm.GetChallenges(remoteURL)
+	for _, c := range challenges {
+		if strings.EqualFold(c.Scheme, "bearer") {
+			dcontext.GetLogger(ctx).Infof("Discovered token authentication URL: %s", c.Parameters["realm"])
+		}
+	}
 	return nil
 }
 
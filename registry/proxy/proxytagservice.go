@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"context"
+	"errors"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
 )
 
 // proxyTagService supports local and remote lookup of tags.
@@ -11,28 +13,51 @@ type proxyTagService struct {
 	localTags      distribution.TagService
 	remoteTags     distribution.TagService
 	authChallenger authChallenger
+
+	repositoryName reference.Named
+	policies       *cachePolicies
 }
 
 var _ distribution.TagService = proxyTagService{}
 
 // Get attempts to get the most recent digest for the tag by checking the remote
 // tag service first and then caching it locally.  If the remote is unavailable
-// the local association is returned
+// the local association is returned. Tags whose caching policy has a TTL are
+// served from the cache until it elapses, while those of policies caching
+// nothing are not cached.
 func (pt proxyTagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	if pt.policies.fresh(pt.repositoryName, tag) {
+		if desc, err := pt.localTags.Get(ctx, tag); err == nil {
+			return desc, nil
+		}
+	}
+
+	var remoteErr error
 	err := pt.authChallenger.tryEstablishChallenges(ctx)
 	if err == nil {
-		desc, err := pt.remoteTags.Get(ctx, tag)
-		if err == nil {
+		var desc distribution.Descriptor
+		desc, remoteErr = pt.remoteTags.Get(ctx, tag)
+		if remoteErr == nil {
+			if pt.policies.noCache(tag, desc.MediaType) {
+				return desc, nil
+			}
 			err := pt.localTags.Tag(ctx, tag, desc)
 			if err != nil {
 				return distribution.Descriptor{}, err
 			}
+			pt.policies.resolvedTag(pt.repositoryName, tag, desc)
 			return desc, nil
 		}
 	}
 
 	desc, err := pt.localTags.Get(ctx, tag)
 	if err != nil {
+		// Report the remote throttling the pull rather than the tag
+		// missing from the cache, so that the client retries.
+		var throttled ErrUpstreamThrottled
+		if errors.As(remoteErr, &throttled) {
+			return distribution.Descriptor{}, remoteErr
+		}
 		return distribution.Descriptor{}, err
 	}
 	return desc, nil
@@ -0,0 +1,488 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/client"
+	"github.com/distribution/distribution/v3/registry/client/auth"
+	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
+	"github.com/distribution/distribution/v3/registry/client/transport"
+	"github.com/opencontainers/go-digest"
+)
+
+// upstream is a remote registry content is pulled from.
+type upstream struct {
+	remoteURL      url.URL
+	transport      http.RoundTripper
+	authChallenger authChallenger
+}
+
+// configureUpstreams returns the upstreams of the proxy configuration, in
+// order of priority.
+func configureUpstreams(config configuration.Proxy) ([]*upstream, error) {
+	if len(config.Mirrors) == 0 {
+		u, err := newUpstream(config.RemoteURL, config.Username, config.Password, 0)
+		if err != nil {
+			return nil, err
+		}
+		return []*upstream{u}, nil
+	}
+
+	upstreams := make([]*upstream, len(config.Mirrors))
+	for i, mirror := range config.Mirrors {
+		if mirror.RemoteURL == "" {
+			return nil, fmt.Errorf("proxy mirror %d requires a remoteurl", i)
+		}
+		u, err := newUpstream(mirror.RemoteURL, mirror.Username, mirror.Password, mirror.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure proxy mirror %s: %v", mirror.RemoteURL, err)
+		}
+		upstreams[i] = u
+	}
+	return upstreams, nil
+}
+
+// newUpstream returns the upstream at remoteURL. No request is made until
+// the upstream is first used, when its challenges and the token
+// authentication URLs the credentials are presented to are discovered, so
+// that an upstream which is down does not prevent the registry from
+// starting. A non-zero timeout bounds the wait for each connection to be
+// established and for the response headers of each request.
+func newUpstream(remoteURL, username, password string, timeout time.Duration) (*upstream, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := http.DefaultTransport
+	if timeout > 0 {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.DialContext = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		t.TLSHandshakeTimeout = timeout
+		t.ResponseHeaderTimeout = timeout
+		tr = t
+	}
+
+	endpoint := *u
+	endpoint.Path = "/v2/"
+	cm := challenge.NewSimpleManager()
+
+	return &upstream{
+		remoteURL: *u,
+		transport: tr,
+		authChallenger: &remoteAuthChallenger{
+			remoteURL: *u,
+			client:    &http.Client{Transport: tr},
+			cm:        cm,
+			cs: credentials{
+				username: username,
+				password: password,
+				cm:       cm,
+				endpoint: endpoint,
+			},
+		},
+	}, nil
+}
+
+// ErrUpstreamThrottled is returned when an upstream responds to a pull with
+// 429 Too Many Requests or 503 Service Unavailable.
+type ErrUpstreamThrottled struct {
+	StatusCode int
+
+	// RetryAfter is the delay the upstream asked clients to wait before
+	// retrying, or zero if it did not say.
+	RetryAfter time.Duration
+}
+
+func (err ErrUpstreamThrottled) Error() string {
+	return fmt.Sprintf("upstream responded with %d %s", err.StatusCode, http.StatusText(err.StatusCode))
+}
+
+// throttleTransport fails the requests an upstream throttles or is
+// unavailable for with an ErrUpstreamThrottled, so that the delay it asked
+// for is not lost to the registry client.
+type throttleTransport struct {
+	http.RoundTripper
+}
+
+func (t throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	return nil, ErrUpstreamThrottled{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number
+// of seconds or a date, returning zero if it is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// remote is a repository of an upstream.
+type remote struct {
+	upstream  *upstream
+	blobs     distribution.BlobService
+	manifests distribution.ManifestService
+	tags      distribution.TagService
+}
+
+// repository returns the named repository of the upstream.
+func (u *upstream) repository(ctx context.Context, name reference.Named) (*remote, error) {
+	c := u.authChallenger
+
+	tkopts := auth.TokenHandlerOptions{
+		Transport:   u.transport,
+		Credentials: c.credentialStore(),
+		Scopes: []auth.Scope{
+			auth.RepositoryScope{
+				Repository: name.Name(),
+				Actions:    []string{"pull"},
+			},
+		},
+		Logger: dcontext.GetLogger(ctx),
+	}
+
+	tr := transport.NewTransport(throttleTransport{u.transport},
+		auth.NewAuthorizer(c.challengeManager(),
+			auth.NewTokenHandlerWithOptions(tkopts)))
+
+	remoteRepo, err := client.NewRepository(name, u.remoteURL.String(), tr)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteManifests, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &remote{
+		upstream:  u,
+		blobs:     remoteRepo.Blobs(ctx),
+		manifests: remoteManifests,
+		tags:      remoteRepo.Tags(ctx),
+	}, nil
+}
+
+// failover tries the remotes of a repository in order, moving on to the next
+// when one is rate limited, fails or does not respond in time. It also acts
+// as the authChallenger of the proxying services, since the challenges of
+// each upstream are established as it is tried.
+type failover struct {
+	remotes []*remote
+
+	// last is the index of the remote which last responded. Calls such as
+	// Open, whose requests are only made once their result is read, go to
+	// it rather than failing over.
+	last int32
+}
+
+var _ authChallenger = &failover{}
+
+// try calls op, named operation in the logs, with the remotes in order,
+// until one succeeds or fails with an error not warranting trying the next.
+func (f *failover) try(ctx context.Context, operation string, op func(*remote) error) error {
+	var err error
+	for i, r := range f.remotes {
+		if err = r.upstream.authChallenger.tryEstablishChallenges(ctx); err == nil {
+			err = op(r)
+			if err == nil || !retryable(ctx, err) {
+				atomic.StoreInt32(&f.last, int32(i))
+				if err == nil && i > 0 {
+					logRetried(ctx, operation, i+1, r.upstream.remoteURL.String())
+				}
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if i < len(f.remotes)-1 {
+			logRetry(ctx, operation, i+1, 0, r.upstream.remoteURL.String(), err)
+		}
+	}
+	return err
+}
+
+// logRetry warns, on the logger of the request, that an attempt of an
+// operation pulling from upstream, if known, failed with err and is retried
+// after backoff, so that operators may alert on the rate of retries.
+func logRetry(ctx context.Context, operation string, attempt int, backoff time.Duration, upstream string, err error) {
+	fields := map[interface{}]interface{}{
+		"proxy.operation":   operation,
+		"proxy.attempt":     attempt,
+		"proxy.backoff":     backoff.String(),
+		"proxy.error.class": retryClass(ctx, err),
+		"error":             err.Error(),
+	}
+	if upstream != "" {
+		fields["proxy.upstream"] = upstream
+	}
+	dcontext.GetLoggerWithFields(ctx, fields).Warn("retrying upstream pull")
+}
+
+// logRetried logs that an operation pulling from upstream, if known,
+// succeeded after retries.
+func logRetried(ctx context.Context, operation string, attempts int, upstream string) {
+	fields := map[interface{}]interface{}{
+		"proxy.operation": operation,
+		"proxy.attempts":  attempts,
+	}
+	if upstream != "" {
+		fields["proxy.upstream"] = upstream
+	}
+	dcontext.GetLoggerWithFields(ctx, fields).Info("upstream pull succeeded after retries")
+}
+
+// tryEstablishChallenges succeeds if the challenges of any of the upstreams
+// can be established.
+func (f *failover) tryEstablishChallenges(ctx context.Context) error {
+	var err error
+	for _, r := range f.remotes {
+		if err = r.upstream.authChallenger.tryEstablishChallenges(ctx); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// challengeManager returns the challenge manager of the first upstream.
+func (f *failover) challengeManager() challenge.Manager {
+	return f.remotes[0].upstream.authChallenger.challengeManager()
+}
+
+// credentialStore returns the credentials of the first upstream.
+func (f *failover) credentialStore() auth.CredentialStore {
+	return f.remotes[0].upstream.authChallenger.credentialStore()
+}
+
+// retryable reports whether err, returned by an upstream, warrants trying
+// the next one: a rate limit, a server error or a failure to get a response.
+func retryable(ctx context.Context, err error) bool {
+	return retryClass(ctx, err) != ""
+}
+
+// retryClass classifies err, returned by an upstream, by why it warrants
+// trying again: "throttled", "unavailable", "server_error", "timeout" or
+// "network". It returns an empty string if err does not warrant it.
+func retryClass(ctx context.Context, err error) string {
+	var throttled ErrUpstreamThrottled
+	if errors.As(err, &throttled) {
+		return "throttled"
+	}
+
+	switch err := err.(type) {
+	case errcode.Errors:
+		for _, e := range err {
+			if class := retryClass(ctx, e); class != "" {
+				return class
+			}
+		}
+		return ""
+	case errcode.Error:
+		return codeRetryClass(err.Code)
+	case errcode.ErrorCode:
+		return codeRetryClass(err)
+	case *client.UnexpectedHTTPResponseError:
+		return statusRetryClass(err.StatusCode)
+	case *client.UnexpectedHTTPStatusError:
+		fields := strings.Fields(err.Status)
+		if len(fields) == 0 {
+			return ""
+		}
+		status, convErr := strconv.Atoi(fields[0])
+		if convErr != nil {
+			return ""
+		}
+		return statusRetryClass(status)
+	case *url.Error:
+		// The request failed without a response, as when the upstream
+		// timed out or refused the connection.
+		if ctx.Err() != nil {
+			return ""
+		}
+		if err.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	return ""
+}
+
+func codeRetryClass(code errcode.ErrorCode) string {
+	switch code {
+	case errcode.ErrorCodeTooManyRequests:
+		return "throttled"
+	case errcode.ErrorCodeUnavailable:
+		return "unavailable"
+	}
+	return ""
+}
+
+func statusRetryClass(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "throttled"
+	case status == http.StatusServiceUnavailable:
+		return "unavailable"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	}
+	return ""
+}
+
+// failoverBlobService pulls blobs from the remotes of a failover.
+type failoverBlobService struct {
+	*failover
+}
+
+var _ distribution.BlobService = failoverBlobService{}
+
+func (fbs failoverBlobService) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	var desc distribution.Descriptor
+	err := fbs.try(ctx, "blob.stat", func(r *remote) error {
+		var err error
+		desc, err = r.blobs.Stat(ctx, dgst)
+		return err
+	})
+	return desc, err
+}
+
+func (fbs failoverBlobService) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	var p []byte
+	err := fbs.try(ctx, "blob.get", func(r *remote) error {
+		var err error
+		p, err = r.blobs.Get(ctx, dgst)
+		return err
+	})
+	return p, err
+}
+
+// Open opens the blob on the remote which last responded, usually to Stat.
+func (fbs failoverBlobService) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	return fbs.remotes[atomic.LoadInt32(&fbs.last)].blobs.Open(ctx, dgst)
+}
+
+func (fbs failoverBlobService) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
+	return distribution.Descriptor{}, distribution.ErrUnsupported
+}
+
+func (fbs failoverBlobService) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+func (fbs failoverBlobService) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+// failoverManifestService pulls manifests from the remotes of a failover.
+type failoverManifestService struct {
+	*failover
+}
+
+var _ distribution.ManifestService = failoverManifestService{}
+
+func (fms failoverManifestService) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	var exists bool
+	err := fms.try(ctx, "manifest.exists", func(r *remote) error {
+		var err error
+		exists, err = r.manifests.Exists(ctx, dgst)
+		return err
+	})
+	return exists, err
+}
+
+func (fms failoverManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	var manifest distribution.Manifest
+	err := fms.try(ctx, "manifest.get", func(r *remote) error {
+		var err error
+		manifest, err = r.manifests.Get(ctx, dgst, options...)
+		return err
+	})
+	return manifest, err
+}
+
+func (fms failoverManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	return "", distribution.ErrUnsupported
+}
+
+func (fms failoverManifestService) Delete(ctx context.Context, dgst digest.Digest) error {
+	return distribution.ErrUnsupported
+}
+
+// failoverTagService resolves tags on the remotes of a failover.
+type failoverTagService struct {
+	*failover
+}
+
+var _ distribution.TagService = failoverTagService{}
+
+func (fts failoverTagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	var desc distribution.Descriptor
+	err := fts.try(ctx, "tag.get", func(r *remote) error {
+		var err error
+		desc, err = r.tags.Get(ctx, tag)
+		return err
+	})
+	return desc, err
+}
+
+func (fts failoverTagService) All(ctx context.Context) ([]string, error) {
+	var tags []string
+	err := fts.try(ctx, "tag.all", func(r *remote) error {
+		var err error
+		tags, err = r.tags.All(ctx)
+		return err
+	})
+	return tags, err
+}
+
+func (fts failoverTagService) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	return distribution.ErrUnsupported
+}
+
+func (fts failoverTagService) Untag(ctx context.Context, tag string) error {
+	return distribution.ErrUnsupported
+}
+
+func (fts failoverTagService) Lookup(ctx context.Context, digest distribution.Descriptor) ([]string, error) {
+	return nil, distribution.ErrUnsupported
+}
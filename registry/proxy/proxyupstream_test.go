@@ -0,0 +1,450 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/client"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// newRateLimitedUpstream returns an upstream answering every request but the
+// version check with 429 Too Many Requests, and the number of requests it
+// rate limited.
+func newRateLimitedUpstream(t *testing.T) (*httptest.Server, *int32) {
+	var limited int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		atomic.AddInt32(&limited, 1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(server.Close)
+	return server, &limited
+}
+
+// newBlobUpstream returns an upstream serving the given blob in the foo
+// repository.
+func newBlobUpstream(t *testing.T, content []byte) (*httptest.Server, digest.Digest) {
+	dgst := digest.FromBytes(content)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+		case "/v2/foo/blobs/" + dgst.String():
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			if r.Method == http.MethodGet {
+				w.Write(content)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, dgst
+}
+
+func newTestProxyingRegistry(t *testing.T, config configuration.Proxy) (distribution.Namespace, distribution.Namespace) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	localRegistry, err := storage.NewRegistry(ctx, driver, storage.EnableDelete, storage.EnableRedirect)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	proxyRegistry, err := NewRegistryPullThroughCache(ctx, localRegistry, driver, config)
+	if err != nil {
+		t.Fatalf("error creating proxying registry: %v", err)
+	}
+	return proxyRegistry, localRegistry
+}
+
+func TestProxyMirrorFailover(t *testing.T) {
+	limitedServer, limited := newRateLimitedUpstream(t)
+	content := []byte("pulled through the second mirror")
+	blobServer, dgst := newBlobUpstream(t, content)
+
+	proxyRegistry, localRegistry := newTestProxyingRegistry(t, configuration.Proxy{
+		Mirrors: []configuration.ProxyMirror{
+			{RemoteURL: limitedServer.URL},
+			{RemoteURL: blobServer.URL},
+		},
+	})
+
+	ctx := context.Background()
+	name, _ := reference.WithName("foo")
+	repo, err := proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("error getting repository: %v", err)
+	}
+
+	desc, err := repo.Blobs(ctx).Stat(ctx, dgst)
+	if err != nil {
+		t.Fatalf("error statting blob: %v", err)
+	}
+	if desc.Size != int64(len(content)) {
+		t.Fatalf("unexpected blob size: %d", desc.Size)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest(http.MethodGet, "", nil)
+	if err := repo.Blobs(ctx).ServeBlob(ctx, w, r, dgst); err != nil {
+		t.Fatalf("error serving blob: %v", err)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("unexpected blob content: %q", w.Body.Bytes())
+	}
+	if atomic.LoadInt32(limited) == 0 {
+		t.Fatalf("the first mirror was not tried")
+	}
+
+	// The blob is cached locally, whichever mirror served it.
+	localRepo, err := localRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("error getting local repository: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p, err := localRepo.Blobs(ctx).Get(ctx, dgst)
+		if err == nil {
+			if !bytes.Equal(p, content) {
+				t.Fatalf("unexpected cached blob content: %q", p)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("blob was not cached: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newLoggingContext returns the context of a request, logging as JSON to the
+// returned buffer.
+func newLoggingContext() (context.Context, *bytes.Buffer) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Formatter = &logrus.JSONFormatter{}
+	ctx := dcontext.WithLogger(context.Background(), logrus.NewEntry(logger).WithField("http.request.id", "request-1"))
+	return ctx, &buf
+}
+
+// logEntries returns the entries logged as JSON to buf.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("error decoding log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestProxyMirrorFailoverLogs(t *testing.T) {
+	limitedServer, _ := newRateLimitedUpstream(t)
+	blobServer, dgst := newBlobUpstream(t, []byte("pulled after failing over"))
+	proxyRegistry, _ := newTestProxyingRegistry(t, configuration.Proxy{
+		Mirrors: []configuration.ProxyMirror{
+			{RemoteURL: limitedServer.URL},
+			{RemoteURL: blobServer.URL},
+		},
+	})
+
+	ctx, buf := newLoggingContext()
+	name, _ := reference.WithName("foo")
+	repo, err := proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("error getting repository: %v", err)
+	}
+	if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+		t.Fatalf("error statting blob: %v", err)
+	}
+
+	var retried, succeeded map[string]interface{}
+	for _, entry := range logEntries(t, buf) {
+		switch entry["msg"] {
+		case "retrying upstream pull":
+			retried = entry
+		case "upstream pull succeeded after retries":
+			succeeded = entry
+		}
+	}
+	if retried == nil || succeeded == nil {
+		t.Fatalf("expected the failover and its success to be logged: %s", buf)
+	}
+	for key, value := range map[string]interface{}{
+		"level":             "warning",
+		"http.request.id":   "request-1",
+		"proxy.operation":   "blob.stat",
+		"proxy.attempt":     float64(1),
+		"proxy.backoff":     "0s",
+		"proxy.upstream":    limitedServer.URL,
+		"proxy.error.class": "throttled",
+	} {
+		if retried[key] != value {
+			t.Errorf("failover logged with %s %v, expected %v", key, retried[key], value)
+		}
+	}
+	for key, value := range map[string]interface{}{
+		"level":           "info",
+		"http.request.id": "request-1",
+		"proxy.operation": "blob.stat",
+		"proxy.attempts":  float64(2),
+		"proxy.upstream":  blobServer.URL,
+	} {
+		if succeeded[key] != value {
+			t.Errorf("success logged with %s %v, expected %v", key, succeeded[key], value)
+		}
+	}
+}
+
+// TestProxyMirrorUnreachableAtStartup checks that a mirror which is down
+// when the registry starts is skipped, and used once it is up.
+func TestProxyMirrorUnreachableAtStartup(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	content := []byte("pulled through the second mirror")
+	blobServer, dgst := newBlobUpstream(t, content)
+
+	proxyRegistry, _ := newTestProxyingRegistry(t, configuration.Proxy{
+		Mirrors: []configuration.ProxyMirror{
+			{RemoteURL: "http://" + addr, Timeout: time.Second},
+			{RemoteURL: blobServer.URL},
+		},
+	})
+
+	ctx := context.Background()
+	name, _ := reference.WithName("foo")
+	repo, err := proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("error getting repository: %v", err)
+	}
+	if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+		t.Fatalf("error statting blob with the first mirror down: %v", err)
+	}
+
+	// Once up, the first mirror is tried first.
+	firstContent := []byte("only on the first mirror")
+	firstServer, firstDgst := newBlobUpstream(t, firstContent)
+	firstServer.Close()
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("unable to listen again on %s: %v", addr, err)
+	}
+	first := httptest.NewUnstartedServer(firstServer.Config.Handler)
+	first.Listener.Close()
+	first.Listener = l
+	first.Start()
+	defer first.Close()
+
+	repo, err = proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("error getting repository: %v", err)
+	}
+	desc, err := repo.Blobs(ctx).Stat(ctx, firstDgst)
+	if err != nil {
+		t.Fatalf("error statting blob once the first mirror is up: %v", err)
+	}
+	if desc.Size != int64(len(firstContent)) {
+		t.Fatalf("unexpected blob size: %d", desc.Size)
+	}
+}
+
+// TestProxyUpstreamCredentials checks that the credentials of an upstream
+// are presented to the token authentication URL it challenges with.
+func TestProxyUpstreamCredentials(t *testing.T) {
+	var tokenRequests int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenRequests, 1)
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"token":"granted"}`))
+	}))
+	defer tokenServer.Close()
+
+	content := []byte("pulled with a token")
+	blobServer, dgst := newBlobUpstream(t, content)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer granted" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q,service="upstream"`, tokenServer.URL+"/token"))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		blobServer.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	proxyRegistry, _ := newTestProxyingRegistry(t, configuration.Proxy{
+		RemoteURL: upstream.URL,
+		Username:  "user",
+		Password:  "secret",
+	})
+
+	ctx := context.Background()
+	name, _ := reference.WithName("foo")
+	repo, err := proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("error getting repository: %v", err)
+	}
+	desc, err := repo.Blobs(ctx).Stat(ctx, dgst)
+	if err != nil {
+		t.Fatalf("error statting blob: %v", err)
+	}
+	if desc.Size != int64(len(content)) {
+		t.Fatalf("unexpected blob size: %d", desc.Size)
+	}
+	if atomic.LoadInt32(&tokenRequests) == 0 {
+		t.Fatalf("no token was requested")
+	}
+}
+
+func TestProxyMirrorNoFailoverOnNotFound(t *testing.T) {
+	content := []byte("only on the second mirror")
+	blobServer, dgst := newBlobUpstream(t, content)
+	emptyServer, _ := newBlobUpstream(t, []byte("another blob"))
+
+	proxyRegistry, _ := newTestProxyingRegistry(t, configuration.Proxy{
+		Mirrors: []configuration.ProxyMirror{
+			{RemoteURL: emptyServer.URL},
+			{RemoteURL: blobServer.URL},
+		},
+	})
+
+	ctx := context.Background()
+	name, _ := reference.WithName("foo")
+	repo, err := proxyRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("error getting repository: %v", err)
+	}
+	if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob unknown to the first mirror, got %v", err)
+	}
+}
+
+func TestProxyMirrorRoundRobin(t *testing.T) {
+	var upstreams []*upstream
+	for i := 0; i < 3; i++ {
+		upstreams = append(upstreams, &upstream{})
+	}
+	pr := &proxyingRegistry{upstreams: upstreams, roundRobin: true}
+
+	for i := 0; i < 6; i++ {
+		order := pr.upstreamOrder()
+		if len(order) != len(upstreams) {
+			t.Fatalf("unexpected number of upstreams: %d", len(order))
+		}
+		for j := range order {
+			if order[j] != upstreams[(i+j)%len(upstreams)] {
+				t.Fatalf("unexpected upstream %d of pull %d", j, i)
+			}
+		}
+	}
+}
+
+func TestProxyStrategyInvalid(t *testing.T) {
+	_, err := NewRegistryPullThroughCache(context.Background(), nil, inmemory.New(), configuration.Proxy{
+		RemoteURL: "http://localhost",
+		Strategy:  "random",
+	})
+	if err == nil {
+		t.Fatalf("expected an error for an unknown strategy")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{errcode.Errors{errcode.ErrorCodeTooManyRequests.WithMessage("slow down")}, true},
+		{errcode.ErrorCodeUnavailable, true},
+		{&client.UnexpectedHTTPResponseError{ParseErr: client.ErrNoErrorsInBody, StatusCode: http.StatusTooManyRequests}, true},
+		{&client.UnexpectedHTTPStatusError{Status: "503 Service Unavailable"}, true},
+		{&client.UnexpectedHTTPStatusError{Status: "302 Found"}, false},
+		{ErrUpstreamThrottled{StatusCode: http.StatusTooManyRequests}, true},
+		{errcode.Errors{errcode.ErrorCodeUnauthorized}, false},
+		{distribution.ErrBlobUnknown, false},
+		{fmt.Errorf("unexpected"), false},
+	} {
+		if retryable(ctx, tc.err) != tc.retryable {
+			t.Errorf("unexpected retryability of %v: %v", tc.err, !tc.retryable)
+		}
+	}
+}
+
+func TestRetryClass(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		err   error
+		class string
+	}{
+		{fmt.Errorf("pulling: %w", ErrUpstreamThrottled{StatusCode: http.StatusTooManyRequests}), "throttled"},
+		{errcode.Errors{errcode.ErrorCodeUnavailable.WithMessage("down")}, "unavailable"},
+		{&client.UnexpectedHTTPStatusError{Status: "502 Bad Gateway"}, "server_error"},
+		{&url.Error{Op: "Get", URL: "http://upstream", Err: timeoutError{}}, "timeout"},
+		{&url.Error{Op: "Get", URL: "http://upstream", Err: fmt.Errorf("connection refused")}, "network"},
+		{distribution.ErrBlobUnknown, ""},
+	} {
+		if class := retryClass(ctx, tc.err); class != tc.class {
+			t.Errorf("%v classified as %q, expected %q", tc.err, class, tc.class)
+		}
+	}
+}
+
+// timeoutError is a network error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	} {
+		if d := parseRetryAfter(tc.value, now); d != tc.expected {
+			t.Errorf("unexpected delay parsed from %q: %v != %v", tc.value, d, tc.expected)
+		}
+	}
+}
@@ -18,17 +18,18 @@ import (
 	logstash "github.com/bshuster-repo/logrus-logstash-hook"
 	"github.com/bugsnag/bugsnag-go"
 	"github.com/docker/go-metrics"
-	gorhandlers "github.com/gorilla/handlers"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/yvasiyarov/gorelic"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
 
 	"github.com/distribution/distribution/v3/configuration"
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/health"
+	prometheus "github.com/distribution/distribution/v3/metrics"
 	"github.com/distribution/distribution/v3/registry/handlers"
 	"github.com/distribution/distribution/v3/registry/listener"
 	"github.com/distribution/distribution/v3/uuid"
@@ -89,6 +90,10 @@ var tlsVersions = map[string]uint16{
 	"tls1.3": tls.VersionTLS13,
 }
 
+// minHTTP2WindowSize is the smallest HTTP/2 flow control window, as set by
+// RFC 7540.
+const minHTTP2WindowSize = 65535
+
 // this channel gets notified when process receives signal. It is global to ease unit testing
 var quit = make(chan os.Signal, 1)
 
@@ -132,6 +137,28 @@ var ServeCmd = &cobra.Command{
 			http.Handle(path, metrics.Handler())
 		}
 
+		if config.HTTP.Debug.Info.Enabled {
+			log.Info("providing registry info on /debug/info")
+			http.Handle("/debug/info", handlers.InfoHandler(config))
+		}
+
+		if statsd := config.HTTP.Debug.StatsD; statsd.Enabled {
+			var dogStatsD bool
+			switch statsd.Format {
+			case "", "statsd":
+			case "dogstatsd":
+				dogStatsD = true
+			default:
+				log.Fatalf("unknown statsd format %q", statsd.Format)
+			}
+			sink, err := prometheus.NewStatsDSink(statsd.Addr, statsd.Prefix, dogStatsD, statsd.Tags)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			log.Info("sending metrics to statsd")
+			go sink.Run(ctx, statsd.Interval)
+		}
+
 		if err = registry.ListenAndServe(); err != nil {
 			log.Fatalln(err)
 		}
@@ -165,16 +192,26 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 	// can only be called once per process.
 	app.RegisterHealthChecks()
 	handler := configureReporting(app)
-	handler = alive("/", handler)
+	// The root page configured is served by the app.
+	if config.HTTP.Pages.Root == (configuration.Page{}) {
+		handler = alive("/", handler)
+	}
 	handler = health.Handler(handler)
 	handler = panicHandler(handler)
-	if !config.Log.AccessLog.Disabled {
-		handler = gorhandlers.CombinedLoggingHandler(os.Stdout, handler)
+	handler, err = configureAccessLog(config, handler)
+	if err != nil {
+		return nil, err
 	}
 
 	server := &http.Server{
 		Handler: handler,
 	}
+	if err := configureServer(server, config); err != nil {
+		return nil, err
+	}
+	if err := configureConnectionLimit(server, config); err != nil {
+		return nil, err
+	}
 
 	return &Registry{
 		app:    app,
@@ -200,6 +237,80 @@ func getCipherSuites(names []string) ([]uint16, error) {
 	return cipherSuiteConsts, nil
 }
 
+// newTLSConfig returns the TLS configuration of the server, without its
+// certificates, restricted to the minimum TLS version and the cipher suites
+// configured. It fails unless some of the cipher suites configured can be
+// used with every version accepted.
+func newTLSConfig(ctx context.Context, config *configuration.Configuration) (*tls.Config, error) {
+	minimumTLS := config.HTTP.TLS.MinimumTLS
+	if minimumTLS == "" {
+		minimumTLS = defaultTLSVersionStr
+	}
+	tlsMinVersion, ok := tlsVersions[minimumTLS]
+	if !ok {
+		return nil, fmt.Errorf("unknown minimum TLS level '%s' specified for http.tls.minimumtls", minimumTLS)
+	}
+	dcontext.GetLogger(ctx).Infof("restricting TLS version to %s or higher", minimumTLS)
+
+	tlsCipherSuites, err := getCipherSuites(config.HTTP.TLS.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.HTTP.TLS.CipherSuites) != 0 {
+		if err := checkCipherSuites(ctx, tlsCipherSuites, minimumTLS, tlsMinVersion); err != nil {
+			return nil, err
+		}
+	}
+	dcontext.GetLogger(ctx).Infof("restricting TLS cipher suites to: %s", strings.Join(getCipherSuiteNames(tlsCipherSuites), ","))
+
+	return &tls.Config{
+		ClientAuth:               tls.NoClientCert,
+		NextProtos:               nextProtos(config),
+		MinVersion:               tlsMinVersion,
+		PreferServerCipherSuites: true,
+		CipherSuites:             tlsCipherSuites,
+	}, nil
+}
+
+// checkCipherSuites checks that every cipher suite of ids can be used with a
+// version from minVersion, named minimumTLS, and that some can be used with
+// the versions below TLS 1.3 if accepted, as the cipher suites of TLS 1.3 are
+// not configurable. The insecure cipher suites are warned about.
+func checkCipherSuites(ctx context.Context, ids []uint16, minimumTLS string, minVersion uint16) error {
+	suites := make(map[uint16]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.ID] = suite
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.ID] = suite
+	}
+
+	var belowTLS13 bool
+	for _, id := range ids {
+		suite, ok := suites[id]
+		if !ok {
+			return fmt.Errorf("unsupported TLS cipher suite '%s' specified for http.tls.ciphersuites", tls.CipherSuiteName(id))
+		}
+		var usable bool
+		for _, version := range suite.SupportedVersions {
+			if version >= minVersion {
+				usable = true
+				belowTLS13 = belowTLS13 || version < tls.VersionTLS13
+			}
+		}
+		if !usable {
+			return fmt.Errorf("TLS cipher suite '%s' specified for http.tls.ciphersuites cannot be used with %s or higher", suite.Name, minimumTLS)
+		}
+		if suite.Insecure {
+			dcontext.GetLogger(ctx).Warnf("TLS cipher suite %s specified for http.tls.ciphersuites is insecure", suite.Name)
+		}
+	}
+	if minVersion < tls.VersionTLS13 && !belowTLS13 {
+		return fmt.Errorf("no TLS cipher suite specified for http.tls.ciphersuites can be used below tls1.3, which http.tls.minimumtls %s accepts", minimumTLS)
+	}
+	return nil
+}
+
 // takes a list of cipher suite ids and converts it to a list of respective names
 func getCipherSuiteNames(ids []uint16) []string {
 	if len(ids) == 0 {
@@ -222,28 +333,10 @@ func (registry *Registry) ListenAndServe() error {
 	}
 
 	if config.HTTP.TLS.Certificate != "" || config.HTTP.TLS.LetsEncrypt.CacheFile != "" {
-		if config.HTTP.TLS.MinimumTLS == "" {
-			config.HTTP.TLS.MinimumTLS = defaultTLSVersionStr
-		}
-		tlsMinVersion, ok := tlsVersions[config.HTTP.TLS.MinimumTLS]
-		if !ok {
-			return fmt.Errorf("unknown minimum TLS level '%s' specified for http.tls.minimumtls", config.HTTP.TLS.MinimumTLS)
-		}
-		dcontext.GetLogger(registry.app).Infof("restricting TLS version to %s or higher", config.HTTP.TLS.MinimumTLS)
-
-		tlsCipherSuites, err := getCipherSuites(config.HTTP.TLS.CipherSuites)
+		tlsConf, err := newTLSConfig(registry.app, config)
 		if err != nil {
 			return err
 		}
-		dcontext.GetLogger(registry.app).Infof("restricting TLS cipher suites to: %s", strings.Join(getCipherSuiteNames(tlsCipherSuites), ","))
-
-		tlsConf := &tls.Config{
-			ClientAuth:               tls.NoClientCert,
-			NextProtos:               nextProtos(config),
-			MinVersion:               tlsMinVersion,
-			PreferServerCipherSuites: true,
-			CipherSuites:             tlsCipherSuites,
-		}
 
 		if config.HTTP.TLS.LetsEncrypt.CacheFile != "" {
 			if config.HTTP.TLS.Certificate != "" {
@@ -283,8 +376,17 @@ func (registry *Registry) ListenAndServe() error {
 				dcontext.GetLogger(registry.app).Debugf("CA Subject: %s", string(subj))
 			}
 
-			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+			switch config.HTTP.TLS.ClientAuth {
+			case "", "require":
+				tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+			case "verifyifgiven":
+				tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+			default:
+				return fmt.Errorf("unknown client authentication %q, expected require or verifyifgiven", config.HTTP.TLS.ClientAuth)
+			}
 			tlsConf.ClientCAs = pool
+		} else if len(config.HTTP.TLS.ClientCertRoutes) != 0 {
+			return fmt.Errorf("client certificate routes require client CAs")
 		}
 
 		ln = tls.NewListener(ln, tlsConf)
@@ -494,3 +596,39 @@ func nextProtos(config *configuration.Configuration) []string {
 		return []string{"h2", "http/1.1"}
 	}
 }
+
+// configureServer applies the HTTP/2 and keep-alive settings of config to
+// server.
+func configureServer(server *http.Server, config *configuration.Configuration) error {
+	server.SetKeepAlivesEnabled(!config.HTTP.KeepAlive.Disabled)
+
+	if config.HTTP.HTTP2.Disabled {
+		// A non-nil, empty map keeps net/http from enabling HTTP/2 on its
+		// own.
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return nil
+	}
+
+	h2, err := http2Server(config)
+	if err != nil {
+		return err
+	}
+	return http2.ConfigureServer(server, h2)
+}
+
+// http2Server returns the HTTP/2 server configured by config.
+func http2Server(config *configuration.Configuration) (*http2.Server, error) {
+	h2 := config.HTTP.HTTP2
+	if h2.InitialConnWindowSize != 0 && h2.InitialConnWindowSize < minHTTP2WindowSize {
+		return nil, fmt.Errorf("http.http2.initialconnwindowsize must be at least %d bytes", minHTTP2WindowSize)
+	}
+	if h2.InitialStreamWindowSize != 0 && h2.InitialStreamWindowSize < minHTTP2WindowSize {
+		return nil, fmt.Errorf("http.http2.initialstreamwindowsize must be at least %d bytes", minHTTP2WindowSize)
+	}
+
+	return &http2.Server{
+		MaxConcurrentStreams:         h2.MaxConcurrentStreams,
+		MaxUploadBufferPerConnection: h2.InitialConnWindowSize,
+		MaxUploadBufferPerStream:     h2.InitialStreamWindowSize,
+	}, nil
+}
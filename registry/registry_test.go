@@ -2,6 +2,7 @@ package registry
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
@@ -11,6 +12,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -26,7 +28,9 @@ import (
 
 	"github.com/distribution/distribution/v3/configuration"
 	dcontext "github.com/distribution/distribution/v3/context"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/encryption"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
@@ -53,6 +57,81 @@ func TestNextProtos(t *testing.T) {
 	}
 }
 
+func TestConfigureServer(t *testing.T) {
+	config := &configuration.Configuration{}
+	config.HTTP.HTTP2.MaxConcurrentStreams = 1000
+	config.HTTP.HTTP2.InitialConnWindowSize = 4 << 20
+	config.HTTP.HTTP2.InitialStreamWindowSize = 2 << 20
+
+	h2, err := http2Server(config)
+	if err != nil {
+		t.Fatalf("unexpected error creating http2 server: %v", err)
+	}
+	if h2.MaxConcurrentStreams != 1000 {
+		t.Errorf("unexpected max concurrent streams: %d", h2.MaxConcurrentStreams)
+	}
+	if h2.MaxUploadBufferPerConnection != 4<<20 {
+		t.Errorf("unexpected connection window size: %d", h2.MaxUploadBufferPerConnection)
+	}
+	if h2.MaxUploadBufferPerStream != 2<<20 {
+		t.Errorf("unexpected stream window size: %d", h2.MaxUploadBufferPerStream)
+	}
+
+	server := &http.Server{}
+	if err := configureServer(server, config); err != nil {
+		t.Fatalf("unexpected error configuring server: %v", err)
+	}
+	if _, ok := server.TLSNextProto["h2"]; !ok {
+		t.Errorf("expected h2 to be configured")
+	}
+
+	config.HTTP.HTTP2.Disabled = true
+	server = &http.Server{}
+	if err := configureServer(server, config); err != nil {
+		t.Fatalf("unexpected error configuring server: %v", err)
+	}
+	if server.TLSNextProto == nil || len(server.TLSNextProto) != 0 {
+		t.Errorf("expected h2 to be disabled, got %v", server.TLSNextProto)
+	}
+
+	config.HTTP.HTTP2.Disabled = false
+	config.HTTP.HTTP2.InitialStreamWindowSize = 1024
+	if err := configureServer(&http.Server{}, config); err == nil {
+		t.Errorf("expected an error for a window size below the minimum")
+	}
+}
+
+func TestConfigureServerKeepAlive(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		config := &configuration.Configuration{}
+		config.HTTP.KeepAlive.Disabled = disabled
+
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		}
+		if err := configureServer(server, config); err != nil {
+			t.Fatalf("unexpected error configuring server: %v", err)
+		}
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		go server.Serve(ln)
+
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			t.Fatalf("unexpected error making request: %v", err)
+		}
+		resp.Body.Close()
+		server.Close()
+
+		if resp.Close != disabled {
+			t.Errorf("keep-alive disabled: %v, connection closed: %v", disabled, resp.Close)
+		}
+	}
+}
+
 type registryTLSConfig struct {
 	cipherSuites    []string
 	certificatePath string
@@ -150,6 +229,67 @@ func TestGetCipherSuite(t *testing.T) {
 	}
 }
 
+func TestNewTLSConfig(t *testing.T) {
+	for _, tc := range []struct {
+		minimumTLS   string
+		cipherSuites []string
+		minVersion   uint16
+		expected     []uint16
+	}{
+		{"", nil, tls.VersionTLS12, defaultCipherSuites},
+		{
+			"tls1.2",
+			[]string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+			tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		},
+		{
+			"tls1.2",
+			[]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_AES_128_GCM_SHA256"},
+			tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_AES_128_GCM_SHA256},
+		},
+		{"tls1.3", []string{"TLS_AES_256_GCM_SHA384"}, tls.VersionTLS13, []uint16{tls.TLS_AES_256_GCM_SHA384}},
+		{"tls1.0", []string{"TLS_RSA_WITH_AES_128_CBC_SHA"}, tls.VersionTLS10, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}},
+	} {
+		config := &configuration.Configuration{}
+		config.HTTP.TLS.MinimumTLS = tc.minimumTLS
+		config.HTTP.TLS.CipherSuites = tc.cipherSuites
+		tlsConf, err := newTLSConfig(context.Background(), config)
+		if err != nil {
+			t.Errorf("minimum %q, cipher suites %v: unexpected error: %v", tc.minimumTLS, tc.cipherSuites, err)
+			continue
+		}
+		if tlsConf.MinVersion != tc.minVersion {
+			t.Errorf("minimum %q: minimum version %x, expected %x", tc.minimumTLS, tlsConf.MinVersion, tc.minVersion)
+		}
+		if !reflect.DeepEqual(tlsConf.CipherSuites, tc.expected) {
+			t.Errorf("cipher suites %v: configured %v, expected %v", tc.cipherSuites,
+				getCipherSuiteNames(tlsConf.CipherSuites), getCipherSuiteNames(tc.expected))
+		}
+	}
+
+	for _, tc := range []struct {
+		minimumTLS   string
+		cipherSuites []string
+	}{
+		{"ssl3", nil},
+		{"tls1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "bad_input"}},
+		// Cipher suites of TLS 1.2 only cannot be used with TLS 1.3.
+		{"tls1.3", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+		{"tls1.3", []string{"TLS_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256"}},
+		// The cipher suites of TLS 1.3 leave none for TLS 1.2.
+		{"tls1.2", []string{"TLS_AES_128_GCM_SHA256", "TLS_AES_256_GCM_SHA384"}},
+	} {
+		config := &configuration.Configuration{}
+		config.HTTP.TLS.MinimumTLS = tc.minimumTLS
+		config.HTTP.TLS.CipherSuites = tc.cipherSuites
+		if _, err := newTLSConfig(context.Background(), config); err == nil {
+			t.Errorf("minimum %q, cipher suites %v: expected an error", tc.minimumTLS, tc.cipherSuites)
+		}
+	}
+}
+
 func buildRegistryTLSConfig(name, keyType string, cipherSuites []string) (*registryTLSConfig, error) {
 	var priv interface{}
 	var pub crypto.PublicKey
@@ -405,3 +545,91 @@ log:
 		t.Error("field baz not configured correctly; expected 'xyzzy' got: ", val)
 	}
 }
+
+func TestStorageServerNetwork(t *testing.T) {
+	defer func(addr, cert, clientCA string, insecure bool) {
+		storageServerAddr, storageServerCertificate, storageServerClientCA, storageServerInsecure = addr, cert, clientCA, insecure
+	}(storageServerAddr, storageServerCertificate, storageServerClientCA, storageServerInsecure)
+
+	for _, tc := range []struct {
+		addr     string
+		cert     string
+		clientCA string
+		insecure bool
+		network  string
+	}{
+		{"unix:///var/run/registry-storage.sock", "", "", false, "unix"},
+		{"localhost:5050", "", "", false, ""},
+		{"localhost:5050", "cert.pem", "", false, ""},
+		{"localhost:5050", "cert.pem", "ca.pem", false, "tcp"},
+		{"localhost:5050", "", "", true, "tcp"},
+	} {
+		storageServerAddr, storageServerCertificate, storageServerClientCA, storageServerInsecure = tc.addr, tc.cert, tc.clientCA, tc.insecure
+
+		network, _, err := storageServerNetwork()
+		if tc.network == "" {
+			if err == nil {
+				t.Errorf("%+v: expected an error", tc)
+			}
+			continue
+		}
+		if err != nil || network != tc.network {
+			t.Errorf("%+v: unexpected network %q: %v", tc, network, err)
+		}
+	}
+}
+
+// TestCreateDriverStorageMiddleware checks that the driver of the commands is
+// wrapped with the configured storage middlewares, so that the content they
+// write is encrypted as the registry would, and read back decrypted.
+func TestCreateDriverStorageMiddleware(t *testing.T) {
+	root, err := ioutil.TempDir("", "registry-middleware-")
+	if err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"filesystem": configuration.Parameters{"rootdirectory": root},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"storage": {{
+				Name:    "encryption",
+				Options: configuration.Parameters{"key": base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))},
+			}},
+		},
+	}
+
+	driver, err := createDriver(config)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	ctx := context.Background()
+	content := []byte("plaintext content")
+	if err := driver.PutContent(ctx, "/content", content); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+
+	stored, err := ioutil.ReadFile(path.Join(root, "content"))
+	if err != nil {
+		t.Fatalf("unexpected error reading stored content: %v", err)
+	}
+	if bytes.Contains(stored, content) {
+		t.Fatal("content stored unencrypted")
+	}
+
+	read, err := driver.GetContent(ctx, "/content")
+	if err != nil {
+		t.Fatalf("unexpected error getting content: %v", err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Fatalf("unexpected content read: %q", read)
+	}
+
+	config.Middleware["storage"][0].Options = configuration.Parameters{}
+	if _, err := createDriver(config); err == nil {
+		t.Fatal("expected an error for an invalid storage middleware")
+	}
+}
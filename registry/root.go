@@ -1,15 +1,33 @@
 package registry
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/distribution/distribution/v3/configuration"
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	grpcdriver "github.com/distribution/distribution/v3/registry/storage/driver/grpc"
 	"github.com/distribution/distribution/v3/version"
 	"github.com/docker/libtrust"
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var showVersion bool
@@ -17,8 +35,31 @@ var showVersion bool
 func init() {
 	RootCmd.AddCommand(ServeCmd)
 	RootCmd.AddCommand(GCCmd)
+	RootCmd.AddCommand(BlobDuplicatesCmd)
+	RootCmd.AddCommand(FsckCmd)
+	RootCmd.AddCommand(PruneTagsCmd)
+	RootCmd.AddCommand(FilterManifestListCmd)
+	RootCmd.AddCommand(CreateManifestListCmd)
+	RootCmd.AddCommand(ExportOCILayoutCmd)
+	RootCmd.AddCommand(ImportOCILayoutCmd)
+	RootCmd.AddCommand(StorageServerCmd)
 	GCCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "do everything except remove the blobs")
-	GCCmd.Flags().BoolVarP(&removeUntagged, "delete-untagged", "m", false, "delete manifests that are not currently referenced via tag")
+	GCCmd.Flags().StringVar(&gcMetricsFile, "metrics-file", "", "write the garbage collection metrics to this file in the Prometheus text format once done, such as for the textfile collector of the node exporter")
+	GCCmd.Flags().DurationVar(&gcGracePeriod, "grace-period", 0, "keep blobs and untagged manifests modified more recently than this duration ago, such as 1h, even if unreferenced")
+	GCCmd.Flags().DurationVar(&gcLockTTL, "lock-ttl", storage.DefaultGCLockTTL, "how long the lock keeping garbage collection runs from overlapping outlives a run which crashed or was killed")
+	GCCmd.Flags().BoolVarP(&removeUntagged, "delete-untagged", "m", false, "delete manifests that are not currently referenced via tag, by a tagged manifest list or as a referrer of another manifest kept")
+	FsckCmd.Flags().BoolVar(&fsckVerifyDigests, "verify-digests", false, "read every blob and check its content matches its digest")
+	FsckCmd.Flags().BoolVar(&fsckRepairTags, "repair-tags", false, "delete the tags which do not point at a manifest of their repository")
+	PruneTagsCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "report the tags which would be deleted without deleting them")
+	FilterManifestListCmd.Flags().StringSliceVarP(&filterPlatforms, "platform", "p", nil, "platform to keep, as os/architecture[/variant], may be repeated")
+	FilterManifestListCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "report the manifest list which would be tagged without writing it")
+	ExportOCILayoutCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "file to write the layout to rather than the standard output")
+	ImportOCILayoutCmd.Flags().StringVarP(&importInput, "input", "i", "", "file to read the layout from rather than the standard input")
+	StorageServerCmd.Flags().StringVarP(&storageServerAddr, "addr", "a", "unix:///var/run/registry-storage.sock", "address to serve on, as host:port or unix:///path/to/socket")
+	StorageServerCmd.Flags().StringVar(&storageServerCertificate, "tls-certificate", "", "certificate to serve TLS with")
+	StorageServerCmd.Flags().StringVar(&storageServerKey, "tls-key", "", "key to serve TLS with")
+	StorageServerCmd.Flags().StringVar(&storageServerClientCA, "tls-client-ca", "", "CA certificate client certificates are required to be signed by")
+	StorageServerCmd.Flags().BoolVar(&storageServerInsecure, "insecure", false, "serve on a TCP address without TLS or client certificates")
 	RootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show the version and exit")
 }
 
@@ -38,6 +79,9 @@ var RootCmd = &cobra.Command{
 
 var dryRun bool
 var removeUntagged bool
+var gcMetricsFile string
+var gcGracePeriod time.Duration
+var gcLockTTL time.Duration
 
 // GCCmd is the cobra command that corresponds to the garbage-collect subcommand
 var GCCmd = &cobra.Command{
@@ -52,7 +96,7 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
+		driver, err := createDriver(config)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
 			os.Exit(1)
@@ -80,10 +124,615 @@ var GCCmd = &cobra.Command{
 		err = storage.MarkAndSweep(ctx, driver, registry, storage.GCOpts{
 			DryRun:         dryRun,
 			RemoveUntagged: removeUntagged,
+			GracePeriod:    gcGracePeriod,
+			LockTTL:        gcLockTTL,
+
+			MaxManifestListDepth: config.Policy.MaxManifestListDepth,
 		})
+		if gcMetricsFile != "" {
+			// Written on failure too, for the duration of the run.
+			if err := writeMetricsFile(gcMetricsFile, metrics.GCNamespace); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write metrics: %v", err)
+			}
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to garbage collect: %v", err)
 			os.Exit(1)
 		}
 	},
 }
+
+// BlobDuplicatesCmd is the cobra command that corresponds to the
+// blob-duplicates subcommand
+var BlobDuplicatesCmd = &cobra.Command{
+	Use:   "blob-duplicates <config>",
+	Short: "`blob-duplicates` reports blobs stored at more than one path",
+	Long:  "`blob-duplicates` walks the blob store and reports, as JSON, any blob content stored at more than one path along with the wasted bytes",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := createDriver(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		report, err := storage.FindDuplicateBlobs(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to find duplicate blobs: %v", err)
+			os.Exit(1)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write report: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var (
+	fsckVerifyDigests bool
+	fsckRepairTags    bool
+)
+
+// FsckCmd is the cobra command that corresponds to the fsck subcommand
+var FsckCmd = &cobra.Command{
+	Use:   "fsck <config>",
+	Short: "`fsck` checks the storage for inconsistencies",
+	Long:  "`fsck` walks the storage and reports, as JSON, manifests referencing missing blobs, tags not pointing at a manifest and, with --verify-digests, blobs whose content does not match their digest. It exits with status 2 if any inconsistency is found",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := createDriver(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		report, err := storage.Fsck(ctx, driver, registry, storage.FsckOpts{
+			VerifyDigests: fsckVerifyDigests,
+			RepairTags:    fsckRepairTags,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to check storage: %v", err)
+			os.Exit(1)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write report: %v", err)
+			os.Exit(1)
+		}
+		if !report.Consistent() {
+			os.Exit(2)
+		}
+	},
+}
+
+// PruneTagsCmd is the cobra command that corresponds to the prune-tags
+// subcommand
+var PruneTagsCmd = &cobra.Command{
+	Use:   "prune-tags <config>",
+	Short: "`prune-tags` deletes tags outside of the retention policy",
+	Long:  "`prune-tags` deletes the tags which fall outside of the retention rules of the configuration, by push time and count",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := createDriver(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		opts := storage.TagRetentionOpts{DryRun: dryRun}
+		for _, rule := range config.Policy.Retention.Rules {
+			opts.Rules = append(opts.Rules, storage.RetentionRule{
+				Repository:    rule.Repository,
+				Tags:          rule.Tags,
+				KeepLast:      rule.KeepLast,
+				KeepNewerThan: rule.KeepNewerThan,
+			})
+		}
+
+		if _, err := storage.PruneTags(ctx, driver, registry, opts); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to prune tags: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var filterPlatforms []string
+
+// FilterManifestListCmd is the cobra command that corresponds to the
+// filter-manifest-list subcommand
+var FilterManifestListCmd = &cobra.Command{
+	Use:     "filter-manifest-list <config> <repository> <tag>",
+	Aliases: []string{"expand-manifest-list"},
+	Short:   "`filter-manifest-list` restricts a tagged manifest list to some platforms",
+	Long:    "`filter-manifest-list` tags a copy of the manifest list a tag points to which only references the manifests of the platforms given with --platform, and reports, as JSON, the manifests dropped which are no longer referenced by a tag. The original list stays reachable by digest until garbage collected",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 3 {
+			fmt.Fprintln(os.Stderr, "expected a configuration, a repository and a tag")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := createDriver(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		result, err := storage.FilterManifestList(ctx, registry, storage.ManifestListFilterOpts{
+			Repository: args[1],
+			Tag:        args[2],
+			Platforms:  filterPlatforms,
+			DryRun:     dryRun,
+
+			MaxManifestListDepth: config.Policy.MaxManifestListDepth,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to filter manifest list: %v", err)
+			os.Exit(1)
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write result: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// CreateManifestListCmd is the cobra command that corresponds to the
+// create-manifest-list subcommand
+var CreateManifestListCmd = &cobra.Command{
+	Use:   "create-manifest-list <config> <repository> <tag> <member>...",
+	Short: "`create-manifest-list` tags a manifest list combining single platform images",
+	Long:  "`create-manifest-list` tags a manifest list combining the image manifests of the repository the members refer to, by tag or digest, with the platforms their configs are for, and prints its digest. An OCI image index is created if any member is an OCI image manifest. Members must be image manifests for distinct platforms",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 4 {
+			fmt.Fprintln(os.Stderr, "expected a configuration, a repository, a tag and members")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := createDriver(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		named, err := reference.WithName(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid repository name %s: %v", args[1], err)
+			os.Exit(1)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct repository: %v", err)
+			os.Exit(1)
+		}
+
+		desc, err := storage.CreateManifestList(ctx, repository, args[2], args[3:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to create manifest list: %v", err)
+			os.Exit(1)
+		}
+		fmt.Println(desc.Digest)
+	},
+}
+
+var exportOutput string
+
+// ExportOCILayoutCmd is the cobra command that corresponds to the
+// export-oci-layout subcommand
+var ExportOCILayoutCmd = &cobra.Command{
+	Use:   "export-oci-layout <config> <repository> [tag...]",
+	Short: "`export-oci-layout` exports tags of a repository as an OCI image layout",
+	Long:  "`export-oci-layout` writes the given tags of a repository, or all of its tags, as a tar archive of an OCI image layout holding their manifests, the manifests of the platforms of manifest lists and the blobs they reference",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "expected a configuration and a repository")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := createDriver(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		named, err := reference.WithName(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid repository name %s: %v", args[1], err)
+			os.Exit(1)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct repository: %v", err)
+			os.Exit(1)
+		}
+
+		out := os.Stdout
+		if exportOutput != "" {
+			out, err = os.Create(exportOutput)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to create %s: %v", exportOutput, err)
+				os.Exit(1)
+			}
+		}
+		if err := storage.ExportOCILayout(ctx, repository, args[2:], config.Policy.MaxManifestListDepth, out); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export layout: %v", err)
+			os.Exit(1)
+		}
+		if err := out.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write layout: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var importInput string
+
+// ImportOCILayoutCmd is the cobra command that corresponds to the
+// import-oci-layout subcommand
+var ImportOCILayoutCmd = &cobra.Command{
+	Use:   "import-oci-layout <config> <repository> [<reference name>=<tag>...]",
+	Short: "`import-oci-layout` imports an OCI image layout into a repository",
+	Long:  "`import-oci-layout` uploads the blobs and manifests of a tar archive of an OCI image layout which the repository lacks, and tags its manifests with their reference names in the index of the layout or, if any are given, with the tags the reference names are mapped to. An import which failed may be run again to complete it",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "expected a configuration and a repository")
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		var tagMapping map[string]string
+		for _, arg := range args[2:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				fmt.Fprintf(os.Stderr, "expected <reference name>=<tag>, got %s\n", arg)
+				cmd.Usage()
+				os.Exit(1)
+			}
+			if tagMapping == nil {
+				tagMapping = make(map[string]string)
+			}
+			tagMapping[parts[0]] = parts[1]
+		}
+
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := createDriver(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		named, err := reference.WithName(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid repository name %s: %v", args[1], err)
+			os.Exit(1)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct repository: %v", err)
+			os.Exit(1)
+		}
+
+		in := os.Stdin
+		if importInput != "" {
+			in, err = os.Open(importInput)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to open %s: %v", importInput, err)
+				os.Exit(1)
+			}
+			defer in.Close()
+		}
+		if err := storage.ImportOCILayout(ctx, repository, in, tagMapping, config.Policy.MaxManifestListDepth); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to import layout: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var (
+	storageServerAddr        string
+	storageServerCertificate string
+	storageServerKey         string
+	storageServerClientCA    string
+	storageServerInsecure    bool
+)
+
+// StorageServerCmd is the cobra command that corresponds to the
+// storage-server subcommand
+var StorageServerCmd = &cobra.Command{
+	Use:   "storage-server <config>",
+	Short: "`storage-server` serves the configured storage driver over gRPC",
+	Long:  "`storage-server` serves the storage driver of the configuration over gRPC, to be used by a registry configured with the grpc storage driver",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if config.Storage.Type() == "grpc" {
+			fmt.Fprintf(os.Stderr, "storage-server cannot serve the grpc driver\n")
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		network, address, err := storageServerNetwork()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		options := grpcdriver.ServerOptions()
+		if storageServerCertificate != "" {
+			tlsConfig, err := storageServerTLSConfig()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to configure TLS: %v", err)
+				os.Exit(1)
+			}
+			options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to listen on %s: %v", storageServerAddr, err)
+			os.Exit(1)
+		}
+
+		server := grpc.NewServer(options...)
+		grpcdriver.NewServer(driver).Register(server)
+
+		dcontext.GetLogger(ctx).Infof("serving %s storage driver on %s", driver.Name(), storageServerAddr)
+		if err := server.Serve(ln); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to serve: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// storageServerNetwork returns the network and address to serve on. The
+// driver is served to anyone who can connect, so a TCP address requires TLS
+// with client certificates unless insecure is set.
+func storageServerNetwork() (string, string, error) {
+	if strings.HasPrefix(storageServerAddr, "unix://") {
+		return "unix", strings.TrimPrefix(storageServerAddr, "unix://"), nil
+	}
+
+	if !storageServerInsecure && (storageServerCertificate == "" || storageServerClientCA == "") {
+		return "", "", fmt.Errorf("serving on %s requires --tls-certificate, --tls-key and --tls-client-ca, or --insecure", storageServerAddr)
+	}
+	return "tcp", storageServerAddr, nil
+}
+
+func storageServerTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(storageServerCertificate, storageServerKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if storageServerClientCA != "" {
+		ca, err := ioutil.ReadFile(storageServerClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", storageServerClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// writeMetricsFile writes the metrics of collector to path in the Prometheus
+// text format. The file is replaced at once, so that it is never read
+// partially written.
+func writeMetricsFile(path string, collector promclient.Collector) error {
+	registry := promclient.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		return err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(tmp, family); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// createDriver creates the storage driver of config, for the storage layout
+// it is configured with, wrapped with the configured storage middlewares as
+// the registry does, so that commands read and write content as it serves
+// it.
+func createDriver(config *configuration.Configuration) (storagedriver.StorageDriver, error) {
+	driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
+	if err != nil {
+		return nil, err
+	}
+	layoutVersion, err := config.Storage.LayoutVersion()
+	if err != nil {
+		return nil, err
+	}
+	driver, err = storage.WithLayoutVersion(driver, layoutVersion)
+	if err != nil {
+		return nil, err
+	}
+	for _, mw := range config.Middleware["storage"] {
+		driver, err = storagemiddleware.Get(mw.Name, mw.Options, driver)
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure storage middleware (%s): %v", mw.Name, err)
+		}
+	}
+	return driver, nil
+}
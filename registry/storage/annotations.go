@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// MaxIndexedAnnotations is the maximum number of annotation keys which may be
+// indexed, bounding the links written for each manifest pushed.
+const MaxIndexedAnnotations = 16
+
+// annotationIndex is the set of the annotation keys manifests are indexed by.
+type annotationIndex map[string]struct{}
+
+// IndexedAnnotations returns a functional option for NewRegistry. It indexes
+// pushed manifests by the values of their annotations with the given keys, so
+// that the manifests with a value of an annotation can be listed with
+// ManifestsByAnnotation.
+func IndexedAnnotations(keys []string) RegistryOption {
+	return func(registry *registry) error {
+		if len(keys) > MaxIndexedAnnotations {
+			return fmt.Errorf("%d annotations indexed, at most %d may be", len(keys), MaxIndexedAnnotations)
+		}
+		registry.annotationIndex = make(annotationIndex, len(keys))
+		for _, key := range keys {
+			if key == "" {
+				return fmt.Errorf("empty indexed annotation key")
+			}
+			registry.annotationIndex[key] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// manifestAnnotations returns the annotations of manifest, if it is of a type
+// which has any.
+func manifestAnnotations(manifest distribution.Manifest) map[string]string {
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		return m.Annotations
+	case *manifestlist.DeserializedManifestList:
+		return m.Annotations
+	}
+	return nil
+}
+
+// link links the manifest revision of the named repository under the values
+// of its indexed annotations.
+func (idx annotationIndex) link(ctx context.Context, driver storagedriver.StorageDriver, name string, revision digest.Digest, annotations map[string]string) error {
+	for key, value := range annotations {
+		if _, ok := idx[key]; !ok {
+			continue
+		}
+		linkPath, err := pathFor(manifestAnnotationLinkPathSpec{
+			name:     name,
+			key:      key,
+			value:    value,
+			revision: revision,
+		})
+		if err != nil {
+			return err
+		}
+		if err := driver.PutContent(ctx, linkPath, []byte(revision)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlink removes the links to the manifest revision of the named repository
+// from the values of its indexed annotations.
+func (idx annotationIndex) unlink(ctx context.Context, driver storagedriver.StorageDriver, name string, revision digest.Digest, annotations map[string]string) error {
+	for key, value := range annotations {
+		if _, ok := idx[key]; !ok {
+			continue
+		}
+		linkPath, err := pathFor(manifestAnnotationLinkPathSpec{
+			name:     name,
+			key:      key,
+			value:    value,
+			revision: revision,
+		})
+		if err != nil {
+			return err
+		}
+		if err := driver.Delete(ctx, linkPath); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storedAnnotations reads the annotations of the stored manifest revision.
+func storedAnnotations(ctx context.Context, blobs distribution.BlobProvider, revision digest.Digest) (map[string]string, error) {
+	content, err := blobs.Get(ctx, revision)
+	if err != nil {
+		return nil, err
+	}
+	var m struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, err
+	}
+	return m.Annotations, nil
+}
+
+// ManifestsByAnnotation returns the manifests of the named repository whose
+// annotation key has the given value, ordered by digest. Only the manifests
+// pushed while key was indexed are found, and manifests deleted since are
+// skipped.
+func ManifestsByAnnotation(ctx context.Context, driver storagedriver.StorageDriver, name, key, value string) ([]Referrer, error) {
+	root, err := pathFor(manifestAnnotationPathSpec{
+		name:  name,
+		key:   key,
+		value: value,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return listLinkedManifests(ctx, driver, name, root)
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	testCreatedAnnotation = "org.opencontainers.image.created"
+	testTeamAnnotation    = "com.example.team"
+)
+
+// putAnnotated pushes an artifact manifest with the given annotations.
+func putAnnotated(t *testing.T, repo distribution.Repository, annotations map[string]string) digest.Digest {
+	t.Helper()
+	ctx := context.Background()
+
+	layer, err := repo.Blobs(ctx).Put(ctx, testArtifactType, []byte(fmt.Sprint(annotations)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.MediaType = testArtifactType
+
+	dm, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageManifest,
+		},
+		ArtifactType: testArtifactType,
+		Config:       ocischema.DescriptorEmptyJSON,
+		Layers:       []distribution.Descriptor{layer},
+		Annotations:  annotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dgst, err := makeManifestService(t, repo).Put(ctx, dm)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+	return dgst
+}
+
+// checkAnnotated checks that the manifests of repository test whose
+// annotation key has value are expected, in order.
+func checkAnnotated(t *testing.T, d *inmemory.Driver, key, value string, expected ...digest.Digest) {
+	t.Helper()
+	manifests, err := ManifestsByAnnotation(context.Background(), d, "test", key, value)
+	if err != nil {
+		t.Fatalf("unexpected error listing manifests with %s=%s: %v", key, value, err)
+	}
+	if len(manifests) != len(expected) {
+		t.Fatalf("unexpected manifests with %s=%s: %v", key, value, manifests)
+	}
+	for i, m := range manifests {
+		if m.Digest != expected[i] || m.Annotations[key] != value {
+			t.Fatalf("unexpected manifests with %s=%s: %v", key, value, manifests)
+		}
+	}
+}
+
+func TestAnnotationIndex(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d, IndexedAnnotations([]string{testCreatedAnnotation, testTeamAnnotation}))
+	repo := makeRepository(t, registry, "test")
+
+	first := putAnnotated(t, repo, map[string]string{
+		testCreatedAnnotation: "2024-01-01T00:00:00Z",
+		testTeamAnnotation:    "platform",
+		"com.example.ignored": "ignored",
+	})
+	second := putAnnotated(t, repo, map[string]string{
+		testCreatedAnnotation: "2024-02-01T00:00:00Z",
+		testTeamAnnotation:    "platform",
+	})
+	both := []digest.Digest{first, second}
+	if both[0] > both[1] {
+		both[0], both[1] = both[1], both[0]
+	}
+
+	checkAnnotated(t, d, testCreatedAnnotation, "2024-01-01T00:00:00Z", first)
+	checkAnnotated(t, d, testCreatedAnnotation, "2024-02-01T00:00:00Z", second)
+	checkAnnotated(t, d, testTeamAnnotation, "platform", both...)
+	checkAnnotated(t, d, testTeamAnnotation, "security")
+	checkAnnotated(t, d, "com.example.ignored", "ignored")
+
+	// Deleted manifests are removed from the index.
+	if err := makeManifestService(t, repo).Delete(ctx, first); err != nil {
+		t.Fatalf("unexpected error deleting manifest: %v", err)
+	}
+	checkAnnotated(t, d, testCreatedAnnotation, "2024-01-01T00:00:00Z")
+	checkAnnotated(t, d, testTeamAnnotation, "platform", second)
+	linkPath, err := pathFor(manifestAnnotationLinkPathSpec{
+		name:     "test",
+		key:      testTeamAnnotation,
+		value:    "platform",
+		revision: first,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, linkPath); err == nil {
+		t.Fatalf("link of deleted manifest %s was not removed", first)
+	}
+}
+
+func TestIndexedAnnotationsBounded(t *testing.T) {
+	keys := make([]string, MaxIndexedAnnotations+1)
+	for i := range keys {
+		keys[i] = fmt.Sprint("com.example.key", i)
+	}
+	if _, err := NewRegistry(context.Background(), inmemory.New(), IndexedAnnotations(keys)); err == nil {
+		t.Fatalf("expected an error indexing %d annotations", len(keys))
+	}
+	if _, err := NewRegistry(context.Background(), inmemory.New(), IndexedAnnotations(keys[:MaxIndexedAnnotations])); err != nil {
+		t.Fatalf("unexpected error indexing %d annotations: %v", MaxIndexedAnnotations, err)
+	}
+}
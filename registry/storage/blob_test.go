@@ -532,6 +532,53 @@ func TestLayerUploadZeroLength(t *testing.T) {
 	simpleUpload(t, bs, []byte{}, digestSha256Empty)
 }
 
+// TestBlobCommitAfterInterruptedMove checks that committing a blob replaces
+// the incomplete content an interrupted move may have left behind, when Move
+// of the storage driver is not atomic.
+func TestBlobCommitAfterInterruptedMove(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	driver := testdriver.New()
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()), EnableDelete, EnableRedirect)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	content := []byte("content moved with a non-atomic move")
+	dgst := digest.FromBytes(content)
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatalf("unexpected error getting blob path: %v", err)
+	}
+	if err := driver.PutContent(ctx, blobPath, content[:10]); err != nil {
+		t.Fatalf("unexpected error putting incomplete content: %v", err)
+	}
+
+	wr, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	if _, err := wr.Write(content); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if _, err := wr.Commit(ctx, distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+
+	stored, err := driver.GetContent(ctx, blobPath)
+	if err != nil {
+		t.Fatalf("unexpected error getting blob content: %v", err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Fatalf("incomplete content was not replaced: %q", stored)
+	}
+}
+
 func simpleUpload(t *testing.T, bs distribution.BlobIngester, blob []byte, expectedDigest digest.Digest) {
 	ctx := context.Background()
 	wr, err := bs.Create(ctx)
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// DuplicateBlob describes a blob whose content is stored at more than one
+// physical path in the blob store.
+type DuplicateBlob struct {
+	// Digest identifies the duplicated content.
+	Digest digest.Digest `json:"digest"`
+
+	// Size is the size of a single copy of the content, in bytes.
+	Size int64 `json:"size"`
+
+	// Paths lists every data path at which the content is stored.
+	Paths []string `json:"paths"`
+
+	// WastedBytes is the space taken by all copies but one.
+	WastedBytes int64 `json:"wastedBytes"`
+}
+
+// BlobDuplicatesReport is the result of a walk of the blob store looking for
+// duplicated content.
+type BlobDuplicatesReport struct {
+	// Blobs is the number of distinct digests found in the blob store.
+	Blobs int `json:"blobs"`
+
+	// Duplicates lists the digests stored at more than one path, ordered by
+	// digest.
+	Duplicates []DuplicateBlob `json:"duplicates"`
+
+	// WastedBytes is the total space which could be reclaimed by removing
+	// the duplicated copies.
+	WastedBytes int64 `json:"wastedBytes"`
+}
+
+// FindDuplicateBlobs walks the blob store and reports any digest whose
+// content is stored at more than one physical path. Blobs are shared between
+// repositories, so this should never happen in a healthy registry, but broken
+// imports may leave content behind under a different layout, such as an
+// unsharded or wrongly sharded directory.
+func FindDuplicateBlobs(ctx context.Context, storageDriver driver.StorageDriver) (*BlobDuplicatesReport, error) {
+	rootPath, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[digest.Digest][]string)
+	sizes := make(map[digest.Digest]int64)
+
+	err = storageDriver.Walk(ctx, rootPath, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() {
+			return nil
+		}
+
+		dataPath := fileInfo.Path()
+		if path.Base(dataPath) != "data" {
+			return nil
+		}
+
+		dgst, ok := blobDigestFromDataPath(rootPath, dataPath)
+		if !ok {
+			dcontext.GetLogger(ctx).Warnf("skipping unrecognized blob path: %s", dataPath)
+			return nil
+		}
+
+		paths[dgst] = append(paths[dgst], dataPath)
+		sizes[dgst] = fileInfo.Size()
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return nil, err
+		}
+	}
+
+	report := &BlobDuplicatesReport{
+		Blobs:      len(paths),
+		Duplicates: []DuplicateBlob{},
+	}
+
+	for dgst, dataPaths := range paths {
+		if len(dataPaths) < 2 {
+			continue
+		}
+
+		sort.Strings(dataPaths)
+		wasted := sizes[dgst] * int64(len(dataPaths)-1)
+		report.Duplicates = append(report.Duplicates, DuplicateBlob{
+			Digest:      dgst,
+			Size:        sizes[dgst],
+			Paths:       dataPaths,
+			WastedBytes: wasted,
+		})
+		report.WastedBytes += wasted
+	}
+
+	sort.Slice(report.Duplicates, func(i, j int) bool {
+		return report.Duplicates[i].Digest < report.Duplicates[j].Digest
+	})
+
+	return report, nil
+}
+
+// blobDigestFromDataPath recovers the digest of a blob from the path of its
+// data file, regardless of how the directories between the algorithm and the
+// hex digest are laid out.
+func blobDigestFromDataPath(rootPath, dataPath string) (digest.Digest, bool) {
+	rel := strings.TrimPrefix(dataPath, rootPath+"/")
+	components := strings.Split(rel, "/")
+	if len(components) < 3 {
+		return "", false
+	}
+
+	algorithm := components[0]
+	hex := components[len(components)-2]
+
+	dgst := digest.NewDigestFromHex(algorithm, hex)
+	if err := dgst.Validate(); err != nil {
+		return "", false
+	}
+
+	return dgst, true
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFindDuplicateBlobs(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	duplicated := []byte("duplicated blob content")
+	unique := []byte("unique blob content")
+	duplicatedDigest := digest.FromBytes(duplicated)
+	uniqueDigest := digest.FromBytes(unique)
+
+	canonicalPath := func(dgst digest.Digest) string {
+		p, err := pathFor(blobDataPathSpec{digest: dgst})
+		if err != nil {
+			t.Fatalf("unexpected error building blob path: %v", err)
+		}
+		return p
+	}
+
+	root, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		t.Fatalf("unexpected error building blobs path: %v", err)
+	}
+
+	// Lay out the duplicated blob at its canonical path and again in an
+	// unsharded directory, as a broken import might.
+	unshardedPath := path.Join(root, duplicatedDigest.Algorithm().String(), duplicatedDigest.Hex(), "data")
+	for p, content := range map[string][]byte{
+		canonicalPath(duplicatedDigest): duplicated,
+		unshardedPath:                   duplicated,
+		canonicalPath(uniqueDigest):     unique,
+	} {
+		if err := d.PutContent(ctx, p, content); err != nil {
+			t.Fatalf("unexpected error writing %s: %v", p, err)
+		}
+	}
+
+	report, err := FindDuplicateBlobs(ctx, d)
+	if err != nil {
+		t.Fatalf("unexpected error finding duplicates: %v", err)
+	}
+
+	if report.Blobs != 2 {
+		t.Fatalf("expected 2 distinct blobs, got %d", report.Blobs)
+	}
+
+	if len(report.Duplicates) != 1 {
+		t.Fatalf("expected 1 duplicated blob, got %d: %#v", len(report.Duplicates), report.Duplicates)
+	}
+
+	dup := report.Duplicates[0]
+	if dup.Digest != duplicatedDigest {
+		t.Fatalf("unexpected duplicated digest: %s != %s", dup.Digest, duplicatedDigest)
+	}
+
+	if len(dup.Paths) != 2 {
+		t.Fatalf("expected 2 paths for duplicated blob, got %v", dup.Paths)
+	}
+
+	if dup.WastedBytes != int64(len(duplicated)) || report.WastedBytes != int64(len(duplicated)) {
+		t.Fatalf("unexpected wasted bytes: %d, %d != %d", dup.WastedBytes, report.WastedBytes, len(duplicated))
+	}
+
+	p, err := json.Marshal(report)
+	if err != nil {
+		t.Fatalf("unexpected error marshaling report: %v", err)
+	}
+
+	var decoded BlobDuplicatesReport
+	if err := json.Unmarshal(p, &decoded); err != nil {
+		t.Fatalf("unexpected error unmarshaling report: %v", err)
+	}
+
+	if decoded.WastedBytes != report.WastedBytes || len(decoded.Duplicates) != 1 {
+		t.Fatalf("report did not survive json roundtrip: %s", p)
+	}
+}
+
+func TestFindDuplicateBlobsEmpty(t *testing.T) {
+	report, err := FindDuplicateBlobs(context.Background(), inmemory.New())
+	if err != nil {
+		t.Fatalf("unexpected error finding duplicates: %v", err)
+	}
+
+	if report.Blobs != 0 || len(report.Duplicates) != 0 || report.WastedBytes != 0 {
+		t.Fatalf("expected an empty report, got %#v", report)
+	}
+}
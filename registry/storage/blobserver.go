@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
 )
@@ -34,7 +36,7 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		return err
 	}
 
-	if bs.redirect {
+	if bs.redirect && !redirectDisabled(ctx) {
 		redirectURL, err := bs.driver.URLFor(ctx, path, map[string]interface{}{"method": r.Method})
 		switch err.(type) {
 		case nil:
@@ -50,29 +52,79 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		}
 	}
 
+	if file, ok := bs.openFile(ctx, path, desc.Size); ok {
+		defer file.Close()
+
+		// ServeContent copies from the file itself, which the connection
+		// sends with sendfile where it supports it.
+		SetBlobHeaders(w.Header(), desc)
+		http.ServeContent(w, r, desc.Digest.String(), time.Time{}, file)
+		return nil
+	}
+
 	br, err := newFileReader(ctx, bs.driver, path, desc.Size)
 	if err != nil {
 		return err
 	}
 	defer br.Close()
 
-	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, desc.Digest)) // If-None-Match handled by ServeContent
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%.f", blobCacheControlMaxAge.Seconds()))
+	SetBlobHeaders(w.Header(), desc) // If-None-Match handled by ServeContent
+	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, br)
+	return nil
+}
 
-	if w.Header().Get("Docker-Content-Digest") == "" {
-		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+// openFile opens the file holding the blob content stored at path, of the
+// given size, if the driver stores it in a local file. Blobs are read through
+// the driver otherwise, or when the file is not the size of the blob, so that
+// no more than the blob is ever served.
+func (bs *blobServer) openFile(ctx context.Context, path string, size int64) (*os.File, bool) {
+	file, err := driver.OpenFile(ctx, bs.driver, path)
+	if err != nil {
+		if _, ok := err.(driver.ErrUnsupportedMethod); !ok {
+			dcontext.GetLogger(ctx).Debugf("error opening %s, reading it through the driver: %v", path, err)
+		}
+		return nil, false
+	}
+	fi, err := file.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != size {
+		file.Close()
+		return nil, false
 	}
+	return file, true
+}
+
+type redirectDisabledKey struct{}
 
-	if w.Header().Get("Content-Type") == "" {
+// WithRedirectDisabled returns a context in which blobs are served with their
+// content, even by registries redirecting blob requests to the backend.
+func WithRedirectDisabled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, redirectDisabledKey{}, true)
+}
+
+func redirectDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(redirectDisabledKey{}).(bool)
+	return disabled
+}
+
+// SetBlobHeaders sets the headers the blob server describes the blob desc
+// with, so that a response without the content, such as one to a HEAD
+// request, matches the one serving it.
+func SetBlobHeaders(header http.Header, desc distribution.Descriptor) {
+	header.Set("ETag", fmt.Sprintf(`"%s"`, desc.Digest))
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%.f", blobCacheControlMaxAge.Seconds()))
+	header.Set("Accept-Ranges", "bytes")
+
+	if header.Get("Docker-Content-Digest") == "" {
+		header.Set("Docker-Content-Digest", desc.Digest.String())
+	}
+
+	if header.Get("Content-Type") == "" {
 		// Set the content type if not already set.
-		w.Header().Set("Content-Type", desc.MediaType)
+		header.Set("Content-Type", desc.MediaType)
 	}
 
-	if w.Header().Get("Content-Length") == "" {
+	if header.Get("Content-Length") == "" {
 		// Set the content length if not already set.
-		w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+		header.Set("Content-Length", fmt.Sprint(desc.Size))
 	}
-
-	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, br)
-	return nil
 }
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/opencontainers/go-digest"
+)
+
+// newFileBlobServer returns a server of the blob of the given size stored by
+// a filesystem driver, sending it with sendfile unless disabled, and the
+// content of the blob.
+func newFileBlobServer(tb testing.TB, size int, disableSendfile bool) (*httptest.Server, distribution.BlobStore, []byte) {
+	root, err := ioutil.TempDir("", "blob-server-")
+	if err != nil {
+		tb.Fatalf("unexpected error creating temporary directory: %v", err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(root) })
+
+	ctx := context.Background()
+	driver := filesystem.New(filesystem.DriverParameters{RootDirectory: root, MaxThreads: 100, DisableSendfile: disableSendfile})
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider()))
+	if err != nil {
+		tb.Fatalf("error creating registry: %v", err)
+	}
+	name, _ := reference.WithName("foo/bar")
+	repository, err := registry.Repository(ctx, name)
+	if err != nil {
+		tb.Fatalf("unexpected error getting repo: %v", err)
+	}
+	blobs := repository.Blobs(ctx)
+
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	desc, err := blobs.Put(ctx, "application/octet-stream", content)
+	if err != nil {
+		tb.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, w := dcontext.WithResponseWriter(r.Context(), w)
+		if err := blobs.ServeBlob(ctx, w, r, desc.Digest); err != nil {
+			tb.Errorf("unexpected error serving blob: %v", err)
+		}
+	}))
+	tb.Cleanup(server.Close)
+	return server, blobs, content
+}
+
+func TestServeBlobFromFile(t *testing.T) {
+	for _, disableSendfile := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disablesendfile=%v", disableSendfile), func(t *testing.T) {
+			server, blobs, content := newFileBlobServer(t, 3<<20+17, disableSendfile)
+
+			dgst := digest.FromBytes(content)
+			bs := blobs.(*linkedBlobStore).blobServer.(*blobServer)
+			file, ok := bs.openFile(context.Background(), mustBlobDataPath(t, dgst), int64(len(content)))
+			if ok {
+				file.Close()
+			}
+			if ok == disableSendfile {
+				t.Fatalf("blob served from its file: %v, expected %v", ok, !disableSendfile)
+			}
+
+			for _, tc := range []struct {
+				rangeHeader string
+				status      int
+				expected    []byte
+			}{
+				{"", http.StatusOK, content},
+				{"bytes=0-0", http.StatusPartialContent, content[:1]},
+				{"bytes=1048576-2097151", http.StatusPartialContent, content[1<<20 : 2<<20]},
+				{"bytes=-17", http.StatusPartialContent, content[len(content)-17:]},
+			} {
+				req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tc.rangeHeader != "" {
+					req.Header.Set("Range", tc.rangeHeader)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("unexpected error fetching blob: %v", err)
+				}
+				body, err := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatalf("unexpected error reading blob: %v", err)
+				}
+				if resp.StatusCode != tc.status {
+					t.Fatalf("range %q: unexpected status %d, expected %d", tc.rangeHeader, resp.StatusCode, tc.status)
+				}
+				if !bytes.Equal(body, tc.expected) {
+					t.Fatalf("range %q: served %d bytes differing from the %d expected", tc.rangeHeader, len(body), len(tc.expected))
+				}
+				if resp.Header.Get("Docker-Content-Digest") != dgst.String() {
+					t.Fatalf("unexpected digest header %q", resp.Header.Get("Docker-Content-Digest"))
+				}
+			}
+		})
+	}
+}
+
+func mustBlobDataPath(t *testing.T, dgst digest.Digest) string {
+	path, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkServeBlob compares serving a large blob with sendfile to copying
+// it through the registry.
+func BenchmarkServeBlob(b *testing.B) {
+	for _, disableSendfile := range []bool{false, true} {
+		b.Run(fmt.Sprintf("disablesendfile=%v", disableSendfile), func(b *testing.B) {
+			server, _, content := newFileBlobServer(b, 64<<20, disableSendfile)
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(server.URL)
+				if err != nil {
+					b.Fatalf("unexpected error fetching blob: %v", err)
+				}
+				n, err := io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != int64(len(content)) {
+					b.Fatalf("unexpected error reading blob: %d bytes read, %v", n, err)
+				}
+			}
+		})
+	}
+}
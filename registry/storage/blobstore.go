@@ -17,6 +17,10 @@ import (
 type blobStore struct {
 	driver  driver.StorageDriver
 	statter distribution.BlobStatter
+
+	// storeContentTypes stores blobs with the Content-Type of their media
+	// type, for the drivers storing one.
+	storeContentTypes bool
 }
 
 var _ distribution.BlobProvider = &blobStore{}
@@ -75,6 +79,10 @@ func (bs *blobStore) Put(ctx context.Context, mediaType string, p []byte) (distr
 		return distribution.Descriptor{}, err
 	}
 
+	if bs.storeContentTypes && mediaType != "" {
+		ctx = driver.WithContentType(ctx, mediaType)
+	}
+
 	// TODO(stevvooe): Write out mediatype here, as well.
 	return distribution.Descriptor{
 		Size: int64(len(p)),
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -41,6 +42,15 @@ type blobWriter struct {
 
 	resumableDigestEnabled bool
 	committed              bool
+	cancelled              bool
+
+	// minChunkSize is the minimum size of the chunks written to the data
+	// file, zero if any size is written. The data received since the last
+	// chunk is held in pending, which is kept in the upload directory
+	// between requests.
+	minChunkSize  int64
+	pending       []byte
+	pendingStored bool
 }
 
 var _ distribution.BlobWriter = &blobWriter{}
@@ -59,11 +69,21 @@ func (bw *blobWriter) StartedAt() time.Time {
 func (bw *blobWriter) Commit(ctx context.Context, desc distribution.Descriptor) (distribution.Descriptor, error) {
 	dcontext.GetLogger(ctx).Debug("(*blobWriter).Commit")
 
+	// The last chunk of an upload may be smaller than the minimum.
+	if err := bw.flushPending(); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
 	if err := bw.fileWriter.Commit(); err != nil {
 		return distribution.Descriptor{}, err
 	}
 
 	bw.Close()
+
+	// A size given by the caller must match the size written.
+	if desc.Size > 0 && desc.Size != bw.Size() {
+		return distribution.Descriptor{}, distribution.ErrBlobInvalidLength
+	}
 	desc.Size = bw.Size()
 
 	canonical, err := bw.validateBlob(ctx, desc)
@@ -103,15 +123,31 @@ func (bw *blobWriter) Cancel(ctx context.Context) error {
 	if err := bw.Close(); err != nil {
 		dcontext.GetLogger(ctx).Errorf("error closing blobwriter: %s", err)
 	}
+	bw.cancelled = true
 
 	return bw.removeResources(ctx)
 }
 
 func (bw *blobWriter) Size() int64 {
-	return bw.fileWriter.Size()
+	return bw.fileWriter.Size() + int64(len(bw.pending))
 }
 
 func (bw *blobWriter) Write(p []byte) (int, error) {
+	if bw.minChunkSize <= 0 {
+		return bw.write(p)
+	}
+
+	bw.pending = append(bw.pending, p...)
+	if int64(len(bw.pending)) < bw.minChunkSize {
+		return len(p), nil
+	}
+	if err := bw.flushPending(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (bw *blobWriter) write(p []byte) (int, error) {
 	// Ensure that the current write offset matches how many bytes have been
 	// written to the digester. If not, we need to update the digest state to
 	// match the current write position.
@@ -131,6 +167,29 @@ func (bw *blobWriter) Write(p []byte) (int, error) {
 }
 
 func (bw *blobWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if bw.minChunkSize <= 0 {
+		return bw.readFrom(r)
+	}
+
+	// Hold the data until the minimum is reached, the rest of r is then
+	// written along with it.
+	pending := bytes.NewBuffer(bw.pending)
+	n, err = io.CopyN(pending, r, bw.minChunkSize-int64(len(bw.pending)))
+	bw.pending = pending.Bytes()
+	if err == io.EOF {
+		return n, nil
+	} else if err != nil {
+		return n, err
+	}
+	if err := bw.flushPending(); err != nil {
+		return n, err
+	}
+
+	nn, err := bw.readFrom(r)
+	return n + nn, err
+}
+
+func (bw *blobWriter) readFrom(r io.Reader) (n int64, err error) {
 	// Ensure that the current write offset matches how many bytes have been
 	// written to the digester. If not, we need to update the digest state to
 	// match the current write position.
@@ -152,12 +211,90 @@ func (bw *blobWriter) Close() error {
 	if bw.committed {
 		return errors.New("blobwriter close after commit")
 	}
+	// Closing a cancelled upload would store its hash state again.
+	if bw.cancelled {
+		return errors.New("blobwriter close after cancel")
+	}
 
 	if err := bw.storeHashState(bw.blobStore.ctx); err != nil && err != errResumableDigestNotAvailable {
 		return err
 	}
 
-	return bw.fileWriter.Close()
+	if err := bw.fileWriter.Close(); err != nil {
+		return err
+	}
+
+	// The pending data is only stored once the chunks written before it are,
+	// so that it is never counted twice.
+	return bw.storePending(bw.blobStore.ctx)
+}
+
+// flushPending writes the pending data to the data file.
+func (bw *blobWriter) flushPending() error {
+	if len(bw.pending) == 0 {
+		return nil
+	}
+	if _, err := bw.write(bw.pending); err != nil {
+		return err
+	}
+	bw.pending = nil
+	return nil
+}
+
+func (bw *blobWriter) pendingPath() (string, error) {
+	return pathFor(uploadPendingPathSpec{
+		name: bw.blobStore.repository.Named().Name(),
+		id:   bw.id,
+	})
+}
+
+// loadPending reads the data left pending by the previous requests to the
+// upload.
+func (bw *blobWriter) loadPending(ctx context.Context) error {
+	pendingPath, err := bw.pendingPath()
+	if err != nil {
+		return err
+	}
+
+	pending, err := bw.driver.GetContent(ctx, pendingPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	bw.pending = pending
+	bw.pendingStored = true
+	return nil
+}
+
+// storePending stores the pending data for the next request to the upload,
+// deleting the data stored before if it was all written.
+func (bw *blobWriter) storePending(ctx context.Context) error {
+	if len(bw.pending) == 0 && !bw.pendingStored {
+		return nil
+	}
+
+	pendingPath, err := bw.pendingPath()
+	if err != nil {
+		return err
+	}
+
+	if len(bw.pending) == 0 {
+		if err := bw.driver.Delete(ctx, pendingPath); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+		bw.pendingStored = false
+		return nil
+	}
+
+	if err := bw.driver.PutContent(ctx, pendingPath, bw.pending); err != nil {
+		return err
+	}
+	bw.pendingStored = true
+	return nil
 }
 
 // validateBlob checks the data against the digest, returning an error if it
@@ -302,7 +439,7 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc distribution.Descriptor
 	}
 
 	// Check for existence
-	if _, err := bw.blobStore.driver.Stat(ctx, blobPath); err != nil {
+	if fi, err := bw.blobStore.driver.Stat(ctx, blobPath); err != nil {
 		switch err := err.(type) {
 		case storagedriver.PathNotFoundError:
 			break // ensure that it doesn't exist.
@@ -313,8 +450,15 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc distribution.Descriptor
 		// If the path exists, we can assume that the content has already
 		// been uploaded, since the blob storage is content-addressable.
 		// While it may be corrupted, detection of such corruption belongs
-		// elsewhere.
-		return nil
+		// elsewhere. When Move is not atomic though, an interrupted move
+		// may have left incomplete content behind, which is replaced unless
+		// its size matches.
+		if storagedriver.IsMoveAtomic(bw.blobStore.driver) || fi.Size() == desc.Size {
+			return nil
+		}
+		logrus.
+			WithField("upload.id", bw.ID()).
+			WithField("digest", desc.Digest).Warnf("replacing content of size %d left at %s by an interrupted move", fi.Size(), blobPath)
 	}
 
 	// If no data was received, we may not actually have a file on disk. Check
@@ -343,6 +487,13 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc distribution.Descriptor
 	}
 
 	// TODO(stevvooe): We should also write the mediatype when executing this move.
+	if bw.blobStore.storeContentTypes {
+		contentType := desc.MediaType
+		if contentType == "" || contentType == storagedriver.DefaultContentType {
+			contentType = detectContentType(ctx, bw.blobStore.driver, bw.path)
+		}
+		ctx = storagedriver.WithContentType(ctx, contentType)
+	}
 
 	return bw.blobStore.driver.Move(ctx, bw.path, blobPath)
 }
@@ -3,11 +3,18 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/distribution/distribution/v3"
 )
 
+// ErrUnavailable is returned when clearing a descriptor from a cache which
+// cannot be reached. Other cache operations fall through to the storage
+// backend instead, but a lost invalidation would let the descriptor of
+// deleted content be served once the cache is reachable again.
+var ErrUnavailable = errors.New("cache: unavailable")
+
 // BlobDescriptorCacheProvider provides repository scoped
 // BlobDescriptorService cache instances and a global descriptor cache.
 type BlobDescriptorCacheProvider interface {
@@ -0,0 +1,128 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/docker/go-metrics"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// defaultInitialReconnectBackoff is the delay before the first attempt
+	// to reconnect to redis once it has become unavailable.
+	defaultInitialReconnectBackoff = 100 * time.Millisecond
+
+	// defaultMaxReconnectBackoff caps the delay between reconnection
+	// attempts.
+	defaultMaxReconnectBackoff = 30 * time.Second
+)
+
+var (
+	// cacheUnavailableCount is the number of cache operations which fell
+	// through to the storage backend because redis was unavailable.
+	cacheUnavailableCount metrics.Counter = prometheus.StorageNamespace.NewCounter("cache_redis_unavailable", "The number of cache operations which fell through to storage because redis was unavailable")
+)
+
+// availability tracks whether redis can be reached. Once a connection error
+// is seen, the cache is considered unavailable and operations fall through to
+// the storage backend without touching redis, while a background goroutine
+// tries to reconnect with exponential backoff.
+type availability struct {
+	pool *redis.Pool
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu          sync.Mutex
+	unavailable bool
+}
+
+func newAvailability(pool *redis.Pool) *availability {
+	return &availability{
+		pool:           pool,
+		initialBackoff: defaultInitialReconnectBackoff,
+		maxBackoff:     defaultMaxReconnectBackoff,
+	}
+}
+
+// get returns a connection from the pool, or false if redis is unavailable,
+// in which case the caller should behave as on a cache miss.
+func (a *availability) get(ctx context.Context) (redis.Conn, bool) {
+	a.mu.Lock()
+	unavailable := a.unavailable
+	a.mu.Unlock()
+
+	if unavailable {
+		cacheUnavailableCount.Inc(1)
+		return nil, false
+	}
+
+	conn := a.pool.Get()
+	if err := conn.Err(); err != nil {
+		conn.Close()
+		a.checkUnavailable(ctx, err)
+		return nil, false
+	}
+
+	return conn, true
+}
+
+// checkUnavailable reports whether err, returned by an operation on a redis
+// connection, means that redis is unavailable. If so, the cache is marked as
+// unavailable and reconnection starts in the background. Errors replied by
+// the redis server itself and cache misses do not make the cache unavailable.
+func (a *availability) checkUnavailable(ctx context.Context, err error) bool {
+	if err == nil || err == redis.ErrNil || err == distribution.ErrBlobUnknown {
+		return false
+	}
+	if _, ok := err.(redis.Error); ok {
+		return false
+	}
+
+	cacheUnavailableCount.Inc(1)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.unavailable {
+		return true
+	}
+
+	dcontext.GetLogger(ctx).Errorf("redis cache unavailable, falling through to storage: %v", err)
+	a.unavailable = true
+	go a.reconnect(context.Background())
+
+	return true
+}
+
+// reconnect pings redis with exponential backoff until it responds, then
+// marks the cache as available again.
+func (a *availability) reconnect(ctx context.Context) {
+	backoff := a.initialBackoff
+	for {
+		time.Sleep(backoff)
+
+		conn := a.pool.Get()
+		_, err := conn.Do("PING")
+		conn.Close()
+		if err == nil {
+			break
+		}
+
+		backoff *= 2
+		if backoff > a.maxBackoff {
+			backoff = a.maxBackoff
+		}
+		dcontext.GetLogger(ctx).Debugf("redis cache still unavailable, retrying in %v: %v", backoff, err)
+	}
+
+	a.mu.Lock()
+	a.unavailable = false
+	a.mu.Unlock()
+
+	dcontext.GetLogger(ctx).Infof("redis cache available again")
+}
@@ -24,7 +24,7 @@ import (
 // Note that there is no implied relationship between these two caches. The
 // layer may exist in one, both or none and the code must be written this way.
 type redisBlobDescriptorService struct {
-	pool *redis.Pool
+	availability *availability
 
 	// TODO(stevvooe): We use a pool because we don't have great control over
 	// the cache lifecycle to manage connections. A new connection if fetched
@@ -33,11 +33,15 @@ type redisBlobDescriptorService struct {
 }
 
 // NewRedisBlobDescriptorCacheProvider returns a new redis-based
-// BlobDescriptorCacheProvider using the provided redis connection pool.
+// BlobDescriptorCacheProvider using the provided redis connection pool. If redis
+// becomes unavailable, cache operations behave as cache misses, so requests
+// are served from storage, until a connection can be made again. Clearing a
+// descriptor fails with cache.ErrUnavailable meanwhile, so that deletes are
+// retried rather than leave stale descriptors in redis.
 func NewRedisBlobDescriptorCacheProvider(pool *redis.Pool) cache.BlobDescriptorCacheProvider {
 	return metrics.NewPrometheusCacheProvider(
 		&redisBlobDescriptorService{
-			pool: pool,
+			availability: newAvailability(pool),
 		},
 		"cache_redis",
 		"Number of seconds taken by redis",
@@ -62,23 +66,39 @@ func (rbds *redisBlobDescriptorService) Stat(ctx context.Context, dgst digest.Di
 		return distribution.Descriptor{}, err
 	}
 
-	conn := rbds.pool.Get()
+	conn, ok := rbds.availability.get(ctx)
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
 	defer conn.Close()
 
-	return rbds.stat(ctx, conn, dgst)
+	desc, err := rbds.stat(ctx, conn, dgst)
+	if rbds.availability.checkUnavailable(ctx, err) {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	return desc, err
 }
 
+// Clear removes the descriptor from the redis hash entry. It fails with
+// cache.ErrUnavailable while redis is unavailable.
 func (rbds *redisBlobDescriptorService) Clear(ctx context.Context, dgst digest.Digest) error {
 	if err := dgst.Validate(); err != nil {
 		return err
 	}
 
-	conn := rbds.pool.Get()
+	conn, ok := rbds.availability.get(ctx)
+	if !ok {
+		return cache.ErrUnavailable
+	}
 	defer conn.Close()
 
 	// Not atomic in redis <= 2.3
 	reply, err := conn.Do("HDEL", rbds.blobDescriptorHashKey(dgst), "digest", "size", "mediatype")
 	if err != nil {
+		if rbds.availability.checkUnavailable(ctx, err) {
+			return cache.ErrUnavailable
+		}
 		return err
 	}
 
@@ -124,10 +144,18 @@ func (rbds *redisBlobDescriptorService) SetDescriptor(ctx context.Context, dgst
 		return err
 	}
 
-	conn := rbds.pool.Get()
+	conn, ok := rbds.availability.get(ctx)
+	if !ok {
+		return nil
+	}
 	defer conn.Close()
 
-	return rbds.setDescriptor(ctx, conn, dgst, desc)
+	err := rbds.setDescriptor(ctx, conn, dgst, desc)
+	if rbds.availability.checkUnavailable(ctx, err) {
+		return nil
+	}
+
+	return err
 }
 
 func (rbds *redisBlobDescriptorService) setDescriptor(ctx context.Context, conn redis.Conn, dgst digest.Digest, desc distribution.Descriptor) error {
@@ -165,9 +193,21 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Stat(ctx context.Conte
 		return distribution.Descriptor{}, err
 	}
 
-	conn := rsrbds.upstream.pool.Get()
+	conn, ok := rsrbds.upstream.availability.get(ctx)
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
 	defer conn.Close()
 
+	desc, err := rsrbds.stat(ctx, conn, dgst)
+	if rsrbds.upstream.availability.checkUnavailable(ctx, err) {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	return desc, err
+}
+
+func (rsrbds *repositoryScopedRedisBlobDescriptorService) stat(ctx context.Context, conn redis.Conn, dgst digest.Digest) (distribution.Descriptor, error) {
 	// Check membership to repository first
 	member, err := redis.Bool(conn.Do("SISMEMBER", rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst))
 	if err != nil {
@@ -200,18 +240,26 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Stat(ctx context.Conte
 	return upstream, nil
 }
 
-// Clear removes the descriptor from the cache and forwards to the upstream descriptor store
+// Clear removes the descriptor from the cache and forwards to the upstream
+// descriptor store. It fails with cache.ErrUnavailable while redis is
+// unavailable.
 func (rsrbds *repositoryScopedRedisBlobDescriptorService) Clear(ctx context.Context, dgst digest.Digest) error {
 	if err := dgst.Validate(); err != nil {
 		return err
 	}
 
-	conn := rsrbds.upstream.pool.Get()
+	conn, ok := rsrbds.upstream.availability.get(ctx)
+	if !ok {
+		return cache.ErrUnavailable
+	}
 	defer conn.Close()
 
 	// Check membership to repository first
 	member, err := redis.Bool(conn.Do("SISMEMBER", rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst))
 	if err != nil {
+		if rsrbds.upstream.availability.checkUnavailable(ctx, err) {
+			return cache.ErrUnavailable
+		}
 		return err
 	}
 
@@ -237,10 +285,18 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) SetDescriptor(ctx cont
 		}
 	}
 
-	conn := rsrbds.upstream.pool.Get()
+	conn, ok := rsrbds.upstream.availability.get(ctx)
+	if !ok {
+		return nil
+	}
 	defer conn.Close()
 
-	return rsrbds.setDescriptor(ctx, conn, dgst, desc)
+	err := rsrbds.setDescriptor(ctx, conn, dgst, desc)
+	if rsrbds.upstream.availability.checkUnavailable(ctx, err) {
+		return nil
+	}
+
+	return err
 }
 
 func (rsrbds *repositoryScopedRedisBlobDescriptorService) setDescriptor(ctx context.Context, conn redis.Conn, dgst digest.Digest, desc distribution.Descriptor) error {
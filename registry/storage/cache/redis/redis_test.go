@@ -1,12 +1,25 @@
 package redis
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"os"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/docker/go-metrics"
 	"github.com/gomodule/redigo/redis"
 )
 
@@ -51,3 +64,306 @@ func TestRedisBlobDescriptorCacheProvider(t *testing.T) {
 
 	cachecheck.CheckBlobDescriptorCache(t, NewRedisBlobDescriptorCacheProvider(pool))
 }
+
+// fakeRedis is a minimal in-memory stand-in for a redis server, supporting
+// the commands used by the cache, which can be taken down to simulate an
+// outage.
+type fakeRedis struct {
+	mu     sync.Mutex
+	down   bool
+	dials  int
+	hashes map[string]map[string][]byte
+	sets   map[string]map[string]struct{}
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		hashes: make(map[string]map[string][]byte),
+		sets:   make(map[string]map[string]struct{}),
+	}
+}
+
+func (f *fakeRedis) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeRedis) dialCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dials
+}
+
+func (f *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			f.dials++
+			if f.down {
+				return nil, errors.New("connection refused")
+			}
+			return &fakeRedisConn{f}, nil
+		},
+		MaxIdle:   1,
+		MaxActive: 2,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+type fakeRedisConn struct {
+	f *fakeRedis
+}
+
+func (c *fakeRedisConn) Close() error { return nil }
+func (c *fakeRedisConn) Err() error   { return nil }
+func (c *fakeRedisConn) Send(commandName string, args ...interface{}) error {
+	return errors.New("not implemented")
+}
+func (c *fakeRedisConn) Flush() error { return errors.New("not implemented") }
+func (c *fakeRedisConn) Receive() (reply interface{}, err error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeRedisConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	f := c.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return nil, io.EOF
+	}
+
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = fmt.Sprint(arg)
+	}
+
+	hash := func(key string) map[string][]byte {
+		if f.hashes[key] == nil {
+			f.hashes[key] = make(map[string][]byte)
+		}
+		return f.hashes[key]
+	}
+
+	switch commandName {
+	case "PING":
+		return "PONG", nil
+	case "HMGET":
+		reply := make([]interface{}, len(strs)-1)
+		for i, field := range strs[1:] {
+			if v, ok := f.hashes[strs[0]][field]; ok {
+				reply[i] = v
+			}
+		}
+		return reply, nil
+	case "HGET":
+		if v, ok := f.hashes[strs[0]][strs[1]]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "HMSET", "HSET":
+		for i := 1; i+1 < len(strs); i += 2 {
+			hash(strs[0])[strs[i]] = []byte(strs[i+1])
+		}
+		return "OK", nil
+	case "HSETNX":
+		if _, ok := hash(strs[0])[strs[1]]; ok {
+			return int64(0), nil
+		}
+		hash(strs[0])[strs[1]] = []byte(strs[2])
+		return int64(1), nil
+	case "HDEL":
+		var n int64
+		for _, field := range strs[1:] {
+			if _, ok := f.hashes[strs[0]][field]; ok {
+				delete(f.hashes[strs[0]], field)
+				n++
+			}
+		}
+		return n, nil
+	case "SADD":
+		if f.sets[strs[0]] == nil {
+			f.sets[strs[0]] = make(map[string]struct{})
+		}
+		f.sets[strs[0]][strs[1]] = struct{}{}
+		return int64(1), nil
+	case "SISMEMBER":
+		if _, ok := f.sets[strs[0]][strs[1]]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+
+	return nil, redis.Error("ERR unknown command " + commandName)
+}
+
+type countingCounter struct {
+	mu sync.Mutex
+	n  float64
+}
+
+func (c *countingCounter) Inc(vs ...float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(vs) == 0 {
+		c.n++
+	}
+	for _, v := range vs {
+		c.n += v
+	}
+}
+
+func (c *countingCounter) value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// TestRedisOutageFallsThroughToStorage simulates redis going away and checks
+// that stats are still served by the storage backend, that redis is not
+// retried on every request while it is down and that the cache is used again
+// once redis comes back.
+func TestRedisOutageFallsThroughToStorage(t *testing.T) {
+	ctx := context.Background()
+
+	counter := &countingCounter{}
+	defer func(c metrics.Counter) { cacheUnavailableCount = c }(cacheUnavailableCount)
+	cacheUnavailableCount = counter
+
+	server := newFakeRedis()
+	provider := &redisBlobDescriptorService{availability: newAvailability(server.pool())}
+	provider.availability.initialBackoff = 50 * time.Millisecond
+	provider.availability.maxBackoff = 100 * time.Millisecond
+
+	redisCache, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+
+	desc := distribution.Descriptor{
+		Digest:    "sha256:abc1111111111111111111111111111111111111111111111111111111111111",
+		Size:      10,
+		MediaType: "application/octet-stream",
+	}
+
+	// The backend stands in for the authoritative storage.
+	backend, err := memory.NewInMemoryBlobDescriptorCacheProvider().RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting backend: %v", err)
+	}
+	if err := backend.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+		t.Fatalf("unexpected error setting backend descriptor: %v", err)
+	}
+
+	statter := cache.NewCachedBlobStatter(redisCache, backend)
+
+	server.setDown(true)
+	for i := 0; i < 3; i++ {
+		got, err := statter.Stat(ctx, desc.Digest)
+		if err != nil {
+			t.Fatalf("unexpected error during outage: %v", err)
+		}
+		if !reflect.DeepEqual(got, desc) {
+			t.Fatalf("unexpected descriptor during outage: %#v != %#v", got, desc)
+		}
+	}
+
+	if dials := server.dialCount(); dials != 1 {
+		t.Fatalf("expected redis to be dialed once before backing off, got %d", dials)
+	}
+	if counter.value() == 0 {
+		t.Fatalf("expected cache unavailable fallthroughs to be counted")
+	}
+
+	// Redis comes back; the background reconnection should notice.
+	server.setDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if conn, ok := provider.availability.get(ctx); ok {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("redis cache did not become available again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A stat now populates the cache, which then answers on its own.
+	if _, err := statter.Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error after outage: %v", err)
+	}
+	got, err := redisCache.Stat(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("expected descriptor to be cached after outage: %v", err)
+	}
+	if !reflect.DeepEqual(got, desc) {
+		t.Fatalf("unexpected cached descriptor: %#v != %#v", got, desc)
+	}
+}
+
+// TestRedisOutageDelete checks that deleting a blob while redis is
+// unavailable fails, rather than leave its descriptor in redis to be served
+// once redis comes back.
+func TestRedisOutageDelete(t *testing.T) {
+	ctx := context.Background()
+
+	server := newFakeRedis()
+	provider := &redisBlobDescriptorService{availability: newAvailability(server.pool())}
+	provider.availability.initialBackoff = 10 * time.Millisecond
+	provider.availability.maxBackoff = 10 * time.Millisecond
+
+	registry, err := storage.NewRegistry(ctx, inmemory.New(), storage.BlobDescriptorCacheProvider(provider), storage.EnableDelete)
+	if err != nil {
+		t.Fatalf("unexpected error creating registry: %v", err)
+	}
+	name, _ := reference.WithName("foo/bar")
+	repo, err := registry.Repository(ctx, name)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	blobs := repo.Blobs(ctx)
+
+	desc, err := blobs.Put(ctx, "application/octet-stream", []byte("deleted during an outage"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	if _, err := blobs.Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error statting blob: %v", err)
+	}
+
+	server.setDown(true)
+	if err := blobs.Delete(ctx, desc.Digest); err != cache.ErrUnavailable {
+		t.Fatalf("expected the delete to fail while redis is unavailable, got %v", err)
+	}
+
+	server.setDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if conn, ok := provider.availability.get(ctx); ok {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("redis cache did not become available again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The failed delete left the blob in place, and retrying it once redis
+	// is back clears its descriptor along with it.
+	if _, err := blobs.Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("blob of a failed delete is gone: %v", err)
+	}
+	if err := blobs.Delete(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error deleting blob: %v", err)
+	}
+	if _, err := blobs.Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("deleted blob still reported present: %v", err)
+	}
+}
@@ -7,67 +7,85 @@ import (
 	"path"
 	"strings"
 
+	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 )
 
+// errFinishedWalk stops the walk of the repositories once a repository is
+// found past those requested.
+var errFinishedWalk = errors.New("finished walk")
+
+var _ distribution.RepositoryWalker = &registry{}
+
 // Returns a list, or partial list, of repositories in the registry.
 // Because it's a quite expensive operation, it should only be used when building up
 // an initial set of repositories.
 func (reg *registry) Repositories(ctx context.Context, repos []string, last string) (n int, err error) {
-	var finishedWalk bool
-	var foundRepos []string
-
 	if len(repos) == 0 {
 		return 0, errors.New("no space in slice")
 	}
 
-	root, err := pathFor(repositoriesRootPathSpec{})
-	if err != nil {
-		return 0, err
-	}
-
-	err = reg.blobStore.driver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
-		err := handleRepository(fileInfo, root, last, func(repoPath string) error {
-			foundRepos = append(foundRepos, repoPath)
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-
-		// if we've filled our array, no need to walk any further
-		if len(foundRepos) == len(repos) {
-			finishedWalk = true
-			return driver.ErrSkipDir
+	err = reg.enumerateRepositories(ctx, last, func(repo string) error {
+		// if we've filled our array, no need to walk any further: there
+		// are more records available
+		if n == len(repos) {
+			return errFinishedWalk
 		}
 
+		repos[n] = repo
+		n++
 		return nil
 	})
 
-	n = copy(repos, foundRepos)
-
-	if err != nil {
-		return n, err
-	} else if !finishedWalk {
+	switch err {
+	case errFinishedWalk:
+		return n, nil
+	case nil:
 		// We didn't fill buffer. No more records are available.
 		return n, io.EOF
+	default:
+		return n, err
 	}
-
-	return n, err
 }
 
 // Enumerate applies ingester to each repository
 func (reg *registry) Enumerate(ctx context.Context, ingester func(string) error) error {
+	return reg.EnumerateRepositories(ctx, ingester)
+}
+
+// EnumerateRepositories calls fn with each repository as it is found by the
+// walk of the storage, stopping early if fn returns an error or ctx is done.
+func (reg *registry) EnumerateRepositories(ctx context.Context, fn func(repo string) error) error {
+	return reg.enumerateRepositories(ctx, "", fn)
+}
+
+// enumerateRepositories calls fn with each repository after last.
+func (reg *registry) enumerateRepositories(ctx context.Context, last string, fn func(repo string) error) error {
 	root, err := pathFor(repositoriesRootPathSpec{})
 	if err != nil {
 		return err
 	}
 
+	// The error stopping the walk is returned as is, rather than as wrapped
+	// by the driver.
+	var stopErr error
 	err = reg.blobStore.driver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
-		return handleRepository(fileInfo, root, "", ingester)
+		if err := ctx.Err(); err != nil {
+			stopErr = err
+			return err
+		}
+		return handleRepository(fileInfo, root, last, func(repo string) error {
+			if err := fn(repo); err != nil {
+				stopErr = err
+				return err
+			}
+			return nil
+		})
 	})
-
+	if stopErr != nil {
+		return stopErr
+	}
 	return err
 }
 
@@ -2,9 +2,11 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
@@ -195,6 +197,65 @@ func TestCatalogEnumerate(t *testing.T) {
 	}
 }
 
+func TestEnumerateRepositories(t *testing.T) {
+	env := setupFS(t)
+	walker := env.registry.(distribution.RepositoryWalker)
+
+	visited := make(map[string]int)
+	var repos []string
+	err := walker.EnumerateRepositories(env.ctx, func(repo string) error {
+		visited[repo]++
+		repos = append(repos, repo)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error enumerating repositories: %v", err)
+	}
+	if !reflect.DeepEqual(repos, env.expected) {
+		t.Fatalf("unexpected repositories enumerated: %v != %v", repos, env.expected)
+	}
+	for repo, count := range visited {
+		if count != 1 {
+			t.Fatalf("repository %s visited %d times", repo, count)
+		}
+	}
+
+	// An error returned by fn aborts the walk.
+	abort := errors.New("abort")
+	repos = nil
+	err = walker.EnumerateRepositories(env.ctx, func(repo string) error {
+		repos = append(repos, repo)
+		if len(repos) == 3 {
+			return abort
+		}
+		return nil
+	})
+	if err != abort {
+		t.Fatalf("expected the error of fn, got %v", err)
+	}
+	if !reflect.DeepEqual(repos, env.expected[:3]) {
+		t.Fatalf("walk not aborted: %v", repos)
+	}
+
+	// So does cancelling the context.
+	ctx, cancel := context.WithCancel(env.ctx)
+	defer cancel()
+	repos = nil
+	err = walker.EnumerateRepositories(ctx, func(repo string) error {
+		repos = append(repos, repo)
+		if len(repos) == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected the walk to be cancelled, got %v", err)
+	}
+	if !reflect.DeepEqual(repos, env.expected[:2]) {
+		t.Fatalf("walk not cancelled: %v", repos)
+	}
+}
+
 func testEq(a, b []string, size int) bool {
 	for cnt := 0; cnt < size-1; cnt++ {
 		if a[cnt] != b[cnt] {
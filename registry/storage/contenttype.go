@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// contentTypeSniffLen is the number of leading bytes of a blob its
+// Content-Type is detected from.
+const contentTypeSniffLen = 512
+
+// contentTypeSignatures are the leading bytes of the blob formats the
+// Content-Type of is detected, with the offset they are found at.
+var contentTypeSignatures = []struct {
+	offset      int
+	signature   []byte
+	contentType string
+}{
+	{0, []byte{0x1f, 0x8b}, "application/gzip"},
+	{0, []byte{0x28, 0xb5, 0x2f, 0xfd}, "application/zstd"},
+	{257, []byte("ustar"), "application/x-tar"},
+}
+
+// detectContentType returns the Content-Type of the blob stored at path, as
+// detected from its leading bytes: the types of compressed layers, tar
+// archives and JSON documents, such as configurations, are detected, and
+// others are application/octet-stream.
+func detectContentType(ctx context.Context, driver storagedriver.StorageDriver, path string) string {
+	r, err := driver.Reader(ctx, path, 0)
+	if err != nil {
+		return storagedriver.DefaultContentType
+	}
+	defer r.Close()
+
+	head := make([]byte, contentTypeSniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return storagedriver.DefaultContentType
+	}
+	return sniffContentType(head[:n])
+}
+
+// sniffContentType returns the Content-Type of a blob starting with head.
+func sniffContentType(head []byte) string {
+	for _, s := range contentTypeSignatures {
+		if len(head) >= s.offset+len(s.signature) && bytes.Equal(head[s.offset:s.offset+len(s.signature)], s.signature) {
+			return s.contentType
+		}
+	}
+	if trimmed := bytes.TrimLeft(head, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		return "application/json"
+	}
+	return storagedriver.DefaultContentType
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// contentTypeDriver records the Content-Type set on the contexts objects are
+// written with.
+type contentTypeDriver struct {
+	storagedriver.StorageDriver
+
+	mu           sync.Mutex
+	contentTypes map[string]string
+}
+
+func (d *contentTypeDriver) record(ctx context.Context, path string) {
+	contentType, ok := storagedriver.ContentType(ctx)
+	if !ok {
+		contentType = storagedriver.DefaultContentType
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.contentTypes[path] = contentType
+}
+
+func (d *contentTypeDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	d.record(ctx, path)
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (d *contentTypeDriver) Move(ctx context.Context, sourcePath, destPath string) error {
+	d.record(ctx, destPath)
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// storedContentType returns the Content-Type the blob dgst was stored with.
+func (d *contentTypeDriver) storedContentType(t *testing.T, dgst digest.Digest) string {
+	t.Helper()
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.contentTypes[blobPath]
+}
+
+// pushContentTypeImage pushes an image with a gzip layer and returns the
+// digests of the layer and of the manifest.
+func pushContentTypeImage(t *testing.T, registry distribution.Namespace) (digest.Digest, digest.Digest) {
+	ctx := context.Background()
+	repo := makeRepository(t, registry, "test")
+
+	var layer bytes.Buffer
+	gz := gzip.NewWriter(&layer)
+	gz.Write([]byte("layer content"))
+	gz.Close()
+
+	wr, err := repo.Blobs(ctx).Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wr.Write(layer.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	layerDesc, err := wr.Commit(ctx, distribution.Descriptor{Digest: digest.FromBytes(layer.Bytes())})
+	if err != nil {
+		t.Fatalf("unexpected error committing layer: %v", err)
+	}
+	layerDesc.MediaType = v1.MediaTypeImageLayerGzip
+
+	config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.MediaType = v1.MediaTypeImageConfig
+
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageManifest,
+		},
+		Config: config,
+		Layers: []distribution.Descriptor{layerDesc},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest, err := makeManifestService(t, repo).Put(ctx, m)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+	return layerDesc.Digest, manifestDigest
+}
+
+func TestStoreContentTypes(t *testing.T) {
+	d := &contentTypeDriver{StorageDriver: inmemory.New(), contentTypes: make(map[string]string)}
+	registry := createRegistry(t, d, StoreContentTypes)
+	layer, manifest := pushContentTypeImage(t, registry)
+
+	if contentType := d.storedContentType(t, layer); contentType != "application/gzip" {
+		t.Errorf("unexpected Content-Type of gzip layer: %q", contentType)
+	}
+	if contentType := d.storedContentType(t, manifest); contentType != v1.MediaTypeImageManifest {
+		t.Errorf("unexpected Content-Type of manifest: %q", contentType)
+	}
+}
+
+func TestStoreContentTypesDisabled(t *testing.T) {
+	d := &contentTypeDriver{StorageDriver: inmemory.New(), contentTypes: make(map[string]string)}
+	registry := createRegistry(t, d)
+	layer, manifest := pushContentTypeImage(t, registry)
+
+	for _, dgst := range []digest.Digest{layer, manifest} {
+		if contentType := d.storedContentType(t, dgst); contentType != storagedriver.DefaultContentType {
+			t.Errorf("unexpected Content-Type of %s: %q", dgst, contentType)
+		}
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar")
+	for _, tc := range []struct {
+		head        []byte
+		contentType string
+	}{
+		{[]byte{0x1f, 0x8b, 0x08}, "application/gzip"},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}, "application/zstd"},
+		{tar, "application/x-tar"},
+		{[]byte("\n {\"os\":\"linux\"}"), "application/json"},
+		{[]byte("plain"), storagedriver.DefaultContentType},
+		{nil, storagedriver.DefaultContentType},
+	} {
+		if contentType := sniffContentType(tc.head); contentType != tc.contentType {
+			t.Errorf("unexpected Content-Type of %q: %q, expected %q", tc.head, contentType, tc.contentType)
+		}
+	}
+}
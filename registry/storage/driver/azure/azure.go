@@ -336,6 +336,16 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 	return nil
 }
 
+// Capabilities reports that Move is not atomic, since it is implemented as a
+// server-side copy followed by a delete of the source.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.Capabilities{
+		ServerSideCopy: true,
+		URLFor:         true,
+		ReadAfterWrite: true,
+	}
+}
+
 // URLFor returns a publicly accessible URL for the blob stored at given path
 // for specified duration by making use of Azure Storage Shared Access Signatures (SAS).
 // See https://msdn.microsoft.com/en-us/library/azure/ee395415.aspx for more info.
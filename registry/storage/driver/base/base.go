@@ -40,6 +40,7 @@ package base
 import (
 	"context"
 	"io"
+	"os"
 	"time"
 
 	dcontext "github.com/distribution/distribution/v3/context"
@@ -197,6 +198,27 @@ func (base *Base) Move(ctx context.Context, sourcePath string, destPath string)
 	return err
 }
 
+// Capabilities reports the capabilities of the underlying storage driver.
+func (base *Base) Capabilities() storagedriver.Capabilities {
+	return storagedriver.CapabilitiesOf(base.StorageDriver)
+}
+
+// OpenFile wraps OpenFile of the underlying storage driver, if it implements
+// storagedriver.FileOpener.
+func (base *Base) OpenFile(ctx context.Context, path string) (*os.File, error) {
+	ctx, done := dcontext.WithTrace(ctx)
+	defer done("%s.OpenFile(%q)", base.Name(), path)
+
+	if !storagedriver.PathRegexp.MatchString(path) {
+		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
+	}
+
+	start := time.Now()
+	file, err := storagedriver.OpenFile(ctx, base.StorageDriver, path)
+	storageAction.WithValues(base.Name(), "OpenFile").UpdateSince(start)
+	return file, base.setDriverName(err)
+}
+
 // Delete wraps Delete of underlying storage driver.
 func (base *Base) Delete(ctx context.Context, path string) error {
 	ctx, done := dcontext.WithTrace(ctx)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"reflect"
 	"strconv"
 	"sync"
@@ -164,6 +165,20 @@ func (r *regulator) Move(ctx context.Context, sourcePath string, destPath string
 	return r.StorageDriver.Move(ctx, sourcePath, destPath)
 }
 
+// Capabilities reports the capabilities of the wrapped storage driver.
+func (r *regulator) Capabilities() storagedriver.Capabilities {
+	return storagedriver.CapabilitiesOf(r.StorageDriver)
+}
+
+// OpenFile opens the file holding the content stored at path, if the wrapped
+// storage driver implements storagedriver.FileOpener.
+func (r *regulator) OpenFile(ctx context.Context, path string) (*os.File, error) {
+	r.enter()
+	defer r.exit()
+
+	return storagedriver.OpenFile(ctx, r.StorageDriver, path)
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (r *regulator) Delete(ctx context.Context, path string) error {
 	r.enter()
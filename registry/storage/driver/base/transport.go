@@ -0,0 +1,73 @@
+package base
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// Connection pool limits of the HTTP transports of object storage drivers,
+// used when not configured. Registries talk to a single storage endpoint at
+// a high concurrency, so as many idle connections are kept to it as in
+// total, rather than the two per host kept by http.DefaultTransport.
+const (
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 100
+	DefaultMaxConnsPerHost     = 0
+)
+
+// ConnectionPool holds the connection pool limits of an HTTP transport. Zero
+// values have the meaning of the fields of http.Transport they set.
+type ConnectionPool struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+}
+
+// ConnectionPoolFromParameters reads the maxidleconns, maxidleconnsperhost
+// and maxconnsperhost parameters of a driver, as decoded from the YAML
+// configuration. Missing parameters take their default, and negative values
+// are an error.
+func ConnectionPoolFromParameters(parameters map[string]interface{}) (ConnectionPool, error) {
+	var pool ConnectionPool
+	for _, p := range []struct {
+		name  string
+		value *int
+		def   int
+	}{
+		{"maxidleconns", &pool.MaxIdleConns, DefaultMaxIdleConns},
+		{"maxidleconnsperhost", &pool.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost},
+		{"maxconnsperhost", &pool.MaxConnsPerHost, DefaultMaxConnsPerHost},
+	} {
+		*p.value = p.def
+		switch v := parameters[p.name].(type) {
+		case string:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return ConnectionPool{}, fmt.Errorf("%s parameter must be an integer, %v invalid", p.name, v)
+			}
+			*p.value = n
+		case int, int32, int64, uint, uint32, uint64:
+			*p.value = int(reflect.ValueOf(v).Convert(reflect.TypeOf(0)).Int())
+		case nil:
+			// use the default
+		default:
+			return ConnectionPool{}, fmt.Errorf("invalid value for %s: %#v", p.name, v)
+		}
+		if *p.value < 0 {
+			return ConnectionPool{}, fmt.Errorf("the %s parameter must not be negative, %d invalid", p.name, *p.value)
+		}
+	}
+	return pool, nil
+}
+
+// NewTransport returns a transport configured as http.DefaultTransport, with
+// the connection pool limits of pool.
+func (pool ConnectionPool) NewTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = pool.MaxIdleConns
+	t.MaxIdleConnsPerHost = pool.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = pool.MaxConnsPerHost
+	return t
+}
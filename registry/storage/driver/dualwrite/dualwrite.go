@@ -0,0 +1,376 @@
+// Package dualwrite provides a storagedriver.StorageDriver which writes to two
+// drivers and reads from the first, so that a registry can be migrated to a
+// new storage backend without downtime: content written while both are
+// configured lands in both, the content written before is copied over, then
+// the new backend becomes the only one.
+//
+// Reads, listings, walks and redirects are served by the primary driver.
+// Writes, moves and deletions are applied to the primary driver, failing if
+// it fails, then to the secondary driver. Failures of the secondary driver
+// either fail the operation, when strict, or are logged and ignored, when
+// best effort. A streamed write the secondary driver fails is cancelled
+// there and carries on with the primary driver only.
+package dualwrite
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+)
+
+const driverName = "dualwrite"
+
+// These constants are the ways in which the failures of the secondary driver
+// are handled.
+const (
+	// SecondaryBestEffort logs the failures of the secondary driver and
+	// carries on with the primary driver.
+	SecondaryBestEffort = "besteffort"
+	// SecondaryStrict fails the operations the secondary driver fails.
+	SecondaryStrict = "strict"
+)
+
+func init() {
+	factory.Register(driverName, &dualWriteDriverFactory{})
+}
+
+// dualWriteDriverFactory implements the factory.StorageDriverFactory
+// interface
+type dualWriteDriverFactory struct{}
+
+func (factory *dualWriteDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+type driver struct {
+	primary   storagedriver.StorageDriver
+	secondary storagedriver.StorageDriver
+	strict    bool
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation which writes to two
+// drivers and reads from the first.
+type Driver struct {
+	baseEmbed
+}
+
+var _ storagedriver.StorageDriver = &Driver{}
+
+// FromParameters constructs a new Driver with a given parameters map.
+// Required parameters:
+//   - primary: the driver read from and written to first, given as a map
+//     with a single key naming the driver and holding its parameters
+//   - secondary: the driver also written to, given in the same way
+//
+// Optional parameters:
+//   - secondarywrites: how the failures of the secondary driver are handled,
+//     "besteffort", the default, or "strict"
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	strict := false
+	switch param := parameters["secondarywrites"]; param {
+	case nil, "", SecondaryBestEffort:
+	case SecondaryStrict:
+		strict = true
+	default:
+		return nil, fmt.Errorf("secondarywrites must be %q or %q, got %v", SecondaryBestEffort, SecondaryStrict, param)
+	}
+
+	primary, err := createDriver(parameters, "primary")
+	if err != nil {
+		return nil, err
+	}
+
+	secondary, err := createDriver(parameters, "secondary")
+	if err != nil {
+		return nil, err
+	}
+
+	return New(primary, secondary, strict), nil
+}
+
+// createDriver constructs the driver described by the named parameter.
+func createDriver(parameters map[string]interface{}, name string) (storagedriver.StorageDriver, error) {
+	param, ok := parameters[name]
+	if !ok || param == nil {
+		return nil, fmt.Errorf("no %s driver provided", name)
+	}
+
+	drivers, err := toStringMap(param)
+	if err != nil || len(drivers) != 1 {
+		return nil, fmt.Errorf("%s must be a map with a single driver, got %v", name, param)
+	}
+
+	for driverType, driverParam := range drivers {
+		if driverType == driverName {
+			return nil, fmt.Errorf("%s driver cannot itself be %s", name, driverName)
+		}
+
+		var driverParameters map[string]interface{}
+		if driverParam != nil {
+			driverParameters, err = toStringMap(driverParam)
+			if err != nil {
+				return nil, fmt.Errorf("parameters of %s driver %s must be a map, got %v", name, driverType, driverParam)
+			}
+		}
+
+		d, err := factory.Create(driverType, driverParameters)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create %s driver %s: %v", name, driverType, err)
+		}
+		return d, nil
+	}
+
+	panic("unreachable")
+}
+
+// toStringMap converts a parameter, as decoded from yaml, to a map keyed by
+// string.
+func toStringMap(param interface{}) (map[string]interface{}, error) {
+	switch m := param.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			converted[key] = v
+		}
+		return converted, nil
+	}
+	return nil, fmt.Errorf("unexpected type %T", param)
+}
+
+// New constructs a new Driver reading from primary and writing to both
+// primary and secondary. The failures of secondary fail the operations when
+// strict, and are logged otherwise.
+func New(primary, secondary storagedriver.StorageDriver, strict bool) *Driver {
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: &driver{primary: primary, secondary: secondary, strict: strict},
+			},
+		},
+	}
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+// Name returns the human-readable "name" of the driver.
+func (d *driver) Name() string {
+	return driverName
+}
+
+// secondaryFailed handles the failure of the secondary driver to carry out
+// op on path: it returns an error if strict, and logs it otherwise.
+func (d *driver) secondaryFailed(ctx context.Context, op, path string, err error) error {
+	if d.strict {
+		return fmt.Errorf("secondary driver failed to %s %s: %v", op, path, err)
+	}
+	dcontext.GetLogger(ctx).Warnf("dualwrite: secondary driver failed to %s %s: %v", op, path, err)
+	return nil
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	return d.primary.GetContent(ctx, path)
+}
+
+// PutContent stores the []byte content at a location designated by "path",
+// with both drivers.
+func (d *driver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := d.primary.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+	if err := d.secondary.PutContent(ctx, path, content); err != nil {
+		return d.secondaryFailed(ctx, "put", path, err)
+	}
+	return nil
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	return d.primary.Reader(ctx, path, offset)
+}
+
+// Writer returns a FileWriter which will store the content written to it at
+// the location designated by "path" after the call to Commit, with both
+// drivers. Appending to content the secondary driver does not hold as the
+// primary does continues with the primary driver only.
+func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	primary, err := d.primary.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := &fileWriter{ctx: ctx, driver: d, path: path, primary: primary}
+	secondary, err := d.secondary.Writer(ctx, path, append)
+	if err == nil && secondary.Size() != primary.Size() {
+		err = fmt.Errorf("secondary holds %d bytes, primary %d", secondary.Size(), primary.Size())
+		secondary.Cancel()
+		secondary.Close()
+	}
+	if err != nil {
+		if err := d.secondaryFailed(ctx, "write", path, err); err != nil {
+			primary.Close()
+			return nil, err
+		}
+		return fw, nil
+	}
+	fw.secondary = secondary
+	return fw, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	return d.primary.Stat(ctx, path)
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	return d.primary.List(ctx, path)
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object, within both drivers.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := d.primary.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	if err := d.secondary.Move(ctx, sourcePath, destPath); err != nil {
+		return d.secondaryFailed(ctx, "move", sourcePath, err)
+	}
+	return nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths,
+// in both drivers. Paths the secondary driver does not hold are ignored.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	if err := d.primary.Delete(ctx, path); err != nil {
+		return err
+	}
+	if err := d.secondary.Delete(ctx, path); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return d.secondaryFailed(ctx, "delete", path, err)
+	}
+	return nil
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at
+// the given path, from the primary driver.
+func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return d.primary.URLFor(ctx, path, options)
+}
+
+// Walk traverses a filesystem defined within the primary driver, starting
+// from the given path, calling f on each file
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return d.primary.Walk(ctx, path, f)
+}
+
+// Capabilities reports the capabilities of the primary driver, which serves
+// the reads. Move is carried out by the backend and atomic when it is for
+// both drivers.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	primary, secondary := storagedriver.CapabilitiesOf(d.primary), storagedriver.CapabilitiesOf(d.secondary)
+	return storagedriver.Capabilities{
+		ServerSideCopy: primary.ServerSideCopy && secondary.ServerSideCopy,
+		AtomicMove:     primary.AtomicMove && secondary.AtomicMove,
+		URLFor:         primary.URLFor,
+		ReadAfterWrite: primary.ReadAfterWrite,
+	}
+}
+
+// fileWriter writes the content written to it with the writers of both
+// drivers. The secondary writer is dropped, and its content cancelled, once
+// it fails and failures are ignored.
+type fileWriter struct {
+	ctx       context.Context
+	driver    *driver
+	path      string
+	primary   storagedriver.FileWriter
+	secondary storagedriver.FileWriter
+}
+
+var _ storagedriver.FileWriter = &fileWriter{}
+
+// secondaryFailed handles the failure of the secondary writer to carry out
+// op, dropping it unless the failure is returned.
+func (fw *fileWriter) secondaryFailed(op string, err error) error {
+	if err := fw.driver.secondaryFailed(fw.ctx, op, fw.path, err); err != nil {
+		return err
+	}
+	fw.secondary.Cancel()
+	fw.secondary.Close()
+	fw.secondary = nil
+	return nil
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	n, err := fw.primary.Write(p)
+	if fw.secondary != nil && n > 0 {
+		if _, err := fw.secondary.Write(p[:n]); err != nil {
+			if err := fw.secondaryFailed("write", err); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+func (fw *fileWriter) Size() int64 {
+	return fw.primary.Size()
+}
+
+func (fw *fileWriter) Close() error {
+	if err := fw.primary.Close(); err != nil {
+		if fw.secondary != nil {
+			fw.secondary.Close()
+		}
+		return err
+	}
+	if fw.secondary != nil {
+		if err := fw.secondary.Close(); err != nil {
+			return fw.driver.secondaryFailed(fw.ctx, "close", fw.path, err)
+		}
+	}
+	return nil
+}
+
+func (fw *fileWriter) Cancel() error {
+	err := fw.primary.Cancel()
+	if fw.secondary != nil {
+		if err := fw.secondary.Cancel(); err != nil {
+			dcontext.GetLogger(fw.ctx).Warnf("dualwrite: secondary driver failed to cancel %s: %v", fw.path, err)
+		}
+	}
+	return err
+}
+
+func (fw *fileWriter) Commit() error {
+	if err := fw.primary.Commit(); err != nil {
+		return err
+	}
+	if fw.secondary != nil {
+		if err := fw.secondary.Commit(); err != nil {
+			return fw.secondaryFailed("commit", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package dualwrite
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+func init() {
+	primaryRoot, err := ioutil.TempDir("", "driver-primary-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(primaryRoot)
+
+	secondaryRoot, err := ioutil.TempDir("", "driver-secondary-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(secondaryRoot)
+
+	driver, err := FromParameters(map[string]interface{}{
+		"primary": map[interface{}]interface{}{
+			"filesystem": map[interface{}]interface{}{
+				"rootdirectory": primaryRoot,
+			},
+		},
+		"secondary": map[interface{}]interface{}{
+			"filesystem": map[interface{}]interface{}{
+				"rootdirectory": secondaryRoot,
+			},
+		},
+		"secondarywrites": SecondaryStrict,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return driver, nil
+	}, testsuites.NeverSkip)
+}
+
+var errFailing = errors.New("failing driver")
+
+// failingDriver fails every write.
+type failingDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d *failingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return errFailing
+}
+
+func (d *failingDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	return nil, errFailing
+}
+
+func (d *failingDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return errFailing
+}
+
+func TestFromParametersInvalid(t *testing.T) {
+	inmemoryDriver := map[string]interface{}{"inmemory": nil}
+
+	for _, params := range []map[string]interface{}{
+		{},
+		{"primary": inmemoryDriver},
+		{"secondary": inmemoryDriver},
+		{"primary": inmemoryDriver, "secondary": "inmemory"},
+		{"primary": inmemoryDriver, "secondary": map[string]interface{}{"inmemory": nil, "filesystem": nil}},
+		{"primary": inmemoryDriver, "secondary": map[string]interface{}{"dualwrite": nil}},
+		{"primary": inmemoryDriver, "secondary": inmemoryDriver, "secondarywrites": "sometimes"},
+	} {
+		if _, err := FromParameters(params); err == nil {
+			t.Errorf("expected an error for parameters %v", params)
+		}
+	}
+}
+
+func TestWritesBoth(t *testing.T) {
+	ctx := context.Background()
+	primary := inmemory.New()
+	secondary := inmemory.New()
+	d := New(primary, secondary, true)
+
+	if err := d.PutContent(ctx, "/manifest", []byte("manifest")); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	fw, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := fw.Write([]byte("layer")); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %v", err)
+	}
+
+	// Resuming the upload appends to both.
+	fw, err = d.Writer(ctx, "/upload", true)
+	if err != nil {
+		t.Fatalf("unexpected error resuming writer: %v", err)
+	}
+	if _, err := fw.Write([]byte(" data")); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := fw.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %v", err)
+	}
+	if err := d.Move(ctx, "/upload", "/layer"); err != nil {
+		t.Fatalf("unexpected error moving: %v", err)
+	}
+
+	for name, backend := range map[string]storagedriver.StorageDriver{"primary": primary, "secondary": secondary} {
+		for path, expected := range map[string]string{"/manifest": "manifest", "/layer": "layer data"} {
+			content, err := backend.GetContent(ctx, path)
+			if err != nil || string(content) != expected {
+				t.Errorf("%s holds %q at %s, expected %q: %v", name, content, path, expected, err)
+			}
+		}
+		if _, err := backend.Stat(ctx, "/upload"); err == nil {
+			t.Errorf("%s still holds the moved upload", name)
+		}
+	}
+
+	if err := d.Delete(ctx, "/manifest"); err != nil {
+		t.Fatalf("unexpected error deleting: %v", err)
+	}
+	for name, backend := range map[string]storagedriver.StorageDriver{"primary": primary, "secondary": secondary} {
+		if _, err := backend.Stat(ctx, "/manifest"); err == nil {
+			t.Errorf("%s still holds the deleted content", name)
+		}
+	}
+
+	// Reads are served by the primary driver only.
+	if err := secondary.PutContent(ctx, "/secondary", []byte("secondary")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, "/secondary"); err == nil {
+		t.Fatal("content of the secondary driver read")
+	}
+}
+
+func TestSecondaryFailures(t *testing.T) {
+	ctx := context.Background()
+
+	for _, strict := range []bool{false, true} {
+		primary := inmemory.New()
+		d := New(primary, &failingDriver{StorageDriver: inmemory.New()}, strict)
+
+		putErr := d.PutContent(ctx, "/manifest", []byte("manifest"))
+		fw, writerErr := d.Writer(ctx, "/upload", false)
+		if writerErr == nil {
+			if _, err := fw.Write([]byte("layer")); err != nil {
+				t.Fatalf("strict %v: unexpected error writing: %v", strict, err)
+			}
+			if err := fw.Commit(); err != nil {
+				t.Fatalf("strict %v: unexpected error committing: %v", strict, err)
+			}
+			fw.Close()
+		}
+		moveErr := d.Move(ctx, "/upload", "/layer")
+
+		for op, err := range map[string]error{"put": putErr, "writer": writerErr, "move": moveErr} {
+			if strict && err == nil {
+				t.Errorf("strict: secondary %s failure ignored", op)
+			}
+			if !strict && err != nil {
+				t.Errorf("best effort: unexpected error on secondary %s failure: %v", op, err)
+			}
+		}
+
+		// The primary driver holds the content either way.
+		if content, err := primary.GetContent(ctx, "/manifest"); err != nil || string(content) != "manifest" {
+			t.Errorf("strict %v: primary holds %q: %v", strict, content, err)
+		}
+		if !strict {
+			if content, err := primary.GetContent(ctx, "/layer"); err != nil || string(content) != "layer" {
+				t.Errorf("best effort: primary holds %q: %v", content, err)
+			}
+		}
+	}
+}
+
+func TestPrimaryFailures(t *testing.T) {
+	ctx := context.Background()
+	secondary := inmemory.New()
+	d := New(&failingDriver{StorageDriver: inmemory.New()}, secondary, false)
+
+	if err := d.PutContent(ctx, "/manifest", []byte("manifest")); err == nil {
+		t.Fatal("primary put failure ignored")
+	}
+	if _, err := d.Writer(ctx, "/upload", false); err == nil {
+		t.Fatal("primary writer failure ignored")
+	}
+	if _, err := secondary.Stat(ctx, "/manifest"); err == nil {
+		t.Fatal("content the primary failed to write written to the secondary")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -32,6 +33,10 @@ const (
 type DriverParameters struct {
 	RootDirectory string
 	MaxThreads    uint64
+
+	// DisableSendfile serves blobs by copying them through the registry
+	// rather than from their files, with sendfile.
+	DisableSendfile bool
 }
 
 func init() {
@@ -46,7 +51,8 @@ func (factory *filesystemDriverFactory) Create(parameters map[string]interface{}
 }
 
 type driver struct {
-	rootDirectory string
+	rootDirectory   string
+	disableSendfile bool
 }
 
 type baseEmbed struct {
@@ -63,6 +69,7 @@ type Driver struct {
 // Optional Parameters:
 // - rootdirectory
 // - maxthreads
+// - sendfile
 func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 	params, err := fromParametersImpl(parameters)
 	if err != nil || params == nil {
@@ -76,6 +83,7 @@ func fromParametersImpl(parameters map[string]interface{}) (*DriverParameters, e
 		err           error
 		maxThreads    = defaultMaxThreads
 		rootDirectory = defaultRootDirectory
+		sendfile      = true
 	)
 
 	if parameters != nil {
@@ -87,18 +95,35 @@ func fromParametersImpl(parameters map[string]interface{}) (*DriverParameters, e
 		if err != nil {
 			return nil, fmt.Errorf("maxthreads config error: %s", err.Error())
 		}
+
+		switch value := parameters["sendfile"].(type) {
+		case nil:
+		case bool:
+			sendfile = value
+		case string:
+			sendfile, err = strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("sendfile config error: %s", err.Error())
+			}
+		default:
+			return nil, fmt.Errorf("sendfile config error: %v is not a boolean", value)
+		}
 	}
 
 	params := &DriverParameters{
-		RootDirectory: rootDirectory,
-		MaxThreads:    maxThreads,
+		RootDirectory:   rootDirectory,
+		MaxThreads:      maxThreads,
+		DisableSendfile: !sendfile,
 	}
 	return params, nil
 }
 
 // New constructs a new Driver with a given rootDirectory
 func New(params DriverParameters) *Driver {
-	fsDriver := &driver{rootDirectory: params.RootDirectory}
+	fsDriver := &driver{
+		rootDirectory:   params.RootDirectory,
+		disableSendfile: params.DisableSendfile,
+	}
 
 	return &Driver{
 		baseEmbed: baseEmbed{
@@ -268,6 +293,32 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 	return err
 }
 
+// OpenFile opens the file the content stored at path is written to, so that
+// it is served with sendfile, unless disabled.
+func (d *driver) OpenFile(ctx context.Context, path string) (*os.File, error) {
+	if d.disableSendfile {
+		return nil, storagedriver.ErrUnsupportedMethod{DriverName: driverName}
+	}
+	file, err := os.Open(d.fullPath(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storagedriver.PathNotFoundError{Path: path}
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// Capabilities reports that Move is atomic, since it is implemented with a
+// rename within a single filesystem. URLFor is unsupported.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.Capabilities{
+		ServerSideCopy: true,
+		AtomicMove:     true,
+		ReadAfterWrite: true,
+	}
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (d *driver) Delete(ctx context.Context, subPath string) error {
 	fullPath := d.fullPath(subPath)
@@ -88,6 +88,35 @@ func TestFromParametersImpl(t *testing.T) {
 			},
 			pass: true,
 		},
+		// check that sendfile may be disabled, as a boolean or a string
+		{
+			params: map[string]interface{}{
+				"sendfile": false,
+			},
+			expected: DriverParameters{
+				RootDirectory:   defaultRootDirectory,
+				MaxThreads:      defaultMaxThreads,
+				DisableSendfile: true,
+			},
+			pass: true,
+		},
+		{
+			params: map[string]interface{}{
+				"sendfile": "true",
+			},
+			expected: DriverParameters{
+				RootDirectory: defaultRootDirectory,
+				MaxThreads:    defaultMaxThreads,
+			},
+			pass: true,
+		},
+		{
+			params: map[string]interface{}{
+				"sendfile": "sometimes",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
 	}
 
 	for _, item := range tests {
@@ -111,3 +140,46 @@ func TestFromParametersImpl(t *testing.T) {
 	}
 
 }
+
+func TestAtomicMove(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temporary directory: %v", err)
+	}
+	defer os.Remove(root)
+
+	driver, err := FromParameters(map[string]interface{}{
+		"rootdirectory": root,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating filesystem driver: %v", err)
+	}
+
+	if !storagedriver.IsMoveAtomic(driver) {
+		t.Fatalf("expected filesystem driver to report an atomic move")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temporary directory: %v", err)
+	}
+	defer os.Remove(root)
+
+	driver, err := FromParameters(map[string]interface{}{
+		"rootdirectory": root,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating filesystem driver: %v", err)
+	}
+
+	expected := storagedriver.Capabilities{
+		ServerSideCopy: true,
+		AtomicMove:     true,
+		ReadAfterWrite: true,
+	}
+	if caps := storagedriver.CapabilitiesOf(driver); caps != expected {
+		t.Fatalf("unexpected capabilities of filesystem driver: %+v", caps)
+	}
+}
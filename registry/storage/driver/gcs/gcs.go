@@ -147,6 +147,14 @@ func FromParameters(parameters map[string]interface{}) (storagedriver.StorageDri
 		}
 	}
 
+	pool, err := base.ConnectionPoolFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	// The token source and the client of the driver send their requests
+	// with the client in the context.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: pool.NewTransport()})
+
 	var ts oauth2.TokenSource
 	jwtConf := new(jwt.Config)
 	if keyfile, ok := parameters["keyfile"]; ok {
@@ -158,7 +166,7 @@ func FromParameters(parameters map[string]interface{}) (storagedriver.StorageDri
 		if err != nil {
 			return nil, err
 		}
-		ts = jwtConf.TokenSource(context.Background())
+		ts = jwtConf.TokenSource(ctx)
 	} else if credentials, ok := parameters["credentials"]; ok {
 		credentialMap, ok := credentials.(map[interface{}]interface{})
 		if !ok {
@@ -183,10 +191,9 @@ func FromParameters(parameters map[string]interface{}) (storagedriver.StorageDri
 		if err != nil {
 			return nil, err
 		}
-		ts = jwtConf.TokenSource(context.Background())
+		ts = jwtConf.TokenSource(ctx)
 	} else {
-		var err error
-		ts, err = google.DefaultTokenSource(context.Background(), storage.ScopeFullControl)
+		ts, err = google.DefaultTokenSource(ctx, storage.ScopeFullControl)
 		if err != nil {
 			return nil, err
 		}
@@ -202,7 +209,7 @@ func FromParameters(parameters map[string]interface{}) (storagedriver.StorageDri
 		rootDirectory:  fmt.Sprint(rootDirectory),
 		email:          jwtConf.Email,
 		privateKey:     jwtConf.PrivateKey,
-		client:         oauth2.NewClient(context.Background(), ts),
+		client:         oauth2.NewClient(ctx, ts),
 		chunkSize:      chunkSize,
 		maxConcurrency: maxConcurrency,
 	}
@@ -274,7 +281,10 @@ func (d *driver) GetContent(context context.Context, path string) ([]byte, error
 func (d *driver) PutContent(context context.Context, path string, contents []byte) error {
 	return retry(func() error {
 		wc := storage.NewWriter(d.context(context), d.bucket, d.pathToKey(path))
-		wc.ContentType = "application/octet-stream"
+		wc.ContentType = storagedriver.DefaultContentType
+		if contentType, ok := storagedriver.ContentType(context); ok {
+			wc.ContentType = contentType
+		}
 		return putContentsClose(wc, contents)
 	})
 }
@@ -454,7 +464,7 @@ func (w *writer) Commit() error {
 	if w.sessionURI == "" {
 		err := retry(func() error {
 			wc := storage.NewWriter(cloud.NewContext(dummyProjectID, w.client), w.bucket, w.name)
-			wc.ContentType = "application/octet-stream"
+			wc.ContentType = storagedriver.DefaultContentType
 			return putContentsClose(wc, w.buffer[0:w.buffSize])
 		})
 		if err != nil {
@@ -680,7 +690,11 @@ func (d *driver) List(context context.Context, path string) ([]string, error) {
 // original object.
 func (d *driver) Move(context context.Context, sourcePath string, destPath string) error {
 	gcsContext := d.context(context)
-	_, err := storageCopyObject(gcsContext, d.bucket, d.pathToKey(sourcePath), d.bucket, d.pathToKey(destPath), nil)
+	var attrs *storage.ObjectAttrs
+	if contentType, ok := storagedriver.ContentType(context); ok {
+		attrs = &storage.ObjectAttrs{ContentType: contentType}
+	}
+	_, err := storageCopyObject(gcsContext, d.bucket, d.pathToKey(sourcePath), d.bucket, d.pathToKey(destPath), attrs)
 	if err != nil {
 		if status, ok := err.(*googleapi.Error); ok {
 			if status.Code == http.StatusNotFound {
@@ -798,6 +812,17 @@ func storageCopyObject(context context.Context, srcBucket, srcName string, destB
 	return obj, err
 }
 
+// Capabilities reports that Move is not atomic, since it is implemented as a
+// server-side copy followed by a delete of the source. URLFor is supported
+// when a private key is configured to sign URLs with.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.Capabilities{
+		ServerSideCopy: true,
+		URLFor:         d.privateKey != nil,
+		ReadAfterWrite: true,
+	}
+}
+
 // URLFor returns a URL which may be used to retrieve the content stored at
 // the given path, possibly using the given options.
 // Returns ErrUnsupportedMethod if this driver has no privateKey
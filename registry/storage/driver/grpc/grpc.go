@@ -0,0 +1,579 @@
+// Package grpc provides a storagedriver.StorageDriver which runs in another
+// process, talking to a Server wrapping the actual driver over gRPC. This
+// keeps the credentials of the storage backend out of the registry process,
+// and allows the backend to be swapped without redeploying the registry.
+//
+// The service is described by storagedriver.proto. Reader and Writer are
+// streamed, pacing the transfer with the flow control of gRPC, and are
+// aborted when their context is cancelled.
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const driverName = "grpc"
+
+// capabilitiesTimeout bounds the call asking for the capabilities of the
+// served driver.
+const capabilitiesTimeout = 10 * time.Second
+
+func init() {
+	factory.Register(driverName, &grpcDriverFactory{})
+}
+
+// grpcDriverFactory implements the factory.StorageDriverFactory interface
+type grpcDriverFactory struct{}
+
+func (factory *grpcDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+type driver struct {
+	conn *grpclib.ClientConn
+
+	capabilitiesOnce sync.Once
+	capabilities     capabilities
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation which calls a
+// storage driver served over gRPC.
+type Driver struct {
+	baseEmbed
+}
+
+var _ storagedriver.StorageDriver = &Driver{}
+
+// FromParameters constructs a new Driver with a given parameters map.
+// Required parameters:
+//   - address: the target of the server, such as host:port or
+//     unix:///path/to/socket
+//
+// Optional parameters:
+//   - cacertificate: the CA certificate the certificate of the server is
+//     verified with, enabling TLS
+//   - certificate, key: the certificate and key the client authenticates
+//     with over TLS
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	address, err := stringParameter(parameters, "address")
+	if err != nil {
+		return nil, err
+	}
+	if address == "" {
+		return nil, fmt.Errorf("no address provided")
+	}
+
+	caCertificate, err := stringParameter(parameters, "cacertificate")
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := stringParameter(parameters, "certificate")
+	if err != nil {
+		return nil, err
+	}
+	key, err := stringParameter(parameters, "key")
+	if err != nil {
+		return nil, err
+	}
+
+	transport := grpclib.WithInsecure()
+	if caCertificate != "" {
+		tlsConfig, err := clientTLSConfig(caCertificate, certificate, key)
+		if err != nil {
+			return nil, err
+		}
+		transport = grpclib.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	} else if certificate != "" || key != "" {
+		return nil, fmt.Errorf("certificate and key require cacertificate")
+	}
+
+	conn, err := grpclib.Dial(address, transport)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to %s: %v", address, err)
+	}
+
+	return New(conn), nil
+}
+
+func stringParameter(parameters map[string]interface{}, name string) (string, error) {
+	param, ok := parameters[name]
+	if !ok || param == nil {
+		return "", nil
+	}
+	s, ok := param.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string, got %v", name, param)
+	}
+	return s, nil
+}
+
+func clientTLSConfig(caCertificate, certificate, key string) (*tls.Config, error) {
+	ca, err := ioutil.ReadFile(caCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cacertificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in cacertificate %s", caCertificate)
+	}
+
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if certificate != "" || key != "" {
+		cert, err := tls.LoadX509KeyPair(certificate, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load certificate and key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// New constructs a new Driver calling the storage driver served over conn.
+func New(conn *grpclib.ClientConn) *Driver {
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: &driver{conn: conn},
+			},
+		},
+	}
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+func (d *driver) invoke(ctx context.Context, method string, req, resp message) error {
+	return d.conn.Invoke(ctx, "/"+serviceName+"/"+method, req, resp, grpclib.ForceCodec(codec{}))
+}
+
+func (d *driver) newStream(ctx context.Context, stream int) (grpclib.ClientStream, error) {
+	desc := &serviceDesc.Streams[stream]
+	return d.conn.NewStream(ctx, desc, "/"+serviceName+"/"+desc.StreamName, grpclib.ForceCodec(codec{}))
+}
+
+// fromStatus maps the gRPC statuses returned by the server to the errors of
+// the storage driver, for a call on path at offset.
+func fromStatus(err error, path string, offset int64) error {
+	if err == nil {
+		return nil
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	switch st.Code() {
+	case codes.NotFound:
+		return storagedriver.PathNotFoundError{Path: path}
+	case codes.InvalidArgument:
+		return storagedriver.InvalidPathError{Path: path}
+	case codes.OutOfRange:
+		return storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	case codes.Unimplemented:
+		return storagedriver.ErrUnsupportedMethod{}
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	}
+
+	return errors.New(st.Message())
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := d.newStream(ctx, getContentStream)
+	if err != nil {
+		return nil, fromStatus(err, path, 0)
+	}
+	if err := stream.SendMsg(&pathRequest{Path: path}); err != nil {
+		return nil, fromStatus(err, path, 0)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, fromStatus(err, path, 0)
+	}
+
+	content := []byte{}
+	for {
+		c := new(chunk)
+		if err := stream.RecvMsg(c); err != nil {
+			if err == io.EOF {
+				return content, nil
+			}
+			return nil, fromStatus(err, path, 0)
+		}
+		content = append(content, c.Data...)
+	}
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := d.newStream(ctx, putContentStream)
+	if err != nil {
+		return fromStatus(err, path, 0)
+	}
+
+	req := &putContentRequest{Path: path}
+	for first := true; first || len(contents) > 0; first = false {
+		n := chunkSize
+		if len(contents) < n {
+			n = len(contents)
+		}
+		req.Data = contents[:n]
+		if err := stream.SendMsg(req); err != nil {
+			if err == io.EOF {
+				// The server failed, the actual error is received below.
+				break
+			}
+			return fromStatus(err, path, 0)
+		}
+		contents = contents[n:]
+		req = &putContentRequest{}
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		return fromStatus(err, path, 0)
+	}
+	return fromStatus(stream.RecvMsg(&empty{}), path, 0)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := d.newStream(ctx, readerStream)
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err, path, offset)
+	}
+	if err := stream.SendMsg(&readerRequest{Path: path, Offset: offset}); err != nil {
+		cancel()
+		return nil, fromStatus(err, path, offset)
+	}
+	if err := stream.CloseSend(); err != nil {
+		cancel()
+		return nil, fromStatus(err, path, offset)
+	}
+
+	// The first message is sent once the content has been opened.
+	if err := stream.RecvMsg(new(chunk)); err != nil {
+		cancel()
+		return nil, fromStatus(err, path, offset)
+	}
+
+	return &reader{
+		stream: stream,
+		cancel: cancel,
+		path:   path,
+		offset: offset,
+	}, nil
+}
+
+// reader reads the chunks streamed by the server.
+type reader struct {
+	stream grpclib.ClientStream
+	cancel context.CancelFunc
+	path   string
+	offset int64
+	buf    []byte
+	err    error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		c := new(chunk)
+		if err := r.stream.RecvMsg(c); err != nil {
+			if err != io.EOF {
+				err = fromStatus(err, r.path, r.offset)
+			}
+			r.err = err
+			continue
+		}
+		r.buf = c.Data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+// Close aborts the stream, if it has not ended yet.
+func (r *reader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := d.newStream(ctx, writerStream)
+	if err != nil {
+		cancel()
+		return nil, fromStatus(err, path, 0)
+	}
+
+	if err := stream.SendMsg(&writerRequest{Path: path, Append: append}); err != nil {
+		cancel()
+		return nil, fromStatus(err, path, 0)
+	}
+	resp := new(writerResponse)
+	if err := stream.RecvMsg(resp); err != nil {
+		cancel()
+		return nil, fromStatus(err, path, 0)
+	}
+
+	return &writer{
+		stream: stream,
+		cancel: cancel,
+		path:   path,
+		size:   resp.Size,
+	}, nil
+}
+
+// writer streams the content written to it to the server.
+type writer struct {
+	stream    grpclib.ClientStream
+	cancel    context.CancelFunc
+	path      string
+	size      int64
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := chunkSize
+		if len(p) < n {
+			n = len(p)
+		}
+		if err := w.stream.SendMsg(&writerRequest{Data: p[:n]}); err != nil {
+			return written, w.sendErr(err)
+		}
+		w.size += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// sendErr returns the error behind err, returned by sending on the stream.
+func (w *writer) sendErr(err error) error {
+	if err == io.EOF {
+		// The server ended the stream, the actual error is received.
+		err = w.stream.RecvMsg(new(writerResponse))
+		if err == nil || err == io.EOF {
+			return fmt.Errorf("writer for %s ended unexpectedly", w.path)
+		}
+	}
+	return fromStatus(err, w.path, 0)
+}
+
+// act requests action on the writer and waits for its acknowledgement.
+func (w *writer) act(action writerAction) error {
+	if err := w.stream.SendMsg(&writerRequest{Action: action}); err != nil {
+		return w.sendErr(err)
+	}
+	resp := new(writerResponse)
+	if err := w.stream.RecvMsg(resp); err != nil {
+		return fromStatus(err, w.path, 0)
+	}
+	w.size = resp.Size
+	return nil
+}
+
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	if w.cancelled {
+		// Cancel ended the stream already.
+		return nil
+	}
+	return w.end()
+}
+
+// end closes the writer on the server and releases the stream.
+func (w *writer) end() error {
+	defer w.cancel()
+
+	if err := w.act(writerClose); err != nil {
+		return err
+	}
+	if err := w.stream.CloseSend(); err != nil {
+		return fromStatus(err, w.path, 0)
+	}
+	if err := w.stream.RecvMsg(new(writerResponse)); err != io.EOF {
+		return fromStatus(err, w.path, 0)
+	}
+	return nil
+}
+
+func (w *writer) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	if err := w.act(writerCancel); err != nil {
+		w.cancel()
+		return err
+	}
+	// Writers may be cancelled without being closed, so the stream is ended
+	// here rather than left open.
+	return w.end()
+}
+
+func (w *writer) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	w.committed = true
+	return w.act(writerCommit)
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	info := new(fileInfo)
+	if err := d.invoke(ctx, "Stat", &pathRequest{Path: path}, info); err != nil {
+		return nil, fromStatus(err, path, 0)
+	}
+
+	fi := storagedriver.FileInfoFields{
+		Path:  info.Path,
+		Size:  info.Size,
+		IsDir: info.IsDir,
+	}
+	if info.ModTime != 0 {
+		fi.ModTime = time.Unix(0, info.ModTime)
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	resp := new(listResponse)
+	if err := d.invoke(ctx, "List", &pathRequest{Path: path}, resp); err != nil {
+		return nil, fromStatus(err, path, 0)
+	}
+	if resp.Paths == nil {
+		return []string{}, nil
+	}
+	return resp.Paths, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	err := d.invoke(ctx, "Move", &moveRequest{SourcePath: sourcePath, DestPath: destPath}, &empty{})
+	return fromStatus(err, sourcePath, 0)
+}
+
+// Capabilities reports the capabilities of the served driver. They are asked
+// for once; the driver is assumed to have none if they cannot be.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	d.capabilitiesOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), capabilitiesTimeout)
+		defer cancel()
+		var caps capabilities
+		if err := d.invoke(ctx, "Capabilities", &empty{}, &caps); err == nil {
+			d.capabilities = caps
+		}
+	})
+	return storagedriver.Capabilities{
+		ServerSideCopy: d.capabilities.ServerSideCopy,
+		AtomicMove:     d.capabilities.AtomicMove,
+		URLFor:         d.capabilities.URLFor,
+		ReadAfterWrite: d.capabilities.ReadAfterWrite,
+	}
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	return fromStatus(d.invoke(ctx, "Delete", &pathRequest{Path: path}, &empty{}), path, 0)
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at
+// the given path, as returned by the served driver.
+func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	req := &urlForRequest{Path: path}
+	if method, ok := options["method"].(string); ok {
+		req.Method = method
+	}
+	if expiry, ok := options["expiry"].(time.Time); ok {
+		req.Expiry = expiry.UnixNano()
+	}
+
+	resp := new(urlForResponse)
+	if err := d.invoke(ctx, "URLFor", req, resp); err != nil {
+		return "", fromStatus(err, path, 0)
+	}
+	return resp.URL, nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
@@ -0,0 +1,253 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+func init() {
+	root, err := ioutil.TempDir("", "driver-grpc-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(root)
+
+	backend := filesystem.New(filesystem.DriverParameters{
+		RootDirectory: root,
+		MaxThreads:    100,
+	})
+
+	conn, err := serveInProcess(backend)
+	if err != nil {
+		panic(err)
+	}
+	driver := New(conn)
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return driver, nil
+	}, testsuites.NeverSkip)
+}
+
+// serveInProcess serves backend with an in-process gRPC server and returns a
+// connection to it.
+func serveInProcess(backend storagedriver.StorageDriver) (*grpclib.ClientConn, error) {
+	listener := bufconn.Listen(1 << 20)
+	server := grpclib.NewServer(ServerOptions()...)
+	NewServer(backend).Register(server)
+	go server.Serve(listener)
+
+	return grpclib.Dial("bufconn",
+		grpclib.WithInsecure(),
+		grpclib.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}))
+}
+
+func TestFromParametersInvalid(t *testing.T) {
+	for _, params := range []map[string]interface{}{
+		{},
+		{"address": 5000},
+		{"address": "localhost:5000", "certificate": "/path/to/cert", "key": "/path/to/key"},
+		{"address": "localhost:5000", "cacertificate": "/does/not/exist"},
+	} {
+		if _, err := FromParameters(params); err == nil {
+			t.Errorf("expected an error for parameters %v", params)
+		}
+	}
+}
+
+func TestReaderCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-grpc-")
+	if err != nil {
+		t.Fatalf("unexpected error creating root directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	conn, err := serveInProcess(filesystem.New(filesystem.DriverParameters{
+		RootDirectory: root,
+		MaxThreads:    100,
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+	defer conn.Close()
+	d := New(conn)
+
+	content := make([]byte, 16*chunkSize)
+	rand.Read(content)
+	if err := d.PutContent(context.Background(), "/large", content); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rc, err := d.Reader(ctx, "/large", 0)
+	if err != nil {
+		t.Fatalf("unexpected error opening reader: %v", err)
+	}
+	defer rc.Close()
+
+	buf := make([]byte, chunkSize)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if !bytes.Equal(buf, content[:chunkSize]) {
+		t.Fatalf("unexpected content read")
+	}
+
+	cancel()
+	if _, err := ioutil.ReadAll(rc); err == nil {
+		t.Fatalf("expected an error reading after the context is cancelled")
+	}
+}
+
+func TestWriterCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-grpc-")
+	if err != nil {
+		t.Fatalf("unexpected error creating root directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	conn, err := serveInProcess(filesystem.New(filesystem.DriverParameters{
+		RootDirectory: root,
+		MaxThreads:    100,
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+	defer conn.Close()
+	d := New(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fw, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatalf("unexpected error opening writer: %v", err)
+	}
+	if _, err := fw.Write([]byte("partial")); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+
+	cancel()
+	if err := fw.Commit(); err == nil {
+		t.Fatalf("expected an error committing after the context is cancelled")
+	}
+}
+
+// openWritersDriver counts the writers of the storage driver it wraps which
+// have not been closed.
+type openWritersDriver struct {
+	storagedriver.StorageDriver
+	open int32
+}
+
+func (d *openWritersDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := d.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&d.open, 1)
+	return &openWriter{FileWriter: fw, d: d}, nil
+}
+
+type openWriter struct {
+	storagedriver.FileWriter
+	d *openWritersDriver
+}
+
+func (w *openWriter) Close() error {
+	atomic.AddInt32(&w.d.open, -1)
+	return w.FileWriter.Close()
+}
+
+// TestWriterCancelWithoutClose checks that cancelling a writer ends its
+// stream, closing the writer of the server, without the writer being closed.
+func TestWriterCancelWithoutClose(t *testing.T) {
+	backend := &openWritersDriver{StorageDriver: inmemory.New()}
+	conn, err := serveInProcess(backend)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+	defer conn.Close()
+	d := New(conn)
+
+	fw, err := d.Writer(context.Background(), "/upload", false)
+	if err != nil {
+		t.Fatalf("unexpected error opening writer: %v", err)
+	}
+	if _, err := fw.Write([]byte("cancelled")); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := fw.Cancel(); err != nil {
+		t.Fatalf("unexpected error cancelling: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&backend.open) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("writer of the server still open after cancelling")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing a cancelled writer: %v", err)
+	}
+}
+
+func TestAtomicMove(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-grpc-")
+	if err != nil {
+		t.Fatalf("unexpected error creating root directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, tc := range []struct {
+		backend storagedriver.StorageDriver
+		atomic  bool
+	}{
+		{filesystem.New(filesystem.DriverParameters{RootDirectory: root, MaxThreads: 100}), true},
+		// A driver reporting no capabilities is assumed not to move atomically.
+		{struct{ storagedriver.StorageDriver }{inmemory.New()}, false},
+	} {
+		conn, err := serveInProcess(tc.backend)
+		if err != nil {
+			t.Fatalf("unexpected error connecting: %v", err)
+		}
+		defer conn.Close()
+
+		if atomic := storagedriver.IsMoveAtomic(New(conn)); atomic != tc.atomic {
+			t.Errorf("unexpected atomicity of Move of %s: %v", tc.backend.Name(), atomic)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	conn, err := serveInProcess(inmemory.New())
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	expected := storagedriver.CapabilitiesOf(inmemory.New())
+	if caps := storagedriver.CapabilitiesOf(New(conn)); caps != expected {
+		t.Fatalf("unexpected capabilities of served driver: %+v, expected %+v", caps, expected)
+	}
+}
@@ -0,0 +1,397 @@
+package grpc
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of storagedriver.proto, encoded in the protocol buffers wire
+// format by hand.
+
+// message is implemented by the messages exchanged with the service.
+type message interface {
+	marshal() []byte
+	unmarshal(b []byte) error
+}
+
+// empty is the empty message.
+type empty struct{}
+
+// pathRequest names the path a call applies to.
+type pathRequest struct {
+	Path string
+}
+
+// chunk holds a piece of streamed content.
+type chunk struct {
+	Data []byte
+}
+
+// putContentRequest streams content to store. Path is only set in the first
+// request.
+type putContentRequest struct {
+	Path string
+	Data []byte
+}
+
+// readerRequest opens the content stored at Path from Offset.
+type readerRequest struct {
+	Path   string
+	Offset int64
+}
+
+// writerAction is the action requested on a writer.
+type writerAction int32
+
+const (
+	// writerWrite writes the data of the request.
+	writerWrite writerAction = iota
+	// writerCommit commits the writer.
+	writerCommit
+	// writerCancel cancels the writer.
+	writerCancel
+	// writerClose closes the writer and ends the stream.
+	writerClose
+)
+
+// writerRequest opens a writer, when first sent, then writes data or acts on
+// the writer.
+type writerRequest struct {
+	Path   string
+	Append bool
+	Data   []byte
+	Action writerAction
+}
+
+// writerResponse acknowledges a writer action with the size written so far.
+type writerResponse struct {
+	Size int64
+}
+
+// fileInfo describes a file or directory.
+type fileInfo struct {
+	Path string
+	Size int64
+	// ModTime is in nanoseconds since the Unix epoch.
+	ModTime int64
+	IsDir   bool
+}
+
+// listResponse holds the children of a directory.
+type listResponse struct {
+	Paths []string
+}
+
+// moveRequest moves SourcePath to DestPath.
+type moveRequest struct {
+	SourcePath string
+	DestPath   string
+}
+
+// urlForRequest requests a URL for the content stored at Path.
+type urlForRequest struct {
+	Path   string
+	Method string
+	// Expiry is in nanoseconds since the Unix epoch, unset when zero.
+	Expiry int64
+}
+
+// urlForResponse holds the URL of some content.
+type urlForResponse struct {
+	URL string
+}
+
+// capabilities lists the optional capabilities of the served driver.
+type capabilities struct {
+	AtomicMove     bool
+	ServerSideCopy bool
+	URLFor         bool
+	ReadAfterWrite bool
+}
+
+func (m *empty) marshal() []byte { return nil }
+
+func (m *empty) unmarshal(b []byte) error {
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {})
+}
+
+func (m *pathRequest) marshal() []byte {
+	return appendString(nil, 1, m.Path)
+}
+
+func (m *pathRequest) unmarshal(b []byte) error {
+	*m = pathRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		if num == 1 && typ == protowire.BytesType {
+			m.Path = string(v)
+		}
+	})
+}
+
+func (m *chunk) marshal() []byte {
+	return appendBytes(nil, 1, m.Data)
+}
+
+func (m *chunk) unmarshal(b []byte) error {
+	*m = chunk{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		if num == 1 && typ == protowire.BytesType {
+			m.Data = append([]byte(nil), v...)
+		}
+	})
+}
+
+func (m *putContentRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Path)
+	return appendBytes(b, 2, m.Data)
+}
+
+func (m *putContentRequest) unmarshal(b []byte) error {
+	*m = putContentRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.Path = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			m.Data = append([]byte(nil), v...)
+		}
+	})
+}
+
+func (m *readerRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Path)
+	return appendVarint(b, 2, uint64(m.Offset))
+}
+
+func (m *readerRequest) unmarshal(b []byte) error {
+	*m = readerRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.Path = string(v)
+		case num == 2 && typ == protowire.VarintType:
+			m.Offset = int64(x)
+		}
+	})
+}
+
+func (m *writerRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Path)
+	b = appendBool(b, 2, m.Append)
+	b = appendBytes(b, 3, m.Data)
+	return appendVarint(b, 4, uint64(m.Action))
+}
+
+func (m *writerRequest) unmarshal(b []byte) error {
+	*m = writerRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.Path = string(v)
+		case num == 2 && typ == protowire.VarintType:
+			m.Append = x != 0
+		case num == 3 && typ == protowire.BytesType:
+			m.Data = append([]byte(nil), v...)
+		case num == 4 && typ == protowire.VarintType:
+			m.Action = writerAction(x)
+		}
+	})
+}
+
+func (m *writerResponse) marshal() []byte {
+	return appendVarint(nil, 1, uint64(m.Size))
+}
+
+func (m *writerResponse) unmarshal(b []byte) error {
+	*m = writerResponse{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		if num == 1 && typ == protowire.VarintType {
+			m.Size = int64(x)
+		}
+	})
+}
+
+func (m *fileInfo) marshal() []byte {
+	b := appendString(nil, 1, m.Path)
+	b = appendVarint(b, 2, uint64(m.Size))
+	b = appendVarint(b, 3, uint64(m.ModTime))
+	return appendBool(b, 4, m.IsDir)
+}
+
+func (m *fileInfo) unmarshal(b []byte) error {
+	*m = fileInfo{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.Path = string(v)
+		case num == 2 && typ == protowire.VarintType:
+			m.Size = int64(x)
+		case num == 3 && typ == protowire.VarintType:
+			m.ModTime = int64(x)
+		case num == 4 && typ == protowire.VarintType:
+			m.IsDir = x != 0
+		}
+	})
+}
+
+func (m *listResponse) marshal() []byte {
+	var b []byte
+	for _, p := range m.Paths {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, p)
+	}
+	return b
+}
+
+func (m *listResponse) unmarshal(b []byte) error {
+	*m = listResponse{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		if num == 1 && typ == protowire.BytesType {
+			m.Paths = append(m.Paths, string(v))
+		}
+	})
+}
+
+func (m *moveRequest) marshal() []byte {
+	b := appendString(nil, 1, m.SourcePath)
+	return appendString(b, 2, m.DestPath)
+}
+
+func (m *moveRequest) unmarshal(b []byte) error {
+	*m = moveRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.SourcePath = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			m.DestPath = string(v)
+		}
+	})
+}
+
+func (m *urlForRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Path)
+	b = appendString(b, 2, m.Method)
+	return appendVarint(b, 3, uint64(m.Expiry))
+}
+
+func (m *urlForRequest) unmarshal(b []byte) error {
+	*m = urlForRequest{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			m.Path = string(v)
+		case num == 2 && typ == protowire.BytesType:
+			m.Method = string(v)
+		case num == 3 && typ == protowire.VarintType:
+			m.Expiry = int64(x)
+		}
+	})
+}
+
+func (m *urlForResponse) marshal() []byte {
+	return appendString(nil, 1, m.URL)
+}
+
+func (m *urlForResponse) unmarshal(b []byte) error {
+	*m = urlForResponse{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		if num == 1 && typ == protowire.BytesType {
+			m.URL = string(v)
+		}
+	})
+}
+
+func (m *capabilities) marshal() []byte {
+	b := appendBool(nil, 1, m.AtomicMove)
+	b = appendBool(b, 2, m.ServerSideCopy)
+	b = appendBool(b, 3, m.URLFor)
+	return appendBool(b, 4, m.ReadAfterWrite)
+}
+
+func (m *capabilities) unmarshal(b []byte) error {
+	*m = capabilities{}
+	return unmarshalFields(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) {
+		if typ != protowire.VarintType {
+			return
+		}
+		switch num {
+		case 1:
+			m.AtomicMove = x != 0
+		case 2:
+			m.ServerSideCopy = x != 0
+		case 3:
+			m.URLFor = x != 0
+		case 4:
+			m.ReadAfterWrite = x != 0
+		}
+	})
+}
+
+// Fields holding their default value are omitted, as in proto3.
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, x uint64) []byte {
+	if x == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, x)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(b, num, 1)
+}
+
+// unmarshalFields calls field with each length delimited or varint field of
+// b, skipping fields of other types.
+func unmarshalFields(b []byte, field func(num protowire.Number, typ protowire.Type, v []byte, x uint64)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid message: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			var x uint64
+			x, n = protowire.ConsumeVarint(b)
+			if n >= 0 {
+				field(num, typ, nil, x)
+			}
+		case protowire.BytesType:
+			var v []byte
+			v, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				field(num, typ, v, 0)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid message: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
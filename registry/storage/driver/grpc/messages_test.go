@@ -0,0 +1,233 @@
+package grpc
+
+import (
+	"bufio"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var (
+	protoPackage = regexp.MustCompile(`^package\s+([\w.]+)\s*;`)
+	protoService = regexp.MustCompile(`^service\s+(\w+)\s*{`)
+	protoRPC     = regexp.MustCompile(`^rpc\s+(\w+)\s*\(`)
+	protoMessage = regexp.MustCompile(`^message\s+(\w+)\s*{\s*(})?`)
+	protoEnum    = regexp.MustCompile(`^enum\s+(\w+)\s*{`)
+	protoValue   = regexp.MustCompile(`^(\w+)\s*=\s*(\d+)\s*;`)
+	protoField   = regexp.MustCompile(`^(repeated\s+)?(\w+)\s+(\w+)\s*=\s*(\d+)\s*;`)
+)
+
+var protoScalars = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+}
+
+// parseProto builds the descriptor of storagedriver.proto, which only uses
+// the subset of the language parsed here, and returns the rpcs it declares.
+func parseProto(t *testing.T) (protoreflect.FileDescriptor, []string) {
+	f, err := os.Open("storagedriver.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:   proto.String("storagedriver.proto"),
+		Syntax: proto.String("proto3"),
+	}
+	var (
+		rpcs []string
+		msg  *descriptorpb.DescriptorProto
+		enum *descriptorpb.EnumDescriptorProto
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		switch {
+		case enum != nil:
+			if line == "}" {
+				enum = nil
+			} else if m := protoValue.FindStringSubmatch(line); m != nil {
+				n, _ := strconv.Atoi(m[2])
+				enum.Value = append(enum.Value, &descriptorpb.EnumValueDescriptorProto{
+					Name:   proto.String(m[1]),
+					Number: proto.Int32(int32(n)),
+				})
+			} else {
+				t.Fatalf("unexpected line in enum: %q", line)
+			}
+		case msg != nil:
+			if line == "}" {
+				msg = nil
+			} else if m := protoEnum.FindStringSubmatch(line); m != nil {
+				enum = &descriptorpb.EnumDescriptorProto{Name: proto.String(m[1])}
+				msg.EnumType = append(msg.EnumType, enum)
+			} else if m := protoField.FindStringSubmatch(line); m != nil {
+				n, _ := strconv.Atoi(m[4])
+				field := &descriptorpb.FieldDescriptorProto{
+					Name:     proto.String(m[3]),
+					JsonName: proto.String(m[3]),
+					Number:   proto.Int32(int32(n)),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				}
+				if m[1] != "" {
+					field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				}
+				if typ, ok := protoScalars[m[2]]; ok {
+					field.Type = typ.Enum()
+				} else {
+					// Only enums nested in the message are used.
+					field.Type = descriptorpb.FieldDescriptorProto_TYPE_ENUM.Enum()
+					field.TypeName = proto.String("." + fd.GetPackage() + "." + msg.GetName() + "." + m[2])
+				}
+				msg.Field = append(msg.Field, field)
+			} else {
+				t.Fatalf("unexpected line in message: %q", line)
+			}
+		default:
+			if m := protoPackage.FindStringSubmatch(line); m != nil {
+				fd.Package = proto.String(m[1])
+			} else if m := protoService.FindStringSubmatch(line); m != nil {
+				if got := fd.GetPackage() + "." + m[1]; got != serviceName {
+					t.Fatalf("service %s, served as %s", got, serviceName)
+				}
+			} else if m := protoRPC.FindStringSubmatch(line); m != nil {
+				rpcs = append(rpcs, m[1])
+			} else if m := protoMessage.FindStringSubmatch(line); m != nil {
+				fd.MessageType = append(fd.MessageType, &descriptorpb.DescriptorProto{Name: proto.String(m[1])})
+				if m[2] == "" {
+					msg = fd.MessageType[len(fd.MessageType)-1]
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := protodesc.NewFile(fd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, rpcs
+}
+
+// goField returns the field of the message struct v matching the proto field
+// fd, named after it in camel case.
+func goField(t *testing.T, v reflect.Value, fd protoreflect.FieldDescriptor) reflect.Value {
+	name := strings.ReplaceAll(string(fd.Name()), "_", "")
+	f := v.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, name) })
+	if !f.IsValid() {
+		t.Fatalf("%s has no field for %s", v.Type(), fd.FullName())
+	}
+	return f
+}
+
+// TestMessagesMatchProto checks that the hand encoded messages round-trip
+// with the messages declared in storagedriver.proto, and that the service
+// serves the rpcs declared there.
+func TestMessagesMatchProto(t *testing.T) {
+	file, rpcs := parseProto(t)
+
+	messages := map[protoreflect.Name]message{
+		"Empty":             &empty{},
+		"PathRequest":       &pathRequest{Path: "/a/b"},
+		"Chunk":             &chunk{Data: []byte("data")},
+		"PutContentRequest": &putContentRequest{Path: "/a/b", Data: []byte("data")},
+		"ReaderRequest":     &readerRequest{Path: "/a/b", Offset: 1 << 40},
+		"WriterRequest":     &writerRequest{Path: "/a/b", Append: true, Data: []byte("data"), Action: writerClose},
+		"WriterResponse":    &writerResponse{Size: 1 << 40},
+		"FileInfo":          &fileInfo{Path: "/a/b", Size: 1 << 40, ModTime: -1, IsDir: true},
+		"ListResponse":      &listResponse{Paths: []string{"/a/b", "/a/c"}},
+		"MoveRequest":       &moveRequest{SourcePath: "/a/b", DestPath: "/a/c"},
+		"URLForRequest":     &urlForRequest{Path: "/a/b", Method: "GET", Expiry: 1 << 60},
+		"URLForResponse":    &urlForResponse{URL: "https://example.com/a/b"},
+		"Capabilities":      &capabilities{AtomicMove: true, URLFor: true, ReadAfterWrite: true},
+	}
+	if got, want := len(messages), file.Messages().Len(); got != want {
+		t.Fatalf("%d messages tested, %d declared", got, want)
+	}
+
+	for name, m := range messages {
+		v := reflect.ValueOf(m).Elem()
+		md := file.Messages().ByName(name)
+		if md == nil {
+			t.Fatalf("%s is not declared", name)
+		}
+		if got, want := v.NumField(), md.Fields().Len(); got != want {
+			t.Fatalf("%s has %d fields, %s %d", v.Type(), got, md.FullName(), want)
+		}
+
+		// Decode the hand encoded message with the descriptor.
+		dm := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(m.marshal(), dm); err != nil {
+			t.Fatalf("%s: %v", md.FullName(), err)
+		}
+		if len(dm.GetUnknown()) != 0 {
+			t.Fatalf("%s: unknown fields %x", md.FullName(), dm.GetUnknown())
+		}
+		fields := md.Fields()
+		for i := 0; i < fields.Len(); i++ {
+			fd := fields.Get(i)
+			f := goField(t, v, fd)
+			var got interface{}
+			switch {
+			case fd.IsList():
+				list := dm.Get(fd).List()
+				var paths []string
+				for j := 0; j < list.Len(); j++ {
+					paths = append(paths, list.Get(j).String())
+				}
+				got = paths
+			case fd.Kind() == protoreflect.EnumKind:
+				got = reflect.ValueOf(dm.Get(fd).Enum()).Convert(f.Type()).Interface()
+			default:
+				got = dm.Get(fd).Interface()
+			}
+			if !reflect.DeepEqual(got, f.Interface()) {
+				t.Errorf("%s: decoded %v, want %v", fd.FullName(), got, f.Interface())
+			}
+		}
+
+		// Decode the message encoded with the descriptor by hand.
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(dm)
+		if err != nil {
+			t.Fatalf("%s: %v", md.FullName(), err)
+		}
+		decoded := reflect.New(v.Type()).Interface().(message)
+		if err := decoded.unmarshal(b); err != nil {
+			t.Fatalf("%s: %v", md.FullName(), err)
+		}
+		if !reflect.DeepEqual(decoded, m) {
+			t.Errorf("%s: decoded %+v, want %+v", md.FullName(), decoded, m)
+		}
+	}
+
+	var served []string
+	for _, m := range serviceDesc.Methods {
+		served = append(served, m.MethodName)
+	}
+	for _, s := range serviceDesc.Streams {
+		served = append(served, s.StreamName)
+	}
+	sort.Strings(rpcs)
+	sort.Strings(served)
+	if !reflect.DeepEqual(served, rpcs) {
+		t.Errorf("served rpcs %v, declared %v", served, rpcs)
+	}
+}
@@ -0,0 +1,400 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// chunkSize is the largest amount of content sent in a single message.
+const chunkSize = 1 << 20
+
+const serviceName = "distribution.storagedriver.v1.StorageDriver"
+
+// codec encodes the messages of the service, which are not generated from
+// storagedriver.proto, in the protocol buffers wire format.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+// storageDriverServer is the interface the service is registered with.
+type storageDriverServer interface {
+	getContent(req *pathRequest, stream grpclib.ServerStream) error
+	putContent(stream grpclib.ServerStream) error
+	reader(req *readerRequest, stream grpclib.ServerStream) error
+	writer(stream grpclib.ServerStream) error
+	stat(ctx context.Context, req *pathRequest) (*fileInfo, error)
+	list(ctx context.Context, req *pathRequest) (*listResponse, error)
+	move(ctx context.Context, req *moveRequest) (*empty, error)
+	delete(ctx context.Context, req *pathRequest) (*empty, error)
+	urlFor(ctx context.Context, req *urlForRequest) (*urlForResponse, error)
+	capabilities(ctx context.Context, req *empty) (*capabilities, error)
+}
+
+var serviceDesc = grpclib.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*storageDriverServer)(nil),
+	Methods: []grpclib.MethodDesc{
+		{MethodName: "Stat", Handler: unaryHandler("Stat", func() message { return &pathRequest{} }, func(s storageDriverServer, ctx context.Context, req message) (interface{}, error) {
+			return s.stat(ctx, req.(*pathRequest))
+		})},
+		{MethodName: "List", Handler: unaryHandler("List", func() message { return &pathRequest{} }, func(s storageDriverServer, ctx context.Context, req message) (interface{}, error) {
+			return s.list(ctx, req.(*pathRequest))
+		})},
+		{MethodName: "Move", Handler: unaryHandler("Move", func() message { return &moveRequest{} }, func(s storageDriverServer, ctx context.Context, req message) (interface{}, error) {
+			return s.move(ctx, req.(*moveRequest))
+		})},
+		{MethodName: "Delete", Handler: unaryHandler("Delete", func() message { return &pathRequest{} }, func(s storageDriverServer, ctx context.Context, req message) (interface{}, error) {
+			return s.delete(ctx, req.(*pathRequest))
+		})},
+		{MethodName: "URLFor", Handler: unaryHandler("URLFor", func() message { return &urlForRequest{} }, func(s storageDriverServer, ctx context.Context, req message) (interface{}, error) {
+			return s.urlFor(ctx, req.(*urlForRequest))
+		})},
+		{MethodName: "Capabilities", Handler: unaryHandler("Capabilities", func() message { return &empty{} }, func(s storageDriverServer, ctx context.Context, req message) (interface{}, error) {
+			return s.capabilities(ctx, req.(*empty))
+		})},
+	},
+	Streams: []grpclib.StreamDesc{
+		{
+			StreamName: "GetContent",
+			Handler: func(srv interface{}, stream grpclib.ServerStream) error {
+				req := new(pathRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(storageDriverServer).getContent(req, stream)
+			},
+			ServerStreams: true,
+		},
+		{
+			StreamName: "PutContent",
+			Handler: func(srv interface{}, stream grpclib.ServerStream) error {
+				return srv.(storageDriverServer).putContent(stream)
+			},
+			ClientStreams: true,
+		},
+		{
+			StreamName: "Reader",
+			Handler: func(srv interface{}, stream grpclib.ServerStream) error {
+				req := new(readerRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(storageDriverServer).reader(req, stream)
+			},
+			ServerStreams: true,
+		},
+		{
+			StreamName: "Writer",
+			Handler: func(srv interface{}, stream grpclib.ServerStream) error {
+				return srv.(storageDriverServer).writer(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "storagedriver.proto",
+}
+
+// Stream descriptors, by their index in serviceDesc.Streams.
+const (
+	getContentStream = iota
+	putContentStream
+	readerStream
+	writerStream
+)
+
+// unaryHandler returns the handler of a unary method, decoding the request
+// created by newRequest and passing it to call, through the interceptor of
+// the server if any.
+func unaryHandler(method string, newRequest func() message, call func(s storageDriverServer, ctx context.Context, req message) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpclib.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpclib.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv.(storageDriverServer), ctx, req)
+		}
+		info := &grpclib.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/" + serviceName + "/" + method,
+		}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(storageDriverServer), ctx, req.(message))
+		})
+	}
+}
+
+// Server exposes a storage driver over gRPC.
+type Server struct {
+	driver storagedriver.StorageDriver
+}
+
+var _ storageDriverServer = &Server{}
+
+// NewServer returns a Server exposing driver.
+func NewServer(driver storagedriver.StorageDriver) *Server {
+	return &Server{driver: driver}
+}
+
+// ServerOptions returns the options a gRPC server must be created with to
+// serve the storage driver service.
+func ServerOptions() []grpclib.ServerOption {
+	return []grpclib.ServerOption{grpclib.ForceServerCodec(codec{})}
+}
+
+// Register registers the storage driver service with gs, which must have
+// been created with ServerOptions.
+func (s *Server) Register(gs *grpclib.Server) {
+	gs.RegisterService(&serviceDesc, s)
+}
+
+// toStatus maps the errors of the storage driver to gRPC statuses.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch err.(type) {
+	case storagedriver.PathNotFoundError:
+		return status.Error(codes.NotFound, err.Error())
+	case storagedriver.InvalidPathError:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case storagedriver.InvalidOffsetError:
+		return status.Error(codes.OutOfRange, err.Error())
+	case storagedriver.ErrUnsupportedMethod:
+		return status.Error(codes.Unimplemented, err.Error())
+	}
+
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+
+	return status.Error(codes.Unknown, err.Error())
+}
+
+func (s *Server) getContent(req *pathRequest, stream grpclib.ServerStream) error {
+	content, err := s.driver.GetContent(stream.Context(), req.Path)
+	if err != nil {
+		return toStatus(err)
+	}
+
+	for len(content) > 0 {
+		n := chunkSize
+		if len(content) < n {
+			n = len(content)
+		}
+		if err := stream.SendMsg(&chunk{Data: content[:n]}); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return nil
+}
+
+func (s *Server) putContent(stream grpclib.ServerStream) error {
+	var (
+		path    string
+		content []byte
+	)
+	for first := true; ; first = false {
+		req := new(putContentRequest)
+		if err := stream.RecvMsg(req); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if first {
+			path = req.Path
+		}
+		content = append(content, req.Data...)
+	}
+
+	if err := s.driver.PutContent(stream.Context(), path, content); err != nil {
+		return toStatus(err)
+	}
+	return stream.SendMsg(&empty{})
+}
+
+func (s *Server) reader(req *readerRequest, stream grpclib.ServerStream) error {
+	rc, err := s.driver.Reader(stream.Context(), req.Path, req.Offset)
+	if err != nil {
+		return toStatus(err)
+	}
+	defer rc.Close()
+
+	// Let the client know that the content could be opened.
+	if err := stream.SendMsg(&chunk{}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			// Sending blocks while the flow control window of the stream
+			// is full, so reads follow the pace of the client.
+			if err := stream.SendMsg(&chunk{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return toStatus(err)
+		}
+	}
+}
+
+func (s *Server) writer(stream grpclib.ServerStream) error {
+	req := new(writerRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+
+	fw, err := s.driver.Writer(stream.Context(), req.Path, req.Append)
+	if err != nil {
+		return toStatus(err)
+	}
+	if err := stream.SendMsg(&writerResponse{Size: fw.Size()}); err != nil {
+		fw.Close()
+		return err
+	}
+
+	for {
+		req := new(writerRequest)
+		if err := stream.RecvMsg(req); err != nil {
+			// The client went away without closing the writer, which is
+			// closed so that it may be resumed.
+			fw.Close()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		switch req.Action {
+		case writerWrite:
+			if _, err := fw.Write(req.Data); err != nil {
+				fw.Close()
+				return toStatus(err)
+			}
+			continue
+		case writerCommit:
+			err = fw.Commit()
+		case writerCancel:
+			err = fw.Cancel()
+		case writerClose:
+			if err := fw.Close(); err != nil {
+				return toStatus(err)
+			}
+			return stream.SendMsg(&writerResponse{Size: fw.Size()})
+		default:
+			err = fmt.Errorf("unknown writer action %d", req.Action)
+		}
+		if err != nil {
+			fw.Close()
+			return toStatus(err)
+		}
+
+		if err := stream.SendMsg(&writerResponse{Size: fw.Size()}); err != nil {
+			fw.Close()
+			return err
+		}
+	}
+}
+
+func (s *Server) stat(ctx context.Context, req *pathRequest) (*fileInfo, error) {
+	fi, err := s.driver.Stat(ctx, req.Path)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	info := &fileInfo{
+		Path:  fi.Path(),
+		Size:  fi.Size(),
+		IsDir: fi.IsDir(),
+	}
+	if modTime := fi.ModTime(); !modTime.IsZero() {
+		info.ModTime = modTime.UnixNano()
+	}
+	return info, nil
+}
+
+func (s *Server) list(ctx context.Context, req *pathRequest) (*listResponse, error) {
+	paths, err := s.driver.List(ctx, req.Path)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &listResponse{Paths: paths}, nil
+}
+
+func (s *Server) move(ctx context.Context, req *moveRequest) (*empty, error) {
+	if err := s.driver.Move(ctx, req.SourcePath, req.DestPath); err != nil {
+		return nil, toStatus(err)
+	}
+	return &empty{}, nil
+}
+
+func (s *Server) delete(ctx context.Context, req *pathRequest) (*empty, error) {
+	if err := s.driver.Delete(ctx, req.Path); err != nil {
+		return nil, toStatus(err)
+	}
+	return &empty{}, nil
+}
+
+func (s *Server) urlFor(ctx context.Context, req *urlForRequest) (*urlForResponse, error) {
+	options := make(map[string]interface{})
+	if req.Method != "" {
+		options["method"] = req.Method
+	}
+	if req.Expiry != 0 {
+		options["expiry"] = time.Unix(0, req.Expiry)
+	}
+
+	u, err := s.driver.URLFor(ctx, req.Path, options)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &urlForResponse{URL: u}, nil
+}
+
+func (s *Server) capabilities(ctx context.Context, req *empty) (*capabilities, error) {
+	caps := storagedriver.CapabilitiesOf(s.driver)
+	return &capabilities{
+		AtomicMove:     caps.AtomicMove,
+		ServerSideCopy: caps.ServerSideCopy,
+		URLFor:         caps.URLFor,
+		ReadAfterWrite: caps.ReadAfterWrite,
+	}, nil
+}
@@ -222,6 +222,16 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 	}
 }
 
+// Capabilities reports that Move is atomic, since it holds the lock of the
+// driver. URLFor is unsupported.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.Capabilities{
+		ServerSideCopy: true,
+		AtomicMove:     true,
+		ReadAfterWrite: true,
+	}
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (d *driver) Delete(ctx context.Context, path string) error {
 	d.mutex.Lock()
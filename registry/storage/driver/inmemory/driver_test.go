@@ -17,3 +17,14 @@ func init() {
 	}
 	testsuites.RegisterSuite(inmemoryDriverConstructor, testsuites.NeverSkip)
 }
+
+func TestCapabilities(t *testing.T) {
+	expected := storagedriver.Capabilities{
+		ServerSideCopy: true,
+		AtomicMove:     true,
+		ReadAfterWrite: true,
+	}
+	if caps := storagedriver.CapabilitiesOf(New()); caps != expected {
+		t.Fatalf("unexpected capabilities of inmemory driver: %+v", caps)
+	}
+}
@@ -110,6 +110,14 @@ func (ac *aliCDNStorageMiddleware) URLFor(ctx context.Context, path string, opti
 	return acURL, nil
 }
 
+// Capabilities reports the capabilities of the wrapped storage driver, which
+// URLFor is added to.
+func (ac *aliCDNStorageMiddleware) Capabilities() storagedriver.Capabilities {
+	caps := storagedriver.CapabilitiesOf(ac.StorageDriver)
+	caps.URLFor = true
+	return caps
+}
+
 // init registers the alicdn layerHandler backend.
 func init() {
 	storagemiddleware.Register("alicdn", storagemiddleware.InitFunc(newAliCDNStorageMiddleware))
@@ -209,6 +209,14 @@ func (lh *cloudFrontStorageMiddleware) URLFor(ctx context.Context, path string,
 	return cfURL, nil
 }
 
+// Capabilities reports the capabilities of the wrapped storage driver, which
+// URLFor is added to.
+func (lh *cloudFrontStorageMiddleware) Capabilities() storagedriver.Capabilities {
+	caps := storagedriver.CapabilitiesOf(lh.StorageDriver)
+	caps.URLFor = true
+	return caps
+}
+
 // init registers the cloudfront layerHandler backend.
 func init() {
 	storagemiddleware.Register("cloudfront", storagemiddleware.InitFunc(newCloudFrontStorageMiddleware))
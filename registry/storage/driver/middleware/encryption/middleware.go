@@ -0,0 +1,860 @@
+// Package encryption provides a storage middleware which encrypts content at
+// rest, for storage backends which lack native server side encryption.
+//
+// Content is encrypted with AES-GCM and stored as a header, holding a random
+// nonce for the object, followed by sealed chunks of chunkSize plaintext
+// bytes and a final chunk of less. The nonce of each chunk is derived from
+// the nonce of the object and the index of the chunk, so that content can be
+// read from any offset without decrypting what precedes it. The additional
+// data of each chunk binds it to the path of the object, its header, its
+// index and whether it is the final chunk, so that chunks can be neither
+// reordered, moved to another object nor dropped from the end of one.
+//
+// Streamed writes only seal full chunks until they are committed, when the
+// final chunk is sealed. When a writer is closed before being committed, the
+// remaining plaintext, possibly none, is sealed with a nonce of its own and
+// kept in a sibling object, suffixed with partialSuffix, until the writer is
+// resumed. Content without a final chunk cannot be read without its partial
+// chunk.
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+)
+
+const (
+	// chunkSize is the number of plaintext bytes sealed in each chunk.
+	chunkSize = 64 << 10
+
+	// partialSuffix is appended to the path of an uncommitted stream to
+	// name the object holding its sealed, incomplete last chunk.
+	partialSuffix = ".partial"
+
+	version = 1
+)
+
+var magic = []byte("DENC")
+
+// KeyResolver returns the encryption key configured by the options of the
+// middleware, for example by fetching it from a key management service.
+type KeyResolver func(options map[string]interface{}) ([]byte, error)
+
+var (
+	keyResolversMu sync.Mutex
+	keyResolvers   = make(map[string]KeyResolver)
+)
+
+// RegisterKeyResolver makes a KeyResolver available under the given name, to
+// be selected with the keyresolver option.
+func RegisterKeyResolver(name string, resolver KeyResolver) error {
+	keyResolversMu.Lock()
+	defer keyResolversMu.Unlock()
+
+	if _, exists := keyResolvers[name]; exists {
+		return fmt.Errorf("key resolver already registered: %s", name)
+	}
+	keyResolvers[name] = resolver
+	return nil
+}
+
+type encryptionStorageMiddleware struct {
+	storagedriver.StorageDriver
+	aead cipher.AEAD
+}
+
+var _ storagedriver.StorageDriver = &encryptionStorageMiddleware{}
+
+func newEncryptionStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	key, err := resolveKey(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(sd, key)
+}
+
+// New returns a storage driver which encrypts the content stored with sd with
+// key, which must be 16, 24 or 32 bytes long to select AES-128, AES-192 or
+// AES-256.
+func New(sd storagedriver.StorageDriver, key []byte) (storagedriver.StorageDriver, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptionStorageMiddleware{StorageDriver: sd, aead: aead}, nil
+}
+
+// resolveKey returns the key given, base64 encoded, by the key option, or
+// resolved by the KeyResolver named by the keyresolver option.
+func resolveKey(options map[string]interface{}) ([]byte, error) {
+	k, hasKey := options["key"]
+	r, hasResolver := options["keyresolver"]
+
+	switch {
+	case hasKey && hasResolver:
+		return nil, fmt.Errorf("only one of key and keyresolver may be provided")
+	case hasKey:
+		s, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("key must be a string")
+		}
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("key must be base64 encoded: %v", err)
+		}
+		return key, nil
+	case hasResolver:
+		name, ok := r.(string)
+		if !ok {
+			return nil, fmt.Errorf("keyresolver must be a string")
+		}
+		keyResolversMu.Lock()
+		resolver, ok := keyResolvers[name]
+		keyResolversMu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown key resolver: %s", name)
+		}
+		key, err := resolver(options)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve encryption key with %s: %v", name, err)
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("no key or keyresolver provided")
+}
+
+// headerSize returns the size of the header preceding the sealed chunks.
+func (d *encryptionStorageMiddleware) headerSize() int64 {
+	return int64(len(magic) + 1 + d.aead.NonceSize())
+}
+
+// sealedChunkSize returns the size of a sealed full chunk.
+func (d *encryptionStorageMiddleware) sealedChunkSize() int64 {
+	return chunkSize + int64(d.aead.Overhead())
+}
+
+// newHeader returns a header holding a new random nonce.
+func (d *encryptionStorageMiddleware) newHeader() ([]byte, error) {
+	header := make([]byte, 0, d.headerSize())
+	header = append(header, magic...)
+	header = append(header, version)
+	nonce := make([]byte, d.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return append(header, nonce...), nil
+}
+
+// parseHeader validates header and returns the nonce it holds.
+func (d *encryptionStorageMiddleware) parseHeader(path string, header []byte) ([]byte, error) {
+	if int64(len(header)) != d.headerSize() || !bytes.Equal(header[:len(magic)], magic) {
+		return nil, fmt.Errorf("%s: content at %s is not encrypted", d.Name(), path)
+	}
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("%s: content at %s has unsupported encryption version %d", d.Name(), path, header[len(magic)])
+	}
+	return header[len(magic)+1:], nil
+}
+
+// chunkNonce derives the nonce of the chunk at index from the nonce of the
+// object.
+func chunkNonce(nonce []byte, index int64) []byte {
+	n := make([]byte, len(nonce))
+	copy(n, nonce)
+	var i [8]byte
+	binary.BigEndian.PutUint64(i[:], uint64(index))
+	for j := range i {
+		n[len(n)-len(i)+j] ^= i[j]
+	}
+	return n
+}
+
+// The kinds of sealed chunks, which are part of their additional data.
+const (
+	kindChunk byte = iota
+	kindFinal
+	kindPartial
+)
+
+// additionalData returns the additional data of the chunk of the given kind
+// at index of the object at path.
+func additionalData(path string, header []byte, index int64, kind byte) []byte {
+	ad := make([]byte, 8+len(path)+len(header)+8+1)
+	binary.BigEndian.PutUint64(ad, uint64(len(path)))
+	n := 8 + copy(ad[8:], path)
+	n += copy(ad[n:], header)
+	binary.BigEndian.PutUint64(ad[n:], uint64(index))
+	ad[n+8] = kind
+	return ad
+}
+
+// chunkKind returns the kind of the chunk, final or not.
+func chunkKind(final bool) byte {
+	if final {
+		return kindFinal
+	}
+	return kindChunk
+}
+
+func (d *encryptionStorageMiddleware) sealChunk(path string, header, nonce []byte, index int64, final bool, plaintext []byte) []byte {
+	return d.aead.Seal(nil, chunkNonce(nonce, index), plaintext, additionalData(path, header, index, chunkKind(final)))
+}
+
+func (d *encryptionStorageMiddleware) openChunk(path string, header, nonce []byte, index int64, final bool, sealed []byte) ([]byte, error) {
+	plaintext, err := d.aead.Open(nil, chunkNonce(nonce, index), sealed, additionalData(path, header, index, chunkKind(final)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: unable to decrypt chunk %d of %s: %v", d.Name(), index, path, err)
+	}
+	return plaintext, nil
+}
+
+// sealPartial seals the incomplete last chunk of an uncommitted stream, at
+// index, with a random nonce stored ahead of it.
+func (d *encryptionStorageMiddleware) sealPartial(path string, header []byte, index int64, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, d.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return d.aead.Seal(nonce, nonce, plaintext, additionalData(path, header, index, kindPartial)), nil
+}
+
+func (d *encryptionStorageMiddleware) openPartial(path string, header []byte, index int64, sealed []byte) ([]byte, error) {
+	if len(sealed) < d.aead.NonceSize() {
+		return nil, fmt.Errorf("%s: invalid partial chunk for %s", d.Name(), path)
+	}
+	nonce, sealed := sealed[:d.aead.NonceSize()], sealed[d.aead.NonceSize():]
+	plaintext, err := d.aead.Open(nil, nonce, sealed, additionalData(path, header, index, kindPartial))
+	if err != nil {
+		return nil, fmt.Errorf("%s: unable to decrypt partial chunk of %s: %v", d.Name(), path, err)
+	}
+	return plaintext, nil
+}
+
+// layout describes how content of a given stored size is split in chunks.
+// As the final chunk is never full, content ends with one exactly when it
+// has been committed.
+type layout struct {
+	// fullChunks is the number of sealed full chunks.
+	fullChunks int64
+	// final is set when the content ends with its final chunk, of
+	// finalChunk plaintext bytes.
+	final      bool
+	finalChunk int64
+}
+
+func (d *encryptionStorageMiddleware) layout(path string, size int64) (layout, error) {
+	if size < d.headerSize() {
+		return layout{}, fmt.Errorf("%s: content at %s is not encrypted", d.Name(), path)
+	}
+	size -= d.headerSize()
+
+	l := layout{fullChunks: size / d.sealedChunkSize()}
+	if rem := size % d.sealedChunkSize(); rem != 0 {
+		if rem < int64(d.aead.Overhead()) {
+			return layout{}, d.truncated(path)
+		}
+		l.final = true
+		l.finalChunk = rem - int64(d.aead.Overhead())
+	}
+	return l, nil
+}
+
+// truncated returns the error for content at path which lost chunks.
+func (d *encryptionStorageMiddleware) truncated(path string) error {
+	return fmt.Errorf("%s: content at %s is truncated", d.Name(), path)
+}
+
+// size returns the plaintext size of the sealed chunks.
+func (l layout) size() int64 {
+	return l.fullChunks*chunkSize + l.finalChunk
+}
+
+// committed reports whether the final chunk has been sealed, in which case
+// there cannot be a partial chunk.
+func (l layout) committed() bool {
+	return l.final
+}
+
+// chunks returns the number of sealed chunks.
+func (l layout) chunks() int64 {
+	if l.final {
+		return l.fullChunks + 1
+	}
+	return l.fullChunks
+}
+
+// readPartial returns the decrypted partial chunk of the uncommitted stream
+// at path. Every closed stream has one, so content without a final chunk
+// nor a partial chunk is truncated.
+func (d *encryptionStorageMiddleware) readPartial(ctx context.Context, path string, header []byte, index int64) ([]byte, error) {
+	sealed, err := d.StorageDriver.GetContent(ctx, path+partialSuffix)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, d.truncated(path)
+		}
+		return nil, err
+	}
+	return d.openPartial(path, header, index, sealed)
+}
+
+// deletePartial deletes the partial chunk of the stream at path, if any.
+func (d *encryptionStorageMiddleware) deletePartial(ctx context.Context, path string) error {
+	err := d.StorageDriver.Delete(ctx, path+partialSuffix)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// GetContent retrieves and decrypts the content stored at "path".
+func (d *encryptionStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	stored, err := d.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := d.layout(path, int64(len(stored)))
+	if err != nil {
+		return nil, err
+	}
+	header := stored[:d.headerSize()]
+	nonce, err := d.parseHeader(path, header)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, 0, l.size())
+	sealed := stored[d.headerSize():]
+	for index := int64(0); len(sealed) > 0; index++ {
+		n := d.sealedChunkSize()
+		if int64(len(sealed)) < n {
+			n = int64(len(sealed))
+		}
+		chunk, err := d.openChunk(path, header, nonce, index, l.final && index == l.fullChunks, sealed[:n])
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, chunk...)
+		sealed = sealed[n:]
+	}
+
+	if !l.committed() {
+		partial, err := d.readPartial(ctx, path, header, l.fullChunks)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, partial...)
+	}
+
+	return content, nil
+}
+
+// PutContent encrypts and stores the []byte content at a location designated
+// by "path".
+func (d *encryptionStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	header, err := d.newHeader()
+	if err != nil {
+		return err
+	}
+	nonce := header[len(magic)+1:]
+
+	stored := make([]byte, 0, d.headerSize()+int64(len(content))+(int64(len(content))/chunkSize+1)*int64(d.aead.Overhead()))
+	stored = append(stored, header...)
+	index := int64(0)
+	for ; len(content) >= chunkSize; index++ {
+		stored = append(stored, d.sealChunk(path, header, nonce, index, false, content[:chunkSize])...)
+		content = content[chunkSize:]
+	}
+	stored = append(stored, d.sealChunk(path, header, nonce, index, true, content)...)
+
+	return d.StorageDriver.PutContent(ctx, path, stored)
+}
+
+// Reader retrieves an io.ReadCloser for the decrypted content stored at
+// "path" with a given byte offset.
+func (d *encryptionStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.Name()}
+	}
+
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	l, err := d.layout(path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := d.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, d.headerSize())
+	if _, err := io.ReadFull(rc, header); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	nonce, err := d.parseHeader(path, header)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	var partial []byte
+	if !l.committed() {
+		partial, err = d.readPartial(ctx, path, header, l.fullChunks)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+
+	size := l.size() + int64(len(partial))
+	if offset > size {
+		rc.Close()
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.Name()}
+	}
+
+	index := offset / chunkSize
+	if index >= l.chunks() {
+		rc.Close()
+		return ioutil.NopCloser(bytes.NewReader(partial[offset-l.size():])), nil
+	}
+
+	if index > 0 {
+		rc.Close()
+		rc, err = d.StorageDriver.Reader(ctx, path, d.headerSize()+index*d.sealedChunkSize())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &reader{
+		d:       d,
+		path:    path,
+		rc:      rc,
+		header:  header,
+		nonce:   nonce,
+		index:   index,
+		chunks:  l.chunks(),
+		final:   l.final,
+		skip:    offset % chunkSize,
+		partial: partial,
+	}, nil
+}
+
+// reader decrypts the sealed chunks read from rc, followed by the partial
+// chunk of an uncommitted stream.
+type reader struct {
+	d      *encryptionStorageMiddleware
+	path   string
+	rc     io.ReadCloser
+	header []byte
+	nonce  []byte
+
+	// index is the index of the next chunk to read, out of chunks, the
+	// last of which is the final chunk if final is set.
+	index  int64
+	chunks int64
+	final  bool
+	// skip is the number of plaintext bytes to skip in the next chunk.
+	skip int64
+
+	buf     []byte
+	partial []byte
+	err     error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.fill()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill decrypts the next chunk into buf.
+func (r *reader) fill() {
+	if r.index >= r.chunks {
+		r.buf = r.partial[r.skip:]
+		r.partial, r.skip = nil, 0
+		r.err = io.EOF
+		return
+	}
+
+	sealed := make([]byte, r.d.sealedChunkSize())
+	n, err := io.ReadFull(r.rc, sealed)
+	if err == io.ErrUnexpectedEOF && r.index == r.chunks-1 {
+		err = nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+		return
+	}
+
+	chunk, err := r.d.openChunk(r.path, r.header, r.nonce, r.index, r.final && r.index == r.chunks-1, sealed[:n])
+	if err != nil {
+		r.err = err
+		return
+	}
+	r.buf = chunk[r.skip:]
+	r.index++
+	r.skip = 0
+}
+
+func (r *reader) Close() error {
+	return r.rc.Close()
+}
+
+// Writer returns a FileWriter which will encrypt the content written to it
+// and store it at the location designated by "path" after the call to
+// Commit.
+func (d *encryptionStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw := &fileWriter{
+		ctx:  ctx,
+		d:    d,
+		path: path,
+	}
+
+	var fi storagedriver.FileInfo
+	if append {
+		var err error
+		fi, err = d.StorageDriver.Stat(ctx, path)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				return nil, err
+			}
+		}
+	}
+
+	if fi == nil {
+		header, err := d.newHeader()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.deletePartial(ctx, path); err != nil {
+			return nil, err
+		}
+		fw.fw, err = d.StorageDriver.Writer(ctx, path, false)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.fw.Write(header); err != nil {
+			fw.fw.Cancel()
+			return nil, err
+		}
+		fw.header = header
+		fw.nonce = header[len(magic)+1:]
+		return fw, nil
+	}
+
+	l, err := d.layout(path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if l.committed() {
+		return nil, fmt.Errorf("%s: cannot append to committed content at %s", d.Name(), path)
+	}
+
+	rc, err := d.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, d.headerSize())
+	_, err = io.ReadFull(rc, header)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	if fw.nonce, err = d.parseHeader(path, header); err != nil {
+		return nil, err
+	}
+	fw.header = header
+	fw.index = l.fullChunks
+
+	fw.buf, err = d.readPartial(ctx, path, header, l.fullChunks)
+	if err != nil {
+		return nil, err
+	}
+	fw.hasPartial = true
+
+	fw.fw, err = d.StorageDriver.Writer(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// fileWriter seals full chunks as they are written, and keeps the plaintext
+// of the incomplete last chunk in buf.
+type fileWriter struct {
+	ctx  context.Context
+	d    *encryptionStorageMiddleware
+	path string
+	fw   storagedriver.FileWriter
+
+	header []byte
+	nonce  []byte
+	// index is the index of the next chunk to seal. The plaintext of the
+	// next chunk is held in buf until full, or sealed as the final chunk on
+	// commit.
+	index int64
+	buf   []byte
+	// hasPartial is set when a partial chunk may be stored for path.
+	hasPartial bool
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+var _ storagedriver.FileWriter = &fileWriter{}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= chunkSize {
+		if err := w.seal(w.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[chunkSize:]
+	}
+	if len(w.buf) == 0 {
+		w.buf = nil
+	}
+	return len(p), nil
+}
+
+// seal writes the next sealed chunk.
+func (w *fileWriter) seal(chunk []byte, final bool) error {
+	if _, err := w.fw.Write(w.d.sealChunk(w.path, w.header, w.nonce, w.index, final, chunk)); err != nil {
+		return err
+	}
+	w.index++
+	return nil
+}
+
+func (w *fileWriter) Size() int64 {
+	return w.index*chunkSize + int64(len(w.buf))
+}
+
+func (w *fileWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	if !w.committed && !w.cancelled {
+		// The partial chunk is stored even if empty, as content without a
+		// final chunk is truncated without one.
+		sealed, err := w.d.sealPartial(w.path, w.header, w.index, w.buf)
+		if err != nil {
+			return err
+		}
+		if err := w.d.StorageDriver.PutContent(w.ctx, w.path+partialSuffix, sealed); err != nil {
+			return err
+		}
+	}
+
+	return w.fw.Close()
+}
+
+func (w *fileWriter) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+
+	if w.hasPartial {
+		if err := w.d.deletePartial(w.ctx, w.path); err != nil {
+			return err
+		}
+	}
+	return w.fw.Cancel()
+}
+
+func (w *fileWriter) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+
+	if err := w.seal(w.buf, true); err != nil {
+		return err
+	}
+	w.buf = nil
+	if err := w.fw.Commit(); err != nil {
+		return err
+	}
+	w.committed = true
+
+	if w.hasPartial {
+		return w.d.deletePartial(w.ctx, w.path)
+	}
+	return nil
+}
+
+// Stat retrieves the FileInfo for the given path, reporting the size of the
+// decrypted content. The size of content without a final chunk nor a
+// partial chunk, which cannot be read, is that of its full chunks.
+func (d *encryptionStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+
+	l, err := d.layout(path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	size := l.size()
+
+	if !l.committed() {
+		partial, err := d.StorageDriver.Stat(ctx, path+partialSuffix)
+		if err == nil {
+			size += partial.Size() - int64(d.aead.NonceSize()+d.aead.Overhead())
+		} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return nil, err
+		}
+	}
+
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    size,
+		ModTime: fi.ModTime(),
+		IsDir:   false,
+	}}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path, omitting partial chunks.
+func (d *encryptionStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	entries, err := d.StorageDriver.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	children := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, partialSuffix) {
+			children = append(children, entry)
+		}
+	}
+	return children, nil
+}
+
+// Move moves an object stored at sourcePath to destPath. As chunks are bound
+// to the path of their object, the content is encrypted anew for destPath,
+// committed if it was, before the source is deleted.
+func (d *encryptionStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	fi, err := d.StorageDriver.Stat(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	l, err := d.layout(sourcePath, fi.Size())
+	if err != nil {
+		return err
+	}
+
+	rc, err := d.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := d.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, rc); err != nil {
+		fw.Cancel()
+		return err
+	}
+	if l.committed() {
+		if err := fw.Commit(); err != nil {
+			fw.Cancel()
+			return err
+		}
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	return d.Delete(ctx, sourcePath)
+}
+
+// Capabilities reports the consistency of the wrapped storage driver. Move
+// reads and writes the content moved as a stream, so is neither carried out
+// by the backend nor atomic, and URLFor is unsupported since the content
+// stored is encrypted.
+func (d *encryptionStorageMiddleware) Capabilities() storagedriver.Capabilities {
+	return storagedriver.Capabilities{
+		ReadAfterWrite: storagedriver.CapabilitiesOf(d.StorageDriver).ReadAfterWrite,
+	}
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths,
+// along with the partial chunk of "path", if any.
+func (d *encryptionStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if err := d.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	return d.deletePartial(ctx, path)
+}
+
+// URLFor is not supported, since the content served from such a URL would
+// not be decrypted.
+func (d *encryptionStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod{DriverName: d.Name()}
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file
+func (d *encryptionStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
+
+func init() {
+	storagemiddleware.Register("encryption", storagemiddleware.InitFunc(newEncryptionStorageMiddleware))
+}
@@ -0,0 +1,393 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func init() {
+	root, err := ioutil.TempDir("", "driver-encryption-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(root)
+
+	driver, err := New(filesystem.New(filesystem.DriverParameters{
+		RootDirectory: root,
+		MaxThreads:    100,
+	}), testKey)
+	if err != nil {
+		panic(err)
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return driver, nil
+	}, testsuites.NeverSkip)
+}
+
+func TestOptions(t *testing.T) {
+	RegisterKeyResolver("test", func(options map[string]interface{}) ([]byte, error) {
+		return testKey, nil
+	})
+
+	for _, options := range []map[string]interface{}{
+		{"key": base64.StdEncoding.EncodeToString(testKey)},
+		{"keyresolver": "test"},
+	} {
+		if _, err := newEncryptionStorageMiddleware(inmemory.New(), options); err != nil {
+			t.Errorf("unexpected error for options %v: %v", options, err)
+		}
+	}
+
+	for _, options := range []map[string]interface{}{
+		{},
+		{"key": "not base64"},
+		{"key": base64.StdEncoding.EncodeToString([]byte("short"))},
+		{"keyresolver": "doesnotexist"},
+		{"key": base64.StdEncoding.EncodeToString(testKey), "keyresolver": "test"},
+	} {
+		if _, err := newEncryptionStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Errorf("expected an error for options %v", options)
+		}
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	d, err := New(backend, testKey)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	content := make([]byte, 3*chunkSize+100)
+	rand.Read(content)
+
+	const (
+		putPath    = "/put/data"
+		streamPath = "/stream/data"
+	)
+
+	if err := d.PutContent(ctx, putPath, content); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+
+	// Write the stream in pieces which do not line up with chunks, resuming
+	// the writer in between.
+	var fw storagedriver.FileWriter
+	for i, piece := range [][]byte{content[:100], content[100 : chunkSize+7], content[chunkSize+7:]} {
+		fw, err = d.Writer(ctx, streamPath, i > 0)
+		if err != nil {
+			t.Fatalf("unexpected error creating writer: %v", err)
+		}
+		if _, err := fw.Write(piece); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		if i < 2 {
+			if err := fw.Close(); err != nil {
+				t.Fatalf("unexpected error closing writer: %v", err)
+			}
+		}
+	}
+	if err := fw.Commit(); err != nil {
+		t.Fatalf("unexpected error committing writer: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %v", err)
+	}
+
+	for _, p := range []string{putPath, streamPath} {
+		stored, err := backend.GetContent(ctx, p)
+		if err != nil {
+			t.Fatalf("unexpected error reading stored content: %v", err)
+		}
+		if bytes.Contains(stored, content[:64]) {
+			t.Errorf("content stored at %s is not encrypted", p)
+		}
+
+		fi, err := d.Stat(ctx, p)
+		if err != nil {
+			t.Fatalf("unexpected error stating %s: %v", p, err)
+		}
+		if fi.Size() != int64(len(content)) {
+			t.Errorf("unexpected size of %s: %d != %d", p, fi.Size(), len(content))
+		}
+
+		decrypted, err := d.GetContent(ctx, p)
+		if err != nil {
+			t.Fatalf("unexpected error getting %s: %v", p, err)
+		}
+		if !bytes.Equal(decrypted, content) {
+			t.Errorf("decrypted content of %s does not match", p)
+		}
+
+		for _, offset := range []int64{0, 1, chunkSize - 1, chunkSize, 2*chunkSize + 5, int64(len(content))} {
+			rc, err := d.Reader(ctx, p, offset)
+			if err != nil {
+				t.Fatalf("unexpected error reading %s at %d: %v", p, offset, err)
+			}
+			read, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("unexpected error reading %s at %d: %v", p, offset, err)
+			}
+			if !bytes.Equal(read, content[offset:]) {
+				t.Errorf("content of %s read at %d does not match", p, offset)
+			}
+		}
+	}
+
+	if _, err := d.URLFor(ctx, putPath, nil); err == nil {
+		t.Errorf("expected URLFor to be unsupported")
+	} else if _, ok := err.(storagedriver.ErrUnsupportedMethod); !ok {
+		t.Errorf("unexpected error from URLFor: %v", err)
+	}
+}
+
+func TestTamperedContent(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	d, err := New(backend, testKey)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	const p = "/tampered/data"
+	content := make([]byte, 2*chunkSize)
+	rand.Read(content)
+	if err := d.PutContent(ctx, p, content); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+
+	stored, err := backend.GetContent(ctx, p)
+	if err != nil {
+		t.Fatalf("unexpected error reading stored content: %v", err)
+	}
+	stored[len(stored)-1] ^= 0xff
+	if err := backend.PutContent(ctx, p, stored); err != nil {
+		t.Fatalf("unexpected error storing tampered content: %v", err)
+	}
+
+	if _, err := d.GetContent(ctx, p); err == nil {
+		t.Errorf("expected an error getting tampered content")
+	}
+
+	rc, err := d.Reader(ctx, p, chunkSize)
+	if err != nil {
+		t.Fatalf("unexpected error opening reader: %v", err)
+	}
+	defer rc.Close()
+	if _, err := ioutil.ReadAll(rc); err == nil {
+		t.Errorf("expected an error reading tampered content")
+	}
+
+	// Content encrypted with another key cannot be decrypted either.
+	other, err := New(backend, []byte("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	if err := d.PutContent(ctx, p, content); err != nil {
+		t.Fatalf("unexpected error putting content: %v", err)
+	}
+	if _, err := other.GetContent(ctx, p); err == nil {
+		t.Errorf("expected an error decrypting with another key")
+	}
+}
+
+// TestTruncatedContent checks that content cut at a chunk boundary, or
+// missing its partial chunk, cannot be read.
+func TestTruncatedContent(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	d, err := New(backend, testKey)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	e := d.(*encryptionStorageMiddleware)
+
+	content := make([]byte, 2*chunkSize+100)
+	rand.Read(content)
+
+	expectTruncated := func(name, p string) {
+		t.Helper()
+		if _, err := d.GetContent(ctx, p); err == nil {
+			t.Errorf("%s: expected an error getting truncated content", name)
+		}
+		rc, err := d.Reader(ctx, p, 0)
+		if err == nil {
+			_, err = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error reading truncated content", name)
+		}
+	}
+
+	for _, chunks := range []int64{0, 1, 2} {
+		const p = "/truncated/data"
+		if err := d.PutContent(ctx, p, content); err != nil {
+			t.Fatalf("unexpected error putting content: %v", err)
+		}
+		stored, err := backend.GetContent(ctx, p)
+		if err != nil {
+			t.Fatalf("unexpected error reading stored content: %v", err)
+		}
+		if err := backend.PutContent(ctx, p, stored[:e.headerSize()+chunks*e.sealedChunkSize()]); err != nil {
+			t.Fatalf("unexpected error storing truncated content: %v", err)
+		}
+		expectTruncated(fmt.Sprintf("committed content cut after %d chunks", chunks), p)
+	}
+
+	// An uncommitted stream cannot be read, nor resumed, without its partial
+	// chunk, even if it holds no data.
+	for _, size := range []int{0, chunkSize, chunkSize + 100} {
+		p := fmt.Sprintf("/uncommitted/%d", size)
+		fw, err := d.Writer(ctx, p, false)
+		if err != nil {
+			t.Fatalf("unexpected error creating writer: %v", err)
+		}
+		if _, err := fw.Write(content[:size]); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatalf("unexpected error closing writer: %v", err)
+		}
+		if read, err := d.GetContent(ctx, p); err != nil || !bytes.Equal(read, content[:size]) {
+			t.Fatalf("unexpected content of uncommitted stream of %d bytes: %v", size, err)
+		}
+
+		if err := backend.Delete(ctx, p+partialSuffix); err != nil {
+			t.Fatalf("unexpected error deleting partial chunk: %v", err)
+		}
+		expectTruncated(fmt.Sprintf("uncommitted stream of %d bytes", size), p)
+		if _, err := d.Writer(ctx, p, true); err == nil {
+			t.Errorf("expected an error resuming a stream of %d bytes without its partial chunk", size)
+		}
+	}
+}
+
+// TestSwappedContent checks that content, or partial chunks, stored for one
+// path cannot be read from another.
+func TestSwappedContent(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	d, err := New(backend, testKey)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	content := make([]byte, chunkSize+100)
+	rand.Read(content)
+
+	for _, p := range []string{"/a/data", "/b/data"} {
+		if err := d.PutContent(ctx, p, content); err != nil {
+			t.Fatalf("unexpected error putting content: %v", err)
+		}
+	}
+	stored, err := backend.GetContent(ctx, "/a/data")
+	if err != nil {
+		t.Fatalf("unexpected error reading stored content: %v", err)
+	}
+	if err := backend.PutContent(ctx, "/b/data", stored); err != nil {
+		t.Fatalf("unexpected error swapping content: %v", err)
+	}
+	if _, err := d.GetContent(ctx, "/b/data"); err == nil {
+		t.Errorf("expected an error getting content stored for another path")
+	}
+
+	for _, p := range []string{"/a/stream", "/b/stream"} {
+		fw, err := d.Writer(ctx, p, false)
+		if err != nil {
+			t.Fatalf("unexpected error creating writer: %v", err)
+		}
+		if _, err := fw.Write(content[:100]); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatalf("unexpected error closing writer: %v", err)
+		}
+	}
+	partial, err := backend.GetContent(ctx, "/a/stream"+partialSuffix)
+	if err != nil {
+		t.Fatalf("unexpected error reading partial chunk: %v", err)
+	}
+	if err := backend.PutContent(ctx, "/b/stream"+partialSuffix, partial); err != nil {
+		t.Fatalf("unexpected error swapping partial chunk: %v", err)
+	}
+	if _, err := d.GetContent(ctx, "/b/stream"); err == nil {
+		t.Errorf("expected an error getting a partial chunk stored for another path")
+	}
+}
+
+// TestMoveUncommitted checks that an uncommitted stream can be moved, and
+// resumed at its destination.
+func TestMoveUncommitted(t *testing.T) {
+	ctx := context.Background()
+	d, err := New(inmemory.New(), testKey)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	content := make([]byte, chunkSize+100)
+	rand.Read(content)
+
+	fw, err := d.Writer(ctx, "/source", false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := fw.Write(content[:chunkSize+50]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %v", err)
+	}
+
+	if err := d.Move(ctx, "/source", "/dest"); err != nil {
+		t.Fatalf("unexpected error moving stream: %v", err)
+	}
+	if _, err := d.Stat(ctx, "/source"); err == nil {
+		t.Errorf("expected source to be deleted")
+	}
+
+	fw, err = d.Writer(ctx, "/dest", true)
+	if err != nil {
+		t.Fatalf("unexpected error resuming moved stream: %v", err)
+	}
+	if fw.Size() != chunkSize+50 {
+		t.Fatalf("unexpected size of moved stream: %d", fw.Size())
+	}
+	if _, err := fw.Write(content[chunkSize+50:]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := fw.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %v", err)
+	}
+
+	read, err := d.GetContent(ctx, "/dest")
+	if err != nil {
+		t.Fatalf("unexpected error getting moved content: %v", err)
+	}
+	if !bytes.Equal(read, content) {
+		t.Errorf("moved content does not match")
+	}
+}
@@ -45,6 +45,14 @@ func (r *redirectStorageMiddleware) URLFor(ctx context.Context, path string, opt
 	return u.String(), nil
 }
 
+// Capabilities reports the capabilities of the wrapped storage driver, which
+// URLFor is added to.
+func (r *redirectStorageMiddleware) Capabilities() storagedriver.Capabilities {
+	caps := storagedriver.CapabilitiesOf(r.StorageDriver)
+	caps.URLFor = true
+	return caps
+}
+
 func init() {
 	storagemiddleware.Register("redirect", storagemiddleware.InitFunc(newRedirectStorageMiddleware))
 }
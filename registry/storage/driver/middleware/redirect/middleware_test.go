@@ -4,6 +4,9 @@ import (
 	"context"
 	"testing"
 
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	check "gopkg.in/check.v1"
 )
 
@@ -57,3 +60,29 @@ func (s *MiddlewareSuite) TestHTTP(c *check.C) {
 	c.Assert(err, check.Equals, nil)
 	c.Assert(url, check.Equals, "http://example.com/morty/data")
 }
+
+func (s *MiddlewareSuite) TestAtomicMove(c *check.C) {
+	options := make(map[string]interface{})
+	options["baseurl"] = "https://example.com"
+	root := c.MkDir()
+	middleware, err := newRedirectStorageMiddleware(filesystem.New(filesystem.DriverParameters{RootDirectory: root, MaxThreads: 100}), options)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(storagedriver.IsMoveAtomic(middleware), check.Equals, true)
+
+	middleware, err = newRedirectStorageMiddleware(struct{ storagedriver.StorageDriver }{inmemory.New()}, options)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(storagedriver.IsMoveAtomic(middleware), check.Equals, false)
+}
+
+func (s *MiddlewareSuite) TestCapabilities(c *check.C) {
+	options := make(map[string]interface{})
+	options["baseurl"] = "https://example.com"
+	middleware, err := newRedirectStorageMiddleware(inmemory.New(), options)
+	c.Assert(err, check.Equals, nil)
+	c.Assert(storagedriver.CapabilitiesOf(middleware), check.Equals, storagedriver.Capabilities{
+		ServerSideCopy: true,
+		AtomicMove:     true,
+		URLFor:         true,
+		ReadAfterWrite: true,
+	})
+}
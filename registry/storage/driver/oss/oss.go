@@ -461,6 +461,16 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 	return nil
 }
 
+// Capabilities reports that Move is not atomic, since it is implemented as a
+// server-side copy followed by a delete of the source.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.Capabilities{
+		ServerSideCopy: true,
+		URLFor:         true,
+		ReadAfterWrite: true,
+	}
+}
+
 // URLFor returns a URL which may be used to retrieve the content stored at the given path.
 // May return an UnsupportedMethodErr in certain StorageDriver implementations.
 func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"math"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"reflect"
 	"sort"
@@ -75,6 +76,21 @@ const listMax = 1000
 // noStorageClass defines the value to be used if storage class is not supported by the S3 endpoint
 const noStorageClass = "NONE"
 
+// Path categories the objects of which may be tagged.
+const (
+	// objectTagsBlob tags the content of blobs: layers, image configs and
+	// manifests.
+	objectTagsBlob = "blob"
+	// objectTagsManifest tags the manifest revision and tag links of
+	// repositories.
+	objectTagsManifest = "manifest"
+	// objectTagsUpload tags the data and state of uploads in progress.
+	objectTagsUpload = "upload"
+)
+
+// maxObjectTags is the largest number of tags S3 allows on an object.
+const maxObjectTags = 10
+
 // validRegions maps known s3 region identifiers to region descriptors
 var validRegions = map[string]struct{}{}
 
@@ -102,6 +118,8 @@ type DriverParameters struct {
 	UserAgent                   string
 	ObjectACL                   string
 	SessionToken                string
+	ObjectTags                  map[string]map[string]string
+	ConnectionPool              base.ConnectionPool
 }
 
 func init() {
@@ -148,6 +166,11 @@ type driver struct {
 	RootDirectory               string
 	StorageClass                string
 	ObjectACL                   string
+	ObjectTagging               map[string]string
+
+	// CustomEndpoint is set when the driver talks to an S3-compatible
+	// endpoint rather than to AWS, whose consistency is unknown.
+	CustomEndpoint bool
 }
 
 type baseEmbed struct {
@@ -338,6 +361,16 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		objectACL = objectACLString
 	}
 
+	objectTags, err := parseObjectTags(parameters["objecttags"])
+	if err != nil {
+		return nil, err
+	}
+
+	connectionPool, err := base.ConnectionPoolFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
 	sessionToken := ""
 
 	params := DriverParameters{
@@ -360,11 +393,94 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		fmt.Sprint(userAgent),
 		objectACL,
 		fmt.Sprint(sessionToken),
+		objectTags,
+		connectionPool,
 	}
 
 	return New(params)
 }
 
+// parseObjectTags parses the objecttags parameter, which maps path categories
+// to the tags of the objects stored under them.
+func parseObjectTags(param interface{}) (map[string]map[string]string, error) {
+	if param == nil {
+		return nil, nil
+	}
+	categories, err := parseStringMap(param)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for objecttags parameter: %v", err)
+	}
+
+	objectTags := make(map[string]map[string]string, len(categories))
+	for category, rawTags := range categories {
+		tags, err := parseStringMap(rawTags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid objecttags of %s: %v", category, err)
+		}
+		objectTags[category] = make(map[string]string, len(tags))
+		for key, value := range tags {
+			switch value.(type) {
+			case string, bool, int, int64, uint64, float64:
+				objectTags[category][key] = fmt.Sprint(value)
+			default:
+				return nil, fmt.Errorf("invalid value of objecttags %s tag %s: %#v", category, key, value)
+			}
+		}
+	}
+	return objectTags, nil
+}
+
+// parseStringMap converts a map parsed from the configuration to a map keyed
+// by strings.
+func parseStringMap(param interface{}) (map[string]interface{}, error) {
+	switch m := param.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		sm := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %#v is not a string", k)
+			}
+			sm[key] = v
+		}
+		return sm, nil
+	default:
+		return nil, fmt.Errorf("%#v is not a map", param)
+	}
+}
+
+// encodeObjectTags validates the tags of each path category and encodes them
+// as expected by the Tagging field of S3 requests.
+func encodeObjectTags(objectTags map[string]map[string]string) (map[string]string, error) {
+	tagging := make(map[string]string, len(objectTags))
+	for category, tags := range objectTags {
+		switch category {
+		case objectTagsBlob, objectTagsManifest, objectTagsUpload:
+		default:
+			return nil, fmt.Errorf("unknown objecttags category %q, must be one of %v", category,
+				[]string{objectTagsBlob, objectTagsManifest, objectTagsUpload})
+		}
+		if len(tags) > maxObjectTags {
+			return nil, fmt.Errorf("objecttags of %s has %d tags, at most %d are allowed", category, len(tags), maxObjectTags)
+		}
+
+		values := url.Values{}
+		for key, value := range tags {
+			if len(key) == 0 || len(key) > 128 {
+				return nil, fmt.Errorf("objecttags of %s has a tag key of %d characters, must be between 1 and 128", category, len(key))
+			}
+			if len(value) > 256 {
+				return nil, fmt.Errorf("objecttags of %s has a value of tag %s longer than 256 characters", category, key)
+			}
+			values.Set(key, value)
+		}
+		tagging[category] = values.Encode()
+	}
+	return tagging, nil
+}
+
 // getParameterAsInt64 converts parameters[name] to an int64 value (using
 // defaultt if nil), verifies it is no smaller than min, and returns it.
 func getParameterAsInt64(parameters map[string]interface{}, name string, defaultt int64, min int64, max int64) (int64, error) {
@@ -414,6 +530,11 @@ func New(params DriverParameters) (*Driver, error) {
 		awsConfig.WithCredentials(creds)
 	}
 
+	objectTagging, err := encodeObjectTags(params.ObjectTags)
+	if err != nil {
+		return nil, err
+	}
+
 	if params.RegionEndpoint != "" {
 		awsConfig.WithS3ForcePathStyle(true)
 		awsConfig.WithEndpoint(params.RegionEndpoint)
@@ -422,22 +543,18 @@ func New(params DriverParameters) (*Driver, error) {
 	awsConfig.WithRegion(params.Region)
 	awsConfig.WithDisableSSL(!params.Secure)
 
-	if params.UserAgent != "" || params.SkipVerify {
-		httpTransport := http.DefaultTransport
-		if params.SkipVerify {
-			httpTransport = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-		}
-		if params.UserAgent != "" {
-			awsConfig.WithHTTPClient(&http.Client{
-				Transport: transport.NewTransport(httpTransport, transport.NewHeaderRequestModifier(http.Header{http.CanonicalHeaderKey("User-Agent"): []string{params.UserAgent}})),
-			})
-		} else {
-			awsConfig.WithHTTPClient(&http.Client{
-				Transport: transport.NewTransport(httpTransport),
-			})
-		}
+	httpTransport := params.ConnectionPool.NewTransport()
+	if params.SkipVerify {
+		httpTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if params.UserAgent != "" {
+		awsConfig.WithHTTPClient(&http.Client{
+			Transport: transport.NewTransport(httpTransport, transport.NewHeaderRequestModifier(http.Header{http.CanonicalHeaderKey("User-Agent"): []string{params.UserAgent}})),
+		})
+	} else {
+		awsConfig.WithHTTPClient(&http.Client{
+			Transport: httpTransport,
+		})
 	}
 
 	sess, err := session.NewSession(awsConfig)
@@ -478,6 +595,8 @@ func New(params DriverParameters) (*Driver, error) {
 		RootDirectory:               params.RootDirectory,
 		StorageClass:                params.StorageClass,
 		ObjectACL:                   params.ObjectACL,
+		ObjectTagging:               objectTagging,
+		CustomEndpoint:              params.RegionEndpoint != "",
 	}
 
 	return &Driver{
@@ -509,11 +628,12 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 	_, err := d.S3.PutObject(&s3.PutObjectInput{
 		Bucket:               aws.String(d.Bucket),
 		Key:                  aws.String(d.s3Path(path)),
-		ContentType:          d.getContentType(),
+		ContentType:          d.getContentType(ctx),
 		ACL:                  d.getACL(),
 		ServerSideEncryption: d.getEncryptionMode(),
 		SSEKMSKeyId:          d.getSSEKMSKeyID(),
 		StorageClass:         d.getStorageClass(),
+		Tagging:              d.getTagging(path),
 		Body:                 bytes.NewReader(contents),
 	})
 	return parseError(path, err)
@@ -522,7 +642,7 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 // Reader retrieves an io.ReadCloser for the content stored at "path" with a
 // given byte offset.
 func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
-	resp, err := d.S3.GetObject(&s3.GetObjectInput{
+	resp, err := d.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(d.Bucket),
 		Key:    aws.String(d.s3Path(path)),
 		Range:  aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-"),
@@ -542,21 +662,23 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 // at the location designated by "path" after the call to Commit.
 func (d *driver) Writer(ctx context.Context, path string, appendParam bool) (storagedriver.FileWriter, error) {
 	key := d.s3Path(path)
+	tagging := d.getTagging(path)
 	if !appendParam {
 		// TODO (brianbland): cancel other uploads at this path
 		resp, err := d.S3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
 			Bucket:               aws.String(d.Bucket),
 			Key:                  aws.String(key),
-			ContentType:          d.getContentType(),
+			ContentType:          d.getContentType(ctx),
 			ACL:                  d.getACL(),
 			ServerSideEncryption: d.getEncryptionMode(),
 			SSEKMSKeyId:          d.getSSEKMSKeyID(),
 			StorageClass:         d.getStorageClass(),
+			Tagging:              tagging,
 		})
 		if err != nil {
 			return nil, err
 		}
-		return d.newWriter(key, *resp.UploadId, nil), nil
+		return d.newWriter(key, tagging, *resp.UploadId, nil), nil
 	}
 	resp, err := d.S3.ListMultipartUploads(&s3.ListMultipartUploadsInput{
 		Bucket: aws.String(d.Bucket),
@@ -591,7 +713,7 @@ func (d *driver) Writer(ctx context.Context, path string, appendParam bool) (sto
 			}
 			allParts = append(allParts, resp.Parts...)
 		}
-		return d.newWriter(key, *multi.UploadId, allParts), nil
+		return d.newWriter(key, tagging, *multi.UploadId, allParts), nil
 	}
 	return nil, storagedriver.PathNotFoundError{Path: path}
 }
@@ -697,13 +819,27 @@ func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
 // Move moves an object stored at sourcePath to destPath, removing the original
 // object.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
-	/* This is terrible, but aws doesn't have an actual move. */
+	// This is terrible, but aws doesn't have an actual move. The source is
+	// only deleted once the copy has completed, so an interrupted Move may
+	// leave both objects behind but never loses data.
 	if err := d.copy(ctx, sourcePath, destPath); err != nil {
 		return err
 	}
 	return d.Delete(ctx, sourcePath)
 }
 
+// Capabilities reports that Move is not atomic, since it is implemented as a
+// server-side copy followed by a delete of the source. Reads after writes are
+// strongly consistent on AWS, but are not assumed to be on S3-compatible
+// endpoints.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.Capabilities{
+		ServerSideCopy: true,
+		URLFor:         true,
+		ReadAfterWrite: !d.CustomEndpoint,
+	}
+}
+
 // copy copies an object stored at sourcePath to destPath.
 func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) error {
 	// S3 can copy objects up to 5 GB in size with a single PUT Object - Copy
@@ -718,14 +854,17 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 	}
 
 	if fileInfo.Size() <= d.MultipartCopyThresholdSize {
-		_, err := d.S3.CopyObject(&s3.CopyObjectInput{
+		_, err := d.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
 			Bucket:               aws.String(d.Bucket),
 			Key:                  aws.String(d.s3Path(destPath)),
-			ContentType:          d.getContentType(),
+			ContentType:          d.getContentType(ctx),
 			ACL:                  d.getACL(),
 			ServerSideEncryption: d.getEncryptionMode(),
 			SSEKMSKeyId:          d.getSSEKMSKeyID(),
 			StorageClass:         d.getStorageClass(),
+			Tagging:              d.getTagging(destPath),
+			TaggingDirective:     d.getTaggingDirective(),
+			MetadataDirective:    d.getMetadataDirective(ctx),
 			CopySource:           aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
 		})
 		if err != nil {
@@ -734,14 +873,15 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 		return nil
 	}
 
-	createResp, err := d.S3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+	createResp, err := d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
 		Bucket:               aws.String(d.Bucket),
 		Key:                  aws.String(d.s3Path(destPath)),
-		ContentType:          d.getContentType(),
+		ContentType:          d.getContentType(ctx),
 		ACL:                  d.getACL(),
 		SSEKMSKeyId:          d.getSSEKMSKeyID(),
 		ServerSideEncryption: d.getEncryptionMode(),
 		StorageClass:         d.getStorageClass(),
+		Tagging:              d.getTagging(destPath),
 	})
 	if err != nil {
 		return err
@@ -761,7 +901,7 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 			if lastByte >= fileInfo.Size() {
 				lastByte = fileInfo.Size() - 1
 			}
-			uploadResp, err := d.S3.UploadPartCopy(&s3.UploadPartCopyInput{
+			uploadResp, err := d.S3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
 				Bucket:          aws.String(d.Bucket),
 				CopySource:      aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
 				Key:             aws.String(d.s3Path(destPath)),
@@ -787,7 +927,7 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 		}
 	}
 
-	_, err = d.S3.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+	_, err = d.S3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
 		Bucket:          aws.String(d.Bucket),
 		Key:             aws.String(d.s3Path(destPath)),
 		UploadId:        createResp.UploadId,
@@ -1084,8 +1224,17 @@ func (d *Driver) S3BucketKey(path string) string {
 }
 
 func parseError(path string, err error) error {
-	if s3Err, ok := err.(awserr.Error); ok && s3Err.Code() == "NoSuchKey" {
-		return storagedriver.PathNotFoundError{Path: path}
+	if s3Err, ok := err.(awserr.Error); ok {
+		switch s3Err.Code() {
+		case "NoSuchKey":
+			return storagedriver.PathNotFoundError{Path: path}
+		case "InvalidObjectState":
+			// The object was transitioned to an archive storage class, by a
+			// lifecycle policy for instance. It still exists, so this must
+			// not be mistaken for a missing path: garbage collection would
+			// otherwise treat what the object references as unreferenced.
+			return fmt.Errorf("object at %s is archived and must be restored to be read: %v", path, err)
+		}
 	}
 
 	return err
@@ -1108,8 +1257,21 @@ func (d *driver) getSSEKMSKeyID() *string {
 	return nil
 }
 
-func (d *driver) getContentType() *string {
-	return aws.String("application/octet-stream")
+// getContentType returns the Content-Type set on ctx, or the default.
+func (d *driver) getContentType(ctx context.Context) *string {
+	if contentType, ok := storagedriver.ContentType(ctx); ok {
+		return aws.String(contentType)
+	}
+	return aws.String(storagedriver.DefaultContentType)
+}
+
+// getMetadataDirective returns the directive copying the metadata of the
+// source object, unless a Content-Type is set on ctx to replace it with.
+func (d *driver) getMetadataDirective(ctx context.Context) *string {
+	if _, ok := storagedriver.ContentType(ctx); ok {
+		return aws.String(s3.MetadataDirectiveReplace)
+	}
+	return aws.String(s3.MetadataDirectiveCopy)
 }
 
 func (d *driver) getACL() *string {
@@ -1123,6 +1285,43 @@ func (d *driver) getStorageClass() *string {
 	return aws.String(d.StorageClass)
 }
 
+// getTagging returns the tags of the objects of the category of path, if
+// any are configured. Tags given when creating a multipart upload are applied
+// to the object on completion.
+func (d *driver) getTagging(path string) *string {
+	tagging, ok := d.ObjectTagging[objectCategory(path)]
+	if !ok {
+		return nil
+	}
+	return aws.String(tagging)
+}
+
+// getTaggingDirective returns the tagging directive of copies, which replace
+// the tags of the source by those of the destination when tags are
+// configured, as copies move uploads to their blob.
+func (d *driver) getTaggingDirective() *string {
+	if len(d.ObjectTagging) == 0 {
+		return nil
+	}
+	return aws.String(s3.TaggingDirectiveReplace)
+}
+
+// objectCategory returns the category of the object stored at path, or the
+// empty string if it belongs to none. Repository name components cannot start
+// with an underscore, so they cannot be mistaken for the directories of
+// uploads and manifests.
+func objectCategory(path string) string {
+	switch {
+	case strings.Contains(path, "/_uploads/"):
+		return objectTagsUpload
+	case strings.Contains(path, "/_manifests/"):
+		return objectTagsManifest
+	case strings.HasPrefix(path, "/docker/registry/v2/blobs/"):
+		return objectTagsBlob
+	}
+	return ""
+}
+
 // writer attempts to upload parts to S3 in a buffered fashion where the last
 // part is at least as large as the chunksize, so the multipart upload could be
 // cleanly resumed in the future. This is violated if Close is called after less
@@ -1130,6 +1329,7 @@ func (d *driver) getStorageClass() *string {
 type writer struct {
 	driver      *driver
 	key         string
+	tagging     *string
 	uploadID    string
 	parts       []*s3.Part
 	size        int64
@@ -1140,7 +1340,7 @@ type writer struct {
 	cancelled   bool
 }
 
-func (d *driver) newWriter(key, uploadID string, parts []*s3.Part) storagedriver.FileWriter {
+func (d *driver) newWriter(key string, tagging *string, uploadID string, parts []*s3.Part) storagedriver.FileWriter {
 	var size int64
 	for _, part := range parts {
 		size += *part.Size
@@ -1148,6 +1348,7 @@ func (d *driver) newWriter(key, uploadID string, parts []*s3.Part) storagedriver
 	return &writer{
 		driver:   d,
 		key:      key,
+		tagging:  tagging,
 		uploadID: uploadID,
 		parts:    parts,
 		size:     size,
@@ -1202,10 +1403,11 @@ func (w *writer) Write(p []byte) (int, error) {
 		resp, err := w.driver.S3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
 			Bucket:               aws.String(w.driver.Bucket),
 			Key:                  aws.String(w.key),
-			ContentType:          w.driver.getContentType(),
+			ContentType:          aws.String(storagedriver.DefaultContentType),
 			ACL:                  w.driver.getACL(),
 			ServerSideEncryption: w.driver.getEncryptionMode(),
 			StorageClass:         w.driver.getStorageClass(),
+			Tagging:              w.tagging,
 		})
 		if err != nil {
 			return 0, err
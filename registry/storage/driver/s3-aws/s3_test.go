@@ -6,19 +6,24 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"gopkg.in/check.v1"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/distribution/distribution/v3/context"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
 )
 
@@ -100,6 +105,8 @@ func init() {
 			driverName + "-test",
 			objectACL,
 			sessionToken,
+			nil,
+			base.ConnectionPool{},
 		}
 
 		return New(parameters)
@@ -743,6 +750,269 @@ func TestMoveWithMultipartCopy(t *testing.T) {
 	}
 }
 
+// taggedRequest is a request received by newTaggingServer.
+type taggedRequest struct {
+	method    string
+	key       string
+	copy      bool
+	uploads   bool
+	tagging   string
+	directive string
+}
+
+// newTaggingServer returns a fake S3 endpoint recording the tags of the
+// requests it receives, answering them just enough for the driver to write
+// and move objects.
+func newTaggingServer(t *testing.T) (*httptest.Server, func() []taggedRequest) {
+	var (
+		mu       sync.Mutex
+		requests []taggedRequest
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		query := r.URL.Query()
+		req := taggedRequest{
+			method:    r.Method,
+			key:       strings.TrimPrefix(r.URL.Path, "/bucket/"),
+			copy:      r.Header.Get("X-Amz-Copy-Source") != "",
+			tagging:   r.Header.Get("X-Amz-Tagging"),
+			directive: r.Header.Get("X-Amz-Tagging-Directive"),
+		}
+		_, req.uploads = query["uploads"]
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		switch {
+		case r.Method == http.MethodGet && query.Get("prefix") != "":
+			fmt.Fprintf(w, `<ListBucketResult><IsTruncated>false</IsTruncated><Contents><Key>%s</Key><Size>4</Size><LastModified>2020-01-01T00:00:00.000Z</LastModified></Contents></ListBucketResult>`, query.Get("prefix"))
+		case r.Method == http.MethodPost && req.uploads:
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPost && query.Get("uploadId") != "":
+			fmt.Fprint(w, `<CompleteMultipartUploadResult></CompleteMultipartUploadResult>`)
+		case r.Method == http.MethodPost:
+			fmt.Fprint(w, `<DeleteResult></DeleteResult>`)
+		case req.copy:
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+		default:
+			w.Header().Set("ETag", `"etag"`)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []taggedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		recorded := requests
+		requests = nil
+		return recorded
+	}
+}
+
+func TestObjectTags(t *testing.T) {
+	server, received := newTaggingServer(t)
+	d, err := FromParameters(map[string]interface{}{
+		"accesskey":      "accesskey",
+		"secretkey":      "secretkey",
+		"region":         "us-east-1",
+		"regionendpoint": server.URL,
+		"bucket":         "bucket",
+		"objecttags": map[interface{}]interface{}{
+			"blob":     map[interface{}]interface{}{"class": "blob", "archive": true},
+			"manifest": map[interface{}]interface{}{"class": "manifest"},
+			"upload":   map[interface{}]interface{}{"class": "upload"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	ctx := context.Background()
+	uploadPath := "/docker/registry/v2/repositories/foo/_uploads/id/data"
+	blobPath := "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+	for _, tc := range []struct {
+		path    string
+		tagging string
+	}{
+		{blobPath, "archive=true&class=blob"},
+		{"/docker/registry/v2/repositories/foo/_manifests/tags/latest/current/link", "class=manifest"},
+		{"/docker/registry/v2/repositories/foo/_uploads/id/startedat", "class=upload"},
+		{"/docker/registry/v2/repositories/foo/_layers/sha256/abcd/link", ""},
+	} {
+		if err := d.PutContent(ctx, tc.path, []byte("data")); err != nil {
+			t.Fatalf("unexpected error putting %s: %v", tc.path, err)
+		}
+		requests := received()
+		if len(requests) != 1 || requests[0].tagging != tc.tagging {
+			t.Errorf("unexpected tagging of %s: %+v", tc.path, requests)
+		}
+	}
+
+	// The tags of multipart uploads are given on creation.
+	fw, err := d.Writer(ctx, uploadPath, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := fw.Write([]byte("data")); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := fw.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	requests := received()
+	if len(requests) == 0 || !requests[0].uploads || requests[0].tagging != "class=upload" {
+		t.Errorf("unexpected tagging of upload: %+v", requests)
+	}
+
+	// Moving an upload to its blob replaces its tags.
+	if err := d.Move(ctx, uploadPath, blobPath); err != nil {
+		t.Fatalf("unexpected error moving upload: %v", err)
+	}
+	var copied bool
+	for _, req := range received() {
+		if !req.copy {
+			continue
+		}
+		copied = true
+		if req.key != strings.TrimPrefix(blobPath, "/") || req.tagging != "archive=true&class=blob" || req.directive != s3.TaggingDirectiveReplace {
+			t.Errorf("unexpected tagging of copy: %+v", req)
+		}
+	}
+	if !copied {
+		t.Errorf("upload was not copied")
+	}
+}
+
+func TestObjectTagsInvalid(t *testing.T) {
+	tooMany := map[interface{}]interface{}{}
+	for i := 0; i <= maxObjectTags; i++ {
+		tooMany[fmt.Sprint("tag", i)] = "value"
+	}
+	for _, objectTags := range []interface{}{
+		"blob",
+		map[interface{}]interface{}{"layer": map[interface{}]interface{}{"class": "layer"}},
+		map[interface{}]interface{}{"blob": "class=blob"},
+		map[interface{}]interface{}{"blob": map[interface{}]interface{}{"class": []interface{}{"blob"}}},
+		map[interface{}]interface{}{"blob": map[interface{}]interface{}{"": "blob"}},
+		map[interface{}]interface{}{"blob": map[interface{}]interface{}{"class": strings.Repeat("b", 257)}},
+		map[interface{}]interface{}{"blob": tooMany},
+	} {
+		_, err := FromParameters(map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": "http://localhost",
+			"bucket":         "bucket",
+			"objecttags":     objectTags,
+		})
+		if err == nil {
+			t.Errorf("expected an error for objecttags %v", objectTags)
+		}
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	for _, tc := range []struct {
+		parameters map[string]interface{}
+		expected   base.ConnectionPool
+	}{
+		{
+			map[string]interface{}{},
+			base.ConnectionPool{
+				MaxIdleConns:        base.DefaultMaxIdleConns,
+				MaxIdleConnsPerHost: base.DefaultMaxIdleConnsPerHost,
+				MaxConnsPerHost:     base.DefaultMaxConnsPerHost,
+			},
+		},
+		{
+			map[string]interface{}{"maxidleconns": 500, "maxidleconnsperhost": "250", "maxconnsperhost": 300, "skipverify": true},
+			base.ConnectionPool{MaxIdleConns: 500, MaxIdleConnsPerHost: 250, MaxConnsPerHost: 300},
+		},
+	} {
+		parameters := map[string]interface{}{
+			"region":         "us-east-1",
+			"regionendpoint": "http://localhost",
+			"bucket":         "bucket",
+		}
+		for k, v := range tc.parameters {
+			parameters[k] = v
+		}
+		d, err := FromParameters(parameters)
+		if err != nil {
+			t.Fatalf("unexpected error creating driver with %v: %v", tc.parameters, err)
+		}
+		httpTransport, ok := d.StorageDriver.(*driver).S3.Client.Config.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("unexpected transport: %#v", d.StorageDriver.(*driver).S3.Client.Config.HTTPClient.Transport)
+		}
+		pool := base.ConnectionPool{
+			MaxIdleConns:        httpTransport.MaxIdleConns,
+			MaxIdleConnsPerHost: httpTransport.MaxIdleConnsPerHost,
+			MaxConnsPerHost:     httpTransport.MaxConnsPerHost,
+		}
+		if pool != tc.expected {
+			t.Errorf("unexpected connection pool with %v: %+v", tc.parameters, pool)
+		}
+		if skipVerify := httpTransport.TLSClientConfig != nil && httpTransport.TLSClientConfig.InsecureSkipVerify; skipVerify != (tc.parameters["skipverify"] == true) {
+			t.Errorf("unexpected skipverify with %v: %v", tc.parameters, skipVerify)
+		}
+	}
+
+	for _, name := range []string{"maxidleconns", "maxidleconnsperhost", "maxconnsperhost"} {
+		for _, value := range []interface{}{-1, "-1", "many"} {
+			_, err := FromParameters(map[string]interface{}{
+				"region":         "us-east-1",
+				"regionendpoint": "http://localhost",
+				"bucket":         "bucket",
+				name:             value,
+			})
+			if err == nil {
+				t.Errorf("expected an error for %s %v", name, value)
+			}
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	for _, tc := range []struct {
+		regionEndpoint string
+		expected       storagedriver.Capabilities
+	}{
+		{
+			"",
+			storagedriver.Capabilities{ServerSideCopy: true, URLFor: true, ReadAfterWrite: true},
+		},
+		{
+			"http://localhost",
+			storagedriver.Capabilities{ServerSideCopy: true, URLFor: true},
+		},
+	} {
+		parameters := map[string]interface{}{
+			"region": "us-east-1",
+			"bucket": "bucket",
+		}
+		if tc.regionEndpoint != "" {
+			parameters["regionendpoint"] = tc.regionEndpoint
+		}
+		d, err := FromParameters(parameters)
+		if err != nil {
+			t.Fatalf("unexpected error creating driver with region endpoint %q: %v", tc.regionEndpoint, err)
+		}
+		if caps := storagedriver.CapabilitiesOf(d); caps != tc.expected {
+			t.Errorf("unexpected capabilities with region endpoint %q: %+v", tc.regionEndpoint, caps)
+		}
+	}
+}
+
+func TestParseErrorArchived(t *testing.T) {
+	err := parseError("/blob", awserr.New("InvalidObjectState", "The operation is not valid for the object's storage class", nil))
+	if _, ok := err.(storagedriver.PathNotFoundError); ok || err == nil {
+		t.Fatalf("archived object reported as missing: %v", err)
+	}
+	err = parseError("/blob", awserr.New("NoSuchKey", "The specified key does not exist.", nil))
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Fatalf("missing object not reported as missing: %v", err)
+	}
+}
+
 func compareWalked(t *testing.T, expected, walked []string) {
 	if len(walked) != len(expected) {
 		t.Fatalf("Mismatch number of fileInfo walked %d expected %d; walked %s; expected %s;", len(walked), len(expected), walked, expected)
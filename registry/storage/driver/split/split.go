@@ -0,0 +1,475 @@
+// Package split provides a storagedriver.StorageDriver which stores registry
+// metadata and blob content with two different drivers, so that, for
+// example, manifests and tags may be kept on fast local disk while layers are
+// kept in cheaper object storage. In-progress uploads may be kept with a
+// third driver, used as scratch space.
+//
+// Paths are routed according to the registry storage layout:
+//
+//   - uploads (<root>/v2/repositories/<name>/_uploads/...) are stored with
+//     the uploads driver, which is the blobs driver unless given. Committing
+//     an upload then moves data within the blobs driver, or copies it from
+//     the uploads driver to the blobs driver, verifying its digest.
+//   - content in the blob store (<root>/v2/blobs/...) is written with the
+//     blobs driver when streamed through Writer, as for layers, and with the
+//     metadata driver when written in one piece through PutContent, as for
+//     manifests. Reads look in the metadata driver first.
+//   - everything else, such as manifest revisions, tags and layer links, is
+//     stored with the metadata driver.
+//
+// Listing a directory which may hold entries in several drivers merges the
+// entries of each, so that walks over the blob store, such as those done by
+// garbage collection, see all content.
+package split
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/opencontainers/go-digest"
+)
+
+const driverName = "split"
+
+// blobsRoot is the root of the content addressable blob store, as laid out
+// by the registry storage package.
+const blobsRoot = "/docker/registry/v2/blobs"
+
+func init() {
+	factory.Register(driverName, &splitDriverFactory{})
+}
+
+// splitDriverFactory implements the factory.StorageDriverFactory interface
+type splitDriverFactory struct{}
+
+func (factory *splitDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+type driver struct {
+	metadata storagedriver.StorageDriver
+	blobs    storagedriver.StorageDriver
+	uploads  storagedriver.StorageDriver
+
+	// separateUploads is set when uploads are not stored with the blobs
+	// driver.
+	separateUploads bool
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation which routes
+// metadata and blob content to two different drivers.
+type Driver struct {
+	baseEmbed
+}
+
+var _ storagedriver.StorageDriver = &Driver{}
+
+// FromParameters constructs a new Driver with a given parameters map.
+// Required parameters:
+//   - metadata: the driver storing manifests, tags and links, given as a map
+//     with a single key naming the driver and holding its parameters
+//   - blobs: the driver storing blob content, given in the same way
+//
+// Optional parameters:
+//   - uploads: the driver storing in-progress uploads, given in the same way
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	metadata, err := createDriver(parameters, "metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := createDriver(parameters, "blobs")
+	if err != nil {
+		return nil, err
+	}
+
+	if param, ok := parameters["uploads"]; ok && param != nil {
+		uploads, err := createDriver(parameters, "uploads")
+		if err != nil {
+			return nil, err
+		}
+		return NewWithUploads(metadata, blobs, uploads), nil
+	}
+
+	return New(metadata, blobs), nil
+}
+
+// createDriver constructs the driver described by the named parameter.
+func createDriver(parameters map[string]interface{}, name string) (storagedriver.StorageDriver, error) {
+	param, ok := parameters[name]
+	if !ok || param == nil {
+		return nil, fmt.Errorf("no %s driver provided", name)
+	}
+
+	drivers, err := toStringMap(param)
+	if err != nil || len(drivers) != 1 {
+		return nil, fmt.Errorf("%s must be a map with a single driver, got %v", name, param)
+	}
+
+	for driverType, driverParam := range drivers {
+		if driverType == driverName {
+			return nil, fmt.Errorf("%s driver cannot itself be %s", name, driverName)
+		}
+
+		var driverParameters map[string]interface{}
+		if driverParam != nil {
+			driverParameters, err = toStringMap(driverParam)
+			if err != nil {
+				return nil, fmt.Errorf("parameters of %s driver %s must be a map, got %v", name, driverType, driverParam)
+			}
+		}
+
+		d, err := factory.Create(driverType, driverParameters)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create %s driver %s: %v", name, driverType, err)
+		}
+		return d, nil
+	}
+
+	panic("unreachable")
+}
+
+// toStringMap converts a parameter, as decoded from yaml, to a map keyed by
+// string.
+func toStringMap(param interface{}) (map[string]interface{}, error) {
+	switch m := param.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			converted[key] = v
+		}
+		return converted, nil
+	}
+	return nil, fmt.Errorf("unexpected type %T", param)
+}
+
+// New constructs a new Driver storing metadata with the metadata driver and
+// blob content, including uploads, with the blobs driver.
+func New(metadata, blobs storagedriver.StorageDriver) *Driver {
+	return newDriver(&driver{metadata: metadata, blobs: blobs, uploads: blobs})
+}
+
+// NewWithUploads constructs a new Driver storing metadata with the metadata
+// driver, blob content with the blobs driver and in-progress uploads with the
+// uploads driver.
+func NewWithUploads(metadata, blobs, uploads storagedriver.StorageDriver) *Driver {
+	return newDriver(&driver{metadata: metadata, blobs: blobs, uploads: uploads, separateUploads: true})
+}
+
+func newDriver(d *driver) *Driver {
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: d,
+			},
+		},
+	}
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+// Name returns the human-readable "name" of the driver.
+func (d *driver) Name() string {
+	return driverName
+}
+
+// isUpload reports whether path is in an upload directory.
+func isUpload(path string) bool {
+	return strings.Contains(path+"/", "/_uploads/")
+}
+
+// isBlobStore reports whether path is in the blob store.
+func isBlobStore(path string) bool {
+	return path == blobsRoot || strings.HasPrefix(path, blobsRoot+"/")
+}
+
+// isMetadata reports whether path can only be stored with the metadata
+// driver.
+func isMetadata(path string) bool {
+	return strings.Contains(path+"/", "/_manifests/") || strings.Contains(path+"/", "/_layers/")
+}
+
+// candidates returns the drivers which may hold path, in the order in which
+// they should be looked up. Paths outside of the blob store, such as
+// repository directories, may hold uploads.
+func (d *driver) candidates(path string) []storagedriver.StorageDriver {
+	switch {
+	case isUpload(path):
+		return []storagedriver.StorageDriver{d.uploads}
+	case isMetadata(path):
+		return []storagedriver.StorageDriver{d.metadata}
+	case isBlobStore(path) || !d.separateUploads:
+		return []storagedriver.StorageDriver{d.metadata, d.blobs}
+	default:
+		return []storagedriver.StorageDriver{d.metadata, d.blobs, d.uploads}
+	}
+}
+
+// find returns the driver holding path.
+func (d *driver) find(ctx context.Context, path string) (storagedriver.StorageDriver, error) {
+	candidates := d.candidates(path)
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	for _, candidate := range candidates {
+		if _, err := candidate.Stat(ctx, path); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		return candidate, nil
+	}
+
+	return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	for _, candidate := range d.candidates(path) {
+		content, err := candidate.GetContent(ctx, path)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			continue
+		}
+		return content, err
+	}
+
+	return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// Content put in the blob store, such as manifests, is stored with the
+// metadata driver.
+func (d *driver) PutContent(ctx context.Context, path string, content []byte) error {
+	if isUpload(path) {
+		return d.uploads.PutContent(ctx, path, content)
+	}
+	return d.metadata.PutContent(ctx, path, content)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	for _, candidate := range d.candidates(path) {
+		rc, err := candidate.Reader(ctx, path, offset)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			continue
+		}
+		return rc, err
+	}
+
+	return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+}
+
+// Writer returns a FileWriter which will store the content written to it at
+// the location designated by "path" after the call to Commit. Uploads are
+// stored with the uploads driver, and streamed content in the blob store,
+// such as layers, with the blobs driver.
+func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if isUpload(path) {
+		return d.uploads.Writer(ctx, path, append)
+	}
+	if isBlobStore(path) {
+		return d.blobs.Writer(ctx, path, append)
+	}
+	return d.metadata.Writer(ctx, path, append)
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	for _, candidate := range d.candidates(path) {
+		fi, err := candidate.Stat(ctx, path)
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			continue
+		}
+		return fi, err
+	}
+
+	return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path, merging the entries held by every driver.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	var (
+		children []string
+		found    bool
+		seen     = make(map[string]struct{})
+	)
+
+	for _, candidate := range d.candidates(path) {
+		entries, err := candidate.List(ctx, path)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+
+		found = true
+		for _, entry := range entries {
+			if _, ok := seen[entry]; !ok {
+				seen[entry] = struct{}{}
+				children = append(children, entry)
+			}
+		}
+	}
+
+	if !found {
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	}
+
+	return children, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object. The object is moved within the driver holding it, unless
+// an upload is moved out of a separate uploads driver.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if d.separateUploads && isUpload(sourcePath) && !isUpload(destPath) {
+		return d.transfer(ctx, sourcePath, destPath)
+	}
+
+	holder, err := d.find(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	return holder.Move(ctx, sourcePath, destPath)
+}
+
+// transfer copies an upload from the uploads driver to destPath with the
+// driver Writer stores it with, then deletes it from the uploads driver. When
+// destPath is in the blob store, the content copied is verified against the
+// digest of the blob, and the transfer fails if destPath is not blob data.
+func (d *driver) transfer(ctx context.Context, sourcePath string, destPath string) error {
+	dgst, ok := blobDigest(destPath)
+	if !ok && isBlobStore(destPath) {
+		return fmt.Errorf("unable to verify the content moved to %s, which is not blob data", destPath)
+	}
+
+	rc, err := d.uploads.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := d.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+
+	var (
+		w        io.Writer = fw
+		verifier digest.Verifier
+	)
+	if ok {
+		verifier = dgst.Verifier()
+		w = io.MultiWriter(fw, verifier)
+	}
+
+	if _, err := io.Copy(w, rc); err != nil {
+		fw.Cancel()
+		return err
+	}
+	if verifier != nil && !verifier.Verified() {
+		fw.Cancel()
+		return fmt.Errorf("content of %s does not match digest %s", sourcePath, dgst)
+	}
+	if err := fw.Commit(); err != nil {
+		return err
+	}
+
+	return d.uploads.Delete(ctx, sourcePath)
+}
+
+// blobDigest returns the digest of the content stored at path, if path is
+// blob data: <root>/v2/blobs/<algorithm>/<shards>/<hex>/data, where the shard
+// directories together make a prefix of the hex digest, one directory of two
+// characters with the default layout and two with the sharded one.
+func blobDigest(path string) (digest.Digest, bool) {
+	if !isBlobStore(path) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(path, blobsRoot+"/"), "/")
+	if len(parts) < 4 || parts[len(parts)-1] != "data" {
+		return "", false
+	}
+	hex := parts[len(parts)-2]
+	if shards := strings.Join(parts[1:len(parts)-2], ""); !strings.HasPrefix(hex, shards) {
+		return "", false
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[0]), hex)
+	if dgst.Validate() != nil {
+		return "", false
+	}
+	return dgst, true
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths,
+// in every driver.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	found := false
+	for _, candidate := range d.candidates(path) {
+		if err := candidate.Delete(ctx, path); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return err
+		}
+		found = true
+	}
+
+	if !found {
+		return storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
+	}
+
+	return nil
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at
+// the given path, from the driver holding it.
+func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	holder, err := d.find(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	return holder.URLFor(ctx, path, options)
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
+
+// Capabilities reports the capabilities both drivers have. Move is carried
+// out by the backend and atomic when it is for both drivers and uploads are
+// not copied from a separate uploads driver, and URLFor is supported when
+// either driver supports it.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	metadata, blobs := storagedriver.CapabilitiesOf(d.metadata), storagedriver.CapabilitiesOf(d.blobs)
+	return storagedriver.Capabilities{
+		ServerSideCopy: !d.separateUploads && metadata.ServerSideCopy && blobs.ServerSideCopy,
+		AtomicMove:     !d.separateUploads && metadata.AtomicMove && blobs.AtomicMove,
+		URLFor:         metadata.URLFor || blobs.URLFor,
+		ReadAfterWrite: metadata.ReadAfterWrite && blobs.ReadAfterWrite,
+	}
+}
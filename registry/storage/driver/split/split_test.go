@@ -0,0 +1,292 @@
+package split
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/opencontainers/go-digest"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+func init() {
+	metadataRoot, err := ioutil.TempDir("", "driver-metadata-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(metadataRoot)
+
+	blobsRoot, err := ioutil.TempDir("", "driver-blobs-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(blobsRoot)
+
+	driver, err := FromParameters(map[string]interface{}{
+		"metadata": map[interface{}]interface{}{
+			"filesystem": map[interface{}]interface{}{
+				"rootdirectory": metadataRoot,
+			},
+		},
+		"blobs": map[interface{}]interface{}{
+			"filesystem": map[interface{}]interface{}{
+				"rootdirectory": blobsRoot,
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return driver, nil
+	}, testsuites.NeverSkip)
+}
+
+func TestFromParametersInvalid(t *testing.T) {
+	inmemoryDriver := map[string]interface{}{"inmemory": nil}
+
+	for _, params := range []map[string]interface{}{
+		{},
+		{"metadata": inmemoryDriver},
+		{"blobs": inmemoryDriver},
+		{"metadata": inmemoryDriver, "blobs": "inmemory"},
+		{"metadata": inmemoryDriver, "blobs": map[string]interface{}{"inmemory": nil, "filesystem": nil}},
+		{"metadata": inmemoryDriver, "blobs": map[string]interface{}{"doesnotexist": nil}},
+		{"metadata": inmemoryDriver, "blobs": map[string]interface{}{"split": nil}},
+		{"metadata": inmemoryDriver, "blobs": inmemoryDriver, "uploads": "inmemory"},
+	} {
+		if _, err := FromParameters(params); err == nil {
+			t.Errorf("expected an error for parameters %v", params)
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	ctx := context.Background()
+	metadata := inmemory.New()
+	blobs := inmemory.New()
+	d := New(metadata, blobs)
+
+	const (
+		manifestLink = "/docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256/abc/link"
+		tagLink      = "/docker/registry/v2/repositories/foo/bar/_manifests/tags/latest/current/link"
+		layerLink    = "/docker/registry/v2/repositories/foo/bar/_layers/sha256/def/link"
+		uploadData   = "/docker/registry/v2/repositories/foo/bar/_uploads/some-id/data"
+		manifestData = "/docker/registry/v2/blobs/sha256/ab/abc/data"
+		layerData    = "/docker/registry/v2/blobs/sha256/de/def/data"
+	)
+
+	for _, path := range []string{manifestLink, tagLink, layerLink, manifestData} {
+		if err := d.PutContent(ctx, path, []byte(path)); err != nil {
+			t.Fatalf("unexpected error putting %s: %v", path, err)
+		}
+	}
+
+	w, err := d.Writer(ctx, uploadData, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := w.Write([]byte("layer")); err != nil {
+		t.Fatalf("unexpected error writing upload: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	w.Close()
+
+	if err := d.Move(ctx, uploadData, layerData); err != nil {
+		t.Fatalf("unexpected error moving upload: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		in   storagedriver.StorageDriver
+		out  storagedriver.StorageDriver
+	}{
+		{manifestLink, metadata, blobs},
+		{tagLink, metadata, blobs},
+		{layerLink, metadata, blobs},
+		{manifestData, metadata, blobs},
+		{layerData, blobs, metadata},
+	} {
+		if _, err := tc.in.Stat(ctx, tc.path); err != nil {
+			t.Errorf("expected %s in the %s driver: %v", tc.path, driverRole(tc.in, metadata), err)
+		}
+		if _, err := tc.out.Stat(ctx, tc.path); err == nil {
+			t.Errorf("unexpected %s in the %s driver", tc.path, driverRole(tc.out, metadata))
+		}
+	}
+
+	content, err := d.GetContent(ctx, layerData)
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %v", err)
+	}
+	if string(content) != "layer" {
+		t.Fatalf("unexpected layer content: %q", content)
+	}
+
+	// Both the manifest and the layer are listed in the blob store.
+	children, err := d.List(ctx, "/docker/registry/v2/blobs/sha256")
+	if err != nil {
+		t.Fatalf("unexpected error listing blob store: %v", err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("expected the blob store to list entries from both drivers, got %v", children)
+	}
+
+	if err := d.Delete(ctx, "/docker/registry/v2/blobs"); err != nil {
+		t.Fatalf("unexpected error deleting blob store: %v", err)
+	}
+	for _, path := range []string{manifestData, layerData} {
+		if _, err := d.Stat(ctx, path); err == nil {
+			t.Errorf("expected %s to be deleted", path)
+		}
+	}
+}
+
+func TestSeparateUploads(t *testing.T) {
+	ctx := context.Background()
+	metadata := inmemory.New()
+	blobs := inmemory.New()
+	uploads := inmemory.New()
+	d := NewWithUploads(metadata, blobs, uploads)
+	if storagedriver.IsMoveAtomic(d) {
+		t.Fatalf("moves out of a separate uploads driver reported as atomic")
+	}
+
+	const (
+		repository = "/docker/registry/v2/repositories/foo/bar"
+		uploadDir  = repository + "/_uploads/some-id"
+		uploadData = uploadDir + "/data"
+	)
+	layer := []byte("some layer content")
+	dgst := digest.FromBytes(layer)
+	layerData := fmt.Sprintf("/docker/registry/v2/blobs/sha256/%s/%s/data", dgst.Encoded()[:2], dgst.Encoded())
+
+	for i, chunk := range [][]byte{layer[:4], layer[4:]} {
+		w, err := d.Writer(ctx, uploadData, i > 0)
+		if err != nil {
+			t.Fatalf("unexpected error creating writer: %v", err)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatalf("unexpected error writing upload: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error closing writer: %v", err)
+		}
+	}
+	if err := d.PutContent(ctx, uploadDir+"/startedat", []byte("now")); err != nil {
+		t.Fatalf("unexpected error putting start date: %v", err)
+	}
+	for _, path := range []string{uploadData, uploadDir + "/startedat"} {
+		if _, err := uploads.Stat(ctx, path); err != nil {
+			t.Fatalf("expected %s in the uploads driver: %v", path, err)
+		}
+		if _, err := blobs.Stat(ctx, path); err == nil {
+			t.Fatalf("unexpected %s in the blobs driver", path)
+		}
+	}
+
+	// Uploads are listed along with the metadata of the repository.
+	if err := d.PutContent(ctx, repository+"/_layers/sha256/def/link", []byte("link")); err != nil {
+		t.Fatalf("unexpected error putting layer link: %v", err)
+	}
+	children, err := d.List(ctx, repository)
+	if err != nil {
+		t.Fatalf("unexpected error listing repository: %v", err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("expected the repository to list uploads and layers, got %v", children)
+	}
+
+	// Content not matching the digest it is moved to is left in place.
+	wrongData := "/docker/registry/v2/blobs/sha256/ab/" + digest.FromString("other").Encoded() + "/data"
+	if err := d.Move(ctx, uploadData, wrongData); err == nil {
+		t.Fatalf("expected an error moving content to the wrong digest")
+	}
+	if _, err := d.Stat(ctx, wrongData); err == nil {
+		t.Fatalf("unexpected content at %s", wrongData)
+	}
+
+	// Content moved to a blob store path which is not blob data cannot be
+	// verified, and is left in place.
+	for _, unverifiable := range []string{
+		"/docker/registry/v2/blobs/sha256/" + dgst.Encoded() + "/data",
+		"/docker/registry/v2/blobs/sha256/cd/" + dgst.Encoded() + "/data",
+		"/docker/registry/v2/blobs/sha256/" + dgst.Encoded()[:2] + "/" + dgst.Encoded() + "/other",
+	} {
+		if err := d.Move(ctx, uploadData, unverifiable); err == nil {
+			t.Fatalf("expected an error moving content to %s", unverifiable)
+		}
+		if _, err := d.Stat(ctx, unverifiable); err == nil {
+			t.Fatalf("unexpected content at %s", unverifiable)
+		}
+	}
+
+	if err := d.Move(ctx, uploadData, layerData); err != nil {
+		t.Fatalf("unexpected error moving upload: %v", err)
+	}
+	if _, err := uploads.Stat(ctx, uploadData); err == nil {
+		t.Fatalf("upload left in the uploads driver after the move")
+	}
+	content, err := blobs.GetContent(ctx, layerData)
+	if err != nil {
+		t.Fatalf("expected the layer in the blobs driver: %v", err)
+	}
+	if string(content) != string(layer) {
+		t.Fatalf("unexpected layer content: %q", content)
+	}
+
+	if err := d.Delete(ctx, uploadDir); err != nil {
+		t.Fatalf("unexpected error deleting upload: %v", err)
+	}
+	if _, err := uploads.Stat(ctx, uploadDir); err == nil {
+		t.Fatalf("upload directory left in the uploads driver")
+	}
+}
+
+// TestBlobDigest checks that the digests of blobs are derived from their data
+// paths with both the default and the sharded layout.
+func TestBlobDigest(t *testing.T) {
+	dgst := digest.FromString("blob")
+	hex := dgst.Encoded()
+
+	for _, path := range []string{
+		"/docker/registry/v2/blobs/sha256/" + hex[:2] + "/" + hex + "/data",
+		"/docker/registry/v2/blobs/sha256/" + hex[:2] + "/" + hex[2:4] + "/" + hex + "/data",
+	} {
+		if got, ok := blobDigest(path); !ok || got != dgst {
+			t.Errorf("unexpected digest of %s: %s, %v", path, got, ok)
+		}
+	}
+
+	for _, path := range []string{
+		"/docker/registry/v2/repositories/foo/_layers/sha256/" + hex + "/link",
+		"/docker/registry/v2/blobs/sha256/" + hex + "/data",
+		"/docker/registry/v2/blobs/sha256/" + hex[2:4] + "/" + hex + "/data",
+		"/docker/registry/v2/blobs/sha256/" + hex[:2] + "/" + hex[4:6] + "/" + hex + "/data",
+		"/docker/registry/v2/blobs/sha256/" + hex[:2] + "/" + hex,
+		"/docker/registry/v2/blobs/sha256/" + hex[:2] + "/" + hex[:6] + "/data",
+	} {
+		if got, ok := blobDigest(path); ok {
+			t.Errorf("unexpected digest of %s: %s", path, got)
+		}
+	}
+}
+
+func driverRole(d, metadata storagedriver.StorageDriver) string {
+	if d == metadata {
+		return "metadata"
+	}
+	return "blobs"
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -92,6 +93,108 @@ type StorageDriver interface {
 	Walk(ctx context.Context, path string, f WalkFn) error
 }
 
+// Capabilities describes the optional features of a StorageDriver, so that its
+// users can branch on them rather than on the type of the driver.
+type Capabilities struct {
+	// ServerSideCopy is set when Move is carried out by the storage backend,
+	// without the content moved being transferred through the registry.
+	ServerSideCopy bool
+
+	// AtomicMove is set when Move is atomic. An atomic Move is never
+	// observed as partially applied: the object is visible at either the
+	// source or the destination path, but not both, even after a crash.
+	AtomicMove bool
+
+	// URLFor is set when URLFor may return URLs the content can be fetched
+	// from directly, such as presigned URLs. URLFor may still return
+	// ErrUnsupportedMethod for some requests, such as those of a method the
+	// URLs cannot be used with.
+	URLFor bool
+
+	// ReadAfterWrite is set when the storage backend is strongly consistent:
+	// content written, moved or deleted is immediately observed so by all
+	// subsequent operations, including listings.
+	ReadAfterWrite bool
+}
+
+// CapabilityReporter is an optional interface which a StorageDriver may
+// implement to report its capabilities. Drivers wrapping another report the
+// capabilities of the driver they wrap, as far as they preserve them.
+type CapabilityReporter interface {
+	// Capabilities returns the capabilities of the driver.
+	Capabilities() Capabilities
+}
+
+// CapabilitiesOf returns the capabilities of the given StorageDriver. Drivers
+// which implement neither CapabilityReporter nor AtomicMover are assumed to
+// have none.
+func CapabilitiesOf(driver StorageDriver) Capabilities {
+	switch d := driver.(type) {
+	case CapabilityReporter:
+		return d.Capabilities()
+	case AtomicMover:
+		return Capabilities{AtomicMove: d.AtomicMove()}
+	}
+	return Capabilities{}
+}
+
+// AtomicMover is an optional interface which a StorageDriver may implement to
+// report whether its Move operation is atomic. It is superseded by
+// CapabilityReporter, and only consulted for drivers which do not implement
+// it.
+type AtomicMover interface {
+	// AtomicMove returns true if Move is atomic.
+	AtomicMove() bool
+}
+
+// IsMoveAtomic reports whether Move is atomic for the given StorageDriver.
+func IsMoveAtomic(driver StorageDriver) bool {
+	return CapabilitiesOf(driver).AtomicMove
+}
+
+// FileOpener is an optional interface which a StorageDriver storing content
+// in local files may implement, so that the content is served from the file
+// itself, with zero-copy system calls such as sendfile where the connection
+// supports them. Drivers wrapping another forward it, as far as the paths
+// they are given map to files of the driver they wrap.
+type FileOpener interface {
+	// OpenFile opens the file holding the content stored at path, for
+	// reading. It returns ErrUnsupportedMethod if the content may not be
+	// read from the file directly.
+	OpenFile(ctx context.Context, path string) (*os.File, error)
+}
+
+// OpenFile opens the file holding the content stored at path by the given
+// StorageDriver, returning ErrUnsupportedMethod if it does not implement
+// FileOpener.
+func OpenFile(ctx context.Context, driver StorageDriver, path string) (*os.File, error) {
+	opener, ok := driver.(FileOpener)
+	if !ok {
+		return nil, ErrUnsupportedMethod{DriverName: driver.Name()}
+	}
+	return opener.OpenFile(ctx, path)
+}
+
+// DefaultContentType is the Content-Type drivers which store one along with
+// objects store them with, unless another is set with WithContentType.
+const DefaultContentType = "application/octet-stream"
+
+type contentTypeKey struct{}
+
+// WithContentType returns a context with which drivers which store a
+// Content-Type along with objects store contentType for the objects written
+// by PutContent and Move, so that the URLs returned by URLFor serve it.
+func WithContentType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, contentType)
+}
+
+// ContentType returns the Content-Type set on ctx with WithContentType, and
+// whether one was.
+func ContentType(ctx context.Context) (string, bool) {
+	contentType, ok := ctx.Value(contentTypeKey{}).(string)
+	return contentType, ok && contentType != ""
+}
+
 // FileWriter provides an abstraction for an opened writable file-like object in
 // the storage backend. The FileWriter must flush all content written to it on
 // the call to Close, but is only required to make its content readable on a
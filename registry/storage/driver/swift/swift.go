@@ -602,6 +602,17 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 	return nil
 }
 
+// Capabilities reports that Move is not atomic, since it is implemented as a
+// server-side copy followed by a delete of the source, and that reads after
+// writes are eventually consistent. URLFor is supported when a secret key is
+// configured to sign temporary URLs with.
+func (d *driver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.Capabilities{
+		ServerSideCopy: true,
+		URLFor:         d.SecretKey != "",
+	}
+}
+
 // URLFor returns a URL which may be used to retrieve the content stored at the given path.
 func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
 	if d.SecretKey == "" {
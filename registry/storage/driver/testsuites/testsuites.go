@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -564,6 +565,74 @@ func (suite *DriverSuite) TestMoveOverwrite(c *check.C) {
 	c.Assert(strings.Contains(err.Error(), suite.Name()), check.Equals, true)
 }
 
+// TestMoveAtomic checks that after a successful Move the source is gone and
+// the destination holds exactly the original bytes. For drivers reporting an
+// atomic Move, it also checks that concurrent readers of the destination
+// never observe partial content.
+func (suite *DriverSuite) TestMoveAtomic(c *check.C) {
+	contents := randomContents(4 * 1024 * 1024)
+	sourcePath := randomPath(32)
+	destPath := randomPath(32)
+
+	defer suite.deletePath(c, firstPart(sourcePath))
+	defer suite.deletePath(c, firstPart(destPath))
+
+	err := suite.StorageDriver.PutContent(suite.ctx, sourcePath, contents)
+	c.Assert(err, check.IsNil)
+
+	atomic := storagedriver.IsMoveAtomic(suite.StorageDriver)
+
+	done := make(chan struct{})
+	observed := make(chan error, 1)
+	if atomic {
+		go func() {
+			defer close(observed)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				received, err := suite.StorageDriver.GetContent(suite.ctx, destPath)
+				if _, ok := err.(storagedriver.PathNotFoundError); ok {
+					continue
+				} else if err != nil {
+					observed <- err
+					return
+				}
+				if !bytes.Equal(received, contents) {
+					observed <- fmt.Errorf("observed partial destination content: %d of %d bytes", len(received), len(contents))
+					return
+				}
+			}
+		}()
+	} else {
+		close(observed)
+	}
+
+	err = suite.StorageDriver.Move(suite.ctx, sourcePath, destPath)
+	close(done)
+	c.Assert(err, check.IsNil)
+	c.Assert(<-observed, check.IsNil)
+
+	fi, err := suite.StorageDriver.Stat(suite.ctx, destPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(fi.Size(), check.Equals, int64(len(contents)))
+
+	received, err := suite.StorageDriver.GetContent(suite.ctx, destPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(bytes.Equal(received, contents), check.Equals, true)
+
+	_, err = suite.StorageDriver.Stat(suite.ctx, sourcePath)
+	c.Assert(err, check.NotNil)
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+
+	_, err = suite.StorageDriver.GetContent(suite.ctx, sourcePath)
+	c.Assert(err, check.NotNil)
+	c.Assert(err, check.FitsTypeOf, storagedriver.PathNotFoundError{})
+}
+
 // TestMoveNonexistent checks that moving a nonexistent key fails and does not
 // delete the data at the destination path.
 func (suite *DriverSuite) TestMoveNonexistent(c *check.C) {
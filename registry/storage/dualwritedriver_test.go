@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver/dualwrite"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// TestDualWriteDriverPush checks that, with the dualwrite driver, a push
+// stores every manifest, tag, link and layer with both drivers.
+func TestDualWriteDriverPush(t *testing.T) {
+	ctx := context.Background()
+	primaryDriver := inmemory.New()
+	secondaryDriver := inmemory.New()
+
+	registry := createRegistry(t, dualwrite.New(primaryDriver, secondaryDriver, true))
+	repo := makeRepository(t, registry, "dualwrite/image")
+	image := uploadRandomSchema2Image(t, repo)
+
+	desc := distribution.Descriptor{Digest: image.manifestDigest}
+	if err := repo.Tags(ctx).Tag(ctx, "latest", desc); err != nil {
+		t.Fatalf("unexpected error tagging manifest: %v", err)
+	}
+
+	revisionLink, _ := pathFor(manifestRevisionLinkPathSpec{name: "dualwrite/image", revision: image.manifestDigest})
+	tagLink, _ := pathFor(manifestTagCurrentPathSpec{name: "dualwrite/image", tag: "latest"})
+	manifestData, _ := pathFor(blobDataPathSpec{digest: image.manifestDigest})
+	paths := []string{revisionLink, tagLink, manifestData}
+	for dgst := range image.layers {
+		layerLink, _ := pathFor(layerLinkPathSpec{name: "dualwrite/image", digest: dgst})
+		layerData, _ := pathFor(blobDataPathSpec{digest: dgst})
+		paths = append(paths, layerLink, layerData)
+	}
+
+	for _, p := range paths {
+		primary, err := primaryDriver.GetContent(ctx, p)
+		if err != nil {
+			t.Fatalf("expected %s to be stored with the primary driver: %v", p, err)
+		}
+		secondary, err := secondaryDriver.GetContent(ctx, p)
+		if err != nil {
+			t.Fatalf("expected %s to be stored with the secondary driver: %v", p, err)
+		}
+		if string(primary) != string(secondary) {
+			t.Fatalf("drivers hold different content at %s", p)
+		}
+	}
+}
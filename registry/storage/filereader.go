@@ -55,6 +55,12 @@ func (fr *fileReader) Read(p []byte) (n int, err error) {
 		return 0, fr.err
 	}
 
+	// Stop reading from the driver as soon as the request is abandoned, such
+	// as when a client disconnects in the middle of a pull.
+	if err := fr.ctx.Err(); err != nil {
+		return 0, fr.closeWithErr(err)
+	}
+
 	rd, err := fr.reader()
 	if err != nil {
 		return 0, err
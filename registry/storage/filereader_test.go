@@ -2,11 +2,15 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
 	mrand "math/rand"
+	"sync/atomic"
 	"testing"
+	"time"
 
-	"github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/opencontainers/go-digest"
 )
@@ -173,6 +177,84 @@ func TestFileReaderNonExistentFile(t *testing.T) {
 	}
 }
 
+// countingDriver wraps a storage driver, counting the bytes read through
+// readers it hands out.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	read int64
+}
+
+func (d *countingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	rc, err := d.StorageDriver.Reader(ctx, path, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReadCloser{ReadCloser: rc, read: &d.read}, nil
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	read *int64
+}
+
+func (rc *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(p)
+	atomic.AddInt64(rc.read, int64(n))
+	return n, err
+}
+
+// TestFileReaderContextCancel ensures that cancelling the context of a
+// reader, such as when a client disconnects mid-pull, stops further reads
+// from the storage driver.
+func TestFileReaderContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	content := make([]byte, 8*fileReaderBufferSize)
+	if _, err := mrand.Read(content); err != nil {
+		t.Fatalf("unexpected error building random data: %v", err)
+	}
+
+	driver := &countingDriver{StorageDriver: inmemory.New()}
+	path := "/large"
+
+	if err := driver.PutContent(ctx, path, content); err != nil {
+		t.Fatalf("error putting content: %v", err)
+	}
+
+	fr, err := newFileReader(ctx, driver, path, int64(len(content)))
+	if err != nil {
+		t.Fatalf("error allocating file reader: %v", err)
+	}
+	defer fr.Close()
+
+	p := make([]byte, 1024)
+	if _, err := fr.Read(p); err != nil {
+		t.Fatalf("unexpected error on first read: %v", err)
+	}
+
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, fr)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read loop did not terminate after context cancellation")
+	}
+
+	if read := atomic.LoadInt64(&driver.read); read > fileReaderBufferSize {
+		t.Fatalf("read %d bytes from driver after cancellation, expected at most %d", read, fileReaderBufferSize)
+	}
+}
+
 // TestLayerReadErrors covers the various error return type for different
 // conditions that can arise when reading a layer.
 func TestFileReaderErrors(t *testing.T) {
@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// FsckOpts contains options for Fsck.
+type FsckOpts struct {
+	// VerifyDigests reads every blob of the blob store and checks that its
+	// content matches the digest it is stored under. This reads all the
+	// data of the registry.
+	VerifyDigests bool
+
+	// RepairTags deletes the tags found dangling.
+	RepairTags bool
+}
+
+// MissingBlob describes a blob referenced by a manifest which is not in the
+// blob store. A manifest whose own content is missing is reported with
+// Digest equal to Manifest.
+type MissingBlob struct {
+	Repository string        `json:"repository"`
+	Manifest   digest.Digest `json:"manifest"`
+	Digest     digest.Digest `json:"digest"`
+}
+
+// UnreadableManifest describes a manifest whose content is present but
+// cannot be parsed.
+type UnreadableManifest struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	Error      string        `json:"error"`
+}
+
+// DanglingTag describes a tag which does not point at a manifest of its
+// repository, either because its link is missing or unreadable or because
+// the manifest it links to is not there.
+type DanglingTag struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+
+	// Digest is the manifest the tag links to, empty if the link is
+	// missing or unreadable.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Reason tells which of the above applies.
+	Reason string `json:"reason"`
+
+	// Repaired reports whether the tag was deleted.
+	Repaired bool `json:"repaired"`
+}
+
+// CorruptBlob describes a blob whose content does not match the digest it
+// is stored under.
+type CorruptBlob struct {
+	Digest digest.Digest `json:"digest"`
+
+	// Actual is the digest of the content stored.
+	Actual digest.Digest `json:"actual"`
+}
+
+// FsckReport is the result of a consistency check of the storage.
+type FsckReport struct {
+	// Repositories, Manifests and Tags are the numbers of each checked.
+	Repositories int `json:"repositories"`
+	Manifests    int `json:"manifests"`
+	Tags         int `json:"tags"`
+
+	// Blobs is the number of blobs whose digest was verified, zero unless
+	// VerifyDigests is set.
+	Blobs int `json:"blobs"`
+
+	MissingBlobs        []MissingBlob        `json:"missingBlobs"`
+	UnreadableManifests []UnreadableManifest `json:"unreadableManifests"`
+	DanglingTags        []DanglingTag        `json:"danglingTags"`
+	CorruptBlobs        []CorruptBlob        `json:"corruptBlobs"`
+}
+
+// Consistent reports whether no inconsistency was found.
+func (r *FsckReport) Consistent() bool {
+	return len(r.MissingBlobs) == 0 && len(r.UnreadableManifests) == 0 &&
+		len(r.DanglingTags) == 0 && len(r.CorruptBlobs) == 0
+}
+
+// Fsck walks the repositories of registry and checks that the blobs
+// referenced by their manifests are in the blob store and that their tags
+// point at manifests of the repository. References to foreign layers, which
+// are not stored by the registry, are not checked. Blobs and manifests left
+// unreferenced are not inconsistencies, garbage collection removes them.
+func Fsck(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts FsckOpts) (*FsckReport, error) {
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	report := &FsckReport{
+		MissingBlobs:        []MissingBlob{},
+		UnreadableManifests: []UnreadableManifest{},
+		DanglingTags:        []DanglingTag{},
+		CorruptBlobs:        []CorruptBlob{},
+	}
+	blobStatter := registry.BlobStatter()
+	// present caches the outcome of blob lookups, as layers are commonly
+	// shared between manifests.
+	present := make(map[digest.Digest]bool)
+
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		report.Repositories++
+
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+
+		manifestService, err := repository.Manifests(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to construct manifest service: %v", err)
+		}
+
+		// The revisions are walked rather than enumerated by the manifest
+		// service, which skips those whose content is missing.
+		revisionsPath, err := pathFor(manifestRevisionsPathSpec{name: repoName})
+		if err != nil {
+			return err
+		}
+
+		err = storageDriver.Walk(ctx, revisionsPath, func(fileInfo driver.FileInfo) error {
+			if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "link" {
+				return nil
+			}
+			dir := path.Dir(fileInfo.Path())
+			dgst := digest.NewDigestFromHex(path.Base(path.Dir(dir)), path.Base(dir))
+			if err := dgst.Validate(); err != nil {
+				dcontext.GetLogger(ctx).Warnf("skipping unrecognized manifest revision path: %s", fileInfo.Path())
+				return nil
+			}
+			report.Manifests++
+
+			exists, err := manifestService.Exists(ctx, dgst)
+			if err != nil {
+				return fmt.Errorf("failed to check manifest %s of %s: %v", dgst, repoName, err)
+			}
+			if !exists {
+				report.MissingBlobs = append(report.MissingBlobs, MissingBlob{Repository: repoName, Manifest: dgst, Digest: dgst})
+				return nil
+			}
+
+			manifest, err := manifestService.Get(ctx, dgst)
+			if err != nil {
+				report.UnreadableManifests = append(report.UnreadableManifests, UnreadableManifest{Repository: repoName, Digest: dgst, Error: err.Error()})
+				return nil
+			}
+
+			for _, descriptor := range manifest.References() {
+				if len(descriptor.URLs) > 0 {
+					continue
+				}
+				found, ok := present[descriptor.Digest]
+				if !ok {
+					_, err := blobStatter.Stat(ctx, descriptor.Digest)
+					switch err {
+					case nil:
+						found = true
+					case distribution.ErrBlobUnknown:
+					default:
+						return fmt.Errorf("failed to check blob %s: %v", descriptor.Digest, err)
+					}
+					present[descriptor.Digest] = found
+				}
+				if !found {
+					report.MissingBlobs = append(report.MissingBlobs, MissingBlob{Repository: repoName, Manifest: dgst, Digest: descriptor.Digest})
+				}
+			}
+			return nil
+		})
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		return fsckTags(ctx, storageDriver, repository, manifestService, opts, report)
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check repositories: %v", err)
+	}
+
+	if opts.VerifyDigests {
+		err := registry.Blobs().Enumerate(ctx, func(dgst digest.Digest) error {
+			actual, err := blobContentDigest(ctx, storageDriver, dgst)
+			if err != nil {
+				return err
+			}
+			report.Blobs++
+			if actual != dgst {
+				report.CorruptBlobs = append(report.CorruptBlobs, CorruptBlob{Digest: dgst, Actual: actual})
+			}
+			return nil
+		})
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify blobs: %v", err)
+		}
+	}
+
+	sort.Slice(report.CorruptBlobs, func(i, j int) bool {
+		return report.CorruptBlobs[i].Digest < report.CorruptBlobs[j].Digest
+	})
+
+	return report, nil
+}
+
+// fsckTags checks that the current link of every tag of repository points
+// at one of its manifests, deleting the tags which do not if asked to.
+func fsckTags(ctx context.Context, storageDriver driver.StorageDriver, repository distribution.Repository, manifestService distribution.ManifestService, opts FsckOpts, report *FsckReport) error {
+	repoName := repository.Named().Name()
+	tagService := repository.Tags(ctx)
+
+	tags, err := tagService.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to retrieve tags of %s: %v", repoName, err)
+	}
+
+	for _, tag := range tags {
+		report.Tags++
+
+		currentPath, err := pathFor(manifestTagCurrentPathSpec{name: repoName, tag: tag})
+		if err != nil {
+			return err
+		}
+
+		dangling := DanglingTag{Repository: repoName, Tag: tag}
+		content, err := storageDriver.GetContent(ctx, currentPath)
+		switch err.(type) {
+		case nil:
+			dgst, err := digest.Parse(string(content))
+			if err != nil {
+				dangling.Reason = "unreadable link"
+				break
+			}
+			exists, err := manifestService.Exists(ctx, dgst)
+			if err != nil {
+				return fmt.Errorf("failed to check manifest %s of tag %s of %s: %v", dgst, tag, repoName, err)
+			}
+			if exists {
+				continue
+			}
+			dangling.Digest = dgst
+			dangling.Reason = "missing manifest"
+		case driver.PathNotFoundError:
+			dangling.Reason = "missing link"
+		default:
+			return fmt.Errorf("failed to read tag %s of %s: %v", tag, repoName, err)
+		}
+
+		if opts.RepairTags {
+			dcontext.GetLogger(ctx).Infof("deleting dangling tag %s:%s", repoName, tag)
+			if err := tagService.Untag(ctx, tag); err != nil {
+				return fmt.Errorf("failed to delete tag %s of %s: %v", tag, repoName, err)
+			}
+			dangling.Repaired = true
+		}
+		report.DanglingTags = append(report.DanglingTags, dangling)
+	}
+
+	return nil
+}
+
+// blobContentDigest returns the digest of the content stored for dgst,
+// computed with the algorithm of dgst.
+func blobContentDigest(ctx context.Context, storageDriver driver.StorageDriver, dgst digest.Digest) (digest.Digest, error) {
+	if !dgst.Algorithm().Available() {
+		return "", fmt.Errorf("unsupported digest algorithm of blob %s", dgst)
+	}
+
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := storageDriver.Reader(ctx, blobPath, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open blob %s: %v", dgst, err)
+	}
+	defer reader.Close()
+
+	digester := dgst.Algorithm().Digester()
+	if _, err := io.Copy(digester.Hash(), reader); err != nil {
+		return "", fmt.Errorf("failed to read blob %s: %v", dgst, err)
+	}
+	return digester.Digest(), nil
+}
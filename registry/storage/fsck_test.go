@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "fsck/app")
+	tags := repo.Tags(ctx)
+
+	healthy := uploadRandomSchema2Image(t, repo)
+	missingLayer := uploadRandomSchema2Image(t, repo)
+	corruptLayer := uploadRandomSchema2Image(t, repo)
+	missingManifest := uploadRandomSchema2Image(t, repo)
+	for tag, im := range map[string]image{
+		"healthy":       healthy,
+		"missing-layer": missingLayer,
+		"corrupt-layer": corruptLayer,
+	} {
+		if err := tags.Tag(ctx, tag, distribution.Descriptor{Digest: im.manifestDigest}); err != nil {
+			t.Fatalf("failed to tag %s: %v", tag, err)
+		}
+	}
+
+	put := func(spec pathSpec, content string) {
+		p, err := pathFor(spec)
+		if err != nil {
+			t.Fatalf("unexpected error building path: %v", err)
+		}
+		if err := d.PutContent(ctx, p, []byte(content)); err != nil {
+			t.Fatalf("failed to write %s: %v", p, err)
+		}
+	}
+	remove := func(spec pathSpec) {
+		p, err := pathFor(spec)
+		if err != nil {
+			t.Fatalf("unexpected error building path: %v", err)
+		}
+		if err := d.Delete(ctx, p); err != nil {
+			t.Fatalf("failed to delete %s: %v", p, err)
+		}
+	}
+
+	// Remove a layer of one image and the content of an untagged manifest.
+	missingLayerDigest := missingLayer.manifest.References()[1].Digest
+	remove(blobDataPathSpec{digest: missingLayerDigest})
+	remove(blobDataPathSpec{digest: missingManifest.manifestDigest})
+
+	// Overwrite a layer with content of another digest.
+	corruptLayerDigest := corruptLayer.manifest.References()[1].Digest
+	put(blobDataPathSpec{digest: corruptLayerDigest}, "corrupted")
+
+	// Point a tag at a manifest which was never pushed, write garbage in
+	// the link of another and leave a third without a link.
+	unknown := digest.FromString("unknown manifest")
+	if err := tags.Tag(ctx, "unknown", distribution.Descriptor{Digest: unknown}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	if err := tags.Tag(ctx, "garbage", distribution.Descriptor{Digest: healthy.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	put(manifestTagCurrentPathSpec{name: "fsck/app", tag: "garbage"}, "not a digest")
+	if err := tags.Tag(ctx, "unlinked", distribution.Descriptor{Digest: healthy.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	remove(manifestTagCurrentPathSpec{name: "fsck/app", tag: "unlinked"})
+
+	report, err := Fsck(ctx, d, registry, FsckOpts{})
+	if err != nil {
+		t.Fatalf("unexpected error checking storage: %v", err)
+	}
+	if report.Consistent() {
+		t.Fatalf("expected inconsistencies to be found")
+	}
+	if report.Repositories != 1 || report.Manifests != 4 || report.Tags != 6 || report.Blobs != 0 {
+		t.Fatalf("unexpected counts: %+v", report)
+	}
+
+	sort.Slice(report.MissingBlobs, func(i, j int) bool {
+		return report.MissingBlobs[i].Manifest < report.MissingBlobs[j].Manifest
+	})
+	expectedMissing := []MissingBlob{
+		{Repository: "fsck/app", Manifest: missingLayer.manifestDigest, Digest: missingLayerDigest},
+		{Repository: "fsck/app", Manifest: missingManifest.manifestDigest, Digest: missingManifest.manifestDigest},
+	}
+	sort.Slice(expectedMissing, func(i, j int) bool {
+		return expectedMissing[i].Manifest < expectedMissing[j].Manifest
+	})
+	if !reflect.DeepEqual(report.MissingBlobs, expectedMissing) {
+		t.Fatalf("unexpected missing blobs: %+v != %+v", report.MissingBlobs, expectedMissing)
+	}
+
+	expectedDangling := map[string]DanglingTag{
+		"garbage":  {Repository: "fsck/app", Tag: "garbage", Reason: "unreadable link"},
+		"unknown":  {Repository: "fsck/app", Tag: "unknown", Digest: unknown, Reason: "missing manifest"},
+		"unlinked": {Repository: "fsck/app", Tag: "unlinked", Reason: "missing link"},
+	}
+	if len(report.DanglingTags) != len(expectedDangling) {
+		t.Fatalf("unexpected dangling tags: %+v", report.DanglingTags)
+	}
+	for _, dangling := range report.DanglingTags {
+		if dangling != expectedDangling[dangling.Tag] {
+			t.Fatalf("unexpected dangling tag: %+v != %+v", dangling, expectedDangling[dangling.Tag])
+		}
+	}
+
+	if len(report.CorruptBlobs) != 0 {
+		t.Fatalf("blob content verified without VerifyDigests: %+v", report.CorruptBlobs)
+	}
+
+	// The report is meant to be consumed as JSON.
+	if _, err := json.Marshal(report); err != nil {
+		t.Fatalf("unexpected error marshaling report: %v", err)
+	}
+
+	report, err = Fsck(ctx, d, registry, FsckOpts{VerifyDigests: true, RepairTags: true})
+	if err != nil {
+		t.Fatalf("unexpected error checking storage: %v", err)
+	}
+	expectedCorrupt := []CorruptBlob{{Digest: corruptLayerDigest, Actual: digest.FromString("corrupted")}}
+	if !reflect.DeepEqual(report.CorruptBlobs, expectedCorrupt) {
+		t.Fatalf("unexpected corrupt blobs: %+v != %+v", report.CorruptBlobs, expectedCorrupt)
+	}
+	if report.Blobs != len(allBlobs(t, registry)) {
+		t.Fatalf("expected every blob to be verified, got %d", report.Blobs)
+	}
+	for _, dangling := range report.DanglingTags {
+		if !dangling.Repaired {
+			t.Fatalf("dangling tag not repaired: %+v", dangling)
+		}
+	}
+
+	remaining, err := tags.All(ctx)
+	if err != nil {
+		t.Fatalf("failed to list tags: %v", err)
+	}
+	sort.Strings(remaining)
+	if expected := []string{"corrupt-layer", "healthy", "missing-layer"}; !reflect.DeepEqual(remaining, expected) {
+		t.Fatalf("unexpected tags after repair: %v != %v", remaining, expected)
+	}
+
+	report, err = Fsck(ctx, d, registry, FsckOpts{})
+	if err != nil {
+		t.Fatalf("unexpected error checking storage: %v", err)
+	}
+	if len(report.DanglingTags) != 0 {
+		t.Fatalf("unexpected dangling tags after repair: %+v", report.DanglingTags)
+	}
+}
+
+func TestFsckEmptyStorage(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	report, err := Fsck(ctx, d, createRegistry(t, d), FsckOpts{VerifyDigests: true})
+	if err != nil {
+		t.Fatalf("unexpected error checking storage: %v", err)
+	}
+	if !report.Consistent() || report.Repositories != 0 {
+		t.Fatalf("unexpected report for empty storage: %+v", report)
+	}
+}
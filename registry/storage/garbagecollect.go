@@ -3,13 +3,32 @@ package storage
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	prometheus "github.com/distribution/distribution/v3/metrics"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
 	"github.com/opencontainers/go-digest"
 )
 
+var (
+	// gcMarkedCount, gcSweptCount and gcReclaimedBytes accumulate over the
+	// garbage collection runs of the process.
+	gcMarkedCount    metrics.Counter = prometheus.GCNamespace.NewCounter("blobs_marked", "The number of blobs marked as in use by garbage collection runs")
+	gcSweptCount     metrics.Counter = prometheus.GCNamespace.NewCounter("blobs_swept", "The number of blobs deleted by garbage collection runs")
+	gcReclaimedBytes metrics.Counter = prometheus.GCNamespace.NewCounter("reclaimed_bytes", "The number of bytes of the blobs deleted by garbage collection runs")
+
+	gcLastRunDuration metrics.Gauge = prometheus.GCNamespace.NewGauge("last_run_duration", "The duration of the last garbage collection run, successful or not", metrics.Seconds)
+	gcLastSuccess     metrics.Gauge = prometheus.GCNamespace.NewGauge("last_success_timestamp", "The unix time the last successful garbage collection run ended", metrics.Seconds)
+)
+
+func init() {
+	metrics.Register(prometheus.GCNamespace)
+}
+
 func emit(format string, a ...interface{}) {
 	fmt.Printf(format+"\n", a...)
 }
@@ -18,6 +37,22 @@ func emit(format string, a ...interface{}) {
 type GCOpts struct {
 	DryRun         bool
 	RemoveUntagged bool
+
+	// GracePeriod protects content younger than it, by the modification
+	// time of its storage, from deletion, so that content pushed but not
+	// yet referenced, such as the manifests of a manifest list not pushed
+	// yet, is not collected. A zero GracePeriod protects nothing.
+	GracePeriod time.Duration
+
+	// MaxManifestListDepth is the number of levels manifest lists may be
+	// nested within one another, DefaultMaxManifestListDepth if zero.
+	// Collection fails on a manifest list nested deeper.
+	MaxManifestListDepth int
+
+	// LockTTL is how long the lock keeping runs from overlapping is held
+	// past its last refresh, DefaultGCLockTTL if zero. Runs other than dry
+	// runs fail with ErrGCInProgress while another holds the lock.
+	LockTTL time.Duration
 }
 
 // ManifestDel contains manifest structure which will be deleted
@@ -27,13 +62,59 @@ type ManifestDel struct {
 	Tags   []string
 }
 
-// MarkAndSweep performs a mark and sweep of registry data
-func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) error {
+// gcStats counts what a garbage collection run did.
+type gcStats struct {
+	marked, swept, reclaimed int64
+}
+
+// MarkAndSweep performs a mark and sweep of registry data. Runs other than
+// dry runs hold a lock stored with the storage driver for their duration, so
+// that they do not overlap, and are recorded in the garbage collection
+// metrics.
+func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) (err error) {
+	if opts.DryRun {
+		return markAndSweep(ctx, storageDriver, registry, opts, &gcStats{})
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lock, err := acquireGCLock(ctx, storageDriver, opts.LockTTL, cancel)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if releaseErr := lock.release(ctx); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}()
+
+	start := time.Now()
+	var stats gcStats
+	err = markAndSweep(runCtx, storageDriver, registry, opts, &stats)
+
+	gcMarkedCount.Inc(float64(stats.marked))
+	gcSweptCount.Inc(float64(stats.swept))
+	gcReclaimedBytes.Inc(float64(stats.reclaimed))
+	end := time.Now()
+	gcLastRunDuration.Set(end.Sub(start).Seconds())
+	if err == nil {
+		gcLastSuccess.Set(float64(end.Unix()))
+	}
+	return err
+}
+
+func markAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts, stats *gcStats) error {
 	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
 	if !ok {
 		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
 	}
 
+	// Content modified after cutoff is within the grace period.
+	var cutoff time.Time
+	if opts.GracePeriod > 0 {
+		cutoff = time.Now().Add(-opts.GracePeriod)
+	}
+
 	// mark
 	markSet := make(map[digest.Digest]struct{})
 	manifestArr := make([]ManifestDel, 0)
@@ -60,6 +141,11 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 			return fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
 		}
 
+		// live holds the manifests of the repository marked so far, which
+		// are kept along with everything they reference.
+		live := make(map[digest.Digest]struct{})
+		var untagged []digest.Digest
+
 		err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
 			if opts.RemoveUntagged {
 				// fetch all tags where this manifest is the latest one
@@ -68,34 +154,14 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 					return fmt.Errorf("failed to retrieve tags for digest %v: %v", dgst, err)
 				}
 				if len(tags) == 0 {
-					emit("manifest eligible for deletion: %s", dgst)
-					// fetch all tags from repository
-					// all of these tags could contain manifest in history
-					// which means that we need check (and delete) those references when deleting manifest
-					allTags, err := repository.Tags(ctx).All(ctx)
-					if err != nil {
-						return fmt.Errorf("failed to retrieve tags %v", err)
-					}
-					manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags})
+					// Decide once all tagged manifests are marked, as a
+					// manifest list enumerated later may reference it.
+					untagged = append(untagged, dgst)
 					return nil
 				}
 			}
-			// Mark the manifest's blob
-			emit("%s: marking manifest %s ", repoName, dgst)
-			markSet[dgst] = struct{}{}
 
-			manifest, err := manifestService.Get(ctx, dgst)
-			if err != nil {
-				return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
-			}
-
-			descriptors := manifest.References()
-			for _, descriptor := range descriptors {
-				markSet[descriptor.Digest] = struct{}{}
-				emit("%s: marking blob %s", repoName, descriptor.Digest)
-			}
-
-			return nil
+			return markManifest(ctx, storageDriver, repoName, manifestService, dgst, opts, 0, live, markSet)
 		})
 
 		// In certain situations such as unfinished uploads, deleting all
@@ -104,10 +170,53 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 		//
 		// In these cases we can continue marking other manifests safely.
 		if _, ok := err.(driver.PathNotFoundError); ok {
-			return nil
+			err = nil
+		}
+		if err != nil {
+			return err
 		}
 
-		return err
+		// Manifests within the grace period are kept, with everything they
+		// reference, before deciding on the others, as they may be
+		// referenced by a manifest list yet to be pushed.
+		for _, dgst := range untagged {
+			linkPath, err := pathFor(manifestRevisionLinkPathSpec{name: repoName, revision: dgst})
+			if err != nil {
+				return err
+			}
+			young, err := modifiedAfter(ctx, storageDriver, linkPath, cutoff)
+			if err != nil {
+				return fmt.Errorf("failed to stat manifest %s: %v", dgst, err)
+			}
+			if young {
+				emit("%s: manifest %s within the grace period", repoName, dgst)
+				if err := markManifest(ctx, storageDriver, repoName, manifestService, dgst, opts, 0, live, markSet); err != nil {
+					return err
+				}
+			}
+		}
+
+		var allTags []string
+		for _, dgst := range untagged {
+			if _, ok := live[dgst]; ok {
+				// referenced by a tagged manifest list, or kept
+				continue
+			}
+
+			emit("manifest eligible for deletion: %s", dgst)
+			if allTags == nil {
+				// fetch all tags from repository
+				// all of these tags could contain manifest in history
+				// which means that we need check (and delete) those references when deleting manifest
+				allTags, err = repository.Tags(ctx).All(ctx)
+				if err != nil {
+					return fmt.Errorf("failed to retrieve tags %v", err)
+				}
+			}
+			manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags})
+		}
+
+		return nil
 	})
 
 	if err != nil {
@@ -118,6 +227,9 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 	vacuum := NewVacuum(ctx, storageDriver)
 	if !opts.DryRun {
 		for _, obj := range manifestArr {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("stopped before deleting manifest %s: %v", obj.Digest, err)
+			}
 			err = vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags)
 			if err != nil {
 				return fmt.Errorf("failed to delete manifest %s: %v", obj.Digest, err)
@@ -128,25 +240,139 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 	deleteSet := make(map[digest.Digest]struct{})
 	err = blobService.Enumerate(ctx, func(dgst digest.Digest) error {
 		// check if digest is in markSet. If not, delete it!
-		if _, ok := markSet[dgst]; !ok {
-			deleteSet[dgst] = struct{}{}
+		if _, ok := markSet[dgst]; ok {
+			return nil
+		}
+		blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+		if err != nil {
+			return err
 		}
+		young, err := modifiedAfter(ctx, storageDriver, blobPath, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+		}
+		if young {
+			emit("blob %s within the grace period", dgst)
+			return nil
+		}
+		deleteSet[dgst] = struct{}{}
 		return nil
 	})
 	if err != nil {
 		return fmt.Errorf("error enumerating blobs: %v", err)
 	}
 	emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", len(markSet), len(deleteSet), len(manifestArr))
+	stats.marked = int64(len(markSet))
 	for dgst := range deleteSet {
 		emit("blob eligible for deletion: %s", dgst)
 		if opts.DryRun {
 			continue
 		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stopped before deleting blob %s: %v", dgst, err)
+		}
+		size, err := blobSize(ctx, storageDriver, dgst)
+		if err != nil {
+			return fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+		}
 		err = vacuum.RemoveBlob(string(dgst))
 		if err != nil {
 			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
 		}
+		stats.swept++
+		stats.reclaimed += size
 	}
 
 	return err
 }
+
+// blobSize returns the size of the content stored for dgst, zero if there is
+// none.
+func blobSize(ctx context.Context, storageDriver driver.StorageDriver, dgst digest.Digest) (int64, error) {
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return 0, err
+	}
+	fi, err := storageDriver.Stat(ctx, blobPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// modifiedAfter reports whether the content at path was modified after
+// cutoff, which is never the case for a zero cutoff or missing content.
+func modifiedAfter(ctx context.Context, storageDriver driver.StorageDriver, path string, cutoff time.Time) (bool, error) {
+	if cutoff.IsZero() {
+		return false, nil
+	}
+	fi, err := storageDriver.Stat(ctx, path)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return fi.ModTime().After(cutoff), nil
+}
+
+// markManifest marks the manifest dgst and the blobs it references as live.
+// The manifests referenced by a manifest list, found depth levels of lists
+// deep, are marked in turn, and so are the referrers of the manifest, such as
+// signatures, if untagged manifests are removed.
+func markManifest(ctx context.Context, storageDriver driver.StorageDriver, repoName string, manifestService distribution.ManifestService, dgst digest.Digest, opts GCOpts, depth int, live, markSet map[digest.Digest]struct{}) error {
+	if _, ok := live[dgst]; ok {
+		return nil
+	}
+	live[dgst] = struct{}{}
+
+	// Mark the manifest's blob
+	emit("%s: marking manifest %s ", repoName, dgst)
+	markSet[dgst] = struct{}{}
+
+	manifest, err := manifestService.Get(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
+	}
+
+	descriptors := manifest.References()
+	for _, descriptor := range descriptors {
+		markSet[descriptor.Digest] = struct{}{}
+		emit("%s: marking blob %s", repoName, descriptor.Digest)
+	}
+
+	if _, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		if err := checkManifestListDepth(dgst, depth+1, opts.MaxManifestListDepth); err != nil {
+			return err
+		}
+		for _, descriptor := range descriptors {
+			exists, err := manifestService.Exists(ctx, descriptor.Digest)
+			if err != nil {
+				return fmt.Errorf("failed to check manifest %v referenced by %v: %v", descriptor.Digest, dgst, err)
+			}
+			if !exists {
+				continue
+			}
+			if err := markManifest(ctx, storageDriver, repoName, manifestService, descriptor.Digest, opts, depth+1, live, markSet); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.RemoveUntagged {
+		referrers, err := Referrers(ctx, storageDriver, repoName, dgst)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve referrers of %v: %v", dgst, err)
+		}
+		for _, referrer := range referrers {
+			if err := markManifest(ctx, storageDriver, repoName, manifestService, referrer.Digest, opts, 0, live, markSet); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
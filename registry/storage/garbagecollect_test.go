@@ -1,18 +1,26 @@
 package storage
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
+	"github.com/docker/go-metrics"
 	"github.com/docker/libtrust"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type image struct {
@@ -500,3 +508,489 @@ func TestOrphanBlobDeleted(t *testing.T) {
 		}
 	}
 }
+
+func TestDeleteUntaggedManifests(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "untagged")
+	manifestService, _ := repo.Manifests(ctx)
+
+	tagged := uploadRandomSchema2Image(t, repo)
+	dangling := uploadRandomSchema2Image(t, repo)
+	listed1 := uploadRandomSchema2Image(t, repo)
+	listed2 := uploadRandomSchema2Image(t, repo)
+	inUntaggedList := uploadRandomSchema2Image(t, repo)
+
+	putManifestList := func(images ...image) digest.Digest {
+		var digests []digest.Digest
+		for _, img := range images {
+			digests = append(digests, img.manifestDigest)
+		}
+		manifestList, err := testutil.MakeManifestList(registry.BlobStatter(), digests)
+		if err != nil {
+			t.Fatalf("Failed to make manifest list: %v", err)
+		}
+		dgst, err := manifestService.Put(ctx, manifestList)
+		if err != nil {
+			t.Fatalf("Failed to add manifest list: %v", err)
+		}
+		return dgst
+	}
+
+	taggedList := putManifestList(listed1, listed2)
+	untaggedList := putManifestList(inUntaggedList)
+
+	for tag, dgst := range map[string]digest.Digest{
+		"image": tagged.manifestDigest,
+		"list":  taggedList,
+	} {
+		if err := repo.Tags(ctx).Tag(ctx, tag, distribution.Descriptor{Digest: dgst}); err != nil {
+			t.Fatalf("failed to tag manifest: %v", err)
+		}
+	}
+
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	manifests := allManifests(t, manifestService)
+	blobs := allBlobs(t, registry)
+
+	// A tagged manifest list keeps the manifests it references alive.
+	for _, img := range []image{tagged, listed1, listed2} {
+		if _, ok := manifests[img.manifestDigest]; !ok {
+			t.Errorf("manifest %s was deleted", img.manifestDigest)
+		}
+		for layer := range img.layers {
+			if _, ok := blobs[layer]; !ok {
+				t.Errorf("layer %s of manifest %s was deleted", layer, img.manifestDigest)
+			}
+		}
+	}
+	if _, ok := manifests[taggedList]; !ok {
+		t.Errorf("tagged manifest list %s was deleted", taggedList)
+	}
+
+	// Dangling manifests, and the manifests only an untagged list
+	// references, are deleted along with their layers.
+	for _, img := range []image{dangling, inUntaggedList} {
+		if _, ok := manifests[img.manifestDigest]; ok {
+			t.Errorf("dangling manifest %s was not deleted", img.manifestDigest)
+		}
+		for layer := range img.layers {
+			if _, ok := blobs[layer]; ok {
+				t.Errorf("layer %s of dangling manifest %s was not deleted", layer, img.manifestDigest)
+			}
+		}
+	}
+	if _, ok := manifests[untaggedList]; ok {
+		t.Errorf("untagged manifest list %s was not deleted", untaggedList)
+	}
+}
+
+func TestDeleteUntaggedManifestsKeepsReferrers(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "signed")
+	manifestService, _ := repo.Manifests(ctx)
+
+	tagged := uploadRandomSchema2Image(t, repo)
+	dangling := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "image", distribution.Descriptor{Digest: tagged.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	subjectOf := func(dgst digest.Digest) *distribution.Descriptor {
+		return &distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: 1}
+	}
+	signature, _ := putArtifact(t, repo, "application/vnd.example.signature.v1+json", subjectOf(tagged.manifestDigest))
+	sbom, _ := putArtifact(t, repo, "application/vnd.example.sbom.v1+json", subjectOf(tagged.manifestDigest))
+	sbomSignature, _ := putArtifact(t, repo, "application/vnd.example.sbom-signature.v1+json", subjectOf(sbom))
+	danglingSignature, _ := putArtifact(t, repo, "application/vnd.example.dangling-signature.v1+json", subjectOf(dangling.manifestDigest))
+
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	manifests := allManifests(t, manifestService)
+	blobs := allBlobs(t, registry)
+
+	// The referrers of a tagged image, and their own referrers, are kept
+	// along with their layers.
+	for _, dgst := range []digest.Digest{tagged.manifestDigest, signature, sbom, sbomSignature} {
+		if _, ok := manifests[dgst]; !ok {
+			t.Errorf("manifest %s was deleted", dgst)
+		}
+	}
+	for _, artifactType := range []string{"application/vnd.example.signature.v1+json", "application/vnd.example.sbom-signature.v1+json"} {
+		layer := digest.FromString(`{"predicate":"` + artifactType + `"}`)
+		if _, ok := blobs[layer]; !ok {
+			t.Errorf("layer %s of a %s was deleted", layer, artifactType)
+		}
+	}
+
+	referrers, err := Referrers(ctx, inmemoryDriver, "signed", tagged.manifestDigest)
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 2 {
+		t.Errorf("expected the signature and sbom to be listed, got %v", referrers)
+	}
+
+	// The referrers of a dangling image are deleted along with it, and so
+	// are the links to them.
+	for _, dgst := range []digest.Digest{dangling.manifestDigest, danglingSignature} {
+		if _, ok := manifests[dgst]; ok {
+			t.Errorf("dangling manifest %s was not deleted", dgst)
+		}
+	}
+	referrersPath, err := pathFor(manifestReferrersPathSpec{name: "signed", subject: dangling.manifestDigest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inmemoryDriver.Stat(ctx, referrersPath); err == nil {
+		t.Errorf("referrers of dangling manifest %s were not deleted", dangling.manifestDigest)
+	}
+}
+
+// recordingMetric records the value of a counter or gauge.
+type recordingMetric struct {
+	value float64
+}
+
+func (m *recordingMetric) Inc(vs ...float64) {
+	if len(vs) == 0 {
+		m.value++
+	}
+	for _, v := range vs {
+		m.value += v
+	}
+}
+
+func (m *recordingMetric) Dec(vs ...float64) {
+	if len(vs) == 0 {
+		m.value--
+	}
+	for _, v := range vs {
+		m.value -= v
+	}
+}
+
+func (m *recordingMetric) Add(v float64) { m.value += v }
+func (m *recordingMetric) Set(v float64) { m.value = v }
+
+func TestGCMetrics(t *testing.T) {
+	marked, swept, reclaimed := &recordingMetric{}, &recordingMetric{}, &recordingMetric{}
+	duration, lastSuccess := &recordingMetric{}, &recordingMetric{}
+	defer func(marked, swept, reclaimed metrics.Counter, duration, lastSuccess metrics.Gauge) {
+		gcMarkedCount, gcSweptCount, gcReclaimedBytes = marked, swept, reclaimed
+		gcLastRunDuration, gcLastSuccess = duration, lastSuccess
+	}(gcMarkedCount, gcSweptCount, gcReclaimedBytes, gcLastRunDuration, gcLastSuccess)
+	gcMarkedCount, gcSweptCount, gcReclaimedBytes = marked, swept, reclaimed
+	gcLastRunDuration, gcLastSuccess = duration, lastSuccess
+
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "gc/metrics")
+
+	orphans, err := testutil.CreateRandomLayers(3)
+	if err != nil {
+		t.Fatalf("Failed to create random layers: %v", err)
+	}
+	if err := testutil.UploadBlobs(repo, orphans); err != nil {
+		t.Fatalf("Failed to upload blobs: %v", err)
+	}
+	var orphanBytes int64
+	for dgst := range orphans {
+		desc, err := registry.BlobStatter().Stat(ctx, dgst)
+		if err != nil {
+			t.Fatalf("Failed to stat blob: %v", err)
+		}
+		orphanBytes += desc.Size
+	}
+	image := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: image.manifestDigest}); err != nil {
+		t.Fatalf("Failed to tag: %v", err)
+	}
+
+	// Dry runs are not recorded.
+	if err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{DryRun: true}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if marked.value != 0 || lastSuccess.value != 0 {
+		t.Fatalf("dry run recorded: marked %v, last success %v", marked.value, lastSuccess.value)
+	}
+
+	before := time.Now().Unix()
+	if err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	// The manifest, its config and its two layers are marked.
+	if marked.value != 4 {
+		t.Fatalf("unexpected number of blobs marked: %v", marked.value)
+	}
+	if swept.value != float64(len(orphans)) {
+		t.Fatalf("unexpected number of blobs swept: %v != %d", swept.value, len(orphans))
+	}
+	if reclaimed.value != float64(orphanBytes) {
+		t.Fatalf("unexpected number of bytes reclaimed: %v != %d", reclaimed.value, orphanBytes)
+	}
+	if duration.value <= 0 {
+		t.Fatalf("unexpected last run duration: %v", duration.value)
+	}
+	if lastSuccess.value < float64(before) {
+		t.Fatalf("unexpected last success timestamp: %v", lastSuccess.value)
+	}
+
+	// The counters advance with every run.
+	if err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if marked.value != 8 || swept.value != float64(len(orphans)) {
+		t.Fatalf("unexpected counters after a second run: marked %v, swept %v", marked.value, swept.value)
+	}
+}
+
+// newGracePeriodDriver returns a filesystem driver, whose modification times
+// can be set with age, storing under a temporary root.
+func newGracePeriodDriver(t *testing.T) (driver.StorageDriver, string) {
+	root, err := ioutil.TempDir("", "gc-grace-period-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return filesystem.New(filesystem.DriverParameters{RootDirectory: root, MaxThreads: 100}), root
+}
+
+// age sets the modification time of the content stored at the path of spec
+// under root to d ago.
+func age(t *testing.T, root string, spec pathSpec, d time.Duration) {
+	t.Helper()
+	p, err := pathFor(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-d)
+	if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(p)), mtime, mtime); err != nil {
+		t.Fatalf("unexpected error setting the modification time of %s: %v", p, err)
+	}
+}
+
+func TestGCGracePeriodKeepsYoungBlobs(t *testing.T) {
+	ctx := context.Background()
+	d, root := newGracePeriodDriver(t)
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "grace")
+
+	orphans, err := testutil.CreateRandomLayers(2)
+	if err != nil {
+		t.Fatalf("Failed to create random layers: %v", err)
+	}
+	if err := testutil.UploadBlobs(repo, orphans); err != nil {
+		t.Fatalf("Failed to upload blobs: %v", err)
+	}
+	var young, old digest.Digest
+	for dgst := range orphans {
+		if young == "" {
+			young = dgst
+		} else {
+			old = dgst
+		}
+	}
+	age(t, root, blobDataPathSpec{digest: old}, 2*time.Hour)
+
+	// formality to create the necessary directories
+	uploadRandomSchema2Image(t, repo)
+
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{GracePeriod: time.Hour}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[young]; !ok {
+		t.Errorf("blob %s within the grace period was deleted", young)
+	}
+	if _, ok := blobs[old]; ok {
+		t.Errorf("blob %s older than the grace period was not deleted", old)
+	}
+}
+
+func TestGCGracePeriodKeepsYoungManifests(t *testing.T) {
+	ctx := context.Background()
+	d, root := newGracePeriodDriver(t)
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "grace")
+	manifestService := makeManifestService(t, repo)
+
+	// Pushed moments before the manifest list referencing it would be.
+	young := uploadRandomSchema2Image(t, repo)
+	old := uploadRandomSchema2Image(t, repo)
+	for _, spec := range []pathSpec{
+		manifestRevisionLinkPathSpec{name: "grace", revision: old.manifestDigest},
+		blobDataPathSpec{digest: old.manifestDigest},
+	} {
+		age(t, root, spec, 2*time.Hour)
+	}
+	for layer := range old.layers {
+		age(t, root, blobDataPathSpec{digest: layer}, 2*time.Hour)
+	}
+
+	tagged := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: tagged.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	err := MarkAndSweep(ctx, d, registry, GCOpts{
+		RemoveUntagged: true,
+		GracePeriod:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	manifests := allManifests(t, manifestService)
+	blobs := allBlobs(t, registry)
+	if _, ok := manifests[young.manifestDigest]; !ok {
+		t.Errorf("manifest %s within the grace period was deleted", young.manifestDigest)
+	}
+	for layer := range young.layers {
+		if _, ok := blobs[layer]; !ok {
+			t.Errorf("layer %s of manifest %s within the grace period was deleted", layer, young.manifestDigest)
+		}
+	}
+	if _, ok := manifests[old.manifestDigest]; ok {
+		t.Errorf("manifest %s older than the grace period was not deleted", old.manifestDigest)
+	}
+	for layer := range old.layers {
+		if _, ok := blobs[layer]; ok {
+			t.Errorf("layer %s of manifest %s older than the grace period was not deleted", layer, old.manifestDigest)
+		}
+	}
+}
+
+func TestGCLock(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "lockedrepo")
+	uploadRandomSchema2Image(t, repo)
+	lockPath, err := pathFor(gcLockPathSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := acquireGCLock(ctx, inmemoryDriver, time.Minute, func() {})
+	if err != nil {
+		t.Fatalf("failed to acquire lock: %v", err)
+	}
+
+	// A second run is refused while the first holds the lock, but dry runs
+	// delete nothing so still run.
+	err = MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{})
+	if _, ok := err.(ErrGCInProgress); !ok {
+		t.Fatalf("expected a run refused while locked, got %v", err)
+	}
+	if err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{DryRun: true}); err != nil {
+		t.Fatalf("failed dry run while locked: %v", err)
+	}
+
+	if err := lock.release(ctx); err != nil {
+		t.Fatalf("failed to release lock: %v", err)
+	}
+	if _, err := inmemoryDriver.Stat(ctx, lockPath); err == nil {
+		t.Fatal("lock not deleted on release")
+	}
+
+	if err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{}); err != nil {
+		t.Fatalf("failed to run once unlocked: %v", err)
+	}
+	if _, err := inmemoryDriver.Stat(ctx, lockPath); err == nil {
+		t.Fatal("lock not released at the end of the run")
+	}
+
+	// The lock is released by failed runs too.
+	if err := MarkAndSweep(ctx, inmemoryDriver, struct{ distribution.Namespace }{registry}, GCOpts{}); err == nil {
+		t.Fatal("expected run to fail")
+	}
+	if _, err := inmemoryDriver.Stat(ctx, lockPath); err == nil {
+		t.Fatal("lock not released at the end of a failed run")
+	}
+}
+
+func TestGCLockTakeover(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "lockedrepo")
+	uploadRandomSchema2Image(t, repo)
+	lockPath, err := pathFor(gcLockPathSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock of a run which crashed an hour ago expired.
+	crashed := time.Now().Add(-time.Hour)
+	stale := fmt.Sprintf(`{"token":"crashed","holder":"crashed","acquired":%q,"expires":%q}`,
+		crashed.Format(time.RFC3339Nano), crashed.Add(DefaultGCLockTTL).Format(time.RFC3339Nano))
+	if err := inmemoryDriver.PutContent(ctx, lockPath, []byte(stale)); err != nil {
+		t.Fatal(err)
+	}
+	if err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{}); err != nil {
+		t.Fatalf("failed to take over stale lock: %v", err)
+	}
+	if _, err := inmemoryDriver.Stat(ctx, lockPath); err == nil {
+		t.Fatal("lock taken over not released")
+	}
+}
+
+func TestGCLockLost(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	lockPath, err := pathFor(gcLockPathSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled := make(chan struct{})
+	lock, err := acquireGCLock(ctx, inmemoryDriver, 30*time.Millisecond, func() { close(cancelled) })
+	if err != nil {
+		t.Fatalf("failed to acquire lock: %v", err)
+	}
+
+	// A run refreshes its lock, so that others do not take it over.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := acquireGCLock(ctx, inmemoryDriver, time.Minute, func() {}); err == nil {
+		t.Fatal("expected a refreshed lock to be held")
+	}
+
+	// A run whose lock another took over is cancelled.
+	other := fmt.Sprintf(`{"token":"other","holder":"other","expires":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339Nano))
+	if err := inmemoryDriver.PutContent(ctx, lockPath, []byte(other)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run not cancelled on losing its lock")
+	}
+	if err := lock.release(ctx); err == nil {
+		t.Fatal("expected an error releasing a lost lock")
+	}
+	if content, err := inmemoryDriver.GetContent(ctx, lockPath); err != nil || string(content) != other {
+		t.Fatalf("lock of another run released: %q, %v", content, err)
+	}
+}
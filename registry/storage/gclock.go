@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/uuid"
+)
+
+// DefaultGCLockTTL is how long the lock of a garbage collection run is held
+// after it was last refreshed, unless configured otherwise. Runs refresh
+// their lock well within its TTL, so the TTL only bounds how long the lock of
+// a run which crashed keeps others from running.
+const DefaultGCLockTTL = 5 * time.Minute
+
+// ErrGCInProgress is returned when garbage collection cannot run as another
+// run holds the lock.
+type ErrGCInProgress struct {
+	Holder   string
+	Acquired time.Time
+	Expires  time.Time
+}
+
+func (err ErrGCInProgress) Error() string {
+	return fmt.Sprintf("garbage collection already in progress: lock held by %s since %s, until %s unless refreshed",
+		err.Holder, err.Acquired.Format(time.RFC3339), err.Expires.Format(time.RFC3339))
+}
+
+// gcLockContent is the content of the lock file of a garbage collection run.
+type gcLockContent struct {
+	// Token identifies the run holding the lock.
+	Token string `json:"token"`
+	// Holder describes the process holding the lock, for operators.
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// gcLock is an advisory lock, stored with the storage driver, keeping
+// garbage collection runs from overlapping. As storage drivers offer no
+// atomic creation, two runs starting at the very same time may both acquire
+// it; acquiring reads the lock back to make that unlikely.
+type gcLock struct {
+	driver driver.StorageDriver
+	path   string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	content gcLockContent
+	lost    bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireGCLock acquires the garbage collection lock for ttl, taking it over
+// if its holder let it expire, and refreshes it until released. cancel is
+// called if the lock is lost to another run meanwhile.
+func acquireGCLock(ctx context.Context, storageDriver driver.StorageDriver, ttl time.Duration, cancel func()) (*gcLock, error) {
+	if ttl <= 0 {
+		ttl = DefaultGCLockTTL
+	}
+	lockPath, err := pathFor(gcLockPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	current, held, err := readGCLock(ctx, storageDriver, lockPath)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if held {
+		if now.Before(current.Expires) {
+			return nil, ErrGCInProgress{Holder: current.Holder, Acquired: current.Acquired, Expires: current.Expires}
+		}
+		dcontext.GetLogger(ctx).Warnf("taking over the garbage collection lock of %s, expired at %s", current.Holder, current.Expires.Format(time.RFC3339))
+	}
+
+	hostname, _ := os.Hostname()
+	lock := &gcLock{
+		driver: storageDriver,
+		path:   lockPath,
+		ttl:    ttl,
+		content: gcLockContent{
+			Token:    uuid.Generate().String(),
+			Holder:   fmt.Sprintf("%s (pid %d)", hostname, os.Getpid()),
+			Acquired: now,
+			Expires:  now.Add(ttl),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := lock.write(ctx); err != nil {
+		return nil, err
+	}
+
+	// Another run writing the lock at the same time wins if its write
+	// landed last.
+	current, held, err = readGCLock(ctx, storageDriver, lockPath)
+	if err != nil {
+		return nil, err
+	}
+	if !held || current.Token != lock.content.Token {
+		return nil, ErrGCInProgress{Holder: current.Holder, Acquired: current.Acquired, Expires: current.Expires}
+	}
+
+	go lock.refresh(ctx, cancel)
+	return lock, nil
+}
+
+// readGCLock returns the content of the lock at lockPath, if held.
+func readGCLock(ctx context.Context, storageDriver driver.StorageDriver, lockPath string) (gcLockContent, bool, error) {
+	var content gcLockContent
+	p, err := storageDriver.GetContent(ctx, lockPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return content, false, nil
+		}
+		return content, false, err
+	}
+	if err := json.Unmarshal(p, &content); err != nil {
+		// A lock which cannot be read is treated as expired.
+		dcontext.GetLogger(ctx).Warnf("invalid garbage collection lock: %v", err)
+		return gcLockContent{Holder: "unknown"}, true, nil
+	}
+	return content, true, nil
+}
+
+func (l *gcLock) write(ctx context.Context) error {
+	p, err := json.Marshal(l.content)
+	if err != nil {
+		return err
+	}
+	return l.driver.PutContent(ctx, l.path, p)
+}
+
+// refresh extends the lock every third of its TTL until released. If another
+// run took the lock over meanwhile, it stops and calls cancel.
+func (l *gcLock) refresh(ctx context.Context, cancel func()) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		l.mu.Lock()
+		current, held, err := readGCLock(ctx, l.driver, l.path)
+		if err == nil && (!held || current.Token != l.content.Token) {
+			dcontext.GetLogger(ctx).Errorf("garbage collection lock lost to %s, stopping", current.Holder)
+			l.lost = true
+			l.mu.Unlock()
+			cancel()
+			return
+		}
+		l.content.Expires = time.Now().Add(l.ttl)
+		if err == nil {
+			err = l.write(ctx)
+		}
+		l.mu.Unlock()
+		if err != nil {
+			dcontext.GetLogger(ctx).Warnf("error refreshing the garbage collection lock: %v", err)
+		}
+	}
+}
+
+// release stops refreshing the lock and deletes it, unless it was lost to
+// another run. It returns an error if the lock was lost, as the run could
+// then have overlapped with another.
+func (l *gcLock) release(ctx context.Context) error {
+	close(l.stop)
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost {
+		return fmt.Errorf("garbage collection lock lost to another run")
+	}
+	current, held, err := readGCLock(ctx, l.driver, l.path)
+	if err != nil {
+		return err
+	}
+	if !held || current.Token != l.content.Token {
+		return fmt.Errorf("garbage collection lock lost to %s", current.Holder)
+	}
+	err = l.driver.Delete(ctx, l.path)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DefaultAllowedLayerMediaTypes are the media types of the docker and OCI tar
+// layers, uncompressed or compressed with gzip or zstd, which are the layers
+// registries restricting layer media types commonly allow. Foreign and
+// non-distributable layers are not among them.
+var DefaultAllowedLayerMediaTypes = []string{
+	schema2.MediaTypeLayer,
+	schema2.MediaTypeUncompressedLayer,
+	v1.MediaTypeImageLayer,
+	v1.MediaTypeImageLayerGzip,
+	ocischema.MediaTypeImageLayerZstd,
+}
+
+// DefaultAllowedForeignLayerMediaTypes are the foreign and non-distributable
+// layer media types, which registries accepting layers referencing external
+// URLs allow in addition to DefaultAllowedLayerMediaTypes.
+var DefaultAllowedForeignLayerMediaTypes = []string{
+	schema2.MediaTypeForeignLayer,
+	v1.MediaTypeImageLayerNonDistributable,
+	v1.MediaTypeImageLayerNonDistributableGzip,
+	ocischema.MediaTypeImageLayerNonDistributableZstd,
+}
+
+// imageLayerMediaTypes are the media types of image layers, which are
+// checked against the allowed layer media types whatever the manifest, so
+// that pushing an image as an artifact does not bypass them.
+var imageLayerMediaTypes = func() map[string]struct{} {
+	mediaTypes := make(map[string]struct{})
+	for _, mediaType := range append(append([]string(nil), DefaultAllowedLayerMediaTypes...), DefaultAllowedForeignLayerMediaTypes...) {
+		mediaTypes[mediaType] = struct{}{}
+	}
+	return mediaTypes
+}()
+
+// layerMediaTypes holds the media types layers of pushed manifests may have.
+// A nil layerMediaTypes allows any media type.
+type layerMediaTypes map[string]struct{}
+
+// verify returns an error for each layer with a media type not allowed.
+func (allowed layerMediaTypes) verify(layers []distribution.Descriptor) []error {
+	if allowed == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, layer := range layers {
+		if _, ok := allowed[layer.MediaType]; !ok {
+			errs = append(errs, distribution.ErrManifestLayerMediaTypeNotAllowed{
+				Digest:    layer.Digest,
+				MediaType: layer.MediaType,
+			})
+		}
+	}
+	return errs
+}
+
+// verifyArtifact returns an error for each layer of an artifact manifest with
+// a media type not allowed. Image layers must be allowed as such, while other
+// layers must be allowed by artifactAllowed, which allows any if nil.
+func (allowed layerMediaTypes) verifyArtifact(artifactAllowed layerMediaTypes, layers []distribution.Descriptor) []error {
+	var errs []error
+	for _, layer := range layers {
+		if _, ok := imageLayerMediaTypes[layer.MediaType]; ok {
+			errs = append(errs, allowed.verify([]distribution.Descriptor{layer})...)
+		} else {
+			errs = append(errs, artifactAllowed.verify([]distribution.Descriptor{layer})...)
+		}
+	}
+	return errs
+}
@@ -31,6 +31,7 @@ type linkedBlobStore struct {
 	ctx                    context.Context // only to be used where context can't come through method args
 	deleteEnabled          bool
 	resumableDigestEnabled bool
+	uploadMinChunkSize     int64
 
 	// linkPathFns specifies one or more path functions allowing one to
 	// control the repository blob link set to which the blob store
@@ -321,6 +322,15 @@ func (lbs *linkedBlobStore) newBlobUpload(ctx context.Context, uuid, path string
 		driver:                 lbs.driver,
 		path:                   path,
 		resumableDigestEnabled: lbs.resumableDigestEnabled,
+		minChunkSize:           lbs.uploadMinChunkSize,
+	}
+
+	// Data may be pending even if the minimum chunk size was since unset.
+	if append {
+		if err := bw.loadPending(ctx); err != nil {
+			fw.Close()
+			return nil, err
+		}
 	}
 
 	return bw, nil
@@ -355,6 +365,9 @@ func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical distribution
 		if err := lbs.blobStore.link(ctx, blobLinkPath, canonical.Digest); err != nil {
 			return err
 		}
+		if lbs.registry != nil && lbs.registry.negativeBlobCache != nil {
+			lbs.registry.negativeBlobCache.invalidate(dgst)
+		}
 	}
 
 	return nil
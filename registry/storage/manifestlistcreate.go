@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/opencontainers/go-digest"
+)
+
+// CreateManifestList tags a manifest list combining the image manifests of
+// the repository members refer to, by tag or digest, with the platforms
+// their configs are for. An OCI image index is created if any member is an
+// OCI image manifest, and a Docker manifest list otherwise. It fails unless
+// every member is an image manifest of the repository, with a config for a
+// platform other members are not for.
+func CreateManifestList(ctx context.Context, repository distribution.Repository, tag string, members []string) (distribution.Descriptor, error) {
+	if len(members) == 0 {
+		return distribution.Descriptor{}, fmt.Errorf("no member to create a manifest list of")
+	}
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+	tagService := repository.Tags(ctx)
+	blobs := repository.Blobs(ctx)
+
+	versioned := manifestlist.SchemaVersion
+	descriptors := make([]manifestlist.ManifestDescriptor, 0, len(members))
+	platforms := make(map[string]string)
+	for _, member := range members {
+		dgst, err := digest.Parse(member)
+		if err != nil {
+			desc, err := tagService.Get(ctx, member)
+			if err != nil {
+				return distribution.Descriptor{}, fmt.Errorf("failed to resolve member %s: %v", member, err)
+			}
+			dgst = desc.Digest
+		}
+		m, err := manifestService.Get(ctx, dgst)
+		if err != nil {
+			return distribution.Descriptor{}, fmt.Errorf("failed to retrieve member %s: %v", member, err)
+		}
+
+		platform, ok, err := imagePlatform(ctx, blobs, dgst, m, DefaultMaxPlatformConfigSize)
+		if err != nil {
+			return distribution.Descriptor{}, fmt.Errorf("failed to read the platform of member %s: %v", member, err)
+		}
+		if !ok {
+			return distribution.Descriptor{}, fmt.Errorf("member %s is not an image manifest", member)
+		}
+		if platform.OS == "" || platform.Architecture == "" {
+			return distribution.Descriptor{}, fmt.Errorf("the config of member %s is for no platform", member)
+		}
+		key := formatPlatform(platform.OS, platform.Architecture, platform.Variant)
+		if platform.OSVersion != "" {
+			key += ":" + platform.OSVersion
+		}
+		if other, ok := platforms[key]; ok {
+			return distribution.Descriptor{}, fmt.Errorf("members %s and %s are both for %s", other, member, key)
+		}
+		platforms[key] = member
+
+		mediaType, payload, err := m.Payload()
+		if err != nil {
+			return distribution.Descriptor{}, err
+		}
+		if _, ok := m.(*ocischema.DeserializedManifest); ok {
+			versioned = manifestlist.OCISchemaVersion
+		}
+		descriptors = append(descriptors, manifestlist.ManifestDescriptor{
+			Descriptor: distribution.Descriptor{
+				MediaType: mediaType,
+				Size:      int64(len(payload)),
+				Digest:    dgst,
+			},
+			Platform: platform,
+		})
+	}
+
+	payload, err := json.MarshalIndent(manifestlist.ManifestList{
+		Versioned: versioned,
+		Manifests: descriptors,
+	}, "", "   ")
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	list, desc, err := distribution.UnmarshalManifest(versioned.MediaType, payload)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	if _, err := manifestService.Put(ctx, list); err != nil {
+		return distribution.Descriptor{}, fmt.Errorf("failed to store manifest list: %v", err)
+	}
+	if err := tagService.Tag(ctx, tag, desc); err != nil {
+		return distribution.Descriptor{}, fmt.Errorf("failed to tag manifest list: %v", err)
+	}
+	return desc, nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCreateManifestList(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "create/app")
+	tags := repo.Tags(ctx)
+
+	_, amd64 := pushPlatformImage(t, repo, "linux", "amd64")
+	_, arm64 := pushPlatformImage(t, repo, "linux", "arm64")
+	if err := tags.Tag(ctx, "amd64", amd64); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+
+	// Members are given by tag or digest.
+	desc, err := CreateManifestList(ctx, repo, "latest", []string{"amd64", arm64.Digest.String()})
+	if err != nil {
+		t.Fatalf("unexpected error creating manifest list: %v", err)
+	}
+	if desc.MediaType != manifestlist.MediaTypeManifestList {
+		t.Fatalf("created %s, expected a manifest list", desc.MediaType)
+	}
+	if tagged, err := tags.Get(ctx, "latest"); err != nil || tagged.Digest != desc.Digest {
+		t.Fatalf("manifest list not tagged: %v, %v", tagged.Digest, err)
+	}
+
+	m, err := makeManifestService(t, repo).Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("failed to get manifest list: %v", err)
+	}
+	list, ok := m.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		t.Fatalf("created %T, expected a manifest list", m)
+	}
+	expected := []manifestlist.ManifestDescriptor{
+		{Descriptor: amd64, Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64"}},
+		{Descriptor: arm64, Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64"}},
+	}
+	if !reflect.DeepEqual(list.Manifests, expected) {
+		t.Fatalf("unexpected manifests: %+v != %+v", list.Manifests, expected)
+	}
+}
+
+func TestCreateManifestListIndex(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "create/index")
+	blobs := repo.Blobs(ctx)
+
+	_, amd64 := pushPlatformImage(t, repo, "linux", "amd64")
+	layer, err := blobs.Put(ctx, v1.MediaTypeImageLayer, []byte("arm/v7 layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := blobs.Put(ctx, v1.MediaTypeImageConfig, []byte(`{"os":"linux","architecture":"arm","variant":"v7","rootfs":{"type":"layers"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.MediaType = v1.MediaTypeImageConfig
+	oci, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{SchemaVersion: 2, MediaType: v1.MediaTypeImageManifest},
+		Config:    config,
+		Layers:    []distribution.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := makeManifestService(t, repo).Put(ctx, oci)
+	if err != nil {
+		t.Fatalf("unexpected error pushing image: %v", err)
+	}
+
+	// A list with an OCI member is an index.
+	desc, err := CreateManifestList(ctx, repo, "latest", []string{amd64.Digest.String(), dgst.String()})
+	if err != nil {
+		t.Fatalf("unexpected error creating manifest list: %v", err)
+	}
+	if desc.MediaType != v1.MediaTypeImageIndex {
+		t.Fatalf("created %s, expected an image index", desc.MediaType)
+	}
+	m, err := makeManifestService(t, repo).Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("failed to get image index: %v", err)
+	}
+	list := m.(*manifestlist.DeserializedManifestList)
+	if len(list.Manifests) != 2 || list.Manifests[1].MediaType != v1.MediaTypeImageManifest ||
+		!reflect.DeepEqual(list.Manifests[1].Platform, manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v7"}) {
+		t.Fatalf("unexpected manifests: %+v", list.Manifests)
+	}
+}
+
+func TestCreateManifestListErrors(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "create/errors")
+	tags := repo.Tags(ctx)
+
+	_, amd64 := pushPlatformImage(t, repo, "linux", "amd64")
+	if err := tags.Tag(ctx, "amd64", amd64); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	if _, err := CreateManifestList(ctx, repo, "list", []string{"amd64"}); err != nil {
+		t.Fatalf("unexpected error creating manifest list: %v", err)
+	}
+
+	for _, tc := range []struct {
+		members  []string
+		expected string
+	}{
+		{nil, "no member"},
+		{[]string{"amd64", "missing"}, "failed to resolve member missing"},
+		{[]string{"amd64", amd64.Digest.String()}, "are both for linux/amd64"},
+		{[]string{"amd64", "list"}, "member list is not an image manifest"},
+	} {
+		_, err := CreateManifestList(ctx, repo, "latest", tc.members)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("members %v: expected an error containing %q, got %v", tc.members, tc.expected, err)
+		}
+	}
+	if _, err := tags.Get(ctx, "latest"); err == nil {
+		t.Fatal("manifest list tagged despite errors")
+	}
+}
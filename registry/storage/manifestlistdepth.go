@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultMaxManifestListDepth is the number of levels manifest lists may be
+// nested within one another when walked, unless configured otherwise. A
+// manifest list referencing image manifests only is one level deep.
+const DefaultMaxManifestListDepth = 8
+
+// manifestListDepth returns the maximum depth of manifest lists configured as
+// maxDepth, the default if it is zero.
+func manifestListDepth(maxDepth int) int {
+	if maxDepth <= 0 {
+		return DefaultMaxManifestListDepth
+	}
+	return maxDepth
+}
+
+// checkManifestListDepth returns an error if the manifest list dgst, found
+// depth levels deep, is nested beyond maxDepth.
+func checkManifestListDepth(dgst digest.Digest, depth, maxDepth int) error {
+	if depth > manifestListDepth(maxDepth) {
+		return distribution.ErrManifestListTooDeep{Digest: dgst, MaxDepth: manifestListDepth(maxDepth)}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// pushNestedLists pushes an image and depth manifest lists for linux/amd64,
+// each referencing the previous one, and tags the outermost list latest.
+func pushNestedLists(t *testing.T, registry distribution.Namespace, repo distribution.Repository, depth int) distribution.Descriptor {
+	ctx := context.Background()
+	manifests := makeManifestService(t, repo)
+	im := uploadRandomSchema2Image(t, repo)
+	desc, err := registry.BlobStatter().Stat(ctx, im.manifestDigest)
+	if err != nil {
+		t.Fatalf("failed to stat manifest: %v", err)
+	}
+	desc.MediaType = schema2.MediaTypeManifest
+
+	for i := 0; i < depth; i++ {
+		list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{{
+			Descriptor: desc,
+			Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64"},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst, err := manifests.Put(ctx, list)
+		if err != nil {
+			t.Fatalf("failed to put manifest list: %v", err)
+		}
+		mediaType, payload, _ := list.Payload()
+		desc = distribution.Descriptor{MediaType: mediaType, Size: int64(len(payload)), Digest: dgst}
+	}
+	if err := repo.Tags(ctx).Tag(ctx, "latest", desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func checkTooDeep(t *testing.T, operation string, err error, maxDepth int) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("nested beyond the maximum depth of %d", maxDepth)) {
+		t.Fatalf("expected %s to fail on lists nested beyond %d levels, got %v", operation, maxDepth, err)
+	}
+}
+
+func TestManifestListDepthExport(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "depth/app")
+	pushNestedLists(t, registry, repo, 3)
+
+	checkTooDeep(t, "export", ExportOCILayout(ctx, repo, nil, 2, &bytes.Buffer{}), 2)
+
+	var buf bytes.Buffer
+	if err := ExportOCILayout(ctx, repo, nil, 3, &buf); err != nil {
+		t.Fatalf("unexpected error exporting lists nested within the limit: %v", err)
+	}
+	layout := buf.Bytes()
+
+	dst := makeRepository(t, createRegistry(t, inmemory.New()), "depth/copy")
+	checkTooDeep(t, "import", ImportOCILayout(ctx, dst, bytes.NewReader(layout), nil, 2), 2)
+	if err := ImportOCILayout(ctx, dst, bytes.NewReader(layout), nil, 0); err != nil {
+		t.Fatalf("unexpected error importing lists nested within the default limit: %v", err)
+	}
+}
+
+func TestManifestListDepthGC(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "depth/app")
+	pushNestedLists(t, registry, repo, 3)
+
+	checkTooDeep(t, "garbage collection", MarkAndSweep(ctx, d, registry, GCOpts{RemoveUntagged: true, MaxManifestListDepth: 2}), 2)
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{RemoveUntagged: true, MaxManifestListDepth: 3}); err != nil {
+		t.Fatalf("unexpected error collecting lists nested within the limit: %v", err)
+	}
+}
+
+func TestManifestListDepthFilter(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "depth/app")
+	desc := pushNestedLists(t, registry, repo, 3)
+
+	opts := ManifestListFilterOpts{
+		Repository:           "depth/app",
+		Tag:                  "latest",
+		Platforms:            []string{"linux/amd64"},
+		MaxManifestListDepth: 2,
+	}
+	_, err := FilterManifestList(ctx, registry, opts)
+	checkTooDeep(t, "filtering", err, 2)
+	if tagged, err := repo.Tags(ctx).Get(ctx, "latest"); err != nil || tagged.Digest != desc.Digest {
+		t.Fatalf("tag moved by a failed filter: %v, %v", tagged.Digest, err)
+	}
+
+	opts.MaxManifestListDepth = 0
+	if _, err := FilterManifestList(ctx, registry, opts); err != nil {
+		t.Fatalf("unexpected error filtering lists nested within the default limit: %v", err)
+	}
+}
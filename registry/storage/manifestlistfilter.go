@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// ManifestListFilterOpts contains options for FilterManifestList.
+type ManifestListFilterOpts struct {
+	// Repository and Tag name the manifest list to filter.
+	Repository string
+	Tag        string
+
+	// Platforms are the platforms to keep, as os/architecture with an
+	// optional /variant. A platform without a variant matches every variant.
+	Platforms []string
+
+	// DryRun reports the manifest list which would be tagged without
+	// storing it or updating the tag.
+	DryRun bool
+
+	// MaxManifestListDepth is the number of levels the manifest lists
+	// tagged in the repository may be nested within one another when
+	// looking for the manifests they reference, DefaultMaxManifestListDepth
+	// if zero.
+	MaxManifestListDepth int
+}
+
+// FilteredManifestList describes the manifest list written by
+// FilterManifestList.
+type FilteredManifestList struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+
+	// Original is the manifest list the tag pointed to. It is left in the
+	// repository, reachable by digest until garbage collected.
+	Original digest.Digest `json:"original"`
+
+	// Filtered is the manifest list the tag points to now.
+	Filtered digest.Digest `json:"filtered"`
+
+	// Kept and Dropped are the manifests of the original list kept in and
+	// dropped from the filtered one.
+	Kept    []digest.Digest `json:"kept"`
+	Dropped []digest.Digest `json:"dropped"`
+
+	// Unreferenced are the dropped manifests which are no longer referenced
+	// by a tag of the repository, directly or through a tagged manifest
+	// list. They are candidates for garbage collection with untagged
+	// manifests deleted.
+	Unreferenced []digest.Digest `json:"unreferenced"`
+}
+
+// platformFilter matches manifest list entries by platform.
+type platformFilter struct {
+	os, architecture, variant string
+}
+
+func parsePlatformFilter(s string) (platformFilter, error) {
+	platform, err := ParsePlatform(s)
+	if err != nil {
+		return platformFilter{}, err
+	}
+	return platformFilter{os: platform.OS, architecture: platform.Architecture, variant: platform.Variant}, nil
+}
+
+func (f platformFilter) matches(platform manifestlist.PlatformSpec) bool {
+	return platform.OS == f.os && platform.Architecture == f.architecture &&
+		(f.variant == "" || platform.Variant == f.variant)
+}
+
+// FilterManifestList replaces the manifest list a tag points to with one
+// only referencing the manifests of the selected platforms, keeping the
+// media type and annotations of the original. The manifests dropped are left
+// in the repository, and those no longer referenced are reported.
+func FilterManifestList(ctx context.Context, registry distribution.Namespace, opts ManifestListFilterOpts) (*FilteredManifestList, error) {
+	if len(opts.Platforms) == 0 {
+		return nil, fmt.Errorf("no platform to keep")
+	}
+	filters := make([]platformFilter, 0, len(opts.Platforms))
+	for _, platform := range opts.Platforms {
+		filter, err := parsePlatformFilter(platform)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+	}
+
+	named, err := reference.WithName(opts.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse repo name %s: %v", opts.Repository, err)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct repository: %v", err)
+	}
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+	tagService := repository.Tags(ctx)
+
+	desc, err := tagService.Get(ctx, opts.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve tag %s of %s: %v", opts.Tag, opts.Repository, err)
+	}
+	manifest, err := manifestService.Get(ctx, desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve manifest %s: %v", desc.Digest, err)
+	}
+	original, ok := manifest.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		return nil, fmt.Errorf("tag %s of %s does not point at a manifest list", opts.Tag, opts.Repository)
+	}
+
+	result := &FilteredManifestList{
+		Repository:   opts.Repository,
+		Tag:          opts.Tag,
+		Original:     desc.Digest,
+		Kept:         []digest.Digest{},
+		Dropped:      []digest.Digest{},
+		Unreferenced: []digest.Digest{},
+	}
+
+	var kept []manifestlist.ManifestDescriptor
+	for _, descriptor := range original.Manifests {
+		keep := false
+		for _, filter := range filters {
+			if filter.matches(descriptor.Platform) {
+				keep = true
+				break
+			}
+		}
+		if keep {
+			kept = append(kept, descriptor)
+			result.Kept = append(result.Kept, descriptor.Digest)
+		} else {
+			result.Dropped = append(result.Dropped, descriptor.Digest)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("no manifest of %s:%s matches the platforms %s", opts.Repository, opts.Tag, strings.Join(opts.Platforms, ", "))
+	}
+
+	mediaType, _, err := original.Payload()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.MarshalIndent(manifestlist.ManifestList{
+		Versioned:   original.Versioned,
+		Manifests:   kept,
+		Annotations: original.Annotations,
+	}, "", "   ")
+	if err != nil {
+		return nil, err
+	}
+	filtered, filteredDesc, err := distribution.UnmarshalManifest(mediaType, payload)
+	if err != nil {
+		return nil, err
+	}
+	result.Filtered = filteredDesc.Digest
+
+	if opts.DryRun {
+		return result, nil
+	}
+
+	// The manifests referenced once the tag is moved are found beforehand,
+	// so that the tag is left as is if they cannot be.
+	referenced, err := taggedManifests(ctx, tagService, manifestService, opts.Tag, opts.MaxManifestListDepth)
+	if err != nil {
+		return nil, err
+	}
+	for _, descriptor := range kept {
+		if err := addReferencedManifests(ctx, manifestService, descriptor.Digest, 1, opts.MaxManifestListDepth, referenced); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := manifestService.Put(ctx, filtered); err != nil {
+		return nil, fmt.Errorf("failed to store filtered manifest list: %v", err)
+	}
+	if err := tagService.Tag(ctx, opts.Tag, filteredDesc); err != nil {
+		return nil, fmt.Errorf("failed to tag filtered manifest list: %v", err)
+	}
+
+	for _, dgst := range result.Dropped {
+		if _, ok := referenced[dgst]; !ok {
+			result.Unreferenced = append(result.Unreferenced, dgst)
+		}
+	}
+	sort.Slice(result.Unreferenced, func(i, j int) bool {
+		return result.Unreferenced[i] < result.Unreferenced[j]
+	})
+
+	return result, nil
+}
+
+// taggedManifests returns the manifests tags other than except point to and
+// those referenced by the manifest lists they point to, through lists nested
+// no deeper than maxDepth.
+func taggedManifests(ctx context.Context, tagService distribution.TagService, manifestService distribution.ManifestService, except string, maxDepth int) (map[digest.Digest]struct{}, error) {
+	tags, err := tagService.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve tags: %v", err)
+	}
+
+	referenced := make(map[digest.Digest]struct{})
+	for _, tag := range tags {
+		if tag == except {
+			continue
+		}
+		desc, err := tagService.Get(ctx, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve tag %s: %v", tag, err)
+		}
+		if err := addReferencedManifests(ctx, manifestService, desc.Digest, 0, maxDepth, referenced); err != nil {
+			return nil, fmt.Errorf("failed to retrieve the manifests of tag %s: %v", tag, err)
+		}
+	}
+	return referenced, nil
+}
+
+// addReferencedManifests adds the manifest dgst, referenced by depth levels
+// of manifest lists, and the manifests it references to referenced.
+func addReferencedManifests(ctx context.Context, manifestService distribution.ManifestService, dgst digest.Digest, depth, maxDepth int, referenced map[digest.Digest]struct{}) error {
+	if _, ok := referenced[dgst]; ok {
+		return nil
+	}
+	referenced[dgst] = struct{}{}
+
+	manifest, err := manifestService.Get(ctx, dgst)
+	if err != nil {
+		if depth > 0 {
+			// The platforms of a manifest list may be missing.
+			if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("failed to retrieve manifest %s: %v", dgst, err)
+	}
+	manifestList, ok := manifest.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		return nil
+	}
+	if err := checkManifestListDepth(dgst, depth+1, maxDepth); err != nil {
+		return err
+	}
+	for _, descriptor := range manifestList.References() {
+		if err := addReferencedManifests(ctx, manifestService, descriptor.Digest, depth+1, maxDepth, referenced); err != nil {
+			return err
+		}
+	}
+	return nil
+}
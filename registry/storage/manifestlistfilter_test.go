@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFilterManifestList(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "filter/app")
+	manifests := makeManifestService(t, repo)
+	tags := repo.Tags(ctx)
+
+	platforms := []manifestlist.PlatformSpec{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "s390x"},
+		{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"},
+	}
+	var descriptors []manifestlist.ManifestDescriptor
+	for _, platform := range platforms {
+		im := uploadRandomSchema2Image(t, repo)
+		desc, err := registry.BlobStatter().Stat(ctx, im.manifestDigest)
+		if err != nil {
+			t.Fatalf("failed to stat manifest: %v", err)
+		}
+		desc.MediaType = schema2.MediaTypeManifest
+		descriptors = append(descriptors, manifestlist.ManifestDescriptor{Descriptor: desc, Platform: platform})
+	}
+
+	built, err := manifestlist.FromDescriptors(descriptors)
+	if err != nil {
+		t.Fatalf("failed to build manifest list: %v", err)
+	}
+	built.Annotations = map[string]string{"org.example.mirror": "true"}
+	payload, err := json.Marshal(built.ManifestList)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest list: %v", err)
+	}
+	list, _, err := distribution.UnmarshalManifest(manifestlist.MediaTypeManifestList, payload)
+	if err != nil {
+		t.Fatalf("failed to unmarshal manifest list: %v", err)
+	}
+	listDigest, err := manifests.Put(ctx, list)
+	if err != nil {
+		t.Fatalf("failed to put manifest list: %v", err)
+	}
+	if err := tags.Tag(ctx, "latest", distribution.Descriptor{Digest: listDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	// The arm manifest stays referenced by a tag of its own.
+	if err := tags.Tag(ctx, "arm", descriptors[2].Descriptor); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+
+	opts := ManifestListFilterOpts{
+		Repository: "filter/app",
+		Tag:        "latest",
+		Platforms:  []string{"linux/amd64", "linux/arm64"},
+	}
+
+	dryRun := opts
+	dryRun.DryRun = true
+	planned, err := FilterManifestList(ctx, registry, dryRun)
+	if err != nil {
+		t.Fatalf("unexpected error filtering manifest list: %v", err)
+	}
+	if desc, err := tags.Get(ctx, "latest"); err != nil || desc.Digest != listDigest {
+		t.Fatalf("tag updated on a dry run: %v, %v", desc.Digest, err)
+	}
+
+	result, err := FilterManifestList(ctx, registry, opts)
+	if err != nil {
+		t.Fatalf("unexpected error filtering manifest list: %v", err)
+	}
+	if result.Original != listDigest || result.Filtered != planned.Filtered {
+		t.Fatalf("unexpected result: %+v, planned %+v", result, planned)
+	}
+	if expected := []digest.Digest{descriptors[0].Digest, descriptors[1].Digest}; !reflect.DeepEqual(result.Kept, expected) {
+		t.Fatalf("unexpected kept manifests: %v != %v", result.Kept, expected)
+	}
+	if expected := []digest.Digest{descriptors[2].Digest, descriptors[3].Digest, descriptors[4].Digest}; !reflect.DeepEqual(result.Dropped, expected) {
+		t.Fatalf("unexpected dropped manifests: %v != %v", result.Dropped, expected)
+	}
+	expectedUnreferenced := []digest.Digest{descriptors[3].Digest, descriptors[4].Digest}
+	sort.Slice(expectedUnreferenced, func(i, j int) bool { return expectedUnreferenced[i] < expectedUnreferenced[j] })
+	if !reflect.DeepEqual(result.Unreferenced, expectedUnreferenced) {
+		t.Fatalf("unexpected unreferenced manifests: %v != %v", result.Unreferenced, expectedUnreferenced)
+	}
+
+	desc, err := tags.Get(ctx, "latest")
+	if err != nil {
+		t.Fatalf("failed to resolve tag: %v", err)
+	}
+	if desc.Digest != result.Filtered {
+		t.Fatalf("tag points at %s, expected %s", desc.Digest, result.Filtered)
+	}
+	fetched, err := manifests.Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("failed to fetch filtered manifest list: %v", err)
+	}
+	filtered, ok := fetched.(*manifestlist.DeserializedManifestList)
+	if !ok {
+		t.Fatalf("unexpected type for filtered manifest list: %T", fetched)
+	}
+	if mediaType, _, _ := filtered.Payload(); mediaType != manifestlist.MediaTypeManifestList {
+		t.Fatalf("unexpected media type for filtered manifest list: %s", mediaType)
+	}
+	if !reflect.DeepEqual(filtered.Manifests, descriptors[:2]) {
+		t.Fatalf("unexpected manifests in filtered list: %+v", filtered.Manifests)
+	}
+	if !reflect.DeepEqual(filtered.Annotations, built.Annotations) {
+		t.Fatalf("unexpected annotations in filtered list: %v", filtered.Annotations)
+	}
+
+	// The original list and the dropped manifests stay until collected.
+	for _, dgst := range append([]digest.Digest{listDigest}, result.Dropped...) {
+		if exists, err := manifests.Exists(ctx, dgst); err != nil || !exists {
+			t.Fatalf("manifest %s no longer reachable: %v", dgst, err)
+		}
+	}
+}
+
+func TestFilterManifestListErrors(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "filter/app")
+	im := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "image", distribution.Descriptor{Digest: im.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+
+	for _, opts := range []ManifestListFilterOpts{
+		{Repository: "filter/app", Tag: "image", Platforms: []string{"linux/amd64"}},
+		{Repository: "filter/app", Tag: "missing", Platforms: []string{"linux/amd64"}},
+		{Repository: "filter/app", Tag: "image", Platforms: []string{"linux"}},
+		{Repository: "filter/app", Tag: "image"},
+	} {
+		if _, err := FilterManifestList(ctx, registry, opts); err == nil {
+			t.Fatalf("expected an error filtering with %+v", opts)
+		}
+	}
+}
@@ -7,18 +7,41 @@ import (
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
 )
 
 // manifestListHandler is a ManifestHandler that covers schema2 manifest lists.
 type manifestListHandler struct {
-	repository distribution.Repository
-	blobStore  distribution.BlobStore
-	ctx        context.Context
+	repository          distribution.Repository
+	blobStore           distribution.BlobStore
+	ctx                 context.Context
+	driver              driver.StorageDriver
+	verificationLimiter verificationLimiter
+	// platformConfigLimit is the size of the largest config read to check
+	// the platforms of the manifests referenced, which are not checked if
+	// zero.
+	platformConfigLimit int64
+	// maxDescriptors is the number of manifests a list may reference, which
+	// is not limited if zero.
+	maxDescriptors int
 }
 
 var _ ManifestHandler = &manifestListHandler{}
 
+// MaxManifestListDescriptors returns a functional option for NewRegistry. It
+// rejects manifest lists and image indexes referencing more than n manifests.
+// Lists are not limited if n is zero.
+func MaxManifestListDescriptors(n int) RegistryOption {
+	return func(registry *registry) error {
+		if n < 0 {
+			return fmt.Errorf("max manifest list descriptors must not be negative, %d invalid", n)
+		}
+		registry.maxManifestListDescriptors = n
+		return nil
+	}
+}
+
 func (ms *manifestListHandler) Unmarshal(ctx context.Context, dgst digest.Digest, content []byte) (distribution.Manifest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestListHandler).Unmarshal")
 
@@ -53,6 +76,13 @@ func (ms *manifestListHandler) Put(ctx context.Context, manifestList distributio
 		return "", err
 	}
 
+	if m.Subject != nil {
+		if err := linkReferrer(ctx, ms.driver, ms.repository.Named().Name(), m.Subject.Digest, revision.Digest); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error linking manifest list to its subject: %v", err)
+			return "", err
+		}
+	}
+
 	return revision.Digest, nil
 }
 
@@ -67,6 +97,17 @@ func (ms *manifestListHandler) verifyManifest(ctx context.Context, mnfst manifes
 		return fmt.Errorf("unrecognized manifest list schema version %d", mnfst.SchemaVersion)
 	}
 
+	if n := len(mnfst.Manifests); ms.maxDescriptors > 0 && n > ms.maxDescriptors {
+		return distribution.ErrManifestVerification{distribution.ErrManifestListTooManyDescriptors{Count: n, Max: ms.maxDescriptors}}
+	}
+
+	if mnfst.Subject != nil {
+		// The subject need not exist, but must be a valid reference.
+		if err := mnfst.Subject.Digest.Validate(); err != nil {
+			return distribution.ErrManifestVerification{err}
+		}
+	}
+
 	if !skipDependencyVerification {
 		// This manifest service is different from the blob service
 		// returned by Blob. It uses a linked blob store to ensure that
@@ -78,7 +119,11 @@ func (ms *manifestListHandler) verifyManifest(ctx context.Context, mnfst manifes
 		}
 
 		for _, manifestDescriptor := range mnfst.References() {
+			if err := ms.verificationLimiter.acquire(ctx); err != nil {
+				return err
+			}
 			exists, err := manifestService.Exists(ctx, manifestDescriptor.Digest)
+			ms.verificationLimiter.release()
 			if err != nil && err != distribution.ErrBlobUnknown {
 				errs = append(errs, err)
 			}
@@ -87,6 +132,10 @@ func (ms *manifestListHandler) verifyManifest(ctx context.Context, mnfst manifes
 				errs = append(errs, distribution.ErrManifestBlobUnknown{Digest: manifestDescriptor.Digest})
 			}
 		}
+
+		if ms.platformConfigLimit > 0 && len(errs) == 0 {
+			errs = append(errs, ms.verifyPlatforms(ctx, manifestService, mnfst)...)
+		}
 	}
 	if len(errs) != 0 {
 		return errs
@@ -94,3 +143,27 @@ func (ms *manifestListHandler) verifyManifest(ctx context.Context, mnfst manifes
 
 	return nil
 }
+
+// verifyPlatforms checks that the configs of the image manifests the list
+// references are for the platforms the list declares them for.
+func (ms *manifestListHandler) verifyPlatforms(ctx context.Context, manifestService distribution.ManifestService, mnfst manifestlist.DeserializedManifestList) []error {
+	var errs []error
+	blobs := ms.repository.Blobs(ctx)
+	for _, desc := range mnfst.Manifests {
+		if desc.Platform.OS == "" && desc.Platform.Architecture == "" {
+			continue
+		}
+		if err := ms.verificationLimiter.acquire(ctx); err != nil {
+			return append(errs, err)
+		}
+		m, err := manifestService.Get(ctx, desc.Digest)
+		if err == nil {
+			err = verifyPlatform(ctx, blobs, desc.Digest, m, desc.Platform, ms.platformConfigLimit)
+		}
+		ms.verificationLimiter.release()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
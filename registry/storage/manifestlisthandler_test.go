@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestMaxManifestListDescriptors(t *testing.T) {
+	const limit = 4
+
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New(), MaxManifestListDescriptors(limit))
+	repo := makeRepository(t, registry, "limits/app")
+	manifests := makeManifestService(t, repo)
+	im := uploadRandomSchema2Image(t, repo)
+	desc, err := registry.BlobStatter().Stat(ctx, im.manifestDigest)
+	if err != nil {
+		t.Fatalf("failed to stat manifest: %v", err)
+	}
+	desc.MediaType = schema2.MediaTypeManifest
+
+	makeList := func(n int) *manifestlist.DeserializedManifestList {
+		var descriptors []manifestlist.ManifestDescriptor
+		for i := 0; i < n; i++ {
+			descriptors = append(descriptors, manifestlist.ManifestDescriptor{
+				Descriptor: desc,
+				Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64", Variant: string(rune('a' + i))},
+			})
+		}
+		list, err := manifestlist.FromDescriptors(descriptors)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	for _, n := range []int{2, limit} {
+		if _, err := manifests.Put(ctx, makeList(n)); err != nil {
+			t.Fatalf("unexpected error putting a list of %d manifests: %v", n, err)
+		}
+	}
+
+	list := makeList(limit + 1)
+	_, err = manifests.Put(ctx, list)
+	verificationErrs, ok := err.(distribution.ErrManifestVerification)
+	if !ok || len(verificationErrs) != 1 {
+		t.Fatalf("expected a verification error putting a list beyond the limit, got %v", err)
+	}
+	if tooMany, ok := verificationErrs[0].(distribution.ErrManifestListTooManyDescriptors); !ok || tooMany.Count != limit+1 || tooMany.Max != limit {
+		t.Fatalf("unexpected verification error %v", verificationErrs[0])
+	}
+
+	_, payload, err := list.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := im.manifestDigest.Algorithm().FromBytes(payload)
+	if exists, err := manifests.Exists(ctx, dgst); err != nil || exists {
+		t.Fatalf("list beyond the limit linked: %v, %v", exists, err)
+	}
+	if _, err := registry.BlobStatter().Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("list beyond the limit stored: %v", err)
+	}
+
+	if _, err := NewRegistry(ctx, inmemory.New(), MaxManifestListDescriptors(-1)); err == nil {
+		t.Fatal("expected an error for a negative limit")
+	}
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ManifestFallbackMediaType returns a functional option for NewRegistry. It
+// sets the media type of the stored manifests of schema version 2 which
+// lack a mediaType field and cannot be classified by their other fields.
+// It must be the media type of a schema2 or OCI manifest, or of a manifest
+// list or OCI image index. Without the option, such manifests are served as
+// OCI image manifests.
+func ManifestFallbackMediaType(mediaType string) RegistryOption {
+	return func(registry *registry) error {
+		switch mediaType {
+		case schema2.MediaTypeManifest, v1.MediaTypeImageManifest, manifestlist.MediaTypeManifestList, v1.MediaTypeImageIndex:
+			registry.manifestFallbackMediaType = mediaType
+			return nil
+		}
+		return fmt.Errorf("unsupported manifest fallback media type %q", mediaType)
+	}
+}
+
+// sniffManifestMediaType classifies the content of a manifest of schema
+// version 2 lacking a mediaType field. OCI manifests and image indexes need
+// not have one, while manifests stored by older imports may lack it. Lists
+// of manifests are told from image manifests by their manifests field, and
+// docker ones from OCI ones by the media types they reference. Content which
+// cannot be classified has the fallback media type.
+//
+// Image manifests with a docker image config are schema2 ones, since OCI
+// manifests may reference docker layers but not docker configs.
+func sniffManifestMediaType(content []byte, fallback string) string {
+	var m struct {
+		Config    *distribution.Descriptor  `json:"config"`
+		Layers    []distribution.Descriptor `json:"layers"`
+		Manifests []distribution.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(content, &m); err != nil {
+		return fallback
+	}
+
+	switch {
+	case m.Manifests != nil:
+		for _, descriptor := range m.Manifests {
+			if isDockerMediaType(descriptor.MediaType) {
+				return manifestlist.MediaTypeManifestList
+			}
+		}
+		return v1.MediaTypeImageIndex
+	case m.Config != nil || m.Layers != nil:
+		if m.Config != nil && m.Config.MediaType == schema2.MediaTypeImageConfig {
+			return schema2.MediaTypeManifest
+		}
+		return v1.MediaTypeImageManifest
+	}
+	return fallback
+}
+
+// isDockerMediaType returns whether mediaType is one of the docker image
+// format rather than the OCI one.
+func isDockerMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "application/vnd.docker.")
+}
+
+// unmarshalUntyped unmarshals the content of a manifest of schema version 2
+// lacking a mediaType field, as the type sniffManifestMediaType classifies
+// it as.
+func (ms *manifestStore) unmarshalUntyped(ctx context.Context, dgst digest.Digest, content []byte) (distribution.Manifest, error) {
+	fallback := ms.repository.registry.manifestFallbackMediaType
+	if fallback == "" {
+		fallback = v1.MediaTypeImageManifest
+	}
+
+	switch sniffManifestMediaType(content, fallback) {
+	case schema2.MediaTypeManifest:
+		return schema2.UnmarshalUntyped(content)
+	case manifestlist.MediaTypeManifestList:
+		m, err := ms.manifestListHandler.Unmarshal(ctx, dgst, content)
+		if err != nil {
+			return nil, err
+		}
+		m.(*manifestlist.DeserializedManifestList).MediaType = manifestlist.MediaTypeManifestList
+		return m, nil
+	case v1.MediaTypeImageIndex:
+		return ms.manifestListHandler.Unmarshal(ctx, dgst, content)
+	default:
+		return ms.ocischemaHandler.Unmarshal(ctx, dgst, content)
+	}
+}
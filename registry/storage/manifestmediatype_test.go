@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestUntypedManifests(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		options   []RegistryOption
+		content   string
+		mediaType string
+		check     func(interface{}) bool
+	}{
+		{
+			name: "schema2 manifest",
+			content: `{
+   "schemaVersion": 2,
+   "config": {
+      "mediaType": "application/vnd.docker.container.image.v1+json",
+      "size": 7023,
+      "digest": "sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7"
+   },
+   "layers": [
+      {
+         "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+         "size": 32654,
+         "digest": "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f"
+      }
+   ]
+}`,
+			mediaType: schema2.MediaTypeManifest,
+			check:     func(m interface{}) bool { _, ok := m.(*schema2.DeserializedManifest); return ok },
+		},
+		{
+			name: "OCI image manifest",
+			content: `{
+   "schemaVersion": 2,
+   "config": {
+      "mediaType": "application/vnd.oci.image.config.v1+json",
+      "size": 7023,
+      "digest": "sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7"
+   },
+   "layers": [
+      {
+         "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+         "size": 32654,
+         "digest": "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f"
+      }
+   ]
+}`,
+			mediaType: v1.MediaTypeImageManifest,
+			check:     func(m interface{}) bool { _, ok := m.(*ocischema.DeserializedManifest); return ok },
+		},
+		{
+			name: "OCI image index",
+			content: `{
+   "schemaVersion": 2,
+   "manifests": [
+      {
+         "mediaType": "application/vnd.oci.image.manifest.v1+json",
+         "size": 7143,
+         "digest": "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f",
+         "platform": {"architecture": "amd64", "os": "linux"}
+      }
+   ]
+}`,
+			mediaType: v1.MediaTypeImageIndex,
+			check:     func(m interface{}) bool { _, ok := m.(*manifestlist.DeserializedManifestList); return ok },
+		},
+		{
+			name: "manifest list",
+			content: `{
+   "schemaVersion": 2,
+   "manifests": [
+      {
+         "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+         "size": 7143,
+         "digest": "sha256:e692418e4cbaf90ca69d05a66403747baa33ee08806650b51fab815ad7fc331f",
+         "platform": {"architecture": "amd64", "os": "linux"}
+      }
+   ]
+}`,
+			mediaType: manifestlist.MediaTypeManifestList,
+			check:     func(m interface{}) bool { _, ok := m.(*manifestlist.DeserializedManifestList); return ok },
+		},
+		{
+			name:      "unclassified manifest",
+			content:   `{"schemaVersion": 2}`,
+			mediaType: v1.MediaTypeImageManifest,
+			check:     func(m interface{}) bool { _, ok := m.(*ocischema.DeserializedManifest); return ok },
+		},
+		{
+			name:      "unclassified manifest with a fallback",
+			options:   []RegistryOption{ManifestFallbackMediaType(schema2.MediaTypeManifest)},
+			content:   `{"schemaVersion": 2}`,
+			mediaType: schema2.MediaTypeManifest,
+			check:     func(m interface{}) bool { _, ok := m.(*schema2.DeserializedManifest); return ok },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			registry := createRegistry(t, inmemory.New(), tc.options...)
+			manifests := makeManifestService(t, makeRepository(t, registry, "test"))
+
+			// Store the content as is, as an import would have.
+			desc, err := manifests.(*manifestStore).blobStore.Put(ctx, "", []byte(tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := manifests.Get(ctx, desc.Digest)
+			if err != nil {
+				t.Fatalf("unexpected error getting manifest: %v", err)
+			}
+			if !tc.check(m) {
+				t.Fatalf("manifest unmarshaled as %T", m)
+			}
+			mediaType, payload, err := m.Payload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mediaType != tc.mediaType {
+				t.Errorf("manifest has media type %q, expected %q", mediaType, tc.mediaType)
+			}
+			if !bytes.Equal(payload, []byte(tc.content)) {
+				t.Errorf("manifest payload was not kept as stored: %s", payload)
+			}
+		})
+	}
+}
+
+func TestManifestFallbackMediaTypeInvalid(t *testing.T) {
+	if _, err := NewRegistry(context.Background(), inmemory.New(), ManifestFallbackMediaType("application/json")); err == nil {
+		t.Fatal("expected an error setting a fallback media type which is not that of a manifest")
+	}
+}
@@ -89,6 +89,20 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 		return nil, err
 	}
 
+	if _, ok := ms.repository.registry.requiredReferrer(ms.repository.Named().Name()); ok {
+		_, provisional, err := provisionalSince(ctx, ms.repository.driver, ms.repository.Named().Name(), dgst)
+		if err != nil {
+			return nil, err
+		}
+		if provisional {
+			// Not served until its required referrer is pushed.
+			return nil, distribution.ErrManifestUnknownRevision{
+				Name:     ms.repository.Named().Name(),
+				Revision: dgst,
+			}
+		}
+	}
+
 	var versioned manifest.Versioned
 	if err = json.Unmarshal(content, &versioned); err != nil {
 		return nil, err
@@ -107,17 +121,9 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 		case manifestlist.MediaTypeManifestList, v1.MediaTypeImageIndex:
 			return ms.manifestListHandler.Unmarshal(ctx, dgst, content)
 		case "":
-			// OCI image or image index - no media type in the content
-
-			// First see if it looks like an image index
-			res, err := ms.manifestListHandler.Unmarshal(ctx, dgst, content)
-			resIndex := res.(*manifestlist.DeserializedManifestList)
-			if err == nil && resIndex.Manifests != nil {
-				return resIndex, nil
-			}
-
-			// Otherwise, assume it must be an image manifest
-			return ms.ocischemaHandler.Unmarshal(ctx, dgst, content)
+			// OCI image or image index, or a manifest stored by an older
+			// import - no media type in the content
+			return ms.unmarshalUntyped(ctx, dgst, content)
 		default:
 			return nil, distribution.ErrManifestVerification{fmt.Errorf("unrecognized manifest content type %s", versioned.MediaType)}
 		}
@@ -129,24 +135,98 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 func (ms *manifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Put")
 
+	var handler ManifestHandler
 	switch manifest.(type) {
 	case *schema1.SignedManifest:
-		return ms.schema1Handler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.schema1Handler
 	case *schema2.DeserializedManifest:
-		return ms.schema2Handler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.schema2Handler
 	case *ocischema.DeserializedManifest:
-		return ms.ocischemaHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.ocischemaHandler
 	case *manifestlist.DeserializedManifestList:
-		return ms.manifestListHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.manifestListHandler
+	default:
+		return "", fmt.Errorf("unrecognized manifest type %T", manifest)
+	}
+
+	if limit := ms.repository.registry.platformConfigLimit; limit > 0 && !ms.skipDependencyVerification {
+		for _, option := range options {
+			if opt, ok := option.(platformOption); ok {
+				if err := ms.verifyPlatform(ctx, manifest, opt.platform, limit); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	rr, requiresReferrer := ms.repository.registry.requiredReferrer(ms.repository.Named().Name())
+	var existed bool
+	if requiresReferrer {
+		_, payload, err := manifest.Payload()
+		if err != nil {
+			return "", err
+		}
+		if existed, err = ms.Exists(ctx, digest.FromBytes(payload)); err != nil {
+			return "", err
+		}
+	}
+
+	revision, err := handler.Put(ctx, manifest, ms.skipDependencyVerification)
+	if err != nil {
+		return "", err
 	}
 
-	return "", fmt.Errorf("unrecognized manifest type %T", manifest)
+	if requiresReferrer {
+		if err := requireReferrer(ctx, ms.repository.driver, ms.repository.Named().Name(), rr, manifest, revision, existed); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error checking the required referrer of manifest: %v", err)
+			return "", err
+		}
+	}
+
+	if index := ms.repository.registry.annotationIndex; len(index) > 0 {
+		if err := index.link(ctx, ms.repository.driver, ms.repository.Named().Name(), revision, manifestAnnotations(manifest)); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error indexing manifest annotations: %v", err)
+			return "", err
+		}
+	}
+
+	return revision, nil
 }
 
-// Delete removes the revision of the specified manifest.
+// verifyPlatform checks that the config of the image manifest put is for
+// the platform it was declared for.
+func (ms *manifestStore) verifyPlatform(ctx context.Context, manifest distribution.Manifest, platform manifestlist.PlatformSpec, limit int64) error {
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return err
+	}
+	if err := verifyPlatform(ctx, ms.repository.Blobs(ctx), digest.FromBytes(payload), manifest, platform, limit); err != nil {
+		return distribution.ErrManifestVerification{err}
+	}
+	return nil
+}
+
+// Delete removes the revision of the specified manifest, and its links from
+// the annotation index.
 func (ms *manifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Delete")
-	return ms.blobStore.Delete(ctx, dgst)
+
+	index := ms.repository.registry.annotationIndex
+	if len(index) == 0 {
+		return ms.blobStore.Delete(ctx, dgst)
+	}
+
+	// The annotations are read before the revision is unlinked, after
+	// which the manifest can no longer be read from the repository. A
+	// manifest which cannot be read is left to Delete to report.
+	annotations, err := storedAnnotations(ctx, ms.blobStore, dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Debugf("error reading annotations of deleted manifest: %v", err)
+	}
+	if err := ms.blobStore.Delete(ctx, dgst); err != nil {
+		return err
+	}
+	return index.unlink(ctx, ms.repository.driver, ms.repository.Named().Name(), dgst, annotations)
 }
 
 func (ms *manifestStore) Enumerate(ctx context.Context, ingester func(digest.Digest) error) error {
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+// negativeBlobGenerations is the number of generations blobs are spread
+// across by digest.
+const negativeBlobGenerations = 256
+
+// negativeBlobCache holds the blobs recently found absent from repositories,
+// keyed by digest, so that repeated existence probes do not reach the
+// storage. Entries are dropped once the blob is linked into a repository by
+// the registry, and expire after ttl, in case it is linked by another
+// registry sharing the storage.
+type negativeBlobCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	blobs     map[digest.Digest]map[string]time.Time
+	lastSweep time.Time
+	// generations change whenever a blob whose digest they are picked by is
+	// linked. A lookup only populates the cache if no blob of its generation
+	// was linked since it started reading the storage, or it could cache
+	// the blob as absent right after its upload.
+	generations [negativeBlobGenerations]uint64
+}
+
+func newNegativeBlobCache(ttl time.Duration) *negativeBlobCache {
+	return &negativeBlobCache{
+		ttl:       ttl,
+		blobs:     make(map[digest.Digest]map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func negativeBlobGeneration(dgst digest.Digest) int {
+	h := fnv.New32a()
+	h.Write([]byte(dgst))
+	return int(h.Sum32() % negativeBlobGenerations)
+}
+
+// generation returns the current generation of dgst, to be passed back when
+// populating the cache.
+func (nc *negativeBlobCache) generation(dgst digest.Digest) uint64 {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.generations[negativeBlobGeneration(dgst)]
+}
+
+// absent reports whether dgst was recently found absent from the repository
+// name.
+func (nc *negativeBlobCache) absent(name string, dgst digest.Digest) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	expires, ok := nc.blobs[dgst][name]
+	return ok && time.Now().Before(expires)
+}
+
+func (nc *negativeBlobCache) setAbsent(name string, dgst digest.Digest, generation uint64) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.generations[negativeBlobGeneration(dgst)] != generation {
+		return
+	}
+	repositories, ok := nc.blobs[dgst]
+	if !ok {
+		repositories = make(map[string]time.Time)
+		nc.blobs[dgst] = repositories
+	}
+	repositories[name] = time.Now().Add(nc.ttl)
+	nc.sweep()
+}
+
+// invalidate drops dgst from the cache, for every repository. It is called
+// once the blob is linked into a repository.
+func (nc *negativeBlobCache) invalidate(dgst digest.Digest) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.generations[negativeBlobGeneration(dgst)]++
+	delete(nc.blobs, dgst)
+}
+
+// sweep drops the expired entries, at most once per ttl so that the cache
+// only holds the blobs probed within the last two ttls. The cache must be
+// locked.
+func (nc *negativeBlobCache) sweep() {
+	now := time.Now()
+	if now.Sub(nc.lastSweep) < nc.ttl {
+		return
+	}
+	nc.lastSweep = now
+
+	for dgst, repositories := range nc.blobs {
+		for name, expires := range repositories {
+			if now.After(expires) {
+				delete(repositories, name)
+			}
+		}
+		if len(repositories) == 0 {
+			delete(nc.blobs, dgst)
+		}
+	}
+}
+
+// negativeCachedBlobStatter is a blob descriptor service of a repository
+// caching the blobs found absent in a negativeBlobCache.
+type negativeCachedBlobStatter struct {
+	distribution.BlobDescriptorService
+	cache      *negativeBlobCache
+	repository string
+}
+
+var _ distribution.BlobDescriptorService = &negativeCachedBlobStatter{}
+
+func (ns *negativeCachedBlobStatter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	if ns.cache.absent(ns.repository, dgst) {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	generation := ns.cache.generation(dgst)
+	desc, err := ns.BlobDescriptorService.Stat(ctx, dgst)
+	if err == distribution.ErrBlobUnknown {
+		ns.cache.setAbsent(ns.repository, dgst, generation)
+	}
+	return desc, err
+}
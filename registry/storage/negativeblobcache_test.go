@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// layerLinkDriver counts the reads of the layer links of repositories, and
+// stalls the next one after reading it, until released.
+type layerLinkDriver struct {
+	driver.StorageDriver
+
+	mu      sync.Mutex
+	reads   int
+	stall   chan struct{}
+	stalled chan struct{}
+}
+
+func (d *layerLinkDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	if !strings.Contains(path, "/_layers/") {
+		return content, err
+	}
+
+	d.mu.Lock()
+	d.reads++
+	stall := d.stall
+	d.stall = nil
+	d.mu.Unlock()
+	if stall != nil {
+		d.stalled <- struct{}{}
+		<-stall
+	}
+	return content, err
+}
+
+func (d *layerLinkDriver) linkReads() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reads
+}
+
+type negativeBlobCacheTestEnv struct {
+	ctx      context.Context
+	driver   *layerLinkDriver
+	registry distribution.Namespace
+}
+
+func newNegativeBlobCacheTestEnv(t *testing.T, ttl time.Duration) *negativeBlobCacheTestEnv {
+	ctx := context.Background()
+	d := &layerLinkDriver{StorageDriver: inmemory.New(), stalled: make(chan struct{})}
+	reg, err := NewRegistry(ctx, d, BlobDescriptorNegativeCache(ttl))
+	if err != nil {
+		t.Fatalf("failed to construct registry: %v", err)
+	}
+	return &negativeBlobCacheTestEnv{ctx: ctx, driver: d, registry: reg}
+}
+
+func (env *negativeBlobCacheTestEnv) blobs(t *testing.T, name string) distribution.BlobStore {
+	t.Helper()
+	named, _ := reference.WithName(name)
+	repo, err := env.registry.Repository(env.ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+	return repo.Blobs(env.ctx)
+}
+
+func (env *negativeBlobCacheTestEnv) expectAbsent(t *testing.T, blobs distribution.BlobStore, dgst digest.Digest) {
+	t.Helper()
+	if _, err := blobs.Stat(env.ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("unexpected error stating absent blob: %v", err)
+	}
+}
+
+func (env *negativeBlobCacheTestEnv) expectFound(t *testing.T, blobs distribution.BlobStore, dgst digest.Digest) {
+	t.Helper()
+	desc, err := blobs.Stat(env.ctx, dgst)
+	if err != nil {
+		t.Fatalf("failed to stat blob: %v", err)
+	}
+	if desc.Digest != dgst {
+		t.Fatalf("stated blob %s, expected %s", desc.Digest, dgst)
+	}
+}
+
+func TestNegativeBlobCacheHit(t *testing.T) {
+	env := newNegativeBlobCacheTestEnv(t, 100*time.Millisecond)
+	blobs := env.blobs(t, "cached/repo")
+	dgst := digest.FromString("absent")
+
+	env.expectAbsent(t, blobs, dgst)
+	reads := env.driver.linkReads()
+	if reads == 0 {
+		t.Fatal("absent blob not looked up in storage")
+	}
+
+	// Probed again, the blob is reported absent from the cache, until its
+	// entry expires.
+	env.expectAbsent(t, blobs, dgst)
+	env.expectAbsent(t, env.blobs(t, "cached/repo"), dgst)
+	if env.driver.linkReads() != reads {
+		t.Fatal("absent blob looked up in storage again")
+	}
+
+	// Absence is cached by repository.
+	env.expectAbsent(t, env.blobs(t, "cached/other"), dgst)
+	if env.driver.linkReads() == reads {
+		t.Fatal("blob absent from another repository not looked up in storage")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	reads = env.driver.linkReads()
+	env.expectAbsent(t, blobs, dgst)
+	if env.driver.linkReads() == reads {
+		t.Fatal("expired absent blob not looked up in storage")
+	}
+}
+
+func TestNegativeBlobCacheInvalidation(t *testing.T) {
+	env := newNegativeBlobCacheTestEnv(t, time.Hour)
+	blobs := env.blobs(t, "cached/repo")
+
+	// Put.
+	content := []byte("put")
+	dgst := digest.FromBytes(content)
+	env.expectAbsent(t, blobs, dgst)
+	if _, err := blobs.Put(env.ctx, "application/octet-stream", content); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	env.expectFound(t, blobs, dgst)
+
+	// Upload.
+	content = []byte("uploaded")
+	dgst = digest.FromBytes(content)
+	env.expectAbsent(t, blobs, dgst)
+	wr, err := blobs.Create(env.ctx)
+	if err != nil {
+		t.Fatalf("failed to start upload: %v", err)
+	}
+	if _, err := wr.Write(content); err != nil {
+		t.Fatalf("failed to write upload: %v", err)
+	}
+	if _, err := wr.Commit(env.ctx, distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("failed to commit upload: %v", err)
+	}
+	env.expectFound(t, blobs, dgst)
+
+	// Cross repository mount.
+	other := env.blobs(t, "cached/other")
+	env.expectAbsent(t, other, dgst)
+	source, _ := reference.WithName("cached/repo")
+	canonical, _ := reference.WithDigest(source, dgst)
+	_, err = other.Create(env.ctx, WithMountFrom(canonical))
+	if ebm, ok := err.(distribution.ErrBlobMounted); !ok {
+		t.Fatalf("failed to mount blob: %v", err)
+	} else if ebm.Descriptor.Digest != dgst {
+		t.Fatalf("mounted blob %s, expected %s", ebm.Descriptor.Digest, dgst)
+	}
+	env.expectFound(t, other, dgst)
+}
+
+// TestNegativeBlobCacheUploadDuringLookup checks that a blob is never reported
+// absent once its upload returned, even if a lookup which found it absent
+// populates the cache afterwards.
+func TestNegativeBlobCacheUploadDuringLookup(t *testing.T) {
+	env := newNegativeBlobCacheTestEnv(t, time.Hour)
+	blobs := env.blobs(t, "cached/repo")
+	content := []byte("uploaded")
+	dgst := digest.FromBytes(content)
+
+	release := make(chan struct{})
+	env.driver.mu.Lock()
+	env.driver.stall = release
+	env.driver.mu.Unlock()
+
+	looked := make(chan struct{})
+	go func() {
+		defer close(looked)
+		blobs.Stat(env.ctx, dgst)
+	}()
+	<-env.driver.stalled
+
+	if _, err := blobs.Put(env.ctx, "application/octet-stream", content); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	close(release)
+	<-looked
+
+	env.expectFound(t, blobs, dgst)
+	stored, err := blobs.Get(env.ctx, dgst)
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+}
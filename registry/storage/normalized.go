@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// LinkNormalizedManifest records that the manifest pushed to the named
+// repository with the digest original was stored as the revision normalized,
+// having been converted to another format.
+func LinkNormalizedManifest(ctx context.Context, driver storagedriver.StorageDriver, name string, original, normalized digest.Digest) error {
+	linkPath, err := pathFor(manifestNormalizedLinkPathSpec{
+		name:     name,
+		original: original,
+	})
+	if err != nil {
+		return err
+	}
+	return driver.PutContent(ctx, linkPath, []byte(normalized))
+}
+
+// NormalizedManifest returns the revision the manifest pushed to the named
+// repository with the digest original was stored as, recorded by
+// LinkNormalizedManifest. It returns distribution.ErrManifestUnknownRevision
+// if the manifest was not converted.
+func NormalizedManifest(ctx context.Context, driver storagedriver.StorageDriver, name string, original digest.Digest) (digest.Digest, error) {
+	linkPath, err := pathFor(manifestNormalizedLinkPathSpec{
+		name:     name,
+		original: original,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	content, err := driver.GetContent(ctx, linkPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return "", distribution.ErrManifestUnknownRevision{Name: name, Revision: original}
+		}
+		return "", err
+	}
+
+	normalized, err := digest.Parse(strings.TrimSpace(string(content)))
+	if err != nil {
+		return "", err
+	}
+	return normalized, nil
+}
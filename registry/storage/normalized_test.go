@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestNormalizedManifestLink(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	original := digest.FromString("pushed")
+	normalized := digest.FromString("stored")
+
+	if _, err := NormalizedManifest(ctx, d, "test", original); err == nil {
+		t.Fatal("expected an error looking up a manifest which was not normalized")
+	} else if _, ok := err.(distribution.ErrManifestUnknownRevision); !ok {
+		t.Fatalf("unexpected error looking up a manifest which was not normalized: %v", err)
+	}
+
+	if err := LinkNormalizedManifest(ctx, d, "test", original, normalized); err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := NormalizedManifest(ctx, d, "test", original)
+	if err != nil {
+		t.Fatalf("unexpected error looking up normalized manifest: %v", err)
+	}
+	if dgst != normalized {
+		t.Fatalf("manifest normalized to %s, expected %s", dgst, normalized)
+	}
+
+	// Links are kept per repository.
+	if _, err := NormalizedManifest(ctx, d, "other", original); err == nil {
+		t.Fatal("expected the manifest not to be normalized in another repository")
+	}
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociLayoutIndex is the index.json of an OCI image layout.
+type ociLayoutIndex struct {
+	SchemaVersion int                       `json:"schemaVersion"`
+	MediaType     string                    `json:"mediaType"`
+	Manifests     []distribution.Descriptor `json:"manifests"`
+}
+
+// ociLayoutExporter collects the content of an OCI image layout, each
+// manifest and blob once however many manifests reference it.
+type ociLayoutExporter struct {
+	repository distribution.Repository
+	manifests  distribution.ManifestService
+	maxDepth   int
+
+	seen     map[digest.Digest]distribution.Descriptor
+	payloads [][]byte
+	// blobs are in the order they are first referenced.
+	blobs []distribution.Descriptor
+}
+
+// ExportOCILayout writes the tags of the repository to w as a tar stream of
+// an OCI image layout, exporting every tag if tags is empty. The index of the
+// layout references the manifest of each tag, annotated with the tag as its
+// reference name. The manifests of the platforms of manifest lists are
+// exported along with the lists, and every blob referenced by an exported
+// manifest is written once. Foreign layers missing from storage are left out,
+// as they are pulled from their URLs. Manifest lists nested beyond maxDepth
+// levels, DefaultMaxManifestListDepth if zero, are not exported.
+func ExportOCILayout(ctx context.Context, repository distribution.Repository, tags []string, maxDepth int, w io.Writer) error {
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	tagService := repository.Tags(ctx)
+	if len(tags) == 0 {
+		tags, err = tagService.All(ctx)
+		if err != nil {
+			return err
+		}
+		sort.Strings(tags)
+	}
+
+	e := &ociLayoutExporter{
+		repository: repository,
+		manifests:  manifests,
+		maxDepth:   maxDepth,
+		seen:       make(map[digest.Digest]distribution.Descriptor),
+	}
+	index := ociLayoutIndex{
+		SchemaVersion: 2,
+		MediaType:     v1.MediaTypeImageIndex,
+	}
+	for _, tag := range tags {
+		desc, err := tagService.Get(ctx, tag)
+		if err != nil {
+			return err
+		}
+		desc, err = e.addManifest(ctx, desc.Digest, 0)
+		if err != nil {
+			return fmt.Errorf("failed to export tag %s: %v", tag, err)
+		}
+		desc.Annotations = map[string]string{v1.AnnotationRefName: tag}
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeLayoutFile(tw, v1.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+	if err := writeLayoutFile(tw, "index.json", indexJSON); err != nil {
+		return err
+	}
+	if err := e.writeBlobs(ctx, tw); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// addManifest adds the manifest with the digest dgst, referenced by depth
+// levels of manifest lists, and the manifests and blobs it references, to the
+// layout, returning its descriptor.
+func (e *ociLayoutExporter) addManifest(ctx context.Context, dgst digest.Digest, depth int) (distribution.Descriptor, error) {
+	if desc, ok := e.seen[dgst]; ok {
+		return desc, nil
+	}
+
+	m, err := e.manifests.Get(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	if digest.FromBytes(payload) != dgst {
+		return distribution.Descriptor{}, fmt.Errorf("payload of manifest %s does not match its digest", dgst)
+	}
+	desc := distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(payload)),
+		Digest:    dgst,
+	}
+	e.seen[dgst] = desc
+	e.payloads = append(e.payloads, payload)
+
+	if _, ok := m.(*manifestlist.DeserializedManifestList); ok {
+		if err := checkManifestListDepth(dgst, depth+1, e.maxDepth); err != nil {
+			return distribution.Descriptor{}, err
+		}
+		for _, ref := range m.References() {
+			if _, err := e.addManifest(ctx, ref.Digest, depth+1); err != nil {
+				return distribution.Descriptor{}, err
+			}
+		}
+		return desc, nil
+	}
+
+	for _, ref := range m.References() {
+		if err := e.addBlob(ctx, ref); err != nil {
+			return distribution.Descriptor{}, err
+		}
+	}
+	return desc, nil
+}
+
+// addBlob adds the blob described by ref to the layout.
+func (e *ociLayoutExporter) addBlob(ctx context.Context, ref distribution.Descriptor) error {
+	if _, ok := e.seen[ref.Digest]; ok {
+		return nil
+	}
+	desc, err := e.repository.Blobs(ctx).Stat(ctx, ref.Digest)
+	if err == distribution.ErrBlobUnknown && len(ref.URLs) > 0 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat blob %s: %v", ref.Digest, err)
+	}
+	e.seen[ref.Digest] = desc
+	e.blobs = append(e.blobs, desc)
+	return nil
+}
+
+// writeBlobs writes the manifests and blobs of the layout to tw, under the
+// directories of their digest algorithms.
+func (e *ociLayoutExporter) writeBlobs(ctx context.Context, tw *tar.Writer) error {
+	dirs := make(map[digest.Algorithm]bool)
+	writeDir := func(dgst digest.Digest) error {
+		if dirs[dgst.Algorithm()] {
+			return nil
+		}
+		if len(dirs) == 0 {
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "blobs/", Mode: 0755}); err != nil {
+				return err
+			}
+		}
+		dirs[dgst.Algorithm()] = true
+		return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: path.Join("blobs", dgst.Algorithm().String()) + "/", Mode: 0755})
+	}
+
+	for _, payload := range e.payloads {
+		dgst := digest.FromBytes(payload)
+		if err := writeDir(dgst); err != nil {
+			return err
+		}
+		if err := writeLayoutFile(tw, ociLayoutBlobPath(dgst), payload); err != nil {
+			return err
+		}
+	}
+
+	blobs := e.repository.Blobs(ctx)
+	for _, desc := range e.blobs {
+		if err := writeDir(desc.Digest); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     ociLayoutBlobPath(desc.Digest),
+			Mode:     0644,
+			Size:     desc.Size,
+		}); err != nil {
+			return err
+		}
+		rc, err := blobs.Open(ctx, desc.Digest)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, rc, desc.Size)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to export blob %s: %v", desc.Digest, err)
+		}
+	}
+	return nil
+}
+
+// ociLayoutBlobPath returns the path of the blob with the digest dgst in an
+// OCI image layout.
+func ociLayoutBlobPath(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// writeLayoutFile writes a file of the layout with the content p to tw.
+func writeLayoutFile(tw *tar.Writer, name string, p []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(p)),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(p)
+	return err
+}
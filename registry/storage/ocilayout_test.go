@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestExportOCILayout(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "export/app")
+	manifests := makeManifestService(t, repo)
+	tags := repo.Tags(ctx)
+
+	amd64 := uploadRandomSchema2Image(t, repo)
+	arm64 := uploadRandomSchema2Image(t, repo)
+	list, err := testutil.MakeManifestList(registry.BlobStatter(), []digest.Digest{amd64.manifestDigest, arm64.manifestDigest})
+	if err != nil {
+		t.Fatalf("failed to make manifest list: %v", err)
+	}
+	listDigest, err := manifests.Put(ctx, list)
+	if err != nil {
+		t.Fatalf("failed to put manifest list: %v", err)
+	}
+	if err := tags.Tag(ctx, "latest", distribution.Descriptor{Digest: listDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	// The amd64 image is also tagged on its own, sharing its content with the
+	// list.
+	if err := tags.Tag(ctx, "amd64", distribution.Descriptor{Digest: amd64.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	// Images which are not exported stay out of the layout.
+	other := uploadRandomSchema2Image(t, repo)
+	if err := tags.Tag(ctx, "other", distribution.Descriptor{Digest: other.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportOCILayout(ctx, repo, []string{"latest", "amd64"}, 0, &buf); err != nil {
+		t.Fatalf("unexpected error exporting layout: %v", err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read layout: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if _, ok := files[hdr.Name]; ok {
+			t.Fatalf("%s written more than once", hdr.Name)
+		}
+		p, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", hdr.Name, err)
+		}
+		files[hdr.Name] = p
+	}
+
+	var layout v1.ImageLayout
+	if err := json.Unmarshal(files["oci-layout"], &layout); err != nil || layout.Version != v1.ImageLayoutVersion {
+		t.Fatalf("unexpected oci-layout %q: %v", files["oci-layout"], err)
+	}
+
+	var index ociLayoutIndex
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatalf("failed to decode index.json: %v", err)
+	}
+	if index.SchemaVersion != 2 || len(index.Manifests) != 2 {
+		t.Fatalf("unexpected index: %s", files["index.json"])
+	}
+	expected := map[string]digest.Digest{"latest": listDigest, "amd64": amd64.manifestDigest}
+	for _, desc := range index.Manifests {
+		tag := desc.Annotations[v1.AnnotationRefName]
+		if desc.Digest != expected[tag] {
+			t.Fatalf("tag %q exported as %s, expected %s", tag, desc.Digest, expected[tag])
+		}
+		if tag == "latest" && desc.MediaType != manifestlist.MediaTypeManifestList {
+			t.Fatalf("manifest list exported with media type %s", desc.MediaType)
+		}
+	}
+
+	// Every blob matches its digest, and every blob of the exported images
+	// is present.
+	for name, p := range files {
+		if !strings.HasPrefix(name, "blobs/") {
+			continue
+		}
+		dgst := digest.Digest(strings.Replace(strings.TrimPrefix(name, "blobs/"), "/", ":", 1))
+		if digest.FromBytes(p) != dgst {
+			t.Fatalf("content of %s does not match its digest", name)
+		}
+	}
+	want := map[digest.Digest]bool{listDigest: true, amd64.manifestDigest: true, arm64.manifestDigest: true}
+	for _, im := range []image{amd64, arm64} {
+		// The images share their config.
+		for _, ref := range im.manifest.References() {
+			want[ref.Digest] = true
+		}
+	}
+	for dgst := range want {
+		if _, ok := files[ociLayoutBlobPath(dgst)]; !ok {
+			t.Fatalf("blob %s missing from the layout", dgst)
+		}
+	}
+	// The layout holds oci-layout, index.json and the wanted blobs only.
+	if len(files) != len(want)+2 {
+		t.Fatalf("layout holds %d files, expected %d", len(files), len(want)+2)
+	}
+	if _, ok := files[ociLayoutBlobPath(other.manifestDigest)]; ok {
+		t.Fatal("manifest of a tag not exported is in the layout")
+	}
+}
+
+func TestExportOCILayoutAllTags(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "export/all")
+	for _, tag := range []string{"b", "a"} {
+		im := uploadRandomSchema2Image(t, repo)
+		if err := repo.Tags(ctx).Tag(ctx, tag, distribution.Descriptor{Digest: im.manifestDigest}); err != nil {
+			t.Fatalf("failed to tag: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ExportOCILayout(ctx, repo, nil, 0, &buf); err != nil {
+		t.Fatalf("unexpected error exporting layout: %v", err)
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("index.json missing from the layout: %v", err)
+		}
+		if hdr.Name != "index.json" {
+			continue
+		}
+		var index ociLayoutIndex
+		if err := json.NewDecoder(tr).Decode(&index); err != nil {
+			t.Fatalf("failed to decode index.json: %v", err)
+		}
+		if len(index.Manifests) != 2 || index.Manifests[0].Annotations[v1.AnnotationRefName] != "a" || index.Manifests[1].Annotations[v1.AnnotationRefName] != "b" {
+			t.Fatalf("unexpected index exporting all tags: %+v", index.Manifests)
+		}
+		return
+	}
+}
+
+func TestExportOCILayoutUnknownTag(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "export/unknown")
+	if err := ExportOCILayout(ctx, repo, []string{"missing"}, 0, ioutil.Discard); err == nil {
+		t.Fatal("expected an error exporting an unknown tag")
+	}
+}
@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociLayoutMaxManifestSize is the size of the largest manifest imported from
+// an OCI image layout, that of the largest the registry accepts pushed.
+const ociLayoutMaxManifestSize = 4 << 20
+
+// ociLayoutImporter imports the content of an OCI image layout into a
+// repository.
+type ociLayoutImporter struct {
+	blobs     distribution.BlobStore
+	manifests distribution.ManifestService
+	maxDepth  int
+
+	// payloads holds the content of the blobs of the layout which may be
+	// manifests, until they are imported as manifests or blobs.
+	payloads map[digest.Digest][]byte
+	imported map[digest.Digest]bool
+}
+
+// ImportOCILayout imports the OCI image layout read from r as a tar stream
+// into the repository, as written by ExportOCILayout. Every blob is checked
+// against its digest as it is read, and uploaded unless the repository has
+// it. The manifests the index of the layout references are then stored,
+// along with the manifests of the platforms of manifest lists, and tagged.
+//
+// The manifests are tagged with their reference names in the index if
+// tagMapping is nil. Otherwise, tagMapping maps the reference names to the
+// tags to apply, and the manifests with reference names it lacks are stored
+// untagged. Content the repository already has is left as is, so an import
+// which failed part way through may be run again to complete it. Layouts with
+// manifest lists nested beyond maxDepth levels, DefaultMaxManifestListDepth if
+// zero, are rejected.
+func ImportOCILayout(ctx context.Context, repository distribution.Repository, r io.Reader, tagMapping map[string]string, maxDepth int) error {
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	im := &ociLayoutImporter{
+		blobs:     repository.Blobs(ctx),
+		manifests: manifests,
+		maxDepth:  maxDepth,
+		payloads:  make(map[digest.Digest][]byte),
+		imported:  make(map[digest.Digest]bool),
+	}
+
+	var layout *v1.ImageLayout
+	var index *ociLayoutIndex
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read layout: %v", err)
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		switch {
+		case name == v1.ImageLayoutFile:
+			layout = new(v1.ImageLayout)
+			if err := json.NewDecoder(tr).Decode(layout); err != nil {
+				return fmt.Errorf("failed to decode %s: %v", v1.ImageLayoutFile, err)
+			}
+			if layout.Version != v1.ImageLayoutVersion {
+				return fmt.Errorf("unsupported image layout version %q", layout.Version)
+			}
+		case name == "index.json":
+			index = new(ociLayoutIndex)
+			if err := json.NewDecoder(io.LimitReader(tr, ociLayoutMaxManifestSize)).Decode(index); err != nil {
+				return fmt.Errorf("failed to decode index.json: %v", err)
+			}
+		case strings.HasPrefix(name, "blobs/"):
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 {
+				return fmt.Errorf("unexpected blob path %s", hdr.Name)
+			}
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+			if err := dgst.Validate(); err != nil {
+				return fmt.Errorf("invalid blob path %s: %v", hdr.Name, err)
+			}
+			if err := im.readBlob(ctx, dgst, hdr.Size, tr); err != nil {
+				return err
+			}
+		}
+	}
+	if layout == nil {
+		return fmt.Errorf("not an OCI image layout: %s missing", v1.ImageLayoutFile)
+	}
+	if index == nil {
+		return fmt.Errorf("not an OCI image layout: index.json missing")
+	}
+
+	tags, err := ociLayoutTags(repository.Named(), index, tagMapping)
+	if err != nil {
+		return err
+	}
+	for _, desc := range index.Manifests {
+		if err := im.importManifest(ctx, desc, 0); err != nil {
+			return err
+		}
+	}
+	// The blobs which turned out not to be manifests are uploaded as such.
+	for dgst, p := range im.payloads {
+		if err := im.putBlob(ctx, dgst, bytes.NewReader(p)); err != nil {
+			return err
+		}
+	}
+
+	tagService := repository.Tags(ctx)
+	for i, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		if err := tagService.Tag(ctx, tag, index.Manifests[i]); err != nil {
+			return fmt.Errorf("failed to tag %s: %v", tag, err)
+		}
+	}
+	return nil
+}
+
+// ociLayoutTags returns the tags to apply to the manifests of the index of a
+// layout imported into the named repository, empty for those left untagged.
+func ociLayoutTags(named reference.Named, index *ociLayoutIndex, tagMapping map[string]string) ([]string, error) {
+	tags := make([]string, len(index.Manifests))
+	mapped := make(map[string]bool)
+	for i, desc := range index.Manifests {
+		refName := desc.Annotations[v1.AnnotationRefName]
+		tag := refName
+		if tagMapping != nil {
+			tag = tagMapping[refName]
+			mapped[refName] = true
+		}
+		if tag == "" {
+			continue
+		}
+		if _, err := reference.WithTag(named, tag); err != nil {
+			return nil, fmt.Errorf("invalid tag %q for reference name %q: %v", tag, refName, err)
+		}
+		tags[i] = tag
+	}
+	for refName := range tagMapping {
+		if !mapped[refName] {
+			return nil, fmt.Errorf("reference name %q not in the index of the layout", refName)
+		}
+	}
+	return tags, nil
+}
+
+// readBlob reads the blob with the digest dgst of the layout from r. Blobs
+// which may be manifests are kept until the manifests are imported, while
+// the others are uploaded.
+func (im *ociLayoutImporter) readBlob(ctx context.Context, dgst digest.Digest, size int64, r io.Reader) error {
+	if size > ociLayoutMaxManifestSize {
+		return im.putBlob(ctx, dgst, r)
+	}
+
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %v", dgst, err)
+	}
+	if dgst.Algorithm().FromBytes(p) != dgst {
+		return fmt.Errorf("content of blob %s does not match its digest", dgst)
+	}
+	var versioned struct {
+		SchemaVersion *int `json:"schemaVersion"`
+	}
+	if json.Unmarshal(p, &versioned) == nil && versioned.SchemaVersion != nil {
+		im.payloads[dgst] = p
+		return nil
+	}
+	return im.putBlob(ctx, dgst, bytes.NewReader(p))
+}
+
+// putBlob uploads the blob with the digest dgst read from r, unless the
+// repository already has it.
+func (im *ociLayoutImporter) putBlob(ctx context.Context, dgst digest.Digest, r io.Reader) error {
+	if _, err := im.blobs.Stat(ctx, dgst); err == nil {
+		return nil
+	} else if err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	bw, err := im.blobs.Create(ctx)
+	if err != nil {
+		return err
+	}
+	verifier := dgst.Verifier()
+	n, err := io.Copy(io.MultiWriter(bw, verifier), r)
+	if err != nil {
+		bw.Cancel(ctx)
+		return fmt.Errorf("failed to upload blob %s: %v", dgst, err)
+	}
+	if !verifier.Verified() {
+		bw.Cancel(ctx)
+		return fmt.Errorf("content of blob %s does not match its digest", dgst)
+	}
+	if _, err := bw.Commit(ctx, distribution.Descriptor{Digest: dgst, Size: n}); err != nil {
+		return fmt.Errorf("failed to upload blob %s: %v", dgst, err)
+	}
+	return nil
+}
+
+// importManifest stores the manifest described by desc, referenced by depth
+// levels of manifest lists, after the manifests and blobs it references,
+// unless the repository already has it.
+func (im *ociLayoutImporter) importManifest(ctx context.Context, desc distribution.Descriptor, depth int) error {
+	if im.imported[desc.Digest] {
+		return nil
+	}
+	p, ok := im.payloads[desc.Digest]
+	if !ok {
+		exists, err := im.manifests.Exists(ctx, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("manifest %s missing from the layout", desc.Digest)
+		}
+		im.imported[desc.Digest] = true
+		return nil
+	}
+	if desc.Size != int64(len(p)) {
+		return fmt.Errorf("manifest %s is %d bytes rather than %d", desc.Digest, len(p), desc.Size)
+	}
+
+	// The media type of the content is preferred to that the manifest is
+	// referenced with.
+	var versioned struct {
+		MediaType string `json:"mediaType"`
+	}
+	json.Unmarshal(p, &versioned)
+	mediaType := versioned.MediaType
+	if mediaType == "" {
+		mediaType = desc.MediaType
+	}
+	if mediaType == "" {
+		mediaType = sniffManifestMediaType(p, v1.MediaTypeImageManifest)
+	}
+	m, _, err := distribution.UnmarshalManifest(mediaType, p)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal manifest %s: %v", desc.Digest, err)
+	}
+	if _, ok := m.(*manifestlist.DeserializedManifestList); ok {
+		if err := checkManifestListDepth(desc.Digest, depth+1, im.maxDepth); err != nil {
+			return err
+		}
+	}
+	delete(im.payloads, desc.Digest)
+	im.imported[desc.Digest] = true
+
+	for _, ref := range m.References() {
+		if _, ok := m.(*manifestlist.DeserializedManifestList); ok {
+			if err := im.importManifest(ctx, ref, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		// A blob which looked like a manifest is uploaded with the manifest
+		// referencing it.
+		if p, ok := im.payloads[ref.Digest]; ok {
+			if err := im.putBlob(ctx, ref.Digest, bytes.NewReader(p)); err != nil {
+				return err
+			}
+			delete(im.payloads, ref.Digest)
+		}
+	}
+
+	exists, err := im.manifests.Exists(ctx, desc.Digest)
+	if err != nil || exists {
+		return err
+	}
+	dgst, err := im.manifests.Put(ctx, m)
+	if err != nil {
+		return fmt.Errorf("failed to store manifest %s: %v", desc.Digest, err)
+	}
+	if dgst != desc.Digest {
+		return fmt.Errorf("manifest %s stored as %s", desc.Digest, dgst)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// exportTestLayout exports a repository tagging a manifest list as latest
+// and one of its platforms as amd64, returning the repository and layout.
+func exportTestLayout(t *testing.T) (distribution.Repository, []byte) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "export/app")
+	manifests := makeManifestService(t, repo)
+
+	amd64 := uploadRandomSchema2Image(t, repo)
+	arm64 := uploadRandomSchema2Image(t, repo)
+	list, err := testutil.MakeManifestList(registry.BlobStatter(), []digest.Digest{amd64.manifestDigest, arm64.manifestDigest})
+	if err != nil {
+		t.Fatalf("failed to make manifest list: %v", err)
+	}
+	listDigest, err := manifests.Put(ctx, list)
+	if err != nil {
+		t.Fatalf("failed to put manifest list: %v", err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: listDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, "amd64", distribution.Descriptor{Digest: amd64.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportOCILayout(ctx, repo, nil, 0, &buf); err != nil {
+		t.Fatalf("unexpected error exporting layout: %v", err)
+	}
+	return repo, buf.Bytes()
+}
+
+// layoutBlobs returns the digests of the blobs of a layout.
+func layoutBlobs(t *testing.T, layout []byte) []digest.Digest {
+	var dgsts []digest.Digest
+	tr := tar.NewReader(bytes.NewReader(layout))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return dgsts
+		}
+		if err != nil {
+			t.Fatalf("failed to read layout: %v", err)
+		}
+		if hdr.Typeflag == tar.TypeReg && strings.HasPrefix(hdr.Name, "blobs/") {
+			dgsts = append(dgsts, digest.Digest(strings.Replace(strings.TrimPrefix(hdr.Name, "blobs/"), "/", ":", 1)))
+		}
+	}
+}
+
+// checkImported checks the tags of the source repository resolve to the
+// same digests in the destination, which has all the content of the layout.
+func checkImported(t *testing.T, src, dst distribution.Repository, tags map[string]string, layout []byte) {
+	ctx := context.Background()
+	for srcTag, dstTag := range tags {
+		want, err := src.Tags(ctx).Get(ctx, srcTag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := dst.Tags(ctx).Get(ctx, dstTag)
+		if err != nil {
+			t.Fatalf("tag %s not imported: %v", dstTag, err)
+		}
+		if got.Digest != want.Digest {
+			t.Fatalf("tag %s imported as %s, expected %s", dstTag, got.Digest, want.Digest)
+		}
+	}
+
+	manifests := makeManifestService(t, dst)
+	for _, dgst := range layoutBlobs(t, layout) {
+		if exists, _ := manifests.Exists(ctx, dgst); exists {
+			continue
+		}
+		p, err := dst.Blobs(ctx).Get(ctx, dgst)
+		if err != nil {
+			t.Fatalf("blob %s not imported: %v", dgst, err)
+		}
+		if digest.FromBytes(p) != dgst {
+			t.Fatalf("blob %s imported with the wrong content", dgst)
+		}
+	}
+}
+
+func TestImportOCILayout(t *testing.T) {
+	ctx := context.Background()
+	src, layout := exportTestLayout(t)
+	registry := createRegistry(t, inmemory.New())
+	dst := makeRepository(t, registry, "import/app")
+
+	if err := ImportOCILayout(ctx, dst, bytes.NewReader(layout), nil, 0); err != nil {
+		t.Fatalf("unexpected error importing layout: %v", err)
+	}
+	tags := map[string]string{"latest": "latest", "amd64": "amd64"}
+	checkImported(t, src, dst, tags, layout)
+
+	// Importing the layout again changes nothing.
+	if err := ImportOCILayout(ctx, dst, bytes.NewReader(layout), nil, 0); err != nil {
+		t.Fatalf("unexpected error importing layout again: %v", err)
+	}
+	checkImported(t, src, dst, tags, layout)
+}
+
+func TestImportOCILayoutTagMapping(t *testing.T) {
+	ctx := context.Background()
+	src, layout := exportTestLayout(t)
+	registry := createRegistry(t, inmemory.New())
+	dst := makeRepository(t, registry, "import/mapped")
+
+	if err := ImportOCILayout(ctx, dst, bytes.NewReader(layout), map[string]string{"latest": "v1"}, 0); err != nil {
+		t.Fatalf("unexpected error importing layout: %v", err)
+	}
+	checkImported(t, src, dst, map[string]string{"latest": "v1"}, layout)
+	if _, err := dst.Tags(ctx).Get(ctx, "amd64"); err == nil {
+		t.Fatal("reference name missing from the mapping was tagged")
+	}
+
+	for _, mapping := range []map[string]string{{"missing": "v1"}, {"latest": "not a tag"}} {
+		if err := ImportOCILayout(ctx, dst, bytes.NewReader(layout), mapping, 0); err == nil {
+			t.Fatalf("expected an error importing with the mapping %v", mapping)
+		}
+	}
+}
+
+func TestImportOCILayoutResume(t *testing.T) {
+	ctx := context.Background()
+	src, layout := exportTestLayout(t)
+	registry := createRegistry(t, inmemory.New())
+	dst := makeRepository(t, registry, "import/resumed")
+
+	if err := ImportOCILayout(ctx, dst, bytes.NewReader(layout[:len(layout)*3/4]), nil, 0); err == nil {
+		t.Fatal("expected an error importing a truncated layout")
+	}
+	if err := ImportOCILayout(ctx, dst, bytes.NewReader(layout), nil, 0); err != nil {
+		t.Fatalf("unexpected error resuming import: %v", err)
+	}
+	checkImported(t, src, dst, map[string]string{"latest": "latest", "amd64": "amd64"}, layout)
+}
+
+func TestImportOCILayoutCorruptBlob(t *testing.T) {
+	ctx := context.Background()
+	_, layout := exportTestLayout(t)
+
+	// Corrupt the last blob of the layout, a layer.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tr := tar.NewReader(bytes.NewReader(layout))
+	blobs := layoutBlobs(t, layout)
+	last := "blobs/" + strings.Replace(blobs[len(blobs)-1].String(), ":", "/", 1)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == last {
+			p[0] ^= 0xff
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(p)
+	}
+	tw.Close()
+
+	registry := createRegistry(t, inmemory.New())
+	dst := makeRepository(t, registry, "import/corrupt")
+	err := ImportOCILayout(ctx, dst, &buf, nil, 0)
+	if err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+		t.Fatalf("expected a digest mismatch importing a corrupt layout, got %v", err)
+	}
+	if _, err := dst.Blobs(ctx).Stat(ctx, blobs[len(blobs)-1]); err != distribution.ErrBlobUnknown {
+		t.Fatalf("corrupt blob was imported: %v", err)
+	}
+	if _, err := dst.Tags(ctx).Get(ctx, "latest"); err == nil {
+		t.Fatal("tag imported from a corrupt layout")
+	}
+}
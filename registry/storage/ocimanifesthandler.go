@@ -8,16 +8,21 @@ import (
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 //ocischemaManifestHandler is a ManifestHandler that covers ocischema manifests.
 type ocischemaManifestHandler struct {
-	repository   distribution.Repository
-	blobStore    distribution.BlobStore
-	ctx          context.Context
-	manifestURLs manifestURLs
+	repository              distribution.Repository
+	blobStore               distribution.BlobStore
+	ctx                     context.Context
+	manifestURLs            manifestURLs
+	layerMediaTypes         layerMediaTypes
+	artifactLayerMediaTypes layerMediaTypes
+	driver                  driver.StorageDriver
+	verificationLimiter     verificationLimiter
 }
 
 var _ ManifestHandler = &ocischemaManifestHandler{}
@@ -45,6 +50,12 @@ func (ms *ocischemaManifestHandler) Put(ctx context.Context, manifest distributi
 		return "", err
 	}
 
+	if !skipDependencyVerification {
+		if err := ms.materializeEmptyJSON(ctx, *m); err != nil {
+			return "", err
+		}
+	}
+
 	mt, payload, err := m.Payload()
 	if err != nil {
 		return "", err
@@ -56,9 +67,52 @@ func (ms *ocischemaManifestHandler) Put(ctx context.Context, manifest distributi
 		return "", err
 	}
 
+	if m.Subject != nil {
+		if err := linkReferrer(ctx, ms.driver, ms.repository.Named().Name(), m.Subject.Digest, revision.Digest); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error linking manifest to its subject: %v", err)
+			return "", err
+		}
+	}
+
 	return revision.Digest, nil
 }
 
+// materializeEmptyJSON stores the empty JSON blob in the repository if the
+// manifest references it, so that clients need not push it before the
+// manifest and may pull it afterwards.
+func (ms *ocischemaManifestHandler) materializeEmptyJSON(ctx context.Context, mnfst ocischema.DeserializedManifest) error {
+	blobsService := ms.repository.Blobs(ctx)
+
+	for _, descriptor := range mnfst.References() {
+		if !isEmptyJSON(descriptor) {
+			continue
+		}
+
+		if err := ms.verificationLimiter.acquire(ctx); err != nil {
+			return err
+		}
+		_, err := blobsService.Stat(ctx, descriptor.Digest)
+		ms.verificationLimiter.release()
+		if err == nil {
+			return nil
+		}
+		if err != distribution.ErrBlobUnknown {
+			return err
+		}
+
+		_, err = blobsService.Put(ctx, ocischema.MediaTypeEmptyJSON, ocischema.EmptyJSON)
+		return err
+	}
+
+	return nil
+}
+
+// isEmptyJSON reports whether descriptor references the empty JSON blob,
+// whatever its media type.
+func isEmptyJSON(descriptor distribution.Descriptor) bool {
+	return descriptor.Digest == ocischema.DescriptorEmptyJSON.Digest && descriptor.Size == ocischema.DescriptorEmptyJSON.Size
+}
+
 // verifyManifest ensures that the manifest content is valid from the
 // perspective of the registry. As a policy, the registry only tries to store
 // valid content, leaving trust policies of that content up to consumers.
@@ -69,6 +123,13 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 		return fmt.Errorf("unrecognized manifest schema version %d", mnfst.Manifest.SchemaVersion)
 	}
 
+	if mnfst.Subject != nil {
+		// The subject need not exist, but must be a valid reference.
+		if err := mnfst.Subject.Digest.Validate(); err != nil {
+			return distribution.ErrManifestVerification{err}
+		}
+	}
+
 	if skipDependencyVerification {
 		return nil
 	}
@@ -80,6 +141,12 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 
 	blobsService := ms.repository.Blobs(ctx)
 
+	if mnfst.IsArtifact() {
+		errs = append(errs, ms.layerMediaTypes.verifyArtifact(ms.artifactLayerMediaTypes, mnfst.Layers)...)
+	} else {
+		errs = append(errs, ms.layerMediaTypes.verify(mnfst.Layers)...)
+	}
+
 	for _, descriptor := range mnfst.References() {
 		err := descriptor.Digest.Validate()
 		if err != nil {
@@ -87,8 +154,18 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 			continue
 		}
 
+		if isEmptyJSON(descriptor) {
+			// The empty JSON blob is stored with the manifest if missing.
+			continue
+		}
+
+		if err := ms.verificationLimiter.acquire(ctx); err != nil {
+			return err
+		}
+
 		switch descriptor.MediaType {
-		case v1.MediaTypeImageLayer, v1.MediaTypeImageLayerGzip, v1.MediaTypeImageLayerNonDistributable, v1.MediaTypeImageLayerNonDistributableGzip:
+		case v1.MediaTypeImageLayer, v1.MediaTypeImageLayerGzip, ocischema.MediaTypeImageLayerZstd,
+			v1.MediaTypeImageLayerNonDistributable, v1.MediaTypeImageLayerNonDistributableGzip, ocischema.MediaTypeImageLayerNonDistributableZstd:
 			allow := ms.manifestURLs.allow
 			deny := ms.manifestURLs.deny
 			for _, u := range descriptor.URLs {
@@ -103,7 +180,7 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 				// check the presence if it is normal layer or
 				// there is no urls for non-distributable
 				if len(descriptor.URLs) == 0 ||
-					(descriptor.MediaType == v1.MediaTypeImageLayer || descriptor.MediaType == v1.MediaTypeImageLayerGzip) {
+					(descriptor.MediaType == v1.MediaTypeImageLayer || descriptor.MediaType == v1.MediaTypeImageLayerGzip || descriptor.MediaType == ocischema.MediaTypeImageLayerZstd) {
 
 					_, err = blobsService.Stat(ctx, descriptor.Digest)
 				}
@@ -125,6 +202,8 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 			_, err = blobsService.Stat(ctx, descriptor.Digest)
 		}
 
+		ms.verificationLimiter.release()
+
 		if err != nil {
 			if err != distribution.ErrBlobUnknown {
 				errs = append(errs, err)
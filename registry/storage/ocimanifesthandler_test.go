@@ -39,6 +39,24 @@ func TestVerifyOCIManifestNonDistributableLayer(t *testing.T) {
 		MediaType: v1.MediaTypeImageLayerNonDistributableGzip,
 	}
 
+	zstdLayer, err := repo.Blobs(ctx).Put(ctx, ocischema.MediaTypeImageLayerZstd, []byte("zstd layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdLayer.MediaType = ocischema.MediaTypeImageLayerZstd
+
+	missingZstdLayer := distribution.Descriptor{
+		Digest:    "sha256:b43bbb8bd6a0e3b4b2b4e6b9aa0a3d423b4a1e05cbe0fd8cf66b73e1d1f1ab9a",
+		Size:      4567,
+		MediaType: ocischema.MediaTypeImageLayerZstd,
+	}
+
+	nonDistributableZstdLayer := distribution.Descriptor{
+		Digest:    "sha256:463435349086340864309863409683460843608348608934092322395278926a",
+		Size:      6323,
+		MediaType: ocischema.MediaTypeImageLayerNonDistributableZstd,
+	}
+
 	emptyLayer := distribution.Descriptor{
 		Digest: "",
 	}
@@ -118,6 +136,41 @@ func TestVerifyOCIManifestNonDistributableLayer(t *testing.T) {
 			[]string{"https://foo/bar"},
 			nil,
 		},
+		{
+			zstdLayer,
+			nil,
+			nil,
+		},
+		{
+			zstdLayer,
+			[]string{"http://foo/bar"},
+			nil,
+		},
+		{
+			zstdLayer,
+			[]string{"http://nope/bar"},
+			errInvalidURL,
+		},
+		{
+			missingZstdLayer,
+			[]string{"http://foo/bar"},
+			distribution.ErrManifestBlobUnknown{Digest: missingZstdLayer.Digest},
+		},
+		{
+			nonDistributableZstdLayer,
+			nil,
+			distribution.ErrManifestBlobUnknown{Digest: nonDistributableZstdLayer.Digest},
+		},
+		{
+			nonDistributableZstdLayer,
+			[]string{"file:///local/file"},
+			errInvalidURL,
+		},
+		{
+			nonDistributableZstdLayer,
+			[]string{"https://foo/bar"},
+			nil,
+		},
 		{
 			emptyLayer,
 			[]string{"https://foo/empty"},
@@ -332,3 +385,210 @@ func TestVerifyOCIManifestBlobLayerAndConfig(t *testing.T) {
 		checkFn(m, c.Err)
 	}
 }
+
+func TestVerifyOCIManifestLayerMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver,
+		AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes))
+	repo := makeRepository(t, registry, "test")
+	manifestService := makeManifestService(t, repo)
+
+	config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.MediaType = v1.MediaTypeImageConfig
+
+	zstdLayer, err := repo.Blobs(ctx).Put(ctx, ocischema.MediaTypeImageLayerZstd, []byte("zstd layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdLayer.MediaType = ocischema.MediaTypeImageLayerZstd
+
+	nonDistributableLayer := distribution.Descriptor{
+		Digest:    "sha256:463435349086340864309863409683460843608348608934092322395278926a",
+		Size:      6323,
+		MediaType: v1.MediaTypeImageLayerNonDistributableGzip,
+		URLs:      []string{"https://foo/bar"},
+	}
+
+	for _, c := range []struct {
+		name    string
+		layer   distribution.Descriptor
+		allowed bool
+	}{
+		{"zstd layer", zstdLayer, true},
+		{"non-distributable layer", nonDistributableLayer, false},
+	} {
+		m := ocischema.Manifest{
+			Versioned: manifest.Versioned{
+				SchemaVersion: 2,
+				MediaType:     v1.MediaTypeImageManifest,
+			},
+			Config: config,
+			Layers: []distribution.Descriptor{c.layer},
+		}
+		dm, err := ocischema.FromStruct(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = manifestService.Put(ctx, dm)
+		if c.allowed {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+
+		verr, ok := err.(distribution.ErrManifestVerification)
+		if !ok || len(verr) != 1 {
+			t.Errorf("%s: expected a verification error, got %v", c.name, err)
+			continue
+		}
+		expected := distribution.ErrManifestLayerMediaTypeNotAllowed{Digest: c.layer.Digest, MediaType: c.layer.MediaType}
+		if verr[0] != expected {
+			t.Errorf("%s: expected %v, got %v", c.name, expected, verr[0])
+		}
+	}
+}
+
+// TestVerifyOCIArtifactLayerMediaTypes checks that artifacts may not have
+// image layers of a media type not allowed, and that their other layers may
+// be restricted separately.
+func TestVerifyOCIArtifactLayerMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	const signatureType = "application/vnd.example.signature.v1+json"
+
+	for _, c := range []struct {
+		name            string
+		artifactAllowed []string
+		layerMediaType  string
+		layerURLs       []string
+		allowed         bool
+	}{
+		{"signature layer", nil, signatureType, nil, true},
+		{"non-distributable layer", nil, v1.MediaTypeImageLayerNonDistributableGzip, []string{"https://foo/bar"}, false},
+		{"allowed signature layer", []string{signatureType}, signatureType, nil, true},
+		{"disallowed sbom layer", []string{signatureType}, "application/vnd.example.sbom.v1+json", nil, false},
+		{"image layer with artifact allowlist", []string{signatureType}, v1.MediaTypeImageLayerGzip, nil, true},
+	} {
+		inmemoryDriver := inmemory.New()
+		options := []RegistryOption{AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes)}
+		if c.artifactAllowed != nil {
+			options = append(options, AllowedArtifactLayerMediaTypes(c.artifactAllowed))
+		}
+		registry := createRegistry(t, inmemoryDriver, options...)
+		repo := makeRepository(t, registry, "test")
+		manifestService := makeManifestService(t, repo)
+
+		layer := distribution.Descriptor{
+			Digest:    "sha256:463435349086340864309863409683460843608348608934092322395278926a",
+			Size:      6323,
+			MediaType: c.layerMediaType,
+			URLs:      c.layerURLs,
+		}
+		if c.layerURLs == nil {
+			var err error
+			layer, err = repo.Blobs(ctx).Put(ctx, c.layerMediaType, []byte(c.name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			layer.MediaType = c.layerMediaType
+		}
+
+		dm, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: manifest.Versioned{
+				SchemaVersion: 2,
+				MediaType:     v1.MediaTypeImageManifest,
+			},
+			ArtifactType: "application/vnd.example.artifact.v1",
+			Config:       ocischema.DescriptorEmptyJSON,
+			Layers:       []distribution.Descriptor{layer},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = manifestService.Put(ctx, dm)
+		if c.allowed {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+
+		verr, ok := err.(distribution.ErrManifestVerification)
+		if !ok || len(verr) != 1 {
+			t.Errorf("%s: expected a verification error, got %v", c.name, err)
+			continue
+		}
+		expected := distribution.ErrManifestLayerMediaTypeNotAllowed{Digest: layer.Digest, MediaType: layer.MediaType}
+		if verr[0] != expected {
+			t.Errorf("%s: expected %v, got %v", c.name, expected, verr[0])
+		}
+	}
+}
+
+func TestVerifyOCIManifestEmptyJSONConfig(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "test")
+	manifestService := makeManifestService(t, repo)
+
+	layer, err := repo.Blobs(ctx).Put(ctx, "application/vnd.example.signature.v1+json", []byte(`{"critical":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.MediaType = "application/vnd.example.signature.v1+json"
+
+	// The empty JSON blob is not pushed, as a config and as a layer.
+	m := ocischema.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageManifest,
+		},
+		Config: ocischema.DescriptorEmptyJSON,
+		Layers: []distribution.Descriptor{layer, ocischema.DescriptorEmptyJSON},
+	}
+	dm, err := ocischema.FromStruct(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dgst, err := manifestService.Put(ctx, dm)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest with the empty JSON config: %v", err)
+	}
+
+	if _, err := manifestService.Get(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+
+	content, err := repo.Blobs(ctx).Get(ctx, ocischema.DescriptorEmptyJSON.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error getting the empty JSON blob: %v", err)
+	}
+	if string(content) != "{}" {
+		t.Fatalf("unexpected content of the empty JSON blob: %q", content)
+	}
+
+	// A descriptor with the digest of the empty JSON blob but another size
+	// is not special-cased.
+	otherRepo := makeRepository(t, registry, "other")
+	otherManifestService := makeManifestService(t, otherRepo)
+
+	m.Config.Size = 3
+	m.Layers = nil
+	dm, err = ocischema.FromStruct(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = otherManifestService.Put(ctx, dm)
+	verr, ok := err.(distribution.ErrManifestVerification)
+	if !ok || len(verr) != 1 || verr[0] != (distribution.ErrManifestBlobUnknown{Digest: ocischema.DescriptorEmptyJSON.Digest}) {
+		t.Fatalf("expected the config to be unknown, got %v", err)
+	}
+}
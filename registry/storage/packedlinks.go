@@ -0,0 +1,428 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// Storage layout versions, selecting how the links of repositories and the
+// blobs of the blob store are stored.
+const (
+	// LayoutVersionLinkFiles stores every link in a file of its own. It is
+	// the default.
+	LayoutVersionLinkFiles = 1
+
+	// LayoutVersionPackedLinks packs the layer links and the manifest
+	// revision links of each repository in a single file for each, saving
+	// the inodes and space of many tiny files. Links stored in files of
+	// their own are still read, so that an existing storage can switch to
+	// it.
+	LayoutVersionPackedLinks = 2
+
+	// LayoutVersionShardedBlobs stores links as LayoutVersionLinkFiles does,
+	// and shards the blobs of the blob store under two levels of
+	// directories rather than one, for storage with millions of blobs.
+	// Blobs stored under a single level are still read, so that an existing
+	// storage can switch to it.
+	LayoutVersionShardedBlobs = 3
+)
+
+// WithLayoutVersion returns driver, wrapped so that the registry stored with
+// it uses the given layout version.
+func WithLayoutVersion(driver storagedriver.StorageDriver, version int) (storagedriver.StorageDriver, error) {
+	switch version {
+	case 0, LayoutVersionLinkFiles:
+		return driver, nil
+	case LayoutVersionPackedLinks:
+		return newPackedLinksDriver(driver)
+	case LayoutVersionShardedBlobs:
+		return newShardedBlobsDriver(driver)
+	default:
+		return nil, fmt.Errorf("unknown storage layout version %d", version)
+	}
+}
+
+// packedLinksFile is the name of the file holding the packed links of a link
+// directory. It is hidden from listings.
+const packedLinksFile = "_packed"
+
+// packedLinksDriver stores the links under the link directories of
+// repositories, <name>/_layers and <name>/_manifests/revisions, in a file
+// within each directory. The links appear at their usual paths, as do the
+// directories holding them, so that walks over repositories are unaware of
+// the packing.
+//
+// Packed files are rewritten on every change to their links. Changes are
+// serialized within the process, so the layout must not be used by several
+// registries writing to the same storage.
+type packedLinksDriver struct {
+	storagedriver.StorageDriver
+
+	repositoriesRoot string
+	locks            [64]sync.Mutex
+}
+
+var _ storagedriver.StorageDriver = &packedLinksDriver{}
+
+func newPackedLinksDriver(driver storagedriver.StorageDriver) (*packedLinksDriver, error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	return &packedLinksDriver{StorageDriver: driver, repositoriesRoot: root}, nil
+}
+
+// linkPath is a path in a link directory. The components following the
+// directory are, in order, the algorithm and the hex digest of the linked
+// content and the name of the link file.
+type linkPath struct {
+	dir        string
+	components []string
+}
+
+func (lp linkPath) key() string {
+	return lp.components[0] + ":" + lp.components[1]
+}
+
+func (lp linkPath) packPath() string {
+	return path.Join(lp.dir, packedLinksFile)
+}
+
+// parseLinkPath returns the link path p is, if it is one.
+func (d *packedLinksDriver) parseLinkPath(p string) (linkPath, bool) {
+	if !strings.HasPrefix(p, d.repositoriesRoot+"/") {
+		return linkPath{}, false
+	}
+	for _, dirName := range []string{"/_layers", "/_manifests/revisions"} {
+		i := strings.Index(p, dirName+"/")
+		if i < 0 {
+			if strings.HasSuffix(p, dirName) {
+				return linkPath{dir: p}, true
+			}
+			continue
+		}
+
+		dir := p[:i+len(dirName)]
+		components := strings.Split(p[len(dir)+1:], "/")
+		if len(components) > 3 || components[0] == packedLinksFile ||
+			(len(components) == 3 && components[2] != "link") {
+			return linkPath{}, false
+		}
+		return linkPath{dir: dir, components: components}, true
+	}
+	return linkPath{}, false
+}
+
+func (d *packedLinksDriver) lock(dir string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(dir))
+	return &d.locks[h.Sum32()%uint32(len(d.locks))]
+}
+
+// packedLinks are the links of a link directory, by algorithm and hex digest
+// of the content linked.
+type packedLinks struct {
+	links   map[string]string
+	modTime time.Time
+}
+
+// readPack reads the packed links of the directory of lp.
+func (d *packedLinksDriver) readPack(ctx context.Context, lp linkPath) (*packedLinks, error) {
+	pack := &packedLinks{links: make(map[string]string)}
+	fi, err := d.StorageDriver.Stat(ctx, lp.packPath())
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return pack, nil
+		}
+		return nil, err
+	}
+	pack.modTime = fi.ModTime()
+
+	content, err := d.StorageDriver.GetContent(ctx, lp.packPath())
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return pack, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %q in packed links %s", line, lp.packPath())
+		}
+		pack.links[fields[0]] = fields[1]
+	}
+	return pack, nil
+}
+
+// writePack replaces the packed links of the directory of lp.
+func (d *packedLinksDriver) writePack(ctx context.Context, lp linkPath, pack *packedLinks) error {
+	if len(pack.links) == 0 {
+		err := d.StorageDriver.Delete(ctx, lp.packPath())
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	keys := make([]string, 0, len(pack.links))
+	for key := range pack.links {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s %s\n", key, pack.links[key])
+	}
+	return d.StorageDriver.PutContent(ctx, lp.packPath(), buf.Bytes())
+}
+
+// matches reports whether the link key is under lp.
+func (lp linkPath) matches(key string) bool {
+	switch len(lp.components) {
+	case 0:
+		return true
+	case 1:
+		return strings.HasPrefix(key, lp.components[0]+":")
+	default:
+		return key == lp.key()
+	}
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *packedLinksDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	lp, ok := d.parseLinkPath(path)
+	if !ok || len(lp.components) != 3 {
+		return d.StorageDriver.GetContent(ctx, path)
+	}
+
+	l := d.lock(lp.dir)
+	l.Lock()
+	pack, err := d.readPack(ctx, lp)
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if content, ok := pack.links[lp.key()]; ok {
+		return []byte(content), nil
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// Links are stored in the packed file of their directory.
+func (d *packedLinksDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	lp, ok := d.parseLinkPath(path)
+	if !ok || len(lp.components) != 3 || len(content) == 0 || bytes.ContainsAny(content, " \t\r\n") {
+		return d.StorageDriver.PutContent(ctx, path, content)
+	}
+
+	l := d.lock(lp.dir)
+	l.Lock()
+	defer l.Unlock()
+	pack, err := d.readPack(ctx, lp)
+	if err != nil {
+		return err
+	}
+	pack.links[lp.key()] = string(content)
+	return d.writePack(ctx, lp, pack)
+}
+
+// Stat retrieves the FileInfo for the given path. Packed links and the
+// directories holding them are reported with the modification time of the
+// packed file.
+func (d *packedLinksDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	lp, ok := d.parseLinkPath(path)
+	if !ok || len(lp.components) == 0 {
+		return d.StorageDriver.Stat(ctx, path)
+	}
+
+	l := d.lock(lp.dir)
+	l.Lock()
+	pack, err := d.readPack(ctx, lp)
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for key, content := range pack.links {
+		if !lp.matches(key) {
+			continue
+		}
+		fi := storagedriver.FileInfoFields{Path: path, ModTime: pack.modTime, IsDir: true}
+		if len(lp.components) == 3 {
+			fi.IsDir = false
+			fi.Size = int64(len(content))
+		}
+		return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path, merging the packed links with the files stored.
+func (d *packedLinksDriver) List(ctx context.Context, path string) ([]string, error) {
+	lp, ok := d.parseLinkPath(path)
+	if !ok || len(lp.components) == 3 {
+		return d.StorageDriver.List(ctx, path)
+	}
+
+	l := d.lock(lp.dir)
+	l.Lock()
+	pack, err := d.readPack(ctx, lp)
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	seen := make(map[string]struct{})
+	var children []string
+	add := func(child string) {
+		if _, ok := seen[child]; !ok {
+			seen[child] = struct{}{}
+			children = append(children, child)
+		}
+	}
+
+	stored, err := d.StorageDriver.List(ctx, path)
+	switch err.(type) {
+	case nil:
+		found = true
+		for _, child := range stored {
+			if child != lp.packPath() {
+				add(child)
+			}
+		}
+	case storagedriver.PathNotFoundError:
+	default:
+		return nil, err
+	}
+
+	for key := range pack.links {
+		if !lp.matches(key) {
+			continue
+		}
+		found = true
+		alg, hex := key[:strings.Index(key, ":")], key[strings.Index(key, ":")+1:]
+		switch len(lp.components) {
+		case 0:
+			add(lp.dir + "/" + alg)
+		case 1:
+			add(lp.dir + "/" + alg + "/" + hex)
+		case 2:
+			add(lp.dir + "/" + alg + "/" + hex + "/link")
+		}
+	}
+
+	if !found {
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: d.Name()}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths,
+// including the packed links under it.
+func (d *packedLinksDriver) Delete(ctx context.Context, path string) error {
+	lp, ok := d.parseLinkPath(path)
+	if !ok || len(lp.components) == 0 {
+		return d.StorageDriver.Delete(ctx, path)
+	}
+
+	l := d.lock(lp.dir)
+	l.Lock()
+	defer l.Unlock()
+	pack, err := d.readPack(ctx, lp)
+	if err != nil {
+		return err
+	}
+	deleted := false
+	for key := range pack.links {
+		if lp.matches(key) {
+			delete(pack.links, key)
+			deleted = true
+		}
+	}
+	if deleted {
+		if err := d.writePack(ctx, lp, pack); err != nil {
+			return err
+		}
+	}
+
+	err = d.StorageDriver.Delete(ctx, path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok && deleted {
+		return nil
+	}
+	return err
+}
+
+// errWalkStopped is returned by the walk of a link directory to stop the walk
+// of the wrapped driver, as f asked by returning storagedriver.ErrSkipDir on a
+// file.
+var errWalkStopped = errors.New("walk stopped")
+
+// Walk traverses the paths under path, including packed links, calling f on
+// each of them. The wrapped driver walks the paths, except for link
+// directories which are listed with the packed links merged in.
+func (d *packedLinksDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	if _, ok := d.parseLinkPath(path); ok {
+		return storagedriver.WalkFallback(ctx, d, path, f)
+	}
+
+	err := d.StorageDriver.Walk(ctx, path, func(fileInfo storagedriver.FileInfo) error {
+		lp, ok := d.parseLinkPath(fileInfo.Path())
+		if !ok || !fileInfo.IsDir() || len(lp.components) != 0 {
+			return f(fileInfo)
+		}
+		if err := f(fileInfo); err != nil {
+			return err
+		}
+
+		stopped := false
+		err := storagedriver.WalkFallback(ctx, d, fileInfo.Path(), func(fileInfo storagedriver.FileInfo) error {
+			err := f(fileInfo)
+			if err == storagedriver.ErrSkipDir && !fileInfo.IsDir() {
+				stopped = true
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if stopped {
+			return errWalkStopped
+		}
+		return storagedriver.ErrSkipDir
+	})
+	if err == errWalkStopped {
+		return nil
+	}
+	return err
+}
+
+// Capabilities reports the capabilities of the wrapped driver.
+func (d *packedLinksDriver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.CapabilitiesOf(d.StorageDriver)
+}
+
+// OpenFile opens the file holding the content stored at path, if the wrapped
+// driver implements storagedriver.FileOpener. Links are not served from
+// files, so are not looked up in packs.
+func (d *packedLinksDriver) OpenFile(ctx context.Context, path string) (*os.File, error) {
+	return storagedriver.OpenFile(ctx, d.StorageDriver, path)
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// checkLinks checks that the layers and manifest of im are linked in repo.
+func checkLinks(t *testing.T, repo distribution.Repository, im image) {
+	ctx := context.Background()
+	for layer := range im.layers {
+		if _, err := repo.Blobs(ctx).Stat(ctx, layer); err != nil {
+			t.Fatalf("layer %s not linked: %v", layer, err)
+		}
+	}
+	if _, err := makeManifestService(t, repo).Get(ctx, im.manifestDigest); err != nil {
+		t.Fatalf("manifest %s not linked: %v", im.manifestDigest, err)
+	}
+	if manifests := allManifests(t, makeManifestService(t, repo)); len(manifests) != 1 {
+		t.Fatalf("unexpected manifests enumerated: %v", manifests)
+	}
+}
+
+func TestLayoutVersions(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		version int
+		packed  bool
+	}{
+		{0, false},
+		{LayoutVersionLinkFiles, false},
+		{LayoutVersionPackedLinks, true},
+	} {
+		backend := inmemory.New()
+		d, err := WithLayoutVersion(backend, tc.version)
+		if err != nil {
+			t.Fatalf("version %d: unexpected error: %v", tc.version, err)
+		}
+		repo := makeRepository(t, createRegistry(t, d), "layout/app")
+		im := uploadRandomSchema2Image(t, repo)
+		checkLinks(t, repo, im)
+
+		var layer digest.Digest
+		for layer = range im.layers {
+			break
+		}
+		layerLink, err := pathFor(layerLinkPathSpec{name: "layout/app", digest: layer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisionLink, err := pathFor(manifestRevisionLinkPathSpec{name: "layout/app", revision: im.manifestDigest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, link := range []string{layerLink, revisionLink} {
+			_, err := backend.Stat(ctx, link)
+			if _, notFound := err.(driver.PathNotFoundError); notFound != tc.packed {
+				t.Fatalf("version %d: unexpected error for link file %s: %v", tc.version, link, err)
+			}
+			packed := path.Join(path.Dir(path.Dir(path.Dir(link))), packedLinksFile)
+			_, err = backend.Stat(ctx, packed)
+			if _, notFound := err.(driver.PathNotFoundError); notFound == tc.packed {
+				t.Fatalf("version %d: unexpected error for packed links %s: %v", tc.version, packed, err)
+			}
+		}
+	}
+
+	if _, err := WithLayoutVersion(inmemory.New(), 4); err == nil {
+		t.Fatalf("expected an error for an unknown layout version")
+	}
+}
+
+// TestPackedLinksReadsLinkFiles checks that links stored in files of their
+// own stay readable with the packed layout, as do new links added to the same
+// directories.
+func TestPackedLinksReadsLinkFiles(t *testing.T) {
+	backend := inmemory.New()
+	repo := makeRepository(t, createRegistry(t, backend), "layout/app")
+	old := uploadRandomSchema2Image(t, repo)
+
+	d, err := WithLayoutVersion(backend, LayoutVersionPackedLinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo = makeRepository(t, createRegistry(t, d), "layout/app")
+	checkLinks(t, repo, old)
+
+	im := uploadRandomSchema2Image(t, repo)
+	for _, img := range []image{old, im} {
+		for layer := range img.layers {
+			if _, err := repo.Blobs(context.Background()).Stat(context.Background(), layer); err != nil {
+				t.Fatalf("layer %s not linked: %v", layer, err)
+			}
+		}
+	}
+	if manifests := allManifests(t, makeManifestService(t, repo)); len(manifests) != 2 {
+		t.Fatalf("unexpected manifests enumerated: %v", manifests)
+	}
+}
+
+func TestPackedLinksGC(t *testing.T) {
+	ctx := context.Background()
+	d, err := WithLayoutVersion(inmemory.New(), LayoutVersionPackedLinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "layout/app")
+	manifestService := makeManifestService(t, repo)
+
+	tagged := uploadRandomSchema2Image(t, repo)
+	untagged := uploadRandomSchema2Image(t, repo)
+	deleted := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: tagged.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	if err := manifestService.Delete(ctx, deleted.manifestDigest); err != nil {
+		t.Fatalf("failed to delete manifest: %v", err)
+	}
+
+	err = MarkAndSweep(ctx, d, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	manifests := allManifests(t, manifestService)
+	blobs := allBlobs(t, registry)
+	if _, ok := manifests[tagged.manifestDigest]; !ok {
+		t.Fatalf("tagged manifest %s was deleted", tagged.manifestDigest)
+	}
+	for layer := range tagged.layers {
+		if _, ok := blobs[layer]; !ok {
+			t.Fatalf("layer %s of the tagged manifest was deleted", layer)
+		}
+	}
+	for _, img := range []image{untagged, deleted} {
+		if _, ok := manifests[img.manifestDigest]; ok {
+			t.Fatalf("manifest %s was not deleted", img.manifestDigest)
+		}
+		for layer := range img.layers {
+			if _, ok := blobs[layer]; ok {
+				t.Fatalf("layer %s of manifest %s was not deleted", layer, img.manifestDigest)
+			}
+		}
+	}
+	checkLinks(t, repo, tagged)
+}
+
+// walkCountingDriver counts the walks of the driver it wraps.
+type walkCountingDriver struct {
+	driver.StorageDriver
+	walks int
+}
+
+func (d *walkCountingDriver) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	d.walks++
+	return d.StorageDriver.Walk(ctx, path, f)
+}
+
+// TestPackedLinksWalk checks that walks are delegated to the wrapped driver
+// and see the packed links at their usual paths, but not the packed files.
+func TestPackedLinksWalk(t *testing.T) {
+	ctx := context.Background()
+	backend := &walkCountingDriver{StorageDriver: inmemory.New()}
+	d, err := WithLayoutVersion(backend, LayoutVersionPackedLinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := makeRepository(t, createRegistry(t, d), "layout/app")
+	im := uploadRandomSchema2Image(t, repo)
+
+	walked := func(walk func(string, driver.WalkFn) error) map[string]bool {
+		paths := make(map[string]bool)
+		if err := walk("/", func(fileInfo driver.FileInfo) error {
+			paths[fileInfo.Path()] = true
+			return nil
+		}); err != nil {
+			t.Fatalf("unexpected error walking: %v", err)
+		}
+		return paths
+	}
+	paths := walked(func(from string, f driver.WalkFn) error {
+		return d.Walk(ctx, from, f)
+	})
+	if backend.walks != 1 {
+		t.Fatalf("expected the wrapped driver to walk once, got %d", backend.walks)
+	}
+	listed := walked(func(from string, f driver.WalkFn) error {
+		return driver.WalkFallback(ctx, d, from, f)
+	})
+	if len(paths) != len(listed) {
+		t.Fatalf("walked %d paths, listed %d", len(paths), len(listed))
+	}
+	for p := range listed {
+		if !paths[p] {
+			t.Fatalf("path %s not walked", p)
+		}
+	}
+
+	for layer := range im.layers {
+		layerLink, _ := pathFor(layerLinkPathSpec{name: "layout/app", digest: layer})
+		if !paths[layerLink] {
+			t.Fatalf("packed link %s not walked", layerLink)
+		}
+	}
+	for p := range paths {
+		if path.Base(p) == packedLinksFile {
+			t.Fatalf("packed file %s walked", p)
+		}
+	}
+}
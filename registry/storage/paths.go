@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/base64"
 	"fmt"
 	"path"
 	"strings"
@@ -34,6 +35,11 @@ const (
 //							-> current/link
 // 							-> index
 //								-> <algorithm>/<hex digest>/link
+// 						referrers/<algorithm>/<hex digest>
+//							-> <algorithm>/<hex digest>/link
+// 						annotations/<encoded key>/<value digest>
+//							-> <algorithm>/<hex digest>/link
+// 						normalized/<algorithm>/<hex digest>/link
 // 					-> _layers/
 // 						<layer links to blob store>
 // 					-> _uploads/<id>
@@ -65,7 +71,12 @@ const (
 // implied as to the ordering of changes to a manifest. The tag store provides
 // support for name, tag lookups of manifests, using "current/link" under a
 // named tag directory. An index is maintained to support deletions of all
-// revisions of a given manifest tag.
+// revisions of a given manifest tag. Manifests with a subject are linked
+// under the referrers directory of their subject, so that the manifests
+// referring to a given manifest can be listed. Likewise, manifests are linked
+// under the annotations directory by the values of their indexed annotations.
+// Manifests converted to another format on push are linked from the digest
+// they were pushed with under the normalized directory.
 //
 // We cover the path formats implemented by this path mapper below.
 //
@@ -74,16 +85,29 @@ const (
 // 	manifestRevisionsPathSpec:      <root>/v2/repositories/<name>/_manifests/revisions/
 // 	manifestRevisionPathSpec:      <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/
 // 	manifestRevisionLinkPathSpec:  <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/link
+// 	manifestRevisionProvisionalPathSpec:  <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/provisional
+// 	repositoryCreatedPathSpec:     <root>/v2/repositories/<name>/_manifests/created
 //
 //	Tags:
 //
 // 	manifestTagsPathSpec:                  <root>/v2/repositories/<name>/_manifests/tags/
 // 	manifestTagPathSpec:                   <root>/v2/repositories/<name>/_manifests/tags/<tag>/
 // 	manifestTagCurrentPathSpec:            <root>/v2/repositories/<name>/_manifests/tags/<tag>/current/link
+// 	manifestTagPushTimePathSpec:           <root>/v2/repositories/<name>/_manifests/tags/<tag>/current/pushedat
 // 	manifestTagIndexPathSpec:              <root>/v2/repositories/<name>/_manifests/tags/<tag>/index/
 // 	manifestTagIndexEntryPathSpec:         <root>/v2/repositories/<name>/_manifests/tags/<tag>/index/<algorithm>/<hex digest>/
 // 	manifestTagIndexEntryLinkPathSpec:     <root>/v2/repositories/<name>/_manifests/tags/<tag>/index/<algorithm>/<hex digest>/link
 //
+//	Referrers:
+//
+// 	manifestReferrersPathSpec:       <root>/v2/repositories/<name>/_manifests/referrers/<algorithm>/<hex digest>/
+// 	manifestReferrerLinkPathSpec:    <root>/v2/repositories/<name>/_manifests/referrers/<algorithm>/<hex digest>/<algorithm>/<hex digest>/link
+//
+//	Annotations:
+//
+// 	manifestAnnotationPathSpec:      <root>/v2/repositories/<name>/_manifests/annotations/<encoded key>/<value digest>/
+// 	manifestAnnotationLinkPathSpec:  <root>/v2/repositories/<name>/_manifests/annotations/<encoded key>/<value digest>/<algorithm>/<hex digest>/link
+//
 // 	Blobs:
 //
 // 	layerLinkPathSpec:            <root>/v2/repositories/<name>/_layers/<algorithm>/<hex digest>/link
@@ -94,6 +118,7 @@ const (
 // 	uploadDataPathSpec:             <root>/v2/repositories/<name>/_uploads/<id>/data
 // 	uploadStartedAtPathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/startedat
 // 	uploadHashStatePathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/hashstates/<algorithm>/<offset>
+// 	uploadPendingPathSpec:          <root>/v2/repositories/<name>/_uploads/<id>/pending
 //
 //	Blob Store:
 //
@@ -102,6 +127,10 @@ const (
 // 	blobDataPathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
 // 	blobMediaTypePathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
 //
+//	Garbage collection:
+//
+// 	gcLockPathSpec:                 <root>/v2/gc/lock
+//
 // For more information on the semantic meaning of each path and their
 // contents, please see the path spec documentation.
 func pathFor(spec pathSpec) (string, error) {
@@ -141,6 +170,14 @@ func pathFor(spec pathSpec) (string, error) {
 		}
 
 		return path.Join(root, "link"), nil
+	case manifestRevisionProvisionalPathSpec:
+		root, err := pathFor(manifestRevisionPathSpec(v))
+
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, "provisional"), nil
 	case manifestTagsPathSpec:
 		return path.Join(append(repoPrefix, v.name, "_manifests", "tags")...), nil
 	case manifestTagPathSpec:
@@ -161,6 +198,14 @@ func pathFor(spec pathSpec) (string, error) {
 		}
 
 		return path.Join(root, "current", "link"), nil
+	case manifestTagPushTimePathSpec:
+		root, err := pathFor(manifestTagPathSpec(v))
+
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, "current", "pushedat"), nil
 	case manifestTagIndexPathSpec:
 		root, err := pathFor(manifestTagPathSpec(v))
 
@@ -193,6 +238,62 @@ func pathFor(spec pathSpec) (string, error) {
 		}
 
 		return path.Join(root, path.Join(components...)), nil
+	case manifestReferrersPathSpec:
+		components, err := digestPathComponents(v.subject, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(repoPrefix, v.name, "_manifests", "referrers"), components...)...), nil
+	case manifestReferrerLinkPathSpec:
+		root, err := pathFor(manifestReferrersPathSpec{
+			name:    v.name,
+			subject: v.subject,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		components, err := digestPathComponents(v.revision, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, path.Join(components...), "link"), nil
+	case manifestAnnotationPathSpec:
+		if v.key == "" {
+			return "", fmt.Errorf("empty annotation key")
+		}
+
+		// Keys and values may hold any character, so keys are encoded and
+		// values digested to form path components.
+		key := base64.RawURLEncoding.EncodeToString([]byte(v.key))
+		value := digest.FromString(v.value).Encoded()
+
+		return path.Join(append(repoPrefix, v.name, "_manifests", "annotations", key, value)...), nil
+	case manifestAnnotationLinkPathSpec:
+		root, err := pathFor(manifestAnnotationPathSpec{
+			name:  v.name,
+			key:   v.key,
+			value: v.value,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		components, err := digestPathComponents(v.revision, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, path.Join(components...), "link"), nil
+	case manifestNormalizedLinkPathSpec:
+		components, err := digestPathComponents(v.original, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(append(repoPrefix, v.name, "_manifests", "normalized"), components...), "link")...), nil
 	case layerLinkPathSpec:
 		components, err := digestPathComponents(v.digest, false)
 		if err != nil {
@@ -240,8 +341,14 @@ func pathFor(spec pathSpec) (string, error) {
 			offset = "" // Limit to the prefix for listing offsets.
 		}
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "hashstates", string(v.alg), offset)...), nil
+	case uploadPendingPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "pending")...), nil
 	case repositoriesRootPathSpec:
 		return path.Join(repoPrefix...), nil
+	case repositoryCreatedPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_manifests", "created")...), nil
+	case gcLockPathSpec:
+		return path.Join(append(rootPrefix, "gc", "lock")...), nil
 	default:
 		// TODO(sday): This is an internal error. Ensure it doesn't escape (panic?).
 		return "", fmt.Errorf("unknown path spec: %#v", v)
@@ -283,6 +390,16 @@ type manifestRevisionLinkPathSpec struct {
 
 func (manifestRevisionLinkPathSpec) pathSpec() {}
 
+// manifestRevisionProvisionalPathSpec describes the file marking a revision of
+// a manifest as provisional, not served until a required referrer is pushed.
+// The contents of this file are the time the revision was pushed.
+type manifestRevisionProvisionalPathSpec struct {
+	name     string
+	revision digest.Digest
+}
+
+func (manifestRevisionProvisionalPathSpec) pathSpec() {}
+
 // manifestTagsPathSpec describes the path elements required to point to the
 // manifest tags directory.
 type manifestTagsPathSpec struct {
@@ -310,6 +427,15 @@ type manifestTagCurrentPathSpec struct {
 
 func (manifestTagCurrentPathSpec) pathSpec() {}
 
+// manifestTagPushTimePathSpec describes the file recording the time the
+// current revision was tagged.
+type manifestTagPushTimePathSpec struct {
+	name string
+	tag  string
+}
+
+func (manifestTagPushTimePathSpec) pathSpec() {}
+
 // manifestTagCurrentPathSpec describes the link to the index of revisions
 // with the given tag.
 type manifestTagIndexPathSpec struct {
@@ -338,6 +464,55 @@ type manifestTagIndexEntryLinkPathSpec struct {
 
 func (manifestTagIndexEntryLinkPathSpec) pathSpec() {}
 
+// manifestReferrersPathSpec describes the directory holding the links to the
+// manifests whose subject is the given manifest.
+type manifestReferrersPathSpec struct {
+	name    string
+	subject digest.Digest
+}
+
+func (manifestReferrersPathSpec) pathSpec() {}
+
+// manifestReferrerLinkPathSpec describes the link to a revision of a manifest
+// within the referrers of its subject.
+type manifestReferrerLinkPathSpec struct {
+	name     string
+	subject  digest.Digest
+	revision digest.Digest
+}
+
+func (manifestReferrerLinkPathSpec) pathSpec() {}
+
+// manifestAnnotationPathSpec describes the directory holding the links to the
+// manifests with the given value of an indexed annotation.
+type manifestAnnotationPathSpec struct {
+	name  string
+	key   string
+	value string
+}
+
+func (manifestAnnotationPathSpec) pathSpec() {}
+
+// manifestAnnotationLinkPathSpec describes the link to a revision of a
+// manifest within the manifests with the given value of an annotation.
+type manifestAnnotationLinkPathSpec struct {
+	name     string
+	key      string
+	value    string
+	revision digest.Digest
+}
+
+func (manifestAnnotationLinkPathSpec) pathSpec() {}
+
+// manifestNormalizedLinkPathSpec describes the link from the digest a
+// manifest was pushed with to the revision it was converted to.
+type manifestNormalizedLinkPathSpec struct {
+	name     string
+	original digest.Digest
+}
+
+func (manifestNormalizedLinkPathSpec) pathSpec() {}
+
 // layersPathSpec contains the path for the layers inside a repo
 type layersPathSpec struct {
 	name string
@@ -416,6 +591,16 @@ type uploadStartedAtPathSpec struct {
 
 func (uploadStartedAtPathSpec) pathSpec() {}
 
+// uploadPendingPathSpec defines the path parameters for the file that holds
+// the data of an upload received since it was last written to the data file,
+// when uploads are written in chunks of a minimum size.
+type uploadPendingPathSpec struct {
+	name string
+	id   string
+}
+
+func (uploadPendingPathSpec) pathSpec() {}
+
 // uploadHashStatePathSpec defines the path parameters for the file that stores
 // the hash function state of an upload at a specific byte offset. If `list` is
 // set, then the path mapper will generate a list prefix for all hash state
@@ -436,6 +621,22 @@ type repositoriesRootPathSpec struct {
 
 func (repositoriesRootPathSpec) pathSpec() {}
 
+// repositoryCreatedPathSpec describes the file recording that a repository
+// was created before anything was pushed to it. The contents of this file
+// are the time it was created.
+type repositoryCreatedPathSpec struct {
+	name string
+}
+
+func (repositoryCreatedPathSpec) pathSpec() {}
+
+// gcLockPathSpec describes the lock held by garbage collection runs, so that
+// they do not overlap. Its contents describe the run holding it and when the
+// lock expires.
+type gcLockPathSpec struct{}
+
+func (gcLockPathSpec) pathSpec() {}
+
 // digestPathComponents provides a consistent path breakdown for a given
 // digest. For a generic digest, it will be as follows:
 //
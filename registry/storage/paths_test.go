@@ -25,6 +25,17 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/link",
 		},
+		{
+			spec: manifestRevisionProvisionalPathSpec{
+				name:     "foo/bar",
+				revision: "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/provisional",
+		},
+		{
+			spec:     repositoryCreatedPathSpec{name: "foo/bar"},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/created",
+		},
 		{
 			spec: manifestTagsPathSpec{
 				name: "foo/bar",
@@ -45,6 +56,13 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/tags/thetag/current/link",
 		},
+		{
+			spec: manifestTagPushTimePathSpec{
+				name: "foo/bar",
+				tag:  "thetag",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/tags/thetag/current/pushedat",
+		},
 		{
 			spec: manifestTagIndexPathSpec{
 				name: "foo/bar",
@@ -69,6 +87,46 @@ func TestPathMapper(t *testing.T) {
 			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/tags/thetag/index/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/link",
 		},
 
+		{
+			spec: manifestReferrersPathSpec{
+				name:    "foo/bar",
+				subject: "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/referrers/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+		},
+		{
+			spec: manifestReferrerLinkPathSpec{
+				name:     "foo/bar",
+				subject:  "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+				revision: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/referrers/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/sha256/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/link",
+		},
+		{
+			spec: manifestAnnotationPathSpec{
+				name:  "foo/bar",
+				key:   "org.opencontainers.image.created",
+				value: "2024-01-01",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/annotations/b3JnLm9wZW5jb250YWluZXJzLmltYWdlLmNyZWF0ZWQ/41b62fb4518505d36dcd35c683efe1310d24ea22d6d146a0804c818070531814",
+		},
+		{
+			spec: manifestAnnotationLinkPathSpec{
+				name:     "foo/bar",
+				key:      "org.opencontainers.image.created",
+				value:    "2024-01-01",
+				revision: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/annotations/b3JnLm9wZW5jb250YWluZXJzLmltYWdlLmNyZWF0ZWQ/41b62fb4518505d36dcd35c683efe1310d24ea22d6d146a0804c818070531814/sha256/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/link",
+		},
+		{
+			spec: manifestNormalizedLinkPathSpec{
+				name:     "foo/bar",
+				original: "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/normalized/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/link",
+		},
+
 		{
 			spec: uploadDataPathSpec{
 				name: "foo/bar",
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultMaxPlatformConfigSize is the size of the largest image config read
+// to validate the platform of a manifest, unless configured otherwise.
+const DefaultMaxPlatformConfigSize = 1 << 20
+
+// ValidatePlatforms returns a functional option for NewRegistry. It rejects
+// manifest lists declaring a platform for an image manifest whose config is
+// for another, and image manifests put with WithPlatform whose config is for
+// another platform. Configs larger than maxConfigSize bytes are not read, and
+// the manifests declared for a platform with them are rejected.
+func ValidatePlatforms(maxConfigSize int64) RegistryOption {
+	return func(registry *registry) error {
+		if maxConfigSize <= 0 {
+			return fmt.Errorf("max config size for platform validation must be positive, %d invalid", maxConfigSize)
+		}
+		registry.platformConfigLimit = maxConfigSize
+		return nil
+	}
+}
+
+// WithPlatform returns a ManifestServiceOption declaring the platform of the
+// image manifest put, checked against its config if the registry validates
+// platforms.
+func WithPlatform(platform manifestlist.PlatformSpec) distribution.ManifestServiceOption {
+	return platformOption{platform: platform}
+}
+
+type platformOption struct {
+	platform manifestlist.PlatformSpec
+}
+
+func (o platformOption) Apply(m distribution.ManifestService) error {
+	return nil
+}
+
+// ParsePlatform parses a platform given as os/architecture with an optional
+// /variant.
+func ParsePlatform(s string) (manifestlist.PlatformSpec, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return manifestlist.PlatformSpec{}, fmt.Errorf("invalid platform %q: expected os/architecture[/variant]", s)
+	}
+	platform := manifestlist.PlatformSpec{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+func formatPlatform(os, architecture, variant string) string {
+	s := os + "/" + architecture
+	if variant != "" {
+		s += "/" + variant
+	}
+	return s
+}
+
+// verifyPlatform checks that the config of the manifest m with the digest
+// dgst is for platform, reading no more than limit bytes of it. The os,
+// architecture and variant are compared when both set them, and manifests
+// other than images, such as artifacts, are not checked.
+func verifyPlatform(ctx context.Context, blobs distribution.BlobStore, dgst digest.Digest, m distribution.Manifest, platform manifestlist.PlatformSpec, limit int64) error {
+	image, ok, err := imagePlatform(ctx, blobs, dgst, m, limit)
+	if err != nil || !ok {
+		return err
+	}
+	if differs(image.OS, platform.OS) || differs(image.Architecture, platform.Architecture) || differs(image.Variant, platform.Variant) {
+		return distribution.ErrManifestPlatformInvalid{
+			Digest: dgst,
+			Reason: fmt.Sprintf("declared for %s, but its config is for %s",
+				formatPlatform(platform.OS, platform.Architecture, platform.Variant),
+				formatPlatform(image.OS, image.Architecture, image.Variant)),
+		}
+	}
+	return nil
+}
+
+// imagePlatform returns the platform the config of the manifest m with the
+// digest dgst is for, reading no more than limit bytes of it, or false if m
+// is not an image manifest.
+func imagePlatform(ctx context.Context, blobs distribution.BlobStore, dgst digest.Digest, m distribution.Manifest, limit int64) (manifestlist.PlatformSpec, bool, error) {
+	var config distribution.Descriptor
+	switch m := m.(type) {
+	case *schema2.DeserializedManifest:
+		config = m.Config
+	case *ocischema.DeserializedManifest:
+		if m.IsArtifact() {
+			return manifestlist.PlatformSpec{}, false, nil
+		}
+		config = m.Config
+	default:
+		return manifestlist.PlatformSpec{}, false, nil
+	}
+
+	if config.Size > limit {
+		return manifestlist.PlatformSpec{}, false, distribution.ErrManifestPlatformInvalid{
+			Digest: dgst,
+			Reason: fmt.Sprintf("config %s of %d bytes exceeds the %d read to check its platform", config.Digest, config.Size, limit),
+		}
+	}
+	rc, err := blobs.Open(ctx, config.Digest)
+	if err == distribution.ErrBlobUnknown {
+		return manifestlist.PlatformSpec{}, false, distribution.ErrManifestBlobUnknown{Digest: config.Digest}
+	}
+	if err != nil {
+		return manifestlist.PlatformSpec{}, false, err
+	}
+	defer rc.Close()
+
+	// The platform of image configs is at their top level, as in
+	// manifest lists.
+	var platform manifestlist.PlatformSpec
+	if err := json.NewDecoder(io.LimitReader(rc, limit)).Decode(&platform); err != nil {
+		return manifestlist.PlatformSpec{}, false, distribution.ErrManifestPlatformInvalid{
+			Digest: dgst,
+			Reason: fmt.Sprintf("failed to decode config %s: %v", config.Digest, err),
+		}
+	}
+	return platform, true, nil
+}
+
+// differs returns whether two platform fields are set to different values.
+func differs(a, b string) bool {
+	return a != "" && b != "" && a != b
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// pushPlatformImage pushes an image whose config is for os/architecture,
+// returning its manifest and descriptor.
+func pushPlatformImage(t *testing.T, repo distribution.Repository, os, architecture string) (distribution.Manifest, distribution.Descriptor) {
+	ctx := context.Background()
+	blobs := repo.Blobs(ctx)
+	layer, err := blobs.Put(ctx, schema2.MediaTypeLayer, []byte(os+"/"+architecture+" layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := blobs.Put(ctx, schema2.MediaTypeImageConfig, []byte(`{"os":"`+os+`","architecture":"`+architecture+`","rootfs":{"type":"layers"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    config,
+		Layers:    []distribution.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := makeManifestService(t, repo).Put(ctx, m)
+	if err != nil {
+		t.Fatalf("unexpected error pushing image: %v", err)
+	}
+	mediaType, payload, _ := m.Payload()
+	return m, distribution.Descriptor{MediaType: mediaType, Size: int64(len(payload)), Digest: dgst}
+}
+
+func checkPlatformInvalid(t *testing.T, err error) {
+	t.Helper()
+	verificationErrs, ok := err.(distribution.ErrManifestVerification)
+	if !ok {
+		t.Fatalf("expected a verification error, got %v", err)
+	}
+	for _, err := range verificationErrs {
+		if _, ok := err.(distribution.ErrManifestPlatformInvalid); ok && strings.Contains(err.Error(), "declared for linux/arm64, but its config is for linux/amd64") {
+			return
+		}
+	}
+	t.Fatalf("expected a platform mismatch, got %v", err)
+}
+
+func TestValidatePlatformsManifestList(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New(), ValidatePlatforms(DefaultMaxPlatformConfigSize))
+	repo := makeRepository(t, registry, "platforms/list")
+	manifests := makeManifestService(t, repo)
+
+	_, amd64 := pushPlatformImage(t, repo, "linux", "amd64")
+	_, arm64 := pushPlatformImage(t, repo, "linux", "arm64")
+	entry := func(desc distribution.Descriptor, architecture string) manifestlist.ManifestDescriptor {
+		return manifestlist.ManifestDescriptor{
+			Descriptor: desc,
+			Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: architecture},
+		}
+	}
+
+	list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{entry(amd64, "amd64"), entry(arm64, "arm64")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manifests.Put(ctx, list); err != nil {
+		t.Fatalf("unexpected error pushing a list with matching platforms: %v", err)
+	}
+
+	list, err = manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{entry(amd64, "arm64"), entry(arm64, "arm64")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manifests.Put(ctx, list)
+	checkPlatformInvalid(t, err)
+}
+
+func TestValidatePlatformsImage(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New(), ValidatePlatforms(DefaultMaxPlatformConfigSize))
+	repo := makeRepository(t, registry, "platforms/image")
+	manifests := makeManifestService(t, repo)
+	m, _ := pushPlatformImage(t, repo, "linux", "amd64")
+
+	if _, err := manifests.Put(ctx, m, WithPlatform(manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64", Variant: "v2"})); err != nil {
+		t.Fatalf("unexpected error pushing an image for its platform: %v", err)
+	}
+	_, err := manifests.Put(ctx, m, WithPlatform(manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64"}))
+	checkPlatformInvalid(t, err)
+
+	// Without platform validation, the platform declared is not checked.
+	registry = createRegistry(t, inmemory.New())
+	repo = makeRepository(t, registry, "platforms/image")
+	m, _ = pushPlatformImage(t, repo, "linux", "amd64")
+	if _, err := makeManifestService(t, repo).Put(ctx, m, WithPlatform(manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64"})); err != nil {
+		t.Fatalf("unexpected error pushing without platform validation: %v", err)
+	}
+}
+
+func TestValidatePlatformsConfigSize(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New(), ValidatePlatforms(16))
+	repo := makeRepository(t, registry, "platforms/large")
+	m, _ := pushPlatformImage(t, repo, "linux", "amd64")
+
+	_, err := makeManifestService(t, repo).Put(ctx, m, WithPlatform(manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64"}))
+	if err == nil || !strings.Contains(err.Error(), "exceeds the 16 read") {
+		t.Fatalf("expected an error pushing an image with a config over the limit, got %v", err)
+	}
+}
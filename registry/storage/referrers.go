@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// linkReferrer links the manifest revision into the referrers of its subject
+// in the named repository.
+func linkReferrer(ctx context.Context, driver storagedriver.StorageDriver, name string, subject, revision digest.Digest) error {
+	linkPath, err := pathFor(manifestReferrerLinkPathSpec{
+		name:     name,
+		subject:  subject,
+		revision: revision,
+	})
+	if err != nil {
+		return err
+	}
+
+	return driver.PutContent(ctx, linkPath, []byte(revision))
+}
+
+// Referrer describes a manifest referring to another through its subject. It
+// also describes the manifests listed by ManifestsByAnnotation.
+type Referrer struct {
+	distribution.Descriptor
+
+	// ArtifactType is the artifact type of the manifest, or the media type
+	// of its config if it has none.
+	ArtifactType string
+}
+
+// Referrers returns the manifests of the named repository whose subject is
+// the given manifest, which need not exist, ordered by digest. Manifests
+// deleted since they were pushed are skipped.
+func Referrers(ctx context.Context, driver storagedriver.StorageDriver, name string, subject digest.Digest) ([]Referrer, error) {
+	root, err := pathFor(manifestReferrersPathSpec{
+		name:    name,
+		subject: subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return listLinkedManifests(ctx, driver, name, root)
+}
+
+// listLinkedManifests returns the manifests of the named repository linked
+// under root, ordered by digest. Manifests deleted since they were linked are
+// skipped.
+func listLinkedManifests(ctx context.Context, driver storagedriver.StorageDriver, name, root string) ([]Referrer, error) {
+	algorithms, err := driver.List(ctx, root)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var referrers []Referrer
+	for _, algorithm := range algorithms {
+		hexes, err := driver.List(ctx, algorithm)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, hex := range hexes {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(algorithm)), path.Base(hex))
+			if err := dgst.Validate(); err != nil {
+				continue
+			}
+
+			referrer, err := readReferrer(ctx, driver, name, dgst)
+			if err != nil {
+				if _, ok := err.(storagedriver.PathNotFoundError); ok {
+					continue
+				}
+				return nil, err
+			}
+			referrers = append(referrers, referrer)
+		}
+	}
+
+	sort.Slice(referrers, func(i, j int) bool {
+		return referrers[i].Digest < referrers[j].Digest
+	})
+
+	return referrers, nil
+}
+
+// readReferrer reads the manifest revision of the named repository with the
+// given digest, returning a PathNotFoundError if it has been deleted.
+func readReferrer(ctx context.Context, driver storagedriver.StorageDriver, name string, dgst digest.Digest) (Referrer, error) {
+	linkPath, err := pathFor(manifestRevisionLinkPathSpec{name: name, revision: dgst})
+	if err != nil {
+		return Referrer{}, err
+	}
+	if _, err := driver.Stat(ctx, linkPath); err != nil {
+		return Referrer{}, err
+	}
+
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return Referrer{}, err
+	}
+	content, err := driver.GetContent(ctx, blobPath)
+	if err != nil {
+		return Referrer{}, err
+	}
+
+	// Referrers are OCI image manifests or indexes, which have the same
+	// fields describing them.
+	var m struct {
+		MediaType    string                  `json:"mediaType"`
+		ArtifactType string                  `json:"artifactType"`
+		Config       distribution.Descriptor `json:"config"`
+		Annotations  map[string]string       `json:"annotations"`
+	}
+	if err := json.Unmarshal(content, &m); err != nil {
+		return Referrer{}, err
+	}
+
+	mediaType := v1.MediaTypeImageManifest
+	if m.MediaType == v1.MediaTypeImageIndex {
+		mediaType = v1.MediaTypeImageIndex
+	}
+
+	artifactType := m.ArtifactType
+	if artifactType == "" {
+		artifactType = m.Config.MediaType
+	}
+
+	return Referrer{
+		Descriptor: distribution.Descriptor{
+			MediaType:   mediaType,
+			Size:        int64(len(content)),
+			Digest:      dgst,
+			Annotations: m.Annotations,
+		},
+		ArtifactType: artifactType,
+	}, nil
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testArtifactType = "application/vnd.example.attestation.v1+json"
+
+// putArtifact pushes an artifact manifest with an empty config, a single
+// layer and the given subject.
+func putArtifact(t *testing.T, repo distribution.Repository, artifactType string, subject *distribution.Descriptor) (digest.Digest, []byte) {
+	t.Helper()
+	ctx := context.Background()
+
+	layer, err := repo.Blobs(ctx).Put(ctx, artifactType, []byte(`{"predicate":"`+artifactType+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.MediaType = artifactType
+
+	dm, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageManifest,
+		},
+		ArtifactType: artifactType,
+		Config:       ocischema.DescriptorEmptyJSON,
+		Layers:       []distribution.Descriptor{layer},
+		Subject:      subject,
+		Annotations:  map[string]string{"org.example.kind": artifactType},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dgst, err := makeManifestService(t, repo).Put(ctx, dm)
+	if err != nil {
+		t.Fatalf("unexpected error putting artifact: %v", err)
+	}
+	_, payload, _ := dm.Payload()
+	return dgst, payload
+}
+
+func TestReferrers(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver,
+		AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes))
+	repo := makeRepository(t, registry, "test")
+
+	subject := distribution.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    digest.FromString("subject which need not exist"),
+		Size:      42,
+	}
+
+	referrers, err := Referrers(ctx, inmemoryDriver, "test", subject.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 0 {
+		t.Fatalf("expected no referrers, got %v", referrers)
+	}
+
+	// Artifacts are pushed with layers which are not allowed in images
+	attestation, payload := putArtifact(t, repo, testArtifactType, &subject)
+	signature, _ := putArtifact(t, repo, "application/vnd.example.signature.v1+json", &subject)
+	putArtifact(t, repo, "application/vnd.example.unrelated.v1+json", nil)
+
+	referrers, err = Referrers(ctx, inmemoryDriver, "test", subject.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 2 {
+		t.Fatalf("expected 2 referrers, got %v", referrers)
+	}
+
+	var found Referrer
+	for _, referrer := range referrers {
+		if referrer.Digest == attestation {
+			found = referrer
+		} else if referrer.Digest != signature {
+			t.Fatalf("unexpected referrer %v", referrer.Digest)
+		}
+	}
+	if found.ArtifactType != testArtifactType || found.MediaType != v1.MediaTypeImageManifest || found.Size != int64(len(payload)) {
+		t.Fatalf("unexpected attestation referrer: %+v", found)
+	}
+	if found.Annotations["org.example.kind"] != testArtifactType {
+		t.Fatalf("unexpected attestation annotations: %v", found.Annotations)
+	}
+
+	// Deleted referrers are not listed
+	if err := makeManifestService(t, repo).Delete(ctx, signature); err != nil {
+		t.Fatalf("unexpected error deleting signature: %v", err)
+	}
+	referrers, err = Referrers(ctx, inmemoryDriver, "test", subject.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != attestation {
+		t.Fatalf("expected only the attestation to be listed, got %v", referrers)
+	}
+}
+
+func TestVerifyOCIManifestInvalidSubject(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "test")
+	manifestService := makeManifestService(t, repo)
+
+	dm, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageManifest,
+		},
+		ArtifactType: testArtifactType,
+		Config:       ocischema.DescriptorEmptyJSON,
+		Subject:      &distribution.Descriptor{Digest: "sha256:invalid", Size: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = manifestService.Put(ctx, dm)
+	if _, ok := err.(distribution.ErrManifestVerification); !ok {
+		t.Fatalf("expected a verification error, got %v", err)
+	}
+}
+
+func TestReferrersZstd(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver,
+		AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes))
+	repo := makeRepository(t, registry, "test")
+	manifestService := makeManifestService(t, repo)
+
+	config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.MediaType = v1.MediaTypeImageConfig
+
+	layer, err := repo.Blobs(ctx).Put(ctx, ocischema.MediaTypeImageLayerZstd, []byte("zstd layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.MediaType = ocischema.MediaTypeImageLayerZstd
+
+	putImage := func(subject *distribution.Descriptor) distribution.Descriptor {
+		dm, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: manifest.Versioned{
+				SchemaVersion: 2,
+				MediaType:     v1.MediaTypeImageManifest,
+			},
+			Config:  config,
+			Layers:  []distribution.Descriptor{layer},
+			Subject: subject,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst, err := manifestService.Put(ctx, dm)
+		if err != nil {
+			t.Fatalf("unexpected error putting zstd image: %v", err)
+		}
+		_, payload, _ := dm.Payload()
+		return distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: int64(len(payload))}
+	}
+
+	// Zstd images may be subjects, and referrers whose layers are checked
+	// against the allowlist like any other image
+	image := putImage(nil)
+	attestation, _ := putArtifact(t, repo, testArtifactType, &image)
+	derived := putImage(&image)
+
+	referrers, err := Referrers(ctx, inmemoryDriver, "test", image.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 2 {
+		t.Fatalf("expected 2 referrers, got %v", referrers)
+	}
+	for _, referrer := range referrers {
+		switch referrer.Digest {
+		case attestation:
+		case derived.Digest:
+			if referrer.ArtifactType != v1.MediaTypeImageConfig || referrer.Size != derived.Size {
+				t.Fatalf("unexpected zstd image referrer: %+v", referrer)
+			}
+		default:
+			t.Fatalf("unexpected referrer %v", referrer.Digest)
+		}
+	}
+}
+
+// TestReferrersIndex checks that image indexes may be subjects, and may be
+// referrers themselves.
+func TestReferrersIndex(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "test")
+	manifestService := makeManifestService(t, repo)
+
+	imageDigest, imagePayload := putArtifact(t, repo, "application/vnd.example.image.v1", nil)
+	image := distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: imageDigest, Size: int64(len(imagePayload))}
+
+	putIndex := func(subject *distribution.Descriptor, artifactType string) distribution.Descriptor {
+		payload, err := json.Marshal(manifestlist.ManifestList{
+			Versioned: manifest.Versioned{
+				SchemaVersion: 2,
+				MediaType:     v1.MediaTypeImageIndex,
+			},
+			Manifests:    []manifestlist.ManifestDescriptor{{Descriptor: image}},
+			ArtifactType: artifactType,
+			Subject:      subject,
+			Annotations:  map[string]string{"org.example.kind": "index"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dm manifestlist.DeserializedManifestList
+		if err := dm.UnmarshalJSON(payload); err != nil {
+			t.Fatal(err)
+		}
+		dgst, err := manifestService.Put(ctx, &dm)
+		if err != nil {
+			t.Fatalf("unexpected error putting index: %v", err)
+		}
+		return distribution.Descriptor{MediaType: v1.MediaTypeImageIndex, Digest: dgst, Size: int64(len(payload))}
+	}
+
+	// An index as a subject
+	index := putIndex(nil, "")
+	signature, _ := putArtifact(t, repo, "application/vnd.example.signature.v1+json", &index)
+
+	referrers, err := Referrers(ctx, inmemoryDriver, "test", index.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != signature {
+		t.Fatalf("expected the signature of the index to be listed, got %v", referrers)
+	}
+
+	// An index as a referrer
+	bundle := putIndex(&image, "application/vnd.example.bundle.v1")
+
+	referrers, err = Referrers(ctx, inmemoryDriver, "test", image.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 1 {
+		t.Fatalf("expected the bundle to be listed, got %v", referrers)
+	}
+	expected := Referrer{
+		Descriptor: distribution.Descriptor{
+			MediaType:   v1.MediaTypeImageIndex,
+			Size:        bundle.Size,
+			Digest:      bundle.Digest,
+			Annotations: map[string]string{"org.example.kind": "index"},
+		},
+		ArtifactType: "application/vnd.example.bundle.v1",
+	}
+	if !reflect.DeepEqual(referrers[0], expected) {
+		t.Fatalf("unexpected bundle referrer: %+v != %+v", referrers[0], expected)
+	}
+}
@@ -2,7 +2,9 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"regexp"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/reference"
@@ -21,10 +23,22 @@ type registry struct {
 	deleteEnabled                bool
 	schema1Enabled               bool
 	resumableDigestEnabled       bool
+	uploadMinChunkSize           int64
 	schema1SigningKey            libtrust.PrivateKey
 	blobDescriptorServiceFactory distribution.BlobDescriptorServiceFactory
 	manifestURLs                 manifestURLs
+	layerMediaTypes              layerMediaTypes
+	artifactLayerMediaTypes      layerMediaTypes
 	driver                       storagedriver.StorageDriver
+	tagCache                     *tagCache
+	negativeBlobCache            *negativeBlobCache
+	tagWriteLocks                *tagWriteLocks
+	annotationIndex              annotationIndex
+	verificationLimiter          verificationLimiter
+	platformConfigLimit          int64
+	maxManifestListDescriptors   int
+	manifestFallbackMediaType    string
+	requiredReferrers            []RequiredReferrer
 }
 
 // manifestURLs holds regular expressions for controlling manifest URL whitelisting
@@ -43,6 +57,16 @@ func EnableRedirect(registry *registry) error {
 	return nil
 }
 
+// StoreContentTypes is a functional option for NewRegistry. It causes blobs
+// to be stored with the Content-Type of their media type, by the drivers
+// storing one, so that redirected downloads carry it. Manifests are stored
+// with their media type, and other blobs with the type detected from their
+// content, falling back to application/octet-stream.
+func StoreContentTypes(registry *registry) error {
+	registry.blobStore.storeContentTypes = true
+	return nil
+}
+
 // EnableDelete is a functional option for NewRegistry. It enables deletion on
 // the registry.
 func EnableDelete(registry *registry) error {
@@ -64,6 +88,20 @@ func DisableDigestResumption(registry *registry) error {
 	return nil
 }
 
+// UploadMinChunkSize returns a functional option for NewRegistry. It holds
+// the data of blob uploads until size bytes are received, so that the data is
+// written to the storage driver in chunks of at least size bytes but the last.
+// This bounds the number of parts of drivers writing uploads in parts.
+func UploadMinChunkSize(size int64) RegistryOption {
+	return func(registry *registry) error {
+		if size < 0 {
+			return fmt.Errorf("upload minimum chunk size must not be negative")
+		}
+		registry.uploadMinChunkSize = size
+		return nil
+	}
+}
+
 // ManifestURLsAllowRegexp is a functional option for NewRegistry.
 func ManifestURLsAllowRegexp(r *regexp.Regexp) RegistryOption {
 	return func(registry *registry) error {
@@ -80,6 +118,31 @@ func ManifestURLsDenyRegexp(r *regexp.Regexp) RegistryOption {
 	}
 }
 
+// AllowedLayerMediaTypes returns a functional option for NewRegistry. It
+// restricts the media types of layers in pushed manifests to mediaTypes.
+func AllowedLayerMediaTypes(mediaTypes []string) RegistryOption {
+	return func(registry *registry) error {
+		registry.layerMediaTypes = make(layerMediaTypes, len(mediaTypes))
+		for _, mediaType := range mediaTypes {
+			registry.layerMediaTypes[mediaType] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// AllowedArtifactLayerMediaTypes returns a functional option for NewRegistry.
+// It restricts the media types of layers in pushed artifact manifests which
+// are not image layers to mediaTypes.
+func AllowedArtifactLayerMediaTypes(mediaTypes []string) RegistryOption {
+	return func(registry *registry) error {
+		registry.artifactLayerMediaTypes = make(layerMediaTypes, len(mediaTypes))
+		for _, mediaType := range mediaTypes {
+			registry.artifactLayerMediaTypes[mediaType] = struct{}{}
+		}
+		return nil
+	}
+}
+
 // Schema1SigningKey returns a functional option for NewRegistry. It sets the
 // key for signing  all schema1 manifests.
 func Schema1SigningKey(key libtrust.PrivateKey) RegistryOption {
@@ -89,6 +152,41 @@ func Schema1SigningKey(key libtrust.PrivateKey) RegistryOption {
 	}
 }
 
+// TagCache returns a functional option for NewRegistry. It caches the tags
+// resolved and listed in memory, dropping those of a repository when its
+// tags are written by the registry and after ttl otherwise.
+func TagCache(ttl time.Duration) RegistryOption {
+	return func(registry *registry) error {
+		if ttl <= 0 {
+			return fmt.Errorf("tag cache ttl must be positive")
+		}
+		registry.tagCache = newTagCache(ttl)
+		return nil
+	}
+}
+
+// BlobDescriptorNegativeCache returns a functional option for NewRegistry. It
+// caches the blobs found absent from repositories in memory, so that they are
+// reported absent without reaching the storage, dropping them when linked
+// into a repository by the registry and after ttl otherwise.
+func BlobDescriptorNegativeCache(ttl time.Duration) RegistryOption {
+	return func(registry *registry) error {
+		if ttl <= 0 {
+			return fmt.Errorf("blob descriptor negative cache ttl must be positive")
+		}
+		registry.negativeBlobCache = newNegativeBlobCache(ttl)
+		return nil
+	}
+}
+
+// SerializeTagWrites is a functional option for NewRegistry. It serializes
+// the writes to each tag within the process, so that concurrent pushes of a
+// tag cannot leave its links inconsistent.
+func SerializeTagWrites(registry *registry) error {
+	registry.tagWriteLocks = &tagWriteLocks{}
+	return nil
+}
+
 // BlobDescriptorServiceFactory returns a functional option for NewRegistry. It sets the
 // factory to create BlobDescriptorServiceFactory middleware.
 func BlobDescriptorServiceFactory(factory distribution.BlobDescriptorServiceFactory) RegistryOption {
@@ -208,6 +306,9 @@ func (repo *repository) Tags(ctx context.Context) distribution.TagService {
 		blobStore:  repo.registry.blobStore,
 	}
 
+	if repo.registry.tagCache != nil {
+		return &cachedTagStore{tagStore: tags, cache: repo.registry.tagCache}
+	}
 	return tags
 }
 
@@ -272,21 +373,31 @@ func (repo *repository) Manifests(ctx context.Context, options ...distribution.M
 		blobStore:      blobStore,
 		schema1Handler: v1Handler,
 		schema2Handler: &schema2ManifestHandler{
-			ctx:          ctx,
-			repository:   repo,
-			blobStore:    blobStore,
-			manifestURLs: repo.registry.manifestURLs,
+			ctx:                 ctx,
+			repository:          repo,
+			blobStore:           blobStore,
+			manifestURLs:        repo.registry.manifestURLs,
+			layerMediaTypes:     repo.registry.layerMediaTypes,
+			verificationLimiter: repo.registry.verificationLimiter,
 		},
 		manifestListHandler: &manifestListHandler{
-			ctx:        ctx,
-			repository: repo,
-			blobStore:  blobStore,
+			ctx:                 ctx,
+			repository:          repo,
+			blobStore:           blobStore,
+			driver:              repo.driver,
+			verificationLimiter: repo.registry.verificationLimiter,
+			platformConfigLimit: repo.registry.platformConfigLimit,
+			maxDescriptors:      repo.registry.maxManifestListDescriptors,
 		},
 		ocischemaHandler: &ocischemaManifestHandler{
-			ctx:          ctx,
-			repository:   repo,
-			blobStore:    blobStore,
-			manifestURLs: repo.registry.manifestURLs,
+			ctx:                     ctx,
+			repository:              repo,
+			blobStore:               blobStore,
+			manifestURLs:            repo.registry.manifestURLs,
+			layerMediaTypes:         repo.registry.layerMediaTypes,
+			artifactLayerMediaTypes: repo.registry.artifactLayerMediaTypes,
+			driver:                  repo.driver,
+			verificationLimiter:     repo.registry.verificationLimiter,
 		},
 	}
 
@@ -315,6 +426,14 @@ func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 		statter = cache.NewCachedBlobStatter(repo.descriptorCache, statter)
 	}
 
+	if repo.registry.negativeBlobCache != nil {
+		statter = &negativeCachedBlobStatter{
+			BlobDescriptorService: statter,
+			cache:                 repo.registry.negativeBlobCache,
+			repository:            repo.name.Name(),
+		}
+	}
+
 	if repo.registry.blobDescriptorServiceFactory != nil {
 		statter = repo.registry.blobDescriptorServiceFactory.BlobAccessController(statter)
 	}
@@ -333,5 +452,6 @@ func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 		linkDirectoryPathSpec:  layersPathSpec{name: repo.name.Name()},
 		deleteEnabled:          repo.registry.deleteEnabled,
 		resumableDigestEnabled: repo.resumableDigestEnabled,
+		uploadMinChunkSize:     repo.registry.uploadMinChunkSize,
 	}
 }
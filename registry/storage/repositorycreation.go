@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// RepositoryExists returns whether the named repository holds any content,
+// pushed or being uploaded, or was created empty by CreateRepository.
+func RepositoryExists(ctx context.Context, driver storagedriver.StorageDriver, name string) (bool, error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return false, err
+	}
+
+	// The directories holding the content of the repository, rather than
+	// the repository directory, which also holds those of the repositories
+	// nested under it.
+	for _, dir := range []string{"_manifests", "_layers", "_uploads"} {
+		_, err := driver.Stat(ctx, path.Join(root, name, dir))
+		if err == nil {
+			return true, nil
+		}
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// CreateRepository creates the named repository, empty, unless it exists. It
+// returns whether the repository was created. Created repositories are listed
+// by the catalog.
+func CreateRepository(ctx context.Context, driver storagedriver.StorageDriver, name string) (bool, error) {
+	exists, err := RepositoryExists(ctx, driver, name)
+	if err != nil || exists {
+		return false, err
+	}
+
+	createdPath, err := pathFor(repositoryCreatedPathSpec{name: name})
+	if err != nil {
+		return false, err
+	}
+	if err := driver.PutContent(ctx, createdPath, []byte(time.Now().UTC().Format(time.RFC3339Nano))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// RequiredReferrer requires the manifests pushed to the repositories it
+// matches to be referred to by a manifest of an artifact type, such as a
+// signature, before they are served. Until then, they are provisional: they
+// are stored but reported unknown when fetched.
+type RequiredReferrer struct {
+	// Repository is the name of a repository or, when it ends with a slash,
+	// a namespace prefix. An empty name matches every repository.
+	Repository string
+
+	// ArtifactType is the artifact type of the referrer required, or the
+	// media type of its config if it has none.
+	ArtifactType string
+
+	// GracePeriod is the time after the push of a manifest within which its
+	// referrer must be pushed. A manifest whose referrer comes later stays
+	// provisional until it is pushed again. There is no limit when zero.
+	GracePeriod time.Duration
+}
+
+func (rr *RequiredReferrer) matchesRepository(name string) bool {
+	return rr.Repository == "" || rr.Repository == name ||
+		(strings.HasSuffix(rr.Repository, "/") && strings.HasPrefix(name, rr.Repository))
+}
+
+// RequiredReferrers returns a functional option for NewRegistry. It keeps
+// the manifests pushed to the repositories matched by requirements
+// provisional until they are referred to by a manifest of the required
+// artifact type. A repository is subject to the first requirement matching
+// it. Manifests which are themselves referrers are never provisional.
+func RequiredReferrers(requirements []RequiredReferrer) RegistryOption {
+	return func(registry *registry) error {
+		for _, rr := range requirements {
+			if rr.ArtifactType == "" {
+				return fmt.Errorf("no artifact type required for the referrers of %q", rr.Repository)
+			}
+			if rr.GracePeriod < 0 {
+				return fmt.Errorf("invalid grace period %v for the referrers of %q: must not be negative", rr.GracePeriod, rr.Repository)
+			}
+		}
+		registry.requiredReferrers = append([]RequiredReferrer(nil), requirements...)
+		return nil
+	}
+}
+
+// requiredReferrer returns the requirement the named repository is subject
+// to, if any.
+func (reg *registry) requiredReferrer(name string) (RequiredReferrer, bool) {
+	for _, rr := range reg.requiredReferrers {
+		if rr.matchesRepository(name) {
+			return rr, true
+		}
+	}
+	return RequiredReferrer{}, false
+}
+
+// manifestSubject returns the subject of manifest and its artifact type, if
+// it is a referrer.
+func manifestSubject(manifest distribution.Manifest) (*distribution.Descriptor, string) {
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		if m.ArtifactType != "" {
+			return m.Subject, m.ArtifactType
+		}
+		return m.Subject, m.Config.MediaType
+	case *manifestlist.DeserializedManifestList:
+		return m.Subject, m.ArtifactType
+	}
+	return nil, ""
+}
+
+// provisionalSince returns the time the provisional manifest revision of the
+// named repository was pushed, or false if it is not provisional.
+func provisionalSince(ctx context.Context, driver storagedriver.StorageDriver, name string, revision digest.Digest) (time.Time, bool, error) {
+	provisionalPath, err := pathFor(manifestRevisionProvisionalPathSpec{name: name, revision: revision})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	content, err := driver.GetContent(ctx, provisionalPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, err
+	}
+	pushedAt, err := time.Parse(time.RFC3339Nano, string(content))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return pushedAt, true, nil
+}
+
+// requireReferrer marks the manifest revision just pushed to the named
+// repository provisional, unless it was already stored and served or a
+// referrer of the required artifact type was pushed before it. If the
+// manifest is a referrer of that type, its subject is no longer provisional
+// if it was pushed within the grace period.
+func requireReferrer(ctx context.Context, driver storagedriver.StorageDriver, name string, rr RequiredReferrer, manifest distribution.Manifest, revision digest.Digest, existed bool) error {
+	if subject, artifactType := manifestSubject(manifest); subject != nil {
+		if artifactType != rr.ArtifactType {
+			return nil
+		}
+		pushedAt, provisional, err := provisionalSince(ctx, driver, name, subject.Digest)
+		if err != nil || !provisional {
+			return err
+		}
+		if rr.GracePeriod > 0 && time.Since(pushedAt) > rr.GracePeriod {
+			dcontext.GetLogger(ctx).Infof("referrer %s of %s pushed after the grace period, which stays provisional", revision, subject.Digest)
+			return nil
+		}
+		return deleteProvisional(ctx, driver, name, subject.Digest)
+	}
+
+	if existed {
+		if _, provisional, err := provisionalSince(ctx, driver, name, revision); err != nil || !provisional {
+			return err
+		}
+	}
+
+	referrers, err := Referrers(ctx, driver, name, revision)
+	if err != nil {
+		return err
+	}
+	for _, referrer := range referrers {
+		if referrer.ArtifactType == rr.ArtifactType {
+			return deleteProvisional(ctx, driver, name, revision)
+		}
+	}
+
+	provisionalPath, err := pathFor(manifestRevisionProvisionalPathSpec{name: name, revision: revision})
+	if err != nil {
+		return err
+	}
+	return driver.PutContent(ctx, provisionalPath, []byte(time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+func deleteProvisional(ctx context.Context, driver storagedriver.StorageDriver, name string, revision digest.Digest) error {
+	provisionalPath, err := pathFor(manifestRevisionProvisionalPathSpec{name: name, revision: revision})
+	if err != nil {
+		return err
+	}
+	err = driver.Delete(ctx, provisionalPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
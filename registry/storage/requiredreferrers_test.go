@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testSignatureType = "application/vnd.example.signature.v1+json"
+
+// checkServable checks whether the manifest dgst of repo is served.
+func checkServable(t *testing.T, repo distribution.Repository, dgst digest.Digest, servable bool) {
+	t.Helper()
+	ctx := context.Background()
+	ms := makeManifestService(t, repo)
+	_, err := ms.Get(ctx, dgst)
+	if servable && err != nil {
+		t.Fatalf("unexpected error fetching manifest %s: %v", dgst, err)
+	}
+	if !servable {
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); !ok {
+			t.Fatalf("expected provisional manifest %s to be unknown, got %v", dgst, err)
+		}
+	}
+	// Provisional manifests are stored all the same.
+	if exists, err := ms.Exists(ctx, dgst); err != nil || !exists {
+		t.Fatalf("manifest %s not stored: %v", dgst, err)
+	}
+}
+
+func TestRequiredReferrers(t *testing.T) {
+	registry := createRegistry(t, inmemory.New(),
+		AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes),
+		RequiredReferrers([]RequiredReferrer{
+			{Repository: "signed/", ArtifactType: testSignatureType},
+		}))
+	repo := makeRepository(t, registry, "signed/app")
+
+	image, payload := putArtifact(t, repo, "application/vnd.example.image.v1+json", nil)
+	checkServable(t, repo, image, false)
+	subject := &distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: image, Size: int64(len(payload))}
+
+	// Referrers of other types do not make the manifest servable, while
+	// being servable themselves.
+	attestation, _ := putArtifact(t, repo, testArtifactType, subject)
+	checkServable(t, repo, attestation, true)
+	checkServable(t, repo, image, false)
+
+	signature, _ := putArtifact(t, repo, testSignatureType, subject)
+	checkServable(t, repo, signature, true)
+	checkServable(t, repo, image, true)
+
+	// Pushing the image again keeps it servable.
+	putArtifact(t, repo, "application/vnd.example.image.v1+json", nil)
+	checkServable(t, repo, image, true)
+
+	// Repositories matched by no requirement are unaffected.
+	other := makeRepository(t, registry, "other/app")
+	unrequired, _ := putArtifact(t, other, "application/vnd.example.image.v1+json", nil)
+	checkServable(t, other, unrequired, true)
+}
+
+// TestRequiredReferrersReferrerPushedFirst checks that a manifest whose
+// signature was pushed before it is servable.
+func TestRequiredReferrersReferrerPushedFirst(t *testing.T) {
+	registry := createRegistry(t, inmemory.New(),
+		AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes),
+		RequiredReferrers([]RequiredReferrer{{ArtifactType: testSignatureType}}))
+	repo := makeRepository(t, registry, "signed/app")
+
+	// The same artifact pushed elsewhere has the same digest.
+	scratch := makeRepository(t, createRegistry(t, inmemory.New(), AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes)), "scratch")
+	dgst, payload := putArtifact(t, scratch, "application/vnd.example.image.v1+json", nil)
+	putArtifact(t, repo, testSignatureType, &distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: int64(len(payload))})
+
+	image, _ := putArtifact(t, repo, "application/vnd.example.image.v1+json", nil)
+	if image != dgst {
+		t.Fatalf("expected manifest %s, got %s", dgst, image)
+	}
+	checkServable(t, repo, image, true)
+}
+
+func TestRequiredReferrersGracePeriod(t *testing.T) {
+	registry := createRegistry(t, inmemory.New(),
+		AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes),
+		RequiredReferrers([]RequiredReferrer{
+			{Repository: "signed/app", ArtifactType: testSignatureType, GracePeriod: time.Millisecond},
+		}))
+	repo := makeRepository(t, registry, "signed/app")
+
+	image, payload := putArtifact(t, repo, "application/vnd.example.image.v1+json", nil)
+	time.Sleep(10 * time.Millisecond)
+	putArtifact(t, repo, testSignatureType, &distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: image, Size: int64(len(payload))})
+	checkServable(t, repo, image, false)
+}
+
+func TestRequiredReferrersInvalid(t *testing.T) {
+	for _, rr := range []RequiredReferrer{
+		{Repository: "signed/"},
+		{ArtifactType: testSignatureType, GracePeriod: -time.Second},
+	} {
+		if _, err := NewRegistry(context.Background(), inmemory.New(), RequiredReferrers([]RequiredReferrer{rr})); err == nil {
+			t.Errorf("expected an error for requirement %+v", rr)
+		}
+	}
+}
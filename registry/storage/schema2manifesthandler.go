@@ -20,10 +20,12 @@ var (
 
 //schema2ManifestHandler is a ManifestHandler that covers schema2 manifests.
 type schema2ManifestHandler struct {
-	repository   distribution.Repository
-	blobStore    distribution.BlobStore
-	ctx          context.Context
-	manifestURLs manifestURLs
+	repository          distribution.Repository
+	blobStore           distribution.BlobStore
+	ctx                 context.Context
+	manifestURLs        manifestURLs
+	layerMediaTypes     layerMediaTypes
+	verificationLimiter verificationLimiter
 }
 
 var _ ManifestHandler = &schema2ManifestHandler{}
@@ -86,6 +88,8 @@ func (ms *schema2ManifestHandler) verifyManifest(ctx context.Context, mnfst sche
 
 	blobsService := ms.repository.Blobs(ctx)
 
+	errs = append(errs, ms.layerMediaTypes.verify(mnfst.Layers)...)
+
 	for _, descriptor := range mnfst.References() {
 		err := descriptor.Digest.Validate()
 		if err != nil {
@@ -93,6 +97,10 @@ func (ms *schema2ManifestHandler) verifyManifest(ctx context.Context, mnfst sche
 			continue
 		}
 
+		if err := ms.verificationLimiter.acquire(ctx); err != nil {
+			return err
+		}
+
 		switch descriptor.MediaType {
 		case schema2.MediaTypeForeignLayer:
 			// Clients download this layer from an external URL, so do not check for
@@ -126,6 +134,8 @@ func (ms *schema2ManifestHandler) verifyManifest(ctx context.Context, mnfst sche
 			_, err = blobsService.Stat(ctx, descriptor.Digest)
 		}
 
+		ms.verificationLimiter.release()
+
 		if err != nil {
 			if err != distribution.ErrBlobUnknown {
 				errs = append(errs, err)
@@ -315,3 +315,70 @@ func TestVerifyManifestBlobLayerAndConfig(t *testing.T) {
 		checkFn(m, c.Err)
 	}
 }
+
+func TestVerifyManifestLayerMediaTypes(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver,
+		AllowedLayerMediaTypes(DefaultAllowedLayerMediaTypes))
+	repo := makeRepository(t, registry, "test")
+	manifestService := makeManifestService(t, repo)
+
+	config, err := repo.Blobs(ctx).Put(ctx, schema2.MediaTypeImageConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := repo.Blobs(ctx).Put(ctx, schema2.MediaTypeLayer, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.MediaType = schema2.MediaTypeLayer
+
+	foreignLayer := distribution.Descriptor{
+		Digest:    "sha256:463435349086340864309863409683460843608348608934092322395278926a",
+		Size:      6323,
+		MediaType: schema2.MediaTypeForeignLayer,
+		URLs:      []string{"https://foo/bar"},
+	}
+
+	for _, c := range []struct {
+		name    string
+		layer   distribution.Descriptor
+		allowed bool
+	}{
+		{"standard layer", layer, true},
+		{"foreign layer", foreignLayer, false},
+	} {
+		m := schema2.Manifest{
+			Versioned: manifest.Versioned{
+				SchemaVersion: 2,
+				MediaType:     schema2.MediaTypeManifest,
+			},
+			Config: config,
+			Layers: []distribution.Descriptor{c.layer},
+		}
+		dm, err := schema2.FromStruct(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = manifestService.Put(ctx, dm)
+		if c.allowed {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.name, err)
+			}
+			continue
+		}
+
+		verr, ok := err.(distribution.ErrManifestVerification)
+		if !ok || len(verr) != 1 {
+			t.Errorf("%s: expected a verification error, got %v", c.name, err)
+			continue
+		}
+		expected := distribution.ErrManifestLayerMediaTypeNotAllowed{Digest: c.layer.Digest, MediaType: c.layer.MediaType}
+		if verr[0] != expected {
+			t.Errorf("%s: expected %v, got %v", c.name, expected, verr[0])
+		}
+	}
+}
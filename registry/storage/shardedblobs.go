@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// shardedBlobsDriver stores the blobs of the blob store under two levels of
+// directories named after the first and second pairs of characters of their
+// hex digests, <algorithm>/<ab>/<cd>/<hex digest>, rather than the first
+// level only, so that no directory holds more than a fraction of the blobs.
+// Blobs appear at their usual paths, and walks over the blob store are unaware
+// of the extra level.
+//
+// Blobs are written to the sharded paths, while blobs stored at the usual
+// paths are still read and deleted, so that an existing storage can switch to
+// the layout.
+type shardedBlobsDriver struct {
+	storagedriver.StorageDriver
+
+	blobsRoot string
+}
+
+var _ storagedriver.StorageDriver = &shardedBlobsDriver{}
+
+func newShardedBlobsDriver(driver storagedriver.StorageDriver) (*shardedBlobsDriver, error) {
+	root, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	return &shardedBlobsDriver{StorageDriver: driver, blobsRoot: root}, nil
+}
+
+// shardedPath returns the sharded path of p, if it is the path of a blob or
+// under one.
+func (d *shardedBlobsDriver) shardedPath(p string) (string, bool) {
+	if !strings.HasPrefix(p, d.blobsRoot+"/") {
+		return "", false
+	}
+	components := strings.Split(p[len(d.blobsRoot)+1:], "/")
+	if len(components) < 3 {
+		return "", false
+	}
+	prefix, hex := components[1], components[2]
+	if len(prefix) != 2 || len(hex) < 4 || !strings.HasPrefix(hex, prefix) {
+		return "", false
+	}
+	sharded := append([]string{d.blobsRoot, components[0], prefix, hex[2:4]}, components[2:]...)
+	return path.Join(sharded...), true
+}
+
+// isShardPrefixDir returns whether p is a directory of the first level of
+// shards, <algorithm>/<ab>, the children of which are second level shards.
+func (d *shardedBlobsDriver) isShardPrefixDir(p string) bool {
+	if !strings.HasPrefix(p, d.blobsRoot+"/") {
+		return false
+	}
+	components := strings.Split(p[len(d.blobsRoot)+1:], "/")
+	return len(components) == 2 && len(components[1]) == 2
+}
+
+// resolve returns the path the content of the blob path p is stored at, its
+// sharded path unless only its usual one exists.
+func (d *shardedBlobsDriver) resolve(ctx context.Context, p string) string {
+	sharded, ok := d.shardedPath(p)
+	if !ok {
+		return p
+	}
+	if _, err := d.StorageDriver.Stat(ctx, sharded); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return p
+		}
+	}
+	return sharded
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *shardedBlobsDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	sharded, ok := d.shardedPath(path)
+	if !ok {
+		return d.StorageDriver.GetContent(ctx, path)
+	}
+	content, err := d.StorageDriver.GetContent(ctx, sharded)
+	if _, notFound := err.(storagedriver.PathNotFoundError); notFound {
+		return d.StorageDriver.GetContent(ctx, path)
+	}
+	return content, err
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// Blobs are stored at their sharded paths.
+func (d *shardedBlobsDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if sharded, ok := d.shardedPath(path); ok {
+		path = sharded
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *shardedBlobsDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	sharded, ok := d.shardedPath(path)
+	if !ok {
+		return d.StorageDriver.Reader(ctx, path, offset)
+	}
+	rc, err := d.StorageDriver.Reader(ctx, sharded, offset)
+	if _, notFound := err.(storagedriver.PathNotFoundError); notFound {
+		return d.StorageDriver.Reader(ctx, path, offset)
+	}
+	return rc, err
+}
+
+// Writer returns a FileWriter which will store the content written to it at
+// the location designated by "path" after the call to Commit. Blobs are
+// written at their sharded paths.
+func (d *shardedBlobsDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if sharded, ok := d.shardedPath(path); ok {
+		path = sharded
+	}
+	return d.StorageDriver.Writer(ctx, path, append)
+}
+
+// Stat retrieves the FileInfo for the given path. Blobs are reported at their
+// usual paths wherever they are stored.
+func (d *shardedBlobsDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	sharded, ok := d.shardedPath(path)
+	if !ok {
+		return d.StorageDriver.Stat(ctx, path)
+	}
+	fi, err := d.StorageDriver.Stat(ctx, sharded)
+	if _, notFound := err.(storagedriver.PathNotFoundError); notFound {
+		return d.StorageDriver.Stat(ctx, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    path,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+	}}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path. The blobs of a shard are listed at their usual paths, merging
+// those stored under the second level of shards with the others.
+func (d *shardedBlobsDriver) List(ctx context.Context, path string) ([]string, error) {
+	if sharded, ok := d.shardedPath(path); ok {
+		children, err := d.StorageDriver.List(ctx, sharded)
+		if _, notFound := err.(storagedriver.PathNotFoundError); notFound {
+			return d.StorageDriver.List(ctx, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, child := range children {
+			children[i] = path + strings.TrimPrefix(child, sharded)
+		}
+		return children, nil
+	}
+	if !d.isShardPrefixDir(path) {
+		return d.StorageDriver.List(ctx, path)
+	}
+
+	stored, err := d.StorageDriver.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{})
+	var children []string
+	for _, child := range stored {
+		if len(child) != len(path)+3 {
+			seen[child] = struct{}{}
+			children = append(children, child)
+			continue
+		}
+		// A second level shard, the blobs of which are listed instead.
+		blobs, err := d.StorageDriver.List(ctx, child)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				continue
+			}
+			return nil, err
+		}
+		for _, blob := range blobs {
+			blob = path + "/" + blob[len(child)+1:]
+			if _, ok := seen[blob]; !ok {
+				seen[blob] = struct{}{}
+				children = append(children, blob)
+			}
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object. Blobs are moved to their sharded paths.
+func (d *shardedBlobsDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	sourcePath = d.resolve(ctx, sourcePath)
+	if sharded, ok := d.shardedPath(destPath); ok {
+		destPath = sharded
+	}
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+// Blobs are deleted from their sharded and usual paths.
+func (d *shardedBlobsDriver) Delete(ctx context.Context, path string) error {
+	sharded, ok := d.shardedPath(path)
+	if !ok {
+		return d.StorageDriver.Delete(ctx, path)
+	}
+	shardedErr := d.StorageDriver.Delete(ctx, sharded)
+	if _, notFound := shardedErr.(storagedriver.PathNotFoundError); !notFound && shardedErr != nil {
+		return shardedErr
+	}
+	err := d.StorageDriver.Delete(ctx, path)
+	if _, notFound := err.(storagedriver.PathNotFoundError); notFound && shardedErr == nil {
+		return nil
+	}
+	return err
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at
+// the given path, wherever the blob is stored.
+func (d *shardedBlobsDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return d.StorageDriver.URLFor(ctx, d.resolve(ctx, path), options)
+}
+
+// Walk traverses the paths under path, with blobs at their usual paths,
+// calling f on each of them.
+func (d *shardedBlobsDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
+
+// Capabilities reports the capabilities of the wrapped driver.
+func (d *shardedBlobsDriver) Capabilities() storagedriver.Capabilities {
+	return storagedriver.CapabilitiesOf(d.StorageDriver)
+}
+
+// OpenFile opens the file holding the content stored at path, wherever the
+// blob is stored, if the wrapped driver implements storagedriver.FileOpener.
+func (d *shardedBlobsDriver) OpenFile(ctx context.Context, path string) (*os.File, error) {
+	return storagedriver.OpenFile(ctx, d.StorageDriver, d.resolve(ctx, path))
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"path"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// checkBlobs checks that the layers and manifest of im can be read from repo
+// and are enumerated by registry.
+func checkBlobs(t *testing.T, registry distribution.Namespace, repo distribution.Repository, im image) {
+	ctx := context.Background()
+	for layer := range im.layers {
+		rc, err := repo.Blobs(ctx).Open(ctx, layer)
+		if err != nil {
+			t.Fatalf("error opening layer %s: %v", layer, err)
+		}
+		verifier := layer.Verifier()
+		_, err = io.Copy(verifier, rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("error reading layer %s: %v", layer, err)
+		}
+		if !verifier.Verified() {
+			t.Fatalf("layer %s read with the wrong content", layer)
+		}
+	}
+	if _, err := makeManifestService(t, repo).Get(ctx, im.manifestDigest); err != nil {
+		t.Fatalf("error reading manifest %s: %v", im.manifestDigest, err)
+	}
+
+	blobs := allBlobs(t, registry)
+	for layer := range im.layers {
+		if _, ok := blobs[layer]; !ok {
+			t.Fatalf("layer %s not enumerated", layer)
+		}
+	}
+	if _, ok := blobs[im.manifestDigest]; !ok {
+		t.Fatalf("manifest %s not enumerated", im.manifestDigest)
+	}
+}
+
+// blobShards returns the number of directory levels between the algorithm
+// and the hex digest of the blob dgst stored in backend, or zero if it is not
+// stored.
+func blobShards(t *testing.T, backend driver.StorageDriver, dgst digest.Digest) int {
+	root, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hex := dgst.Hex()
+	for shards, p := range []string{
+		path.Join(root, dgst.Algorithm().String(), hex[:2], hex, "data"),
+		path.Join(root, dgst.Algorithm().String(), hex[:2], hex[2:4], hex, "data"),
+	} {
+		if _, err := backend.Stat(context.Background(), p); err == nil {
+			return shards + 1
+		}
+	}
+	return 0
+}
+
+func TestShardedBlobsLayout(t *testing.T) {
+	for _, tc := range []struct {
+		version int
+		shards  int
+	}{
+		{0, 1},
+		{LayoutVersionLinkFiles, 1},
+		{LayoutVersionPackedLinks, 1},
+		{LayoutVersionShardedBlobs, 2},
+	} {
+		backend := inmemory.New()
+		d, err := WithLayoutVersion(backend, tc.version)
+		if err != nil {
+			t.Fatalf("version %d: unexpected error: %v", tc.version, err)
+		}
+		registry := createRegistry(t, d)
+		repo := makeRepository(t, registry, "layout/app")
+		im := uploadRandomSchema2Image(t, repo)
+		checkBlobs(t, registry, repo, im)
+
+		for layer := range im.layers {
+			if shards := blobShards(t, backend, layer); shards != tc.shards {
+				t.Fatalf("version %d: layer stored under %d levels, expected %d", tc.version, shards, tc.shards)
+			}
+		}
+		if shards := blobShards(t, backend, im.manifestDigest); shards != tc.shards {
+			t.Fatalf("version %d: manifest stored under %d levels, expected %d", tc.version, shards, tc.shards)
+		}
+	}
+}
+
+// TestShardedBlobsReadsUnshardedBlobs checks that blobs stored under a single
+// level stay readable with the sharded layout, alongside new blobs, and are
+// deleted by garbage collection.
+func TestShardedBlobsReadsUnshardedBlobs(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	repo := makeRepository(t, createRegistry(t, backend), "layout/app")
+	old := uploadRandomSchema2Image(t, repo)
+	unreferenced := uploadRandomSchema2Image(t, repo)
+
+	d, err := WithLayoutVersion(backend, LayoutVersionShardedBlobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := createRegistry(t, d)
+	repo = makeRepository(t, registry, "layout/app")
+	checkBlobs(t, registry, repo, old)
+
+	im := uploadRandomSchema2Image(t, repo)
+	checkBlobs(t, registry, repo, im)
+	if shards := blobShards(t, backend, im.manifestDigest); shards != 2 {
+		t.Fatalf("new manifest stored under %d levels", shards)
+	}
+	if shards := blobShards(t, backend, old.manifestDigest); shards != 1 {
+		t.Fatalf("old manifest moved under %d levels", shards)
+	}
+
+	for _, tagged := range []image{old, im} {
+		if err := repo.Tags(ctx).Tag(ctx, tagged.manifestDigest.Hex()[:8], distribution.Descriptor{Digest: tagged.manifestDigest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := makeManifestService(t, repo).Delete(ctx, unreferenced.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if err := MarkAndSweep(ctx, d, registry, GCOpts{}); err != nil {
+		t.Fatalf("failed mark and sweep: %v", err)
+	}
+	for layer := range unreferenced.layers {
+		if shards := blobShards(t, backend, layer); shards != 0 {
+			t.Fatalf("unreferenced layer %s not deleted", layer)
+		}
+	}
+	checkBlobs(t, registry, repo, old)
+	checkBlobs(t, registry, repo, im)
+}
@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/split"
+)
+
+// TestSplitDriverPushPull checks that, with the split driver, a push stores
+// manifests and tags with the metadata driver and layer bytes with the blobs
+// driver, and that a pull reassembles the image from both.
+func TestSplitDriverPushPull(t *testing.T) {
+	ctx := context.Background()
+	metadataDriver := inmemory.New()
+	blobsDriver := inmemory.New()
+
+	registry := createRegistry(t, split.New(metadataDriver, blobsDriver))
+	repo := makeRepository(t, registry, "split/image")
+	image := uploadRandomSchema2Image(t, repo)
+
+	desc := distribution.Descriptor{Digest: image.manifestDigest}
+	if err := repo.Tags(ctx).Tag(ctx, "latest", desc); err != nil {
+		t.Fatalf("unexpected error tagging manifest: %v", err)
+	}
+
+	revisionLink, _ := pathFor(manifestRevisionLinkPathSpec{name: "split/image", revision: image.manifestDigest})
+	tagLink, _ := pathFor(manifestTagCurrentPathSpec{name: "split/image", tag: "latest"})
+	manifestData, _ := pathFor(blobDataPathSpec{digest: image.manifestDigest})
+	for _, p := range []string{revisionLink, tagLink, manifestData} {
+		checkStoredIn(t, p, "metadata", metadataDriver, blobsDriver)
+	}
+
+	for dgst := range image.layers {
+		layerData, _ := pathFor(blobDataPathSpec{digest: dgst})
+		checkStoredIn(t, layerData, "blobs", blobsDriver, metadataDriver)
+	}
+
+	// Pull the image back
+	manifests := makeManifestService(t, repo)
+	tagged, err := repo.Tags(ctx).Get(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error resolving tag: %v", err)
+	}
+	fetched, err := manifests.Get(ctx, tagged.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest: %v", err)
+	}
+	_, expectedPayload, _ := image.manifest.Payload()
+	_, fetchedPayload, _ := fetched.Payload()
+	if !bytes.Equal(expectedPayload, fetchedPayload) {
+		t.Fatalf("fetched manifest does not match pushed manifest")
+	}
+
+	for dgst, rs := range image.layers {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("unexpected error seeking layer: %v", err)
+		}
+		expected, err := ioutil.ReadAll(rs)
+		if err != nil {
+			t.Fatalf("unexpected error reading layer: %v", err)
+		}
+
+		rc, err := repo.Blobs(ctx).Open(ctx, dgst)
+		if err != nil {
+			t.Fatalf("unexpected error opening layer %s: %v", dgst, err)
+		}
+		actual, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("unexpected error reading layer %s: %v", dgst, err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Fatalf("fetched layer %s does not match pushed layer", dgst)
+		}
+	}
+}
+
+// TestSplitDriverShardedUploads checks that uploads stored with a separate
+// uploads driver are moved to the sharded paths of the sharded layout, and
+// verified against their digest there.
+func TestSplitDriverShardedUploads(t *testing.T) {
+	ctx := context.Background()
+	metadataDriver := inmemory.New()
+	blobsDriver := inmemory.New()
+	uploadsDriver := inmemory.New()
+
+	d, err := WithLayoutVersion(split.NewWithUploads(metadataDriver, blobsDriver, uploadsDriver), LayoutVersionShardedBlobs)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "split/sharded")
+	image := uploadRandomSchema2Image(t, repo)
+
+	for dgst := range image.layers {
+		layerData, _ := pathFor(blobDataPathSpec{digest: dgst})
+		sharded, ok := d.(*shardedBlobsDriver).shardedPath(layerData)
+		if !ok {
+			t.Fatalf("no sharded path for %s", layerData)
+		}
+		checkStoredIn(t, sharded, "blobs", blobsDriver, metadataDriver)
+
+		if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("unexpected error getting layer %s: %v", dgst, err)
+		}
+	}
+}
+
+// TestSplitDriverGarbageCollect checks that garbage collection sees and
+// removes content from both drivers.
+func TestSplitDriverGarbageCollect(t *testing.T) {
+	ctx := context.Background()
+	metadataDriver := inmemory.New()
+	blobsDriver := inmemory.New()
+	splitDriver := split.New(metadataDriver, blobsDriver)
+
+	registry := createRegistry(t, splitDriver)
+	repo := makeRepository(t, registry, "split/gc")
+	kept := uploadRandomSchema2Image(t, repo)
+	deleted := uploadRandomSchema2Image(t, repo)
+
+	before := allBlobs(t, registry)
+	for dgst := range deleted.layers {
+		if _, ok := before[dgst]; !ok {
+			t.Fatalf("layer %s from the blobs driver is not enumerated", dgst)
+		}
+	}
+	if _, ok := before[deleted.manifestDigest]; !ok {
+		t.Fatalf("manifest %s from the metadata driver is not enumerated", deleted.manifestDigest)
+	}
+
+	manifests := makeManifestService(t, repo)
+	if err := manifests.Delete(ctx, deleted.manifestDigest); err != nil {
+		t.Fatalf("unexpected error deleting manifest: %v", err)
+	}
+
+	err := MarkAndSweep(ctx, splitDriver, registry, GCOpts{})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	after := allBlobs(t, registry)
+	if _, ok := after[kept.manifestDigest]; !ok {
+		t.Fatalf("kept manifest is missing")
+	}
+	for dgst := range kept.layers {
+		if _, ok := after[dgst]; !ok {
+			t.Fatalf("kept layer %s is missing", dgst)
+		}
+	}
+
+	manifestData, _ := pathFor(blobDataPathSpec{digest: deleted.manifestDigest})
+	checkDeleted(t, manifestData, metadataDriver)
+	for dgst := range deleted.layers {
+		layerData, _ := pathFor(blobDataPathSpec{digest: dgst})
+		checkDeleted(t, layerData, blobsDriver)
+	}
+}
+
+// checkStoredIn checks that p is stored with the named driver in, and only
+// with it.
+func checkStoredIn(t *testing.T, p, name string, in, notIn driver.StorageDriver) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := in.Stat(ctx, p); err != nil {
+		t.Errorf("expected %s to be stored with the %s driver: %v", p, name, err)
+	}
+	if _, err := notIn.Stat(ctx, p); err == nil {
+		t.Errorf("expected %s to be stored only with the %s driver", p, name)
+	}
+}
+
+func checkDeleted(t *testing.T, p string, d driver.StorageDriver) {
+	t.Helper()
+	if _, err := d.Stat(context.Background(), p); err == nil {
+		t.Errorf("expected %s to be deleted", p)
+	}
+}
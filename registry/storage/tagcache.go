@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+)
+
+// tagCache holds the tags of repositories resolved or listed recently, keyed
+// by repository name. Entries are dropped when the tags of their repository
+// are written through the cache and expire after ttl, in case they are
+// written by another registry sharing the storage.
+type tagCache struct {
+	ttl time.Duration
+
+	mu           sync.Mutex
+	repositories map[string]*cachedTags
+	lastSweep    time.Time
+	// generations is the last generation given to cached tags.
+	generations uint64
+}
+
+// cachedTags holds the cached tags of a repository.
+type cachedTags struct {
+	// generation changes on every write to the tags of the repository,
+	// and is never reused. A lookup only populates the cache if no write
+	// happened since it started reading the storage, or it could cache the
+	// digest a tag pointed to before the write.
+	generation uint64
+
+	digests map[string]cachedDigest
+
+	list        []string
+	listExpires time.Time
+}
+
+type cachedDigest struct {
+	desc    distribution.Descriptor
+	expires time.Time
+}
+
+func newTagCache(ttl time.Duration) *tagCache {
+	return &tagCache{
+		ttl:          ttl,
+		repositories: make(map[string]*cachedTags),
+		lastSweep:    time.Now(),
+	}
+}
+
+// repository returns the cached tags of name, creating them if needed. The
+// cache must be locked.
+func (tc *tagCache) repository(name string) *cachedTags {
+	repo, ok := tc.repositories[name]
+	if !ok {
+		tc.generations++
+		repo = &cachedTags{generation: tc.generations, digests: make(map[string]cachedDigest)}
+		tc.repositories[name] = repo
+	}
+	return repo
+}
+
+// generation returns the current generation of the tags of name, to be
+// passed back when populating the cache.
+func (tc *tagCache) generation(name string) uint64 {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.repository(name).generation
+}
+
+func (tc *tagCache) get(name, tag string) (distribution.Descriptor, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	repo, ok := tc.repositories[name]
+	if !ok {
+		return distribution.Descriptor{}, false
+	}
+	entry, ok := repo.digests[tag]
+	if !ok || time.Now().After(entry.expires) {
+		return distribution.Descriptor{}, false
+	}
+	return entry.desc, true
+}
+
+func (tc *tagCache) setDigest(name, tag string, generation uint64, desc distribution.Descriptor) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	repo := tc.repository(name)
+	if repo.generation != generation {
+		return
+	}
+	repo.digests[tag] = cachedDigest{desc: desc, expires: time.Now().Add(tc.ttl)}
+	tc.sweep()
+}
+
+func (tc *tagCache) all(name string) ([]string, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	repo, ok := tc.repositories[name]
+	if !ok || repo.list == nil || time.Now().After(repo.listExpires) {
+		return nil, false
+	}
+	return append([]string(nil), repo.list...), true
+}
+
+func (tc *tagCache) setAll(name string, generation uint64, tags []string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	repo := tc.repository(name)
+	if repo.generation != generation {
+		return
+	}
+	repo.list = append(make([]string, 0, len(tags)), tags...)
+	repo.listExpires = time.Now().Add(tc.ttl)
+	tc.sweep()
+}
+
+// invalidate drops the cached tags of name. It is called once a write to
+// them returned, successfully or not.
+func (tc *tagCache) invalidate(name string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	repo := tc.repository(name)
+	tc.generations++
+	repo.generation = tc.generations
+	repo.digests = make(map[string]cachedDigest)
+	repo.list = nil
+}
+
+// sweep drops the expired entries, at most once per ttl so that the cache
+// only holds the tags used within the last two ttls. The cache must be locked.
+func (tc *tagCache) sweep() {
+	now := time.Now()
+	if now.Sub(tc.lastSweep) < tc.ttl {
+		return
+	}
+	tc.lastSweep = now
+
+	for name, repo := range tc.repositories {
+		for tag, entry := range repo.digests {
+			if now.After(entry.expires) {
+				delete(repo.digests, tag)
+			}
+		}
+		if repo.list != nil && now.After(repo.listExpires) {
+			repo.list = nil
+		}
+		if len(repo.digests) == 0 && repo.list == nil {
+			delete(tc.repositories, name)
+		}
+	}
+}
+
+// cachedTagStore is a tagStore resolving and listing tags through a
+// tagCache.
+type cachedTagStore struct {
+	*tagStore
+	cache *tagCache
+}
+
+var _ distribution.TagService = &cachedTagStore{}
+var _ distribution.TagChecker = &cachedTagStore{}
+
+func (ts *cachedTagStore) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	name := ts.repository.Named().Name()
+	if desc, ok := ts.cache.get(name, tag); ok {
+		return desc, nil
+	}
+
+	generation := ts.cache.generation(name)
+	desc, err := ts.tagStore.Get(ctx, tag)
+	if err != nil {
+		return desc, err
+	}
+	ts.cache.setDigest(name, tag, generation, desc)
+	return desc, nil
+}
+
+func (ts *cachedTagStore) All(ctx context.Context) ([]string, error) {
+	name := ts.repository.Named().Name()
+	if tags, ok := ts.cache.all(name); ok {
+		return tags, nil
+	}
+
+	generation := ts.cache.generation(name)
+	tags, err := ts.tagStore.All(ctx)
+	if err != nil {
+		return tags, err
+	}
+	ts.cache.setAll(name, generation, tags)
+	return tags, nil
+}
+
+func (ts *cachedTagStore) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	defer ts.cache.invalidate(ts.repository.Named().Name())
+	return ts.tagStore.Tag(ctx, tag, desc)
+}
+
+func (ts *cachedTagStore) Untag(ctx context.Context, tag string) error {
+	defer ts.cache.invalidate(ts.repository.Named().Name())
+	return ts.tagStore.Untag(ctx, tag)
+}
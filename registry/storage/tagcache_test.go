@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+type tagCacheTestEnv struct {
+	ctx    context.Context
+	driver driver.StorageDriver
+	tags   distribution.TagService
+}
+
+func newTagCacheTestEnv(t *testing.T, ttl time.Duration) *tagCacheTestEnv {
+	ctx := context.Background()
+	d := inmemory.New()
+	reg, err := NewRegistry(ctx, d, TagCache(ttl))
+	if err != nil {
+		t.Fatalf("failed to construct registry: %v", err)
+	}
+	named, _ := reference.WithName("cached/repo")
+	repo, err := reg.Repository(ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+	return &tagCacheTestEnv{ctx: ctx, driver: d, tags: repo.Tags(ctx)}
+}
+
+// tagBehind points tag at dgst in the storage without going through the
+// cache, as another registry sharing the storage would.
+func (env *tagCacheTestEnv) tagBehind(t *testing.T, tag string, dgst digest.Digest) {
+	t.Helper()
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{name: "cached/repo", tag: tag})
+	if err != nil {
+		t.Fatalf("unexpected error building path: %v", err)
+	}
+	if err := env.driver.PutContent(env.ctx, currentPath, []byte(dgst)); err != nil {
+		t.Fatalf("failed to write tag link: %v", err)
+	}
+}
+
+func (env *tagCacheTestEnv) expectDigest(t *testing.T, tag string, expected digest.Digest) {
+	t.Helper()
+	desc, err := env.tags.Get(env.ctx, tag)
+	if err != nil {
+		t.Fatalf("failed to resolve %s: %v", tag, err)
+	}
+	if desc.Digest != expected {
+		t.Fatalf("%s resolved to %s, expected %s", tag, desc.Digest, expected)
+	}
+}
+
+func (env *tagCacheTestEnv) expectTags(t *testing.T, expected ...string) {
+	t.Helper()
+	tags, err := env.tags.All(env.ctx)
+	if err != nil {
+		t.Fatalf("failed to list tags: %v", err)
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("unexpected tags: %v != %v", tags, expected)
+	}
+}
+
+func TestTagCacheResolveHit(t *testing.T) {
+	env := newTagCacheTestEnv(t, 100*time.Millisecond)
+	first, second := digest.FromString("first"), digest.FromString("second")
+
+	if err := env.tags.Tag(env.ctx, "latest", distribution.Descriptor{Digest: first}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	env.expectDigest(t, "latest", first)
+
+	// Changed behind the cache, the tag resolves from the cache until
+	// its entry expires.
+	env.tagBehind(t, "latest", second)
+	env.expectDigest(t, "latest", first)
+
+	time.Sleep(150 * time.Millisecond)
+	env.expectDigest(t, "latest", second)
+}
+
+func TestTagCacheListHit(t *testing.T) {
+	env := newTagCacheTestEnv(t, 100*time.Millisecond)
+	dgst := digest.FromString("manifest")
+
+	if err := env.tags.Tag(env.ctx, "a", distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	env.expectTags(t, "a")
+
+	env.tagBehind(t, "b", dgst)
+	env.expectTags(t, "a")
+
+	time.Sleep(150 * time.Millisecond)
+	env.expectTags(t, "a", "b")
+}
+
+func TestTagCacheInvalidation(t *testing.T) {
+	env := newTagCacheTestEnv(t, time.Hour)
+	first, second := digest.FromString("first"), digest.FromString("second")
+
+	if err := env.tags.Tag(env.ctx, "latest", distribution.Descriptor{Digest: first}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	env.expectDigest(t, "latest", first)
+	env.expectTags(t, "latest")
+
+	if err := env.tags.Tag(env.ctx, "latest", distribution.Descriptor{Digest: second}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	env.expectDigest(t, "latest", second)
+
+	if err := env.tags.Tag(env.ctx, "stable", distribution.Descriptor{Digest: first}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	env.expectTags(t, "latest", "stable")
+
+	if err := env.tags.Untag(env.ctx, "latest"); err != nil {
+		t.Fatalf("failed to untag: %v", err)
+	}
+	if _, err := env.tags.Get(env.ctx, "latest"); err == nil {
+		t.Fatalf("deleted tag resolved from the cache")
+	} else if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		t.Fatalf("unexpected error resolving deleted tag: %v", err)
+	}
+	env.expectTags(t, "stable")
+}
+
+// stallingDriver stalls the next read of a tag link after reading it, until
+// released.
+type stallingDriver struct {
+	driver.StorageDriver
+
+	mu      sync.Mutex
+	stall   chan struct{}
+	stalled chan struct{}
+}
+
+func (d *stallingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	if !strings.HasSuffix(path, "/current/link") {
+		return content, err
+	}
+
+	d.mu.Lock()
+	stall := d.stall
+	d.stall = nil
+	d.mu.Unlock()
+	if stall != nil {
+		d.stalled <- struct{}{}
+		<-stall
+	}
+	return content, err
+}
+
+// TestTagCacheWriteDuringLookup checks that a tag never resolves to the
+// digest it pointed to before a write once the write returned, even if a
+// lookup which read the previous digest populates the cache afterwards.
+func TestTagCacheWriteDuringLookup(t *testing.T) {
+	ctx := context.Background()
+	d := &stallingDriver{StorageDriver: inmemory.New(), stalled: make(chan struct{})}
+	reg, err := NewRegistry(ctx, d, TagCache(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to construct registry: %v", err)
+	}
+	named, _ := reference.WithName("cached/repo")
+	repo, err := reg.Repository(ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+	env := &tagCacheTestEnv{ctx: ctx, driver: d, tags: repo.Tags(ctx)}
+	first, second := digest.FromString("first"), digest.FromString("second")
+
+	if err := env.tags.Tag(ctx, "latest", distribution.Descriptor{Digest: first}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+
+	release := make(chan struct{})
+	d.mu.Lock()
+	d.stall = release
+	d.mu.Unlock()
+
+	looked := make(chan struct{})
+	go func() {
+		defer close(looked)
+		env.tags.Get(ctx, "latest")
+	}()
+	<-d.stalled
+
+	if err := env.tags.Tag(ctx, "latest", distribution.Descriptor{Digest: second}); err != nil {
+		t.Fatalf("failed to tag: %v", err)
+	}
+	close(release)
+	<-looked
+
+	env.expectDigest(t, "latest", second)
+}
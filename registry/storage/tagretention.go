@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// RetentionRule selects the tags of repositories to keep. The tags matched
+// by a rule which satisfy none of its conditions are deleted.
+type RetentionRule struct {
+	// Repository is the name of a repository or, when it ends with a slash,
+	// a namespace prefix. An empty name matches every repository.
+	Repository string
+
+	// Tags is a regular expression matched against whole tags. An empty
+	// expression matches every tag.
+	Tags string
+
+	// KeepLast keeps the given number of most recently pushed tags.
+	KeepLast int
+
+	// KeepNewerThan keeps the tags pushed within the given duration.
+	KeepNewerThan time.Duration
+}
+
+// TagRetentionOpts contains options for PruneTags.
+type TagRetentionOpts struct {
+	// Rules are the retention rules. A tag is subject to the first rule
+	// matching its repository and itself, and kept if no rule matches.
+	Rules []RetentionRule
+
+	// DryRun reports the tags outside of the rules without deleting them.
+	DryRun bool
+
+	// Now is the time push times are compared against. It defaults to the
+	// current time.
+	Now time.Time
+}
+
+// PrunedTag describes a tag deleted by PruneTags.
+type PrunedTag struct {
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+	PushedAt   time.Time
+}
+
+// retentionRule is a RetentionRule with its tag expression compiled.
+type retentionRule struct {
+	RetentionRule
+	tags *regexp.Regexp
+}
+
+func (rule *retentionRule) matchesRepository(name string) bool {
+	return rule.Repository == "" || rule.Repository == name ||
+		(strings.HasSuffix(rule.Repository, "/") && strings.HasPrefix(name, rule.Repository))
+}
+
+// retainedTag is a tag along with the time it was last pushed.
+type retainedTag struct {
+	name     string
+	digest   digest.Digest
+	pushedAt time.Time
+}
+
+// PruneTags deletes the tags of the repositories of registry which fall
+// outside of the retention rules. The time a tag was pushed is the
+// modification time of the link to its current manifest, which is rewritten
+// every time the tag is pushed. Manifests left untagged are not deleted,
+// which garbage collection does when removing untagged manifests.
+func PruneTags(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts TagRetentionOpts) ([]PrunedTag, error) {
+	rules := make([]*retentionRule, len(opts.Rules))
+	for i, rule := range opts.Rules {
+		if rule.KeepLast < 0 || rule.KeepNewerThan < 0 {
+			return nil, fmt.Errorf("retention rule %d must not keep a negative number or age of tags", i)
+		}
+		if rule.KeepLast == 0 && rule.KeepNewerThan == 0 {
+			return nil, fmt.Errorf("retention rule %d must keep the last tags or those newer than a duration", i)
+		}
+		expr := rule.Tags
+		if expr == "" {
+			expr = ".*"
+		}
+		tags, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag expression of retention rule %d: %v", i, err)
+		}
+		rules[i] = &retentionRule{RetentionRule: rule, tags: tags}
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	var pruned []PrunedTag
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		var applicable []*retentionRule
+		for _, rule := range rules {
+			if rule.matchesRepository(repoName) {
+				applicable = append(applicable, rule)
+			}
+		}
+		if len(applicable) == 0 {
+			return nil
+		}
+
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+		tagService := repository.Tags(ctx)
+
+		allTags, err := tagService.All(ctx)
+		if err != nil {
+			if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+				return nil
+			}
+			return fmt.Errorf("failed to retrieve tags of %s: %v", repoName, err)
+		}
+
+		// Group the tags by the first rule matching them.
+		matched := make(map[*retentionRule][]retainedTag)
+		for _, tag := range allTags {
+			var rule *retentionRule
+			for _, r := range applicable {
+				if r.tags.MatchString(tag) {
+					rule = r
+					break
+				}
+			}
+			if rule == nil {
+				continue
+			}
+
+			rt, ok, err := tagPushTime(ctx, storageDriver, tagService, repoName, tag)
+			if err != nil {
+				return err
+			}
+			if ok {
+				matched[rule] = append(matched[rule], rt)
+			}
+		}
+
+		for _, rule := range applicable {
+			tags := matched[rule]
+			// Most recently pushed first, ties broken by name so that
+			// the outcome does not depend on the listing order.
+			sort.Slice(tags, func(i, j int) bool {
+				if !tags[i].pushedAt.Equal(tags[j].pushedAt) {
+					return tags[i].pushedAt.After(tags[j].pushedAt)
+				}
+				return tags[i].name > tags[j].name
+			})
+
+			for i, tag := range tags {
+				if i < rule.KeepLast {
+					continue
+				}
+				if rule.KeepNewerThan > 0 && now.Sub(tag.pushedAt) < rule.KeepNewerThan {
+					continue
+				}
+
+				if opts.DryRun {
+					emit("tag eligible for deletion: %s:%s", repoName, tag.name)
+				} else {
+					emit("deleting tag: %s:%s", repoName, tag.name)
+					if err := tagService.Untag(ctx, tag.name); err != nil {
+						return fmt.Errorf("failed to delete tag %s of %s: %v", tag.name, repoName, err)
+					}
+				}
+				pruned = append(pruned, PrunedTag{
+					Repository: repoName,
+					Tag:        tag.name,
+					Digest:     tag.digest,
+					PushedAt:   tag.pushedAt,
+				})
+			}
+		}
+		return nil
+	})
+	return pruned, err
+}
+
+// tagPushTime returns the manifest tag currently points to and the time it
+// was pushed, or false if the tag was deleted in the meantime.
+func tagPushTime(ctx context.Context, storageDriver driver.StorageDriver, tagService distribution.TagService, repoName, tag string) (retainedTag, bool, error) {
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{
+		name: repoName,
+		tag:  tag,
+	})
+	if err != nil {
+		return retainedTag{}, false, err
+	}
+
+	fi, err := storageDriver.Stat(ctx, currentPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return retainedTag{}, false, nil
+		}
+		return retainedTag{}, false, fmt.Errorf("failed to stat tag %s of %s: %v", tag, repoName, err)
+	}
+
+	desc, err := tagService.Get(ctx, tag)
+	if err != nil {
+		if _, ok := err.(distribution.ErrTagUnknown); ok {
+			return retainedTag{}, false, nil
+		}
+		return retainedTag{}, false, fmt.Errorf("failed to resolve tag %s of %s: %v", tag, repoName, err)
+	}
+
+	return retainedTag{name: tag, digest: desc.Digest, pushedAt: fi.ModTime()}, true, nil
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+type retentionTestEnv struct {
+	ctx      context.Context
+	driver   driver.StorageDriver
+	registry distribution.Namespace
+}
+
+func newRetentionTestEnv(t *testing.T) *retentionTestEnv {
+	ctx := context.Background()
+	d := inmemory.New()
+	reg, err := NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatalf("failed to construct registry: %v", err)
+	}
+	return &retentionTestEnv{ctx: ctx, driver: d, registry: reg}
+}
+
+// tag pushes the given tags to the named repository, in order and a few
+// milliseconds apart so that their push times differ.
+func (env *retentionTestEnv) tag(t *testing.T, name string, tags ...string) {
+	t.Helper()
+	named, err := reference.WithName(name)
+	if err != nil {
+		t.Fatalf("failed to parse name: %v", err)
+	}
+	repo, err := env.registry.Repository(env.ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+	for _, tag := range tags {
+		desc := distribution.Descriptor{Digest: digest.FromString(tag)}
+		if err := repo.Tags(env.ctx).Tag(env.ctx, tag, desc); err != nil {
+			t.Fatalf("failed to tag %s: %v", tag, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (env *retentionTestEnv) tags(t *testing.T, name string) []string {
+	t.Helper()
+	named, _ := reference.WithName(name)
+	repo, err := env.registry.Repository(env.ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+	tags, err := repo.Tags(env.ctx).All(env.ctx)
+	if err != nil {
+		t.Fatalf("failed to list tags: %v", err)
+	}
+	return tags
+}
+
+func prunedTags(pruned []PrunedTag) []string {
+	var tags []string
+	for _, p := range pruned {
+		tags = append(tags, p.Repository+":"+p.Tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func TestPruneTagsKeepLast(t *testing.T) {
+	env := newRetentionTestEnv(t)
+	env.tag(t, "app/web", "1", "2", "3", "4", "dev-a", "dev-b")
+	env.tag(t, "other", "1", "2", "3")
+
+	opts := TagRetentionOpts{
+		Rules: []RetentionRule{{
+			Repository: "app/",
+			Tags:       "[0-9]+",
+			KeepLast:   2,
+		}},
+		DryRun: true,
+	}
+
+	pruned, err := PruneTags(env.ctx, env.driver, env.registry, opts)
+	if err != nil {
+		t.Fatalf("failed to prune tags: %v", err)
+	}
+	expected := []string{"app/web:1", "app/web:2"}
+	if !reflect.DeepEqual(prunedTags(pruned), expected) {
+		t.Fatalf("unexpected tags eligible for deletion: %v != %v", prunedTags(pruned), expected)
+	}
+	if pruned[0].Digest != digest.FromString(pruned[0].Tag) {
+		t.Errorf("unexpected digest of pruned tag: %s", pruned[0].Digest)
+	}
+	if tags := env.tags(t, "app/web"); len(tags) != 6 {
+		t.Fatalf("dry run deleted tags: %v", tags)
+	}
+
+	opts.DryRun = false
+	pruned, err = PruneTags(env.ctx, env.driver, env.registry, opts)
+	if err != nil {
+		t.Fatalf("failed to prune tags: %v", err)
+	}
+	if !reflect.DeepEqual(prunedTags(pruned), expected) {
+		t.Fatalf("unexpected deleted tags: %v != %v", prunedTags(pruned), expected)
+	}
+	if tags := env.tags(t, "app/web"); !reflect.DeepEqual(tags, []string{"3", "4", "dev-a", "dev-b"}) {
+		t.Fatalf("unexpected remaining tags: %v", tags)
+	}
+	if tags := env.tags(t, "other"); len(tags) != 3 {
+		t.Fatalf("unexpected remaining tags of unmatched repository: %v", tags)
+	}
+}
+
+func TestPruneTagsKeepNewerThan(t *testing.T) {
+	env := newRetentionTestEnv(t)
+	env.tag(t, "app", "old-1", "old-2")
+	mark := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	env.tag(t, "app", "new-1", "new-2")
+
+	opts := TagRetentionOpts{
+		Rules: []RetentionRule{{
+			KeepNewerThan: time.Hour,
+		}},
+		DryRun: true,
+		Now:    mark.Add(time.Hour),
+	}
+
+	pruned, err := PruneTags(env.ctx, env.driver, env.registry, opts)
+	if err != nil {
+		t.Fatalf("failed to prune tags: %v", err)
+	}
+	expected := []string{"app:old-1", "app:old-2"}
+	if !reflect.DeepEqual(prunedTags(pruned), expected) {
+		t.Fatalf("unexpected tags eligible for deletion: %v != %v", prunedTags(pruned), expected)
+	}
+	if tags := env.tags(t, "app"); len(tags) != 4 {
+		t.Fatalf("dry run deleted tags: %v", tags)
+	}
+
+	// Tags satisfying either condition are kept.
+	opts.Rules[0].KeepLast = 3
+	opts.DryRun = false
+	pruned, err = PruneTags(env.ctx, env.driver, env.registry, opts)
+	if err != nil {
+		t.Fatalf("failed to prune tags: %v", err)
+	}
+	if !reflect.DeepEqual(prunedTags(pruned), []string{"app:old-1"}) {
+		t.Fatalf("unexpected deleted tags: %v", prunedTags(pruned))
+	}
+	if tags := env.tags(t, "app"); !reflect.DeepEqual(tags, []string{"new-1", "new-2", "old-2"}) {
+		t.Fatalf("unexpected remaining tags: %v", tags)
+	}
+}
+
+func TestPruneTagsInvalidRules(t *testing.T) {
+	env := newRetentionTestEnv(t)
+
+	for _, rule := range []RetentionRule{
+		{},
+		{KeepLast: -1},
+		{KeepNewerThan: -time.Hour},
+		{KeepLast: 1, Tags: "("},
+	} {
+		if _, err := PruneTags(env.ctx, env.driver, env.registry, TagRetentionOpts{Rules: []RetentionRule{rule}}); err == nil {
+			t.Errorf("expected an error for rule %+v", rule)
+		}
+	}
+}
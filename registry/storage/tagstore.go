@@ -2,15 +2,24 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"path"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
 )
 
 var _ distribution.TagService = &tagStore{}
+var _ distribution.TagChecker = &tagStore{}
+var _ distribution.TagPushTimeProvider = &tagStore{}
+
+// errTagFound stops the walk of the tags of a repository once one is found.
+var errTagFound = errors.New("tag found")
 
 // tagStore provides methods to manage manifest tags in a backend storage driver.
 // This implementation uses the same on-disk layout as the (now deleted) tag
@@ -55,6 +64,38 @@ func (ts *tagStore) All(ctx context.Context) ([]string, error) {
 	return tags, nil
 }
 
+// HasTags returns whether the repository has at least one tag, stopping at
+// the first one found.
+func (ts *tagStore) HasTags(ctx context.Context) (bool, error) {
+	pathSpec, err := pathFor(manifestTagPathSpec{
+		name: ts.repository.Named().Name(),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	err = ts.blobStore.driver.Walk(ctx, pathSpec, func(fileInfo storagedriver.FileInfo) error {
+		if fileInfo.IsDir() && path.Dir(fileInfo.Path()) == pathSpec {
+			found = true
+			return errTagFound
+		}
+		return nil
+	})
+	if found {
+		// The walk was stopped by errTagFound, which drivers may wrap.
+		return true, nil
+	}
+	switch err.(type) {
+	case nil:
+		return false, nil
+	case storagedriver.PathNotFoundError:
+		return false, distribution.ErrRepositoryUnknown{Name: ts.repository.Named().Name()}
+	default:
+		return false, err
+	}
+}
+
 // Tag tags the digest with the given tag, updating the the store to point at
 // the current tag. The digest must point to a manifest.
 func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
@@ -67,6 +108,11 @@ func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descr
 		return err
 	}
 
+	if l := ts.writeLock(tag); l != nil {
+		l.Lock()
+		defer l.Unlock()
+	}
+
 	lbs := ts.linkedBlobStore(ctx, tag)
 
 	// Link into the index
@@ -75,7 +121,66 @@ func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descr
 	}
 
 	// Overwrite the current link
-	return ts.blobStore.link(ctx, currentPath, desc.Digest)
+	if err := ts.blobStore.link(ctx, currentPath, desc.Digest); err != nil {
+		return err
+	}
+
+	return ts.recordPushTime(ctx, tag, time.Now())
+}
+
+// recordPushTime records t as the time the tag was last pushed.
+func (ts *tagStore) recordPushTime(ctx context.Context, tag string, t time.Time) error {
+	pushTimePath, err := pathFor(manifestTagPushTimePathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ts.blobStore.driver.PutContent(ctx, pushTimePath, []byte(t.UTC().Format(time.RFC3339Nano)))
+}
+
+// PushTime returns the time the tag was last pushed. Tags pushed before push
+// times were recorded are given the modification time of their current link,
+// which is recorded for them if the storage can be written.
+func (ts *tagStore) PushTime(ctx context.Context, tag string) (time.Time, error) {
+	pushTimePath, err := pathFor(manifestTagPushTimePathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	content, err := ts.blobStore.driver.GetContent(ctx, pushTimePath)
+	if err == nil {
+		return time.Parse(time.RFC3339Nano, string(content))
+	}
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		return time.Time{}, err
+	}
+
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	fi, err := ts.blobStore.driver.Stat(ctx, currentPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return time.Time{}, distribution.ErrTagUnknown{Tag: tag}
+		}
+		return time.Time{}, err
+	}
+
+	if err := ts.recordPushTime(ctx, tag, fi.ModTime()); err != nil {
+		dcontext.GetLogger(ctx).Warnf("failed to record push time of tag %s: %v", tag, err)
+	}
+	return fi.ModTime(), nil
 }
 
 // resolve the current revision for name and tag.
@@ -112,9 +217,22 @@ func (ts *tagStore) Untag(ctx context.Context, tag string) error {
 		return err
 	}
 
+	if l := ts.writeLock(tag); l != nil {
+		l.Lock()
+		defer l.Unlock()
+	}
 	return ts.blobStore.driver.Delete(ctx, tagPath)
 }
 
+// writeLock returns the lock serializing the writes to tag, or nil if they
+// are not serialized.
+func (ts *tagStore) writeLock(tag string) *sync.Mutex {
+	if ts.repository.registry.tagWriteLocks == nil {
+		return nil
+	}
+	return ts.repository.registry.tagWriteLocks.lock(ts.repository.Named().Name(), tag)
+}
+
 // linkedBlobStore returns the linkedBlobStore for the named tag, allowing one
 // to index manifest blobs by tag name. While the tag store doesn't map
 // precisely to the linked blob store, using this ensures the links are
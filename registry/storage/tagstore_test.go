@@ -2,13 +2,18 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest"
 	"github.com/distribution/distribution/v3/manifest/schema2"
 	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	digest "github.com/opencontainers/go-digest"
 )
@@ -166,6 +171,121 @@ func TestTagStoreAll(t *testing.T) {
 
 }
 
+func TestTagStoreHasTags(t *testing.T) {
+	env := testTagStore(t)
+	tagStore := env.ts.(distribution.TagChecker)
+	ctx := env.ctx
+
+	if _, err := tagStore.HasTags(ctx); err == nil {
+		t.Fatalf("expected an error for a repository never tagged")
+	} else if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	desc := distribution.Descriptor{Digest: "sha256:eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"}
+	for _, tag := range []string{"a", "b"} {
+		if err := env.ts.Tag(ctx, tag, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hasTags, err := tagStore.HasTags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasTags {
+		t.Errorf("expected the repository to have tags")
+	}
+
+	for _, tag := range []string{"a", "b"} {
+		if err := env.ts.Untag(ctx, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hasTags, err = tagStore.HasTags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasTags {
+		t.Errorf("expected the repository to have no tags")
+	}
+}
+
+func TestTagStorePushTime(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	reg, err := NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoRef, _ := reference.WithName("a/b")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := repo.Tags(ctx)
+	provider := tags.(distribution.TagPushTimeProvider)
+
+	if _, err := provider.PushTime(ctx, "latest"); err == nil {
+		t.Fatalf("expected an error for an unknown tag")
+	} else if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	desc := distribution.Descriptor{Digest: "sha256:eeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee"}
+	before := time.Now()
+	if err := tags.Tag(ctx, "latest", desc); err != nil {
+		t.Fatal(err)
+	}
+	pushedAt, err := provider.PushTime(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushedAt.Before(before) || pushedAt.After(time.Now()) {
+		t.Fatalf("unexpected push time %v", pushedAt)
+	}
+
+	if err := tags.Tag(ctx, "latest", desc); err != nil {
+		t.Fatal(err)
+	}
+	repushedAt, err := provider.PushTime(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !repushedAt.After(pushedAt) {
+		t.Fatalf("push time %v not updated by pushing the tag again at %v", pushedAt, repushedAt)
+	}
+
+	// A tag pushed before push times were recorded is given the
+	// modification time of its current link, which is then recorded.
+	pushTimePath, err := pathFor(manifestTagPushTimePathSpec{name: "a/b", tag: "latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, pushTimePath); err != nil {
+		t.Fatal(err)
+	}
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{name: "a/b", tag: "latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := d.Stat(ctx, currentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushedAt, err = provider.PushTime(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pushedAt.Equal(fi.ModTime()) {
+		t.Fatalf("push time %v, expected the link modification time %v", pushedAt, fi.ModTime())
+	}
+	if _, err := d.GetContent(ctx, pushTimePath); err != nil {
+		t.Fatalf("push time not recorded: %v", err)
+	}
+}
+
 func TestTagLookup(t *testing.T) {
 	env := testTagStore(t)
 	tagStore := env.ts
@@ -314,3 +434,87 @@ func digestMap(dgsts []digest.Digest) map[digest.Digest]struct{} {
 	}
 	return set
 }
+
+// slowTagDriver delays the return of the writes to tags, so that concurrent
+// writes to a tag interleave.
+type slowTagDriver struct {
+	driver.StorageDriver
+}
+
+func (d *slowTagDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	err := d.StorageDriver.PutContent(ctx, path, content)
+	if strings.Contains(path, "/_manifests/tags/") {
+		time.Sleep(time.Millisecond)
+	}
+	return err
+}
+
+func TestTagStoreSerializedWrites(t *testing.T) {
+	ctx := context.Background()
+	d := &slowTagDriver{StorageDriver: inmemory.New()}
+	reg, err := NewRegistry(ctx, d, SerializeTagWrites)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoRef, _ := reference.WithName("a/b")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := repo.Tags(ctx)
+
+	// checkConsistent checks the tag, if it exists, is in its index and has
+	// a push time.
+	checkConsistent := func(round int) (distribution.Descriptor, bool) {
+		desc, err := tags.Get(ctx, "latest")
+		if _, ok := err.(distribution.ErrTagUnknown); ok {
+			return desc, false
+		}
+		if err != nil {
+			t.Fatalf("round %d: unexpected error getting tag: %v", round, err)
+		}
+		indexPath, err := pathFor(manifestTagIndexEntryLinkPathSpec{name: "a/b", tag: "latest", revision: desc.Digest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Stat(ctx, indexPath); err != nil {
+			t.Fatalf("round %d: tag points to %s, which is not in its index: %v", round, desc.Digest, err)
+		}
+		pushTimePath, err := pathFor(manifestTagPushTimePathSpec{name: "a/b", tag: "latest"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Stat(ctx, pushTimePath); err != nil {
+			t.Fatalf("round %d: tag has no push time: %v", round, err)
+		}
+		return desc, true
+	}
+
+	const writers = 8
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		digests := make(map[digest.Digest]struct{})
+		for i := 0; i < writers; i++ {
+			dgst := digest.FromString(fmt.Sprintf("manifest %d %d", round, i))
+			digests[dgst] = struct{}{}
+			wg.Add(1)
+			go func(i int, dgst digest.Digest) {
+				defer wg.Done()
+				if i%2 == 0 {
+					// The tag may already be deleted.
+					tags.Untag(ctx, "latest")
+					return
+				}
+				if err := tags.Tag(ctx, "latest", distribution.Descriptor{Digest: dgst}); err != nil {
+					t.Errorf("unexpected error tagging: %v", err)
+				}
+			}(i, dgst)
+		}
+		wg.Wait()
+		if desc, ok := checkConsistent(round); ok {
+			if _, ok := digests[desc.Digest]; !ok {
+				t.Fatalf("round %d: tag points to %s, which was not written", round, desc.Digest)
+			}
+		}
+	}
+}
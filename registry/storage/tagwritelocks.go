@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// tagWriteLocks serializes the writes to each tag within the process, so
+// that the index, current and push time links of a tag are written as a
+// whole and the last writer wins. Tags are spread across the locks by
+// repository and tag name, so unrelated tags may share a lock. Registries
+// writing to the same storage are not serialized with one another.
+type tagWriteLocks struct {
+	locks [256]sync.Mutex
+}
+
+func (tl *tagWriteLocks) lock(name, tag string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(tag))
+	return &tl.locks[h.Sum32()%uint32(len(tl.locks))]
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sort"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// UploadInfo describes an in-progress blob upload.
+type UploadInfo struct {
+	// ID is the identifier of the upload.
+	ID string
+
+	// Offset is the number of bytes received so far.
+	Offset int64
+
+	// StartedAt is the time the upload was started.
+	StartedAt time.Time
+
+	// LastModified is the time data was last written to the upload. It is
+	// the start time if no data has been written yet.
+	LastModified time.Time
+}
+
+// ListUploads returns the in-progress blob uploads of the named repository,
+// ordered by start time, as found in the upload directory. Uploads without a
+// readable start time, such as those being created or cancelled, are
+// skipped, and so are those with a malformed one, which are logged.
+func ListUploads(ctx context.Context, driver storagedriver.StorageDriver, name string) ([]UploadInfo, error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := driver.List(ctx, path.Join(root, name, "_uploads"))
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var uploads []UploadInfo
+	for _, child := range children {
+		info, err := uploadInfo(ctx, driver, name, path.Base(child))
+		if err != nil {
+			switch err := err.(type) {
+			case storagedriver.PathNotFoundError:
+				continue
+			case *time.ParseError:
+				dcontext.GetLogger(ctx).Warnf("skipping upload %s of %s with a malformed start time: %v", info.ID, name, err)
+				continue
+			}
+			return nil, err
+		}
+		uploads = append(uploads, info)
+	}
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].StartedAt.Before(uploads[j].StartedAt)
+	})
+
+	return uploads, nil
+}
+
+// uploadInfo reads the state of the upload with the given id from the
+// upload store.
+func uploadInfo(ctx context.Context, driver storagedriver.StorageDriver, name, id string) (UploadInfo, error) {
+	info := UploadInfo{ID: id}
+
+	startedAtPath, err := pathFor(uploadStartedAtPathSpec{name: name, id: id})
+	if err != nil {
+		return info, err
+	}
+	startedAtBytes, err := driver.GetContent(ctx, startedAtPath)
+	if err != nil {
+		return info, err
+	}
+	info.StartedAt, err = time.Parse(time.RFC3339, string(startedAtBytes))
+	if err != nil {
+		return info, err
+	}
+	info.LastModified = info.StartedAt
+
+	dataPath, err := pathFor(uploadDataPathSpec{name: name, id: id})
+	if err != nil {
+		return info, err
+	}
+	fi, err := driver.Stat(ctx, dataPath)
+	switch err.(type) {
+	case nil:
+		info.Offset = fi.Size()
+		if fi.ModTime().After(info.LastModified) {
+			info.LastModified = fi.ModTime()
+		}
+	case storagedriver.PathNotFoundError:
+	default:
+		return info, err
+	}
+
+	// Data held until the minimum chunk size is reached was received too.
+	pendingPath, err := pathFor(uploadPendingPathSpec{name: name, id: id})
+	if err != nil {
+		return info, err
+	}
+	fi, err = driver.Stat(ctx, pendingPath)
+	switch err.(type) {
+	case nil:
+		info.Offset += fi.Size()
+		if fi.ModTime().After(info.LastModified) {
+			info.LastModified = fi.ModTime()
+		}
+	case storagedriver.PathNotFoundError:
+	default:
+		return info, err
+	}
+
+	return info, nil
+}
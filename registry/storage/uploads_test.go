@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestListUploads(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "foo/uploads")
+
+	uploads, err := ListUploads(ctx, d, "foo/uploads")
+	if err != nil {
+		t.Fatalf("unexpected error listing uploads of a new repository: %v", err)
+	}
+	if len(uploads) != 0 {
+		t.Fatalf("expected no uploads, got %v", uploads)
+	}
+
+	before := time.Now().UTC().Truncate(time.Second)
+	offsets := map[string]int64{}
+	for _, size := range []int{0, 128} {
+		bw, err := repo.Blobs(ctx).Create(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error creating upload: %v", err)
+		}
+		if _, err := bw.Write(bytes.Repeat([]byte("a"), size)); err != nil {
+			t.Fatalf("unexpected error writing upload: %v", err)
+		}
+		if err := bw.Close(); err != nil {
+			t.Fatalf("unexpected error closing upload: %v", err)
+		}
+		offsets[bw.ID()] = int64(size)
+	}
+	after := time.Now().UTC()
+
+	uploads, err = ListUploads(ctx, d, "foo/uploads")
+	if err != nil {
+		t.Fatalf("unexpected error listing uploads: %v", err)
+	}
+	if len(uploads) != len(offsets) {
+		t.Fatalf("expected %d uploads, got %v", len(offsets), uploads)
+	}
+
+	for _, upload := range uploads {
+		offset, ok := offsets[upload.ID]
+		if !ok {
+			t.Fatalf("unexpected upload %s", upload.ID)
+		}
+		if upload.Offset != offset {
+			t.Errorf("upload %s: expected offset %d, got %d", upload.ID, offset, upload.Offset)
+		}
+		if upload.StartedAt.Before(before) || upload.StartedAt.After(after) {
+			t.Errorf("upload %s: start time %v outside of [%v, %v]", upload.ID, upload.StartedAt, before, after)
+		}
+		if upload.LastModified.Before(upload.StartedAt) || upload.LastModified.After(after) {
+			t.Errorf("upload %s: last modified time %v outside of [%v, %v]", upload.ID, upload.LastModified, upload.StartedAt, after)
+		}
+	}
+}
+
+func TestListUploadsMalformedStartedAt(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "foo/uploads")
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		bw, err := repo.Blobs(ctx).Create(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error creating upload: %v", err)
+		}
+		if err := bw.Close(); err != nil {
+			t.Fatalf("unexpected error closing upload: %v", err)
+		}
+		ids = append(ids, bw.ID())
+	}
+
+	startedAtPath, err := pathFor(uploadStartedAtPathSpec{name: "foo/uploads", id: ids[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, startedAtPath, []byte("not a time")); err != nil {
+		t.Fatalf("unexpected error corrupting start time: %v", err)
+	}
+
+	uploads, err := ListUploads(ctx, d, "foo/uploads")
+	if err != nil {
+		t.Fatalf("unexpected error listing uploads: %v", err)
+	}
+	if len(uploads) != 1 || uploads[0].ID != ids[1] {
+		t.Fatalf("expected only upload %s to be listed, got %v", ids[1], uploads)
+	}
+}
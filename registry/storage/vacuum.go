@@ -81,7 +81,21 @@ func (v Vacuum) RemoveManifest(name string, dgst digest.Digest, tags []string) e
 		return err
 	}
 	dcontext.GetLogger(v.ctx).Infof("deleting manifest: %s", manifestPath)
-	return v.driver.Delete(v.ctx, manifestPath)
+	if err := v.driver.Delete(v.ctx, manifestPath); err != nil {
+		return err
+	}
+
+	// remove the links to the referrers of the manifest, which are swept
+	// along with it unless they are tagged
+	referrersPath, err := pathFor(manifestReferrersPathSpec{name: name, subject: dgst})
+	if err != nil {
+		return err
+	}
+	err = v.driver.Delete(v.ctx, referrersPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
 }
 
 // RemoveRepository removes a repository directory from the
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+)
+
+var (
+	verificationChecksWaiting = prometheus.StorageNamespace.NewGauge("manifest_verification_checks_waiting", "The number of blob checks of manifest verifications waiting for the concurrency limit", "")
+	verificationCheckWait     = prometheus.StorageNamespace.NewTimer("manifest_verification_check_wait", "The number of seconds blob checks of manifest verifications waited for the concurrency limit")
+)
+
+// verificationLimiter bounds the number of blob checks of manifest
+// verifications run concurrently across the registry, so that bursts of
+// pushes queue rather than overwhelm the storage backend. A check holds its
+// slot only while it runs, so a verification needing more checks than the
+// limit cannot deadlock. A nil limiter does not limit checks.
+type verificationLimiter chan struct{}
+
+// ManifestVerificationConcurrency returns a functional option for
+// NewRegistry. It limits the blob checks of pushed manifests, such as those
+// verifying that the layers they reference exist, to n at a time across the
+// registry. Checks are not limited if n is zero.
+func ManifestVerificationConcurrency(n int) RegistryOption {
+	return func(registry *registry) error {
+		if n < 0 {
+			return fmt.Errorf("manifest verification concurrency must not be negative, %d invalid", n)
+		}
+		if n > 0 {
+			registry.verificationLimiter = make(verificationLimiter, n)
+		}
+		return nil
+	}
+}
+
+// acquire waits for a slot to run a check in, unless ctx is done first.
+func (l verificationLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	default:
+	}
+
+	verificationChecksWaiting.Inc(1)
+	defer verificationChecksWaiting.Dec(1)
+	defer verificationCheckWait.UpdateSince(time.Now())
+
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of a check which has run.
+func (l verificationLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// concurrencyDriver records the most layer links read at once, holding each
+// read for a while so that concurrent verifications overlap.
+type concurrencyDriver struct {
+	storagedriver.StorageDriver
+
+	mu       sync.Mutex
+	reading  int
+	maxReads int
+}
+
+func (d *concurrencyDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if !strings.Contains(path, "/_layers/") {
+		return d.StorageDriver.GetContent(ctx, path)
+	}
+
+	d.mu.Lock()
+	d.reading++
+	if d.reading > d.maxReads {
+		d.maxReads = d.reading
+	}
+	d.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	defer func() {
+		d.mu.Lock()
+		d.reading--
+		d.mu.Unlock()
+	}()
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func TestManifestVerificationConcurrency(t *testing.T) {
+	const limit, layers, pushes = 2, 4, 16
+
+	ctx := context.Background()
+	d := &concurrencyDriver{StorageDriver: inmemory.New()}
+	registry := createRegistry(t, d, ManifestVerificationConcurrency(limit))
+	repo := makeRepository(t, registry, "test")
+
+	var descriptors []distribution.Descriptor
+	for i := 0; i < layers; i++ {
+		desc, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte(fmt.Sprint("layer ", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc.MediaType = v1.MediaTypeImageLayer
+		descriptors = append(descriptors, desc)
+	}
+
+	// Each verification needs more checks than the limit, which must not
+	// deadlock it.
+	var wg sync.WaitGroup
+	errs := make(chan error, pushes)
+	for i := 0; i < pushes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dm, err := ocischema.FromStruct(ocischema.Manifest{
+				Versioned: manifest.Versioned{
+					SchemaVersion: 2,
+					MediaType:     v1.MediaTypeImageManifest,
+				},
+				Config:      ocischema.DescriptorEmptyJSON,
+				Layers:      descriptors,
+				Annotations: map[string]string{"com.example.push": fmt.Sprint(i)},
+			})
+			if err != nil {
+				errs <- err
+				return
+			}
+			manifests, err := repo.Manifests(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = manifests.Put(ctx, dm)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error pushing manifest: %v", err)
+		}
+	}
+	if d.maxReads == 0 || d.maxReads > limit {
+		t.Fatalf("%d blob checks ran at once, expected at most %d", d.maxReads, limit)
+	}
+}
+
+func TestManifestVerificationConcurrencyCanceled(t *testing.T) {
+	limiter := make(verificationLimiter, 1)
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected waiting for a slot to end with the context, got %v", err)
+	}
+
+	limiter.release()
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifestVerificationConcurrencyInvalid(t *testing.T) {
+	if _, err := NewRegistry(context.Background(), inmemory.New(), ManifestVerificationConcurrency(-1)); err == nil {
+		t.Fatal("expected an error limiting verifications to a negative concurrency")
+	}
+}
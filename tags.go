@@ -2,6 +2,7 @@ package distribution
 
 import (
 	"context"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 )
@@ -35,3 +36,19 @@ type TagManifestsProvider interface {
 	// includes currently linked digest. There is no ordering guaranteed
 	ManifestDigests(ctx context.Context, tag string) ([]digest.Digest, error)
 }
+
+// TagChecker is implemented by tag services able to tell whether a
+// repository has any tag without enumerating them.
+type TagChecker interface {
+	// HasTags returns whether the repository has at least one tag. It
+	// returns ErrRepositoryUnknown if the repository was never tagged.
+	HasTags(ctx context.Context) (bool, error)
+}
+
+// TagPushTimeProvider is implemented by tag services recording the time each
+// tag was last pushed.
+type TagPushTimeProvider interface {
+	// PushTime returns the time the tag was last pushed. It returns
+	// ErrTagUnknown if the tag does not exist.
+	PushTime(ctx context.Context, tag string) (time.Time, error)
+}